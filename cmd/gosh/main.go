@@ -12,6 +12,7 @@ import (
 	"strings"
 
 	"golang.org/x/crypto/ssh/terminal"
+	"golang.org/x/xerrors"
 
 	"mvdan.cc/sh/v3/interp"
 	"mvdan.cc/sh/v3/syntax"
@@ -22,6 +23,16 @@ var command = flag.String("c", "", "command to be executed")
 func main() {
 	flag.Parse()
 	err := runAll()
+	var errexit *interp.ErrexitError
+	if xerrors.As(err, &errexit) {
+		// unlike an explicit exit, this is likely unexpected
+		if errexit.Cmd != "" {
+			fmt.Fprintf(os.Stderr, "%s: %q failed with errexit set\n", errexit.Pos, errexit.Cmd)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: assignment failed with errexit set\n", errexit.Pos)
+		}
+		os.Exit(int(errexit.Status))
+	}
 	if e, ok := interp.IsExitStatus(err); ok {
 		os.Exit(int(e))
 	}
@@ -32,7 +43,17 @@ func main() {
 }
 
 func runAll() error {
-	r, err := interp.New(interp.StdIO(os.Stdin, os.Stdout, os.Stderr))
+	// Like other shells, the arguments after a command or script are its
+	// parameters. With a command, the first of them is $0.
+	args := flag.Args()
+	opts := []interp.RunnerOption{interp.StdIO(os.Stdin, os.Stdout, os.Stderr)}
+	if *command != "" && len(args) > 0 {
+		opts = append(opts, interp.ShellName(args[0]))
+	}
+	if len(args) > 0 {
+		opts = append(opts, interp.Params(append([]string{"--"}, args[1:]...)...))
+	}
+	r, err := interp.New(opts...)
 	if err != nil {
 		return err
 	}
@@ -40,18 +61,13 @@ func runAll() error {
 	if *command != "" {
 		return run(r, strings.NewReader(*command), "")
 	}
-	if flag.NArg() == 0 {
+	if len(args) == 0 {
 		if terminal.IsTerminal(int(os.Stdin.Fd())) {
 			return runInteractive(r, os.Stdin, os.Stdout, os.Stderr)
 		}
 		return run(r, os.Stdin, "")
 	}
-	for _, path := range flag.Args() {
-		if err := runPath(r, path); err != nil {
-			return err
-		}
-	}
-	return nil
+	return runPath(r, args[0])
 }
 
 func run(r *interp.Runner, reader io.Reader, name string) error {
@@ -75,11 +91,11 @@ func runPath(r *interp.Runner, path string) error {
 
 func runInteractive(r *interp.Runner, stdin io.Reader, stdout, stderr io.Writer) error {
 	parser := syntax.NewParser()
-	fmt.Fprintf(stdout, "$ ")
+	fmt.Fprint(stdout, prompt(r, "PS1", "$ "))
 	var runErr error
 	fn := func(stmts []*syntax.Stmt) bool {
 		if parser.Incomplete() {
-			fmt.Fprintf(stdout, "> ")
+			fmt.Fprint(stdout, prompt(r, "PS2", "> "))
 			return true
 		}
 		ctx := context.Background()
@@ -89,7 +105,7 @@ func runInteractive(r *interp.Runner, stdin io.Reader, stdout, stderr io.Writer)
 				return false
 			}
 		}
-		fmt.Fprintf(stdout, "$ ")
+		fmt.Fprint(stdout, prompt(r, "PS1", "$ "))
 		return true
 	}
 	if err := parser.Interactive(stdin, fn); err != nil {
@@ -97,3 +113,16 @@ func runInteractive(r *interp.Runner, stdin io.Reader, stdout, stderr io.Writer)
 	}
 	return runErr
 }
+
+// prompt returns the expanded value of a prompt variable such as $PS1, or def
+// if it is unset.
+func prompt(r *interp.Runner, name, def string) string {
+	vr, ok := r.Vars[name]
+	if !ok && r.Env != nil {
+		vr = r.Env.Get(name)
+	}
+	if !vr.IsSet() {
+		return def
+	}
+	return interp.ExpandPrompt(r, vr.String())
+}
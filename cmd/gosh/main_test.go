@@ -139,6 +139,16 @@ var interactiveTests = []struct {
 			"你好\n$ ",
 		},
 	},
+	{
+		pairs: []string{
+			"PS1='$((1 + 2))> '; PS2='\\\\ '\n",
+			"3> ",
+			"echo 'foo\n",
+			"\\ ",
+			"bar'\n",
+			"foo\nbar\n3> ",
+		},
+	},
 	{
 		pairs: []string{
 			"echo foo; exit 0; echo bar\n",
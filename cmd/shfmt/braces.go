@@ -0,0 +1,82 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import "mvdan.cc/sh/v3/syntax"
+
+// expandAllBraces replaces the words with brace expansions in f by the words
+// they expand to, as done by -expand-braces. Only the words which undergo
+// brace expansion are changed: the arguments of simple commands, the words of
+// for loops, and the values of array elements without an index.
+func expandAllBraces(f *syntax.File) {
+	syntax.Walk(f, func(node syntax.Node) bool {
+		switch x := node.(type) {
+		case *syntax.CallExpr:
+			x.Args = expandWords(x.Args)
+		case *syntax.WordIter:
+			x.Items = expandWords(x.Items)
+		case *syntax.ArrayExpr:
+			var elems []*syntax.ArrayElem
+			for _, elem := range x.Elems {
+				if elem.Index != nil || elem.Value == nil {
+					elems = append(elems, elem)
+					continue
+				}
+				for i, w := range expandWords([]*syntax.Word{elem.Value}) {
+					elem2 := &syntax.ArrayElem{Value: w}
+					if i == 0 {
+						elem2.Comments = elem.Comments
+					}
+					elems = append(elems, elem2)
+				}
+			}
+			x.Elems = elems
+		}
+		return true
+	})
+}
+
+// expandWords returns words with their brace expansions expanded. Words which
+// expand to nothing are dropped, like the shell does, unless none are left.
+// Words without any brace expansions are kept as they are.
+func expandWords(words []*syntax.Word) []*syntax.Word {
+	var expanded []*syntax.Word
+	for _, w := range words {
+		split := *w
+		if !syntax.SplitBraces(&split) {
+			expanded = append(expanded, w)
+			continue
+		}
+		for _, w2 := range syntax.ExpandBraces(w) {
+			if len(w2.Parts) > 0 {
+				expanded = append(expanded, positionLits(w2, w))
+			}
+		}
+	}
+	if len(expanded) == 0 {
+		return words
+	}
+	return expanded
+}
+
+// positionLits gives the literals in w2, a word expanded from w, the positions
+// of w if they have none, such as braces which aren't part of an expansion.
+// Otherwise, the printer can't tell which line they are on.
+func positionLits(w2, w *syntax.Word) *syntax.Word {
+	for i, part := range w2.Parts {
+		lit, ok := part.(*syntax.Lit)
+		if !ok || (lit.ValuePos.IsValid() && lit.ValueEnd.IsValid()) {
+			continue
+		}
+		lit2 := *lit // the literal may be shared
+		if !lit2.ValuePos.IsValid() {
+			lit2.ValuePos = w.Pos()
+		}
+		if !lit2.ValueEnd.IsValid() {
+			lit2.ValueEnd = w.End()
+		}
+		w2.Parts[i] = &lit2
+	}
+	return w2
+}
@@ -0,0 +1,236 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// diagnostic is a finding reported via -format, either a file whose
+// formatting differs or one which failed to parse.
+type diagnostic struct {
+	Path    string `json:"path"`
+	Line    uint   `json:"line"`
+	Col     uint   `json:"col"`
+	Rule    string `json:"rule"` // "format" or "parse"
+	Message string `json:"message"`
+}
+
+func (d *diagnostic) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", d.Path, d.Line, d.Col, d.Message)
+}
+
+// diagnosticRules describes the kinds of diagnostics, by their Rule.
+var diagnosticRules = []struct{ id, level, desc string }{
+	{"format", "warning", "the formatting of the file differs from shfmt's"},
+	{"parse", "error", "the file failed to parse"},
+}
+
+func diagnosticLevel(rule string) string {
+	for _, r := range diagnosticRules {
+		if r.id == rule {
+			return r.level
+		}
+	}
+	return "error"
+}
+
+// formatDiagnostic reports where the formatting of src first differs from res,
+// its formatted version.
+func formatDiagnostic(src, res []byte, path string) *diagnostic {
+	i := 0
+	for i < len(src) && i < len(res) && src[i] == res[i] {
+		i++
+	}
+	line := uint(bytes.Count(src[:i], []byte("\n")) + 1)
+	col := uint(i - bytes.LastIndexByte(src[:i], '\n'))
+	return &diagnostic{
+		Path:    path,
+		Line:    line,
+		Col:     col,
+		Rule:    "format",
+		Message: "formatting differs from shfmt's",
+	}
+}
+
+// parseDiagnostic returns the diagnostic for a parse error, or nil if err
+// isn't one; see isParseError.
+func parseDiagnostic(err error) *diagnostic {
+	d := &diagnostic{Rule: "parse"}
+	switch err := err.(type) {
+	case syntax.ParseError:
+		d.Path, d.Line, d.Col, d.Message = err.Filename, err.Pos.Line(), err.Pos.Col(), err.Text
+	case suggestedParseError:
+		d = parseDiagnostic(err.ParseError)
+		d.Message += "\n" + err.guess
+	case syntax.LangError:
+		d.Path, d.Line, d.Col = err.Filename, err.Pos.Line(), err.Pos.Col()
+		// Drop the "path:line:col: " prefix.
+		err.Filename = ""
+		d.Message = strings.TrimPrefix(err.Error(), err.Pos.String()+": ")
+	default:
+		return nil
+	}
+	return d
+}
+
+// diagnosticWriter writes diagnostics in the format given via -format. JSON
+// records are written one per line as they are found, while the formats which
+// are a single document are written by finish.
+type diagnosticWriter struct {
+	w      io.Writer
+	format string
+	diags  []*diagnostic
+}
+
+// diags is where diagnostics are reported, if -format asks for them.
+var diags *diagnosticWriter
+
+func (dw *diagnosticWriter) add(d *diagnostic) error {
+	if dw.format == "json" {
+		return json.NewEncoder(dw.w).Encode(d)
+	}
+	dw.diags = append(dw.diags, d)
+	return nil
+}
+
+func (dw *diagnosticWriter) finish() error {
+	switch dw.format {
+	case "checkstyle":
+		return dw.writeCheckstyle()
+	case "sarif":
+		return dw.writeSARIF()
+	}
+	return nil
+}
+
+// writeCheckstyle writes the diagnostics as a Checkstyle XML report, with the
+// errors grouped by file in the order they were found.
+func (dw *diagnosticWriter) writeCheckstyle() error {
+	type csError struct {
+		Line     uint   `xml:"line,attr"`
+		Column   uint   `xml:"column,attr"`
+		Severity string `xml:"severity,attr"`
+		Message  string `xml:"message,attr"`
+		Source   string `xml:"source,attr"`
+	}
+	type csFile struct {
+		Name   string    `xml:"name,attr"`
+		Errors []csError `xml:"error"`
+	}
+	type csReport struct {
+		XMLName xml.Name  `xml:"checkstyle"`
+		Version string    `xml:"version,attr"`
+		Files   []*csFile `xml:"file"`
+	}
+	report := csReport{Version: "4.3"}
+	byPath := make(map[string]*csFile)
+	for _, d := range dw.diags {
+		f := byPath[d.Path]
+		if f == nil {
+			f = &csFile{Name: d.Path}
+			byPath[d.Path] = f
+			report.Files = append(report.Files, f)
+		}
+		f.Errors = append(f.Errors, csError{
+			Line:     d.Line,
+			Column:   d.Col,
+			Severity: diagnosticLevel(d.Rule),
+			Message:  d.Message,
+			Source:   "shfmt." + d.Rule,
+		})
+	}
+	if _, err := io.WriteString(dw.w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(dw.w)
+	enc.Indent("", "\t")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(dw.w, "\n")
+	return err
+}
+
+// writeSARIF writes the diagnostics as a SARIF 2.1.0 log with a single run.
+func (dw *diagnosticWriter) writeSARIF() error {
+	type text struct {
+		Text string `json:"text"`
+	}
+	type rule struct {
+		ID               string `json:"id"`
+		ShortDescription text   `json:"shortDescription"`
+	}
+	type region struct {
+		StartLine   uint `json:"startLine"`
+		StartColumn uint `json:"startColumn"`
+	}
+	type location struct {
+		PhysicalLocation struct {
+			ArtifactLocation struct {
+				URI string `json:"uri"`
+			} `json:"artifactLocation"`
+			Region region `json:"region"`
+		} `json:"physicalLocation"`
+	}
+	type result struct {
+		RuleID    string     `json:"ruleId"`
+		Level     string     `json:"level"`
+		Message   text       `json:"message"`
+		Locations []location `json:"locations"`
+	}
+	type driver struct {
+		Name           string `json:"name"`
+		Version        string `json:"version"`
+		InformationURI string `json:"informationUri"`
+		Rules          []rule `json:"rules"`
+	}
+	type run struct {
+		Tool struct {
+			Driver driver `json:"driver"`
+		} `json:"tool"`
+		Results []result `json:"results"`
+	}
+	var r run
+	r.Tool.Driver = driver{
+		Name:           "shfmt",
+		Version:        version,
+		InformationURI: "https://github.com/mvdan/sh",
+	}
+	for _, dr := range diagnosticRules {
+		r.Tool.Driver.Rules = append(r.Tool.Driver.Rules, rule{dr.id, text{dr.desc}})
+	}
+	r.Results = []result{} // never null
+	for _, d := range dw.diags {
+		var loc location
+		loc.PhysicalLocation.ArtifactLocation.URI = (&url.URL{Path: filepath.ToSlash(d.Path)}).String()
+		loc.PhysicalLocation.Region = region{d.Line, d.Col}
+		r.Results = append(r.Results, result{
+			RuleID:    d.Rule,
+			Level:     diagnosticLevel(d.Rule),
+			Message:   text{d.Message},
+			Locations: []location{loc},
+		})
+	}
+	enc := json.NewEncoder(dw.w)
+	enc.SetIndent("", "\t")
+	return enc.Encode(struct {
+		Schema  string `json:"$schema"`
+		Version string `json:"version"`
+		Runs    []run  `json:"runs"`
+	}{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []run{r},
+	})
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"fmt"
+	"sort"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// directiveWarnings returns warnings about the "# shfmt:off" and "# shfmt:on"
+// comments in a file which don't come in pairs, or which are ignored by the
+// printer since they are not on their own line before a statement.
+//
+// Like the printer, it looks for pairs of directives within each list of
+// statements, such as the body of a function.
+func directiveWarnings(f *syntax.File, path string) []string {
+	type warning struct {
+		pos syntax.Pos
+		msg string
+	}
+	var warns []warning
+	warnf := func(pos syntax.Pos, format string, a ...interface{}) {
+		warns = append(warns, warning{pos, fmt.Sprintf(format, a...)})
+	}
+	used := make(map[syntax.Pos]bool)
+	check := func(stmts []*syntax.Stmt, last []syntax.Comment, scope string) {
+		var offPos syntax.Pos
+		visit := func(c syntax.Comment) {
+			switch syntax.FmtDirective(c) {
+			case "off":
+				if offPos.IsValid() {
+					warnf(c.Pos(), "formatting is already off since line %d", offPos.Line())
+				} else {
+					offPos = c.Pos()
+				}
+			case "on":
+				if !offPos.IsValid() {
+					warnf(c.Pos(), "formatting is not off")
+				}
+				offPos = syntax.Pos{}
+			default:
+				return
+			}
+			used[c.Pos()] = true
+		}
+		for _, s := range stmts {
+			for _, c := range s.Comments {
+				if c.Pos().After(s.Pos()) {
+					break
+				}
+				visit(c)
+			}
+		}
+		for _, c := range last {
+			visit(c)
+		}
+		if offPos.IsValid() {
+			warnf(offPos, "no matching \"# shfmt:on\"; formatting is off until the end of the %s", scope)
+		}
+	}
+	walkStmtLists(f, check)
+	syntax.Walk(f, func(node syntax.Node) bool {
+		if c, ok := node.(*syntax.Comment); ok && syntax.FmtDirective(*c) != "" && !used[c.Pos()] {
+			warnf(c.Pos(), "directive ignored; it must be on its own line before a statement")
+		}
+		return true
+	})
+	sort.SliceStable(warns, func(i, j int) bool {
+		return warns[i].pos.Offset() < warns[j].pos.Offset()
+	})
+	prefix := ""
+	if path != "" {
+		prefix = path + ":"
+	}
+	lines := make([]string, len(warns))
+	for i, w := range warns {
+		lines[i] = fmt.Sprintf("%s%s: warning: %s", prefix, w.pos, w.msg)
+	}
+	return lines
+}
+
+// walkStmtLists calls fn for each list of statements in a file, along with the
+// comments after its last statement and a name for the kind of list.
+func walkStmtLists(f *syntax.File, fn func(stmts []*syntax.Stmt, last []syntax.Comment, scope string)) {
+	syntax.Walk(f, func(node syntax.Node) bool {
+		switch x := node.(type) {
+		case *syntax.File:
+			fn(x.Stmts, x.Last, "file")
+		case *syntax.Block:
+			fn(x.Stmts, x.Last, "block")
+		case *syntax.Subshell:
+			fn(x.Stmts, x.Last, "subshell")
+		case *syntax.CmdSubst:
+			fn(x.Stmts, x.Last, "command substitution")
+		case *syntax.ProcSubst:
+			fn(x.Stmts, x.Last, "process substitution")
+		case *syntax.IfClause:
+			fn(x.Cond, x.CondLast, "condition")
+			fn(x.Then, x.ThenLast, "block")
+		case *syntax.WhileClause:
+			fn(x.Cond, x.CondLast, "condition")
+			fn(x.Do, x.DoLast, "block")
+		case *syntax.ForClause:
+			fn(x.Do, x.DoLast, "block")
+		case *syntax.CaseItem:
+			fn(x.Stmts, x.Last, "case item")
+		}
+		return true
+	})
+}
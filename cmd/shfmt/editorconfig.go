@@ -0,0 +1,388 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// editorConfigFlags are the flags which can be set by EditorConfig files, with
+// the properties which set them. See editorConfigValues.
+var editorConfigFlags = []struct{ flag, property string }{
+	{"ln", "shell_variant"},
+	{"i", "indent_size"},
+	{"bn", "binary_next_line"},
+	{"ci", "switch_case_indent"},
+	{"sr", "space_redirects"},
+	{"kp", "keep_padding"},
+}
+
+var (
+	// cmdLineFlags are the flags given on the command line, either
+	// directly or via -style, which EditorConfig files can't override.
+	cmdLineFlags map[string]bool
+
+	// editorConfigBase holds the values of editorConfigFlags before any
+	// EditorConfig file was applied, so that they can be restored for
+	// files which don't set them. It is nil until a file sets any.
+	editorConfigBase map[string]string
+
+	// editorConfigs caches the .editorconfig file in each directory, or nil
+	// if there is none.
+	editorConfigs = make(map[string]*editorConfig)
+)
+
+// applyEditorConfig sets the flags from the EditorConfig files which apply to
+// the file at path, and sets up the parser and printer again if any of them
+// changed. Flags in cmdLineFlags are left alone. An empty path, for input which
+// isn't a file, restores the flags as if no EditorConfig files applied.
+func applyEditorConfig(path string) error {
+	props := make(map[string]string)
+	if path != "" {
+		var err error
+		if props, err = editorConfigProps(path); err != nil {
+			return err
+		}
+	}
+	values, err := editorConfigValues(props)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if editorConfigBase == nil {
+		if len(values) == 0 {
+			return nil
+		}
+		editorConfigBase = make(map[string]string)
+		for _, ef := range editorConfigFlags {
+			editorConfigBase[ef.flag] = flag.Lookup(ef.flag).Value.String()
+		}
+	}
+	changed := false
+	for _, ef := range editorConfigFlags {
+		value, ok := values[ef.flag]
+		if !ok || cmdLineFlags[ef.flag] {
+			value = editorConfigBase[ef.flag]
+		}
+		f := flag.Lookup(ef.flag)
+		if f.Value.String() != value {
+			f.Value.Set(value)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	if _, err := configure(); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// editorConfigValues returns the flag values corresponding to a set of
+// EditorConfig properties, by flag name.
+//
+// indent_style=tab means indenting with tabs, and indent_style=space with
+// indent_size spaces, or 8 if it's not set. indent_size on its own also means
+// indenting with spaces. The other properties are named after the printer
+// options, like binary_next_line, and shell_variant selects the language.
+func editorConfigValues(props map[string]string) (map[string]string, error) {
+	values := make(map[string]string)
+	style, size := props["indent_style"], props["indent_size"]
+	switch {
+	case style == "tab":
+		values["i"] = "0"
+	case style == "space" || size != "":
+		if size == "" || size == "tab" {
+			size = "8"
+		}
+		n, err := strconv.ParseUint(size, 10, 0)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid EditorConfig indent_size: %q", size)
+		}
+		values["i"] = size
+	case style != "":
+		return nil, fmt.Errorf("invalid EditorConfig indent_style: %q", style)
+	}
+	for _, ef := range editorConfigFlags {
+		value, ok := props[ef.property]
+		if !ok {
+			continue
+		}
+		switch ef.flag {
+		case "i":
+		case "ln":
+			switch value {
+			case "bash", "posix", "mksh":
+				values[ef.flag] = value
+			default:
+				return nil, fmt.Errorf("invalid EditorConfig %s: %q", ef.property, value)
+			}
+		default:
+			if value != "true" && value != "false" {
+				return nil, fmt.Errorf("invalid EditorConfig %s: %q", ef.property, value)
+			}
+			values[ef.flag] = value
+		}
+	}
+	return values, nil
+}
+
+// editorConfig is a parsed .editorconfig file.
+type editorConfig struct {
+	// root is set by "root = true" before the first section, meaning that
+	// files in parent directories don't apply.
+	root bool
+
+	sections []editorConfigSection
+}
+
+type editorConfigSection struct {
+	glob  *editorConfigGlob
+	props [][2]string // key and value pairs, in order
+}
+
+// editorConfigProps returns the EditorConfig properties which apply to the
+// file at path, from the .editorconfig files in its directory and each of its
+// parents, up to one with "root = true". Closer files take precedence, as do
+// later sections within a file. Properties with the value "unset" are left out.
+//
+// Keys are lowercased, and so are values, as the properties used by shfmt are
+// case insensitive.
+func editorConfigProps(path string) (map[string]string, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	var confs []*editorConfig
+	for dir := filepath.Dir(abs); ; {
+		conf, err := loadEditorConfig(dir)
+		if err != nil {
+			return nil, err
+		}
+		if conf != nil {
+			dirs = append(dirs, dir)
+			confs = append(confs, conf)
+			if conf.root {
+				break
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			break
+		}
+		dir = parent
+	}
+	props := make(map[string]string)
+	for i := len(confs) - 1; i >= 0; i-- {
+		rel, err := filepath.Rel(dirs[i], abs)
+		if err != nil {
+			return nil, err
+		}
+		rel = filepath.ToSlash(rel)
+		for _, section := range confs[i].sections {
+			if !section.glob.match(rel) {
+				continue
+			}
+			for _, kv := range section.props {
+				props[kv[0]] = kv[1]
+			}
+		}
+	}
+	for key, value := range props {
+		if value == "unset" {
+			delete(props, key)
+		}
+	}
+	return props, nil
+}
+
+// loadEditorConfig returns the .editorconfig file in dir, which is only read
+// once. It returns nil if there is no such file.
+func loadEditorConfig(dir string) (*editorConfig, error) {
+	if conf, ok := editorConfigs[dir]; ok {
+		return conf, nil
+	}
+	path := filepath.Join(dir, ".editorconfig")
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		editorConfigs[dir] = nil
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	conf := &editorConfig{}
+	var section *editorConfigSection
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "", line[0] == '#', line[0] == ';':
+		case line[0] == '[' && line[len(line)-1] == ']':
+			glob, err := compileEditorConfigGlob(line[1 : len(line)-1])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+			conf.sections = append(conf.sections, editorConfigSection{glob: glob})
+			section = &conf.sections[len(conf.sections)-1]
+		default:
+			i := strings.IndexByte(line, '=')
+			if i < 0 {
+				continue // invalid lines are ignored
+			}
+			key := strings.ToLower(strings.TrimSpace(line[:i]))
+			value := strings.ToLower(strings.TrimSpace(line[i+1:]))
+			if section == nil {
+				if key == "root" {
+					conf.root = value == "true"
+				}
+				continue
+			}
+			section.props = append(section.props, [2]string{key, value})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	editorConfigs[dir] = conf
+	return conf, nil
+}
+
+// editorConfigGlob is a section glob, matched against paths relative to the
+// directory of its .editorconfig file.
+type editorConfigGlob struct {
+	rx *regexp.Regexp
+
+	// ranges are the numeric ranges like {1..3}, each matched by a
+	// capturing group of rx, in order.
+	ranges [][2]int64
+}
+
+func (g *editorConfigGlob) match(path string) bool {
+	m := g.rx.FindStringSubmatch(path)
+	if m == nil {
+		return false
+	}
+	for i, r := range g.ranges {
+		n, err := strconv.ParseInt(m[i+1], 10, 64)
+		if err != nil || n < r[0] || n > r[1] {
+			return false
+		}
+	}
+	return true
+}
+
+var editorConfigRange = regexp.MustCompile(`^([+-]?[0-9]+)\.\.([+-]?[0-9]+)$`)
+
+// compileEditorConfigGlob compiles a section glob, following the EditorConfig
+// rules: "*" matches any characters but slashes, "**" any characters, "?" any
+// single character but a slash, "[abc]" and "[!abc]" character classes,
+// "{a,b}" any of the comma-separated globs, and "{1..3}" integers in a range.
+// A glob without slashes matches files in any directory.
+func compileEditorConfigGlob(glob string) (*editorConfigGlob, error) {
+	g := &editorConfigGlob{}
+	var sb strings.Builder
+	sb.WriteString("^")
+	if strings.HasPrefix(glob, "/") {
+		glob = glob[1:]
+	} else if !strings.Contains(glob, "/") {
+		sb.WriteString("(?:.*/)?")
+	}
+	// closers holds the positions of the closing braces of the {a,b}
+	// alternations which are open.
+	var closers []int
+	for i := 0; i < len(glob); i++ {
+		c := glob[i]
+		switch {
+		case c == '\\' && i+1 < len(glob):
+			i++
+			sb.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		case c == '*' && i+1 < len(glob) && glob[i+1] == '*':
+			i++
+			sb.WriteString(".*")
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(glob[i+1:], ']')
+			if end < 0 || strings.Contains(glob[i+1:i+1+end], "/") {
+				sb.WriteString(`\[`)
+				break
+			}
+			class := glob[i+1 : i+1+end]
+			sb.WriteString("[")
+			if strings.HasPrefix(class, "!") {
+				sb.WriteString("^")
+				class = class[1:]
+			}
+			sb.WriteString(strings.Replace(class, `\`, `\\`, -1))
+			sb.WriteString("]")
+			i += 1 + end
+		case c == '{':
+			end := matchingBrace(glob, i)
+			if end < 0 {
+				sb.WriteString(`\{`)
+				break
+			}
+			inner := glob[i+1 : end]
+			if m := editorConfigRange.FindStringSubmatch(inner); m != nil {
+				lo, _ := strconv.ParseInt(m[1], 10, 64)
+				hi, _ := strconv.ParseInt(m[2], 10, 64)
+				g.ranges = append(g.ranges, [2]int64{lo, hi})
+				sb.WriteString("([+-]?[0-9]+)")
+				i = end
+				break
+			}
+			if !strings.Contains(inner, ",") {
+				sb.WriteString(`\{`)
+				break
+			}
+			closers = append(closers, end)
+			sb.WriteString("(?:")
+		case c == ',' && len(closers) > 0:
+			sb.WriteString("|")
+		case c == '}' && len(closers) > 0 && closers[len(closers)-1] == i:
+			closers = closers[:len(closers)-1]
+			sb.WriteString(")")
+		default:
+			sb.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	sb.WriteString("$")
+	rx, err := regexp.Compile(sb.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid section glob %q: %v", glob, err)
+	}
+	g.rx = rx
+	return g, nil
+}
+
+// matchingBrace returns the position of the brace closing the one at i in a
+// glob, or -1 if there is none.
+func matchingBrace(glob string, i int) int {
+	depth := 0
+	for ; i < len(glob); i++ {
+		switch glob[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
@@ -0,0 +1,43 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+)
+
+var dropBOM = flag.Bool("drop-bom", false, "")
+
+var utf8BOM = []byte("\xef\xbb\xbf")
+
+// splitBOM splits the UTF-8 byte order mark off the start of src, if it has
+// one, so that the rest can be parsed. The mark is kept when printing the
+// formatted program, unless -drop-bom is given.
+//
+// Files encoded as UTF-16, which the parser doesn't support, result in an
+// error, as otherwise they would fail to parse at confusing positions. They
+// are found by their byte order mark, or by a null byte in either of the first
+// two bytes, which never appear in shell programs.
+func splitBOM(src []byte, path string) (bom, rest []byte, err error) {
+	if bytes.HasPrefix(src, utf8BOM) {
+		return src[:len(utf8BOM)], src[len(utf8BOM):], nil
+	}
+	utf16 := ""
+	switch {
+	case bytes.HasPrefix(src, []byte("\xff\xfe")):
+		utf16 = "UTF-16LE"
+	case bytes.HasPrefix(src, []byte("\xfe\xff")):
+		utf16 = "UTF-16BE"
+	case len(src) >= 2 && src[0] != 0 && src[1] == 0:
+		utf16 = "UTF-16LE"
+	case len(src) >= 2 && src[0] == 0 && src[1] != 0:
+		utf16 = "UTF-16BE"
+	}
+	if utf16 != "" {
+		return nil, nil, fmt.Errorf("%s: file seems to be encoded as %s; only UTF-8 is supported", path, utf16)
+	}
+	return nil, src, nil
+}
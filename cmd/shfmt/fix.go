@@ -0,0 +1,364 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"text/tabwriter"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// fixRule is one of the rewrites applied by "shfmt fix".
+type fixRule struct {
+	// name is how the rule is selected with -only and -exclude. It must
+	// not change, as users depend on it.
+	name string
+
+	// apply rewrites a program, returning how many changes it made. It
+	// must be safe, keeping the program's behavior as it is. The parser is
+	// the one the program was parsed with.
+	apply func(f *syntax.File, parser *syntax.Parser) int
+}
+
+// fixRules are all the rules of "shfmt fix", in the order in which they are
+// applied. Each rule sees the program as rewritten by the rules before it; for
+// example, quotes can turn `echo "foo"` into one that echo-printf rewrites.
+var fixRules = []fixRule{
+	// prologue goes first, as it works on the source of the program,
+	// which doesn't include any changes made to the syntax tree.
+	{"prologue", fixPrologue},
+	{"backticks", fixBackticks},
+	{"function-style", fixFunctionStyle},
+	{"quotes", fixQuotes},
+	{"echo-printf", fixEchoPrintf},
+}
+
+var (
+	fixOnly    = flag.String("only", "", "")
+	fixExclude = flag.String("exclude", "", "")
+
+	// fixing is set when running as "shfmt fix".
+	fixing bool
+
+	// fixSelected are the rules to apply, and fixCounts are how many
+	// changes each of them made so far. The counts are updated atomically,
+	// as files are formatted concurrently.
+	fixSelected []fixRule
+	fixCounts   []int64
+)
+
+// selectFixRules sets fixSelected from the -only and -exclude lists.
+func selectFixRules(only, exclude string) error {
+	known := make(map[string]bool, len(fixRules))
+	for _, rule := range fixRules {
+		known[rule.name] = true
+	}
+	split := func(list string) (map[string]bool, error) {
+		if list == "" {
+			return nil, nil
+		}
+		names := make(map[string]bool)
+		for _, name := range strings.Split(list, ",") {
+			if !known[name] {
+				return nil, fmt.Errorf("unknown fix rule: %s", name)
+			}
+			names[name] = true
+		}
+		return names, nil
+	}
+	onlyNames, err := split(only)
+	if err != nil {
+		return err
+	}
+	excludeNames, err := split(exclude)
+	if err != nil {
+		return err
+	}
+	fixSelected = nil
+	for _, rule := range fixRules {
+		if (onlyNames == nil || onlyNames[rule.name]) && !excludeNames[rule.name] {
+			fixSelected = append(fixSelected, rule)
+		}
+	}
+	fixCounts = make([]int64, len(fixSelected))
+	return nil
+}
+
+// applyFixRules applies the selected rules to a program, in order.
+func applyFixRules(parser *syntax.Parser, f *syntax.File) {
+	for i, rule := range fixSelected {
+		atomic.AddInt64(&fixCounts[i], int64(rule.apply(f, parser)))
+	}
+}
+
+// writeFixCounts writes how many changes each selected rule made.
+func writeFixCounts(w io.Writer) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for i, rule := range fixSelected {
+		fmt.Fprintf(tw, "%s:\t%d\n", rule.name, fixCounts[i])
+	}
+	tw.Flush()
+}
+
+// skipDisabled wraps a function for syntax.Walk so that it skips the statements
+// in regions where formatting is disabled via "# shfmt:off", as the printer
+// keeps their source as it is.
+func skipDisabled(f *syntax.File, visit func(syntax.Node) bool) func(syntax.Node) bool {
+	disabled := make(map[*syntax.Stmt]bool)
+	if f.Src != nil {
+		walkStmtLists(f, func(stmts []*syntax.Stmt, _ []syntax.Comment, _ string) {
+			off := false
+			for _, s := range stmts {
+				for _, c := range s.Comments {
+					if c.Pos().After(s.Pos()) {
+						break
+					}
+					switch syntax.FmtDirective(c) {
+					case "off":
+						off = true
+					case "on":
+						off = false
+					}
+				}
+				disabled[s] = off
+			}
+		})
+	}
+	return func(node syntax.Node) bool {
+		if s, ok := node.(*syntax.Stmt); ok && disabled[s] {
+			return false
+		}
+		return visit(node)
+	}
+}
+
+// fixPrologue moves the options given to the shell in the shebang into a set
+// line, like -shebang-set.
+func fixPrologue(f *syntax.File, parser *syntax.Parser) int {
+	if f.Src == nil {
+		return 0
+	}
+	moved := moveShebangOpts(f.Src, f)
+	if moved == nil || bytes.Equal(moved, f.Src) {
+		return 0
+	}
+	f2, err := parser.Parse(bytes.NewReader(moved), f.Name)
+	if err != nil {
+		return 0 // should never happen; leave the program as it was
+	}
+	*f = *f2
+	return 1
+}
+
+// fixBackticks replaces `foo` command substitutions with $(foo).
+func fixBackticks(f *syntax.File, _ *syntax.Parser) int {
+	n := 0
+	syntax.Walk(f, skipDisabled(f, func(node syntax.Node) bool {
+		if cs, ok := node.(*syntax.CmdSubst); ok && cs.Backquotes {
+			cs.Backquotes = false
+			n++
+		}
+		return true
+	}))
+	return n
+}
+
+// fixFunctionStyle replaces "function f" declarations with the portable
+// "f()".
+func fixFunctionStyle(f *syntax.File, _ *syntax.Parser) int {
+	n := 0
+	syntax.Walk(f, skipDisabled(f, func(node syntax.Node) bool {
+		if fd, ok := node.(*syntax.FuncDecl); ok && fd.RsrvWord {
+			fd.RsrvWord = false
+			n++
+		}
+		return true
+	}))
+	return n
+}
+
+// fixQuotes replaces double quotes which contain nothing to expand or escape,
+// such as "foo", with single quotes.
+//
+// Double quotes within other double quotes are left alone, as single quotes
+// mean something else there, and so are those in arithmetic expressions, where
+// single quotes aren't allowed.
+func fixQuotes(f *syntax.File, _ *syntax.Parser) int {
+	n := 0
+	var visit func(node syntax.Node) bool
+	visit = skipDisabled(f, func(node syntax.Node) bool {
+		switch x := node.(type) {
+		case *syntax.Word:
+			for i, part := range x.Parts {
+				dq, ok := part.(*syntax.DblQuoted)
+				if !ok || dq.Dollar {
+					continue
+				}
+				value, ok := staticDblQuoted(dq)
+				if !ok || strings.Contains(value, "'") {
+					continue
+				}
+				x.Parts[i] = &syntax.SglQuoted{Left: dq.Left, Right: dq.Right, Value: value}
+				n++
+			}
+		case *syntax.DblQuoted:
+			return false
+		case *syntax.ArithmExp, *syntax.ArithmCmd, *syntax.LetClause, *syntax.CStyleLoop:
+			return false
+		case *syntax.Assign:
+			if x.Index != nil {
+				// skip the index, which may be arithmetic
+				if x.Value != nil {
+					syntax.Walk(x.Value, visit)
+				}
+				if x.Array != nil {
+					syntax.Walk(x.Array, visit)
+				}
+				return false
+			}
+		case *syntax.ArrayElem:
+			if x.Index != nil {
+				if x.Value != nil {
+					syntax.Walk(x.Value, visit)
+				}
+				return false
+			}
+		case *syntax.ParamExp:
+			// skip any index or slice, which may be arithmetic
+			if x.Exp != nil && x.Exp.Word != nil {
+				syntax.Walk(x.Exp.Word, visit)
+			}
+			if x.Repl != nil {
+				if x.Repl.Orig != nil {
+					syntax.Walk(x.Repl.Orig, visit)
+				}
+				if x.Repl.With != nil {
+					syntax.Walk(x.Repl.With, visit)
+				}
+			}
+			return false
+		}
+		return true
+	})
+	syntax.Walk(f, visit)
+	return n
+}
+
+// staticDblQuoted returns the value of double quotes like "foo", which contain
+// nothing to expand or escape.
+func staticDblQuoted(dq *syntax.DblQuoted) (string, bool) {
+	switch len(dq.Parts) {
+	case 0:
+		return "", true
+	case 1:
+		lit, ok := dq.Parts[0].(*syntax.Lit)
+		if !ok || strings.ContainsAny(lit.Value, "\\$`") {
+			return "", false
+		}
+		return lit.Value, true
+	}
+	return "", false
+}
+
+// fixEchoPrintf replaces echo commands whose arguments are fixed strings, like
+// "echo foo 'bar baz'", with "printf '%s\n' 'foo bar baz'". Those echo commands
+// can't treat any argument as an option or an escape sequence, so the output
+// is the same.
+//
+// Programs which declare a function named echo are left alone.
+func fixEchoPrintf(f *syntax.File, _ *syntax.Parser) int {
+	echoFunc := false
+	syntax.Walk(f, func(node syntax.Node) bool {
+		if fd, ok := node.(*syntax.FuncDecl); ok && fd.Name.Value == "echo" {
+			echoFunc = true
+		}
+		return !echoFunc
+	})
+	if echoFunc {
+		return 0
+	}
+	n := 0
+	syntax.Walk(f, skipDisabled(f, func(node syntax.Node) bool {
+		call, ok := node.(*syntax.CallExpr)
+		if !ok || len(call.Args) == 0 || call.Args[0].Lit() != "echo" {
+			return true
+		}
+		var values []string
+		for _, word := range call.Args[1:] {
+			value, ok := staticWord(word)
+			if !ok {
+				return true
+			}
+			values = append(values, value)
+		}
+		line := strings.Join(values, " ")
+		if strings.HasPrefix(line, "-") || strings.ContainsAny(line, "\\'") {
+			return true
+		}
+		// Keep the positions of the command, so that it starts and ends
+		// where it did in the source.
+		echo, last := call.Args[0], call.Args[len(call.Args)-1]
+		args := []*syntax.Word{
+			{Parts: []syntax.WordPart{&syntax.Lit{ValuePos: echo.Pos(), ValueEnd: echo.End(), Value: "printf"}}},
+		}
+		if len(values) == 0 {
+			end := posBefore(echo.End())
+			args = append(args, sglWord(end, end, `\n`))
+		} else {
+			args = append(args,
+				sglWord(echo.End(), echo.End(), `%s\n`),
+				sglWord(call.Args[1].Pos(), posBefore(last.End()), line),
+			)
+		}
+		call.Args = args
+		n++
+		return true
+	}))
+	return n
+}
+
+// staticWord returns the value of a word which expands to itself as a single
+// field, like foo, 'foo bar', or "foo".
+func staticWord(word *syntax.Word) (string, bool) {
+	var sb strings.Builder
+	for _, part := range word.Parts {
+		switch x := part.(type) {
+		case *syntax.Lit:
+			if strings.ContainsAny(x.Value, "\\*?[]{}~") {
+				return "", false
+			}
+			sb.WriteString(x.Value)
+		case *syntax.SglQuoted:
+			if x.Dollar {
+				return "", false
+			}
+			sb.WriteString(x.Value)
+		case *syntax.DblQuoted:
+			value, ok := staticDblQuoted(x)
+			if !ok || x.Dollar {
+				return "", false
+			}
+			sb.WriteString(value)
+		default:
+			return "", false
+		}
+	}
+	return sb.String(), true
+}
+
+func sglWord(left, right syntax.Pos, value string) *syntax.Word {
+	return &syntax.Word{Parts: []syntax.WordPart{&syntax.SglQuoted{Left: left, Right: right, Value: value}}}
+}
+
+// posBefore returns the position of the byte before pos, which must be on the
+// same line.
+func posBefore(pos syntax.Pos) syntax.Pos {
+	return syntax.NewPos(pos.Offset()-1, pos.Line(), pos.Col()-1)
+}
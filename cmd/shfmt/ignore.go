@@ -0,0 +1,211 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// ignoreFile is a parsed .shfmtignore file, which lists the paths to skip when
+// walking its directory, with the same syntax as a .gitignore file. With
+// -gitignore, .gitignore files are used as well.
+type ignoreFile struct {
+	patterns []ignorePattern
+}
+
+type ignorePattern struct {
+	rx      *regexp.Regexp
+	negated bool // "!pattern", to not ignore a path after all
+	dirOnly bool // "pattern/", only matching directories
+}
+
+// loadIgnoreFile reads the ignore file at path, returning nil if there is none.
+func loadIgnoreFile(path string) (*ignoreFile, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	ign := &ignoreFile{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.HasSuffix(line, " ") && !strings.HasSuffix(line, `\ `) {
+			line = strings.TrimRight(line, " ")
+		}
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		var pat ignorePattern
+		if line[0] == '!' {
+			pat.negated = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			pat.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		rx, err := compileIgnorePattern(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		pat.rx = rx
+		ign.patterns = append(ign.patterns, pat)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return ign, nil
+}
+
+// match reports whether a path relative to the ignore file's directory is
+// ignored. As with .gitignore files, the last pattern to match decides. ok is
+// false if no pattern matched.
+func (ign *ignoreFile) match(rel string, isDir bool) (ignored, ok bool) {
+	for _, pat := range ign.patterns {
+		if pat.dirOnly && !isDir {
+			continue
+		}
+		if pat.rx.MatchString(rel) {
+			ignored, ok = !pat.negated, true
+		}
+	}
+	return ignored, ok
+}
+
+// compileIgnorePattern compiles a .gitignore pattern: "*" matches any
+// characters but slashes, "?" any single character but a slash, "[abc]" and
+// "[!abc]" character classes, and "**" any number of directories when it's a
+// whole path element. Patterns with a slash other than at the end are relative
+// to the directory of the ignore file; others match paths at any depth.
+func compileIgnorePattern(pattern string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("^")
+	if strings.HasPrefix(pattern, "/") {
+		pattern = pattern[1:]
+	} else if !strings.Contains(pattern, "/") {
+		sb.WriteString("(?:.*/)?")
+	}
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		atStart := i == 0 || pattern[i-1] == '/'
+		switch {
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			sb.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case strings.HasPrefix(pattern[i:], "**/") && atStart:
+			i += 2
+			sb.WriteString("(?:.*/)?")
+		case pattern[i:] == "**" && atStart:
+			i++
+			sb.WriteString(".*")
+		case c == '*':
+			sb.WriteString("[^/]*")
+		case c == '?':
+			sb.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				sb.WriteString(`\[`)
+				break
+			}
+			class := pattern[i+1 : i+1+end]
+			sb.WriteString("[")
+			if strings.HasPrefix(class, "!") {
+				sb.WriteString("^")
+				class = class[1:]
+			}
+			sb.WriteString(strings.Replace(class, `\`, `\\`, -1))
+			sb.WriteString("]")
+			i += 1 + end
+		default:
+			sb.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	sb.WriteString("$")
+	rx, err := regexp.Compile(sb.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	return rx, nil
+}
+
+// walkIgnores keeps the ignore files with a name, such as .shfmtignore, found
+// while walking a directory.
+type walkIgnores struct {
+	name  string
+	files map[string]*ignoreFile // by directory, nil if there is none
+}
+
+func newWalkIgnores(name string) *walkIgnores {
+	return &walkIgnores{name: name, files: make(map[string]*ignoreFile)}
+}
+
+// load reads the ignore file in dir, if any, to be used by ignored.
+func (w *walkIgnores) load(dir string) error {
+	ign, err := loadIgnoreFile(filepath.Join(dir, w.name))
+	w.files[dir] = ign
+	return err
+}
+
+// ignored reports whether path is ignored by the ignore files in the
+// directories from root down to the directory containing path. Deeper files
+// take precedence. Since ignored directories are skipped, their contents
+// needn't be checked.
+func (w *walkIgnores) ignored(root, path string, isDir bool) bool {
+	var dirs []string
+	for dir := filepath.Dir(path); ; dir = filepath.Dir(dir) {
+		dirs = append(dirs, dir)
+		if dir == root || dir == filepath.Dir(dir) {
+			break
+		}
+	}
+	ignored := false
+	for i := len(dirs) - 1; i >= 0; i-- {
+		ign := w.files[dirs[i]]
+		if ign == nil {
+			continue
+		}
+		rel, err := filepath.Rel(dirs[i], path)
+		if err != nil {
+			continue
+		}
+		if ig, ok := ign.match(filepath.ToSlash(rel), isDir); ok {
+			ignored = ig
+		}
+	}
+	return ignored
+}
+
+// hasIgnoreDirective reports whether a "# shfmt:ignore" comment line is at the
+// top of src, before anything but comments and blank lines.
+func hasIgnoreDirective(src []byte) bool {
+	for len(src) > 0 {
+		var line []byte
+		if i := bytes.IndexByte(src, '\n'); i >= 0 {
+			line, src = src[:i], src[i+1:]
+		} else {
+			line, src = src, nil
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] != '#' {
+			return false
+		}
+		if string(bytes.TrimSpace(line[1:])) == "shfmt:ignore" {
+			return true
+		}
+	}
+	return false
+}
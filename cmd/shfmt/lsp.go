@@ -0,0 +1,410 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/diff"
+)
+
+var lspMode = flag.Bool("lsp", false, "")
+
+// JSON-RPC and LSP error codes.
+const (
+	lspParseError           = -32700
+	lspInvalidRequest       = -32600
+	lspMethodNotFound       = -32601
+	lspInvalidParams        = -32602
+	lspServerNotInitialized = -32002
+)
+
+type lspError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *lspError) Error() string { return e.Message }
+
+type lspMessage struct {
+	ID     *json.RawMessage `json:"id"` // nil for notifications
+	Method string           `json:"method"`
+	Params json.RawMessage  `json:"params"`
+}
+
+// lspPosition is a position in a document, where Character counts UTF-16
+// code units as required by the protocol.
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type lspTextEdit struct {
+	Range   lspRange `json:"range"`
+	NewText string   `json:"newText"`
+}
+
+type lspDiagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"` // 1 is an error
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type lspDocumentParams struct {
+	TextDocument struct {
+		URI  string `json:"uri"`
+		Text string `json:"text"`
+	} `json:"textDocument"`
+	ContentChanges []struct {
+		Text string `json:"text"`
+	} `json:"contentChanges"`
+	Range *lspRange `json:"range"`
+}
+
+// lspServer is a language server for shell programs, speaking JSON-RPC over a
+// reader and writer such as standard input and output. It formats and reports
+// parse errors in the open documents, using the same options as when
+// formatting files, including EditorConfig files for documents on disk.
+type lspServer struct {
+	r  *bufio.Reader
+	w  io.Writer
+	wk *worker
+
+	docs map[string][]byte // open documents by URI
+
+	initialized, shutdown bool
+}
+
+// runLSP runs a language server until the client asks it to exit, returning
+// the exit status.
+func runLSP(r io.Reader, w io.Writer) int {
+	s := &lspServer{
+		r:    bufio.NewReader(r),
+		w:    w,
+		wk:   newWorker(nil, ioutil.Discard),
+		docs: make(map[string][]byte),
+	}
+	for {
+		body, err := s.read()
+		if err == io.EOF && s.shutdown {
+			return 0
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		var msg lspMessage
+		if err := json.Unmarshal(body, &msg); err != nil {
+			err = s.reply(nil, nil, &lspError{lspParseError, err.Error()})
+		} else if msg.Method == "exit" {
+			if s.shutdown {
+				return 0
+			}
+			return 1
+		} else {
+			result, lerr := s.handle(msg.Method, msg.Params)
+			if msg.ID != nil {
+				err = s.reply(msg.ID, result, lerr)
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+}
+
+// read reads the content of the next message.
+func (s *lspServer) read() ([]byte, error) {
+	length := -1
+	for {
+		line, err := s.r.ReadString('\n')
+		if err == io.EOF && line == "" && length < 0 {
+			return nil, io.EOF
+		} else if err != nil {
+			return nil, fmt.Errorf("reading message header: %v", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 || !strings.EqualFold(line[:i], "Content-Length") {
+			continue
+		}
+		if length, err = strconv.Atoi(strings.TrimSpace(line[i+1:])); err != nil || length < 0 {
+			return nil, fmt.Errorf("invalid Content-Length header: %q", line)
+		}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("message without a Content-Length header")
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(s.r, body); err != nil {
+		return nil, fmt.Errorf("reading message: %v", err)
+	}
+	return body, nil
+}
+
+func (s *lspServer) write(msg interface{}) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, "Content-Length: %d\r\n\r\n", len(body)); err != nil {
+		return err
+	}
+	_, err = s.w.Write(body)
+	return err
+}
+
+func (s *lspServer) reply(id *json.RawMessage, result interface{}, lerr *lspError) error {
+	msg := map[string]interface{}{"jsonrpc": "2.0", "id": id}
+	if lerr != nil {
+		msg["error"] = lerr
+	} else {
+		msg["result"] = result
+	}
+	return s.write(msg)
+}
+
+func (s *lspServer) notify(method string, params interface{}) error {
+	return s.write(map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params})
+}
+
+func (s *lspServer) handle(method string, rawParams json.RawMessage) (interface{}, *lspError) {
+	switch {
+	case method == "initialize":
+		s.initialized = true
+		return map[string]interface{}{
+			"capabilities": map[string]interface{}{
+				// Full documents are sent on each change.
+				"textDocumentSync": map[string]interface{}{
+					"openClose": true,
+					"change":    1,
+				},
+				"documentFormattingProvider":      true,
+				"documentRangeFormattingProvider": true,
+			},
+			"serverInfo": map[string]string{"name": "shfmt", "version": version},
+		}, nil
+	case !s.initialized:
+		return nil, &lspError{lspServerNotInitialized, "server not initialized"}
+	case s.shutdown:
+		return nil, &lspError{lspInvalidRequest, "server is shutting down"}
+	case method == "shutdown":
+		s.shutdown = true
+		return nil, nil
+	case method == "initialized", strings.HasPrefix(method, "$/"):
+		return nil, nil
+	}
+	var params lspDocumentParams
+	if err := json.Unmarshal(rawParams, &params); err != nil {
+		return nil, &lspError{lspInvalidParams, err.Error()}
+	}
+	uri := params.TextDocument.URI
+	switch method {
+	case "textDocument/didOpen":
+		s.docs[uri] = []byte(params.TextDocument.Text)
+		return nil, s.publishDiagnostics(uri)
+	case "textDocument/didChange":
+		if n := len(params.ContentChanges); n > 0 {
+			s.docs[uri] = []byte(params.ContentChanges[n-1].Text)
+		}
+		return nil, s.publishDiagnostics(uri)
+	case "textDocument/didClose":
+		delete(s.docs, uri)
+		return nil, s.publishDiagnostics(uri)
+	case "textDocument/formatting", "textDocument/rangeFormatting":
+		return s.format(uri, params.Range)
+	}
+	return nil, &lspError{lspMethodNotFound, "method not found: " + method}
+}
+
+// setup sets up the worker for the document at uri, returning the path to use
+// for it in messages.
+func (s *lspServer) setup(uri string) (string, error) {
+	path := ""
+	if u, err := url.Parse(uri); err == nil && u.Scheme == "file" {
+		path = filepath.FromSlash(u.Path)
+	}
+	if err := applyEditorConfig(path); err != nil {
+		return "", err
+	}
+	s.wk.setConfig(config)
+	if path == "" {
+		return uri, nil
+	}
+	return path, nil
+}
+
+// publishDiagnostics reports the parse error in a document, if any. Closed
+// documents have their diagnostics cleared.
+func (s *lspServer) publishDiagnostics(uri string) *lspError {
+	diagnostics := []lspDiagnostic{}
+	if src, ok := s.docs[uri]; ok {
+		path, err := s.setup(uri)
+		var bom []byte
+		if err == nil {
+			bom, src, err = splitBOM(src, path)
+		}
+		if err == nil && !hasIgnoreDirective(src) {
+			_, err = s.wk.parser.Parse(bytes.NewReader(src), path)
+		}
+		if err != nil {
+			var pos lspPosition
+			msg := err.Error()
+			if d := parseDiagnostic(err); d != nil {
+				pos = lspPos(src, d.Line, d.Col)
+				if pos.Line == 0 && bom != nil {
+					pos.Character++ // U+FEFF is a single code unit
+				}
+				msg = d.Message
+			}
+			diagnostics = append(diagnostics, lspDiagnostic{
+				Range:    lspRange{pos, pos},
+				Severity: 1,
+				Source:   "shfmt",
+				Message:  msg,
+			})
+		}
+	}
+	if err := s.notify("textDocument/publishDiagnostics", map[string]interface{}{
+		"uri":         uri,
+		"diagnostics": diagnostics,
+	}); err != nil {
+		return &lspError{lspInvalidRequest, err.Error()}
+	}
+	return nil
+}
+
+// format returns the edits to format a document, or only the lines within rng
+// if it's not nil. The result is null if the document can't be formatted, such
+// as when it fails to parse, as that is reported via diagnostics.
+func (s *lspServer) format(uri string, rng *lspRange) (interface{}, *lspError) {
+	src, ok := s.docs[uri]
+	if !ok {
+		return nil, &lspError{lspInvalidParams, "document is not open: " + uri}
+	}
+	path, err := s.setup(uri)
+	if err != nil {
+		return nil, nil
+	}
+	var buf bytes.Buffer
+	s.wk.out = &buf
+	if err := s.wk.formatBytes(src, path, ""); err != nil {
+		return nil, nil
+	}
+	return lineEdits(src, buf.Bytes(), rng), nil
+}
+
+// lineEdits returns the edits which turn src into res, replacing whole lines.
+// If rng isn't nil, only the edits touching the lines within it are returned.
+func lineEdits(src, res []byte, rng *lspRange) []lspTextEdit {
+	a, b := splitLines(src), splitLines(res)
+	ranges := diff.Myers(context.Background(), diff.Bytes(a, b)).IndexRanges
+	edits := []lspTextEdit{}
+	for i := 0; i < len(ranges); {
+		r := ranges[i]
+		if !r.IsInsert() && !r.IsDelete() {
+			i++
+			continue
+		}
+		// Join a deletion and an insertion into a single edit.
+		for i++; i < len(ranges) && (ranges[i].IsInsert() || ranges[i].IsDelete()); i++ {
+			r.HighA, r.HighB = ranges[i].HighA, ranges[i].HighB
+		}
+		if rng != nil && !linesOverlap(r.LowA, r.HighA, *rng) {
+			continue
+		}
+		edits = append(edits, lspTextEdit{
+			Range:   lspRange{lspPosition{Line: r.LowA}, lineEnd(a, r.HighA)},
+			NewText: string(bytes.Join(b[r.LowB:r.HighB], nil)),
+		})
+	}
+	return edits
+}
+
+// splitLines splits src into lines, each with its trailing newline if it has
+// one.
+func splitLines(src []byte) [][]byte {
+	lines := bytes.SplitAfter(src, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// lineEnd returns the position just past the first n lines.
+func lineEnd(lines [][]byte, n int) lspPosition {
+	if n == 0 || n < len(lines) || bytes.HasSuffix(lines[n-1], []byte("\n")) {
+		return lspPosition{Line: n}
+	}
+	return lspPosition{Line: n - 1, Character: utf16Len(lines[n-1])}
+}
+
+// linesOverlap reports whether the lines from low up to high, or the point
+// before low if they are equal, touch the lines within rng. A range ending at
+// the start of a line doesn't include it.
+func linesOverlap(low, high int, rng lspRange) bool {
+	start, end := rng.Start.Line, rng.End.Line
+	if rng.End.Character == 0 && end > start {
+		end--
+	}
+	if low == high {
+		return low >= start && low <= end+1
+	}
+	return low <= end && high > start
+}
+
+// lspPos converts a 1-based line and byte column in src to a position.
+func lspPos(src []byte, line, col uint) lspPosition {
+	pos := lspPosition{}
+	if line > 0 {
+		pos.Line = int(line) - 1
+	}
+	lines := splitLines(src)
+	if pos.Line < len(lines) && col > 0 {
+		text := lines[pos.Line]
+		if int(col)-1 < len(text) {
+			text = text[:col-1]
+		}
+		pos.Character = utf16Len(text)
+	}
+	return pos
+}
+
+// utf16Len returns the number of UTF-16 code units needed to encode b.
+func utf16Len(b []byte) int {
+	n := 0
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+		b = b[size:]
+	}
+	return n
+}
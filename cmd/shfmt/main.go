@@ -6,29 +6,55 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/pkg/diff"
 	"golang.org/x/crypto/ssh/terminal"
 
 	"mvdan.cc/sh/v3/fileutil"
 	"mvdan.cc/sh/v3/syntax"
+	"mvdan.cc/sh/v3/syntax/typedjson"
 )
 
 var (
-	showVersion = flag.Bool("version", false, "")
+	showVersion  = flag.Bool("version", false, "")
+	capabilities = flag.Bool("capabilities-json", false, "")
 
 	list    = flag.Bool("l", false, "")
 	write   = flag.Bool("w", false, "")
-	simple  = flag.Bool("s", false, "")
 	find    = flag.Bool("f", false, "")
 	diffOut = flag.Bool("d", false, "")
+	diffDir = flag.String("o", "", "")
+	quiet   = flag.Bool("q", false, "")
+	suggest = flag.Bool("suggest", false, "")
+
+	convTests    = flag.Bool("ct", false, "")
+	watchFiles   = flag.Bool("watch", false, "")
+	expandBraces = flag.Bool("expand-braces", false, "")
+
+	filesFrom = flag.String("files", "", "")
+	nulSep    = flag.Bool("0", false, "")
+	stdinName = flag.String("filename", "", "")
+	rangeStr  = flag.String("range", "", "")
+	follow    = flag.Bool("follow", false, "")
+	gitignore = flag.Bool("gitignore", false, "")
+
+	shebangSet  = flag.Bool("shebang-set", false, "")
+	shebangWarn = flag.Bool("shebang-warn", false, "")
+	fixUnicode  = flag.Bool("fix-unicode", false, "")
 
 	langStr = flag.String("ln", "", "")
 	posix   = flag.Bool("p", false, "")
@@ -38,23 +64,110 @@ var (
 	caseIndent  = flag.Bool("ci", false, "")
 	spaceRedirs = flag.Bool("sr", false, "")
 	keepPadding = flag.Bool("kp", false, "")
+	alignComs   = flag.Uint("ac", 0, "")
 	minify      = flag.Bool("mn", false, "")
+	bracesStr   = flag.String("pb", "", "")
+	hdocIndent  = flag.Bool("hi", false, "")
+	reindent    = flag.Bool("reindent", false, "")
+	lineLen     = flag.Uint("ll", 0, "")
+	styleStr    = flag.String("style", "", "")
+	explain     = flag.Bool("explain", false, "")
+
+	minifyBraces = flag.Bool("mn-braces", false, "")
 
-	toJSON = flag.Bool("tojson", false, "")
+	toJSON     = flag.Bool("tojson", false, "")
+	indentJSON = flag.String("indentjson", "\t", "")
+	fromJSON   = flag.Bool("fromjson", false, "")
+	toHTML     = flag.Bool("tohtml", false, "")
 
-	parser            *syntax.Parser
-	printer           *syntax.Printer
-	readBuf, writeBuf bytes.Buffer
+	colorStr = flag.String("color", "", "")
 
-	copyBuf = make([]byte, 32*1024)
+	diagFormat = flag.String("format", "", "")
+
+	progressMode progressFlag
+	simplifyMode simplifyFlag
+
+	// config is the configuration to format files with, as set up by
+	// configure.
+	config *formatConfig
 
 	in    io.Reader = os.Stdin
 	out   io.Writer = os.Stdout
 	color bool
+	prog  *progress
+
+	// lineRange is the first and last line given via -range, if any.
+	lineRange *[2]uint
+
+	// scripts decides which files in directories are formatted, as
+	// adjusted by -include and -skip.
+	scripts fileutil.ScriptMatcher
 
 	version = "v3.0.0-alpha2"
 )
 
+func init() {
+	flag.Var(&simplifyMode, "s", "")
+	flag.Var((*globsFlag)(&scripts.Include), "include", "")
+	flag.Var((*globsFlag)(&scripts.Exclude), "skip", "")
+}
+
+// globsFlag is the value of a flag which may be given many times, each with a
+// glob as per fileutil.ScriptMatcher.
+type globsFlag []string
+
+func (f *globsFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *globsFlag) Set(s string) error {
+	if err := fileutil.ValidGlob(s); err != nil {
+		return fmt.Errorf("invalid glob %q: %v", s, err)
+	}
+	*f = append(*f, s)
+	return nil
+}
+
+// simplifyFlag is the value of -s, which can be given without a value like a
+// boolean flag to apply all the simplification rules, or with a
+// comma-separated list of rule names to only apply those.
+type simplifyFlag struct {
+	enabled bool
+	rules   syntax.SimplifyRule
+}
+
+func (f *simplifyFlag) String() string {
+	switch {
+	case !f.enabled:
+		return "false"
+	case f.rules == syntax.SimplifyAll:
+		return "true"
+	}
+	return f.rules.String()
+}
+
+func (f *simplifyFlag) Set(s string) error {
+	switch s {
+	case "true":
+		*f = simplifyFlag{true, syntax.SimplifyAll}
+		return nil
+	case "false":
+		*f = simplifyFlag{}
+		return nil
+	}
+	var rules syntax.SimplifyRule
+	for _, name := range strings.Split(s, ",") {
+		rule, ok := syntax.LookupSimplifyRule(strings.TrimSpace(name))
+		if !ok {
+			return fmt.Errorf("unknown simplify rule %q; valid rules: %s",
+				name, syntax.SimplifyAll)
+		}
+		rules |= rule
+	}
+	*f = simplifyFlag{true, rules}
+	return nil
+}
+
+func (f *simplifyFlag) IsBoolFlag() bool { return true }
+
 func main() {
 	os.Exit(main1())
 }
@@ -62,21 +175,63 @@ func main() {
 func main1() int {
 	flag.Usage = func() {
 		fmt.Fprint(os.Stderr, `usage: shfmt [flags] [path ...]
+       shfmt fix [flags] [path ...]
 
 If no arguments are given, standard input will be used. If a given path
 is a directory, it will be recursively searched for shell files - both
-by filename extension and by shebang.
+by filename extension and by shebang. Paths listed in .shfmtignore files
+are skipped, and so are files starting with a "# shfmt:ignore" comment.
+Use -include and -skip to adjust which files in directories are formatted.
 
   -version  show version and exit
+  -capabilities-json  print the supported languages and options as JSON
 
   -l        list files whose formatting differs from shfmt's
   -w        write result to file instead of stdout
   -d        error with a diff when the formatting differs
-  -s        simplify the code
+  -o dir    with -d, write each diff to dir/<path>.patch instead of stdout
+  -q        with -l or -d, only set the exit status
+  -s        simplify the code; -s=rule,... only applies the given rules out of
+            arithm-parens, arithm-vars, subshells, test-quotes, test-parens,
+            test-negations, test-match and single-quotes
+  -ct       with -s, convert [ ] tests to [[ ]], or [[ ]] to [ ] and case
+            with -ln=posix, where the input is then parsed as bash
+  -suggest  on a missing "fi", "done" and the like, guess where it belongs
+  -watch    with -w, keep running and reformat files as they change, printing
+            the path of each one; stop with an interrupt, such as ctrl-c
+  -expand-braces  replace words like a{b,c} by the words they expand to,
+                  like "ab ac"
+
+  -files file  also format the paths listed in file, one per line; use - for
+               standard input
+  -0           with -files, paths are separated by null bytes instead
+  -filename path  format standard input as if it was the file at path, such
+                  as for its EditorConfig options and in messages
+  -include glob  also format files in directories matching glob, such as
+                 "*.bash_lib" or "bin/*", whatever their name or shebang
+  -skip glob   skip files and directories matching glob, such as "vendor";
+               globs with a slash match the path relative to the directory
+               given, and others match the base name; both may be repeated
+  -gitignore   also skip the paths listed in .gitignore files when walking
+               directories, like those in .shfmtignore files
+  -follow      follow symlinks to files and directories when walking
+               directories, formatting each directory only once
+  -range a:b   only format the top-level statements on lines a to b of a
+               single file, leaving the rest as is
+  -j uint      format this many files at once, 0 meaning one per CPU (the
+               default); the output is the same no matter the number
+
+  -shebang-set   move shell options from the shebang to a set line after it
+  -shebang-warn  warn about shebangs giving multiple arguments to env
+  -fix-unicode   replace no-break spaces, invisible characters and curly
+                 quotes in code with their plain ASCII counterparts
+  -drop-bom      drop the UTF-8 byte order mark at the start of files, which is
+                 otherwise kept; files encoded as UTF-16 are always an error
 
 Parser options:
 
-  -ln str   language variant to parse (bash/posix/mksh, default "bash")
+  -ln str   language variant to parse (bash/posix/mksh/auto, default "bash");
+            auto detects it for each file from its shebang or extension
   -p        shorthand for -ln=posix
 
 Printer options:
@@ -86,123 +241,778 @@ Printer options:
   -ci       switch cases will be indented
   -sr       redirect operators will be followed by a space
   -kp       keep column alignment paddings
+  -ac uint  align trailing comments, padding with at most this many spaces
   -mn       minify program to reduce its size (implies -s)
+  -mn-braces  with -mn, also factor words like "ab ac" into a{b,c}
+  -pb str   braces around variables (leave/always/minimal, default "leave")
+  -hi       re-indent <<- heredoc bodies, also when indenting with spaces
+  -reindent convert the indentation of the input to -i, including regions
+            where formatting is disabled and paddings kept by -kp
+  -ll uint  break commands and arrays which go past this many columns (default 0, off)
+
+  -style str  preset of parser and printer options
+              (default/google/minimal-diff, default "default"); the flags
+              above override its individual settings
+  -explain    print the parser and printer options in effect, with where
+              each value came from, and exit
+
+When formatting files, the options above are also read from .editorconfig
+files: indent_style and indent_size, shell_variant, binary_next_line,
+switch_case_indent, space_redirects and keep_padding. Flags and -style take
+precedence over them.
 
 Utilities:
 
   -f        recursively find all shell files and print the paths
-  -tojson   print syntax tree to stdout as a typed JSON
+  -tojson   print syntax tree to stdout as a typed JSON; with paths, one
+            document per file on a single line, with the path as its Name
+  -indentjson str  with -tojson, indent the JSON with str of spaces and tabs
+                   (default a tab for stdin, and none for paths)
+  -fromjson read syntax tree from stdin as a typed JSON, and print it
+  -tohtml   print formatted program to stdout as syntax-highlighted HTML
+
+  -format str  report files whose formatting differs and parse errors with
+               their positions instead of printing the formatted programs
+               (text/json/checkstyle/sarif, default "text", meaning off); json
+               writes a record per line
+  -color str  color diffs and formatted programs (auto/always/never, default
+              "auto"); auto colors when printing to a terminal, unless NO_COLOR
+              is set
+  -progress   report progress on stderr while formatting paths: an updating
+              line on a terminal, or JSON records otherwise; use
+              -progress=nototal to skip counting the files first
+  -summary, -v  print how many files were scanned, parsed, changed, skipped
+                for not having a shell shebang, ignored and failed, and the
+                time taken, on stderr once done
+
+  -lsp      run a language server on stdin/out, formatting documents and
+            reporting their parse errors with the options above
+
+  -list-parse-errors-only  only parse the files, printing a line per file
+                           which fails to parse; use =json for JSON records.
+                           Unless -ln is given, the language of each file is
+                           detected like with -ln=auto
+
+Rewrites:
+
+  shfmt fix applies safe rewrite rules to the programs before formatting them,
+  and then prints how many changes each rule made to standard error. The rules
+  run in this order, each of them seeing the changes made by the ones before:
+
+    prologue        move shell options in the shebang to a set line
+    backticks       replace `+"`cmd`"+` with $(cmd)
+    function-style  replace "function f" with "f()"
+    quotes          replace "foo" with 'foo' when there is nothing to expand
+    echo-printf     replace echo of fixed strings with printf
+
+  -only list     only apply these comma-separated rules
+  -exclude list  don't apply these comma-separated rules
+
+The exit status is 0 on success, 4 if any file failed to parse, and 3 if the
+formatting of any file differs when using -d, or -l without -w. Any other
+error, such as a file which can't be read, results in 1. When more than one
+applies, 1 takes precedence over 4, which takes precedence over 3.
 `)
 	}
-	flag.Parse()
+	if len(os.Args) > 1 && os.Args[1] == "fix" {
+		fixing = true
+		flag.CommandLine.Parse(os.Args[2:])
+	} else {
+		flag.Parse()
+	}
 
 	if *showVersion {
 		fmt.Println(version)
 		return 0
 	}
-	if *posix && *langStr != "" {
-		fmt.Fprintf(os.Stderr, "-p and -ln=lang cannot coexist\n")
+	if *capabilities {
+		caps := syntax.SupportedCapabilities()
+		if caps.Version == "" || caps.Version == "(devel)" {
+			caps.Version = version
+		}
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "\t")
+		if err := enc.Encode(caps); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		return 0
+	}
+	if *quiet && !*list && !*diffOut {
+		fmt.Fprintf(os.Stderr, "-q can only be used with -l or -d\n")
+		return 1
+	}
+	if *diffDir != "" && !*diffOut {
+		fmt.Fprintf(os.Stderr, "-o can only be used with -d\n")
+		return 1
+	}
+	if *watchFiles && !*write {
+		fmt.Fprintf(os.Stderr, "-watch can only be used with -w\n")
+		return 1
+	}
+	if *fromJSON && (*list || *diffOut) {
+		fmt.Fprintf(os.Stderr, "-fromjson cannot be used with -l or -d\n")
+		return 1
+	}
+	if *nulSep && *filesFrom == "" {
+		fmt.Fprintf(os.Stderr, "-0 can only be used with -files\n")
+		return 1
+	}
+	if *stdinName != "" && (flag.NArg() > 0 || *filesFrom != "") {
+		fmt.Fprintf(os.Stderr, "-filename can only be used with stdin\n")
+		return 1
+	}
+	if *rangeStr != "" {
+		r, err := parseLineRange(*rangeStr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		lineRange = &r
+		for _, name := range []string{"mn", "tojson", "fromjson", "tohtml"} {
+			if flag.Lookup(name).Value.String() == "true" {
+				fmt.Fprintf(os.Stderr, "-range cannot be used with -%s\n", name)
+				return 1
+			}
+		}
+		if flag.NArg() > 1 || *filesFrom != "" {
+			fmt.Fprintf(os.Stderr, "-range can only be used with a single file\n")
+			return 1
+		} else if flag.NArg() == 1 {
+			if info, err := os.Stat(flag.Arg(0)); err == nil && info.IsDir() {
+				fmt.Fprintf(os.Stderr, "-range can only be used with a single file\n")
+				return 1
+			}
+		}
+	}
+	switch *diagFormat {
+	case "text", "":
+	case "json", "checkstyle", "sarif":
+		for _, name := range []string{"l", "d", "f", "watch", "tojson", "fromjson", "tohtml"} {
+			if flag.Lookup(name).Value.String() == "true" {
+				fmt.Fprintf(os.Stderr, "-format=%s cannot be used with -%s\n", *diagFormat, name)
+				return 1
+			}
+		}
+		if parseErrorsMode != "" {
+			fmt.Fprintf(os.Stderr, "-format=%s cannot be used with -list-parse-errors-only\n", *diagFormat)
+			return 1
+		}
+		diags = &diagnosticWriter{w: out, format: *diagFormat}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown diagnostics format: %s\n", *diagFormat)
+		return 1
+	}
+	if fixing {
+		if err := selectFixRules(*fixOnly, *fixExclude); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if !*quiet {
+			defer writeFixCounts(os.Stderr)
+		}
+	} else if *fixOnly != "" || *fixExclude != "" {
+		fmt.Fprintf(os.Stderr, "-only and -exclude can only be used with shfmt fix\n")
+		return 1
+	}
+	if parseErrorsMode != "" {
+		if err := parseErrorsFlagsErr(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	style := syntax.StyleDefault()
+	switch *styleStr {
+	case "default", "":
+	case "google":
+		style = syntax.StyleGoogle()
+	case "minimal-diff":
+		style = syntax.StyleMinimalDiff()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown style: %s\n", *styleStr)
+		return 1
+	}
+	// Flags given explicitly take precedence over the style.
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	if explicit["p"] {
+		explicit["ln"] = true
+	}
+	if explicit["indentjson"] && !*toJSON {
+		fmt.Fprintf(os.Stderr, "-indentjson can only be used with -tojson\n")
+		return 1
+	}
+	if strings.Trim(*indentJSON, " \t") != "" {
+		// Anything else would make the JSON invalid.
+		fmt.Fprintf(os.Stderr, "-indentjson can only contain spaces and tabs\n")
+		return 1
+	}
+	styleSource := make(map[string]string)
+	defaults := make(map[string]string)
+	for _, sf := range styleFlags(syntax.StyleDefault()) {
+		defaults[sf.name] = sf.value
+	}
+	for _, sf := range styleFlags(style) {
+		if !explicit[sf.name] && sf.value != defaults[sf.name] {
+			flag.Set(sf.name, sf.value)
+			styleSource[sf.name] = "-style=" + style.Name
+		}
+	}
+	if *explain {
+		tw := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+		for _, sf := range styleFlags(syntax.StyleDefault()) {
+			source := "default"
+			if explicit[sf.name] {
+				source = "flag -" + sf.name
+				if sf.name == "ln" && *posix {
+					source = "flag -p"
+				}
+			} else if src := styleSource[sf.name]; src != "" {
+				source = src
+			}
+			value := flag.Lookup(sf.name).Value.String()
+			switch {
+			case sf.name == "ln" && *posix:
+				value = syntax.LangPOSIX.String()
+			case value == "":
+				value = sf.value
+			}
+			fmt.Fprintf(tw, "%s\t-%s=%s\t%s\n", sf.option, sf.name, value, source)
+		}
+		tw.Flush()
+		return 0
+	}
+	lang, err := configure()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if (explicit["ln"] || styleSource["ln"] != "") && !config.autoLang {
+		given := lang
+		parseErrorsLang = &given
+	}
+	// Flags take precedence over EditorConfig files, including those set
+	// by the style.
+	cmdLineFlags = make(map[string]bool)
+	for name := range explicit {
+		cmdLineFlags[name] = true
+	}
+	for name := range styleSource {
+		cmdLineFlags[name] = true
+	}
+	switch *colorStr {
+	case "always":
+		color = true
+	case "never":
+	case "auto", "":
+		if os.Getenv("FORCE_COLOR") == "true" {
+			// Undocumented way to force color; used in the tests.
+			color = true
+		} else if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+			// Equivalent to forcing color to be turned off.
+		} else if f, ok := out.(*os.File); ok && terminal.IsTerminal(int(f.Fd())) {
+			color = true
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown color mode: %s\n", *colorStr)
+		return 1
+	}
+	if *lspMode {
+		for _, name := range []string{"l", "w", "d", "f", "watch", "tojson", "fromjson", "tohtml", "format", "filename", "files", "range", "list-parse-errors-only", "summary", "v"} {
+			if explicit[name] {
+				fmt.Fprintf(os.Stderr, "-lsp cannot be used with -%s\n", name)
+				return 1
+			}
+		}
+		if flag.NArg() > 0 {
+			fmt.Fprintf(os.Stderr, "-lsp can only be used with stdin/out\n")
+			return 1
+		}
+		color = false
+		return runLSP(in, out)
+	}
+	if showSummary {
+		if parseErrorsMode != "" {
+			fmt.Fprintf(os.Stderr, "-summary cannot be used with -list-parse-errors-only\n")
+			return 1
+		}
+		sum = &summary{start: time.Now()}
+	}
+	status := 0
+	finishDiags := func() {
+		if diags == nil {
+			return
+		}
+		if err := diags.finish(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			status = 1
+		}
+	}
+	// The most severe status is used, no matter the order of the errors.
+	setStatus := func(s int) {
+		if exitSeverity(s) > exitSeverity(status) {
+			status = s
+		}
+	}
+	onError := func(err error) {
+		if f, ok := err.(*parseFailure); ok {
+			if prog != nil {
+				prog.clear()
+			}
+			if err := writeParseFailure(out, f); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				setStatus(1)
+			}
+			setStatus(exitParseError)
+			return
+		}
+		if err == errChanged {
+			setStatus(exitChanged)
+			return
+		}
+		if prog != nil {
+			prog.clear()
+		}
+		if diags != nil {
+			d, ok := err.(*diagnostic)
+			if !ok {
+				d = parseDiagnostic(err)
+			}
+			if d != nil {
+				if err := diags.add(d); err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					setStatus(1)
+				}
+				switch {
+				case d.Rule == "parse":
+					setStatus(exitParseError)
+				case !*write:
+					setStatus(exitChanged)
+				}
+				return
+			}
+		}
+		fmt.Fprintln(os.Stderr, err)
+		if isParseError(err) {
+			setStatus(exitParseError)
+		} else {
+			setStatus(1)
+		}
+	}
+	paths := flag.Args()
+	if *filesFrom != "" {
+		list, err := readFileList(*filesFrom)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		paths = append(paths, list...)
+	} else if len(paths) == 0 {
+		wk := newWorker(out, os.Stderr)
+		stdinFn := wk.formatStdin
+		if parseErrorsMode != "" {
+			stdinFn = checkParseStdin
+		}
+		err := stdinFn()
+		if err != nil {
+			onError(err)
+		}
+		finishDiags()
+		if sum != nil {
+			sum.add(stdinPath(), true, wk.stats, err)
+			sum.write(os.Stderr)
+		}
+		return status
+	}
+	if *toJSON {
+		if *list || *write || *diffOut {
+			fmt.Fprintln(os.Stderr, "-tojson cannot be used with -l, -w or -d")
+			return 1
+		}
+		// One document per file, each on a single line.
+		if !explicit["indentjson"] {
+			*indentJSON = ""
+		}
+	}
+	if *fromJSON {
+		fmt.Fprintln(os.Stderr, "-fromjson can only be used with stdin/out")
+		return 1
+	}
+	if *toHTML {
+		fmt.Fprintln(os.Stderr, "-tohtml can only be used with stdin/out")
 		return 1
 	}
+	if progressMode != "" {
+		prog = newProgress(os.Stderr, paths, progressMode != "nototal")
+	}
+	if parseErrorsMode != "" {
+		for _, path := range paths {
+			walk(path, onError, checkParsePath)
+		}
+	} else {
+		formatPaths(paths, onError)
+	}
+	if prog != nil {
+		prog.finish()
+		prog = nil
+	}
+	if sum != nil {
+		sum.write(os.Stderr)
+	}
+	if *watchFiles {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt)
+		defer signal.Stop(sigs)
+		*list = true // report the files which get reformatted
+		watch(paths, onError, sigs)
+	}
+	finishDiags()
+	return status
+}
+
+// formatConfig holds the options to format files with. It isn't modified once
+// set up, so that it can be shared by the workers, each of which builds its own
+// parser and printer from it.
+type formatConfig struct {
+	parserOpts  []syntax.ParserOption
+	printerOpts []syntax.PrinterOption
+
+	simplify     bool
+	simplifyOpts []syntax.SimplifyOption
+
+	// posixTests is set when the input is parsed as bash to convert its
+	// tests with -ct, while -ln=posix was given.
+	posixTests bool
+
+	// autoLang is set by -ln=auto, to parse each file with the language
+	// variant given by detectLang.
+	autoLang bool
+}
+
+// configure sets config from the flags, returning the language variant given
+// via -ln or -p. With -ln=auto, it returns bash, the variant files fall back to.
+func configure() (syntax.LangVariant, error) {
+	if *posix && *langStr != "" {
+		return 0, fmt.Errorf("-p and -ln=lang cannot coexist")
+	}
 	lang := syntax.LangBash
+	autoLang := false
 	switch *langStr {
 	case "bash", "":
+	case "auto":
+		autoLang = true
 	case "posix":
 		lang = syntax.LangPOSIX
 	case "mksh":
 		lang = syntax.LangMirBSDKorn
 	default:
-		fmt.Fprintf(os.Stderr, "unknown shell language: %s\n", *langStr)
-		return 1
+		return 0, fmt.Errorf("unknown shell language: %s", *langStr)
 	}
 	if *posix {
 		lang = syntax.LangPOSIX
 	}
-	if *minify {
-		*simple = true
+	braces := syntax.BracesLeave
+	switch *bracesStr {
+	case "leave", "":
+	case "always":
+		braces = syntax.BracesAlways
+	case "minimal":
+		braces = syntax.BracesMinimal
+	default:
+		return 0, fmt.Errorf("unknown braces mode: %s", *bracesStr)
 	}
-	parser = syntax.NewParser(syntax.KeepComments(true), syntax.Variant(lang))
-	printer = syntax.NewPrinter(
+	conf := &formatConfig{simplify: simplifyMode.enabled || *minify, autoLang: autoLang}
+	if simplifyMode.enabled && simplifyMode.rules != syntax.SimplifyAll {
+		conf.simplifyOpts = append(conf.simplifyOpts, syntax.SimplifyRules(simplifyMode.rules))
+	}
+	if autoLang {
+		for _, name := range []string{"ct", "expand-braces", "mn-braces"} {
+			if flag.Lookup(name).Value.String() == "true" {
+				return 0, fmt.Errorf("-%s cannot be used with -ln=auto", name)
+			}
+		}
+	}
+	if *minifyBraces && !*minify {
+		return 0, fmt.Errorf("-mn-braces can only be used with -mn")
+	}
+	if (*expandBraces || *minifyBraces) && lang == syntax.LangPOSIX {
+		return 0, fmt.Errorf("brace expansions are not supported with -ln=posix")
+	}
+	parseLang := lang
+	if *convTests {
+		if !conf.simplify {
+			return 0, fmt.Errorf("-ct can only be used with -s")
+		}
+		conf.simplifyOpts = append(conf.simplifyOpts, syntax.ConvertTests(lang))
+		if lang == syntax.LangPOSIX {
+			// The POSIX parser doesn't read [[ ]] as tests.
+			conf.posixTests = true
+			parseLang = syntax.LangBash
+		}
+	}
+	// The source is kept to print regions with formatting turned off.
+	conf.parserOpts = []syntax.ParserOption{
+		syntax.KeepComments(true), syntax.Variant(parseLang), syntax.RetainSource(true),
+	}
+	conf.printerOpts = []syntax.PrinterOption{
 		syntax.Indent(*indent),
 		syntax.BinaryNextLine(*binNext),
 		syntax.SwitchCaseIndent(*caseIndent),
 		syntax.SpaceRedirects(*spaceRedirs),
 		syntax.KeepPadding(*keepPadding),
+		syntax.AlignComments(*alignComs),
 		syntax.Minify(*minify),
-	)
-	if os.Getenv("FORCE_COLOR") == "true" {
-		// Undocumented way to force color; used in the tests.
-		color = true
-	} else if os.Getenv("TERM") == "dumb" {
-		// Equivalent to forcing color to be turned off.
-	} else if f, ok := out.(*os.File); ok && terminal.IsTerminal(int(f.Fd())) {
-		color = true
+		syntax.MinifyBraces(*minifyBraces),
+		syntax.ParamBraces(braces),
+		syntax.HeredocIndent(*hdocIndent),
+		syntax.Reindent(*reindent),
+		syntax.WrapAt(*lineLen),
 	}
-	if flag.NArg() == 0 {
-		if err := formatStdin(); err != nil {
-			if err != errChangedWithDiff {
-				fmt.Fprintln(os.Stderr, err)
-			}
-			return 1
+	config = conf
+	return lang, nil
+}
+
+// parseLineRange parses the value of -range, like "3:10", or "3" for a single
+// line.
+func parseLineRange(s string) ([2]uint, error) {
+	startStr, endStr := s, s
+	if i := strings.IndexByte(s, ':'); i >= 0 {
+		startStr, endStr = s[:i], s[i+1:]
+	}
+	start, err1 := strconv.ParseUint(startStr, 10, 32)
+	end, err2 := strconv.ParseUint(endStr, 10, 32)
+	if err1 != nil || err2 != nil || start == 0 || end < start {
+		return [2]uint{}, fmt.Errorf("invalid line range: %q", s)
+	}
+	return [2]uint{uint(start), uint(end)}, nil
+}
+
+// detectLang returns the language variant of the file at path, from its
+// shebang or else from its extension, falling back to bash. The ".sh"
+// extension is used for bash scripts too, so it also means bash.
+func detectLang(path string, src []byte) syntax.LangVariant {
+	// Drop version suffixes, like in "bash4" or "bash-5.1".
+	switch strings.TrimRight(fileutil.Shebang(src), "0123456789.-") {
+	case "sh":
+		return syntax.LangPOSIX
+	case "bash":
+		return syntax.LangBash
+	case "mksh":
+		return syntax.LangMirBSDKorn
+	}
+	if filepath.Ext(path) == ".mksh" {
+		return syntax.LangMirBSDKorn
+	}
+	return syntax.LangBash
+}
+
+// readFileList reads the list of paths given via -files, where "-" means
+// standard input.
+func readFileList(name string) ([]string, error) {
+	var data []byte
+	var err error
+	if name == "-" {
+		data, err = ioutil.ReadAll(in)
+	} else {
+		data, err = ioutil.ReadFile(name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sep := "\n"
+	if *nulSep {
+		sep = "\x00"
+	}
+	return splitFileList(string(data), sep), nil
+}
+
+// splitFileList splits a list of paths by sep, skipping empty ones. With
+// newlines, a trailing carriage return is removed from each path too.
+func splitFileList(list, sep string) []string {
+	var paths []string
+	for _, path := range strings.Split(list, sep) {
+		if sep == "\n" {
+			path = strings.TrimSuffix(path, "\r")
+		}
+		if path != "" {
+			paths = append(paths, path)
 		}
-		return 0
 	}
-	if *toJSON {
-		fmt.Fprintln(os.Stderr, "-tojson can only be used with stdin/out")
+	return paths
+}
+
+// errChanged is returned when the formatting of a file differs and the
+// options used mean that this should be reported via the exit status.
+var errChanged = fmt.Errorf("formatting differs")
+
+// Exit statuses other than 0 for success and 1 for any other error. 2 is left
+// out, as the flag package uses it for invalid flags.
+const (
+	exitChanged    = 3 // the formatting of a file differs
+	exitParseError = 4 // a file failed to parse
+)
+
+// exitSeverity orders the exit statuses, so that the most severe one is used
+// when many files are formatted: any other error comes before parse errors,
+// which come before formatting changes.
+func exitSeverity(status int) int {
+	switch status {
+	case 0:
+		return 0
+	case exitChanged:
 		return 1
+	case exitParseError:
+		return 2
 	}
-	status := 0
-	for _, path := range flag.Args() {
-		walk(path, func(err error) {
-			if err != errChangedWithDiff {
-				fmt.Fprintln(os.Stderr, err)
-			}
-			status = 1
-		})
-	}
-	return status
+	return 3
 }
 
-var errChangedWithDiff = fmt.Errorf("")
+// isParseError reports whether err is due to a file failing to parse, either
+// because of its syntax or because of the language variant it was parsed as.
+func isParseError(err error) bool {
+	switch err.(type) {
+	case syntax.ParseError, syntax.LangError, suggestedParseError:
+		return true
+	}
+	return false
+}
 
-func formatStdin() error {
+func (wk *worker) formatStdin() error {
+	wk.stats = fileStats{}
 	if *write {
 		return fmt.Errorf("-w cannot be used on standard input")
 	}
+	if *diffDir != "" {
+		return fmt.Errorf("-o cannot be used on standard input")
+	}
+	if *stdinName != "" {
+		if err := applyEditorConfig(*stdinName); err != nil {
+			return err
+		}
+		wk.setConfig(config)
+	}
+	if *fromJSON {
+		return wk.formatJSON()
+	}
 	src, err := ioutil.ReadAll(in)
 	if err != nil {
 		return err
 	}
-	return formatBytes(src, "<standard input>")
+	return wk.formatBytes(src, stdinPath(), "")
+}
+
+// stdinPath returns the path to use for standard input in messages, which is
+// the one given via -filename, if any.
+func stdinPath() string {
+	if *stdinName != "" {
+		return *stdinName
+	}
+	return "<standard input>"
+}
+
+// formatJSON prints a syntax tree read from standard input as typed JSON, as
+// written by -tojson.
+func (wk *worker) formatJSON() error {
+	path := stdinPath()
+	node, err := typedjson.Decode(in)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if wk.conf.simplify {
+		syntax.Simplify(node, wk.conf.simplifyOpts...)
+	}
+	if *toJSON {
+		return typedjson.EncodeOptions{Indent: *indentJSON}.Encode(wk.out, node)
+	}
+	wk.writeBuf.Reset()
+	if err := wk.printer.Print(&wk.writeBuf, node); err != nil {
+		return err
+	}
+	res := wk.writeBuf.Bytes()
+	if *toHTML {
+		return wk.writeHTML(wk.out, res, path)
+	}
+	if color {
+		return wk.writeHighlighted(wk.out, res, path, syntax.HighlightANSI)
+	}
+	_, err = wk.out.Write(res)
+	return err
 }
 
 var vcsDir = regexp.MustCompile(`^\.(git|svn|hg)$`)
 
-func walk(path string, onError func(error)) {
-	info, err := os.Stat(path)
+// walk calls fn for root if it isn't a directory, or else for each file under
+// it which could be a shell script, in which case checkShebang tells fn whether
+// the file is a script only if it has a shell shebang.
+func walk(root string, onError func(error), fn func(name, path string, checkShebang bool) error) {
+	info, err := os.Stat(root)
 	if err != nil {
 		onError(err)
 		return
 	}
 	if !info.IsDir() {
-		if err := formatPath(path, false); err != nil {
+		name := filepath.Clean(root)
+		if filepath.IsAbs(name) || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			// don't write patches outside of the -o directory
+			name = filepath.Base(name)
+		}
+		if err := fn(filepath.ToSlash(name), root, false); err != nil {
 			onError(err)
 		}
 		return
 	}
-	filepath.Walk(path, func(path string, info os.FileInfo, err error) error {
-		if info.IsDir() && vcsDir.MatchString(info.Name()) {
+	// The walked paths are clean, so the root must be too for the ignore
+	// files in it to be found, such as with "dir/" or "./dir".
+	root = filepath.Clean(root)
+	ignores := []*walkIgnores{newWalkIgnores(".shfmtignore")}
+	if *gitignore {
+		ignores = append(ignores, newWalkIgnores(".gitignore"))
+	}
+	walkFn := filepath.Walk
+	if *follow {
+		walkFn = walkFollow
+	}
+	walkFn(root, func(path string, info os.FileInfo, err error) error {
+		if info != nil && info.IsDir() && vcsDir.MatchString(info.Name()) {
 			return filepath.SkipDir
 		}
 		if err != nil {
 			onError(err)
 			return nil
 		}
-		conf := fileutil.CouldBeScript(info)
+		// Patch names are relative to the root, which is usually the top
+		// directory of a repository.
+		name, err := filepath.Rel(root, path)
+		if err != nil {
+			onError(err)
+			return nil
+		}
+		name = filepath.ToSlash(name)
+		skip := path != root && scripts.Excluded(name)
+		for _, ign := range ignores {
+			if path != root && ign.ignored(root, path, info.IsDir()) {
+				skip = true
+			}
+		}
+		if skip {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			for _, ign := range ignores {
+				if err := ign.load(path); err != nil {
+					onError(err)
+				}
+			}
+			return nil
+		}
+		conf := scripts.CouldBeScript(name, info)
 		if conf == fileutil.ConfNotScript {
 			return nil
 		}
-		err = formatPath(path, conf == fileutil.ConfIfShebang)
+		err = fn(name, path, conf == fileutil.ConfIfShebang)
 		if err != nil && !os.IsNotExist(err) {
 			onError(err)
 		}
@@ -210,83 +1020,353 @@ func walk(path string, onError func(error)) {
 	})
 }
 
-func formatPath(path string, checkShebang bool) error {
+// walkFollow is like filepath.Walk, but it follows symlinks to files and
+// directories, as given via -follow. A directory is only walked once, even if
+// it's reached via multiple paths, which also stops symlink cycles. Dangling
+// symlinks are passed to walkFn as they are.
+func walkFollow(root string, walkFn filepath.WalkFunc) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		return walkFn(root, nil, err)
+	}
+	var seen []os.FileInfo
+	err = walkFollowDir(root, info, walkFn, &seen)
+	if err == filepath.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func walkFollowDir(path string, info os.FileInfo, walkFn filepath.WalkFunc, seen *[]os.FileInfo) error {
+	if !info.IsDir() {
+		return walkFn(path, info, nil)
+	}
+	for _, prev := range *seen {
+		if os.SameFile(prev, info) {
+			return nil
+		}
+	}
+	*seen = append(*seen, info)
+	names, err := readDirNames(path)
+	err1 := walkFn(path, info, err)
+	if err != nil || err1 != nil {
+		return err1
+	}
+	for _, name := range names {
+		filename := filepath.Join(path, name)
+		info, err := os.Lstat(filename)
+		if err == nil && info.Mode()&os.ModeSymlink != 0 {
+			if target, err := os.Stat(filename); err == nil {
+				info = target
+			}
+		}
+		if err != nil {
+			if err := walkFn(filename, info, err); err != nil && err != filepath.SkipDir {
+				return err
+			}
+			continue
+		}
+		err = walkFollowDir(filename, info, walkFn, seen)
+		if err != nil && (err != filepath.SkipDir || !info.IsDir()) {
+			return err
+		}
+	}
+	return nil
+}
+
+// readDirNames returns the sorted names of the entries in a directory.
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	names, err := f.Readdirnames(-1)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// formatPath formats the file at path. name is its path relative to the
+// directory being walked, used to name patches.
+//
+// formatted is false if the file was skipped for not having a shell shebang,
+// when checkShebang is set.
+func (wk *worker) formatPath(name, path string, checkShebang bool) (formatted bool, err error) {
+	wk.stats = fileStats{}
 	f, err := os.Open(path)
 	if err != nil {
-		return err
+		return false, err
 	}
 	defer f.Close()
-	readBuf.Reset()
+	wk.readBuf.Reset()
 	if checkShebang {
-		n, err := f.Read(copyBuf[:32])
+		n, err := f.Read(wk.copyBuf[:128])
 		if err != nil {
-			return err
+			return false, err
 		}
-		if !fileutil.HasShebang(copyBuf[:n]) {
-			return nil
+		if !fileutil.HasShebang(wk.copyBuf[:n]) {
+			return false, nil
 		}
-		readBuf.Write(copyBuf[:n])
+		wk.readBuf.Write(wk.copyBuf[:n])
 	}
 	if *find {
-		fmt.Fprintln(out, path)
-		return nil
+		fmt.Fprintln(wk.out, path)
+		return true, nil
 	}
-	if _, err := io.CopyBuffer(&readBuf, f, copyBuf); err != nil {
-		return err
+	if _, err := io.CopyBuffer(&wk.readBuf, f, wk.copyBuf); err != nil {
+		return true, err
 	}
 	f.Close()
-	return formatBytes(readBuf.Bytes(), path)
+	return true, wk.formatBytes(wk.readBuf.Bytes(), path, name)
 }
 
-func formatBytes(src []byte, path string) error {
-	prog, err := parser.Parse(bytes.NewReader(src), path)
+func (wk *worker) formatBytes(orig []byte, path, name string) error {
+	bom, src, err := splitBOM(orig, path)
 	if err != nil {
 		return err
 	}
-	if *simple {
-		syntax.Simplify(prog)
+	if !*toJSON && !*toHTML && hasIgnoreDirective(src) {
+		// Files with a shfmt:ignore directive are left as they are,
+		// even if they can't be parsed.
+		wk.stats.ignored = true
+		if !*list && !*write && !*diffOut && diags == nil {
+			_, err := wk.out.Write(orig)
+			return err
+		}
+		return nil
+	}
+	if wk.conf.autoLang {
+		syntax.Variant(detectLang(path, src))(wk.parser)
+	}
+	prog, err := wk.parser.Parse(bytes.NewReader(src), path)
+	if err != nil {
+		if perr, ok := err.(syntax.ParseError); ok && *suggest {
+			if guess := suggestCloser(src, perr); guess != "" {
+				err = suggestedParseError{perr, guess}
+			}
+		}
+		prog = nil // only partially parsed
+	} else {
+		wk.stats.parsed = true
+	}
+	// src is kept as is, to compare the result with the original file.
+	fixed, prog, uerr := wk.checkUnicode(src, prog, path)
+	if prog == nil {
+		return err
+	} else if uerr != nil {
+		return uerr
+	}
+	if *shebangSet {
+		if moved := moveShebangOpts(fixed, prog); moved != nil {
+			fixed = moved
+			if prog, err = wk.parser.Parse(bytes.NewReader(fixed), path); err != nil {
+				return err
+			}
+		}
+	}
+	if *shebangWarn {
+		for _, warn := range shebangWarnings(fixed, path) {
+			fmt.Fprintln(wk.errOut, warn)
+		}
+	}
+	if fixing {
+		applyFixRules(wk.parser, prog)
+	}
+	if *expandBraces {
+		expandAllBraces(prog)
+	}
+	if wk.conf.simplify {
+		syntax.Simplify(prog, wk.conf.simplifyOpts...)
+		if wk.conf.posixTests {
+			syntax.Walk(prog, func(node syntax.Node) bool {
+				if tc, ok := node.(*syntax.TestClause); ok {
+					fmt.Fprintf(wk.errOut, "%s:%s: warning: [[ ]] left as is, as it has no POSIX equivalent\n",
+						path, tc.Pos())
+				}
+				return true
+			})
+		}
 	}
 	if *toJSON {
+		return typedjson.EncodeOptions{Indent: *indentJSON}.Encode(wk.out, prog)
+	}
+	if !*minify {
+		for _, warn := range directiveWarnings(prog, path) {
+			fmt.Fprintln(wk.errOut, warn)
+		}
+	}
+	wk.writeBuf.Reset()
+	if lineRange != nil {
+		err = wk.printer.PrintLines(&wk.writeBuf, prog, lineRange[0], lineRange[1])
+	} else {
+		err = wk.printer.Print(&wk.writeBuf, prog)
+	}
+	if err != nil {
+		return err
+	}
+	res := wk.writeBuf.Bytes()
+	if *toHTML {
 		// must be standard input; fine to return
-		return writeJSON(out, prog, true)
-	}
-	writeBuf.Reset()
-	printer.Print(&writeBuf, prog)
-	res := writeBuf.Bytes()
-	if !bytes.Equal(src, res) {
-		if *list {
-			if _, err := fmt.Fprintln(out, path); err != nil {
+		return wk.writeHTML(wk.out, res, path)
+	}
+	full := res
+	if bom != nil && !*dropBOM {
+		full = append(append([]byte(nil), bom...), res...)
+	}
+	if !bytes.Equal(orig, full) {
+		wk.stats.changed = true
+		if *list && !*quiet {
+			if _, err := fmt.Fprintln(wk.out, path); err != nil {
 				return err
 			}
 		}
 		if *write {
-			f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
-			if err != nil {
+			if err := writeFile(path, full); err != nil {
 				return err
 			}
-			if _, err := f.Write(res); err != nil {
+		}
+		if *diffDir != "" {
+			if err := writePatch(orig, full, name); err != nil {
 				return err
 			}
-			if err := f.Close(); err != nil {
-				return err
+		} else if *diffOut && !*quiet {
+			if err := diffBytes(wk.out, orig, full, path); err != nil {
+				return fmt.Errorf("computing diff: %s", err)
 			}
 		}
-		if *diffOut {
-			if err := diffBytes(src, res, path); err != nil {
-				return fmt.Errorf("computing diff: %s", err)
+		if diags != nil {
+			return formatDiagnostic(orig, full, path)
+		}
+		if *diffOut || (*list && !*write) {
+			return errChanged
+		}
+	}
+	if !*list && !*write && !*diffOut && diags == nil {
+		if color {
+			if _, err := wk.out.Write(full[:len(full)-len(res)]); err != nil {
+				return err
 			}
-			return errChangedWithDiff
+			return wk.writeHighlighted(wk.out, res, path, syntax.HighlightANSI)
+		}
+		if _, err := wk.out.Write(full); err != nil {
+			return err
 		}
 	}
-	if !*list && !*write && !*diffOut {
-		if _, err := out.Write(res); err != nil {
+	return nil
+}
+
+// writeFile replaces the contents of the file at path with data. The data is
+// written to a temporary file in the same directory, which then replaces the
+// original file, so that a crash cannot leave a file half-written.
+//
+// Symlinks are followed, so that their targets are updated instead of the links
+// being replaced. The new file keeps the permissions and the owner of the
+// original.
+//
+// An error is returned if the temporary file can't be created, such as in a
+// directory which isn't writable. The original file is overwritten in place
+// instead if the temporary file can't replace it, as on some network and
+// Windows filesystems. The same happens if the original file has other hard
+// links, which would otherwise stop sharing its contents, or if the current
+// user can't give the new file the same owner.
+func writeFile(path string, data []byte) error {
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if hardLinked(info) {
+		return writeFileInPlace(path, data)
+	}
+	dir, base := filepath.Split(path)
+	f, err := ioutil.TempFile(dir, "."+base+".shfmt")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+	// Chown before Chmod, as changing the owner may clear the setuid and
+	// setgid bits.
+	if !copyOwner(f, info) {
+		f.Close()
+		os.Remove(tmpPath)
+		return writeFileInPlace(path, data)
+	}
+	err = func() error {
+		defer f.Close()
+		if _, err := f.Write(data); err != nil {
+			return err
+		}
+		mode := info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		if err := f.Chmod(mode); err != nil {
 			return err
 		}
+		if err := f.Sync(); err != nil {
+			return err
+		}
+		return f.Close()
+	}()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return writeFileInPlace(path, data)
 	}
+	// Make the rename itself durable too.
+	syncDir(dir)
 	return nil
 }
 
-func diffBytes(b1, b2 []byte, path string) error {
+// writeFileInPlace truncates and overwrites the file at path, keeping its
+// permissions and owner as they are.
+func writeFileInPlace(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeHTML writes a formatted program as syntax-highlighted HTML, within a
+// pre element.
+func (wk *worker) writeHTML(w io.Writer, src []byte, path string) error {
+	if _, err := io.WriteString(w, `<pre class="sh">`); err != nil {
+		return err
+	}
+	if err := wk.writeHighlighted(w, src, path, syntax.HighlightHTML); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "</pre>\n")
+	return err
+}
+
+// writeHighlighted writes a formatted program with syntax highlighting. The
+// program is parsed again, so that the positions used to highlight it match
+// the formatted source.
+func (wk *worker) writeHighlighted(w io.Writer, src []byte, path string, fn syntax.HighlightFunc) error {
+	prog, err := wk.parser.Parse(bytes.NewReader(src), path)
+	if err != nil {
+		return err
+	}
+	return syntax.NewHighlighter(syntax.HighlightWith(fn)).Highlight(w, prog)
+}
+
+func diffBytes(w io.Writer, b1, b2 []byte, path string) error {
 	a := bytes.Split(b1, []byte("\n"))
 	b := bytes.Split(b2, []byte("\n"))
 	ab := diff.Bytes(a, b)
@@ -295,8 +1375,71 @@ func diffBytes(b1, b2 []byte, path string) error {
 	if color {
 		opts = append(opts, diff.TerminalColor())
 	}
-	if _, err := e.WriteUnified(out, ab, opts...); err != nil {
+	if _, err := e.WriteUnified(w, ab, opts...); err != nil {
 		return err
 	}
 	return nil
 }
+
+// writePatch writes the diff between b1 and b2 to the file <name>.patch in the
+// -o directory, creating any parent directories. The patch uses the a/ and b/
+// prefixes expected by "git apply", and it is never colored.
+func writePatch(b1, b2 []byte, name string) error {
+	ab := &patchLines{a: splitLines(b1), b: splitLines(b2)}
+	e := diff.Myers(context.Background(), ab)
+	var buf bytes.Buffer
+	if _, err := e.WriteUnified(&buf, ab, diff.Names("a/"+name, "b/"+name)); err != nil {
+		return fmt.Errorf("computing diff: %s", err)
+	}
+	patchPath := filepath.Join(*diffDir, filepath.FromSlash(name)+".patch")
+	if err := os.MkdirAll(filepath.Dir(patchPath), 0777); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(patchPath, buf.Bytes(), 0666)
+}
+
+// patchLines is like diff.Bytes, but its lines keep their trailing newlines,
+// so that a line missing one at the end of a file is a change too. Such a line
+// is written with the marker that patch and "git apply" expect.
+type patchLines struct {
+	a, b [][]byte
+}
+
+func (ab *patchLines) LenA() int                                { return len(ab.a) }
+func (ab *patchLines) LenB() int                                { return len(ab.b) }
+func (ab *patchLines) Equal(ai, bi int) bool                    { return bytes.Equal(ab.a[ai], ab.b[bi]) }
+func (ab *patchLines) WriteATo(w io.Writer, i int) (int, error) { return writePatchLine(w, ab.a[i]) }
+func (ab *patchLines) WriteBTo(w io.Writer, i int) (int, error) { return writePatchLine(w, ab.b[i]) }
+
+func writePatchLine(w io.Writer, line []byte) (int, error) {
+	if n := len(line); n > 0 && line[n-1] == '\n' {
+		return w.Write(line[:n-1])
+	}
+	return fmt.Fprintf(w, "%s\n\\ No newline at end of file", line)
+}
+
+// styleFlag is the flag corresponding to one of the options of a style, with
+// the option's value in that style.
+type styleFlag struct {
+	option, name, value string
+}
+
+// styleFlags returns the flags for the options of a style, in the order in which
+// they are listed in the usage text.
+func styleFlags(s syntax.Style) []styleFlag {
+	return []styleFlag{
+		{"Variant", "ln", s.Variant.String()},
+		{"Indent", "i", strconv.FormatUint(uint64(s.Indent), 10)},
+		{"BinaryNextLine", "bn", strconv.FormatBool(s.BinaryNextLine)},
+		{"SwitchCaseIndent", "ci", strconv.FormatBool(s.SwitchCaseIndent)},
+		{"SpaceRedirects", "sr", strconv.FormatBool(s.SpaceRedirects)},
+		{"KeepPadding", "kp", strconv.FormatBool(s.KeepPadding)},
+		{"AlignComments", "ac", strconv.FormatUint(uint64(s.AlignComments), 10)},
+		{"Minify", "mn", strconv.FormatBool(s.Minify)},
+		{"MinifyBraces", "mn-braces", strconv.FormatBool(s.MinifyBraces)},
+		{"ParamBraces", "pb", s.ParamBraces.String()},
+		{"HeredocIndent", "hi", strconv.FormatBool(s.HeredocIndent)},
+		{"Reindent", "reindent", strconv.FormatBool(s.Reindent)},
+		{"WrapAt", "ll", strconv.FormatUint(uint64(s.WrapAt), 10)},
+	}
+}
@@ -6,12 +6,19 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"runtime"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/rogpeppe/go-internal/testscript"
 
@@ -19,8 +26,7 @@ import (
 )
 
 func init() {
-	parser = syntax.NewParser(syntax.KeepComments(true))
-	printer = syntax.NewPrinter()
+	config = &formatConfig{parserOpts: []syntax.ParserOption{syntax.KeepComments(true)}}
 }
 
 func TestMain(m *testing.M) {
@@ -57,6 +63,8 @@ var walkTests = []struct {
 	{Modify, false, "shebang-space", "#! /bin/sh\n foo"},
 	{Modify, false, "shebang-tabs", "#!\t/bin/env\tsh\n foo"},
 	{Modify, false, "shebang-args", "#!/bin/bash -e -x\nfoo"},
+	{Modify, false, "shebang-env-split", "#!/usr/bin/env -S bash -euo pipefail\n foo"},
+	{Modify, false, "shebang-version", "#!/usr/local/bin/bash4\n foo"},
 	{Modify, false, "ext.sh", " foo"},
 	{Modify, false, "ext.bash", " foo"},
 	{Modify, false, "ext-shebang.sh", "#!/bin/sh\n foo"},
@@ -70,6 +78,7 @@ var walkTests = []struct {
 	{None, false, "ext.other", " foo"},
 	{None, false, "ext-shebang.other", "#!/bin/sh\n foo"},
 	{None, false, "shebang-nospace", "#!/bin/envsh\n foo"},
+	{None, false, "shebang-other", "#!/usr/bin/env python\n foo"},
 	{None, false, filepath.Join(".git", "ext.sh"), " foo"},
 	{None, false, filepath.Join(".svn", "ext.sh"), " foo"},
 	{None, false, filepath.Join(".hg", "ext.sh"), " foo"},
@@ -109,7 +118,7 @@ func TestWalk(t *testing.T) {
 	var outBuf bytes.Buffer
 	out = &outBuf
 	*list, *write = true, true
-	*simple = true
+	config.simplify = true
 	gotError := false
 	errored := map[string]bool{}
 	onError := func(err error) {
@@ -122,7 +131,7 @@ func TestWalk(t *testing.T) {
 	doWalk := func(path string) {
 		gotError = false
 		outBuf.Reset()
-		walk(path, onError)
+		walk(path, onError, formatPath)
 	}
 	doWalk(tdir)
 	modified := map[string]bool{}
@@ -163,8 +172,523 @@ func TestWalk(t *testing.T) {
 	*find = true
 	doWalk(tdir)
 	numFound := strings.Count(outBuf.String(), "\n")
-	if want := 13; numFound != want {
+	if want := 15; numFound != want {
 		t.Fatalf("shfmt -f printed %d paths, but wanted %d", numFound, want)
 	}
 	*find = false
 }
+
+func TestWriteFile(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("the tests use Unix permissions and symlinks")
+	}
+	tdir, err := ioutil.TempDir("", "shfmt-write")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+	check := func(path, want string) {
+		t.Helper()
+		got, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("want %q in %s, got %q", want, path, got)
+		}
+	}
+
+	path := filepath.Join(tdir, "perm.sh")
+	if err := ioutil.WriteFile(path, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	mode := 0750 | os.ModeSetuid | os.ModeSetgid
+	if err := os.Chmod(path, mode); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(path, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	check(path, "new")
+	if info, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	} else if got := info.Mode(); got != mode {
+		t.Fatalf("want mode %v, got %v", mode, got)
+	}
+
+	target := filepath.Join(tdir, "target.sh")
+	link := filepath.Join(tdir, "link.sh")
+	if err := ioutil.WriteFile(target, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("target.sh", link); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(link, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	check(target, "new")
+	if info, err := os.Lstat(link); err != nil {
+		t.Fatal(err)
+	} else if info.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("the symlink was replaced by a %v file", info.Mode())
+	}
+
+	entries, err := ioutil.ReadDir(tdir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("temporary files were left behind: %d entries", len(entries))
+	}
+
+	// Hard links keep sharing the same file.
+	path = filepath.Join(tdir, "hard.sh")
+	hardLink := filepath.Join(tdir, "hard-link.sh")
+	if err := ioutil.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(path, hardLink); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeFile(path, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	check(path, "new")
+	check(hardLink, "new")
+
+	// Files in read-only directories can't be replaced, and are left alone.
+	rdir := filepath.Join(tdir, "readonly")
+	path = filepath.Join(rdir, "file.sh")
+	if err := os.Mkdir(rdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(rdir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(rdir, 0755)
+	if os.Geteuid() == 0 {
+		t.Skip("root can write to read-only directories")
+	}
+	if err := writeFile(path, []byte("new")); err == nil {
+		t.Fatal("want an error for a file in a read-only directory")
+	}
+	check(path, "old")
+}
+
+func TestSplitFileList(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		list, sep string
+		want      []string
+	}{
+		{"", "\n", nil},
+		{"a.sh\nb c.sh\n", "\n", []string{"a.sh", "b c.sh"}},
+		{"a.sh\r\n\nb.sh", "\n", []string{"a.sh", "b.sh"}},
+		{"a.sh\x00b\nc.sh\x00", "\x00", []string{"a.sh", "b\nc.sh"}},
+		{"\x00a.sh\x00\x00", "\x00", []string{"a.sh"}},
+	}
+	for i, tc := range tests {
+		got := splitFileList(tc.list, tc.sep)
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%03d: want %q, got %q", i, tc.want, got)
+		}
+	}
+}
+
+func TestEditorConfigGlob(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		glob, path string
+		want       bool
+	}{
+		{"*", "a.sh", true},
+		{"*", "dir/a.sh", true},
+		{"*.sh", "dir/sub/a.sh", true},
+		{"*.sh", "a.bash", false},
+		{"dir/*.sh", "dir/a.sh", true},
+		{"dir/*.sh", "dir/sub/a.sh", false},
+		{"dir/*.sh", "other/dir/a.sh", false},
+		{"/a.sh", "a.sh", true},
+		{"/a.sh", "dir/a.sh", false},
+		{"dir/**.sh", "dir/sub/a.sh", true},
+		{"a?.sh", "ab.sh", true},
+		{"a?.sh", "a/.sh", false},
+		{"*.{sh,bash}", "a.bash", true},
+		{"*.{sh,bash}", "a.zsh", false},
+		{"{a,{b,c}d}.sh", "cd.sh", true},
+		{"{a}.sh", "{a}.sh", true},
+		{"[ab].sh", "b.sh", true},
+		{"[!ab].sh", "b.sh", false},
+		{"[!ab].sh", "c.sh", true},
+		{"a{1..3}.sh", "a2.sh", true},
+		{"a{1..3}.sh", "a4.sh", false},
+		{`\*.sh`, "*.sh", true},
+		{`\*.sh`, "a.sh", false},
+	}
+	for i, tc := range tests {
+		g, err := compileEditorConfigGlob(tc.glob)
+		if err != nil {
+			t.Errorf("%03d: %v", i, err)
+			continue
+		}
+		if got := g.match(tc.path); got != tc.want {
+			t.Errorf("%03d: %q matching %q: want %t, got %t", i, tc.glob, tc.path, tc.want, got)
+		}
+	}
+}
+
+func TestIgnorePattern(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		pattern, path string
+		want          bool
+	}{
+		{"a.sh", "a.sh", true},
+		{"a.sh", "dir/a.sh", true},
+		{"a.sh", "b.sh", false},
+		{"*.sh", "dir/sub/a.sh", true},
+		{"*.sh", "a.bash", false},
+		{"/a.sh", "a.sh", true},
+		{"/a.sh", "dir/a.sh", false},
+		{"dir/*.sh", "dir/a.sh", true},
+		{"dir/*.sh", "dir/sub/a.sh", false},
+		{"dir/*.sh", "other/dir/a.sh", false},
+		{"**/gen", "gen", true},
+		{"**/gen", "dir/sub/gen", true},
+		{"dir/**", "dir/sub/a.sh", true},
+		{"dir/**", "dir", false},
+		{"a/**/b.sh", "a/b.sh", true},
+		{"a/**/b.sh", "a/x/y/b.sh", true},
+		{"a**.sh", "a/b.sh", false},
+		{"a?.sh", "ab.sh", true},
+		{"a?.sh", "a/.sh", false},
+		{"[ab].sh", "b.sh", true},
+		{"[!ab].sh", "b.sh", false},
+		{"[!ab].sh", "c.sh", true},
+		{`\*.sh`, "*.sh", true},
+		{`\*.sh`, "a.sh", false},
+		{`\#a.sh`, "#a.sh", true},
+	}
+	for i, tc := range tests {
+		rx, err := compileIgnorePattern(tc.pattern)
+		if err != nil {
+			t.Errorf("%03d: %v", i, err)
+			continue
+		}
+		if got := rx.MatchString(tc.path); got != tc.want {
+			t.Errorf("%03d: %q matching %q: want %t, got %t", i, tc.pattern, tc.path, tc.want, got)
+		}
+	}
+}
+
+func TestIgnoreDirective(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		src  string
+		want bool
+	}{
+		{"", false},
+		{"# shfmt:ignore\nfoo", true},
+		{"#shfmt:ignore", true},
+		{"#!/bin/sh\n\n# generated file\n  # shfmt:ignore\nfoo", true},
+		{"foo\n# shfmt:ignore", false},
+		{"# shfmt:ignore this", false},
+		{"echo # shfmt:ignore", false},
+	}
+	for i, tc := range tests {
+		if got := hasIgnoreDirective([]byte(tc.src)); got != tc.want {
+			t.Errorf("%03d: %q: want %t, got %t", i, tc.src, tc.want, got)
+		}
+	}
+}
+
+func TestSplitBOM(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		src       string
+		bom, rest string
+		err       string
+	}{
+		{"", "", "", ""},
+		{"echo", "", "echo", ""},
+		{"\xef\xbb\xbfecho", "\xef\xbb\xbf", "echo", ""},
+		{"\xef\xbb", "", "\xef\xbb", ""},
+		{"\xff\xfee\x00", "", "", "UTF-16LE"},
+		{"\xfe\xff\x00e", "", "", "UTF-16BE"},
+		{"e\x00c\x00", "", "", "UTF-16LE"},
+		{"\x00e\x00c", "", "", "UTF-16BE"},
+		{"\n", "", "\n", ""},
+	}
+	for i, tc := range tests {
+		bom, rest, err := splitBOM([]byte(tc.src), "f.sh")
+		if tc.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%03d: %q: want error with %q, got %v", i, tc.src, tc.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%03d: %q: unexpected error: %v", i, tc.src, err)
+		} else if string(bom) != tc.bom || string(rest) != tc.rest {
+			t.Errorf("%03d: %q: want %q and %q, got %q and %q", i, tc.src, tc.bom, tc.rest, bom, rest)
+		}
+	}
+}
+
+func TestFixRules(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		rule    string
+		in      string
+		want    string
+		changes int
+	}{
+		{"prologue", "#!/bin/sh -e\nfoo\n", "#!/bin/sh\nset -e\nfoo\n", 1},
+		{"prologue", "#!/bin/sh\nfoo\n", "#!/bin/sh\nfoo\n", 0},
+		{"backticks", "a=`b` \"`c`\"\n", "a=$(b) \"$(c)\"\n", 2},
+		{"backticks", "echo `echo \\`foo\\``\n", "echo $(echo $(foo))\n", 2},
+		{"function-style", "function f() { :; }\nfunction g { :; }\nh() { :; }\n", "f() { :; }\ng() { :; }\nh() { :; }\n", 2},
+		{"quotes", `echo "foo" "" "$a" "a\$b" "it's" $"x"` + "\n", `echo 'foo' '' "$a" "a\$b" "it's" $"x"` + "\n", 2},
+		{"quotes", `echo "${a:-"b"}" ${a:-"b"} $(("1")) "$(echo "c")"` + "\n", `echo "${a:-"b"}" ${a:-'b'} $(("1")) "$(echo "c")"` + "\n", 1},
+		{"quotes", `a["k"]="v" b=("x" ["y"]="z")` + "\n", `a["k"]='v' b=('x' ["y"]='z')` + "\n", 3},
+		{"echo-printf", "echo\necho foo 'a b' \"c\"\n", "printf '\\n'\nprintf '%s\\n' 'foo a b c'\n", 2},
+		{"echo-printf", "echo -n foo\necho \"$a\"\necho *\necho 'a\\b'\necho \"'\"\n", "echo -n foo\necho \"$a\"\necho *\necho 'a\\b'\necho \"'\"\n", 0},
+		{"echo-printf", "echo() { :; }\necho foo\n", "echo() { :; }\necho foo\n", 0},
+	}
+	rules := make(map[string]fixRule)
+	for _, rule := range fixRules {
+		rules[rule.name] = rule
+	}
+	p := syntax.NewParser(syntax.KeepComments(true), syntax.RetainSource(true))
+	for i, tc := range tests {
+		f, err := p.Parse(strings.NewReader(tc.in), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		changes := rules[tc.rule].apply(f, p)
+		var buf bytes.Buffer
+		syntax.NewPrinter().Print(&buf, f)
+		if got := buf.String(); got != tc.want || changes != tc.changes {
+			t.Errorf("%03d: %s on %q:\nwant %d changes, %q\ngot  %d changes, %q",
+				i, tc.rule, tc.in, tc.changes, tc.want, changes, got)
+		}
+	}
+}
+
+// writeFixtureTree writes n shell scripts under dir, spread over a few
+// directories, to benchmark walking a large repository.
+func writeFixtureTree(tb testing.TB, dir string, n int) {
+	var buf bytes.Buffer
+	for i := 0; i < 50; i++ {
+		fmt.Fprintf(&buf, "foo_%d() {\n\tif [[ -n $bar ]]; then\n\t\techo \"$((i + %d))\" >out\n\tfi\n}\n", i, i)
+	}
+	for i := 0; i < n; i++ {
+		path := filepath.Join(dir, fmt.Sprintf("dir%d", i%10), fmt.Sprintf("file%d.sh", i))
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			tb.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, buf.Bytes(), 0666); err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+// benchmarkWalk walks dir with fn, like shfmt does for each path given.
+func benchmarkWalk(dir string, fn func(name, path string, checkShebang bool) error) func(*testing.B) {
+	return func(b *testing.B) {
+		onError := func(err error) { b.Fatal(err) }
+		for i := 0; i < b.N; i++ {
+			walk(dir, onError, fn)
+		}
+	}
+}
+
+// BenchmarkWalk compares walking a fixture tree by formatting it with -l, and
+// with -list-parse-errors-only, which should be faster as it skips printing.
+func BenchmarkWalk(b *testing.B) {
+	dir, err := ioutil.TempDir("", "shfmt-bench")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFixtureTree(b, dir, 200)
+	oldOut, oldList := out, *list
+	out, *list = ioutil.Discard, true
+	defer func() { out, *list = oldOut, oldList }()
+	b.Run("Format", benchmarkWalk(dir, formatPath))
+	b.Run("ParseErrors", benchmarkWalk(dir, checkParsePath))
+}
+
+// TestWatch runs -watch over a temporary directory, writing files while it
+// runs. It is not parallel, as it sets globals.
+func TestWatch(t *testing.T) {
+	tdir, err := ioutil.TempDir("", "shfmt-watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tdir)
+	writeFile := func(name, body string) {
+		path := filepath.Join(tdir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(body), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// waitFile waits until the file has the given contents.
+	waitFile := func(name, want string) {
+		path := filepath.Join(tdir, name)
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			got, _ := ioutil.ReadFile(path)
+			if string(got) == want {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("%s was not reformatted: %q", name, got)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+	writeFile("a.sh", "echo a\n")
+	writeFile("noext", "foo  bar\n")
+
+	var outBuf bytes.Buffer
+	oldOut, oldList, oldWrite := out, *list, *write
+	oldInterval, oldDebounce := watchInterval, watchDebounce
+	defer func() {
+		out, *list, *write = oldOut, oldList, oldWrite
+		watchInterval, watchDebounce = oldInterval, oldDebounce
+	}()
+	out, *list, *write = &outBuf, true, true
+	watchInterval, watchDebounce = 10*time.Millisecond, 30*time.Millisecond
+
+	var errs []string
+	onError := func(err error) { errs = append(errs, err.Error()) }
+	sigs := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	go func() {
+		watch([]string{tdir}, onError, sigs)
+		close(done)
+	}()
+	// Let the first walk see the files as they are.
+	time.Sleep(10 * watchInterval)
+
+	// Writing the same file many times in a row only formats it once.
+	for i := 0; i < 5; i++ {
+		writeFile("a.sh", "echo  a\n")
+	}
+	waitFile("a.sh", "echo a\n")
+
+	// New directories and files are picked up.
+	writeFile(filepath.Join("new", "b.sh"), "if  b; then c; fi\n")
+	waitFile(filepath.Join("new", "b.sh"), "if b; then c; fi\n")
+
+	// Files are found as when walking, such as via a shebang.
+	writeFile("noext", "#!/bin/sh\nfoo  bar\n")
+	waitFile("noext", "#!/bin/sh\nfoo bar\n")
+	writeFile(".hidden.sh", "foo  bar\n")
+	writeFile("other.txt", "foo  bar\n")
+	writeFile("broken.sh", "if a; then\n")
+	// Walk errors are only reported once, even if they persist.
+	if err := os.MkdirAll(filepath.Join(tdir, "bad", ".shfmtignore"), 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for a few more rounds, to check that our own writes don't
+	// trigger any more formatting.
+	time.Sleep(20 * watchInterval)
+	sigs <- os.Interrupt
+	<-done
+
+	want := strings.Join([]string{
+		filepath.Join(tdir, "a.sh"),
+		filepath.Join(tdir, "new", "b.sh"),
+		filepath.Join(tdir, "noext"),
+	}, "\n") + "\n"
+	if got := outBuf.String(); got != want {
+		t.Fatalf("wrong reformatted files:\nwant: %q\ngot:  %q", want, got)
+	}
+	for _, name := range []string{".hidden.sh", "other.txt"} {
+		if got, _ := ioutil.ReadFile(filepath.Join(tdir, name)); string(got) != "foo  bar\n" {
+			t.Fatalf("%s should not have been formatted: %q", name, got)
+		}
+	}
+	sort.Strings(errs)
+	if len(errs) != 2 || !strings.Contains(errs[0], ".shfmtignore") ||
+		!strings.Contains(errs[1], "broken.sh:1:1: if statement must end") {
+		t.Fatalf("want one error for bad/.shfmtignore and broken.sh, got %q", errs)
+	}
+}
+
+func TestLSP(t *testing.T) {
+	var in bytes.Buffer
+	send := func(msg string) {
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(msg), msg)
+	}
+	send(`{"jsonrpc": "2.0", "id": 1, "method": "initialize", "params": {}}`)
+	send(`{"jsonrpc": "2.0", "method": "initialized", "params": {}}`)
+	send(`{"jsonrpc": "2.0", "method": "textDocument/didOpen", "params": {"textDocument": {"uri": "untitled:a", "text": "foo  a\nfoo\nfoo  c\n"}}}`)
+	send(`{"jsonrpc": "2.0", "id": 2, "method": "textDocument/formatting", "params": {"textDocument": {"uri": "untitled:a"}}}`)
+	send(`{"jsonrpc": "2.0", "id": 3, "method": "textDocument/rangeFormatting", "params": {"textDocument": {"uri": "untitled:a"},
+		"range": {"start": {"line": 1, "character": 0}, "end": {"line": 2, "character": 3}}}}`)
+	send(`{"jsonrpc": "2.0", "method": "textDocument/didChange", "params": {"textDocument": {"uri": "untitled:a"}, "contentChanges": [{"text": "x='é𝄞' )\n"}]}}`)
+	send(`{"jsonrpc": "2.0", "id": 4, "method": "textDocument/formatting", "params": {"textDocument": {"uri": "untitled:a"}}}`)
+	send(`{"jsonrpc": "2.0", "method": "textDocument/didClose", "params": {"textDocument": {"uri": "untitled:a"}}}`)
+	send(`{"jsonrpc": "2.0", "id": 5, "method": "textDocument/hover", "params": {}}`)
+	send(`{"jsonrpc": "2.0", "id": 6, "method": "shutdown"}`)
+	send(`{"jsonrpc": "2.0", "method": "exit"}`)
+
+	var out bytes.Buffer
+	if status := runLSP(&in, &out); status != 0 {
+		t.Fatalf("want exit status 0, got %d", status)
+	}
+	want := []string{
+		`{"jsonrpc": "2.0", "id": 1, "result": {"capabilities": {
+			"textDocumentSync": {"openClose": true, "change": 1},
+			"documentFormattingProvider": true, "documentRangeFormattingProvider": true
+		}, "serverInfo": {"name": "shfmt", "version": "` + version + `"}}}`,
+		`{"jsonrpc": "2.0", "method": "textDocument/publishDiagnostics", "params": {"uri": "untitled:a", "diagnostics": []}}`,
+		`{"jsonrpc": "2.0", "id": 2, "result": [
+			{"range": {"start": {"line": 0, "character": 0}, "end": {"line": 1, "character": 0}}, "newText": "foo a\n"},
+			{"range": {"start": {"line": 2, "character": 0}, "end": {"line": 3, "character": 0}}, "newText": "foo c\n"}
+		]}`,
+		`{"jsonrpc": "2.0", "id": 3, "result": [
+			{"range": {"start": {"line": 2, "character": 0}, "end": {"line": 3, "character": 0}}, "newText": "foo c\n"}
+		]}`,
+		`{"jsonrpc": "2.0", "method": "textDocument/publishDiagnostics", "params": {"uri": "untitled:a", "diagnostics": [
+			{"range": {"start": {"line": 0, "character": 8}, "end": {"line": 0, "character": 8}},
+			"severity": 1, "source": "shfmt", "message": "a command can only contain words and redirects"}
+		]}}`,
+		`{"jsonrpc": "2.0", "id": 4, "result": null}`,
+		`{"jsonrpc": "2.0", "method": "textDocument/publishDiagnostics", "params": {"uri": "untitled:a", "diagnostics": []}}`,
+		`{"jsonrpc": "2.0", "id": 5, "error": {"code": -32601, "message": "method not found: textDocument/hover"}}`,
+		`{"jsonrpc": "2.0", "id": 6, "result": null}`,
+	}
+	s := &lspServer{r: bufio.NewReader(&out)}
+	for i, w := range want {
+		body, err := s.read()
+		if err != nil {
+			t.Fatalf("%d: %v", i, err)
+		}
+		var gotMsg, wantMsg interface{}
+		if err := json.Unmarshal(body, &gotMsg); err != nil {
+			t.Fatal(err)
+		}
+		if err := json.Unmarshal([]byte(w), &wantMsg); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(gotMsg, wantMsg) {
+			t.Fatalf("%d: unexpected message:\nwant: %s\ngot:  %s", i, w, body)
+		}
+	}
+	if body, err := s.read(); err != io.EOF {
+		t.Fatalf("want no more messages, got %s (%v)", body, err)
+	}
+}
@@ -0,0 +1,17 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package main
+
+import "os"
+
+// copyOwner does nothing, as files on this platform don't have Unix owners.
+func copyOwner(f *os.File, info os.FileInfo) bool { return true }
+
+// hardLinked always reports false, as the number of hard links isn't known.
+func hardLinked(info os.FileInfo) bool { return false }
+
+// syncDir does nothing, as directories can't be flushed on this platform.
+func syncDir(path string) {}
@@ -0,0 +1,45 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// copyOwner makes f owned by the same user and group as the file described by
+// info, reporting whether it succeeded. Only privileged users can give away
+// files, or change their group to one they aren't a member of.
+func copyOwner(f *os.File, info os.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return true
+	}
+	if int(st.Uid) == os.Geteuid() && int(st.Gid) == os.Getegid() {
+		return true // nothing to do
+	}
+	return f.Chown(int(st.Uid), int(st.Gid)) == nil
+}
+
+// hardLinked reports whether the file described by info has more than one
+// hard link.
+func hardLinked(info os.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && st.Nlink > 1
+}
+
+// syncDir flushes the entries of the directory at path to disk, such as after
+// renaming a file within it. Errors are ignored, as not all filesystems
+// support it.
+func syncDir(path string) {
+	if path == "" {
+		path = "."
+	}
+	if d, err := os.Open(path); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"mvdan.cc/sh/v3/fileutil"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+func init() {
+	flag.Var(&parseErrorsMode, "list-parse-errors-only", "")
+}
+
+// parseErrorsFlag is the value of -list-parse-errors-only, which can be given
+// without a value like a boolean flag. It is empty if the mode isn't enabled.
+type parseErrorsFlag string
+
+func (f *parseErrorsFlag) String() string { return string(*f) }
+
+func (f *parseErrorsFlag) Set(s string) error {
+	switch s {
+	case "true":
+		*f = "text"
+	case "false":
+		*f = ""
+	case "text", "json":
+		*f = parseErrorsFlag(s)
+	default:
+		return fmt.Errorf("unknown parse errors format: %s", s)
+	}
+	return nil
+}
+
+func (f *parseErrorsFlag) IsBoolFlag() bool { return true }
+
+var (
+	parseErrorsMode parseErrorsFlag
+
+	// parseErrorsLang is the language given via -ln or -style, if any.
+	// Otherwise, the language of each file is detected; see fileLang.
+	parseErrorsLang *syntax.LangVariant
+
+	parseErrorsParsers = make(map[syntax.LangVariant]*syntax.Parser)
+)
+
+// parseFailure is a file which failed to parse, as reported by
+// -list-parse-errors-only. Each one is a line of text, or a JSON record.
+type parseFailure struct {
+	Path    string `json:"path"`
+	Lang    string `json:"lang"`
+	Line    uint   `json:"line"`
+	Col     uint   `json:"col"`
+	Message string `json:"message"`
+}
+
+func (f *parseFailure) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s: %s", f.Path, f.Line, f.Col, f.Lang, f.Message)
+}
+
+// writeParseFailure reports a parse failure to w in the format given via
+// -list-parse-errors-only.
+func writeParseFailure(w io.Writer, f *parseFailure) error {
+	if parseErrorsMode == "json" {
+		return json.NewEncoder(w).Encode(f)
+	}
+	_, err := fmt.Fprintln(w, f)
+	return err
+}
+
+// checkParsePath parses the file at path, with the same arguments as
+// formatPath, returning a *parseFailure if it doesn't parse.
+func checkParsePath(name, path string, checkShebang bool) error {
+	src, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if checkShebang && !fileutil.HasShebang(src) {
+		return nil
+	}
+	if prog != nil {
+		prog.update(path)
+	}
+	return checkParseBytes(src, path)
+}
+
+// checkParseBytes parses src as the file at path, returning a *parseFailure if
+// it doesn't parse.
+func checkParseBytes(src []byte, path string) error {
+	_, src, err := splitBOM(src, path)
+	if err != nil {
+		return err
+	}
+	lang := fileLang(path, src)
+	p := parseErrorsParsers[lang]
+	if p == nil {
+		p = syntax.NewParser(syntax.Variant(lang))
+		parseErrorsParsers[lang] = p
+	}
+	_, err = p.Parse(bytes.NewReader(src), path)
+	f := &parseFailure{Path: path, Lang: lang.String()}
+	switch err := err.(type) {
+	case nil:
+		return nil
+	case syntax.ParseError:
+		f.Line, f.Col, f.Message = err.Pos.Line(), err.Pos.Col(), err.Text
+	case syntax.LangError:
+		f.Line, f.Col = err.Pos.Line(), err.Pos.Col()
+		// Drop the "path:line:col: " prefix.
+		err.Filename = ""
+		f.Message = strings.TrimPrefix(err.Error(), err.Pos.String()+": ")
+	default:
+		return err
+	}
+	return f
+}
+
+// fileLang returns the language to parse the file at path with. Unless one was
+// given, it is detected via detectLang.
+func fileLang(path string, src []byte) syntax.LangVariant {
+	if parseErrorsLang != nil {
+		return *parseErrorsLang
+	}
+	return detectLang(path, src)
+}
+
+// checkParseStdin is like checkParseBytes, for standard input.
+func checkParseStdin() error {
+	src, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	return checkParseBytes(src, stdinPath())
+}
+
+// parseErrorsFlagsErr returns an error if -list-parse-errors-only is used with
+// any flags to print or write files, which it never does.
+func parseErrorsFlagsErr() error {
+	for _, name := range []string{"l", "w", "d", "f", "tojson", "tohtml"} {
+		if flag.Lookup(name).Value.String() == "true" {
+			return fmt.Errorf("-list-parse-errors-only cannot be used with -%s", name)
+		}
+	}
+	return nil
+}
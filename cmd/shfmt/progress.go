@@ -0,0 +1,168 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"mvdan.cc/sh/v3/fileutil"
+)
+
+func init() {
+	flag.Var(&progressMode, "progress", "")
+}
+
+// progressFlag is the value of -progress, which can be given without a value
+// like a boolean flag. It is empty if progress isn't reported.
+type progressFlag string
+
+func (f *progressFlag) String() string { return string(*f) }
+
+func (f *progressFlag) Set(s string) error {
+	switch s {
+	case "true":
+		*f = "total"
+	case "false":
+		*f = ""
+	case "nototal":
+		*f = progressFlag(s)
+	default:
+		return fmt.Errorf("unknown progress mode: %s", s)
+	}
+	return nil
+}
+
+func (f *progressFlag) IsBoolFlag() bool { return true }
+
+// progressInterval is the minimum time between two progress reports, so that
+// they don't slow down formatting many small files.
+const progressInterval = 200 * time.Millisecond
+
+// progress reports how many of the files being walked have been formatted. On
+// a terminal, it keeps a single line updated; otherwise, it writes a JSON
+// record per line, as described in progressRecord.
+type progress struct {
+	w        io.Writer
+	terminal bool
+
+	total int // -1 if not counted
+	done  int
+	path  string // being formatted
+
+	start, last time.Time
+	shown       bool // whether the terminal line is showing
+}
+
+// progressRecord is a progress report written as JSON. The last record, written
+// once all files are done, has no path.
+type progressRecord struct {
+	Done    int     `json:"done"`
+	Total   *int    `json:"total,omitempty"`
+	Path    string  `json:"path,omitempty"`
+	Elapsed float64 `json:"elapsed"` // in seconds
+}
+
+// newProgress sets up reporting the progress of walking paths to w. If total
+// is true, the files under paths are counted first, like -f would find them.
+func newProgress(w io.Writer, paths []string, total bool) *progress {
+	p := &progress{w: w, total: -1, start: time.Now()}
+	if f, ok := w.(*os.File); ok && terminal.IsTerminal(int(f.Fd())) {
+		p.terminal = os.Getenv("TERM") != "dumb"
+	}
+	if total {
+		p.total = 0
+		count := func(name, path string, checkShebang bool) error {
+			if !checkShebang || isShebangFile(path) {
+				p.total++
+			}
+			return nil
+		}
+		for _, path := range paths {
+			// Errors are reported once, when formatting.
+			walk(path, func(error) {}, count)
+		}
+	}
+	return p
+}
+
+// isShebangFile reports whether the file at path starts with a shell shebang.
+func isShebangFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	var buf [128]byte
+	n, _ := f.Read(buf[:])
+	return fileutil.HasShebang(buf[:n])
+}
+
+// update is called when the file at path starts being formatted. The previous
+// file, if any, is then done.
+func (p *progress) update(path string) {
+	if p.path != "" {
+		p.done++
+	}
+	p.path = path
+	now := time.Now()
+	if now.Sub(p.last) < progressInterval {
+		return
+	}
+	p.last = now
+	p.report(now)
+}
+
+// finish reports the final progress, once all files are done.
+func (p *progress) finish() {
+	if p.path != "" {
+		p.done++
+	}
+	p.path = ""
+	p.report(time.Now())
+	if p.terminal {
+		fmt.Fprintln(p.w)
+	}
+}
+
+// clear clears the terminal line, so that an error can be printed instead. The
+// line is shown again with the next report.
+func (p *progress) clear() {
+	if p.terminal && p.shown {
+		fmt.Fprint(p.w, "\r\x1b[K")
+		p.shown = false
+	}
+}
+
+func (p *progress) report(now time.Time) {
+	elapsed := now.Sub(p.start)
+	if !p.terminal {
+		rec := progressRecord{
+			Done:    p.done,
+			Path:    p.path,
+			Elapsed: float64(elapsed/time.Millisecond) / 1000,
+		}
+		if p.total >= 0 {
+			rec.Total = &p.total
+		}
+		json.NewEncoder(p.w).Encode(rec)
+		return
+	}
+	line := fmt.Sprintf("%d", p.done)
+	if p.total >= 0 {
+		line += fmt.Sprintf("/%d", p.total)
+	}
+	line += fmt.Sprintf(" files, %s", elapsed.Round(100*time.Millisecond))
+	if p.path != "" {
+		line += ": " + p.path
+	}
+	fmt.Fprint(p.w, "\r\x1b[K", line)
+	p.shown = true
+}
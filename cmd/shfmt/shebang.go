@@ -0,0 +1,238 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// shebang is a shebang line which gives options to a shell, like
+// "#!/bin/bash -eu" or "#!/usr/bin/env bash -e".
+type shebang struct {
+	// line is the entire first line, and keep is the prefix of it which
+	// remains once the options are removed.
+	line, keep string
+
+	// envArg is set if the shell is run via env, such as in
+	// "#!/usr/bin/env bash -e". Linux passes all the text after the
+	// interpreter as a single argument like "bash -e", so env looks for a
+	// program by that name, which doesn't exist.
+	envArg string
+
+	// opts holds the options in the form used by optionSet, or is nil if
+	// any of the arguments isn't an option which set also accepts.
+	opts []string
+}
+
+// setLetters are the single-letter options which may be given both to a shell
+// and to its set builtin.
+const setLetters = "aefhuvxBCEHPT"
+
+// parseShebang returns the shebang at the start of src, or nil if there is no
+// shebang which gives arguments to a shell. Shebangs like
+// "#!/usr/bin/env -S bash -e" are ignored, as they work as expected.
+func parseShebang(src []byte) *shebang {
+	if !bytes.HasPrefix(src, []byte("#!")) {
+		return nil
+	}
+	line := string(src)
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	type field struct {
+		s          string
+		start, end int
+	}
+	var fields []field
+	for i := 2; i < len(line); {
+		if line[i] == ' ' || line[i] == '\t' {
+			i++
+			continue
+		}
+		j := i
+		for j < len(line) && line[j] != ' ' && line[j] != '\t' {
+			j++
+		}
+		fields = append(fields, field{line[i:j], i, j})
+		i = j
+	}
+	sb := &shebang{line: line}
+	if len(fields) > 0 && path.Base(fields[0].s) == "env" {
+		if len(fields) < 2 || strings.HasPrefix(fields[1].s, "-") {
+			// env -S splits the arguments itself
+			return nil
+		}
+		fields = fields[1:]
+		sb.envArg = strings.TrimRight(line[fields[0].start:], " \t")
+	}
+	if len(fields) < 2 || !strings.HasSuffix(path.Base(fields[0].s), "sh") {
+		return nil
+	}
+	sb.keep = line[:fields[0].end]
+	args := make([]string, len(fields)-1)
+	for i, f := range fields[1:] {
+		args[i] = f.s
+	}
+	sb.opts, _ = parseSetOpts(args, setLetters)
+	return sb
+}
+
+// parseSetOpts parses the arguments to set or to a shell, returning each of
+// the options as a single letter like "e", or as "o name" for the -o form. ok
+// is false if any argument isn't one of the given letters or -o.
+func parseSetOpts(args []string, letters string) (opts []string, ok bool) {
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if len(arg) < 2 || arg[0] != '-' || arg == "--" {
+			return nil, false
+		}
+		for _, c := range arg[1:] {
+			switch {
+			case c == 'o':
+				if i++; i >= len(args) {
+					return nil, false
+				}
+				opts = append(opts, "o "+args[i])
+			case strings.ContainsRune(letters, c):
+				opts = append(opts, string(c))
+			default:
+				return nil, false
+			}
+		}
+	}
+	return opts, true
+}
+
+// optionNames maps the single-letter options to their long names, as the same
+// option may be given in either form.
+var optionNames = map[string]string{
+	"a": "allexport", "b": "notify", "e": "errexit", "f": "noglob",
+	"h": "hashall", "k": "keyword", "m": "monitor", "n": "noexec",
+	"p": "privileged", "t": "onecmd", "u": "nounset", "v": "verbose",
+	"x": "xtrace", "B": "braceexpand", "C": "noclobber", "E": "errtrace",
+	"H": "histexpand", "P": "physical", "T": "functrace",
+}
+
+// optionName returns the long name of an option like "e" or "o errexit".
+func optionName(opt string) string {
+	if name, ok := optionNames[opt]; ok {
+		return name
+	}
+	return strings.TrimPrefix(opt, "o ")
+}
+
+// optionSet formats options like "e" and "o pipefail" as arguments to set,
+// such as "-eo pipefail".
+func optionSet(opts []string) string {
+	letters := "-"
+	var names []string
+	for _, opt := range opts {
+		if strings.HasPrefix(opt, "o ") {
+			names = append(names, opt[2:])
+		} else {
+			letters += opt
+		}
+	}
+	var args []string
+	if len(names) > 0 {
+		args = append(args, letters+"o "+names[0])
+		for _, name := range names[1:] {
+			args = append(args, "-o "+name)
+		}
+	} else {
+		args = append(args, letters)
+	}
+	return strings.Join(args, " ")
+}
+
+// moveShebangOpts moves the options given to the shell in the shebang of a
+// program into a set line, returning the new source. The options are added to
+// the first of the set commands at the start of the program if there are any,
+// and are otherwise set on a new line right after the shebang. Options which
+// are already set there are not repeated.
+//
+// The returned source is nil if there are no options to move, or if the
+// shebang has arguments which are not options that set accepts.
+func moveShebangOpts(src []byte, f *syntax.File) []byte {
+	sb := parseShebang(src)
+	if sb == nil || sb.opts == nil {
+		return nil
+	}
+	var target *syntax.Stmt
+	done := make(map[string]bool)
+	for _, stmt := range f.Stmts {
+		opts, ok := setCommand(stmt)
+		if !ok {
+			break
+		}
+		if target == nil {
+			target = stmt
+		}
+		for _, opt := range opts {
+			done[optionName(opt)] = true
+		}
+	}
+	var add []string
+	for _, opt := range sb.opts {
+		if name := optionName(opt); !done[name] {
+			add = append(add, opt)
+			done[name] = true
+		}
+	}
+	var buf bytes.Buffer
+	buf.WriteString(sb.keep)
+	rest := src[len(sb.line):]
+	switch {
+	case len(add) == 0:
+		buf.Write(rest)
+	case target != nil:
+		end := int(target.Cmd.End().Offset()) - len(sb.line)
+		buf.Write(rest[:end])
+		buf.WriteString(" " + optionSet(add))
+		buf.Write(rest[end:])
+	default:
+		buf.WriteString("\nset " + optionSet(add))
+		buf.Write(rest)
+	}
+	return buf.Bytes()
+}
+
+// setCommand reports whether a statement is a plain set command which only
+// enables options, returning them.
+func setCommand(stmt *syntax.Stmt) ([]string, bool) {
+	call, ok := stmt.Cmd.(*syntax.CallExpr)
+	if !ok || len(call.Assigns) > 0 || len(call.Args) < 2 ||
+		len(stmt.Redirs) > 0 || stmt.Negated || stmt.Background || stmt.Coprocess ||
+		call.Args[0].Lit() != "set" {
+		return nil, false
+	}
+	args := make([]string, len(call.Args)-1)
+	for i, word := range call.Args[1:] {
+		if args[i] = word.Lit(); args[i] == "" {
+			return nil, false
+		}
+	}
+	// allow any letter, as these options aren't being moved
+	return parseSetOpts(args, "abefhkmnptuvxBCEHPT")
+}
+
+// shebangWarnings returns a warning if a program's shebang gives multiple
+// arguments to env, which doesn't work on Linux.
+func shebangWarnings(src []byte, path string) []string {
+	sb := parseShebang(src)
+	if sb == nil || sb.envArg == "" {
+		return nil
+	}
+	prefix := ""
+	if path != "" {
+		prefix = path + ":"
+	}
+	return []string{fmt.Sprintf(`%s1:1: warning: env gets %q as a single argument on Linux; use "env -S" or a set line`,
+		prefix, sb.envArg)}
+}
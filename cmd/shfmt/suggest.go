@@ -0,0 +1,104 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// unclosedRe matches the parse errors about a construct missing its closing
+// word, which is captured.
+var unclosedRe = regexp.MustCompile(`^(?:\w+ statement must end with "(\w+)"|reached \S+ without matching [{(] with ([})]))$`)
+
+// suggestedParseError is a parse error followed by a line from suggestCloser.
+type suggestedParseError struct {
+	syntax.ParseError
+	guess string
+}
+
+func (e suggestedParseError) Error() string {
+	return fmt.Sprintf("%v\n%s", e.ParseError, e.guess)
+}
+
+// suggestCloser returns a line guessing where the closing word missing in a
+// parse error belongs, or an empty string if the error is of another kind.
+//
+// The guess is based on indentation alone: the closing word is assumed to
+// belong after the last line that is indented deeper than the line opening
+// the construct.
+func suggestCloser(src []byte, perr syntax.ParseError) string {
+	m := unclosedRe.FindStringSubmatch(perr.Text)
+	if m == nil {
+		return ""
+	}
+	closer := m[1] + m[2]
+	lines := strings.Split(string(src), "\n")
+	start := int(perr.Pos.Line()) - 1
+	if start < 0 || start >= len(lines) {
+		return ""
+	}
+	base := indentWidth(lines[start])
+	last := start
+	for i := start + 1; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		if width := indentWidth(lines[i]); width < base ||
+			(width == base && !continuesClause(closer, line)) {
+			break
+		}
+		last = i
+	}
+	prefix := ""
+	if perr.Filename != "" {
+		prefix = perr.Filename + ":"
+	}
+	return fmt.Sprintf("%s%d:1: guess based on indentation: %q may be missing after this line",
+		prefix, last+1, closer)
+}
+
+// indentWidth returns the width of a line's indentation, with tab stops every
+// eight columns.
+func indentWidth(line string) int {
+	width := 0
+	for _, c := range line {
+		switch c {
+		case ' ':
+			width++
+		case '\t':
+			width += 8 - width%8
+		default:
+			return width
+		}
+	}
+	return width
+}
+
+// continuesClause reports whether a line indented like the start of a
+// construct is still part of it, such as "else" in an if clause.
+func continuesClause(closer, line string) bool {
+	word := line
+	if i := strings.IndexAny(line, " \t;"); i >= 0 {
+		word = line[:i]
+	}
+	switch closer {
+	case "fi":
+		return word == "then" || word == "elif" || word == "else"
+	case "done":
+		return word == "do"
+	case "esac":
+		switch word {
+		case "fi", "done", "}", "esac":
+			return false
+		}
+		// case patterns and their terminators are often not indented
+		return strings.HasPrefix(line, ";;") || strings.Contains(line, ")")
+	}
+	return false
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"time"
+)
+
+var showSummary bool
+
+func init() {
+	flag.BoolVar(&showSummary, "summary", false, "")
+	flag.BoolVar(&showSummary, "v", false, "")
+}
+
+// fileStats is what happened to a single file, as recorded by a worker.
+type fileStats struct {
+	ignored bool // via a shfmt:ignore directive
+	parsed  bool
+	changed bool // its formatting differs
+}
+
+// summary counts what happened to the files during a run, to be reported at
+// the end of it with -summary.
+type summary struct {
+	start time.Time
+
+	scanned int // found by walking or given, including those skipped
+	skipped int // without a shell shebang
+	ignored int
+	parsed  int
+	changed int
+	failed  int
+}
+
+// sum collects the summary, if -summary was given.
+var sum *summary
+
+// add records a file which was scanned, unless path is empty, such as for an
+// error found while walking. formatted is false if the file was skipped for
+// not having a shell shebang.
+func (s *summary) add(path string, formatted bool, stats fileStats, err error) {
+	if path != "" {
+		s.scanned++
+		switch {
+		case !formatted && err == nil:
+			s.skipped++
+		case stats.ignored:
+			s.ignored++
+		case stats.parsed:
+			s.parsed++
+		}
+		if stats.changed {
+			s.changed++
+		}
+	}
+	if isFailure(err) {
+		s.failed++
+	}
+}
+
+// isFailure reports whether err means that a file couldn't be formatted, as
+// opposed to one reporting that its formatting differs.
+func isFailure(err error) bool {
+	if err == nil || err == errChanged {
+		return false
+	}
+	if d, ok := err.(*diagnostic); ok && d.Rule == "format" {
+		return false
+	}
+	return true
+}
+
+func (s *summary) write(w io.Writer) error {
+	_, err := fmt.Fprintf(w, "%d files scanned, %d parsed, %d changed, %d skipped by shebang, %d ignored, %d failed in %s\n",
+		s.scanned, s.parsed, s.changed, s.skipped, s.ignored, s.failed,
+		time.Since(s.start).Round(time.Millisecond))
+	return err
+}
@@ -0,0 +1,234 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"unicode/utf8"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// confusable is a character which is easily pasted into a script from a
+// document or a chat message, and which looks like a blank or an ASCII quote
+// but isn't one to the shell.
+type confusable struct {
+	name string
+
+	// fix is what -fix-unicode replaces the character with.
+	fix string
+}
+
+var confusables = map[rune]confusable{
+	'\u00a0': {"NO-BREAK SPACE", " "},
+	'\u2000': {"EN QUAD", " "},
+	'\u2001': {"EM QUAD", " "},
+	'\u2002': {"EN SPACE", " "},
+	'\u2003': {"EM SPACE", " "},
+	'\u2004': {"THREE-PER-EM SPACE", " "},
+	'\u2005': {"FOUR-PER-EM SPACE", " "},
+	'\u2006': {"SIX-PER-EM SPACE", " "},
+	'\u2007': {"FIGURE SPACE", " "},
+	'\u2008': {"PUNCTUATION SPACE", " "},
+	'\u2009': {"THIN SPACE", " "},
+	'\u200a': {"HAIR SPACE", " "},
+	'\u202f': {"NARROW NO-BREAK SPACE", " "},
+	'\u205f': {"MEDIUM MATHEMATICAL SPACE", " "},
+	'\u3000': {"IDEOGRAPHIC SPACE", " "},
+
+	'\u00ad': {"SOFT HYPHEN", ""},
+	'\u200b': {"ZERO WIDTH SPACE", ""},
+	'\u200c': {"ZERO WIDTH NON-JOINER", ""},
+	'\u200d': {"ZERO WIDTH JOINER", ""},
+	'\u2060': {"WORD JOINER", ""},
+	'\ufeff': {"ZERO WIDTH NO-BREAK SPACE", ""},
+
+	'\u2018': {"LEFT SINGLE QUOTATION MARK", "'"},
+	'\u2019': {"RIGHT SINGLE QUOTATION MARK", "'"},
+	'\u201c': {"LEFT DOUBLE QUOTATION MARK", `"`},
+	'\u201d': {"RIGHT DOUBLE QUOTATION MARK", `"`},
+}
+
+func (c confusable) isQuote() bool { return c.fix == "'" || c.fix == `"` }
+
+func (c confusable) problem() string {
+	switch c.fix {
+	case " ":
+		return "is not a blank to the shell"
+	case "":
+		return "is invisible, but part of a word"
+	}
+	return "is not a shell quote"
+}
+
+// confusableAt is a confusable character at an offset in a file's source.
+type confusableAt struct {
+	offset int
+	r      rune
+}
+
+// checkUnicode reports the confusable characters in the code of a program,
+// leaving out those in comments, heredoc bodies, and the contents of quoted
+// strings. With -fix-unicode, they are replaced instead.
+//
+// prog is the syntax tree of src, or nil if src failed to parse. The returned
+// source and syntax tree are those of the fixed program, or src and prog if
+// nothing was fixed.
+func (wk *worker) checkUnicode(src []byte, prog *syntax.File, path string) ([]byte, *syntax.File, error) {
+	found := findConfusables(src)
+	if len(found) == 0 {
+		return src, prog, nil
+	}
+	tree := prog
+	if tree == nil {
+		// The characters may well be why the source failed to parse,
+		// like in "if x;\u00a0then". Parse it with blanks in their
+		// place to tell where they are.
+		tree, _ = wk.parser.Parse(bytes.NewReader(blankConfusables(src, found)), path)
+	}
+	if tree != nil {
+		found = confusablesInCode(found, tree)
+		if *fixUnicode && len(found) > 0 {
+			fixed, fixedProg, err := wk.fixUnicodeChars(src, found, path)
+			if err != nil {
+				return src, prog, err
+			}
+			src, prog = fixed, fixedProg
+			// quotes which could not be replaced are still reported
+			found = confusablesInCode(findConfusables(src), prog)
+		}
+	}
+	for _, warn := range unicodeWarnings(src, found, path) {
+		fmt.Fprintln(wk.errOut, warn)
+	}
+	return src, prog, nil
+}
+
+// findConfusables returns all the confusable characters in src.
+func findConfusables(src []byte) []confusableAt {
+	var found []confusableAt
+	for i := 0; i < len(src); {
+		r, size := utf8.DecodeRune(src[i:])
+		if _, ok := confusables[r]; ok {
+			found = append(found, confusableAt{i, r})
+		}
+		i += size
+	}
+	return found
+}
+
+// confusablesInCode returns the characters which are part of the code of a
+// program, given its syntax tree.
+func confusablesInCode(found []confusableAt, f *syntax.File) []confusableAt {
+	// Nodes whose contents aren't code, like quoted strings, may contain
+	// nodes which are code again, like command substitutions. The innermost
+	// one decides.
+	type region struct {
+		start, end int
+		code       bool
+	}
+	var regions []region
+	add := func(node syntax.Node, code bool) {
+		regions = append(regions, region{int(node.Pos().Offset()), int(node.End().Offset()), code})
+	}
+	syntax.Walk(f, func(node syntax.Node) bool {
+		switch x := node.(type) {
+		case *syntax.SglQuoted, *syntax.DblQuoted, *syntax.Comment:
+			add(x, false)
+		case *syntax.CmdSubst, *syntax.ProcSubst:
+			add(x, true)
+		case *syntax.Redirect:
+			if x.Hdoc != nil {
+				add(x.Hdoc, false)
+			}
+		}
+		return true
+	})
+	var inCode []confusableAt
+	for _, c := range found {
+		code, size := true, -1
+		for _, r := range regions {
+			if r.start <= c.offset && c.offset < r.end && (size < 0 || r.end-r.start < size) {
+				code, size = r.code, r.end-r.start
+			}
+		}
+		if code {
+			inCode = append(inCode, c)
+		}
+	}
+	return inCode
+}
+
+// unicodeWarnings returns a warning for each confusable character.
+func unicodeWarnings(src []byte, found []confusableAt, path string) []string {
+	prefix := ""
+	if path != "" {
+		prefix = path + ":"
+	}
+	var warns []string
+	line, lineStart := 1, 0
+	for _, c := range found {
+		for i := lineStart; i < c.offset; i++ {
+			if src[i] == '\n' {
+				line++
+				lineStart = i + 1
+			}
+		}
+		conf := confusables[c.r]
+		warns = append(warns, fmt.Sprintf("%s%d:%d: warning: U+%04X %s %s",
+			prefix, line, c.offset-lineStart+1, c.r, conf.name, conf.problem()))
+	}
+	return warns
+}
+
+// blankConfusables returns a copy of src with each of the confusable
+// characters which aren't quotes replaced by as many spaces as its bytes, so
+// that the offsets in the copy are the same.
+func blankConfusables(src []byte, found []confusableAt) []byte {
+	blanked := append([]byte(nil), src...)
+	for _, c := range found {
+		if !confusables[c.r].isQuote() {
+			for i := 0; i < utf8.RuneLen(c.r); i++ {
+				blanked[c.offset+i] = ' '
+			}
+		}
+	}
+	return blanked
+}
+
+// fixConfusables returns a copy of src with the confusable characters replaced
+// by blanks and ASCII quotes, or removed if they are invisible. Quotes are only
+// replaced if quotes is true.
+func fixConfusables(src []byte, found []confusableAt, quotes bool) []byte {
+	var buf bytes.Buffer
+	last := 0
+	for _, c := range found {
+		conf := confusables[c.r]
+		if conf.isQuote() && !quotes {
+			continue
+		}
+		buf.Write(src[last:c.offset])
+		buf.WriteString(conf.fix)
+		last = c.offset + utf8.RuneLen(c.r)
+	}
+	buf.Write(src[last:])
+	return buf.Bytes()
+}
+
+// fixUnicodeChars replaces the confusable characters found in src and parses
+// the result. Curly quotes are left alone if replacing them would make the
+// program fail to parse, like in "echo it\u2019s".
+func (wk *worker) fixUnicodeChars(src []byte, found []confusableAt, path string) ([]byte, *syntax.File, error) {
+	fixed := fixConfusables(src, found, true)
+	prog, err := wk.parser.Parse(bytes.NewReader(fixed), path)
+	if err == nil {
+		return fixed, prog, nil
+	}
+	fixed = fixConfusables(src, found, false)
+	if prog, err = wk.parser.Parse(bytes.NewReader(fixed), path); err != nil {
+		return nil, nil, fmt.Errorf("-fix-unicode would break the program: %v", err)
+	}
+	return fixed, prog, nil
+}
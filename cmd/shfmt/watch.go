@@ -0,0 +1,138 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"os"
+	"sort"
+	"time"
+)
+
+var (
+	// watchInterval is how often the paths given to -watch are checked for
+	// changes.
+	watchInterval = 250 * time.Millisecond
+
+	// watchDebounce is how long a changed file must stay unchanged before it
+	// is formatted, so that rapid successive writes only format it once.
+	watchDebounce = 100 * time.Millisecond
+)
+
+// watchedFile is the state of a file being watched, as found by walk.
+type watchedFile struct {
+	name         string
+	checkShebang bool
+
+	modTime time.Time
+	size    int64
+
+	// changed is when the file was last seen to change, or the zero time
+	// if it hasn't changed since it was last formatted.
+	changed time.Time
+}
+
+// watch keeps on checking the files under roots for changes, formatting each
+// file once it has changed and then stayed unchanged for watchDebounce. New
+// files are treated as changed, so that files in new directories are picked up
+// too. It returns once a signal is received from sigs.
+//
+// Files are checked by polling, as it works the same everywhere. The walk skips
+// the same files as when formatting, and files only format if they have a
+// shell shebang when one is required. Errors from the walk are only reported
+// once, until they change or go away.
+func watch(roots []string, onError func(error), sigs <-chan os.Signal) {
+	// reported holds the last error reported for each path, so that the
+	// same errors aren't reported again on every walk.
+	reported := make(map[string]string)
+	scan := func(prev map[string]*watchedFile, now time.Time) map[string]*watchedFile {
+		seen := make(map[string]string)
+		files := scanWatched(roots, func(err error) {
+			path, msg := errorPath(err), err.Error()
+			if path == "" {
+				path = msg
+			}
+			if reported[path] != msg && seen[path] != msg {
+				onError(err)
+			}
+			seen[path] = msg
+		}, prev, now)
+		reported = seen
+		return files
+	}
+	files := scan(nil, time.Time{})
+	ticker := time.NewTicker(watchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-sigs:
+			return
+		case now := <-ticker.C:
+			files = scan(files, now)
+			var ready []string
+			for path, f := range files {
+				if !f.changed.IsZero() && now.Sub(f.changed) >= watchDebounce {
+					ready = append(ready, path)
+				}
+			}
+			sort.Strings(ready)
+			for _, path := range ready {
+				f := files[path]
+				if err := formatPath(f.name, path, f.checkShebang); err != nil {
+					onError(err)
+				}
+				// Our own writes must not count as changes.
+				f.changed = time.Time{}
+				if info, err := os.Stat(path); err == nil {
+					f.modTime, f.size = info.ModTime(), info.Size()
+				}
+			}
+		}
+	}
+}
+
+// scanWatched walks roots and returns the state of the files found. Files which
+// are new or differ from those in prev are marked as changed at now, unless
+// prev is nil, meaning that the state is being set up for the first time.
+func scanWatched(roots []string, onError func(error), prev map[string]*watchedFile, now time.Time) map[string]*watchedFile {
+	files := make(map[string]*watchedFile, len(prev))
+	// Files may be removed while walking; that's not an error.
+	scanError := func(err error) {
+		if !os.IsNotExist(err) {
+			onError(err)
+		}
+	}
+	for _, root := range roots {
+		walk(root, scanError, func(name, path string, checkShebang bool) error {
+			info, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			f := &watchedFile{
+				name:         name,
+				checkShebang: checkShebang,
+				modTime:      info.ModTime(),
+				size:         info.Size(),
+			}
+			if old := prev[path]; old != nil {
+				f.changed = old.changed
+				if !f.modTime.Equal(old.modTime) || f.size != old.size {
+					f.changed = now
+				}
+			} else if prev != nil {
+				f.changed = now
+			}
+			files[path] = f
+			return nil
+		})
+	}
+	return files
+}
+
+// errorPath returns the path which an error is about, if it is known.
+func errorPath(err error) string {
+	if err, ok := err.(*os.PathError); ok {
+		return err.Path
+	}
+	return ""
+}
@@ -0,0 +1,164 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"os"
+	"runtime"
+	"sync"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+var numWorkers = flag.Uint("j", 0, "")
+
+// worker formats files with its own parser, printer, and buffers, as those
+// can't be shared between goroutines.
+type worker struct {
+	conf    *formatConfig
+	parser  *syntax.Parser
+	printer *syntax.Printer
+
+	readBuf, writeBuf bytes.Buffer
+	copyBuf           []byte
+
+	// out and errOut are where the output and the warnings for the file
+	// being formatted are written to.
+	out, errOut io.Writer
+
+	stats fileStats // for the file being formatted
+}
+
+func newWorker(out, errOut io.Writer) *worker {
+	wk := &worker{copyBuf: make([]byte, 32*1024), out: out, errOut: errOut}
+	wk.setConfig(config)
+	return wk
+}
+
+// setConfig sets up the worker's parser and printer for a configuration,
+// unless they were set up for it already.
+func (wk *worker) setConfig(conf *formatConfig) {
+	if conf == wk.conf {
+		return
+	}
+	wk.conf = conf
+	wk.parser = syntax.NewParser(conf.parserOpts...)
+	wk.printer = syntax.NewPrinter(conf.printerOpts...)
+}
+
+// formatJob is a file to be formatted by a worker. Its output and warnings
+// are kept until they can be written in the order in which files were found.
+type formatJob struct {
+	name, path   string
+	checkShebang bool
+	conf         *formatConfig
+
+	formatted   bool
+	stats       fileStats
+	out, errOut bytes.Buffer
+	err         error
+
+	done chan struct{} // closed once the fields above are set
+}
+
+// formatPaths formats the files under paths with -j workers, calling onError
+// with each error. Files are formatted concurrently, but their output, any
+// warnings, and errors are written in the same order as if they had been
+// formatted one at a time.
+//
+// EditorConfig files are applied while walking, so that each file is
+// formatted with the configuration set up for it.
+func formatPaths(paths []string, onError func(error)) {
+	n := int(*numWorkers)
+	if n == 0 {
+		n = runtime.GOMAXPROCS(0)
+	}
+	jobs := make(chan *formatJob)
+	// results has the jobs in walk order, including errors found while
+	// walking, and limits how many may be waiting to be written.
+	results := make(chan *formatJob, 4*n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		wk := newWorker(nil, nil)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				wk.setConfig(job.conf)
+				wk.out, wk.errOut = &job.out, &job.errOut
+				job.formatted, job.err = wk.formatPath(job.name, job.path, job.checkShebang)
+				job.stats = wk.stats
+				close(job.done)
+			}
+		}()
+	}
+	go func() {
+		walkError := func(err error) {
+			job := &formatJob{err: err, done: make(chan struct{})}
+			close(job.done)
+			results <- job
+		}
+		for _, root := range paths {
+			walk(root, walkError, func(name, path string, checkShebang bool) error {
+				if err := applyEditorConfig(path); err != nil {
+					return err
+				}
+				job := &formatJob{
+					name:         name,
+					path:         path,
+					checkShebang: checkShebang,
+					conf:         config,
+					done:         make(chan struct{}),
+				}
+				results <- job
+				jobs <- job
+				return nil
+			})
+		}
+		close(jobs)
+		close(results)
+	}()
+	for job := range results {
+		<-job.done
+		if job.formatted && prog != nil {
+			prog.update(job.path)
+		}
+		if sum != nil {
+			sum.add(job.path, job.formatted, job.stats, job.err)
+		}
+		if job.errOut.Len() > 0 {
+			if prog != nil {
+				prog.clear()
+			}
+			os.Stderr.Write(job.errOut.Bytes())
+		}
+		out.Write(job.out.Bytes())
+		if job.err != nil {
+			onError(job.err)
+		}
+	}
+	wg.Wait()
+}
+
+// seqWorker formats files one at a time, for formatPath.
+var seqWorker *worker
+
+// formatPath formats the file at path with the configuration set up for it,
+// writing directly to the output. It is used to format files one at a time,
+// such as with -watch.
+func formatPath(name, path string, checkShebang bool) error {
+	if err := applyEditorConfig(path); err != nil {
+		return err
+	}
+	if seqWorker == nil {
+		seqWorker = newWorker(nil, nil)
+	}
+	seqWorker.setConfig(config)
+	seqWorker.out, seqWorker.errOut = out, os.Stderr
+	_, err := seqWorker.formatPath(name, path, checkShebang)
+	return err
+}
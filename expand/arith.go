@@ -4,12 +4,35 @@
 package expand
 
 import (
+	"bytes"
 	"fmt"
 	"strconv"
+	"strings"
 
 	"mvdan.cc/sh/v3/syntax"
 )
 
+// ArithmError is returned by Arithm when an expression cannot be evaluated,
+// such as when dividing by zero.
+type ArithmError struct {
+	// Node is the part of the expression which failed, like "x / 0".
+	Node    syntax.ArithmExpr
+	Message string
+}
+
+func (e ArithmError) Error() string {
+	var buf bytes.Buffer
+	syntax.NewPrinter().Print(&buf, e.Node)
+	return fmt.Sprintf("%s: %s: %s", e.Node.Pos(), buf.String(), e.Message)
+}
+
+// Arithm evaluates an arithmetic expression. Like in Bash, integers wrap around
+// on overflow, and the && and || operators only evaluate their right operand
+// when needed.
+//
+// Assignments like "x += 2" and "a[i]++" update the variables in cfg.Env,
+// which must then implement WriteEnviron. An ArithmError is returned if the
+// expression is invalid at run time, such as when dividing by zero.
 func Arithm(cfg *Config, expr syntax.ArithmExpr) (int, error) {
 	switch x := expr.(type) {
 	case *syntax.Word:
@@ -17,34 +40,24 @@ func Arithm(cfg *Config, expr syntax.ArithmExpr) (int, error) {
 		if err != nil {
 			return 0, err
 		}
-		// recursively fetch vars
-		i := 0
-		for syntax.ValidName(str) {
-			val := cfg.envGet(str)
-			if val == "" {
-				break
-			}
-			if i++; i >= maxNameRefDepth {
-				break
-			}
-			str = val
-		}
-		// default to 0
-		return atoi(str), nil
+		return cfg.arithmValue(str), nil
 	case *syntax.ParenArithm:
 		return Arithm(cfg, x.X)
 	case *syntax.UnaryArithm:
 		switch x.Op {
 		case syntax.Inc, syntax.Dec:
-			name := x.X.(*syntax.Word).Lit()
-			old := atoi(cfg.envGet(name))
+			ref, err := cfg.arithmRef(x.X)
+			if err != nil {
+				return 0, err
+			}
+			old := ref.get(cfg)
 			val := old
 			if x.Op == syntax.Inc {
 				val++
 			} else {
 				val--
 			}
-			if err := cfg.envSet(name, strconv.Itoa(val)); err != nil {
+			if err := ref.set(cfg, val); err != nil {
 				return 0, err
 			}
 			if x.Post {
@@ -79,10 +92,23 @@ func Arithm(cfg *Config, expr syntax.ArithmExpr) (int, error) {
 				return 0, err
 			}
 			b2 := x.Y.(*syntax.BinaryArithm) // must have Op==TernColon
-			if cond == 1 {
+			if cond != 0 {
 				return Arithm(cfg, b2.X)
 			}
 			return Arithm(cfg, b2.Y)
+		case syntax.AndArit, syntax.OrArit:
+			left, err := Arithm(cfg, x.X)
+			if err != nil {
+				return 0, err
+			}
+			if (left != 0) == (x.Op == syntax.OrArit) {
+				return oneIf(left != 0), nil
+			}
+			right, err := Arithm(cfg, x.Y)
+			if err != nil {
+				return 0, err
+			}
+			return oneIf(right != 0), nil
 		}
 		left, err := Arithm(cfg, x.X)
 		if err != nil {
@@ -92,12 +118,164 @@ func Arithm(cfg *Config, expr syntax.ArithmExpr) (int, error) {
 		if err != nil {
 			return 0, err
 		}
+		if msg := binAritError(x.Op, right); msg != "" {
+			return 0, ArithmError{Node: x, Message: msg}
+		}
 		return binArit(x.Op, left, right), nil
 	default:
 		panic(fmt.Sprintf("unexpected arithm expr: %T", x))
 	}
 }
 
+// arithmValue returns the integer value of a string, following variable names
+// recursively like in "a=b b=3; echo $((a))". Values which aren't integers
+// default to 0.
+func (cfg *Config) arithmValue(str string) int {
+	for i := 0; syntax.ValidName(str); i++ {
+		val := cfg.envGet(str)
+		if val == "" || i >= maxNameRefDepth {
+			break
+		}
+		str = val
+	}
+	return atoi(str)
+}
+
+// arithmRef is a variable, or an element of an array variable, which is
+// assigned to by an arithmetic expression.
+type arithmRef struct {
+	name string
+	vr   Variable
+
+	hasIndex bool
+	index    int    // for indexed arrays
+	key      string // for associative arrays
+}
+
+// arithmRef finds the variable or array element that an operand like "x" or
+// "a[i]" refers to. The index of an array element is only evaluated once, so
+// that "a[i++] += 2" increments i once.
+func (cfg *Config) arithmRef(expr syntax.ArithmExpr) (arithmRef, error) {
+	var ref arithmRef
+	notVar := ArithmError{Node: expr, Message: "attempted assignment to non-variable"}
+	word, ok := expr.(*syntax.Word)
+	if !ok || len(word.Parts) != 1 {
+		return ref, notVar
+	}
+	var index syntax.ArithmExpr
+	switch x := word.Parts[0].(type) {
+	case *syntax.Lit:
+		if !syntax.ValidName(x.Value) {
+			return ref, notVar
+		}
+		ref.name = x.Value
+	case *syntax.ParamExp:
+		if !x.Short || x.Index == nil {
+			return ref, notVar
+		}
+		ref.name, index = x.Param.Value, x.Index
+	default:
+		return ref, notVar
+	}
+	name, vr := cfg.Env.Get(ref.name).Resolve(cfg.Env)
+	if name != "" {
+		ref.name = name
+	}
+	ref.vr = vr
+	if vr.ReadOnly {
+		return ref, ArithmError{Node: expr, Message: "readonly variable"}
+	}
+	switch vr.Kind {
+	case Associative:
+		// Like Bash, "m" is the same as "m[0]".
+		ref.hasIndex, ref.key = true, "0"
+		if index != nil {
+			w, ok := index.(*syntax.Word)
+			if !ok {
+				return ref, ArithmError{Node: expr, Message: "bad array subscript"}
+			}
+			key, err := Literal(cfg, w)
+			if err != nil {
+				return ref, err
+			}
+			ref.key = key
+		}
+	case Indexed:
+		ref.hasIndex = true
+	}
+	if index != nil && vr.Kind != Associative {
+		n, err := Arithm(cfg, index)
+		if err != nil {
+			return ref, err
+		}
+		if n < 0 {
+			// negative indexes count from the end
+			length := len(vr.List)
+			if vr.Kind == String {
+				length = 1
+			}
+			if n += length; n < 0 {
+				return ref, ArithmError{Node: expr, Message: "bad array subscript"}
+			}
+		}
+		ref.hasIndex, ref.index = true, n
+	}
+	return ref, nil
+}
+
+func (ref arithmRef) get(cfg *Config) int {
+	var str string
+	switch {
+	case !ref.hasIndex:
+		str = ref.vr.String()
+	case ref.vr.Kind == Associative:
+		str = ref.vr.Map[ref.key]
+	case ref.vr.Kind == Indexed:
+		if ref.index < len(ref.vr.List) {
+			str = ref.vr.List[ref.index]
+		}
+	case ref.index == 0:
+		str = ref.vr.String()
+	}
+	return cfg.arithmValue(str)
+}
+
+// set assigns a value to the variable or array element. The variable keeps
+// its attributes, such as being exported or local.
+func (ref arithmRef) set(cfg *Config, val int) error {
+	wenv, ok := cfg.Env.(WriteEnviron)
+	if !ok {
+		return fmt.Errorf("environment is read-only")
+	}
+	vr := ref.vr
+	str := strconv.Itoa(val)
+	switch {
+	case !ref.hasIndex:
+		vr.Kind, vr.Str = String, str
+	case vr.Kind == Associative:
+		m := make(map[string]string, len(vr.Map)+1)
+		for k, v := range vr.Map {
+			m[k] = v
+		}
+		m[ref.key] = str
+		vr.Map = m
+	default:
+		var list []string
+		switch vr.Kind {
+		case String:
+			list = append(list, vr.Str)
+		case Indexed:
+			list = append(list, vr.List...)
+		}
+		for len(list) <= ref.index {
+			list = append(list, "")
+		}
+		list[ref.index] = str
+		vr.Kind, vr.Str, vr.List = Indexed, "", list
+	}
+	return wenv.Set(ref.name, vr)
+}
+
 func oneIf(b bool) int {
 	if b {
 		return 1
@@ -106,49 +284,72 @@ func oneIf(b bool) int {
 }
 
 // atoi is just a shorthand for strconv.Atoi that ignores the error,
-// just like shells do.
+// just like shells do. Like in Bash, numbers too large for an integer wrap
+// around.
 func atoi(s string) int {
-	n, _ := strconv.Atoi(s)
+	n, err := strconv.Atoi(s)
+	if err, ok := err.(*strconv.NumError); ok && err.Err == strconv.ErrRange {
+		n = 0
+		for _, c := range strings.TrimLeft(s, "+-") {
+			n = n*10 + int(c-'0')
+		}
+		if s[0] == '-' {
+			n = -n
+		}
+	}
 	return n
 }
 
 func (cfg *Config) assgnArit(b *syntax.BinaryArithm) (int, error) {
-	name := b.X.(*syntax.Word).Lit()
-	val := atoi(cfg.envGet(name))
+	ref, err := cfg.arithmRef(b.X)
+	if err != nil {
+		return 0, err
+	}
 	arg, err := Arithm(cfg, b.Y)
 	if err != nil {
 		return 0, err
 	}
-	switch b.Op {
-	case syntax.Assgn:
-		val = arg
-	case syntax.AddAssgn:
-		val += arg
-	case syntax.SubAssgn:
-		val -= arg
-	case syntax.MulAssgn:
-		val *= arg
-	case syntax.QuoAssgn:
-		val /= arg
-	case syntax.RemAssgn:
-		val %= arg
-	case syntax.AndAssgn:
-		val &= arg
-	case syntax.OrAssgn:
-		val |= arg
-	case syntax.XorAssgn:
-		val ^= arg
-	case syntax.ShlAssgn:
-		val <<= uint(arg)
-	case syntax.ShrAssgn:
-		val >>= uint(arg)
-	}
-	if err := cfg.envSet(name, strconv.Itoa(val)); err != nil {
+	val := arg
+	if b.Op != syntax.Assgn {
+		op := assgnBinOp[b.Op]
+		if msg := binAritError(op, arg); msg != "" {
+			return 0, ArithmError{Node: b, Message: msg}
+		}
+		val = binArit(op, ref.get(cfg), arg)
+	}
+	if err := ref.set(cfg, val); err != nil {
 		return 0, err
 	}
 	return val, nil
 }
 
+// assgnBinOp maps each assignment operator like "+=" to its binary operator.
+var assgnBinOp = map[syntax.BinAritOperator]syntax.BinAritOperator{
+	syntax.AddAssgn: syntax.Add,
+	syntax.SubAssgn: syntax.Sub,
+	syntax.MulAssgn: syntax.Mul,
+	syntax.QuoAssgn: syntax.Quo,
+	syntax.RemAssgn: syntax.Rem,
+	syntax.AndAssgn: syntax.And,
+	syntax.OrAssgn:  syntax.Or,
+	syntax.XorAssgn: syntax.Xor,
+	syntax.ShlAssgn: syntax.Shl,
+	syntax.ShrAssgn: syntax.Shr,
+}
+
+// binAritError returns the error message for a binary operator whose right
+// operand is invalid, like a division by zero, or an empty string otherwise.
+// The messages are the same as Bash's.
+func binAritError(op syntax.BinAritOperator, y int) string {
+	switch {
+	case (op == syntax.Quo || op == syntax.Rem) && y == 0:
+		return "division by 0"
+	case op == syntax.Pow && y < 0:
+		return "exponent less than 0"
+	}
+	return ""
+}
+
 func intPow(a, b int) int {
 	p := 1
 	for b > 0 {
@@ -4,6 +4,7 @@
 package expand
 
 import (
+	"fmt"
 	"strconv"
 
 	"mvdan.cc/sh/v3/syntax"
@@ -24,58 +25,62 @@ func Braces(word *syntax.Word) []*syntax.Word {
 			continue
 		}
 		if br.Sequence {
-			var from, to int
+			var from, to, width int
 			if br.Chars {
 				from = int(br.Elems[0].Lit()[0])
 				to = int(br.Elems[1].Lit()[0])
 			} else {
-				from, _ = strconv.Atoi(br.Elems[0].Lit())
-				to, _ = strconv.Atoi(br.Elems[1].Lit())
+				fromStr, toStr := br.Elems[0].Lit(), br.Elems[1].Lit()
+				from, _ = strconv.Atoi(fromStr)
+				to, _ = strconv.Atoi(toStr)
+				width = padWidth(fromStr)
+				if w := padWidth(toStr); w > width {
+					width = w
+				}
 			}
-			upward := from <= to
+			// Like Bash, the sign of the increment is ignored, as
+			// the direction is given by the endpoints.
 			incr := 1
-			if !upward {
-				incr = -1
-			}
 			if len(br.Elems) > 2 {
 				n, _ := strconv.Atoi(br.Elems[2].Lit())
-				if n != 0 && n > 0 == upward {
+				if n < 0 {
+					n = -n
+				}
+				if n != 0 {
 					incr = n
 				}
 			}
-			n := from
-			for {
-				if upward && n > to {
-					break
-				}
-				if !upward && n < to {
-					break
-				}
+			if from > to {
+				incr = -incr
+			}
+			for n := from; (incr > 0 && n <= to) || (incr < 0 && n >= to); n += incr {
 				next := *word
 				next.Parts = next.Parts[i+1:]
 				lit := &syntax.Lit{}
-				if br.Chars {
-					lit.Value = string(n)
-				} else {
+				switch {
+				case br.Chars:
+					lit.Value = string(rune(n))
+				case width > 0:
+					lit.Value = fmt.Sprintf("%0*d", width, n)
+				default:
 					lit.Value = strconv.Itoa(n)
 				}
 				next.Parts = append([]syntax.WordPart{lit}, next.Parts...)
 				exp := Braces(&next)
 				for _, w := range exp {
-					w.Parts = append(left, w.Parts...)
+					w.Parts = append(left[:len(left):len(left)], w.Parts...)
 				}
 				all = append(all, exp...)
-				n += incr
 			}
 			return all
 		}
 		for _, elem := range br.Elems {
 			next := *word
 			next.Parts = next.Parts[i+1:]
-			next.Parts = append(elem.Parts, next.Parts...)
+			next.Parts = append(elem.Parts[:len(elem.Parts):len(elem.Parts)], next.Parts...)
 			exp := Braces(&next)
 			for _, w := range exp {
-				w.Parts = append(left, w.Parts...)
+				w.Parts = append(left[:len(left):len(left)], w.Parts...)
 			}
 			all = append(all, exp...)
 		}
@@ -83,3 +88,13 @@ func Braces(word *syntax.Word) []*syntax.Word {
 	}
 	return []*syntax.Word{{Parts: left}}
 }
+
+// padWidth returns the width to which the numbers of a sequence expansion are
+// zero-padded because of one of its endpoints, such as 3 for "001" or "-01".
+// It returns 0 if the endpoint does not ask for padding.
+func padWidth(s string) int {
+	if len(s) > 1 && s[0] == '0' || len(s) > 2 && s[0] == '-' && s[1] == '0' {
+		return len(s)
+	}
+	return 0
+}
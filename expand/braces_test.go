@@ -6,6 +6,8 @@ package expand
 import (
 	"bytes"
 	"fmt"
+	"math/rand"
+	"strings"
 	"testing"
 
 	"mvdan.cc/sh/v3/syntax"
@@ -146,6 +148,124 @@ var braceTests = []struct {
 		litWord("{1..1}"),
 		litWords("1"),
 	},
+
+	// the cases below were checked against Bash 5.2
+	{
+		litWord("a{1..10..-3}"),
+		litWords("a1", "a4", "a7", "a10"),
+	},
+	{
+		litWord("a{10..1..3}"),
+		litWords("a10", "a7", "a4", "a1"),
+	},
+	{
+		litWord("a{-5..-1..2}"),
+		litWords("a-5", "a-3", "a-1"),
+	},
+	{
+		litWord("a{0..-3}"),
+		litWords("a0", "a-1", "a-2", "a-3"),
+	},
+	{
+		litWord("a{+1..3}"),
+		litWords("a1", "a2", "a3"),
+	},
+	{
+		litWord("a{08..11}"),
+		litWords("a08", "a09", "a10", "a11"),
+	},
+	{
+		litWord("a{1..010..4}"),
+		litWords("a001", "a005", "a009"),
+	},
+	{
+		litWord("a{05..1..2}"),
+		litWords("a05", "a03", "a01"),
+	},
+	{
+		litWord("a{-01..1}"),
+		litWords("a-01", "a000", "a001"),
+	},
+	{
+		litWord("a{-1..01}"),
+		litWords("a-1", "a00", "a01"),
+	},
+	{
+		litWord("a{2..-03..2}"),
+		litWords("a002", "a000", "a-02"),
+	},
+	{
+		litWord("a{-0..1}"),
+		litWords("a0", "a1"),
+	},
+	{
+		litWord("a{00..0}"),
+		litWords("a00"),
+	},
+	{
+		litWord("a{1..3..01}"),
+		litWords("a1", "a2", "a3"),
+	},
+	{
+		litWord("a{z..a..-8}"),
+		litWords("az", "ar", "aj", "ab"),
+	},
+	{
+		litWord("a{C..F}"),
+		litWords("aC", "aD", "aE", "aF"),
+	},
+	{
+		litWord("a{Y..b..2}"),
+		litWords("aY", "a[", "a]", "a_", "aa"),
+	},
+	{
+		litWord("{a..b}{01..2}"),
+		litWords("a01", "a02", "b01", "b02"),
+	},
+	{
+		litWord("a{1..10..a}"),
+		litWords("a{1..10..a}"),
+	},
+	{
+		litWord("a{1..3..}"),
+		litWords("a{1..3..}"),
+	},
+	{
+		litWord("a{..3}"),
+		litWords("a{..3}"),
+	},
+	{
+		litWord("a{1..2..3..4}"),
+		litWords("a{1..2..3..4}"),
+	},
+	{
+		litWord("a{1...3}"),
+		litWords("a{1...3}"),
+	},
+	{
+		litWord("a{1.5..3}"),
+		litWords("a{1.5..3}"),
+	},
+	{
+		litWord("a{ab..c}"),
+		litWords("a{ab..c}"),
+	},
+	{
+		litWord("a{1..c}"),
+		litWords("a{1..c}"),
+	},
+	{
+		litWord(`a\{b,c}`),
+		litWords(`a\{b,c}`),
+	},
+	{
+		litWord(`a{b\,c,d\}}`),
+		litWords(`ab\,c`, `ad\}`),
+	},
+	{
+		litWord(`a{1\..3}`),
+		litWords(`a{1\..3}`),
+	},
 }
 
 func TestBraces(t *testing.T) {
@@ -192,3 +312,97 @@ func printWords(words ...*syntax.Word) string {
 	p.Print(&buf, call)
 	return buf.String()
 }
+
+// randomBraceWord returns a random word made of pieces of brace expansions,
+// such as "{", "..", and escaped commas, split into literals by parameter
+// expansions.
+func randomBraceWord(rnd *rand.Rand) *syntax.Word {
+	pieces := []string{"a", "b", "1", "3", "{", "}", ",", "..", `\{`, `\,`, "0"}
+	word := &syntax.Word{}
+	var sb strings.Builder
+	for n := rnd.Intn(12); n >= 0; n-- {
+		if rnd.Intn(8) == 0 {
+			if sb.Len() > 0 {
+				word.Parts = append(word.Parts, lit(sb.String()))
+				sb.Reset()
+			}
+			word.Parts = append(word.Parts, &syntax.ParamExp{
+				Short: true, Param: lit("x"),
+			})
+			continue
+		}
+		sb.WriteString(pieces[rnd.Intn(len(pieces))])
+	}
+	if sb.Len() > 0 {
+		word.Parts = append(word.Parts, lit(sb.String()))
+	}
+	return word
+}
+
+func TestExpandBracesAgrees(t *testing.T) {
+	t.Parallel()
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		word := randomBraceWord(rnd)
+		inStr := printWords(word)
+
+		split := *word
+		syntax.SplitBraces(&split)
+		want := Braces(&split)
+
+		got := syntax.ExpandBraces(word)
+		if gotStr, wantStr := printWords(got...), printWords(want...); gotStr != wantStr {
+			t.Fatalf("mismatch in %q\nwant: %s\ngot:  %s", inStr, wantStr, gotStr)
+		}
+		if printWords(word) != inStr {
+			t.Fatalf("ExpandBraces modified %q", inStr)
+		}
+		// Printing the resulting words must give source which expands to
+		// the same words again.
+		for _, w := range got {
+			w2 := *w
+			syntax.SplitBraces(&w2)
+			again := Braces(&w2)
+			if len(again) != 1 || printWords(again...) != printWords(w) {
+				t.Fatalf("%q from %q expands again to %s",
+					printWords(w), inStr, printWords(again...))
+			}
+		}
+	}
+}
+
+func TestFactorBracesAgrees(t *testing.T) {
+	t.Parallel()
+	rnd := rand.New(rand.NewSource(1))
+	pieces := []string{"a", "b", "/usr/lib/", ".so", "1", "..", ".", "-", "0"}
+	for i := 0; i < 5000; i++ {
+		var words []*syntax.Word
+		prefix := pieces[rnd.Intn(len(pieces))]
+		for n := rnd.Intn(6); n >= 0; n-- {
+			var sb strings.Builder
+			if rnd.Intn(3) > 0 {
+				sb.WriteString(prefix)
+			}
+			for m := rnd.Intn(3); m >= 0; m-- {
+				sb.WriteString(pieces[rnd.Intn(len(pieces))])
+			}
+			words = append(words, litWord(sb.String()))
+		}
+		inStr := printWords(words...)
+
+		factored := syntax.FactorBraces(words)
+		if gotStr := printWords(factored...); len(gotStr) > len(inStr) {
+			t.Fatalf("factoring %q made it longer: %q", inStr, gotStr)
+		}
+		var got []*syntax.Word
+		for _, w := range factored {
+			w2 := *w
+			syntax.SplitBraces(&w2)
+			got = append(got, Braces(&w2)...)
+		}
+		if gotStr := printWords(got...); gotStr != inStr {
+			t.Fatalf("%q factored into %q, which expands to %q",
+				inStr, printWords(factored...), gotStr)
+		}
+	}
+}
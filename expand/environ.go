@@ -112,6 +112,10 @@ func (v Variable) Resolve(env Environ) (string, Variable) {
 		if v.Kind != NameRef {
 			return name, v
 		}
+		if v.Str == "" {
+			// a nameref not referring to any variable yet
+			return name, Variable{}
+		}
 		name = v.Str // keep name for the next iteration
 		v = env.Get(name)
 	}
@@ -29,7 +29,7 @@ type Config struct {
 	//   * "#", "@", "*", "0"-"9" for the shell's parameters
 	//   * "?", "$", "PPID" for the shell's status and process
 	//   * "HOME foo" to retrieve user foo's home directory (if unset,
-	//     os/user.Lookup will be used)
+	//     HomeDir will be used)
 	//
 	// If nil, there are no environment variables set. Use
 	// ListEnviron(os.Environ()...) to use the system's environment
@@ -43,6 +43,15 @@ type Config struct {
 	// UnexpectedCommandError.
 	CmdSubst func(io.Writer, *syntax.CmdSubst) error
 
+	// ProcSubst starts a process substitution node, such as "<(cmd)",
+	// returning the path which it expands to. Reading from or writing to
+	// the path must read the standard output or write the standard input
+	// of the commands within, respectively.
+	//
+	// If nil, encountering a process substitution will result in an
+	// UnexpectedCommandError.
+	ProcSubst func(*syntax.ProcSubst) (string, error)
+
 	// ReadDir is used for file path globbing. If nil, globbing is disabled.
 	// Use ioutil.ReadDir to use the filesystem directly.
 	ReadDir func(string) ([]os.FileInfo, error)
@@ -51,6 +60,14 @@ type Config struct {
 	// "**".
 	GlobStar bool
 
+	// HomeDir returns the home directory of a user, for tilde expansion
+	// like "~foo". If it returns an error, the tilde is left as is, like
+	// in Bash.
+	//
+	// If nil, os/user.Lookup is used. To disable the lookups, such as when
+	// there is no user database, use a func which always errors.
+	HomeDir func(name string) (string, error)
+
 	bufferAlloc bytes.Buffer
 	fieldAlloc  [4]fieldPart
 	fieldsAlloc [4][]fieldPart
@@ -62,12 +79,19 @@ type Config struct {
 }
 
 // UnexpectedCommandError is returned if a command substitution is encountered
-// when Config.CmdSubst is nil.
+// when Config.CmdSubst is nil, or a process substitution is encountered when
+// Config.ProcSubst is nil.
 type UnexpectedCommandError struct {
 	Node *syntax.CmdSubst
+
+	// ProcNode is set instead of Node for a process substitution.
+	ProcNode *syntax.ProcSubst
 }
 
 func (u UnexpectedCommandError) Error() string {
+	if u.ProcNode != nil {
+		return fmt.Sprintf("unexpected process substitution at %s", u.ProcNode.Pos())
+	}
 	return fmt.Sprintf("unexpected command substitution at %s", u.Node.Pos())
 }
 
@@ -112,7 +136,8 @@ func (cfg *Config) strBuilder() *bytes.Buffer {
 }
 
 func (cfg *Config) envGet(name string) string {
-	return cfg.Env.Get(name).String()
+	_, vr := cfg.Env.Get(name).Resolve(cfg.Env)
+	return vr.String()
 }
 
 func (cfg *Config) envSet(name, value string) error {
@@ -124,8 +149,8 @@ func (cfg *Config) envSet(name, value string) error {
 }
 
 // Literal expands a single shell word. It is similar to Fields, but the result
-// is a single string. This is the behavior when a word is used as the value in
-// a shell variable assignment, for example.
+// is a single string. This is the behavior when a word is used as the target of
+// a redirection, for example.
 //
 // The config specifies shell expansion options; nil behaves the same as an
 // empty config.
@@ -134,7 +159,25 @@ func Literal(cfg *Config, word *syntax.Word) (string, error) {
 		return "", nil
 	}
 	cfg = prepareConfig(cfg)
-	field, err := cfg.wordField(word.Parts, quoteNone)
+	field, err := cfg.wordField(word.Parts, quoteNone, false)
+	if err != nil {
+		return "", err
+	}
+	return cfg.fieldJoin(field), nil
+}
+
+// Assign expands a single shell word used as the value in a shell variable
+// assignment. It is like Literal, but tilde expansion is also done after each
+// unquoted colon, such as in "PATH=~/bin:~foo/bin".
+//
+// The config specifies shell expansion options; nil behaves the same as an
+// empty config.
+func Assign(cfg *Config, word *syntax.Word) (string, error) {
+	if word == nil {
+		return "", nil
+	}
+	cfg = prepareConfig(cfg)
+	field, err := cfg.wordField(word.Parts, quoteNone, true)
 	if err != nil {
 		return "", err
 	}
@@ -152,7 +195,7 @@ func Document(cfg *Config, word *syntax.Word) (string, error) {
 		return "", nil
 	}
 	cfg = prepareConfig(cfg)
-	field, err := cfg.wordField(word.Parts, quoteDouble)
+	field, err := cfg.wordField(word.Parts, quoteDouble, false)
 	if err != nil {
 		return "", err
 	}
@@ -167,7 +210,7 @@ func Document(cfg *Config, word *syntax.Word) (string, error) {
 // empty config.
 func Pattern(cfg *Config, word *syntax.Word) (string, error) {
 	cfg = prepareConfig(cfg)
-	field, err := cfg.wordField(word.Parts, quoteNone)
+	field, err := cfg.wordField(word.Parts, quoteNone, false)
 	if err != nil {
 		return "", err
 	}
@@ -182,6 +225,68 @@ func Pattern(cfg *Config, word *syntax.Word) (string, error) {
 	return buf.String(), nil
 }
 
+// Regexp expands a single shell word as an extended regular expression, such as
+// the right side of a Bash regex test like "[[ $x =~ $re ]]". Quoted parts of
+// the input word and characters escaped with a backslash match literally, as
+// regexp.QuoteMeta is used on them. The result can be used on regexp.Compile
+// directly.
+//
+// The config specifies shell expansion options; nil behaves the same as an
+// empty config.
+func Regexp(cfg *Config, word *syntax.Word) (string, error) {
+	cfg = prepareConfig(cfg)
+	field, err := cfg.wordField(regexpParts(word.Parts), quoteNone, false)
+	if err != nil {
+		return "", err
+	}
+	buf := cfg.strBuilder()
+	for _, part := range field {
+		if part.quote > quoteNone {
+			buf.WriteString(regexp.QuoteMeta(part.val))
+		} else {
+			buf.WriteString(part.val)
+		}
+	}
+	return buf.String(), nil
+}
+
+// regexpParts splits the unquoted literals in wps at backslashes, so that each
+// escaped character becomes a quoted part of its own.
+func regexpParts(wps []syntax.WordPart) []syntax.WordPart {
+	var parts []syntax.WordPart
+	for i, wp := range wps {
+		lit, ok := wp.(*syntax.Lit)
+		if !ok || !strings.Contains(lit.Value, "\\") {
+			if parts != nil {
+				parts = append(parts, wp)
+			}
+			continue
+		}
+		if parts == nil {
+			parts = append(parts, wps[:i]...)
+		}
+		s := lit.Value
+		for {
+			j := strings.IndexByte(s, '\\')
+			if j < 0 || j+1 == len(s) {
+				break
+			}
+			if j > 0 {
+				parts = append(parts, &syntax.Lit{Value: s[:j]})
+			}
+			parts = append(parts, &syntax.SglQuoted{Value: s[j+1 : j+2]})
+			s = s[j+2:]
+		}
+		if s != "" {
+			parts = append(parts, &syntax.Lit{Value: s})
+		}
+	}
+	if parts == nil {
+		return wps
+	}
+	return parts
+}
+
 // Format expands a format string with a number of arguments, following the
 // shell's format specifications. These include printf(1), among others.
 //
@@ -396,6 +501,10 @@ func Fields(cfg *Config, words ...*syntax.Word) ([]string, error) {
 	return fields, nil
 }
 
+func extGlobString(eg *syntax.ExtGlob) string {
+	return eg.Op.String() + eg.Pattern.Value + ")"
+}
+
 type fieldPart struct {
 	val   string
 	quote quoteLevel
@@ -409,13 +518,18 @@ const (
 	quoteSingle
 )
 
-func (cfg *Config) wordField(wps []syntax.WordPart, ql quoteLevel) ([]fieldPart, error) {
+// wordField expands the parts of a word into a single field. If assign is true,
+// the word is the value of an assignment, so tildes are also expanded after
+// unquoted colons.
+func (cfg *Config) wordField(wps []syntax.WordPart, ql quoteLevel, assign bool) ([]fieldPart, error) {
 	var field []fieldPart
 	for i, wp := range wps {
 		switch x := wp.(type) {
 		case *syntax.Lit:
 			s := x.Value
-			if i == 0 && ql == quoteNone {
+			if assign {
+				s = cfg.expandAssignUsers(s, i == 0)
+			} else if i == 0 && ql == quoteNone {
 				if prefix, rest := cfg.expandUser(s); prefix != "" {
 					// TODO: return two separate fieldParts,
 					// like in wordFields?
@@ -444,7 +558,7 @@ func (cfg *Config) wordField(wps []syntax.WordPart, ql quoteLevel) ([]fieldPart,
 			}
 			field = append(field, fp)
 		case *syntax.DblQuoted:
-			wfield, err := cfg.wordField(x.Parts, quoteDouble)
+			wfield, err := cfg.wordField(x.Parts, quoteDouble, false)
 			if err != nil {
 				return nil, err
 			}
@@ -464,12 +578,22 @@ func (cfg *Config) wordField(wps []syntax.WordPart, ql quoteLevel) ([]fieldPart,
 				return nil, err
 			}
 			field = append(field, fieldPart{val: val})
+		case *syntax.ProcSubst:
+			path, err := cfg.procSubst(x)
+			if err != nil {
+				return nil, err
+			}
+			field = append(field, fieldPart{val: path})
 		case *syntax.ArithmExp:
 			n, err := Arithm(cfg, x.X)
 			if err != nil {
 				return nil, err
 			}
 			field = append(field, fieldPart{val: strconv.Itoa(n)})
+		case *syntax.ExtGlob:
+			// TODO: support extended globs; for now, keep them as
+			// they were written.
+			field = append(field, fieldPart{val: extGlobString(x)})
 		default:
 			panic(fmt.Sprintf("unhandled word part: %T", x))
 		}
@@ -488,6 +612,13 @@ func (cfg *Config) cmdSubst(cs *syntax.CmdSubst) (string, error) {
 	return strings.TrimRight(buf.String(), "\n"), nil
 }
 
+func (cfg *Config) procSubst(ps *syntax.ProcSubst) (string, error) {
+	if cfg.ProcSubst == nil {
+		return "", UnexpectedCommandError{ProcNode: ps}
+	}
+	return cfg.ProcSubst(ps)
+}
+
 func (cfg *Config) wordFields(wps []syntax.WordPart) ([][]fieldPart, error) {
 	fields := cfg.fieldsAlloc[:0]
 	curField := cfg.fieldAlloc[:0]
@@ -524,7 +655,12 @@ func (cfg *Config) wordFields(wps []syntax.WordPart) ([][]fieldPart, error) {
 				for i := 0; i < len(s); i++ {
 					b := s[i]
 					if b == '\\' {
-						i++
+						if i++; i >= len(s) {
+							// a trailing backslash, such as
+							// one from "{Z..a}", quotes nothing
+							allowEmpty = true
+							break
+						}
 						b = s[i]
 					}
 					buf.WriteByte(b)
@@ -556,7 +692,7 @@ func (cfg *Config) wordFields(wps []syntax.WordPart) ([][]fieldPart, error) {
 					continue
 				}
 			}
-			wfield, err := cfg.wordField(x.Parts, quoteDouble)
+			wfield, err := cfg.wordField(x.Parts, quoteDouble, false)
 			if err != nil {
 				return nil, err
 			}
@@ -576,12 +712,20 @@ func (cfg *Config) wordFields(wps []syntax.WordPart) ([][]fieldPart, error) {
 				return nil, err
 			}
 			splitAdd(val)
+		case *syntax.ProcSubst:
+			path, err := cfg.procSubst(x)
+			if err != nil {
+				return nil, err
+			}
+			curField = append(curField, fieldPart{val: path})
 		case *syntax.ArithmExp:
 			n, err := Arithm(cfg, x.X)
 			if err != nil {
 				return nil, err
 			}
 			curField = append(curField, fieldPart{val: strconv.Itoa(n)})
+		case *syntax.ExtGlob:
+			curField = append(curField, fieldPart{val: extGlobString(x)})
 		default:
 			panic(fmt.Sprintf("unhandled word part: %T", x))
 		}
@@ -604,7 +748,7 @@ func (cfg *Config) quotedElems(pe *syntax.ParamExp) []string {
 	if nodeLit(pe.Index) != "@" {
 		return nil
 	}
-	vr := cfg.Env.Get(pe.Param.Value)
+	_, vr := cfg.Env.Get(pe.Param.Value).Resolve(cfg.Env)
 	if vr.Kind == Indexed {
 		return vr.List
 	}
@@ -620,36 +764,89 @@ func (cfg *Config) expandUser(field string) (prefix, rest string) {
 		rest = name[i:]
 		name = name[:i]
 	}
-	if name == "" {
+	if dir, ok := cfg.homeDir(name); ok {
+		return dir, rest
+	}
+	return "", field
+}
+
+// expandAssignUsers does tilde expansion on a literal part of an assignment
+// value, where a tilde prefix can start the value or follow a colon, and ends at
+// a slash or colon. first is whether the literal starts the value.
+func (cfg *Config) expandAssignUsers(s string, first bool) string {
+	if !strings.Contains(s, "~") {
+		return s
+	}
+	buf := cfg.strBuilder()
+	for i := 0; i < len(s); i++ {
+		if s[i] != '~' || (i == 0 && !first) || (i > 0 && s[i-1] != ':') {
+			buf.WriteByte(s[i])
+			continue
+		}
+		end := i + 1
+		for end < len(s) && s[end] != '/' && s[end] != ':' {
+			end++
+		}
+		if dir, ok := cfg.homeDir(s[i+1 : end]); ok {
+			buf.WriteString(dir)
+			i = end - 1
+			continue
+		}
+		buf.WriteByte(s[i])
+	}
+	return buf.String()
+}
+
+// homeDir returns the directory that a tilde prefix like "~name" expands to,
+// given the name after the tilde. It reports false if there isn't one, in which
+// case the tilde prefix is left as is.
+func (cfg *Config) homeDir(name string) (string, bool) {
+	switch name {
+	case "":
 		// Current user; try via "HOME", otherwise fall back to the
 		// system's appropriate home dir env var. Don't use os/user, as
 		// that's overkill. We can't use os.UserHomeDir, because we want
 		// to use cfg.Env, and we always want to check "HOME" first.
 
 		if vr := cfg.Env.Get("HOME"); vr.IsSet() {
-			return vr.String(), rest
+			return vr.String(), true
 		}
 
 		if runtime.GOOS == "windows" {
 			if vr := cfg.Env.Get("USERPROFILE"); vr.IsSet() {
-				return vr.String(), rest
+				return vr.String(), true
 			}
 		}
-		return "", field
+		return "", false
+	case "+", "-":
+		// "~+" is the current directory, and "~-" is the previous one.
+		varName := "PWD"
+		if name == "-" {
+			varName = "OLDPWD"
+		}
+		if vr := cfg.Env.Get(varName); vr.IsSet() {
+			return vr.String(), true
+		}
+		return "", false
 	}
 
 	// Not the current user; try via "HOME <name>", otherwise fall back to
-	// os/user. There isn't a way to lookup user home dirs without cgo.
+	// HomeDir or os/user. There isn't a way to lookup user home dirs
+	// without cgo.
 
 	if vr := cfg.Env.Get("HOME " + name); vr.IsSet() {
-		return vr.String(), rest
+		return vr.String(), true
 	}
 
+	if cfg.HomeDir != nil {
+		dir, err := cfg.HomeDir(name)
+		return dir, err == nil
+	}
 	u, err := user.Lookup(name)
 	if err != nil {
-		return "", field
+		return "", false
 	}
-	return u.HomeDir, rest
+	return u.HomeDir, true
 }
 
 func findAllIndex(pat, name string, n int) [][]int {
@@ -4,6 +4,7 @@
 package expand
 
 import (
+	"fmt"
 	"os"
 	"strings"
 	"testing"
@@ -61,3 +62,54 @@ func TestConfigNils(t *testing.T) {
 		})
 	}
 }
+
+func TestHomeDir(t *testing.T) {
+	t.Parallel()
+	cfg := &Config{
+		Env: ListEnviron("HOME=/home/me", "PWD=/cur", "OLDPWD=/old"),
+		HomeDir: func(name string) (string, error) {
+			if name == "bob" {
+				return "/home/bob", nil
+			}
+			return "", fmt.Errorf("unknown user: %s", name)
+		},
+	}
+	tests := []struct {
+		src                string
+		wantFields, wantAs string
+	}{
+		{"~", "/home/me", "/home/me"},
+		{"~bob/x", "/home/bob/x", "/home/bob/x"},
+		{"~alice/x", "~alice/x", "~alice/x"},
+		{"~+/x", "/cur/x", "/cur/x"},
+		{"~-", "/old", "/old"},
+		{"~bob:~", "~bob:~", "/home/bob:/home/me"},
+		{"a:~/x:~bob:'~':~alice", "a:~/x:~bob:~:~alice", "a:/home/me/x:/home/bob:~:~alice"},
+		{"$x:~", ":~", ":/home/me"},
+		{"a~:\"~\"", "a~:~", "a~:~"},
+	}
+	p := syntax.NewParser()
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			f, err := p.Parse(strings.NewReader("x="+tc.src), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			word := f.Stmts[0].Cmd.(*syntax.CallExpr).Assigns[0].Value
+			fields, err := Fields(cfg, word)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Join(fields, " "); got != tc.wantFields {
+				t.Errorf("Fields: want %q, got %q", tc.wantFields, got)
+			}
+			got, err := Assign(cfg, word)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.wantAs {
+				t.Errorf("Assign: want %q, got %q", tc.wantAs, got)
+			}
+		})
+	}
+}
@@ -96,7 +96,7 @@ func (cfg *Config) paramExp(pe *syntax.ParamExp) (string, error) {
 		switch {
 		case pe.Names != 0:
 			strs = cfg.namesByPrefix(pe.Param.Value)
-		case orig.Kind == NameRef:
+		case orig.Kind == NameRef && index == nil:
 			strs = append(strs, orig.Str)
 		case vr.Kind == Indexed:
 			for i, e := range vr.List {
@@ -111,7 +111,7 @@ func (cfg *Config) paramExp(pe *syntax.ParamExp) (string, error) {
 		case !syntax.ValidName(str):
 			return "", fmt.Errorf("invalid indirect expansion")
 		default:
-			vr = cfg.Env.Get(str)
+			_, vr = cfg.Env.Get(str).Resolve(cfg.Env)
 			strs = append(strs, vr.String())
 		}
 		sort.Strings(strs)
@@ -6,20 +6,98 @@
 package fileutil
 
 import (
+	"bytes"
 	"os"
+	"path"
 	"regexp"
 	"strings"
 )
 
 var (
-	shebangRe = regexp.MustCompile(`^#!\s?/(usr/)?bin/(env\s+)?(sh|bash)\s`)
-	extRe     = regexp.MustCompile(`\.(sh|bash)$`)
+	shellRe = regexp.MustCompile(`^(sh|bash|mksh)(-?[0-9][0-9.]*)?$`)
+	extRe   = regexp.MustCompile(`\.(sh|bash)$`)
 )
 
-// HasShebang reports whether bs begins with a valid sh or bash shebang.
-// It supports variations with /usr and env.
+// HasShebang reports whether bs begins with a valid sh, bash or mksh shebang,
+// as found by Shebang. Version suffixes like "bash4" or "bash-5.1" are allowed.
 func HasShebang(bs []byte) bool {
-	return shebangRe.Match(bs)
+	return shellRe.MatchString(Shebang(bs))
+}
+
+// Shebang returns the name of the interpreter in the shebang at the start of
+// bs, such as "bash" for "#!/bin/bash -e", or an empty string if there is no
+// shebang. The name is the base name of the interpreter's path, so callers may
+// use it to pick a shell language variant.
+//
+// A UTF-8 byte order mark before the shebang and blanks after "#!" are allowed.
+// If the interpreter is env, the program it runs is returned, skipping over the
+// options and variable assignments given to env, including "-S" or
+// "--split-string", as in "#!/usr/bin/env -S bash -e".
+//
+// Since bs may only be a prefix of a file, an empty string is also returned if
+// the interpreter's name might have been cut short, meaning that it is not
+// followed by a blank or a newline.
+func Shebang(bs []byte) string {
+	bs = bytes.TrimPrefix(bs, []byte("\xef\xbb\xbf"))
+	if !bytes.HasPrefix(bs, []byte("#!")) {
+		return ""
+	}
+	line := string(bs[2:])
+	complete := false
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line, complete = line[:i], true
+	}
+	if strings.HasSuffix(line, " ") || strings.HasSuffix(line, "\t") ||
+		strings.HasSuffix(line, "\r") {
+		complete = true
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+	if path.Base(fields[0]) == "env" {
+		fields = envCommand(fields[1:])
+		if len(fields) == 0 {
+			return ""
+		}
+	}
+	if len(fields) == 1 && !complete {
+		return ""
+	}
+	return path.Base(fields[0])
+}
+
+// envCommand returns the command and arguments which env runs, given the
+// arguments to env.
+func envCommand(args []string) []string {
+	for len(args) > 0 {
+		arg := args[0]
+		switch {
+		case strings.HasPrefix(arg, "-S"), strings.HasPrefix(arg, "--split-string"):
+			// The string to split may be attached, like "-Sbash".
+			// The rest was already split by blanks.
+			arg = strings.TrimPrefix(arg, "-S")
+			arg = strings.TrimPrefix(arg, "--split-string")
+			arg = strings.TrimPrefix(arg, "=")
+			if arg == "" {
+				args = args[1:]
+			} else {
+				args[0] = arg
+			}
+		case arg == "-u", arg == "-C", arg == "--unset", arg == "--chdir":
+			// Options with a separate argument.
+			if len(args) < 2 {
+				return nil
+			}
+			args = args[2:]
+		case strings.HasPrefix(arg, "-"), strings.Contains(arg, "="):
+			// Any other options, and variables like FOO=bar.
+			args = args[1:]
+		default:
+			return args
+		}
+	}
+	return nil
 }
 
 // ScriptConfidence defines how likely a file is to be a shell script,
@@ -53,3 +131,63 @@ func CouldBeScript(info os.FileInfo) ScriptConfidence {
 		return ConfIfShebang
 	}
 }
+
+// ScriptMatcher decides which files found while walking a directory could be
+// shell scripts, like CouldBeScript, with extra rules given as globs. Its zero
+// value behaves like CouldBeScript.
+//
+// Globs follow path.Match. A glob containing a slash is matched against the
+// slash-separated path relative to the walked directory, such as "bin/*", and
+// any other glob is matched against the base name at any depth, such as
+// "*.bash_lib".
+type ScriptMatcher struct {
+	// Include holds globs for files which are shell scripts regardless of
+	// their name, such as those with a different extension or none at all.
+	Include []string
+
+	// Exclude holds globs for files and directories which are never
+	// considered, taking precedence over Include.
+	Exclude []string
+}
+
+// Excluded reports whether the file or directory at the relative path rel
+// matches any of the Exclude globs. Directories which are excluded should not
+// be walked.
+func (m *ScriptMatcher) Excluded(rel string) bool {
+	return matchGlobs(m.Exclude, rel)
+}
+
+// CouldBeScript reports how likely the file at the relative path rel is to be
+// a shell script. Files matching Include are scripts even if they are hidden
+// or have a non-shell extension, but directories and symlinks never are.
+func (m *ScriptMatcher) CouldBeScript(rel string, info os.FileInfo) ScriptConfidence {
+	switch {
+	case info.IsDir(), info.Mode()&os.ModeSymlink != 0:
+		return ConfNotScript
+	case m.Excluded(rel):
+		return ConfNotScript
+	case matchGlobs(m.Include, rel):
+		return ConfIsScript
+	}
+	return CouldBeScript(info)
+}
+
+func matchGlobs(globs []string, rel string) bool {
+	rel = path.Clean(rel)
+	for _, glob := range globs {
+		name := rel
+		if !strings.Contains(glob, "/") {
+			name = path.Base(rel)
+		}
+		if ok, _ := path.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidGlob returns an error if glob is malformed, as per path.Match.
+func ValidGlob(glob string) error {
+	_, err := path.Match(glob, "")
+	return err
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package fileutil
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+var shebangTests = []struct {
+	in    string
+	want  string
+	shell bool
+}{
+	{"#!/bin/sh\n", "sh", true},
+	{"#!/bin/bash\necho foo", "bash", true},
+	{"#!/usr/bin/bash -e\n", "bash", true},
+	{"#!/usr/bin/env bash\n", "bash", true},
+	{"#!/usr/bin/env sh\r\n", "sh", true},
+	{"#! /bin/sh\n", "sh", true},
+	{"#!\t/bin/sh -eu\n", "sh", true},
+	{"#!/usr/local/bin/mksh\n", "mksh", true},
+	{"#!/usr/bin/env -S bash -euo pipefail\n", "bash", true},
+	{"#!/usr/bin/env -Sbash -e\n", "bash", true},
+	{"#!/usr/bin/env --split-string=bash -e\n", "bash", true},
+	{"#!/usr/bin/env -i PATH=/bin -u HOME bash\n", "bash", true},
+	{"#!/usr/bin/env - bash\n", "bash", true},
+	{"#!/opt/bin/bash4\n", "bash4", true},
+	{"#!/usr/bin/env bash-5.1\n", "bash-5.1", true},
+	{"\xef\xbb\xbf#!/bin/bash\n", "bash", true},
+	{"#!/bin/sh", "", false},   // might be cut short
+	{"#!/bin/sh ", "sh", true}, // can't be cut short
+	{"#!/usr/bin/env -S ba", "", false},
+	{"#!/usr/bin/python\n", "python", false},
+	{"#!/usr/bin/env python3\n", "python3", false},
+	{"#!/usr/bin/env -S node --harmony\n", "node", false},
+	{"#!/bin/zsh\n", "zsh", false},
+	{"#!/bin/bashful\n", "bashful", false},
+	{"#!/usr/bin/env\n", "", false},
+	{"#!/usr/bin/env -u\n", "", false},
+	{"#!\n", "", false},
+	{" #!/bin/sh\n", "", false},
+	{"# comment\n", "", false},
+	{"echo foo\n", "", false},
+	{"", "", false},
+}
+
+func TestShebang(t *testing.T) {
+	t.Parallel()
+	for i, tc := range shebangTests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			if got := Shebang([]byte(tc.in)); got != tc.want {
+				t.Fatalf("Shebang(%q) = %q, want %q", tc.in, got, tc.want)
+			}
+			if got := HasShebang([]byte(tc.in)); got != tc.shell {
+				t.Fatalf("HasShebang(%q) = %v, want %v", tc.in, got, tc.shell)
+			}
+		})
+	}
+}
+
+type fakeInfo struct {
+	name string
+	size int64
+	mode os.FileMode
+}
+
+func (fi fakeInfo) Name() string       { return fi.name }
+func (fi fakeInfo) Size() int64        { return fi.size }
+func (fi fakeInfo) Mode() os.FileMode  { return fi.mode }
+func (fi fakeInfo) ModTime() time.Time { return time.Time{} }
+func (fi fakeInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi fakeInfo) Sys() interface{}   { return nil }
+
+func TestScriptMatcher(t *testing.T) {
+	m := &ScriptMatcher{
+		Include: []string{"*.bash_lib", "bin/*", ".profile"},
+		Exclude: []string{"vendor", "*_gen.sh", "bin/skip"},
+	}
+	tests := []struct {
+		rel  string
+		info fakeInfo
+		want ScriptConfidence
+	}{
+		{"foo.sh", fakeInfo{"foo.sh", 20, 0}, ConfIsScript},
+		{"lib/foo.bash_lib", fakeInfo{"foo.bash_lib", 20, 0}, ConfIsScript},
+		{"bin/tool", fakeInfo{"tool", 2, 0}, ConfIsScript},
+		{"bin/tool.py", fakeInfo{"tool.py", 20, 0}, ConfIsScript},
+		{"sub/bin/tool.py", fakeInfo{"tool.py", 20, 0}, ConfNotScript},
+		{"tool", fakeInfo{"tool", 20, 0}, ConfIfShebang},
+		{".profile", fakeInfo{".profile", 20, 0}, ConfIsScript},
+		{"a/foo_gen.sh", fakeInfo{"foo_gen.sh", 20, 0}, ConfNotScript},
+		{"bin/skip", fakeInfo{"skip", 20, 0}, ConfNotScript},
+		{"bin/link", fakeInfo{"link", 20, os.ModeSymlink}, ConfNotScript},
+		{"bin/dir", fakeInfo{"dir", 20, os.ModeDir}, ConfNotScript},
+	}
+	for _, tc := range tests {
+		if got := m.CouldBeScript(tc.rel, tc.info); got != tc.want {
+			t.Errorf("CouldBeScript(%q) = %v, want %v", tc.rel, got, tc.want)
+		}
+	}
+	for rel, want := range map[string]bool{
+		"vendor":     true,
+		"a/vendor":   true,
+		"vendored":   false,
+		"bin/skip":   true,
+		"a/bin/skip": false,
+	} {
+		if got := m.Excluded(rel); got != want {
+			t.Errorf("Excluded(%q) = %v, want %v", rel, got, want)
+		}
+	}
+	if err := ValidGlob("[a-"); err == nil {
+		t.Errorf("ValidGlob did not error on a malformed glob")
+	}
+}
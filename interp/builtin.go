@@ -4,6 +4,7 @@
 package interp
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -24,7 +25,7 @@ func isBuiltin(name string) bool {
 		"wait", "builtin", "trap", "type", "source", ".", "command",
 		"dirs", "pushd", "popd", "umask", "alias", "unalias",
 		"fg", "bg", "getopts", "eval", "test", "[", "exec",
-		"return", "read", "shopt":
+		"return", "read", "shopt", "jobs", "disown", "ulimit":
 		return true
 	}
 	return false
@@ -51,6 +52,7 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		return 1
 	case "exit":
 		r.exitShell = true
+		r.exitErr = &ExitError{Explicit: true, Pos: pos}
 		switch len(args) {
 		case 0:
 			return r.exit
@@ -70,6 +72,10 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			r.errf("set: %v\n", err)
 			return 2
 		}
+		if r.monitorSet && !r.monitorWarned {
+			r.errf("set: monitor mode is not supported; job control is unavailable\n")
+			r.monitorWarned = true
+		}
 		r.updateExpandOpts()
 	case "shift":
 		n := 1
@@ -93,6 +99,7 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 	case "unset":
 		vars := true
 		funcs := true
+		refs := false
 	unsetOpts:
 		for i, arg := range args {
 			switch arg {
@@ -100,21 +107,34 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 				funcs = false
 			case "-f":
 				vars = false
+			case "-n":
+				// unset nameref variables, not what they refer to
+				funcs = false
+				refs = true
 			default:
 				args = args[i:]
 				break unsetOpts
 			}
 		}
 
+		status := 0
 		for _, arg := range args {
-			if vr := r.lookupVar(arg); vr.IsSet() && vars {
-				r.delVar(arg)
+			name := arg
+			if vars && !refs {
+				name, _, _ = r.resolveVar(arg)
+			}
+			if vr := r.lookupVar(name); (vr.IsSet() || vr.ReadOnly) && vars {
+				if vr.ReadOnly {
+					status = 1
+				}
+				r.delVar(name)
 				continue
 			}
 			if _, ok := r.Funcs[arg]; ok && funcs {
-				delete(r.Funcs, arg)
+				r.delFunc(arg)
 			}
 		}
+		return status
 	case "echo":
 		newline, doExpand := true, false
 	echoOpts:
@@ -185,6 +205,10 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 	case "pwd":
 		r.outf("%s\n", r.envGet("PWD"))
 	case "cd":
+		if r.restricted {
+			r.errf("cd: restricted\n")
+			return 1
+		}
 		var path string
 		switch len(args) {
 		case 0:
@@ -197,12 +221,125 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		}
 		return r.changeDir(path)
 	case "wait":
+		if len(args) == 0 {
+			for len(r.bgJobs) > 0 {
+				if !r.waitJob(ctx, r.bgJobs[0]) {
+					return 1
+				}
+			}
+			break
+		}
+		code := 0
+		for _, arg := range args {
+			job := r.findJob(arg)
+			if job == nil {
+				if strings.HasPrefix(arg, "%") {
+					r.errf("wait: %s: no such job\n", arg)
+				} else {
+					r.errf("wait: pid %s is not a child of this shell\n", arg)
+				}
+				code = 127
+				continue
+			}
+			if !r.waitJob(ctx, job) {
+				return 1
+			}
+			code = job.exit
+		}
+		return code
+	case "jobs":
+		pidsOnly := false
+		for len(args) > 0 && strings.HasPrefix(args[0], "-") {
+			switch args[0] {
+			case "-p":
+				pidsOnly = true
+			case "-l":
+			default:
+				r.errf("jobs: invalid option %q\n", args[0])
+				return 2
+			}
+			args = args[1:]
+		}
+		jobs := r.bgJobs
 		if len(args) > 0 {
-			panic("wait with args not handled yet")
+			jobs = nil
+			for _, arg := range args {
+				job := r.findJob(arg)
+				if job == nil {
+					r.errf("jobs: %s: no such job\n", arg)
+					return 1
+				}
+				jobs = append(jobs, job)
+			}
 		}
-		err := r.bgShells.Wait()
-		if _, ok := IsExitStatus(err); err != nil && !ok {
-			r.setErr(err)
+		var finished []*bgJob
+		for _, job := range jobs {
+			if pidsOnly {
+				r.outf("%d\n", job.processID())
+				continue
+			}
+			state := "Running"
+			if job.finished() {
+				finished = append(finished, job)
+				state = "Done"
+				if job.exit != 0 {
+					state = fmt.Sprintf("Exit %d", job.exit)
+				}
+			}
+			var buf bytes.Buffer
+			syntax.NewPrinter().Print(&buf, job.stmt)
+			r.outf("[%d]\t%s\t%s\n", job.id, state, buf.String())
+		}
+		// Like in Bash, finished jobs are forgotten once reported.
+		for _, job := range finished {
+			r.waitJob(ctx, job)
+		}
+	case "disown":
+		all, running, noHup := false, false, false
+		for len(args) > 0 && strings.HasPrefix(args[0], "-") && len(args[0]) > 1 {
+			for _, c := range args[0][1:] {
+				switch c {
+				case 'a':
+					all = true
+				case 'r':
+					running = true
+				case 'h':
+					noHup = true
+				default:
+					r.errf("disown: invalid option %q\n", "-"+string(c))
+					return 2
+				}
+			}
+			args = args[1:]
+		}
+		var jobs []*bgJob
+		switch {
+		case len(args) > 0:
+			for _, arg := range args {
+				job := r.findJob(arg)
+				if job == nil {
+					r.errf("disown: %s: no such job\n", arg)
+					return 1
+				}
+				jobs = append(jobs, job)
+			}
+		case all || running:
+			jobs = append(jobs, r.bgJobs...)
+		case len(r.bgJobs) > 0:
+			jobs = append(jobs, r.bgJobs[len(r.bgJobs)-1])
+		default:
+			r.errf("disown: current: no such job\n")
+			return 1
+		}
+		for _, job := range jobs {
+			if running && job.finished() {
+				continue
+			}
+			if noHup {
+				job.noHup = true
+			} else {
+				r.forgetJob(job)
+			}
 		}
 	case "builtin":
 		if len(args) < 1 {
@@ -241,32 +378,46 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			r.errf("eval: %v\n", err)
 			return 1
 		}
+		r.xtraceLevel++
 		r.stmts(ctx, file.Stmts)
+		r.xtraceLevel--
 		return r.exit
 	case "source", ".":
 		if len(args) < 1 {
 			r.errf("%v: source: need filename\n", pos)
 			return 2
 		}
-		f, err := r.open(ctx, args[0], os.O_RDONLY, 0, false)
+		if r.restricted && strings.Contains(args[0], "/") {
+			r.errf("%s: %s: restricted\n", name, args[0])
+			return 1
+		}
+		f, name, err := r.sourceFile(ctx, args[0])
 		if err != nil {
 			r.errf("source: %v\n", err)
 			return 1
 		}
 		defer f.Close()
 		p := syntax.NewParser()
-		file, err := p.Parse(f, args[0])
+		file, err := p.Parse(f, name)
 		if err != nil {
 			r.errf("source: %v\n", err)
 			return 1
 		}
+		// Without extra arguments, the sourced file uses and can modify
+		// the current parameters.
 		oldParams := r.Params
-		r.Params = args[1:]
+		if len(args) > 1 {
+			r.Params = args[1:]
+		}
 		oldInSource := r.inSource
 		r.inSource = true
+		r.xtraceLevel++
 		r.stmts(ctx, file.Stmts)
+		r.xtraceLevel--
 
-		r.Params = oldParams
+		if len(args) > 1 {
+			r.Params = oldParams
+		}
 		r.inSource = oldInSource
 		if code, ok := r.err.(returnStatus); ok {
 			r.err = nil
@@ -294,7 +445,7 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		if parseErr {
 			return 2
 		}
-		return oneIf(r.bashTest(ctx, expr, true) == "")
+		return oneIf(r.bashTest(ctx, expr, true, false) == "")
 	case "exec":
 		// TODO: Consider syscall.Exec, i.e. actually replacing
 		// the process. It's in theory what a shell should do,
@@ -304,8 +455,13 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			r.keepRedirs = true
 			break
 		}
-		r.exec(ctx, args)
+		if r.restricted {
+			r.errf("exec: restricted\n")
+			return 1
+		}
+		r.exec(ctx, pos, args)
 		r.exitShell = true
+		r.exitErr = &ExitError{Explicit: true, Pos: pos}
 		return r.exit
 	case "command":
 		show := false
@@ -326,7 +482,7 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 			if isBuiltin(args[0]) {
 				return r.builtinCode(ctx, pos, args[0], args[1:])
 			}
-			r.exec(ctx, args)
+			r.exec(ctx, pos, args)
 			return r.exit
 		}
 		last := 0
@@ -350,6 +506,10 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		}
 		r.out("\n")
 	case "pushd":
+		if r.restricted {
+			r.errf("pushd: restricted\n")
+			return 1
+		}
 		change := true
 		if len(args) > 0 && args[0] == "-n" {
 			change = false
@@ -560,6 +720,9 @@ func (r *Runner) builtinCode(ctx context.Context, pos syntax.Pos, name string, a
 		}
 		r.updateExpandOpts()
 
+	case "ulimit":
+		return r.ulimit(args)
+
 	default:
 		// "trap", "umask", "alias", "unalias", "fg", "bg",
 		panic(fmt.Sprintf("unhandled builtin: %s", name))
@@ -620,9 +783,42 @@ func (r *Runner) changeDir(path string) int {
 	r.Dir = path
 	r.Vars["OLDPWD"] = r.Vars["PWD"]
 	r.Vars["PWD"] = expand.Variable{Kind: expand.String, Str: path}
+	r.varsChanged(true)
 	return 0
 }
 
+// sourceFile opens the file run by the source builtin, returning it along with
+// the name to use in its positions. Without a SourceHandler, names without a
+// slash are searched for in $PATH first, like in Bash.
+func (r *Runner) sourceFile(ctx context.Context, name string) (io.ReadCloser, string, error) {
+	if r.sourceHandler != nil {
+		hc := r.handlerContext()
+		f, fname, err := r.sourceHandler(context.WithValue(ctx, handlerCtxKey{}, hc), name)
+		switch err.(type) {
+		case nil:
+		case *os.PathError:
+		default: // handler's custom fatal error
+			r.setErr(err)
+		}
+		return f, fname, err
+	}
+	path := name
+	if !strings.Contains(name, "/") {
+		for _, dir := range splitList(r.envGet("PATH")) {
+			if dir == "" {
+				continue
+			}
+			cand := filepath.Join(dir, name)
+			if info, err := r.stat(cand); err == nil && info.Mode().IsRegular() {
+				path = cand
+				break
+			}
+		}
+	}
+	f, err := r.open(ctx, OpenSource, path, os.O_RDONLY, 0, false)
+	return f, path, err
+}
+
 func (r *Runner) absPath(path string) string {
 	if !filepath.IsAbs(path) {
 		path = filepath.Join(r.Dir, path)
@@ -630,6 +826,57 @@ func (r *Runner) absPath(path string) string {
 	return filepath.Clean(path)
 }
 
+var errRootEscape = fmt.Errorf("path escapes the root directory")
+
+// hostPath returns the absolute path on the host for a path as seen by the
+// shell program. The two only differ when RootDir is used.
+func (r *Runner) hostPath(path string) (string, error) {
+	path = r.absPath(path)
+	if r.rootDir == "" {
+		return path, nil
+	}
+	// path is clean and absolute, so it cannot contain ".." elements.
+	path = filepath.Join(r.rootDir, path)
+	if r.rootStrict {
+		if err := checkInsideRoot(r.rootDir, path); err != nil {
+			return "", err
+		}
+	}
+	return path, nil
+}
+
+// checkInsideRoot returns errRootEscape if path, once its symbolic links are
+// followed, is not within root. The path does not need to exist; its longest
+// existing prefix is resolved.
+func checkInsideRoot(root, path string) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return err
+	}
+	dir, rest := path, ""
+	for {
+		real, err := filepath.EvalSymlinks(dir)
+		if err == nil {
+			path = filepath.Join(real, rest)
+			break
+		}
+		if !os.IsNotExist(err) {
+			return err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return err
+		}
+		rest = filepath.Join(filepath.Base(dir), rest)
+		dir = parent
+	}
+	rel, err := filepath.Rel(realRoot, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return errRootEscape
+	}
+	return nil
+}
+
 type getopts struct {
 	argidx  int
 	runeidx int
@@ -0,0 +1,241 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// Package conformance compares how package interp runs shell scripts with how
+// system shells such as bash or dash run them.
+//
+// Compare runs a script under the interpreter and under each of the given
+// shells, and fails the test if the results differ:
+//
+//	func TestArithmetic(t *testing.T) {
+//		conformance.Compare(t, `echo $((1 << 3))`, "bash", "dash")
+//	}
+//
+// When the interpreter doesn't run a script like a shell does, the simplest way
+// to report the bug is with a failing Compare case. Reduce the script to the fewest
+// lines which still show the difference, and add it to a test in any module
+// which requires mvdan.cc/sh/v3:
+//
+//	package divergence_test
+//
+//	import (
+//		"testing"
+//
+//		"mvdan.cc/sh/v3/interp/conformance"
+//	)
+//
+//	func TestDivergence(t *testing.T) {
+//		conformance.Compare(t, `set -- a b; echo "${@:2}"`, "bash")
+//	}
+//
+// Then run "go test -v" and open an issue with the test and its output, which
+// includes the script, what differs, and the versions of the shells used. If
+// the difference is only cosmetic, such as the name of the shell at the start
+// of error messages, a Normalizer can hide it.
+package conformance
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"mvdan.cc/sh/v3/interp"
+)
+
+// Interp is the name used for the interpreter in a Result and in the reports
+// of Compare.
+const Interp = "interp"
+
+// Result holds the outcome of running a script, either under the interpreter or
+// under a system shell.
+type Result struct {
+	// Shell is the name of the shell which ran the script, or Interp.
+	Shell string
+
+	Stdout, Stderr string
+
+	// Status is the script's exit status.
+	Status uint8
+}
+
+// A Normalizer rewrites a Result before it is compared, to hide differences
+// between shells which don't matter, such as the format of error messages.
+type Normalizer func(res *Result)
+
+// A Comparer runs scripts under the interpreter and under system shells, and
+// compares their results. The zero value compares the standard output and
+// exit status.
+type Comparer struct {
+	// Stderr makes the standard error be compared too. Error messages often
+	// differ between shells, so it is usually needed to use Normalizers
+	// such as StripErrorPrefix as well.
+	Stderr bool
+
+	// Normalize is applied in order to each Result before comparing them,
+	// including the interpreter's.
+	Normalize []Normalizer
+
+	// Options are the options for the interpreter's Runner. Options for
+	// the standard input and output, as well as the directory, are
+	// overridden.
+	Options []interp.RunnerOption
+}
+
+// Compare is shorthand for a zero Comparer's Compare method.
+func Compare(t testing.TB, script string, shells ...string) {
+	t.Helper()
+	new(Comparer).Compare(t, script, shells...)
+}
+
+// Compare runs script under the interpreter and under each of the shells, and
+// reports an error to t for each shell whose result differs from the
+// interpreter's. Shells are looked up in $PATH; those which can't be found are
+// skipped, and the test is skipped if none can be.
+//
+// Each run happens in a new temporary directory, with no standard input and
+// with the environment of the current process.
+func (c *Comparer) Compare(t testing.TB, script string, shells ...string) {
+	t.Helper()
+	var paths []string
+	for _, shell := range shells {
+		path, err := exec.LookPath(shell)
+		if err != nil {
+			t.Logf("skipping %s: %v", shell, err)
+			continue
+		}
+		paths = append(paths, path)
+	}
+	if len(paths) == 0 {
+		t.Skipf("none of the shells were found: %s", strings.Join(shells, ", "))
+	}
+	want, err := c.Run(context.Background(), script, Interp)
+	if err != nil {
+		t.Fatalf("%s could not run the script: %v\n%s", Interp, err, quoteScript(script))
+	}
+	for _, path := range paths {
+		got, err := c.Run(context.Background(), script, path)
+		if err != nil {
+			t.Errorf("%s could not run the script: %v\n%s", path, err, quoteScript(script))
+			continue
+		}
+		if diff := c.diff(want, got); diff != "" {
+			t.Errorf("%s and %s differ running:\n%s%s%s",
+				Interp, got.Shell, quoteScript(script), diff, shellVersion(path))
+		}
+	}
+}
+
+// Run runs script under a shell and returns its normalized result. The shell is
+// either a path or a name to look up in $PATH, or Interp to use the
+// interpreter.
+//
+// An error is only returned if the script could not be run at all; exiting
+// with a non-zero status is not an error.
+func (c *Comparer) Run(ctx context.Context, script, shell string) (*Result, error) {
+	dir, err := ioutil.TempDir("", "conformance")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	res := &Result{Shell: Interp}
+	if shell == Interp {
+		opts := append(c.Options[:len(c.Options):len(c.Options)],
+			interp.StdIO(nil, nil, nil), interp.Dir(dir))
+		ires, err := interp.Capture(ctx, opts, script)
+		if err != nil {
+			return nil, err
+		}
+		res.Stdout, res.Stderr = string(ires.Stdout), string(ires.Stderr)
+		res.Status = ires.Status
+	} else {
+		var stdout, stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, shell, "-c", script)
+		cmd.Dir = dir
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		err := cmd.Run()
+		if err, ok := err.(*exec.ExitError); ok {
+			res.Status = 1
+			if status, ok := err.Sys().(syscall.WaitStatus); ok {
+				res.Status = uint8(status.ExitStatus())
+			}
+		} else if err != nil {
+			return nil, err
+		}
+		res.Shell = filepath.Base(shell)
+		res.Stdout, res.Stderr = stdout.String(), stderr.String()
+	}
+	for _, fn := range c.Normalize {
+		fn(res)
+	}
+	return res, nil
+}
+
+// diff describes how two results differ, or returns the empty string if they
+// don't.
+func (c *Comparer) diff(want, got *Result) string {
+	var buf strings.Builder
+	compare := func(name, w, g string) {
+		if w == g {
+			return
+		}
+		width := len(Interp)
+		if len(got.Shell) > width {
+			width = len(got.Shell)
+		}
+		fmt.Fprintf(&buf, "%s:\n", name)
+		fmt.Fprintf(&buf, "\t%-*s %s\n", width+1, want.Shell+":", w)
+		fmt.Fprintf(&buf, "\t%-*s %s\n", width+1, got.Shell+":", g)
+	}
+	compare("stdout", strconv.Quote(want.Stdout), strconv.Quote(got.Stdout))
+	if c.Stderr {
+		compare("stderr", strconv.Quote(want.Stderr), strconv.Quote(got.Stderr))
+	}
+	compare("status", strconv.Itoa(int(want.Status)), strconv.Itoa(int(got.Status)))
+	return buf.String()
+}
+
+// quoteScript indents a script so that it stands out in a report.
+func quoteScript(script string) string {
+	var buf strings.Builder
+	for _, line := range strings.Split(strings.TrimSuffix(script, "\n"), "\n") {
+		fmt.Fprintf(&buf, "\t%s\n", line)
+	}
+	return buf.String()
+}
+
+// shellVersion returns the version of a shell to include in a report, if it
+// supports the --version flag like bash does. Shells like dash don't, so
+// nothing is returned for them.
+func shellVersion(path string) string {
+	out, err := exec.Command(path, "--version").Output()
+	if err != nil || len(out) == 0 {
+		return ""
+	}
+	line := string(out)
+	if i := strings.IndexByte(line, '\n'); i >= 0 {
+		line = line[:i]
+	}
+	return fmt.Sprintf("version: %s\n", line)
+}
+
+var errorPrefix = regexp.MustCompile(`(?m)^[^:\n]+: (line )?[0-9]+: `)
+
+// StripErrorPrefix is a Normalizer which removes the prefix that shells add to
+// their error messages, such as "bash: line 1: " or "dash: 2: ", which the
+// interpreter doesn't print.
+func StripErrorPrefix(res *Result) {
+	if res.Shell == Interp {
+		return
+	}
+	res.Stderr = errorPrefix.ReplaceAllString(res.Stderr, "")
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package conformance
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// posixTests are run under all the POSIX shells found, like bash and dash.
+var posixTests = []string{
+	// exit statuses
+	"true",
+	"false",
+	"exit 3",
+	"exit 300",
+	"! false",
+	"false; exit",
+	"exit; echo foo",
+
+	// quotes and escapes
+	"echo  foo ",
+	"echo ' foo '",
+	`echo " foo "`,
+	`echo a'b'c"d"e`,
+	`a=" b c "; echo $a`,
+	`a=" b c "; echo "$a"`,
+	`echo "$(echo ' b c ')"`,
+	"echo a\\ b",
+	"echo \\$a",
+	"echo \"a\\\nb\"",
+	"echo 'a\\\nb'",
+	`echo "\""`,
+	`printf '%s\n' \\\\`,
+
+	// parameters and variables
+	`set -- a b c; x="$@"; echo "$x"`,
+	`set -- b c; echo a"$@"d`,
+	`echo $1 $3; set -- a b c; echo $1 $3`,
+	"foo=bar foo=etc; echo $foo",
+	"foo=bar; unset foo; echo ${foo-unset}",
+	"foo=bar; foo=x true; echo $foo",
+	`foo=abcabc; echo ${foo#*b} ${foo##*b} ${foo%b*} ${foo%%b*}`,
+	`echo ${#foo} ${foo:-def} ${foo:=set} $foo`,
+
+	// arithmetic
+	"echo $((1 + 2 * 3)) $((7 / 2)) $((7 % 3)) $((1 << 3))",
+	"a=3; echo $((a += 2)) $a",
+	"echo $((2 > 1 && 0 || 5))",
+
+	// control flow
+	"for i in a b c; do echo $i; done",
+	"i=0; while [ $i -lt 3 ]; do i=$((i + 1)); done; echo $i",
+	"case foo in f*) echo yes ;; *) echo no ;; esac",
+	"if false; then echo a; elif true; then echo b; fi",
+	"f() { echo $#; return 2; }; f a b; echo $?",
+	"{ echo a; false; } | cat; echo $?",
+}
+
+// bashTests are only run under bash, as they use its features.
+var bashTests = []string{
+	"a=(x y z); echo ${a[1]} ${#a[@]}",
+	"declare -A m=([k]=v); echo ${m[k]}",
+	`[[ foo == f* ]] && echo match`,
+	`echo $'a\tb'`,
+	"echo {a,b}{1,2}",
+	"x=foo; echo ${x^^} ${x/o/0}",
+}
+
+// errexitTests check how "set -e" is ignored in tested contexts, including in
+// the bodies of functions called from them. The interpreter follows bash here;
+// other shells differ, such as dash with command substitutions.
+var errexitTests = []string{
+	"set -e; f() { false; echo cont; }; if f; then echo y; fi; echo end",
+	"set -e; g() { false; echo g; }; f() { g; echo f; }; if f; then echo y; fi",
+	"set -e; f() { false; echo cont; return 1; }; while f; do :; done; until f; do break; done; echo end",
+	"set -e; f() { false; echo cont; }; ! f; echo end",
+	"set -e; f() { false; echo cont; }; f && echo y; f || echo n; echo end",
+	"set -e; false && true; echo end; true && false; echo unreachable",
+	"set -e; f() { true && false; echo unreachable; }; f; echo unreachable",
+	"set -e; f() { false; echo cont; }; if (f); then echo y; fi; if f | cat; then echo y; fi",
+	`set -e; f() { false; echo cont; }; if x=$(f); then echo "y $x"; fi`,
+}
+
+func TestCompare(t *testing.T) {
+	if testing.Short() {
+		t.Skip("calling shells is slow")
+	}
+	t.Parallel()
+	for i := range posixTests {
+		script := posixTests[i]
+		t.Run(fmt.Sprintf("posix%03d", i), func(t *testing.T) {
+			t.Parallel()
+			Compare(t, script, "bash", "dash", "mksh")
+		})
+	}
+	for i := range bashTests {
+		script := bashTests[i]
+		t.Run(fmt.Sprintf("bash%03d", i), func(t *testing.T) {
+			t.Parallel()
+			Compare(t, script, "bash")
+		})
+	}
+	for i := range errexitTests {
+		script := errexitTests[i]
+		t.Run(fmt.Sprintf("errexit%03d", i), func(t *testing.T) {
+			t.Parallel()
+			Compare(t, script, "bash")
+		})
+	}
+}
+
+func TestCompareStderr(t *testing.T) {
+	t.Parallel()
+	c := &Comparer{Stderr: true, Normalize: []Normalizer{StripErrorPrefix}}
+	c.Compare(t, "echo foo >&2; exit 1", "bash", "dash")
+}
+
+// recorder is a testing.TB which records the errors reported to it.
+type recorder struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestCompareReport(t *testing.T) {
+	t.Parallel()
+	// Make every shell's output differ from the interpreter's.
+	c := &Comparer{Normalize: []Normalizer{func(res *Result) {
+		if res.Shell != Interp {
+			res.Stdout += "extra"
+		}
+	}}}
+	rec := &recorder{TB: t}
+	c.Compare(rec, "echo foo", "bash")
+	if len(rec.errors) != 1 {
+		t.Fatalf("want one error, got %q", rec.errors)
+	}
+	want := "interp and bash differ running:\n" +
+		"\techo foo\n" +
+		"stdout:\n" +
+		"\tinterp: \"foo\\n\"\n" +
+		"\tbash:   \"foo\\nextra\"\n"
+	if got := rec.errors[0]; !strings.HasPrefix(got, want) {
+		t.Fatalf("wrong report:\nwant prefix: %q\ngot:         %q", want, got)
+	}
+}
+
+var stripErrorPrefixTests = []struct {
+	in, want string
+}{
+	{"foo\n", "foo\n"},
+	{"bash: line 1: foo: command not found\n", "foo: command not found\n"},
+	{"dash: 2: foo: not found\n", "foo: not found\n"},
+	{"a\nbash: line 3: b\n", "a\nb\n"},
+	{"foo: bar\n", "foo: bar\n"},
+}
+
+func TestStripErrorPrefix(t *testing.T) {
+	t.Parallel()
+	for i, tc := range stripErrorPrefixTests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			res := &Result{Shell: "bash", Stderr: tc.in}
+			StripErrorPrefix(res)
+			if res.Stderr != tc.want {
+				t.Fatalf("want %q, got %q", tc.want, res.Stderr)
+			}
+			res = &Result{Shell: Interp, Stderr: tc.in}
+			StripErrorPrefix(res)
+			if res.Stderr != tc.in {
+				t.Fatalf("interp's result should be left as is, got %q", res.Stderr)
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// coproc is a coprocess started via the "coproc" keyword. It runs in the
+// background like a job, with its standard input and output connected to the
+// shell via pipes.
+//
+// The shell's ends of the pipes are the file descriptors in NAME[1] and
+// NAME[0]. Like when Bash reaps a coprocess, they are closed and the variables
+// are unset once the coprocess has finished, before the next statement runs,
+// or when the job is waited for. Any output it left unread is then lost.
+type coproc struct {
+	name   string
+	fds    [2]int // read and write ends, as in NAME[0] and NAME[1]
+	reaped bool
+
+	// The shell's ends of the pipes. Like in Bash, they are OS pipes,
+	// so that writes don't block until the coprocess reads them.
+	in  *os.File // to the coprocess's standard input
+	out *os.File // from the coprocess's standard output
+}
+
+// close closes the shell's ends of the pipes, which unblocks the coprocess if
+// it is reading its input or writing its output.
+func (c *coproc) close() {
+	c.in.Close()
+	c.out.Close()
+}
+
+func (r *Runner) coproc(ctx context.Context, cc *syntax.CoprocClause) {
+	name := "COPROC"
+	if cc.Name != nil {
+		name = r.literal(cc.Name)
+	}
+	for _, job := range r.bgJobs {
+		if job.coproc != nil && !job.finished() {
+			// Like Bash, only warn; the old one's variables are
+			// replaced if the name is the same.
+			r.errf("warning: execute_coproc: coproc [%d:%s] still exists\n",
+				job.processID(), job.coproc.name)
+		}
+	}
+	var fds [2]int
+	var err error
+	if fds[0], err = r.freeFd(64); err == nil {
+		fds[1], err = r.freeFd(fds[0])
+	}
+	if err != nil {
+		r.errf("coproc: %v\n", err)
+		r.exit = 1
+		return
+	}
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		r.errf("coproc: %v\n", err)
+		r.exit = 1
+		return
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		inR.Close()
+		inW.Close()
+		r.errf("coproc: %v\n", err)
+		r.exit = 1
+		return
+	}
+	c := &coproc{name: name, fds: fds, in: inW, out: outR}
+	r.setFd(c.fds[0], outR)
+	r.setFd(c.fds[1], inW)
+
+	r2 := r.sub()
+	r2.stdin, r2.stdout = inR, outW
+	// The coprocess doesn't get the shell's ends of its pipes.
+	delete(r2.fds, c.fds[0])
+	delete(r2.fds, c.fds[1])
+	job := r.goJob(ctx, &syntax.Stmt{Position: cc.Pos(), Cmd: cc}, r2, cc.Stmt, func() {
+		// Let the shell read the remaining output until EOF, and
+		// make its writes fail.
+		outW.Close()
+		inR.Close()
+	})
+	job.coproc = c
+
+	r.setVar(name, nil, expand.Variable{Kind: expand.Indexed, List: []string{
+		strconv.Itoa(c.fds[0]), strconv.Itoa(c.fds[1]),
+	}})
+	r.setVarString(name+"_PID", strconv.Itoa(job.processID()))
+	r.exit = 0
+}
+
+// reapCoprocs reaps the coprocesses which have finished.
+func (r *Runner) reapCoprocs() {
+	for _, job := range r.bgJobs {
+		if job.coproc != nil && job.finished() {
+			r.reapCoproc(job.coproc)
+		}
+	}
+}
+
+// reapCoproc closes the shell's ends of the pipes of a coprocess which has
+// finished, and unsets its variables. It does nothing if it was reaped before.
+func (r *Runner) reapCoproc(c *coproc) {
+	if c.reaped {
+		return
+	}
+	c.reaped = true
+	c.close()
+	for _, fd := range c.fds {
+		if f := r.fds[fd]; f == c.in || f == c.out {
+			delete(r.fds, fd)
+		}
+	}
+	if vr := r.lookupVar(c.name); vr.Kind == expand.Indexed && len(vr.List) == 2 &&
+		vr.List[0] == strconv.Itoa(c.fds[0]) && vr.List[1] == strconv.Itoa(c.fds[1]) {
+		r.delVar(c.name)
+		r.delVar(c.name + "_PID")
+	}
+}
+
+// freeFd returns the highest file descriptor below max which isn't open, much
+// like Bash picks the descriptors it uses internally. The standard input,
+// output and error are never picked, so an error is returned if all the
+// descriptors between them and max are open.
+func (r *Runner) freeFd(max int) (int, error) {
+	for fd := max - 1; fd > 2; fd-- {
+		if _, ok := r.fds[fd]; !ok {
+			return fd, nil
+		}
+	}
+	return 0, fmt.Errorf("no free file descriptor below %d", max)
+}
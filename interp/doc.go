@@ -4,4 +4,7 @@
 // Package interp implements an interpreter that executes shell
 // programs. It aims to support POSIX, but its support is not complete
 // yet. It also supports some Bash features.
+//
+// The simplest way to run a program and get its output is via Output,
+// CombinedOutput, or Capture. For more control, build a Runner with New.
 package interp
@@ -0,0 +1,233 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"io"
+	"strings"
+	"sync"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// DryRunConfig configures a dry run. See DryRun.
+type DryRunConfig struct {
+	// Handler, if non-nil, is called with each step as soon as it is
+	// planned. Since parts of a program such as pipelines run
+	// concurrently, calls are serialized but may come from multiple
+	// goroutines.
+	Handler func(step PlanStep)
+
+	// ApplyBuiltins makes the builtins which change the state inherited by
+	// later commands, such as cd and export, take effect as usual. This way,
+	// the directories and arguments of later steps are realistic. The
+	// builtins are planned steps either way.
+	ApplyBuiltins bool
+
+	// Placeholder is the output given to every command substitution, as
+	// they are never run.
+	Placeholder string
+}
+
+// PlanStep is a command which a program would run, as planned by DryRun.
+type PlanStep struct {
+	// Kind is TraceExec for programs and TraceBuiltin for builtins.
+	Kind TraceKind
+
+	// Pos is the position of the command's first word.
+	Pos syntax.Pos
+
+	// Args are the command's fields after expansion.
+	Args []string
+
+	// Dir is the directory the command would run in.
+	Dir string
+
+	// Env holds the variables set only for this command, such as FOO in
+	// "FOO=bar cmd". It is nil if there are none.
+	Env map[string]string
+
+	// Files maps the file descriptors redirected to files, such as 1 in
+	// "cmd >out.txt", to the paths of those files. It is nil if there are
+	// none.
+	Files map[int]string
+
+	// Unevaluated is true if the arguments, variables or files of the
+	// command contain the output of a command substitution which was not
+	// run. If Placeholder is not empty, this includes any values containing
+	// it, such as a variable assigned from a command substitution earlier.
+	Unevaluated bool
+
+	// Depth is the number of function calls and subshells which the
+	// command is nested in, like in TraceEvent.
+	Depth int
+}
+
+// DryRun makes the interpreter plan the commands that a program would run,
+// instead of running them. Each program which would be executed is a step of
+// the plan, and it is assumed to succeed with exit status zero. The plan of
+// the last Run call can be retrieved via Runner.Plan.
+//
+// Builtins and functions run as usual, as they cannot affect anything outside
+// of the interpreter, with some exceptions. The builtins which change the
+// state inherited by programs, namely cd, pushd, popd, export, umask, and
+// ulimit, are also planned steps, and they only run if ApplyBuiltins is set.
+// Any other builtin whose output is redirected to a file is also a planned
+// step.
+//
+// Redirections never create, truncate or write to files; output to such files
+// is discarded. Files are still opened for reading, so that commands like
+// "read line <file" work. Command substitutions are never run, and their
+// output is the configured placeholder instead.
+func DryRun(cfg DryRunConfig) RunnerOption {
+	return func(r *Runner) error {
+		r.dryRun = &dryRun{DryRunConfig: cfg}
+		return nil
+	}
+}
+
+type dryRun struct {
+	DryRunConfig
+
+	mu    sync.Mutex
+	steps []PlanStep
+}
+
+func (d *dryRun) add(step PlanStep) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.steps = append(d.steps, step)
+	if d.Handler != nil {
+		d.Handler(step)
+	}
+}
+
+// Plan returns the steps planned by the last Run call, in the order that they
+// were planned. It is nil unless DryRun is used.
+func (r *Runner) Plan() []PlanStep {
+	if r.dryRun == nil {
+		return nil
+	}
+	r.dryRun.mu.Lock()
+	defer r.dryRun.mu.Unlock()
+	return append([]PlanStep(nil), r.dryRun.steps...)
+}
+
+// stateBuiltin reports whether a builtin changes the state inherited by
+// programs, and thus is a planned step in a dry run.
+func stateBuiltin(name string) bool {
+	switch name {
+	case "cd", "pushd", "popd", "export", "umask", "ulimit":
+		return true
+	}
+	return false
+}
+
+// planFile is a file opened by a redirection in a dry run. Files for reading
+// are opened as usual, but files for writing are nil and discard all writes.
+type planFile struct {
+	io.ReadWriteCloser
+
+	path        string
+	unevaluated bool
+}
+
+func (f *planFile) Read(p []byte) (int, error) {
+	if f.ReadWriteCloser == nil {
+		return 0, io.EOF
+	}
+	return f.ReadWriteCloser.Read(p)
+}
+
+func (f *planFile) Write(p []byte) (int, error) {
+	if f.ReadWriteCloser == nil {
+		return len(p), nil
+	}
+	return f.ReadWriteCloser.Write(p)
+}
+
+func (f *planFile) Close() error {
+	if f.ReadWriteCloser == nil {
+		return nil
+	}
+	return f.ReadWriteCloser.Close()
+}
+
+// writesToFile reports whether any of the open file descriptors is a file
+// opened for writing in a dry run.
+func (r *Runner) writesToFile() bool {
+	for _, w := range [...]io.Writer{r.stdout, r.stderr} {
+		if f, ok := w.(*planFile); ok && f.ReadWriteCloser == nil {
+			return true
+		}
+	}
+	for _, f := range r.fds {
+		if f, ok := f.(*planFile); ok && f.ReadWriteCloser == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// dryCall plans a builtin in a dry run if necessary, and reports whether it
+// should run.
+func (r *Runner) dryCall(pos syntax.Pos, args []string) bool {
+	switch {
+	case stateBuiltin(args[0]):
+		r.planStep(TraceBuiltin, pos, args)
+		return r.dryRun.ApplyBuiltins
+	case r.writesToFile():
+		r.planStep(TraceBuiltin, pos, args)
+	}
+	return true
+}
+
+func (r *Runner) planStep(kind TraceKind, pos syntax.Pos, args []string) {
+	step := PlanStep{
+		Kind:        kind,
+		Pos:         pos,
+		Args:        args,
+		Dir:         r.Dir,
+		Depth:       r.traceDepth,
+		Unevaluated: r.dryUneval,
+	}
+	placeholder := r.dryRun.Placeholder
+	hasPlaceholder := func(s string) bool {
+		return placeholder != "" && strings.Contains(s, placeholder)
+	}
+	for _, arg := range args {
+		if hasPlaceholder(arg) {
+			step.Unevaluated = true
+		}
+	}
+	if len(r.cmdVars) > 0 {
+		step.Env = make(map[string]string, len(r.cmdVars))
+		for k, v := range r.cmdVars {
+			step.Env[k] = v
+			if hasPlaceholder(v) {
+				step.Unevaluated = true
+			}
+		}
+	}
+	addFile := func(fd int, f interface{}) {
+		pf, ok := f.(*planFile)
+		if !ok {
+			return
+		}
+		if step.Files == nil {
+			step.Files = make(map[int]string)
+		}
+		step.Files[fd] = pf.path
+		if pf.unevaluated || hasPlaceholder(pf.path) {
+			step.Unevaluated = true
+		}
+	}
+	addFile(0, r.stdin)
+	addFile(1, r.stdout)
+	addFile(2, r.stderr)
+	for fd, f := range r.fds {
+		addFile(fd, f)
+	}
+	r.dryRun.add(step)
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+const deployScript = `
+APP=web
+ENVIRONMENT=${1:-staging}
+RELEASE=$(git rev-parse --short HEAD)
+cd "$APP"
+read -r hosts <hosts.txt
+if [ "$ENVIRONMENT" = production ]; then
+	replicas=3
+else
+	replicas=1
+fi
+for host in $hosts; do
+	scp build.tar.gz "deploy@$host:/tmp/$RELEASE.tgz"
+	ssh "deploy@$host" "systemctl restart $APP" >>deploy.log 2>&1
+done
+export REPLICAS=$replicas
+echo "deployed $RELEASE" >release.txt
+echo "deploying $APP to $ENVIRONMENT"
+DEBUG=1 kubectl scale --replicas=$replicas "deploy/$APP"
+`
+
+func TestDryRun(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "interp-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	appDir := filepath.Join(dir, "web")
+	if err := os.Mkdir(appDir, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(appDir, "hosts.txt"), []byte("app1 app2\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	scp := func(dir, host string) PlanStep {
+		return PlanStep{
+			Kind:        TraceExec,
+			Args:        []string{"scp", "build.tar.gz", "deploy@" + host + ":/tmp/<unevaluated>.tgz"},
+			Dir:         dir,
+			Unevaluated: true,
+		}
+	}
+	ssh := func(dir, host string) PlanStep {
+		return PlanStep{
+			Kind:  TraceExec,
+			Args:  []string{"ssh", "deploy@" + host, "systemctl restart web"},
+			Dir:   dir,
+			Files: map[int]string{1: "deploy.log", 2: "deploy.log"},
+		}
+	}
+	wantAll := map[bool][]PlanStep{
+		// cd is not applied, so hosts.txt is not found and there are
+		// no hosts
+		false: {
+			{Kind: TraceBuiltin, Args: []string{"cd", "web"}, Dir: dir},
+			{Kind: TraceBuiltin, Args: []string{"export", "REPLICAS=3"}, Dir: dir},
+			{
+				Kind:        TraceBuiltin,
+				Args:        []string{"echo", "deployed <unevaluated>"},
+				Dir:         dir,
+				Files:       map[int]string{1: "release.txt"},
+				Unevaluated: true,
+			},
+			{
+				Kind: TraceExec,
+				Args: []string{"kubectl", "scale", "--replicas=3", "deploy/web"},
+				Dir:  dir,
+				Env:  map[string]string{"DEBUG": "1"},
+			},
+		},
+		true: {
+			{Kind: TraceBuiltin, Args: []string{"cd", "web"}, Dir: dir},
+			scp(appDir, "app1"),
+			ssh(appDir, "app1"),
+			scp(appDir, "app2"),
+			ssh(appDir, "app2"),
+			{Kind: TraceBuiltin, Args: []string{"export", "REPLICAS=3"}, Dir: appDir},
+			{
+				Kind:        TraceBuiltin,
+				Args:        []string{"echo", "deployed <unevaluated>"},
+				Dir:         appDir,
+				Files:       map[int]string{1: "release.txt"},
+				Unevaluated: true,
+			},
+			{
+				Kind: TraceExec,
+				Args: []string{"kubectl", "scale", "--replicas=3", "deploy/web"},
+				Dir:  appDir,
+				Env:  map[string]string{"DEBUG": "1"},
+			},
+		},
+	}
+	file := parse(t, nil, deployScript)
+	for _, apply := range []bool{false, true} {
+		apply := apply
+		t.Run(fmt.Sprintf("Apply%t", apply), func(t *testing.T) {
+			var handled []PlanStep
+			var stdout bytes.Buffer
+			r, err := New(
+				Dir(dir),
+				Params("production"),
+				StdIO(nil, &stdout, ioutil.Discard),
+				DryRun(DryRunConfig{
+					Handler:       func(step PlanStep) { handled = append(handled, step) },
+					ApplyBuiltins: apply,
+					Placeholder:   "<unevaluated>",
+				}),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Run(context.Background(), file); err != nil {
+				t.Fatal(err)
+			}
+			got := r.Plan()
+			if !reflect.DeepEqual(got, handled) {
+				t.Fatalf("Plan and Handler differ:\n%#v\n%#v", got, handled)
+			}
+			for i := range got {
+				got[i].Pos = syntax.Pos{}
+			}
+			if want := wantAll[apply]; !reflect.DeepEqual(got, want) {
+				t.Fatalf("want plan:\n%#v\ngot:\n%#v", want, got)
+			}
+			// builtins without side effects still run
+			if want := "deploying web to production\n"; stdout.String() != want {
+				t.Fatalf("want stdout %q, got %q", want, stdout.String())
+			}
+			for _, name := range []string{"release.txt", "deploy.log"} {
+				if _, err := os.Stat(filepath.Join(appDir, name)); !os.IsNotExist(err) {
+					t.Fatalf("%s was created", name)
+				}
+			}
+		})
+	}
+}
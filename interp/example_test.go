@@ -6,7 +6,10 @@ package interp_test
 import (
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -36,6 +39,28 @@ func Example() {
 	// global_value
 }
 
+func ExampleCapture() {
+	src := `
+		echo "hello $USER"
+		echo "about to fail" >&2
+		exit 2
+	`
+	res, err := interp.Capture(context.TODO(), []interp.RunnerOption{
+		interp.Env(expand.ListEnviron("USER=gopher")),
+	}, src)
+	if err != nil {
+		fmt.Println("error:", err)
+		return
+	}
+	fmt.Printf("stdout: %q\n", res.Stdout)
+	fmt.Printf("stderr: %q\n", res.Stderr)
+	fmt.Println("status:", res.Status)
+	// Output:
+	// stdout: "hello gopher\n"
+	// stderr: "about to fail\n"
+	// status: 2
+}
+
 func ExampleExecHandler() {
 	src := "echo foo; join ! foo bar baz; missing-program bar"
 	file, _ := syntax.NewParser().Parse(strings.NewReader(src), "")
@@ -65,3 +90,66 @@ func ExampleExecHandler() {
 	// foo!bar!baz
 	// missing-program is not installed
 }
+
+func ExampleOpenHandler() {
+	dir, _ := ioutil.TempDir("", "interp-example")
+	defer os.RemoveAll(dir)
+
+	src := `
+		cd "$DIR"
+		echo allowed >file
+		read line <file
+		echo $line
+		echo denied >/etc/file
+		[ -w /etc/file ] || echo /etc/file is not writable
+		./file
+	`
+	file, _ := syntax.NewParser().Parse(strings.NewReader(src), "")
+
+	// Only allow writing files within dir.
+	writeFlags := os.O_WRONLY | os.O_RDWR | os.O_APPEND | os.O_CREATE | os.O_TRUNC
+	open := func(ctx context.Context, path string, flag int, perm os.FileMode) (io.ReadWriteCloser, error) {
+		hc := interp.HandlerCtx(ctx)
+		if flag&writeFlags != 0 {
+			abs := path
+			if !filepath.IsAbs(abs) {
+				abs = filepath.Join(hc.Dir, abs)
+			}
+			if !strings.HasPrefix(abs, dir+string(filepath.Separator)) {
+				return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrPermission}
+			}
+		}
+		return interp.DefaultOpenHandler()(ctx, path, flag, perm)
+	}
+
+	// Don't run any programs within dir, as they could have been written
+	// by the script.
+	exec := func(ctx context.Context, args []string) error {
+		hc := interp.HandlerCtx(ctx)
+		path := args[0]
+		if found, err := interp.LookPath(hc.Env, path); err == nil {
+			path = found
+		}
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(hc.Dir, path)
+		}
+		if strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			fmt.Fprintf(hc.Stderr, "%s: not allowed\n", args[0])
+			return interp.NewExitStatus(126)
+		}
+		return interp.DefaultExecHandler(2*time.Second)(ctx, args)
+	}
+
+	runner, _ := interp.New(
+		interp.Env(expand.ListEnviron("DIR="+dir)),
+		interp.StdIO(nil, os.Stdout, os.Stdout),
+		interp.OpenHandler(open),
+		interp.ExecHandler(exec),
+	)
+	runner.Run(context.TODO(), file)
+	// Output:
+	// allowed
+	// open /etc/file: permission denied
+	// /etc/file is not writable
+	// ./file: not allowed
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"mvdan.cc/sh/v3/pattern"
+)
+
+// ExportAction is what an ExportCheckFunc decides to do with an exported
+// variable about to be passed to a program.
+type ExportAction uint8
+
+const (
+	// ExportAllow passes the variable to the program as it is.
+	ExportAllow ExportAction = iota
+
+	// ExportRedact passes the variable to the program with RedactedValue
+	// as its value, so that a program checking whether it is set still
+	// finds it.
+	ExportRedact
+
+	// ExportDeny fails the command with exit status 126, without starting
+	// the program.
+	ExportDeny
+)
+
+// RedactedValue is the value given to variables redacted via ExportRedact.
+const RedactedValue = "REDACTED"
+
+// ExportCheckFunc decides what to do with an exported variable which is about
+// to be passed to a program, given the command name as written in the program
+// and the variable's name. The HandlerContext in ctx has the position of the
+// command being run, among other state.
+//
+// Returning a non-nil error halts the interpreter, like with ExecHandlerFunc.
+type ExportCheckFunc func(ctx context.Context, cmd, name string) (ExportAction, error)
+
+// ExportCheck sets a function to be called for each exported variable whose
+// name matches any of the shell patterns, like "*_TOKEN", when a program
+// started by DefaultExecHandler is about to receive it. It is called once per
+// variable for each program, after any ChildEnvFilter, so variables which the
+// filter drops are not checked. Once a variable is denied, the rest are not
+// checked.
+//
+// Like ChildEnvFilter, the check applies to all programs, including those
+// started in subshells, process substitutions, and coprocesses. Expansions
+// within the shell still see the real values.
+func ExportCheck(fn ExportCheckFunc, patterns ...string) RunnerOption {
+	return func(r *Runner) error {
+		for _, pat := range patterns {
+			if _, err := pattern.Regexp(pat, 0); err != nil {
+				return fmt.Errorf("invalid export pattern %q: %v", pat, err)
+			}
+		}
+		r.exportCheck = func(ctx context.Context, cmd, name string) (ExportAction, error) {
+			for _, pat := range patterns {
+				if match(pat, name) {
+					return fn(ctx, cmd, name)
+				}
+			}
+			return ExportAllow, nil
+		}
+		return nil
+	}
+}
+
+// checkExports applies an ExportCheckFunc to the environment of a program as
+// "name=value" strings, returning the environment to use. If a variable is
+// denied, its name is returned too.
+func checkExports(ctx context.Context, check ExportCheckFunc, cmd string, env []string) ([]string, string, error) {
+	seen := make(map[string]bool, len(env))
+	copied := false
+	for i, kv := range env {
+		name := kv
+		if j := strings.IndexByte(kv, '='); j >= 0 {
+			name = kv[:j]
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		action, err := check(ctx, cmd, name)
+		if err != nil {
+			return nil, "", err
+		}
+		switch action {
+		case ExportRedact:
+			if !copied {
+				// the list may be shared with other commands
+				env = append([]string(nil), env...)
+				copied = true
+			}
+			env[i] = name + "=" + RedactedValue
+		case ExportDeny:
+			return nil, name, nil
+		}
+	}
+	return env, "", nil
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// FS is a filesystem used by the interpreter, as set by FileSystem. It is used
+// by redirections, globbing, file test operators like "[ -f file ]", the cd
+// builtin, and sourced files, and it can be fetched by handlers via
+// HandlerContext.FS.
+//
+// The paths given to its methods are always absolute and clean, using the
+// host's path separator. When RootDir is used, they are translated host paths.
+//
+// Some operations still require the real filesystem: finding and running
+// programs via DefaultExecHandler, process substitutions, coprocesses, the
+// checks done by StrictRootDir, and validating the directory given to
+// RootDir.
+type FS interface {
+	// Open opens a file like os.OpenFile.
+	Open(name string, flag int, perm os.FileMode) (io.ReadWriteCloser, error)
+
+	// Stat and Lstat return information about a file like os.Stat and
+	// os.Lstat, respectively.
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+
+	// ReadDir lists a directory like ioutil.ReadDir, sorted by name.
+	ReadDir(name string) ([]os.FileInfo, error)
+
+	// Getwd returns the directory which the interpreter starts in when Dir
+	// isn't used.
+	Getwd() (string, error)
+}
+
+// DefaultFS returns the FS used by default, which is the operating system's
+// filesystem.
+func DefaultFS() FS { return osFS{} }
+
+type osFS struct{}
+
+func (osFS) Open(name string, flag int, perm os.FileMode) (io.ReadWriteCloser, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error)      { return os.Stat(name) }
+func (osFS) Lstat(name string) (os.FileInfo, error)     { return os.Lstat(name) }
+func (osFS) ReadDir(name string) ([]os.FileInfo, error) { return ioutil.ReadDir(name) }
+func (osFS) Getwd() (string, error)                     { return os.Getwd() }
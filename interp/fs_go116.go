@@ -0,0 +1,105 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// +build go1.16
+
+package interp
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// IOFS returns a read-only FS backed by fsys, such as an embed.FS or an
+// fstest.MapFS. The path "/" is the root of fsys, which is also where the
+// interpreter starts if Dir isn't used.
+//
+// Opening a file for writing fails with a permission error, so redirections
+// like ">file" and ">/dev/null" fail too. Since fsys has no symbolic links,
+// Lstat is the same as Stat.
+func IOFS(fsys fs.FS) FS { return ioFS{fsys} }
+
+type ioFS struct {
+	fsys fs.FS
+}
+
+// name converts an absolute host path to a path as used by fs.FS.
+func (f ioFS) name(op, path string) (string, error) {
+	name := strings.TrimPrefix(filepath.ToSlash(path), "/")
+	if name == "" {
+		name = "."
+	}
+	if !fs.ValidPath(name) {
+		return "", &os.PathError{Op: op, Path: path, Err: fs.ErrInvalid}
+	}
+	return name, nil
+}
+
+// pathErr makes err refer to path instead of the name used with fs.FS.
+func (f ioFS) pathErr(path string, err error) error {
+	if perr, ok := err.(*fs.PathError); ok {
+		perr.Path = path
+	}
+	return err
+}
+
+func (f ioFS) Open(path string, flag int, perm os.FileMode) (io.ReadWriteCloser, error) {
+	name, err := f.name("open", path)
+	if err != nil {
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC) != 0 {
+		return nil, &os.PathError{Op: "open", Path: path, Err: fs.ErrPermission}
+	}
+	file, err := f.fsys.Open(name)
+	if err != nil {
+		return nil, f.pathErr(path, err)
+	}
+	return readOnlyFile{file, path}, nil
+}
+
+func (f ioFS) Stat(path string) (os.FileInfo, error) {
+	name, err := f.name("stat", path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fs.Stat(f.fsys, name)
+	return info, f.pathErr(path, err)
+}
+
+func (f ioFS) Lstat(path string) (os.FileInfo, error) { return f.Stat(path) }
+
+func (f ioFS) ReadDir(path string) ([]os.FileInfo, error) {
+	name, err := f.name("readdir", path)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := fs.ReadDir(f.fsys, name)
+	if err != nil {
+		return nil, f.pathErr(path, err)
+	}
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return nil, f.pathErr(filepath.Join(path, entry.Name()), err)
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+func (f ioFS) Getwd() (string, error) { return string(filepath.Separator), nil }
+
+// readOnlyFile is a file from an fs.FS, which can't be written to.
+type readOnlyFile struct {
+	fs.File
+	path string
+}
+
+func (f readOnlyFile) Write(p []byte) (int, error) {
+	return 0, &os.PathError{Op: "write", Path: f.path, Err: fs.ErrPermission}
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// +build go1.16
+
+package interp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+var ioFSTests = []struct {
+	src, want string
+}{
+	{"echo *", "a.txt b.txt dir\n"},
+	{"echo *.txt dir/*", "a.txt b.txt dir/c.txt\n"},
+	{"echo /dir/*", "/dir/c.txt\n"},
+	{"echo nomatch*", "nomatch*\n"},
+	{"[ -f a.txt ] && echo yes", "yes\n"},
+	{"[ -f dir ] || echo no", "no\n"},
+	{"[ -d dir ] && [ -e /dir/c.txt ] && echo yes", "yes\n"},
+	{"[[ -s a.txt && ! -e missing ]] && echo yes", "yes\n"},
+	{"[ -r a.txt ] && echo yes", "yes\n"},
+	{"[ -w a.txt ] || echo no", "no\n"},
+	{"[ -x dir/c.txt ] && [ ! -x a.txt ] && [ ! -x dir ] && echo yes", "yes\n"},
+	{"read line <a.txt; echo $line", "foo\n"},
+	{"echo $(<dir/c.txt)", "bar\n"},
+	{"cat <b.txt", "b\n"},
+	{"cat a.txt dir/c.txt", "foo\nbar\n"},
+	{"cd dir; echo *; pwd", "c.txt\n/dir\n"},
+	{"cd missing || echo no", "no\n"},
+	{"echo foo >new.txt", "open /new.txt: permission denied\nexit status 1"},
+	{"cat <missing", "open /missing: file does not exist\nexit status 1"},
+	{"read x < <(echo foo); echo $x", "foo\n"},
+	{"cat < <(echo foo)", "foo\n"},
+}
+
+func TestIOFS(t *testing.T) {
+	t.Parallel()
+	fsys := fstest.MapFS{
+		"a.txt":     {Data: []byte("foo\n")},
+		"b.txt":     {Data: []byte("b\n")},
+		"dir/c.txt": {Data: []byte("bar\n"), Mode: 0755},
+	}
+	// A "cat" which reads files via the FS, like the shell does.
+	cat := func(ctx context.Context, args []string) error {
+		hc := HandlerCtx(ctx)
+		if len(args) == 1 {
+			_, err := io.Copy(hc.Stdout, hc.Stdin)
+			return err
+		}
+		for _, arg := range args[1:] {
+			f, err := hc.FS.Open(filepath.Join(hc.Dir, arg), os.O_RDONLY, 0)
+			if err != nil {
+				fmt.Fprintln(hc.Stderr, err)
+				return NewExitStatus(1)
+			}
+			_, err = io.Copy(hc.Stdout, f)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	exec := func(ctx context.Context, args []string) error {
+		if args[0] == "cat" {
+			return cat(ctx, args)
+		}
+		return fmt.Errorf("unexpected program: %q", args[0])
+	}
+	p := syntax.NewParser()
+	for i := range ioFSTests {
+		tc := ioFSTests[i]
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			t.Parallel()
+			file, err := p.Parse(strings.NewReader(tc.src), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			r, err := New(FileSystem(IOFS(fsys)), ExecHandler(exec),
+				StdIO(nil, &buf, &buf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Dir != "/" {
+				t.Fatalf("want the initial dir to be /, got %q", r.Dir)
+			}
+			if err := r.Run(context.Background(), file); err != nil {
+				buf.WriteString(err.Error())
+			}
+			if got := buf.String(); got != tc.want {
+				t.Fatalf("wrong output in %q:\nwant: %q\ngot:  %q",
+					tc.src, tc.want, got)
+			}
+		})
+	}
+}
+
+func TestIOFSDir(t *testing.T) {
+	t.Parallel()
+	fsys := IOFS(fstest.MapFS{"dir/a": {}})
+	if _, err := New(FileSystem(fsys), Dir("/dir")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(FileSystem(fsys), Dir("/missing")); err == nil {
+		t.Fatal("want an error for a missing dir")
+	}
+	if _, err := New(FileSystem(fsys), Dir("/dir/a")); err == nil {
+		t.Fatal("want an error for a dir which is a file")
+	}
+	// Dir is checked with the FileSystem, whichever option comes first.
+	if _, err := New(Dir("/dir"), FileSystem(fsys)); err != nil {
+		t.Fatal(err)
+	}
+}
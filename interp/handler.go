@@ -16,6 +16,7 @@ import (
 	"time"
 
 	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/syntax"
 )
 
 // HandlerCtx returns HandlerContext value stored in ctx.
@@ -28,6 +29,14 @@ func HandlerCtx(ctx context.Context) HandlerContext {
 	return hc
 }
 
+// WithHandlerCtx returns a copy of ctx holding hc, which can be retrieved via
+// HandlerCtx. A handler wrapping another one, such as a middleware given to
+// ExecHandlers, can use it to call the wrapped handler with a modified
+// HandlerContext, like one with a different standard output.
+func WithHandlerCtx(ctx context.Context, hc HandlerContext) context.Context {
+	return context.WithValue(ctx, handlerCtxKey{}, hc)
+}
+
 type handlerCtxKey struct{}
 
 // HandlerContext is the data passed to all the handler functions via a context value.
@@ -47,6 +56,61 @@ type HandlerContext struct {
 	Stdout io.Writer
 	// Stderr is the interpreter's current standard error writer.
 	Stderr io.Writer
+
+	// Rlimits holds the resource limits to apply to started programs, as
+	// set by ResourceLimit and the ulimit builtin. It must not be modified.
+	Rlimits map[Resource]Rlimit
+
+	// EnvFilter is the function set by ChildEnvFilter, if any. Given the
+	// command name and the exported variables in Env, it returns the
+	// environment for a started program.
+	EnvFilter func(cmd string, env []string) []string
+
+	// ExportCheck is the function set by ExportCheck, if any, which only
+	// calls the given function for the variables matching its patterns.
+	ExportCheck ExportCheckFunc
+
+	// FS is the filesystem set by FileSystem, which handlers should use
+	// to access files seen by the shell. It is nil if the HandlerContext
+	// did not come from a Runner.
+	FS FS
+
+	// Open is the reason why the shell is opening a file. It is only set
+	// when calling an OpenHandlerFunc.
+	Open OpenKind
+
+	// Pos is the position of the command being run. It is only set when
+	// calling an ExecHandlerFunc.
+	Pos syntax.Pos
+
+	runner *Runner
+
+	// started is called with the process ID of the started program, if
+	// the command is a background job on its own; see Runner.bgStarted.
+	started func(pid int)
+}
+
+// Subshell returns a new Runner with a copy of the interpreter's current state,
+// like a subshell would. A handler can use it to run shell code, as the Runner
+// calling the handler is busy; see ErrRunnerBusy. Changes made by the code,
+// such as to variables, functions, or the current directory, don't affect the
+// interpreter.
+//
+// The returned Runner can be used after the handler returns, but it must not be
+// run concurrently with other Runners sharing its standard input or output.
+func (hc HandlerContext) Subshell() *Runner {
+	if hc.runner == nil {
+		panic("interp.HandlerContext.Subshell: no Runner in the HandlerContext")
+	}
+	r := hc.runner.sub()
+	if len(r.Funcs) > 0 {
+		funcs := make(map[string]*syntax.Stmt, len(r.Funcs))
+		for name, body := range r.Funcs {
+			funcs[name] = body
+		}
+		r.Funcs = funcs
+	}
+	return r
 }
 
 // ExecHandlerFunc is a handler which executes simple command. It is
@@ -65,6 +129,11 @@ type ExecHandlerFunc func(ctx context.Context, args []string) error
 // On Windows, the kill signal is always sent immediately,
 // because Go doesn't currently support sending Interrupt on Windows.
 // Runner.New sets killTimeout to 2 seconds by default.
+// Any resource limits, environment filter, and export check in the
+// HandlerContext are applied to the started process.
+//
+// The returned handler can be wrapped to restrict which programs may run; see
+// the OpenHandler example.
 func DefaultExecHandler(killTimeout time.Duration) ExecHandlerFunc {
 	return func(ctx context.Context, args []string) error {
 		hc := HandlerCtx(ctx)
@@ -73,18 +142,42 @@ func DefaultExecHandler(killTimeout time.Duration) ExecHandlerFunc {
 			fmt.Fprintln(hc.Stderr, err)
 			return NewExitStatus(127)
 		}
+		env := execEnv(hc.Env)
+		if hc.EnvFilter != nil {
+			// the list may be shared with other commands
+			env = append([]string(nil), env...)
+			env = hc.EnvFilter(args[0], env)
+			if env == nil {
+				// a nil Env would inherit the current process's
+				env = []string{}
+			}
+		}
+		if hc.ExportCheck != nil {
+			var denied string
+			env, denied, err = checkExports(ctx, hc.ExportCheck, args[0], env)
+			if err != nil {
+				return err
+			}
+			if denied != "" {
+				fmt.Fprintf(hc.Stderr, "%s: exporting %s is not allowed\n", args[0], denied)
+				return NewExitStatus(126)
+			}
+		}
 		cmd := exec.Cmd{
 			Path:   path,
 			Args:   args,
-			Env:    execEnv(hc.Env),
+			Env:    env,
 			Dir:    hc.Dir,
 			Stdin:  hc.Stdin,
 			Stdout: hc.Stdout,
 			Stderr: hc.Stderr,
 		}
 
-		err = cmd.Start()
+		err = startCmd(&cmd, hc.Rlimits)
 		if err == nil {
+			if hc.started != nil {
+				hc.started(cmd.Process.Pid)
+			}
 			if done := ctx.Done(); done != nil {
 				go func() {
 					<-done
@@ -264,25 +357,119 @@ func pathExts(env expand.Environ) []string {
 	return exts
 }
 
+// OpenKind is the reason why the shell opens a file, which an OpenHandlerFunc
+// can find in HandlerContext.Open.
+type OpenKind int
+
+const (
+	OpenRedirect OpenKind = iota // a redirect, like "<file" or ">file"
+	OpenSource                   // a script run via "source" or "."
+	OpenCmdSubst                 // a file read via "$(<file)"
+	OpenTest                     // a permission check, like "[ -r file ]"
+)
+
 // OpenHandlerFunc is a handler which opens files. It is
 // called for all files that are opened directly by the shell, such as
 // in redirects. Files opened by executed programs are not included.
 //
 // The path parameter may be relative to the current directory, which can be
-// fetched via HandlerCtx.
+// fetched via HandlerCtx. The flag parameter holds the os.OpenFile flags, such
+// as os.O_WRONLY for files which will be written to, and HandlerContext.Open
+// tells why the file is being opened.
+//
+// A handler can implement a policy by wrapping DefaultOpenHandler, as shown
+// in the OpenHandler example.
 //
 // Use a return error of type *os.PathError to have the error printed to
 // stderr and the exit status set to 1. If the error is of any other type, the
 // interpreter will come to a stop.
 type OpenHandlerFunc func(ctx context.Context, path string, flag int, perm os.FileMode) (io.ReadWriteCloser, error)
 
-// DefaultOpenHandler returns an OpenHandlerFunc used by default. It uses os.OpenFile to open files.
+// DefaultOpenHandler returns an OpenHandlerFunc used by default. It opens files
+// via HandlerContext.FS, falling back to os.OpenFile if it is nil.
 func DefaultOpenHandler() OpenHandlerFunc {
 	return func(ctx context.Context, path string, flag int, perm os.FileMode) (io.ReadWriteCloser, error) {
 		mc := HandlerCtx(ctx)
 		if !filepath.IsAbs(path) {
 			path = filepath.Join(mc.Dir, path)
 		}
+		if mc.FS != nil {
+			return mc.FS.Open(path, flag, perm)
+		}
 		return os.OpenFile(path, flag, perm)
 	}
 }
+
+// SourceHandlerFunc is a handler which resolves the files run by the "source"
+// and "." builtins, such as to serve them from memory or from an embedded
+// filesystem. It replaces the default behavior of searching $PATH for names
+// without a slash and opening the file via the OpenHandlerFunc.
+//
+// The name parameter is the first argument given to the builtin. The returned
+// name is used as the file name in the positions of the sourced program, such
+// as in error messages.
+//
+// Use a return error of type *os.PathError to have the error printed to
+// stderr and the exit status set to 1. If the error is of any other type, the
+// interpreter will come to a stop.
+type SourceHandlerFunc func(ctx context.Context, name string) (io.ReadCloser, string, error)
+
+// TraceKind is the kind of command described by a TraceEvent.
+type TraceKind int
+
+const (
+	TraceExec    TraceKind = iota // a program, run via the exec handler
+	TraceBuiltin                  // a builtin, like "echo"
+	TraceFunc                     // a call to a declared function
+)
+
+// TraceEvent describes a simple command run by the interpreter. See
+// TraceHandlerFunc.
+type TraceEvent struct {
+	Kind TraceKind
+
+	// Done is false when the command is about to run, and true once it has
+	// finished.
+	Done bool
+
+	// Pos is the position of the command's first word.
+	Pos syntax.Pos
+
+	// Args are the command's fields after expansion. They must not be
+	// modified.
+	Args []string
+
+	// Dir is the interpreter's current directory when the command started.
+	Dir string
+
+	// Env holds the variables set only for this command, such as FOO in
+	// "FOO=bar cmd". It is nil if there are none.
+	Env map[string]string
+
+	// Depth is the number of function calls, subshells and command
+	// substitutions which the command is nested in. Commands at the top
+	// level have a depth of zero.
+	Depth int
+
+	// Output is where the trace of the xtrace option is written, which is
+	// the file descriptor in BASH_XTRACEFD if it is set, or standard error.
+	// Handlers may write their own trace to it.
+	Output io.Writer
+
+	// Start is the time at which the command started.
+	Start time.Time
+
+	// Duration and Exit are the time the command took to run and its exit
+	// status. They are only set when Done is true.
+	Duration time.Duration
+	Exit     int
+}
+
+// TraceHandlerFunc is a handler which is called twice for every simple
+// command, after its arguments have been expanded: once right before it runs,
+// and once when it finishes. It is called for programs, builtins, and function
+// calls, including those in subshells, pipelines, and command substitutions.
+//
+// Since parts of a program such as pipelines and background jobs run
+// concurrently, the handler may be called from multiple goroutines at once.
+type TraceHandlerFunc func(ev TraceEvent)
@@ -8,12 +8,17 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"reflect"
 	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"mvdan.cc/sh/v3/expand"
 	"mvdan.cc/sh/v3/syntax"
 )
 
@@ -38,6 +43,15 @@ func blacklistNondevOpen(ctx context.Context, path string, flags int, mode os.Fi
 	return testOpenHandler(ctx, path, flags, mode)
 }
 
+func denyOpenKind(kind OpenKind) OpenHandlerFunc {
+	return func(ctx context.Context, path string, flags int, mode os.FileMode) (io.ReadWriteCloser, error) {
+		if HandlerCtx(ctx).Open == kind {
+			return nil, fmt.Errorf("denied: %s", path)
+		}
+		return testOpenHandler(ctx, path, flags, mode)
+	}
+}
+
 var modCases = []struct {
 	name string
 	exec ExecHandlerFunc
@@ -87,6 +101,30 @@ var modCases = []struct {
 		src:  "echo foo >/dev/null; echo bar >/tmp/x",
 		want: "non-dev: /tmp/x",
 	},
+	{
+		name: "OpenDenyRedirect",
+		open: denyOpenKind(OpenRedirect),
+		src:  "[ -r /dev/null ] && x=$(</dev/null) && . /dev/null && echo ok; echo foo >/dev/null",
+		want: "ok\ndenied: /dev/null",
+	},
+	{
+		name: "OpenDenySource",
+		open: denyOpenKind(OpenSource),
+		src:  "echo foo >/dev/null; . /dev/null",
+		want: "source: denied: /dev/null\ndenied: /dev/null",
+	},
+	{
+		name: "OpenDenyCmdSubst",
+		open: denyOpenKind(OpenCmdSubst),
+		src:  "echo foo >/dev/null; x=$(</dev/null)",
+		want: "denied: /dev/null\ndenied: /dev/null",
+	},
+	{
+		name: "OpenDenyTest",
+		open: denyOpenKind(OpenTest),
+		src:  "echo foo >/dev/null; [ -w /dev/null ]",
+		want: "denied: /dev/null",
+	},
 }
 
 func TestRunnerHandlers(t *testing.T) {
@@ -118,6 +156,513 @@ func TestRunnerHandlers(t *testing.T) {
 	}
 }
 
+func TestRunnerExecHandlers(t *testing.T) {
+	t.Parallel()
+	var calls []string
+	middleware := func(name string) func(next ExecHandlerFunc) ExecHandlerFunc {
+		return func(next ExecHandlerFunc) ExecHandlerFunc {
+			return func(ctx context.Context, args []string) error {
+				calls = append(calls, name)
+				if args[0] == name {
+					// Replace the standard output for the next
+					// handlers.
+					hc := HandlerCtx(ctx)
+					hc.Stdout = ioutil.Discard
+					ctx = WithHandlerCtx(ctx, hc)
+				}
+				return next(ctx, args)
+			}
+		}
+	}
+	var buf bytes.Buffer
+	r, err := New(StdIO(nil, &buf, &buf),
+		ExecHandler(func(ctx context.Context, args []string) error {
+			calls = append(calls, "exec")
+			fmt.Fprintln(HandlerCtx(ctx).Stdout, args[0])
+			return nil
+		}),
+		ExecHandlers(middleware("first"), middleware("second")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Run(context.Background(), parse(t, nil, "first; other")); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"first", "second", "exec", "first", "second", "exec"}
+	if !reflect.DeepEqual(calls, want) {
+		t.Fatalf("want calls %q, got %q", want, calls)
+	}
+	if got := buf.String(); got != "other\n" {
+		t.Fatalf("want output %q, got %q", "other\n", got)
+	}
+}
+
+func TestRunnerChildEnvFilter(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("the tests use Unix commands")
+	}
+	path := os.Getenv("PATH")
+	env := expand.ListEnviron("PATH="+path, "HOME=/home/user", "LANG=C", "SECRET=s")
+	// allow lets through PATH, HOME and LANG, plus some extra names for
+	// commands in extra.
+	allow := func(extra map[string][]string) func(string, []string) []string {
+		return func(cmd string, env []string) []string {
+			allowed := map[string]bool{"PATH": true, "HOME": true, "LANG": true}
+			for _, name := range extra[cmd] {
+				allowed[name] = true
+			}
+			var list []string
+			for _, kv := range env {
+				if allowed[kv[:strings.IndexByte(kv, '=')]] {
+					list = append(list, kv)
+				}
+			}
+			return list
+		}
+	}
+	base := "HOME=/home/user\nLANG=C\nPATH=" + path + "\n"
+	tests := []struct {
+		filter func(string, []string) []string
+		src    string
+		want   string
+	}{
+		{nil, "env | grep -c SECRET", "1\n"},
+		{allow(nil), "env | sort", base},
+		{allow(nil), "echo $SECRET; FOO=1 env | sort", "s\n" + base},
+		{
+			allow(map[string][]string{"env": {"FOO"}}),
+			"FOO=1 BAR=2 env | sort",
+			"FOO=1\n" + base,
+		},
+		{
+			allow(map[string][]string{"env": {"FOO"}}),
+			"export FOO=2 BAR=3; env | sort; FOO=1 env | grep FOO",
+			"FOO=2\n" + base + "FOO=1\n",
+		},
+		{
+			allow(map[string][]string{"printenv": {"FOO"}}),
+			"FOO=1 printenv FOO; FOO=1 env | grep -c FOO || true",
+			"1\n0\n",
+		},
+		{allow(nil), "sort <(env); (env | sort)", base + base},
+		{
+			func(string, []string) []string { return nil },
+			"env | wc -l",
+			"0\n",
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			// the commands in pipes write concurrently
+			buf := &limitBuffer{}
+			r, err := New(Env(env), StdIO(nil, buf, buf), ChildEnvFilter(tc.filter))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Run(context.Background(), parse(t, nil, tc.src)); err != nil {
+				t.Fatalf("%v: %s", err, buf.Bytes())
+			}
+			if got := strings.TrimLeft(string(buf.Bytes()), " "); got != tc.want {
+				t.Fatalf("want:\n%s\ngot:\n%s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestRunnerExportCheck(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("the tests use Unix commands")
+	}
+	env := expand.ListEnviron("PATH="+os.Getenv("PATH"), "HOME_TOKEN=h")
+	noHome := expand.ListEnviron("PATH=" + os.Getenv("PATH"))
+	tests := []struct {
+		env    expand.Environ
+		action ExportAction
+		src    string
+		want   string
+		calls  []string // as "cmd name", sorted
+	}{
+		{env, ExportAllow, "env | grep HOME_TOKEN", "HOME_TOKEN=h\n", []string{"env HOME_TOKEN", "grep HOME_TOKEN"}},
+		{env, ExportRedact, "env | grep HOME_TOKEN", "HOME_TOKEN=REDACTED\n", []string{"env HOME_TOKEN", "grep HOME_TOKEN"}},
+		{env, ExportDeny, "env; echo $?", "env: exporting HOME_TOKEN is not allowed\n126\n", []string{"env HOME_TOKEN"}},
+		{
+			noHome, ExportRedact,
+			"A_TOKEN=1 B_SECRET=2 OTHER=3 env | grep -e A_ -e B_ -e OTHER | sort",
+			"A_TOKEN=REDACTED\nB_SECRET=REDACTED\nOTHER=3\n",
+			[]string{"env A_TOKEN", "env B_SECRET"},
+		},
+		{
+			noHome, ExportRedact,
+			`export X_TOKEN=x; echo $X_TOKEN; sh -c '[ -n "$X_TOKEN" ] && echo set'`,
+			"x\nset\n",
+			[]string{"sh X_TOKEN"},
+		},
+		{
+			noHome, ExportRedact,
+			"(X_TOKEN=x env) | grep X_",
+			"X_TOKEN=REDACTED\n",
+			[]string{"env X_TOKEN"},
+		},
+		{
+			noHome, ExportRedact,
+			"while read -r l; do echo $l; done < <(X_TOKEN=x env | grep X_)",
+			"X_TOKEN=REDACTED\n",
+			[]string{"env X_TOKEN"},
+		},
+		{
+			noHome, ExportRedact,
+			`coproc { X_TOKEN=x env; echo end; read; }; while read -r l && [[ $l != end ]]; do [[ $l == X_* ]] && echo $l; done <&"${COPROC[0]}"; echo >&"${COPROC[1]}"; wait`,
+			"X_TOKEN=REDACTED\n",
+			[]string{"env X_TOKEN"},
+		},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			var mu sync.Mutex
+			var calls []string
+			check := func(ctx context.Context, cmd, name string) (ExportAction, error) {
+				if !HandlerCtx(ctx).Pos.IsValid() {
+					t.Errorf("no position for %s in %s", name, cmd)
+				}
+				mu.Lock()
+				calls = append(calls, cmd+" "+name)
+				mu.Unlock()
+				return tc.action, nil
+			}
+			// the commands in pipes write concurrently
+			buf := &limitBuffer{}
+			r, err := New(Env(tc.env), StdIO(nil, buf, buf),
+				ExportCheck(check, "*_TOKEN", "*_SECRET"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Run(context.Background(), parse(t, nil, tc.src)); err != nil {
+				t.Fatalf("%v: %s", err, buf.Bytes())
+			}
+			if got := string(buf.Bytes()); got != tc.want {
+				t.Fatalf("want:\n%s\ngot:\n%s", tc.want, got)
+			}
+			sort.Strings(calls)
+			if !reflect.DeepEqual(calls, tc.calls) {
+				t.Fatalf("want calls %q, got %q", tc.calls, calls)
+			}
+		})
+	}
+}
+
+func TestRunnerExportCheckError(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("the tests use Unix commands")
+	}
+	check := func(ctx context.Context, cmd, name string) (ExportAction, error) {
+		return ExportAllow, fmt.Errorf("cannot check %s", name)
+	}
+	r, err := New(ExportCheck(check, "FOO"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Run(context.Background(), parse(t, nil, "FOO=1 env; echo unreachable"))
+	if err == nil || err.Error() != "cannot check FOO" {
+		t.Fatalf("want the check's error, got %v", err)
+	}
+	if _, err := New(ExportCheck(check, "[")); err == nil {
+		t.Fatal("want an error for an invalid pattern")
+	}
+}
+
+func TestRunnerExecEnv(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		src  string
+		want string
+	}{
+		{"prog", "A=1\n"},
+		{"B=2 prog; prog", "A=1 B=2\nA=1\n"},
+		{"A=3 prog; prog", "A=3\nA=1\n"},
+		{"export B=2; prog; B=3; prog; unset B; prog", "A=1 B=2\nA=1 B=3\nA=1\n"},
+		{"C=1; prog; export C; prog", "A=1\nA=1 C=1\n"},
+		{"A=2; prog; unset A; prog", "A=2\nA=1\n"},
+		{"f() { local -x L=1; prog; }; f; prog", "A=1 L=1\nA=1\n"},
+		{"export B=2; f() { B=3 prog; }; f; prog", "A=1 B=3\nA=1 B=2\n"},
+		{"(export B=2; prog); prog", "A=1 B=2\nA=1\n"},
+		{"export B=2; prog | prog2; prog & wait", "A=1 B=2\nA=1 B=2\n"},
+		{"declare -x D=1; prog; cd /; prog", "A=1 D=1\nA=1 D=1\n"},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			// the commands in pipes write concurrently
+			buf := &limitBuffer{}
+			exec := func(ctx context.Context, args []string) error {
+				if args[0] == "prog2" {
+					return nil
+				}
+				fmt.Fprintln(buf, strings.Join(execEnv(HandlerCtx(ctx).Env), " "))
+				return nil
+			}
+			r, err := New(Env(expand.ListEnviron("A=1")), ExecHandler(exec))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Run(context.Background(), parse(t, nil, tc.src)); err != nil {
+				t.Fatal(err)
+			}
+			if got := string(buf.Bytes()); got != tc.want {
+				t.Fatalf("want:\n%s\ngot:\n%s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestRunnerBusy(t *testing.T) {
+	t.Parallel()
+	entered := make(chan bool)
+	release := make(chan bool)
+	exec := func(ctx context.Context, args []string) error {
+		if args[0] == "block" {
+			entered <- true
+			<-release
+		}
+		return nil
+	}
+	r, err := New(ExecHandler(exec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- r.Run(context.Background(), parse(t, nil, "block")) }()
+	<-entered
+	if err := r.Run(context.Background(), parse(t, nil, "true")); err != ErrRunnerBusy {
+		t.Fatalf("want ErrRunnerBusy, got %v", err)
+	}
+	release <- true
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Run(context.Background(), parse(t, nil, "true")); err != nil {
+		t.Fatalf("Run after the first one finished: %v", err)
+	}
+
+	// Runs racing on a fresh Runner; one wins, and the others must return
+	// right away without touching its state.
+	r, err = New(ExecHandler(exec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := parse(t, nil, "foo=bar; true")
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			errs[i] = r.Run(context.Background(), file)
+			wg.Done()
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil && err != ErrRunnerBusy {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRunnerSubshell(t *testing.T) {
+	t.Parallel()
+	var r *Runner
+	var stdout limitBuffer
+	exec := func(ctx context.Context, args []string) error {
+		if args[0] != "nested" {
+			return testExecHandler(ctx, args)
+		}
+		file := parse(t, nil, args[1])
+		if err := r.Run(ctx, file); err != ErrRunnerBusy {
+			return fmt.Errorf("want ErrRunnerBusy, got %v", err)
+		}
+		return HandlerCtx(ctx).Subshell().Run(ctx, file)
+	}
+	r, err := New(StdIO(nil, &stdout, &stdout), ExecHandler(exec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := `foo=parent; f() { echo f $foo; }; cd /
+FOO=cmd nested 'echo $foo $FOO $PWD; f; foo=child; g() { :; }; cd /tmp; nested "echo nested \$foo"; exit 3'
+echo $? $foo $PWD; type g &>/dev/null || echo no g`
+	if err := r.Run(context.Background(), parse(t, nil, src)); err != nil {
+		t.Fatal(err)
+	}
+	want := "parent cmd /\nf parent\nnested child\n3 parent /\nno g\n"
+	if got := string(stdout.Bytes()); got != want {
+		t.Fatalf("want:\n%s\ngot:\n%s", want, got)
+	}
+}
+
+func TestRunnerTraceHandler(t *testing.T) {
+	t.Parallel()
+	file := parse(t, nil, `
+f() { echo in f; }
+FOO=bar true
+f x
+a=$(echo sub)
+prog $a
+(cd /; false)
+`)
+	var got []string
+	r, err := New(
+		StdIO(nil, ioutil.Discard, ioutil.Discard),
+		ExecHandler(func(ctx context.Context, args []string) error {
+			return NewExitStatus(3)
+		}),
+		TraceHandler(func(ev TraceEvent) {
+			kinds := [...]string{TraceExec: "exec", TraceBuiltin: "builtin", TraceFunc: "func"}
+			s := fmt.Sprintf("%d %s %s %q", ev.Depth, kinds[ev.Kind], ev.Pos, ev.Args)
+			if ev.Env != nil {
+				s += fmt.Sprintf(" env=%v", ev.Env)
+			}
+			if ev.Done {
+				s += fmt.Sprintf(" exit=%d", ev.Exit)
+				if ev.Duration < 0 {
+					t.Errorf("negative duration: %v", ev.Duration)
+				}
+			}
+			if ev.Dir == "/" {
+				s += " dir=/"
+			}
+			got = append(got, s)
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Run(context.Background(), file); err == nil || err.Error() != "exit status 1" {
+		t.Fatalf("want exit status 1, got %v", err)
+	}
+	want := []string{
+		`0 builtin 3:9 ["true"] env=map[FOO:bar]`,
+		`0 builtin 3:9 ["true"] env=map[FOO:bar] exit=0`,
+		`0 func 4:1 ["f" "x"]`,
+		`1 builtin 2:7 ["echo" "in" "f"]`,
+		`1 builtin 2:7 ["echo" "in" "f"] exit=0`,
+		`0 func 4:1 ["f" "x"] exit=0`,
+		`1 builtin 5:5 ["echo" "sub"]`,
+		`1 builtin 5:5 ["echo" "sub"] exit=0`,
+		`0 exec 6:1 ["prog" "sub"]`,
+		`0 exec 6:1 ["prog" "sub"] exit=3`,
+		`1 builtin 7:2 ["cd" "/"]`,
+		`1 builtin 7:2 ["cd" "/"] exit=0`,
+		`1 builtin 7:8 ["false"] dir=/`,
+		`1 builtin 7:8 ["false"] exit=1 dir=/`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("want:\n%s\ngot:\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+// bufferFile is an open file which writes to a buffer.
+type bufferFile struct{ bytes.Buffer }
+
+func (*bufferFile) Close() error { return nil }
+
+func TestRunnerXTraceFd(t *testing.T) {
+	t.Parallel()
+	file := parse(t, nil, `
+exec 7>trace
+BASH_XTRACEFD=7
+set -x
+echo foo 'a b'
+prog
+unset BASH_XTRACEFD
+true
+`)
+	var trace bufferFile
+	var stdout, stderr bytes.Buffer
+	r, err := New(
+		StdIO(nil, &stdout, &stderr),
+		OpenHandler(func(ctx context.Context, path string, flag int, perm os.FileMode) (io.ReadWriteCloser, error) {
+			if path != "trace" {
+				return nil, fmt.Errorf("unexpected open of %q", path)
+			}
+			return &trace, nil
+		}),
+		ExecHandler(func(ctx context.Context, args []string) error { return nil }),
+		TraceHandler(func(ev TraceEvent) {
+			if ev.Kind == TraceExec && !ev.Done {
+				fmt.Fprintf(ev.Output, "exec %s\n", ev.Args[0])
+			}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Run(context.Background(), file); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := stdout.String(), "foo a b\n"; got != want {
+		t.Fatalf("want stdout %q, got %q", want, got)
+	}
+	// Unsetting BASH_XTRACEFD closes fd 7, and sends the trace back to
+	// stderr.
+	if got, want := stderr.String(), "+ true\n"; got != want {
+		t.Fatalf("want stderr %q, got %q", want, got)
+	}
+	want := "+ echo foo 'a b'\n+ prog\nexec prog\n+ unset BASH_XTRACEFD\n"
+	if got := trace.String(); got != want {
+		t.Fatalf("want trace %q, got %q", want, got)
+	}
+	if _, ok := r.fds[7]; ok {
+		t.Fatalf("fd 7 should have been closed")
+	}
+}
+
+func TestRunnerSourceHandler(t *testing.T) {
+	t.Parallel()
+	libs := map[string]string{
+		"args.sh":  "echo lib $# $@",
+		"bad.sh":   "echo (",
+		"shift.sh": "shift",
+		"fatal.sh": "",
+	}
+	source := func(ctx context.Context, name string) (io.ReadCloser, string, error) {
+		if name == "fatal.sh" {
+			return nil, "", fmt.Errorf("fatal: %s", name)
+		}
+		src, ok := libs[name]
+		if !ok {
+			return nil, "", &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		return ioutil.NopCloser(strings.NewReader(src)), "embed/" + name, nil
+	}
+	tests := []struct {
+		src, want string
+	}{
+		{"source args.sh a b; echo $#", "lib 2 a b\n0\n"},
+		{"set -- x; . args.sh; echo $@", "lib 1 x\nx\n"},
+		{"set -- x y; source shift.sh; echo $@; source shift.sh a b; echo $@", "y\ny\n"},
+		{"source missing.sh", "source: open missing.sh: file does not exist\nexit status 1"},
+		{"source bad.sh", "source: embed/bad.sh:1:1: \"foo(\" must be followed by )\nexit status 1"},
+		{"source fatal.sh; echo unreachable", "source: fatal: fatal.sh\nfatal: fatal.sh"},
+	}
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			file := parse(t, nil, tc.src)
+			var cb concBuffer
+			r, err := New(StdIO(nil, &cb, &cb), SourceHandler(source))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Run(context.Background(), file); err != nil {
+				cb.WriteString(err.Error())
+			}
+			if got := cb.String(); got != tc.want {
+				t.Fatalf("want:\n%s\ngot:\n%s", tc.want, got)
+			}
+		})
+	}
+}
+
 type readyBuffer struct {
 	buf       bytes.Buffer
 	seenReady sync.WaitGroup
@@ -6,10 +6,12 @@ package interp
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math"
+	"math/rand"
 	"os"
 	"path/filepath"
 	"regexp"
@@ -19,7 +21,6 @@ import (
 	"sync"
 	"time"
 
-	"golang.org/x/sync/errgroup"
 	"golang.org/x/xerrors"
 
 	"mvdan.cc/sh/v3/expand"
@@ -43,21 +44,23 @@ func New(opts ...RunnerOption) (*Runner, error) {
 		usedNew:     true,
 		execHandler: DefaultExecHandler(2 * time.Second),
 		openHandler: DefaultOpenHandler(),
+		fs:          DefaultFS(),
 	}
+	r.opts[optPromptVars] = true // enabled by default, like in Bash
 	r.dirStack = r.dirBootstrap[:0]
+	r.lazyDir = true
 	for _, opt := range opts {
 		if err := opt(r); err != nil {
 			return nil, err
 		}
 	}
+	r.lazyDir = false
 	// Set the default fallbacks, if necessary.
 	if r.Env == nil {
 		Env(nil)(r)
 	}
-	if r.Dir == "" {
-		if err := Dir("")(r); err != nil {
-			return nil, err
-		}
+	if err := r.setDir(r.Dir); err != nil {
+		return nil, err
 	}
 	if r.stdout == nil || r.stderr == nil {
 		StdIO(r.stdin, r.stdout, r.stderr)(r)
@@ -70,6 +73,11 @@ func (r *Runner) fillExpandConfig(ctx context.Context) {
 	r.ecfg = &expand.Config{
 		Env: expandEnv{r},
 		CmdSubst: func(w io.Writer, cs *syntax.CmdSubst) error {
+			if r.dryRun != nil {
+				r.dryUneval = true
+				_, err := io.WriteString(w, r.dryRun.Placeholder)
+				return err
+			}
 			switch len(cs.Stmts) {
 			case 0: // nothing to do
 				return nil
@@ -79,7 +87,7 @@ func (r *Runner) fillExpandConfig(ctx context.Context) {
 					break
 				}
 				path := r.literal(word)
-				f, err := r.open(ctx, path, os.O_RDONLY, 0, true)
+				f, err := r.open(ctx, OpenCmdSubst, path, os.O_RDONLY, 0, true)
 				if err != nil {
 					return err
 				}
@@ -88,9 +96,15 @@ func (r *Runner) fillExpandConfig(ctx context.Context) {
 			}
 			r2 := r.sub()
 			r2.stdout = w
+			r2.traceDepth++
+			r2.xtraceLevel++
 			r2.stmts(ctx, cs.Stmts)
 			return r2.err
 		},
+		ProcSubst: func(ps *syntax.ProcSubst) (string, error) {
+			return r.startProcSubst(ctx, ps)
+		},
+		HomeDir: r.userHomeDir,
 	}
 	r.updateExpandOpts()
 }
@@ -115,7 +129,7 @@ func (r *Runner) updateExpandOpts() {
 	if r.opts[optNoGlob] {
 		r.ecfg.ReadDir = nil
 	} else {
-		r.ecfg.ReadDir = ioutil.ReadDir
+		r.ecfg.ReadDir = r.readDir
 	}
 	r.ecfg.GlobStar = r.opts[optGlobStar]
 }
@@ -134,6 +148,21 @@ func (r *Runner) arithm(expr syntax.ArithmExpr) int {
 	return n
 }
 
+// arithmCmd is like arithm, but for expressions run as commands like "((expr))"
+// and "let expr". Like in Bash, errors such as a division by zero are not fatal
+// there; they only set the exit status to 1. The boolean result reports
+// whether the expression was evaluated without errors.
+func (r *Runner) arithmCmd(expr syntax.ArithmExpr) (int, bool) {
+	n, err := expand.Arithm(r.ecfg, expr)
+	if _, ok := err.(expand.ArithmError); ok {
+		r.errf("%v\n", err)
+		r.exit = 1
+		return 0, false
+	}
+	r.expandErr(err)
+	return n, err == nil
+}
+
 func (r *Runner) fields(words ...*syntax.Word) []string {
 	strs, err := expand.Fields(r.ecfg, words...)
 	r.expandErr(err)
@@ -146,6 +175,12 @@ func (r *Runner) literal(word *syntax.Word) string {
 	return str
 }
 
+func (r *Runner) assignWord(word *syntax.Word) string {
+	str, err := expand.Assign(r.ecfg, word)
+	r.expandErr(err)
+	return str
+}
+
 func (r *Runner) document(word *syntax.Word) string {
 	str, err := expand.Document(r.ecfg, word)
 	r.expandErr(err)
@@ -158,6 +193,12 @@ func (r *Runner) pattern(word *syntax.Word) string {
 	return str
 }
 
+func (r *Runner) regexp(word *syntax.Word) string {
+	str, err := expand.Regexp(r.ecfg, word)
+	r.expandErr(err)
+	return str
+}
+
 // expandEnv exposes Runner's variables to the expand package.
 type expandEnv struct {
 	r *Runner
@@ -166,10 +207,26 @@ type expandEnv struct {
 var _ expand.WriteEnviron = expandEnv{}
 
 func (e expandEnv) Get(name string) expand.Variable {
-	return e.r.lookupVar(name)
+	vr := e.r.lookupVar(name)
+	if vr.Kind == expand.NameRef && e.r.nameRefLoops(name) {
+		// Like Bash, expand to nothing instead of following the loop.
+		e.r.errf("warning: %s: circular name reference\n", name)
+		return expand.Variable{}
+	}
+	return vr
 }
 
 func (e expandEnv) Set(name string, vr expand.Variable) error {
+	if vr.Kind != expand.NameRef {
+		name2, cur, ok := e.r.resolveVar(name)
+		if !ok {
+			e.r.errf("warning: %s: circular name reference\n", name)
+			return nil
+		}
+		if name2 != name {
+			name, vr.Local = name2, cur.Local
+		}
+	}
 	e.r.setVarInternal(name, vr)
 	return nil // TODO: return any errors
 }
@@ -197,28 +254,68 @@ func Env(env expand.Environ) RunnerOption {
 
 // Dir sets the interpreter's working directory. If empty, the process's current
 // directory is used.
+//
+// When used with RootDir, path is a virtual path within the root directory, and
+// it defaults to the root itself. The directory is checked to exist via the
+// FileSystem, regardless of the order in which the options are given to New.
 func Dir(path string) RunnerOption {
 	return func(r *Runner) error {
-		if path == "" {
-			path, err := os.Getwd()
-			if err != nil {
-				return fmt.Errorf("could not get current dir: %v", err)
-			}
+		if r.lazyDir {
 			r.Dir = path
 			return nil
 		}
-		path, err := filepath.Abs(path)
+		return r.setDir(path)
+	}
+}
+
+func (r *Runner) setDir(path string) error {
+	if path == "" && r.rootDir != "" {
+		r.Dir = string(filepath.Separator)
+		return nil
+	}
+	if path == "" {
+		path, err := r.fs.Getwd()
 		if err != nil {
-			return fmt.Errorf("could not get absolute dir: %v", err)
+			return fmt.Errorf("could not get current dir: %v", err)
 		}
-		info, err := os.Stat(path)
+		r.Dir = path
+		return nil
+	}
+	if r.rootDir != "" {
+		// A virtual path; relative paths start at the root.
+		path = filepath.Join(string(filepath.Separator), path)
+	} else {
+		var err error
+		path, err = filepath.Abs(path)
 		if err != nil {
-			return fmt.Errorf("could not stat: %v", err)
-		}
-		if !info.IsDir() {
-			return fmt.Errorf("%s is not a directory", path)
+			return fmt.Errorf("could not get absolute dir: %v", err)
 		}
-		r.Dir = path
+	}
+	hostPath, err := r.hostPath(path)
+	if err != nil {
+		return fmt.Errorf("could not map dir: %v", err)
+	}
+	info, err := r.fs.Stat(hostPath)
+	if err != nil {
+		return fmt.Errorf("could not stat: %v", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	r.Dir = path
+	return nil
+}
+
+// ShellName sets $0, the name of the shell or shell script, like the name given
+// after the command in "bash -c 'echo $0' name". It takes precedence over the
+// name of a *syntax.File being run, which is used otherwise. Without either,
+// $0 is "gosh".
+//
+// Like in other shells, $0 doesn't change in functions, sourced files, or
+// subshells.
+func ShellName(name string) RunnerOption {
+	return func(r *Runner) error {
+		r.shellName = name
 		return nil
 	}
 }
@@ -228,6 +325,9 @@ func Dir(path string) RunnerOption {
 // Params("+e") will unset the "-e" option and leave the parameters untouched.
 //
 // This is similar to what the interpreter's "set" builtin does.
+//
+// Job control is not supported, so monitor mode via "-m" or "-o monitor" is
+// accepted but has no effect. The "set" builtin warns about it once.
 func Params(args ...string) RunnerOption {
 	return func(r *Runner) error {
 		onlyFlags := true
@@ -244,7 +344,8 @@ func Params(args ...string) RunnerOption {
 			}
 			enable := arg[0] == '-'
 			var opt *bool
-			if flag := arg[1:]; flag == "o" {
+			flag := arg[1:]
+			if flag == "o" {
 				args = args[1:]
 				if len(args) == 0 && enable {
 					for i, opt := range &shellOptsTable {
@@ -266,6 +367,13 @@ func Params(args ...string) RunnerOption {
 			} else {
 				opt = r.optByFlag(flag)
 			}
+			if opt == nil && (flag == "m" || (flag == "o" && args[0] == "monitor")) {
+				// Job control isn't supported, so monitor mode is
+				// accepted but has no effect. See the set builtin.
+				r.monitorSet = r.monitorSet || enable
+				args = args[1:]
+				continue
+			}
 			if opt == nil {
 				return fmt.Errorf("invalid option: %q", arg)
 			}
@@ -282,9 +390,36 @@ func Params(args ...string) RunnerOption {
 }
 
 // ExecHandler sets command execution handler. See ExecHandlerFunc for more info.
+//
+// Unlike with DefaultExecHandler, a background job running a program has a
+// synthetic process ID in "$!", as the handler may run commands in-process.
 func ExecHandler(f ExecHandlerFunc) RunnerOption {
 	return func(r *Runner) error {
 		r.execHandler = f
+		r.execCustom = true
+		return nil
+	}
+}
+
+// ExecHandlers appends middlewares to handle command execution. The
+// middlewares are chained from first to last, and the first is called by the
+// runner. Each middleware should call the "next" handler at most once, and the
+// last one wraps the handler set so far, such as via ExecHandler, which is
+// DefaultExecHandler if none was set.
+//
+// For example, a middleware can log the commands being run:
+//
+//	func(next interp.ExecHandlerFunc) interp.ExecHandlerFunc {
+//		return func(ctx context.Context, args []string) error {
+//			log.Println(args)
+//			return next(ctx, args)
+//		}
+//	}
+func ExecHandlers(middlewares ...func(next ExecHandlerFunc) ExecHandlerFunc) RunnerOption {
+	return func(r *Runner) error {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			r.execHandler = middlewares[i](r.execHandler)
+		}
 		return nil
 	}
 }
@@ -297,6 +432,228 @@ func OpenHandler(f OpenHandlerFunc) RunnerOption {
 	}
 }
 
+// FileSystem sets the filesystem used by the interpreter. If nil, DefaultFS is
+// used. See FS for more info.
+func FileSystem(fsys FS) RunnerOption {
+	return func(r *Runner) error {
+		if fsys == nil {
+			fsys = DefaultFS()
+		}
+		r.fs = fsys
+		return nil
+	}
+}
+
+// RandomSeed sets the seed of the pseudo-random numbers given by $RANDOM, to
+// get reproducible results. By default, the seed is based on the current time.
+// As in Bash, assigning a number to RANDOM also sets the seed.
+func RandomSeed(seed int64) RunnerOption {
+	return func(r *Runner) error {
+		r.randSeed = &seed
+		return nil
+	}
+}
+
+// SourceHandler sets the handler which resolves the files run by the source
+// builtin. See SourceHandlerFunc for more info.
+func SourceHandler(f SourceHandlerFunc) RunnerOption {
+	return func(r *Runner) error {
+		r.sourceHandler = f
+		return nil
+	}
+}
+
+// TraceHandler sets a handler to be called before and after every simple
+// command. See TraceHandlerFunc for more info.
+func TraceHandler(f TraceHandlerFunc) RunnerOption {
+	return func(r *Runner) error {
+		r.traceHandler = f
+		return nil
+	}
+}
+
+// RestrictedShell makes the runner a restricted shell, like "bash -r", to run
+// untrusted scripts with fewer ways to affect the rest of the system:
+//
+//   - cd and pushd fail, so that the directory can't be changed
+//   - PATH, ENV, SHELL and BASH_ENV are read-only variables
+//   - command names, and files given to source, can't contain slashes
+//   - output redirections like ">file" fail, so that no files are written
+//   - exec fails when given a command to replace the shell with
+//
+// These rules are checked before calling any handlers. As in Bash, breaking
+// a rule is an error with exit status 1, and they also apply to subshells and
+// sourced files. Note that programs run via the exec handler aren't restricted
+// in any way, so the handler should only allow those which can't get around
+// the rules.
+func RestrictedShell(enabled bool) RunnerOption {
+	return func(r *Runner) error {
+		r.restricted = enabled
+		return nil
+	}
+}
+
+// StrictErrExit makes the "errexit" option, set via "set -e", apply within
+// functions, subshells and command substitutions even when their exit status is
+// tested, such as in "if f; then". Only the tested command itself is exempt.
+//
+// By default, the interpreter behaves like Bash, where errexit is ignored for
+// the entire body of a function called in a tested context. That is, the
+// conditions of if, while and until, any command in a && or || list except the
+// last, and any pipeline preceded by !. For example, "cont" is printed below,
+// even though false fails before it:
+//
+//	set -e
+//	f() { false; echo cont; }
+//	if f; then echo ok; fi
+func StrictErrExit(enabled bool) RunnerOption {
+	return func(r *Runner) error {
+		r.strictErrExit = enabled
+		return nil
+	}
+}
+
+// restrictedVars are the variables which are read-only in a restricted shell.
+var restrictedVars = [...]string{"PATH", "ENV", "SHELL", "BASH_ENV"}
+
+var errRestricted = fmt.Errorf("restricted")
+
+// cmdVarsErr reports an error and returns errRestricted if any of the
+// assignments before a command is to a read-only variable, including those
+// which are read-only in a restricted shell. The command isn't run then.
+func (r *Runner) cmdVarsErr(assigns []*syntax.Assign) error {
+	for _, as := range assigns {
+		name := as.Name.Value
+		readOnly := r.lookupVar(name).ReadOnly
+		if r.restricted {
+			for _, name2 := range restrictedVars {
+				readOnly = readOnly || name == name2
+			}
+		}
+		if readOnly {
+			r.errf("%s: readonly variable\n", name)
+			return errRestricted
+		}
+	}
+	return nil
+}
+
+// YieldEvery makes the interpreter call fn every n statements that it runs,
+// giving the caller a chance to report progress or to stop the interpreter,
+// even within a long loop of builtins. Statements in loops and function bodies
+// are counted each time they run.
+//
+// If fn returns a non-nil error, the interpreter stops with that error. If fn
+// is nil, runtime.Gosched is called instead. In both cases, the context passed
+// to Run is checked for cancellation right after.
+//
+// Subshells, such as those in pipelines, count their statements separately.
+func YieldEvery(n int, fn func(ctx context.Context) error) RunnerOption {
+	return func(r *Runner) error {
+		if n < 0 {
+			return fmt.Errorf("invalid yield interval: %d", n)
+		}
+		r.yieldEvery = n
+		r.yieldFunc = fn
+		return nil
+	}
+}
+
+// RootDir makes the interpreter treat dir as the root of the filesystem, much
+// like chroot. Absolute paths used by the shell program, such as "/etc/foo",
+// are translated to be under dir. This applies to redirections, the cd builtin,
+// globbing, file test operators, sourced files, and the directory that programs
+// are executed in.
+//
+// Handlers always receive translated host paths. Program names are still
+// looked up in the host's $PATH, unless RootDirLookPath is enabled. Arguments
+// to programs are never translated, as they may not be paths at all.
+//
+// Since ".." can never go above the root, the only possible escape is via
+// symbolic links; see StrictRootDir.
+func RootDir(dir string) RunnerOption {
+	return func(r *Runner) error {
+		if dir == "" {
+			r.rootDir = ""
+			return nil
+		}
+		dir, err := filepath.Abs(dir)
+		if err != nil {
+			return fmt.Errorf("could not get absolute root dir: %v", err)
+		}
+		info, err := os.Stat(dir)
+		if err != nil {
+			return fmt.Errorf("could not stat: %v", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+		r.rootDir = dir
+		return nil
+	}
+}
+
+// StrictRootDir makes the interpreter refuse to access any path which, once
+// symbolic links are followed, is outside of the directory set via RootDir.
+func StrictRootDir(enabled bool) RunnerOption {
+	return func(r *Runner) error {
+		r.rootStrict = enabled
+		return nil
+	}
+}
+
+// RootDirLookPath makes the elements of $PATH be translated by RootDir when
+// executing programs, so that binaries are found inside the root directory.
+func RootDirLookPath(enabled bool) RunnerOption {
+	return func(r *Runner) error {
+		r.rootLookPath = enabled
+		return nil
+	}
+}
+
+// ResourceLimit sets a limit for a resource, which is applied to every program
+// started by DefaultExecHandler. Shell programs can use the ulimit builtin to
+// lower the limits, but never to raise them above the hard limit. Resources
+// without a limit keep the ones of the current process.
+//
+// Limits are only supported on Linux, where each program is started via the
+// current executable, found at /proc/self/exe, which sets its limits before
+// executing it. On other platforms, ulimit reports all resources as unlimited,
+// and setting limits only prints a warning.
+func ResourceLimit(res Resource, lim Rlimit) RunnerOption {
+	return func(r *Runner) error {
+		if res < 0 || int(res) >= len(rlimitTable) {
+			return fmt.Errorf("invalid resource: %d", res)
+		}
+		if lim.Cur > lim.Max {
+			return fmt.Errorf("soft limit %d is above the hard limit %d", lim.Cur, lim.Max)
+		}
+		rlimits := make(map[Resource]Rlimit, len(r.rlimits)+1)
+		for res, lim := range r.rlimits {
+			rlimits[res] = lim
+		}
+		rlimits[res] = lim
+		r.rlimits = rlimits
+		return nil
+	}
+}
+
+// ChildEnvFilter sets a function to choose the environment of each program
+// started by DefaultExecHandler. It is given the command name as written in the
+// program and the exported variables as "name=value" strings, including any
+// assignments prefixed to the command, like in "FOO=1 curl ...". The returned
+// list is the program's whole environment; if it is empty, the program gets no
+// environment variables at all.
+//
+// The filter applies to all programs, including those started in subshells and
+// process substitutions. Expansions within the shell still see all variables.
+func ChildEnvFilter(fn func(cmd string, env []string) []string) RunnerOption {
+	return func(r *Runner) error {
+		r.childEnvFilter = fn
+		return nil
+	}
+}
+
 // StdIO configures an interpreter's standard input, standard output, and
 // standard error. If out or err are nil, they default to a writer that discards
 // the output.
@@ -345,12 +702,91 @@ type Runner struct {
 	Vars  map[string]expand.Variable
 	Funcs map[string]*syntax.Stmt
 
+	// exportedFuncs holds the names of the functions exported via
+	// "export -f", or imported from the environment.
+	exportedFuncs map[string]bool
+
 	// execHandler is a function responsible for executing programs. It must be non-nil.
 	execHandler ExecHandlerFunc
+	// execCustom is set by ExecHandler. As the handler may not start
+	// programs, background jobs then keep synthetic process IDs.
+	execCustom bool
 
 	// openHandler is a function responsible for opening files. It must be non-nil.
 	openHandler OpenHandlerFunc
 
+	// fs is the filesystem set by FileSystem. It must be non-nil.
+	fs FS
+
+	// sourceHandler resolves the files run by the source builtin, if
+	// non-nil.
+	sourceHandler SourceHandlerFunc
+
+	// traceHandler is called around every simple command, if non-nil.
+	traceHandler TraceHandlerFunc
+
+	// traceDepth is the current nesting depth, as reported in TraceEvent.
+	traceDepth int
+
+	// restricted is set by RestrictedShell.
+	restricted bool
+
+	// strictErrExit is set by StrictErrExit.
+	strictErrExit bool
+
+	// xtraceFd is the file descriptor set by BASH_XTRACEFD which the
+	// trace of the xtrace option is written to, or -1 for stderr.
+	xtraceFd int
+	// xtraceLevel is the number of command substitutions, evals and
+	// sourced files which the trace is nested in, as shown by PS4.
+	xtraceLevel int
+
+	// outputLimit holds the stdout and stderr limits set by OutputLimit.
+	outputLimit [2]int
+
+	// yieldEvery and yieldFunc are set by YieldEvery. yieldCount is the
+	// number of statements run since the last yield.
+	yieldEvery int
+	yieldFunc  func(ctx context.Context) error
+	yieldCount int
+
+	// rootDir is the host directory acting as the filesystem root, if any.
+	rootDir      string
+	rootStrict   bool
+	rootLookPath bool
+
+	// rlimits holds the resource limits set via ResourceLimit and the
+	// ulimit builtin. It is copied on write, as subshells share it.
+	rlimits map[Resource]Rlimit
+
+	// childEnvFilter is set by ChildEnvFilter.
+	childEnvFilter func(cmd string, env []string) []string
+
+	// exportCheck is set by ExportCheck, only calling the given function
+	// for the variables matching its patterns.
+	exportCheck ExportCheckFunc
+
+	// hostInfo is set by SystemInfo. If nil, the system is queried.
+	hostInfo *HostInfo
+	// userHomeDir is set by UserHomeDir. If nil, os/user is used.
+	userHomeDir func(name string) (string, error)
+
+	// rand is the source of $RANDOM, seeded with randSeed if it is
+	// non-nil, as set by RandomSeed.
+	rand     *rand.Rand
+	randSeed *int64
+
+	// secondsStart is the time from which $SECONDS counts.
+	secondsStart time.Time
+
+	// persist is set by PersistVars. It is not copied by subshells, as
+	// their changes to variables don't persist.
+	persist *varPersister
+
+	// dynamicOff holds the dynamic variables such as RANDOM which lost
+	// their special meaning by being unset.
+	dynamicOff map[string]bool
+
 	stdin  io.Reader
 	stdout io.Writer
 	stderr io.Writer
@@ -365,7 +801,12 @@ type Runner struct {
 
 	usedNew bool
 
-	filename string // only if Node was a File
+	// lazyDir is set while New applies its options, so that Dir is only
+	// checked once RootDir and FileSystem are known.
+	lazyDir bool
+
+	filename  string // only if Node was a File
+	shellName string // set via ShellName
 
 	// like Vars, but local to a func i.e. "local foo=bar"
 	funcVars map[string]expand.Variable
@@ -373,6 +814,10 @@ type Runner struct {
 	// like Vars, but local to a cmd i.e. "foo=bar prog args..."
 	cmdVars map[string]string
 
+	// envCache is the environment given to handlers, built from Env, Vars
+	// and funcVars.
+	envCache envCache
+
 	// >0 to break or continue out of N enclosing loops
 	breakEnclosing, contnEnclosing int
 
@@ -385,7 +830,40 @@ type Runner struct {
 	exit      int   // current (last) exit status code
 	exitShell bool  // whether the shell needs to exit
 
-	bgShells errgroup.Group
+	// exitErr records why the shell is exiting when it is via the "exit"
+	// builtin or errexit. Its status is filled in by Run.
+	exitErr error
+	// lastCmd is the name of the last simple command run by cmd, for
+	// ErrexitError.
+	lastCmd string
+
+	// bgJobs are the background jobs started via "&" which haven't been
+	// waited for yet. lastBgJob is the last one started, for $!.
+	bgJobs    []*bgJob
+	lastBgJob *bgJob
+	nextBgPid int
+
+	// bgStarted is set when the runner runs a background job made of a
+	// single simple command, to report the process ID of the program it
+	// starts, or zero if it runs a function or builtin instead. It is
+	// only called once.
+	bgStarted func(pid int)
+
+	// procSubsts are the process substitutions like "<(cmd)" which the
+	// statements being run have started. Like in Bash, they use the
+	// standard input and output from before the redirections of the
+	// statement, stmtStdin and stmtStdout.
+	procSubsts []*procSubst
+	// outerProcSubsts are the paths of the process substitutions started
+	// by the parent runners, which the statements may still use.
+	outerProcSubsts []string
+	stmtStdin       io.Reader
+	stmtStdout      io.Writer
+
+	// monitorSet is true once monitor mode was enabled via "set -m", and
+	// monitorWarned once the set builtin warned that it is unsupported.
+	monitorSet    bool
+	monitorWarned bool
 
 	opts runnerOpts
 
@@ -396,6 +874,8 @@ type Runner struct {
 	origStdout io.Writer
 	origStderr io.Writer
 
+	origRlimits map[Resource]Rlimit
+
 	// Most scripts don't use pushd/popd, so make space for the initial PWD
 	// without requiring an extra allocation.
 	dirStack     []string
@@ -407,6 +887,21 @@ type Runner struct {
 	// apply to the current shell, and not just the command.
 	keepRedirs bool
 
+	// dryRun is non-nil if DryRun is used; it is shared with subshells.
+	dryRun *dryRun
+	// dryUneval is set when a command substitution is replaced by the
+	// placeholder in a dry run.
+	dryUneval bool
+
+	// fds holds the file descriptors above 2 which the program opened,
+	// such as via "exec 3>file". The standard streams are stdin, stdout,
+	// and stderr.
+	//
+	// The interpreter never uses file descriptors for its internal state,
+	// like the program's source or its heredocs, so the program can never
+	// interfere with them. This is similar to how Bash protects fd 255.
+	fds map[int]io.ReadWriteCloser
+
 	// So that we can get io.Copy to reuse the same buffer within a runner.
 	// For example, this saves an allocation for every shell pipe, since
 	// io.PipeReader does not implement io.WriterTo.
@@ -463,11 +958,13 @@ var shellOptsTable = [...]struct {
 	{"f", "noglob"},
 	{"u", "nounset"},
 	{" ", "pipefail"},
+	{"x", "xtrace"},
 }
 
 var bashOptsTable = [...]string{
 	// sorted alphabetically by name
 	"globstar",
+	"promptvars",
 }
 
 // To access the shell options arrays without a linear search when we
@@ -480,8 +977,10 @@ const (
 	optNoGlob
 	optNoUnset
 	optPipeFail
+	optXTrace
 
 	optGlobStar
+	optPromptVars
 )
 
 // Reset returns a runner to its initial state, right before the first call to
@@ -502,29 +1001,58 @@ func (r *Runner) Reset() {
 		r.origStdin = r.stdin
 		r.origStdout = r.stdout
 		r.origStderr = r.stderr
+		r.origRlimits = r.rlimits
+	}
+	// don't leave any background jobs or process substitutions running
+	r.stopJobs()
+	r.stopProcSubsts(0)
+	for _, f := range r.fds {
+		f.Close()
 	}
 	// reset the internal state
 	*r = Runner{
-		Env:         r.Env,
-		execHandler: r.execHandler,
-		openHandler: r.openHandler,
+		Env:            r.Env,
+		execHandler:    r.execHandler,
+		execCustom:     r.execCustom,
+		openHandler:    r.openHandler,
+		fs:             r.fs,
+		sourceHandler:  r.sourceHandler,
+		traceHandler:   r.traceHandler,
+		restricted:     r.restricted,
+		strictErrExit:  r.strictErrExit,
+		yieldEvery:     r.yieldEvery,
+		yieldFunc:      r.yieldFunc,
+		rootDir:        r.rootDir,
+		rootStrict:     r.rootStrict,
+		rootLookPath:   r.rootLookPath,
+		hostInfo:       r.hostInfo,
+		userHomeDir:    r.userHomeDir,
+		childEnvFilter: r.childEnvFilter,
+		exportCheck:    r.exportCheck,
+		randSeed:       r.randSeed,
+		dryRun:         r.dryRun,
+		outputLimit:    r.outputLimit,
+		persist:        r.persist,
+		shellName:      r.shellName,
 
 		// These can be set by functions like Dir or Params, but
 		// builtins can overwrite them; reset the fields to whatever the
 		// constructor set up.
-		Dir:    r.origDir,
-		Params: r.origParams,
-		opts:   r.origOpts,
-		stdin:  r.origStdin,
-		stdout: r.origStdout,
-		stderr: r.origStderr,
-
-		origDir:    r.origDir,
-		origParams: r.origParams,
-		origOpts:   r.origOpts,
-		origStdin:  r.origStdin,
-		origStdout: r.origStdout,
-		origStderr: r.origStderr,
+		Dir:     r.origDir,
+		Params:  r.origParams,
+		opts:    r.origOpts,
+		stdin:   r.origStdin,
+		stdout:  r.origStdout,
+		stderr:  r.origStderr,
+		rlimits: r.origRlimits,
+
+		origDir:     r.origDir,
+		origParams:  r.origParams,
+		origOpts:    r.origOpts,
+		origStdin:   r.origStdin,
+		origStdout:  r.origStdout,
+		origStderr:  r.origStderr,
+		origRlimits: r.origRlimits,
 
 		// emptied below, to reuse the space
 		Vars:      r.Vars,
@@ -532,6 +1060,8 @@ func (r *Runner) Reset() {
 		dirStack:  r.dirStack[:0],
 		usedNew:   r.usedNew,
 		bufCopier: r.bufCopier,
+
+		xtraceFd: -1,
 	}
 	if r.Vars == nil {
 		r.Vars = make(map[string]expand.Variable)
@@ -548,17 +1078,36 @@ func (r *Runner) Reset() {
 		}
 	}
 	if vr := r.Env.Get("HOME"); !vr.IsSet() {
-		home, _ := os.UserHomeDir()
+		var home string
+		if r.userHomeDir != nil {
+			home, _ = r.userHomeDir(r.sysInfo().User)
+		} else {
+			home, _ = os.UserHomeDir()
+		}
 		r.Vars["HOME"] = expand.Variable{Kind: expand.String, Str: home}
 	}
+	uid := os.Getuid()
+	if r.hostInfo != nil {
+		uid = r.hostInfo.UID
+	}
 	r.Vars["UID"] = expand.Variable{
 		Kind:     expand.String,
 		ReadOnly: true,
-		Str:      strconv.Itoa(os.Getuid()),
+		Str:      strconv.Itoa(uid),
 	}
 	r.Vars["PWD"] = expand.Variable{Kind: expand.String, Str: r.Dir}
 	r.Vars["IFS"] = expand.Variable{Kind: expand.String, Str: " \t\n"}
 	r.Vars["OPTIND"] = expand.Variable{Kind: expand.String, Str: "1"}
+	if vr := r.Env.Get("PS4"); !vr.IsSet() {
+		r.Vars["PS4"] = expand.Variable{Kind: expand.String, Str: "+ "}
+	}
+
+	seed := r.now().UnixNano()
+	if r.randSeed != nil {
+		seed = *r.randSeed
+	}
+	r.rand = rand.New(rand.NewSource(seed))
+	r.secondsStart = r.now()
 
 	if runtime.GOOS == "windows" {
 		// convert $PATH to a unix path list
@@ -566,6 +1115,20 @@ func (r *Runner) Reset() {
 		path = strings.Join(filepath.SplitList(path), ":")
 		r.Vars["PATH"] = expand.Variable{Kind: expand.String, Str: path}
 	}
+	if r.persist != nil {
+		r.loadPersisted()
+	}
+	r.importFuncs()
+	if r.restricted {
+		for _, name := range restrictedVars {
+			vr, ok := r.Vars[name]
+			if !ok {
+				vr = r.Env.Get(name)
+			}
+			vr.ReadOnly = true
+			r.Vars[name] = vr
+		}
+	}
 
 	r.dirStack = append(r.dirStack, r.Dir)
 	r.didReset = true
@@ -573,27 +1136,52 @@ func (r *Runner) Reset() {
 }
 
 func (r *Runner) handlerCtx(ctx context.Context) context.Context {
+	return context.WithValue(ctx, handlerCtxKey{}, r.handlerContext())
+}
+
+func (r *Runner) handlerContext() HandlerContext {
 	hc := HandlerContext{
-		Dir:    r.Dir,
-		Stdin:  r.stdin,
-		Stdout: r.stdout,
-		Stderr: r.stderr,
-	}
-	oenv := overlayEnviron{
-		parent: r.Env,
-		values: make(map[string]expand.Variable),
-	}
-	for name, vr := range r.Vars {
-		oenv.Set(name, vr)
-	}
-	for name, vr := range r.funcVars {
-		oenv.Set(name, vr)
+		Dir:         r.Dir,
+		Stdin:       r.stdin,
+		Stdout:      r.stdout,
+		Stderr:      r.stderr,
+		Rlimits:     r.rlimits,
+		EnvFilter:   r.childEnvFilter,
+		ExportCheck: r.exportCheck,
+		FS:          r.fs,
+		runner:      r,
+	}
+	exec, execIdx := r.cachedExecEnv()
+	oenv := overlayEnviron{parent: r.cachedEnviron()}
+	if len(r.cmdVars) > 0 || r.rootDir != "" {
+		oenv.values = make(map[string]expand.Variable, len(r.cmdVars))
 	}
 	for name, value := range r.cmdVars {
 		oenv.Set(name, expand.Variable{Exported: true, Kind: expand.String, Str: value})
 	}
-	hc.Env = oenv
-	return context.WithValue(ctx, handlerCtxKey{}, hc)
+	if r.rootDir != "" {
+		// Handlers work with host paths.
+		hc.Dir, _ = r.hostPath(r.Dir)
+		vr := oenv.Get("PWD")
+		vr.Str = hc.Dir
+		oenv.Set("PWD", vr)
+		if r.rootLookPath {
+			vr := oenv.Get("PATH")
+			var list []string
+			for _, elem := range splitList(vr.String()) {
+				if elem == "" || elem == "." {
+					list = append(list, elem)
+					continue
+				}
+				elem, _ = r.hostPath(elem)
+				list = append(list, elem)
+			}
+			vr.Kind, vr.Str = expand.String, strings.Join(list, ":")
+			oenv.Set("PATH", vr)
+		}
+	}
+	hc.Env = handlerEnviron{oenv, exec, execIdx}
+	return hc
 }
 
 // exitStatus is a non-zero status code resulting from running a shell node.
@@ -606,6 +1194,43 @@ func NewExitStatus(status uint8) error {
 	return exitStatus(status)
 }
 
+// ExitError is returned by Runner.Run when the shell finishes with a non-zero
+// exit status, unless it was due to the "errexit" option. It contains an exit
+// status, so IsExitStatus can also be used with it.
+type ExitError struct {
+	Status uint8
+
+	// Explicit is true if the shell exited via the "exit" or "exec"
+	// builtins, and false if it ran out of commands or stopped due to an
+	// error such as an unbound variable with "nounset".
+	Explicit bool
+
+	// Pos is the position of the builtin call if Explicit is true.
+	Pos syntax.Pos
+}
+
+func (e *ExitError) Error() string { return exitStatus(e.Status).Error() }
+
+func (e *ExitError) Unwrap() error { return exitStatus(e.Status) }
+
+// ErrexitError is returned by Runner.Run when the shell exits because a command
+// failed while the "errexit" option was set, such as via "set -e". It contains
+// an exit status, so IsExitStatus can also be used with it.
+type ErrexitError struct {
+	Status uint8
+
+	// Cmd is the name of the failed command, such as "false". It is empty
+	// if the failed command only consisted of assignments.
+	Cmd string
+
+	// Pos is the position of the failed statement.
+	Pos syntax.Pos
+}
+
+func (e *ErrexitError) Error() string { return exitStatus(e.Status).Error() }
+
+func (e *ErrexitError) Unwrap() error { return exitStatus(e.Status) }
+
 // IsExitStatus checks whether error contains an exit status and returns it.
 func IsExitStatus(err error) (status uint8, ok bool) {
 	var s exitStatus
@@ -625,17 +1250,37 @@ func (r *Runner) setErr(err error) {
 // error is returned, it will typically contain commands exit status,
 // which can be retrieved with IsExitStatus.
 //
+// A non-zero exit status is returned as an *ErrexitError if the shell exited
+// due to the "errexit" option, and as an *ExitError otherwise. Errors from the
+// context, such as context.Canceled, are returned as they are.
+//
 // Run can be called multiple times synchronously to interpret programs
 // incrementally. To reuse a Runner without keeping the internal shell state,
 // call Reset.
+//
+// Calling Run while the same Runner is already running, be it from another
+// goroutine or from within one of its handlers, returns ErrRunnerBusy right
+// away. Handlers can use HandlerContext.Subshell to run more code instead.
 func (r *Runner) Run(ctx context.Context, node syntax.Node) error {
+	if _, busy := runningRunners.LoadOrStore(r, struct{}{}); busy {
+		return ErrRunnerBusy
+	}
+	defer runningRunners.Delete(r)
 	if !r.didReset {
 		r.Reset()
 	}
 	r.fillExpandConfig(ctx)
+	// Env and Vars may have been modified directly since the last run.
+	r.varsChanged(true)
 	r.err = nil
 	r.exitShell = false
+	r.exitErr = nil
 	r.filename = ""
+	if r.dryRun != nil {
+		r.dryRun.mu.Lock()
+		r.dryRun.steps = nil
+		r.dryRun.mu.Unlock()
+	}
 	switch x := node.(type) {
 	case *syntax.File:
 		r.filename = x.Name
@@ -648,11 +1293,31 @@ func (r *Runner) Run(ctx context.Context, node syntax.Node) error {
 		return fmt.Errorf("node can only be File, Stmt, or Command: %T", x)
 	}
 	if r.exit != 0 {
-		r.setErr(NewExitStatus(uint8(r.exit)))
+		status := uint8(r.exit)
+		switch err := r.exitErr.(type) {
+		case *ExitError:
+			err.Status = status
+			r.setErr(err)
+		case *ErrexitError:
+			err.Status = status
+			r.setErr(err)
+		default:
+			r.setErr(&ExitError{Status: status})
+		}
+	}
+	if r.err == nil && r.persist != nil && r.dryRun == nil {
+		r.err = r.savePersisted()
 	}
 	return r.err
 }
 
+// ErrRunnerBusy is returned by Runner.Run when the Runner is already running.
+var ErrRunnerBusy = errors.New("interp: Runner is already running")
+
+// runningRunners holds the Runners which are within a Run call. It lives
+// outside of Runner, as Reset overwrites the entire Runner while running.
+var runningRunners sync.Map // map[*Runner]struct{}
+
 // Exited reports whether the last Run call should exit an entire shell. This
 // can be triggered by the "exit" built-in command, for example.
 //
@@ -692,39 +1357,242 @@ func (r *Runner) stmt(ctx context.Context, st *syntax.Stmt) {
 	if r.stop(ctx) {
 		return
 	}
+	if r.yieldEvery > 0 {
+		if r.yieldCount++; r.yieldCount >= r.yieldEvery && r.yield(ctx) {
+			return
+		}
+	}
+	r.reapCoprocs()
 	if st.Background {
-		r2 := r.sub()
-		st2 := *st
-		st2.Background = false
-		r.bgShells.Go(func() error {
-			return r2.Run(ctx, &st2)
-		})
+		r.startJob(ctx, st)
+		r.exit = 0
 	} else {
 		r.stmtSync(ctx, st)
 	}
 }
 
+// yield calls the function set by YieldEvery, and reports whether the
+// interpreter should stop.
+func (r *Runner) yield(ctx context.Context) bool {
+	r.yieldCount = 0
+	if r.yieldFunc == nil {
+		runtime.Gosched()
+	} else if err := r.yieldFunc(ctx); err != nil {
+		r.setErr(err)
+	}
+	return r.stop(ctx)
+}
+
+// bgPidBase is where the process IDs given to background jobs start, unless
+// they run a single program, which gives them its real process ID. Other jobs
+// aren't OS processes at all, so the IDs are synthetic; they are kept above
+// Linux's maximum PID so that they never refer to a real process.
+const bgPidBase = 1 << 22
+
+// bgJob is a statement running in the background, started via "&".
+type bgJob struct {
+	id   int // job number, as in "%1"
+	pid  int // process ID, as in "$!"; see processID
+	stmt *syntax.Stmt
+
+	started chan struct{} // closed once pid is set
+
+	cancel context.CancelFunc
+	done   chan struct{} // closed once the job finishes
+
+	exit int   // exit status code, once done
+	err  error // fatal error, once done
+
+	noHup bool // marked via "disown -h"; not stopped by Reset
+
+	coproc *coproc // non-nil if started via "coproc"
+}
+
+// processID returns the job's process ID. If the job runs a single simple
+// command, it waits until the command is started, as the ID is that of the
+// program it runs, if any.
+func (j *bgJob) processID() int {
+	<-j.started
+	return j.pid
+}
+
+func (j *bgJob) finished() bool {
+	select {
+	case <-j.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (r *Runner) startJob(ctx context.Context, st *syntax.Stmt) {
+	st2 := *st
+	st2.Background = false
+	r.goJob(ctx, st, r.sub(), &st2, nil)
+}
+
+// goJob starts a background job for st, which runs node with r2. If done is
+// not nil, it is called once node has finished running.
+func (r *Runner) goJob(ctx context.Context, st *syntax.Stmt, r2 *Runner, node syntax.Node, done func()) *bgJob {
+	ctx, cancel := context.WithCancel(ctx)
+	job := &bgJob{
+		id:      1,
+		stmt:    st,
+		started: make(chan struct{}),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	if n := len(r.bgJobs); n > 0 {
+		job.id = r.bgJobs[n-1].id + 1
+	}
+	r.nextBgPid++
+	job.pid = bgPidBase + r.nextBgPid
+	r.lastBgJob = job
+	r.bgJobs = append(r.bgJobs, job)
+	var once sync.Once
+	started := func(pid int) {
+		once.Do(func() {
+			if pid > 0 {
+				job.pid = pid
+			}
+			close(job.started)
+		})
+	}
+	if st, ok := node.(*syntax.Stmt); ok {
+		if _, ok := st.Cmd.(*syntax.CallExpr); ok {
+			r2.bgStarted = started
+		}
+	}
+	if r2.bgStarted == nil {
+		started(0)
+	}
+	go func() {
+		err := r2.Run(ctx, node)
+		// The job may not have run any command at all.
+		started(0)
+		if status, ok := IsExitStatus(err); ok {
+			job.exit = int(status)
+		} else if err != nil {
+			job.exit = 1
+			job.err = err
+		}
+		if done != nil {
+			done()
+		}
+		cancel()
+		close(job.done)
+	}()
+	return job
+}
+
+// findJob returns the background job given by a "wait", "jobs" or "disown"
+// argument, which can be either a process ID like "1234" or a job spec like "%1".
+func (r *Runner) findJob(spec string) *bgJob {
+	for _, job := range r.bgJobs {
+		switch {
+		case strings.HasPrefix(spec, "%"):
+			if spec[1:] == strconv.Itoa(job.id) {
+				return job
+			}
+		case spec == strconv.Itoa(job.processID()):
+			return job
+		}
+	}
+	return nil
+}
+
+// waitJob waits for a background job to finish and forgets about it. It
+// returns false if ctx was cancelled first.
+func (r *Runner) waitJob(ctx context.Context, job *bgJob) bool {
+	select {
+	case <-job.done:
+	case <-ctx.Done():
+		r.setErr(ctx.Err())
+		return false
+	}
+	r.forgetJob(job)
+	if job.coproc != nil {
+		r.reapCoproc(job.coproc)
+	}
+	if job.err != nil {
+		r.setErr(job.err)
+	}
+	return true
+}
+
+// forgetJob removes a background job from the job table.
+func (r *Runner) forgetJob(job *bgJob) {
+	for i, job2 := range r.bgJobs {
+		if job2 == job {
+			r.bgJobs = append(r.bgJobs[:i], r.bgJobs[i+1:]...)
+			break
+		}
+	}
+}
+
+// stopJobs cancels all background jobs and waits for them to stop. Jobs marked
+// via "disown -h" are forgotten, but left running.
+func (r *Runner) stopJobs() {
+	for _, job := range r.bgJobs {
+		if job.noHup {
+			continue
+		}
+		job.cancel()
+		if job.coproc != nil {
+			// builtins reading or writing the pipes don't
+			// stop when cancelled
+			job.coproc.close()
+		}
+		<-job.done
+	}
+	r.bgJobs = nil
+}
+
 func (r *Runner) stmtSync(ctx context.Context, st *syntax.Stmt) {
+	numProcSubsts := len(r.procSubsts)
 	oldIn, oldOut, oldErr := r.stdin, r.stdout, r.stderr
+	oldStmtIn, oldStmtOut := r.stmtStdin, r.stmtStdout
+	r.stmtStdin, r.stmtStdout = oldIn, oldOut
+	defer func() { r.stmtStdin, r.stmtStdout = oldStmtIn, oldStmtOut }()
+	var oldFds map[int]io.ReadWriteCloser
+	if len(st.Redirs) > 0 && len(r.fds) > 0 {
+		oldFds = make(map[int]io.ReadWriteCloser, len(r.fds))
+		for fd, f := range r.fds {
+			oldFds[fd] = f
+		}
+	}
+	var closers []io.Closer
+	redirErr := false
 	for _, rd := range st.Redirs {
 		cls, err := r.redir(ctx, rd)
 		if err != nil {
 			r.exit = 1
-			return
+			redirErr = true
+			break
 		}
 		if cls != nil {
-			defer cls.Close()
+			closers = append(closers, cls)
 		}
 	}
-	if st.Cmd == nil {
+	switch {
+	case redirErr:
+	case st.Cmd == nil:
 		r.exit = 0
-	} else {
+	case st.Negated:
+		oldNoErrExit := r.noErrExit
+		r.noErrExit = true
+		r.cmd(ctx, st.Cmd)
+		r.noErrExit = oldNoErrExit
+	default:
 		r.cmd(ctx, st.Cmd)
 	}
-	if st.Negated {
+	if redirErr || (st.Negated && r.exitShell) {
+		// The shell is exiting, such as via errexit within a
+		// function; keep its exit status.
+	} else if st.Negated {
 		r.exit = oneIf(r.exit == 0)
 	} else if _, ok := st.Cmd.(*syntax.CallExpr); !ok {
-	} else if r.exit != 0 && !r.noErrExit && r.opts[optErrExit] {
+	} else if r.exit != 0 && !r.noErrExit && r.opts[optErrExit] && !r.exitShell {
 		// If the "errexit" option is set and a simple command failed,
 		// exit the shell. Exceptions:
 		//
@@ -732,28 +1600,78 @@ func (r *Runner) stmtSync(ctx context.Context, st *syntax.Stmt) {
 		//   part of && or || lists
 		//   preceded by !
 		r.exitShell = true
+		r.exitErr = &ErrexitError{Cmd: r.lastCmd, Pos: st.Pos()}
+	}
+	if r.keepRedirs {
+		// "exec" made the redirections permanent. Close the
+		// descriptors which were closed or replaced.
+		r.keepRedirs = false
+		for fd, f := range oldFds {
+			if r.fds[fd] != f {
+				f.Close()
+			}
+		}
+		// Keep any process substitutions running too, as their named
+		// pipes may now be open.
+		return
+	}
+	r.stdin, r.stdout, r.stderr = oldIn, oldOut, oldErr
+	if len(st.Redirs) > 0 {
+		r.fds = oldFds
 	}
-	if !r.keepRedirs {
-		r.stdin, r.stdout, r.stderr = oldIn, oldOut, oldErr
+	for _, cls := range closers {
+		cls.Close()
 	}
+	r.stopProcSubsts(numProcSubsts)
 }
 
 func (r *Runner) sub() *Runner {
 	// Keep in sync with the Runner type. Manually copy fields, to not copy
-	// sensitive ones like errgroup.Group, and to do deep copies of slices.
+	// sensitive ones like background jobs, and to do deep copies of slices.
 	r2 := &Runner{
-		Env:         r.Env,
-		Dir:         r.Dir,
-		Params:      r.Params,
-		Funcs:       r.Funcs,
-		execHandler: r.execHandler,
-		openHandler: r.openHandler,
-		stdin:       r.stdin,
-		stdout:      r.stdout,
-		stderr:      r.stderr,
-		filename:    r.filename,
-		opts:        r.opts,
-	}
+		Env:            r.Env,
+		Dir:            r.Dir,
+		Params:         r.Params,
+		Funcs:          r.Funcs,
+		execHandler:    r.execHandler,
+		execCustom:     r.execCustom,
+		openHandler:    r.openHandler,
+		fs:             r.fs,
+		sourceHandler:  r.sourceHandler,
+		traceHandler:   r.traceHandler,
+		traceDepth:     r.traceDepth,
+		restricted:     r.restricted,
+		strictErrExit:  r.strictErrExit,
+		xtraceFd:       r.xtraceFd,
+		xtraceLevel:    r.xtraceLevel,
+		yieldEvery:     r.yieldEvery,
+		yieldFunc:      r.yieldFunc,
+		rootDir:        r.rootDir,
+		rootStrict:     r.rootStrict,
+		rootLookPath:   r.rootLookPath,
+		rlimits:        r.rlimits,
+		childEnvFilter: r.childEnvFilter,
+		exportCheck:    r.exportCheck,
+		hostInfo:       r.hostInfo,
+		userHomeDir:    r.userHomeDir,
+		secondsStart:   r.secondsStart,
+		dryRun:         r.dryRun,
+		stdin:          r.stdin,
+		stdout:         r.stdout,
+		stderr:         r.stderr,
+		filename:       r.filename,
+		shellName:      r.shellName,
+		opts:           r.opts,
+		lastBgJob:      r.lastBgJob,
+		envCache:       r.envCache,
+	}
+	r2.outerProcSubsts = r.outerProcSubsts[:len(r.outerProcSubsts):len(r.outerProcSubsts)]
+	for _, p := range r.procSubsts {
+		r2.outerProcSubsts = append(r2.outerProcSubsts, p.path)
+	}
+	// Like in Bash, errexit stays ignored in subshells and command
+	// substitutions whose exit status is tested.
+	r2.noErrExit = r.noErrExit && !r.strictErrExit
 	r2.Vars = make(map[string]expand.Variable, len(r.Vars))
 	for k, v := range r.Vars {
 		r2.Vars[k] = v
@@ -762,10 +1680,31 @@ func (r *Runner) sub() *Runner {
 	for k, v := range r.funcVars {
 		r2.funcVars[k] = v
 	}
+	// Subshells have their own $RANDOM sequence, which is still
+	// deterministic when using RandomSeed.
+	r2.rand = rand.New(rand.NewSource(r.rand.Int63()))
+	if len(r.exportedFuncs) > 0 {
+		r2.exportedFuncs = make(map[string]bool, len(r.exportedFuncs))
+		for name := range r.exportedFuncs {
+			r2.exportedFuncs[name] = true
+		}
+	}
+	if len(r.dynamicOff) > 0 {
+		r2.dynamicOff = make(map[string]bool, len(r.dynamicOff))
+		for name := range r.dynamicOff {
+			r2.dynamicOff[name] = true
+		}
+	}
 	r2.cmdVars = make(map[string]string, len(r.cmdVars))
 	for k, v := range r.cmdVars {
 		r2.cmdVars[k] = v
 	}
+	if len(r.fds) > 0 {
+		r2.fds = make(map[int]io.ReadWriteCloser, len(r.fds))
+		for fd, f := range r.fds {
+			r2.fds[fd] = f
+		}
+	}
 	r2.dirStack = append(r2.dirBootstrap[:0], r.dirStack...)
 	r2.fillExpandConfig(r.ectx)
 	r2.didReset = true
@@ -781,24 +1720,42 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 		r.stmts(ctx, x.Stmts)
 	case *syntax.Subshell:
 		r2 := r.sub()
+		r2.traceDepth++
 		r2.stmts(ctx, x.Stmts)
 		r.exit = r2.exit
 		r.setErr(r2.err)
 	case *syntax.CallExpr:
+		r.dryUneval = false
 		fields := r.fields(x.Args...)
 		if len(fields) == 0 {
 			for _, as := range x.Assigns {
 				vr := r.assignVal(as, "")
+				if r.opts[optXTrace] {
+					r.xtraceAssign(as, vr)
+				}
 				r.setVar(as.Name.Value, as.Index, vr)
 			}
+			r.lastCmd = ""
+			break
+		}
+		if r.cmdVarsErr(x.Assigns) != nil {
+			r.exit = 127
+			r.lastCmd = fields[0]
 			break
 		}
 		for _, as := range x.Assigns {
 			vr := r.assignVal(as, "")
 			// we know that inline vars must be strings
 			r.cmdVars[as.Name.Value] = vr.Str
+			if r.opts[optXTrace] {
+				r.xtraceAssign(as, vr)
+			}
+		}
+		if r.opts[optXTrace] {
+			r.xtrace(fields)
 		}
 		r.call(ctx, x.Args[0].Pos(), fields)
+		r.lastCmd = fields[0]
 		// cmdVars can be nuked here, as they are never useful
 		// again once we nest into further levels of inline
 		// vars.
@@ -847,6 +1804,9 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 		r.stmts(ctx, x.Cond)
 		r.noErrExit = oldNoErrExit
 
+		if r.exitShell {
+			break
+		}
 		if r.exit == 0 {
 			r.stmts(ctx, x.Then)
 			break
@@ -862,6 +1822,9 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 			r.stmts(ctx, x.Cond)
 			r.noErrExit = oldNoErrExit
 
+			if r.exitShell {
+				break
+			}
 			stop := (r.exit == 0) == x.Until
 			r.exit = 0
 			if stop || r.loopStmtsBroken(ctx, x.Do) {
@@ -872,36 +1835,76 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 		switch y := x.Loop.(type) {
 		case *syntax.WordIter:
 			name := y.Name.Value
-			items := r.Params // for i; do ...
+			// Like in Bash, the items are expanded once before the
+			// first iteration, so changes to the parameters or
+			// arrays in the loop body don't affect the iteration.
+			var items []string
 			if y.InPos.IsValid() {
 				items = r.fields(y.Items...) // for i in ...; do ...
+			} else {
+				// for i; do ...
+				items = append([]string(nil), r.Params...)
 			}
 			for _, field := range items {
+				if r.opts[optXTrace] {
+					r.xtraceFor(y)
+				}
 				r.setVarString(name, field)
 				if r.loopStmtsBroken(ctx, x.Do) {
 					break
 				}
 			}
 		case *syntax.CStyleLoop:
-			r.arithm(y.Init)
-			for r.arithm(y.Cond) != 0 {
-				if r.exit != 0 || r.loopStmtsBroken(ctx, x.Do) {
+			r.exit = 0
+			if y.Init != nil {
+				if _, ok := r.arithmCmd(y.Init); !ok {
+					break
+				}
+			}
+			for !r.stop(ctx) {
+				// an empty condition is always true
+				if y.Cond != nil {
+					if n, ok := r.arithmCmd(y.Cond); !ok || n == 0 {
+						break
+					}
+				}
+				if r.loopStmtsBroken(ctx, x.Do) {
 					break
 				}
-				r.arithm(y.Post)
+				if y.Post != nil {
+					if _, ok := r.arithmCmd(y.Post); !ok {
+						break
+					}
+				}
 			}
 		}
 	case *syntax.FuncDecl:
 		r.setFunc(x.Name.Value, x.Body)
 	case *syntax.ArithmCmd:
-		r.exit = oneIf(r.arithm(x.X) == 0)
+		if r.opts[optXTrace] {
+			r.xtraceArithmCmd(x)
+		}
+		if n, ok := r.arithmCmd(x.X); ok {
+			r.exit = oneIf(n == 0)
+		}
 	case *syntax.LetClause:
+		if r.opts[optXTrace] {
+			r.xtraceLet(x)
+		}
+		// the status is that of the last expression
 		var val int
 		for _, expr := range x.Exprs {
-			val = r.arithm(expr)
+			n, ok := r.arithmCmd(expr)
+			if !ok {
+				return
+			}
+			val = n
 		}
 		r.exit = oneIf(val == 0)
 	case *syntax.CaseClause:
+		if r.opts[optXTrace] {
+			r.xtraceCase(x)
+		}
 		str := r.literal(x.Word)
 		for _, ci := range x.Items {
 			for _, word := range ci.Patterns {
@@ -914,12 +1917,12 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 		}
 	case *syntax.TestClause:
 		r.exit = 0
-		if r.bashTest(ctx, x.X, false) == "" && r.exit == 0 {
+		if r.bashTest(ctx, x.X, false, false) == "" && r.exit == 0 {
 			// to preserve exit status code 2 for regex errors, etc
 			r.exit = 1
 		}
 	case *syntax.DeclClause:
-		local, global := false, false
+		local, global, funcs := false, false, false
 		var modes []string
 		valType := ""
 		switch x.Variant.Value {
@@ -941,9 +1944,27 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 		case "nameref":
 			valType = "-n"
 		}
+		// export is a builtin which is planned in dry runs
+		dryExport := r.dryRun != nil && x.Variant.Value == "export"
+		var planArgs []string
+		if dryExport {
+			r.dryUneval = false
+			planArgs = []string{x.Variant.Value}
+		}
+		// Like in Bash, all the values are expanded before any variable
+		// is set, and the trace is written in between.
+		var vars []declVar
+		traceFields := []string{x.Variant.Value}
 		for _, as := range x.Args {
 			for _, as := range r.flattenAssign(as) {
 				name := as.Name.Value
+				if as.Naked || as.Array != nil {
+					traceFields = append(traceFields, name)
+				}
+				if name == "-f" && x.Variant.Value == "export" {
+					funcs = true
+					continue
+				}
 				if strings.HasPrefix(name, "-") {
 					switch name {
 					case "-x", "-r":
@@ -959,12 +1980,43 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 					}
 					continue
 				}
+				if funcs {
+					if dryExport {
+						planArgs = append(planArgs, "-f", name)
+						if !r.dryRun.ApplyBuiltins {
+							continue
+						}
+					}
+					if r.Funcs[name] == nil {
+						r.errf("export: %s: not a function\n", name)
+						r.exit = 1
+						continue
+					}
+					r.exportFunc(name)
+					continue
+				}
 				if !syntax.ValidName(name) {
 					r.errf("declare: invalid name %q\n", name)
 					r.exit = 1
 					return
 				}
 				vr := r.assignVal(as, valType)
+				if !as.Naked && as.Array == nil {
+					traceFields = append(traceFields, name+"="+vr.String())
+				}
+				if dryExport {
+					arg := name
+					if !as.Naked {
+						arg += "=" + vr.String()
+					}
+					planArgs = append(planArgs, arg)
+					if !r.dryRun.ApplyBuiltins {
+						continue
+					}
+				}
+				if vr.Kind == expand.NameRef && vr.Str != "" && !r.validNameRef(name, vr.Str) {
+					continue
+				}
 				if global {
 					vr.Local = false
 				} else if local {
@@ -978,9 +2030,20 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 						vr.ReadOnly = true
 					}
 				}
-				r.setVar(name, as.Index, vr)
+				vars = append(vars, declVar{as, vr})
 			}
 		}
+		if r.opts[optXTrace] {
+			r.xtraceDecl(x.Variant.Value, traceFields, vars)
+		}
+		for _, v := range vars {
+			r.setVar(v.as.Name.Value, v.as.Index, v.vr)
+		}
+		if dryExport {
+			r.planStep(TraceBuiltin, x.Pos(), planArgs)
+		}
+	case *syntax.CoprocClause:
+		r.coproc(ctx, x)
 	case *syntax.TimeClause:
 		start := time.Now()
 		if x.Stmt != nil {
@@ -1002,6 +2065,12 @@ func (r *Runner) cmd(ctx context.Context, cm syntax.Command) {
 	}
 }
 
+// declVar is a variable to be set by a declaration clause.
+type declVar struct {
+	as *syntax.Assign
+	vr expand.Variable
+}
+
 func (r *Runner) flattenAssign(as *syntax.Assign) []*syntax.Assign {
 	// Convert "declare $x" into "declare value".
 	// Don't use syntax.Parser here, as we only want the basic
@@ -1083,60 +2152,177 @@ func (r *Runner) hdocReader(rd *syntax.Redirect) io.Reader {
 	return &buf
 }
 
+// fdStream is a file descriptor which wasn't opened by a redirection, such as
+// a duplicate of a standard stream or a heredoc. Closing it is a no-op.
+type fdStream struct {
+	io.Reader
+	io.Writer
+}
+
+var errBadFd = fmt.Errorf("bad file descriptor")
+
+func (s fdStream) Read(p []byte) (int, error) {
+	if s.Reader == nil {
+		return 0, errBadFd
+	}
+	return s.Reader.Read(p)
+}
+
+func (s fdStream) Write(p []byte) (int, error) {
+	if s.Writer == nil {
+		return 0, errBadFd
+	}
+	return s.Writer.Write(p)
+}
+
+func (s fdStream) Close() error { return nil }
+
+// fd returns the open file descriptor n, if any.
+func (r *Runner) fd(n int) (io.ReadWriteCloser, bool) {
+	switch n {
+	case 0:
+		return fdStream{Reader: r.stdin}, true
+	case 1:
+		return fdStream{Writer: r.stdout}, true
+	case 2:
+		return fdStream{Writer: r.stderr}, true
+	}
+	f, ok := r.fds[n]
+	return f, ok
+}
+
+// setFd sets the file descriptor n. A nil f closes it; closing a standard
+// stream makes it behave like /dev/null.
+func (r *Runner) setFd(n int, f io.ReadWriteCloser) {
+	if s, ok := f.(fdStream); ok && n <= 2 {
+		// Don't wrap the standard streams unnecessarily.
+		if n == 0 {
+			r.stdin = s.Reader
+		} else if n == 1 {
+			r.stdout = s.Writer
+		} else {
+			r.stderr = s.Writer
+		}
+		return
+	}
+	switch n {
+	case 0:
+		if f == nil {
+			r.stdin = strings.NewReader("")
+		} else {
+			r.stdin = f
+		}
+	case 1, 2:
+		var w io.Writer = ioutil.Discard
+		if f != nil {
+			w = f
+		}
+		if n == 1 {
+			r.stdout = w
+		} else {
+			r.stderr = w
+		}
+	default:
+		if f == nil {
+			delete(r.fds, n)
+			return
+		}
+		if r.fds == nil {
+			r.fds = make(map[int]io.ReadWriteCloser)
+		}
+		r.fds[n] = f
+	}
+}
+
 func (r *Runner) redir(ctx context.Context, rd *syntax.Redirect) (io.Closer, error) {
-	if rd.Hdoc != nil {
-		r.stdin = r.hdocReader(rd)
-		return nil, nil
+	fd := 1
+	switch rd.Op {
+	case syntax.RdrIn, syntax.DplIn, syntax.RdrInOut,
+		syntax.Hdoc, syntax.DashHdoc, syntax.WordHdoc:
+		fd = 0
 	}
-	orig := &r.stdout
 	if rd.N != nil {
-		switch rd.N.Value {
-		case "1":
-		case "2":
-			orig = &r.stderr
+		n, err := strconv.Atoi(rd.N.Value)
+		if err != nil {
+			r.errf("%s: invalid file descriptor\n", rd.N.Value)
+			return nil, err
 		}
+		fd = n
+	}
+	if rd.Hdoc != nil {
+		r.setFd(fd, fdStream{Reader: r.hdocReader(rd)})
+		return nil, nil
 	}
+	r.dryUneval = false
 	arg := r.literal(rd.Word)
 	switch rd.Op {
+	case syntax.RdrOut, syntax.AppOut, syntax.RdrAll, syntax.AppAll,
+		syntax.ClbOut, syntax.RdrInOut:
+		if r.restricted {
+			r.errf("%s: restricted: cannot redirect output\n", arg)
+			return nil, errRestricted
+		}
+	}
+	switch rd.Op {
 	case syntax.WordHdoc:
-		r.stdin = strings.NewReader(arg + "\n")
+		r.setFd(fd, fdStream{Reader: strings.NewReader(arg + "\n")})
 		return nil, nil
-	case syntax.DplOut:
-		switch arg {
-		case "1":
-			*orig = r.stdout
-		case "2":
-			*orig = r.stderr
+	case syntax.DplOut, syntax.DplIn:
+		if arg == "-" {
+			// Closing a descriptor that isn't open is not an error.
+			r.setFd(fd, nil)
+			return nil, nil
+		}
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			// TODO: support ">&word", meaning "&>word".
+			return nil, nil
 		}
+		f, ok := r.fd(n)
+		if !ok {
+			r.errf("%d: %v\n", n, errBadFd)
+			return nil, errBadFd
+		}
+		r.setFd(fd, f)
 		return nil, nil
 	case syntax.RdrIn, syntax.RdrOut, syntax.AppOut,
-		syntax.RdrAll, syntax.AppAll:
+		syntax.RdrAll, syntax.AppAll, syntax.ClbOut, syntax.RdrInOut:
 		// done further below
-	// case syntax.DplIn:
 	default:
-		panic(fmt.Sprintf("unhandled redirect op: %v", rd.Op))
+		err := fmt.Errorf("unsupported redirect op: %v", rd.Op)
+		r.errf("%v\n", err)
+		return nil, err
 	}
 	mode := os.O_RDONLY
 	switch rd.Op {
 	case syntax.AppOut, syntax.AppAll:
 		mode = os.O_WRONLY | os.O_CREATE | os.O_APPEND
-	case syntax.RdrOut, syntax.RdrAll:
+	case syntax.RdrOut, syntax.RdrAll, syntax.ClbOut:
+		// noclobber is not supported, so ">|" is like ">"
 		mode = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	case syntax.RdrInOut:
+		mode = os.O_RDWR | os.O_CREATE
 	}
-	f, err := r.open(ctx, arg, mode, 0644, true)
-	if err != nil {
-		return nil, err
+	var f io.ReadWriteCloser
+	if r.dryRun != nil && mode != os.O_RDONLY {
+		// never create or modify files in a dry run
+		f = &planFile{path: arg, unevaluated: r.dryUneval}
+	} else {
+		var err error
+		f, err = r.open(ctx, OpenRedirect, arg, mode, 0644, true)
+		if err != nil {
+			return nil, err
+		}
+		if r.dryRun != nil {
+			f = &planFile{ReadWriteCloser: f, path: arg, unevaluated: r.dryUneval}
+		}
 	}
 	switch rd.Op {
-	case syntax.RdrIn:
-		r.stdin = f
-	case syntax.RdrOut, syntax.AppOut:
-		*orig = f
 	case syntax.RdrAll, syntax.AppAll:
 		r.stdout = f
 		r.stderr = f
 	default:
-		panic(fmt.Sprintf("unhandled redirect op: %v", rd.Op))
+		r.setFd(fd, f)
 	}
 	return f, nil
 }
@@ -1168,18 +2354,44 @@ func (r *Runner) call(ctx context.Context, pos syntax.Pos, args []string) {
 		return
 	}
 	name := args[0]
-	if body := r.Funcs[name]; body != nil {
+	body := r.Funcs[name]
+	if r.traceHandler != nil {
+		kind := TraceExec
+		switch {
+		case body != nil:
+			kind = TraceFunc
+		case isBuiltin(name):
+			kind = TraceBuiltin
+		}
+		ev := r.traceStart(kind, pos, args)
+		defer r.traceDone(ev)
+	}
+	if r.bgStarted != nil && (body != nil || isBuiltin(name)) {
+		// The job runs in-process, so it keeps a synthetic ID.
+		r.bgStarted(0)
+		r.bgStarted = nil
+	}
+	if body != nil {
 		// stack them to support nested func calls
 		oldParams := r.Params
 		r.Params = args[1:]
 		oldInFunc := r.inFunc
 		oldFuncVars := r.funcVars
 		r.funcVars = nil
+		r.varsChanged(hasExported(oldFuncVars))
 		r.inFunc = true
+		r.traceDepth++
+		oldNoErrExit := r.noErrExit
+		if r.strictErrExit {
+			r.noErrExit = false
+		}
 
 		r.stmt(ctx, body)
 
+		r.noErrExit = oldNoErrExit
+		r.traceDepth--
 		r.Params = oldParams
+		r.varsChanged(hasExported(r.funcVars) || hasExported(oldFuncVars))
 		r.funcVars = oldFuncVars
 		r.inFunc = oldInFunc
 		if code, ok := r.err.(returnStatus); ok {
@@ -1189,14 +2401,67 @@ func (r *Runner) call(ctx context.Context, pos syntax.Pos, args []string) {
 		return
 	}
 	if isBuiltin(name) {
+		if r.dryRun != nil && !r.dryCall(pos, args) {
+			r.exit = 0
+			return
+		}
 		r.exit = r.builtinCode(ctx, pos, name, args[1:])
 		return
 	}
-	r.exec(ctx, args)
+	r.exec(ctx, pos, args)
+}
+
+func (r *Runner) traceStart(kind TraceKind, pos syntax.Pos, args []string) TraceEvent {
+	ev := TraceEvent{
+		Kind:   kind,
+		Pos:    pos,
+		Args:   args,
+		Dir:    r.Dir,
+		Depth:  r.traceDepth,
+		Output: r.xtraceOutput(),
+		Start:  time.Now(),
+	}
+	if len(r.cmdVars) > 0 {
+		ev.Env = make(map[string]string, len(r.cmdVars))
+		for k, v := range r.cmdVars {
+			ev.Env[k] = v
+		}
+	}
+	r.traceHandler(ev)
+	return ev
 }
 
-func (r *Runner) exec(ctx context.Context, args []string) {
-	err := r.execHandler(r.handlerCtx(ctx), args)
+func (r *Runner) traceDone(ev TraceEvent) {
+	ev.Done = true
+	ev.Duration = time.Since(ev.Start)
+	ev.Exit = r.exit
+	r.traceHandler(ev)
+}
+
+func (r *Runner) exec(ctx context.Context, pos syntax.Pos, args []string) {
+	if r.restricted && strings.Contains(args[0], "/") {
+		r.errf("%s: restricted: cannot specify `/' in command names\n", args[0])
+		r.exit = 1
+		return
+	}
+	if r.dryRun != nil {
+		r.planStep(TraceExec, pos, args)
+		r.exit = 0
+		return
+	}
+	hc := r.handlerContext()
+	hc.Pos = pos
+	if !r.execCustom {
+		hc.started = r.bgStarted
+	} else if r.bgStarted != nil {
+		r.bgStarted(0)
+	}
+	r.bgStarted = nil
+	err := r.execHandler(context.WithValue(ctx, handlerCtxKey{}, hc), args)
+	if hc.started != nil {
+		// The handler may not have started a program.
+		hc.started(0)
+	}
 	if status, ok := IsExitStatus(err); ok {
 		r.exit = int(status)
 		return
@@ -1209,8 +2474,26 @@ func (r *Runner) exec(ctx context.Context, args []string) {
 	r.exit = 0
 }
 
-func (r *Runner) open(ctx context.Context, path string, flags int, mode os.FileMode, print bool) (io.ReadWriteCloser, error) {
-	f, err := r.openHandler(r.handlerCtx(ctx), path, flags, mode)
+func (r *Runner) open(ctx context.Context, kind OpenKind, path string, flags int, mode os.FileMode, print bool) (io.ReadWriteCloser, error) {
+	procSubst := r.isProcSubst(path)
+	if r.rootDir != "" && !procSubst {
+		hostPath, err := r.hostPath(path)
+		if err != nil {
+			err = &os.PathError{Op: "open", Path: path, Err: err}
+			if print {
+				r.errf("%v\n", err)
+			}
+			return nil, err
+		}
+		path = hostPath
+	}
+	hc := r.handlerContext()
+	hc.Open = kind
+	if procSubst {
+		// The path is on the host, outside of RootDir and FileSystem.
+		hc.FS = nil
+	}
+	f, err := r.openHandler(context.WithValue(ctx, handlerCtxKey{}, hc), path, flags, mode)
 	// TODO: support wrapped PathError returned from openHandler.
 	switch err.(type) {
 	case nil:
@@ -1225,5 +2508,31 @@ func (r *Runner) open(ctx context.Context, path string, flags int, mode os.FileM
 }
 
 func (r *Runner) stat(name string) (os.FileInfo, error) {
-	return os.Stat(r.absPath(name))
+	if r.isProcSubst(name) {
+		return os.Stat(name)
+	}
+	path, err := r.hostPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return r.fs.Stat(path)
+}
+
+func (r *Runner) lstat(name string) (os.FileInfo, error) {
+	if r.isProcSubst(name) {
+		return os.Lstat(name)
+	}
+	path, err := r.hostPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return r.fs.Lstat(path)
+}
+
+func (r *Runner) readDir(name string) ([]os.FileInfo, error) {
+	path, err := r.hostPath(name)
+	if err != nil {
+		return nil, err
+	}
+	return r.fs.ReadDir(path)
 }
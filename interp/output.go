@@ -0,0 +1,153 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// truncatedMarker ends a captured stream which went over its OutputLimit.
+const truncatedMarker = "\n[output truncated]\n"
+
+// OutputLimit sets the maximum number of bytes of standard output and
+// standard error captured by Output, CombinedOutput and Capture. A limit of
+// zero means no limit. With CombinedOutput, the standard output limit applies
+// to both streams combined.
+//
+// Any output past a limit is discarded without an error, so that the program
+// keeps running, and the captured stream ends with "\n[output truncated]\n".
+//
+// This option has no effect when using Runner.Run directly.
+func OutputLimit(stdout, stderr int) RunnerOption {
+	return func(r *Runner) error {
+		r.outputLimit = [2]int{stdout, stderr}
+		return nil
+	}
+}
+
+// Result holds the outcome of running a program via Capture.
+type Result struct {
+	// Stdout and Stderr hold the program's standard output and standard
+	// error.
+	Stdout, Stderr []byte
+
+	// Status is the exit status of the program.
+	Status uint8
+
+	// Duration is the time the program took to run.
+	Duration time.Duration
+
+	// Truncated is true if any of the output was discarded because of an
+	// OutputLimit.
+	Truncated bool
+}
+
+// Output parses src as a Bash program and runs it with a new Runner built with
+// opts, returning its standard output. The standard error is written to the
+// writer set via StdIO, if any.
+//
+// Like Runner.Run, the returned error is non-nil if the program exits with a
+// non-zero status; IsExitStatus can be used to check for that case. The output
+// up to that point is returned either way.
+//
+// Output and the functions like it are the simplest way to run small programs.
+// They are safe for concurrent use, as long as the options are too.
+func Output(ctx context.Context, opts []RunnerOption, src string) ([]byte, error) {
+	var stdout *limitBuffer
+	err := runOutput(ctx, opts, src, func(r *Runner) {
+		stdout = &limitBuffer{limit: r.outputLimit[0]}
+		r.stdout = stdout
+	})
+	return stdout.Bytes(), err
+}
+
+// CombinedOutput is like Output, but returns both the standard output and the
+// standard error, interleaved in the order they were written.
+func CombinedOutput(ctx context.Context, opts []RunnerOption, src string) ([]byte, error) {
+	var out *limitBuffer
+	err := runOutput(ctx, opts, src, func(r *Runner) {
+		out = &limitBuffer{limit: r.outputLimit[0]}
+		r.stdout, r.stderr = out, out
+	})
+	return out.Bytes(), err
+}
+
+// Capture is like Output, but returns both streams separately along with the
+// exit status and duration of the program. Unlike Output, a non-zero exit
+// status is not an error; the returned error is only non-nil if the program
+// could not be parsed or was stopped early, such as by a cancelled context.
+func Capture(ctx context.Context, opts []RunnerOption, src string) (*Result, error) {
+	var stdout, stderr *limitBuffer
+	start := time.Now()
+	err := runOutput(ctx, opts, src, func(r *Runner) {
+		stdout = &limitBuffer{limit: r.outputLimit[0]}
+		stderr = &limitBuffer{limit: r.outputLimit[1]}
+		r.stdout, r.stderr = stdout, stderr
+	})
+	res := &Result{Duration: time.Since(start)}
+	if stdout != nil {
+		res.Stdout, res.Stderr = stdout.Bytes(), stderr.Bytes()
+		res.Truncated = stdout.truncated || stderr.truncated
+	}
+	if status, ok := IsExitStatus(err); ok {
+		res.Status = status
+		err = nil
+	}
+	return res, err
+}
+
+// runOutput parses and runs src with a new Runner, calling setup with the
+// Runner before running it.
+func runOutput(ctx context.Context, opts []RunnerOption, src string, setup func(*Runner)) error {
+	file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+	if err != nil {
+		return err
+	}
+	r, err := New(opts...)
+	if err != nil {
+		return err
+	}
+	setup(r)
+	return r.Run(ctx, file)
+}
+
+// limitBuffer is a buffer which is safe for concurrent use, and which discards
+// any writes past its limit.
+type limitBuffer struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit > 0 && b.buf.Len()+len(p) > b.limit {
+		b.buf.Write(p[:b.limit-b.buf.Len()])
+		b.truncated = true
+		return len(p), nil
+	}
+	return b.buf.Write(p)
+}
+
+// Bytes returns the contents of the buffer, ending with truncatedMarker if any
+// writes were discarded. It is nil if b is nil.
+func (b *limitBuffer) Bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.truncated {
+		return append(b.buf.Bytes()[:b.buf.Len():b.buf.Len()], truncatedMarker...)
+	}
+	return b.buf.Bytes()
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestOutput(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	src := "echo out; echo err >&2; exit 3"
+
+	out, err := Output(ctx, nil, src)
+	if want := "out\n"; string(out) != want {
+		t.Fatalf("Output: want %q, got %q", want, out)
+	}
+	if status, ok := IsExitStatus(err); !ok || status != 3 {
+		t.Fatalf("Output: want exit status 3, got %v", err)
+	}
+
+	out, err = CombinedOutput(ctx, nil, src)
+	if want := "out\nerr\n"; string(out) != want {
+		t.Fatalf("CombinedOutput: want %q, got %q", want, out)
+	}
+	if status, ok := IsExitStatus(err); !ok || status != 3 {
+		t.Fatalf("CombinedOutput: want exit status 3, got %v", err)
+	}
+
+	res, err := Capture(ctx, nil, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(res.Stdout) != "out\n" || string(res.Stderr) != "err\n" ||
+		res.Status != 3 || res.Truncated || res.Duration <= 0 {
+		t.Fatalf("Capture: unexpected result: %#v", res)
+	}
+
+	if _, err := Capture(ctx, nil, "echo ("); err == nil {
+		t.Fatalf("Capture: want a parse error")
+	}
+}
+
+func TestOutputLimit(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	src := `for i in 1 2 3 4 5; do echo "line $i"; echo "err $i" >&2; done`
+	opts := []RunnerOption{OutputLimit(10, 4)}
+
+	out, err := Output(ctx, opts, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "line 1\nlin" + truncatedMarker; string(out) != want {
+		t.Fatalf("Output: want %q, got %q", want, out)
+	}
+
+	out, err = CombinedOutput(ctx, opts, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "line 1\nerr" + truncatedMarker; string(out) != want {
+		t.Fatalf("CombinedOutput: want %q, got %q", want, out)
+	}
+
+	res, err := Capture(ctx, []RunnerOption{OutputLimit(0, 4)}, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "line 1\nline 2\nline 3\nline 4\nline 5\n"; string(res.Stdout) != want {
+		t.Fatalf("Capture: want stdout %q, got %q", want, res.Stdout)
+	}
+	if want := "err " + truncatedMarker; string(res.Stderr) != want {
+		t.Fatalf("Capture: want stderr %q, got %q", want, res.Stderr)
+	}
+	if !res.Truncated {
+		t.Fatalf("Capture: want Truncated to be set")
+	}
+}
+
+func TestOutputConcurrent(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+	var wg sync.WaitGroup
+	const n = 20
+	errs := make(chan error, 2*n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			src := fmt.Sprintf("n=%d; echo $((n * 2)) & echo $n >&2; wait", i)
+			res, err := Capture(ctx, nil, src)
+			if err != nil {
+				errs <- err
+				return
+			}
+			want := fmt.Sprintf("%d\n", i*2)
+			if got := string(res.Stdout); got != want {
+				errs <- fmt.Errorf("%d: want stdout %q, got %q", i, want, got)
+			}
+			want = fmt.Sprintf("%d\n", i)
+			if got := string(res.Stderr); got != want {
+				errs <- fmt.Errorf("%d: want stderr %q, got %q", i, want, got)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
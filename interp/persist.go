@@ -0,0 +1,144 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"fmt"
+	"sort"
+
+	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/pattern"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// A VarStore holds shell variables which persist across runs, as set up by
+// PersistVars. It could be backed by a file, a database, or simply memory. If
+// Runners sharing a store run concurrently, it must be safe for concurrent use.
+type VarStore interface {
+	// Get returns the value of a variable, and whether it is in the store.
+	Get(name string) (value string, ok bool, err error)
+
+	// Set stores the value of a variable, replacing any previous one.
+	Set(name, value string) error
+
+	// List returns the names of the variables in the store.
+	List() ([]string, error)
+}
+
+// persistArray is the name of the indexed array which a program can use to list
+// more variables to persist.
+const persistArray = "PERSIST"
+
+// PersistVars makes the interpreter share variables with other runs via store.
+//
+// The variables in store are loaded when the option is applied, and they are
+// set as global variables each time the Runner is reset, such as before its
+// first run. Those with invalid names are ignored.
+//
+// Each time Run returns without an error, the variables to persist are saved
+// to store. A failed run, including one which exits with a non-zero status,
+// saves nothing. The variables to persist are those loaded from store, global
+// variables whose names match any of the shell patterns, like "CACHE_*", and
+// the variables named by the PERSIST indexed array, as in:
+//
+//	PERSIST=(token)
+//	token=$(fetch-token)
+//
+// Only string values are saved; unset variables and arrays are left as they
+// are in store, and nothing is saved in dry-run mode. Read-only variables, such
+// as UID, are neither loaded nor saved.
+//
+// Runners sharing a store don't see each other's changes until they are
+// created again, and each variable saved is overwritten, so the last Runner to
+// finish wins. For example, two concurrent runs incrementing a counter from
+// 1 both save 2.
+func PersistVars(store VarStore, patterns ...string) RunnerOption {
+	return func(r *Runner) error {
+		for _, pat := range patterns {
+			if _, err := pattern.Regexp(pat, 0); err != nil {
+				return fmt.Errorf("invalid persist pattern %q: %v", pat, err)
+			}
+		}
+		names, err := store.List()
+		if err != nil {
+			return fmt.Errorf("could not list persisted variables: %v", err)
+		}
+		loaded := make(map[string]string, len(names))
+		for _, name := range names {
+			if !syntax.ValidName(name) {
+				continue
+			}
+			value, ok, err := store.Get(name)
+			if err != nil {
+				return fmt.Errorf("could not load persisted variable %s: %v", name, err)
+			}
+			if ok {
+				loaded[name] = value
+			}
+		}
+		r.persist = &varPersister{store: store, patterns: patterns, loaded: loaded}
+		return nil
+	}
+}
+
+// varPersister holds the state of PersistVars.
+type varPersister struct {
+	store    VarStore
+	patterns []string
+
+	// loaded holds the values from the store, kept up to date with the
+	// values saved since.
+	loaded map[string]string
+}
+
+// loadPersisted sets the variables loaded by PersistVars.
+func (r *Runner) loadPersisted() {
+	for name, value := range r.persist.loaded {
+		if r.lookupVar(name).ReadOnly {
+			continue
+		}
+		r.Vars[name] = expand.Variable{Kind: expand.String, Str: value}
+	}
+}
+
+// savePersisted saves the variables to persist, as described in PersistVars.
+func (r *Runner) savePersisted() error {
+	p := r.persist
+	save := make(map[string]bool)
+	for name := range p.loaded {
+		save[name] = true
+	}
+	for name := range r.Vars {
+		for _, pat := range p.patterns {
+			if match(pat, name) {
+				save[name] = true
+				break
+			}
+		}
+	}
+	if vr := r.lookupVar(persistArray); vr.Kind == expand.Indexed {
+		for _, name := range vr.List {
+			if syntax.ValidName(name) {
+				save[name] = true
+			}
+		}
+	}
+	delete(save, persistArray)
+	names := make([]string, 0, len(save))
+	for name := range save {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		vr := r.lookupVar(name)
+		if !vr.IsSet() || vr.Kind != expand.String || vr.ReadOnly {
+			continue
+		}
+		if err := p.store.Set(name, vr.Str); err != nil {
+			return fmt.Errorf("could not save persisted variable %s: %v", name, err)
+		}
+		p.loaded[name] = vr.Str
+	}
+	return nil
+}
@@ -0,0 +1,227 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// memStore is a VarStore kept in memory.
+type memStore struct {
+	mu   sync.Mutex
+	vars map[string]string
+}
+
+func newMemStore(pairs ...string) *memStore {
+	s := &memStore{vars: make(map[string]string)}
+	for i := 0; i < len(pairs); i += 2 {
+		s.vars[pairs[i]] = pairs[i+1]
+	}
+	return s
+}
+
+func (s *memStore) Get(name string) (string, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := s.vars[name]
+	return value, ok, nil
+}
+
+func (s *memStore) Set(name, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.vars[name] = value
+	return nil
+}
+
+func (s *memStore) List() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var names []string
+	for name := range s.vars {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+var persistTests = []struct {
+	patterns []string
+	store    []string // pairs of name and value
+	src      string
+	want     string
+	after    []string // the store after the run
+}{
+	{
+		nil, []string{"count", "1"},
+		"echo $count; count=$((count + 1))",
+		"1\n", []string{"count", "2"},
+	},
+	{
+		nil, nil,
+		"foo=bar",
+		"", nil,
+	},
+	{
+		nil, []string{"count", "1"},
+		"count=5; false",
+		"exit status 1", []string{"count", "1"},
+	},
+	{
+		nil, []string{"count", "1"},
+		"count=5; exit 3",
+		"exit status 3", []string{"count", "1"},
+	},
+	{
+		nil, []string{"count", "1"},
+		"count=5; exit 0",
+		"", []string{"count", "5"},
+	},
+	{
+		[]string{"CACHE_*"}, nil,
+		"CACHE_a=x CACHE_b=y other=z",
+		"", []string{"CACHE_a", "x", "CACHE_b", "y"},
+	},
+	{
+		nil, nil,
+		"PERSIST=(token); token=abc; other=z",
+		"", []string{"token", "abc"},
+	},
+	{
+		nil, nil,
+		"PERSIST=(token unset arr 0bad); token=abc; arr=(x)",
+		"", []string{"token", "abc"},
+	},
+	{
+		nil, []string{"count", "1"},
+		"unset count",
+		"", []string{"count", "1"},
+	},
+	{
+		nil, []string{"count", "1", "0bad", "x", "UID", "1234"},
+		"echo $count; [[ $UID != 1234 ]] && echo ok",
+		"1\nok\n", []string{"count", "1", "0bad", "x", "UID", "1234"},
+	},
+	{
+		nil, nil,
+		"PERSIST=(token); readonly token=abc",
+		"", nil,
+	},
+	{
+		nil, []string{"count", "1"},
+		"(count=5); f() { local count=6; }; f",
+		"", []string{"count", "1"},
+	},
+}
+
+func TestPersistVars(t *testing.T) {
+	t.Parallel()
+	p := syntax.NewParser()
+	for i := range persistTests {
+		tc := persistTests[i]
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			t.Parallel()
+			file, err := p.Parse(strings.NewReader(tc.src), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			store := newMemStore(tc.store...)
+			var buf bytes.Buffer
+			r, err := New(PersistVars(store, tc.patterns...), StdIO(nil, &buf, &buf))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Run(context.Background(), file); err != nil {
+				buf.WriteString(err.Error())
+			}
+			if got := buf.String(); got != tc.want {
+				t.Fatalf("wrong output in %q:\nwant: %q\ngot:  %q",
+					tc.src, tc.want, got)
+			}
+			if want := newMemStore(tc.after...).vars; !reflect.DeepEqual(store.vars, want) {
+				t.Fatalf("wrong store after %q:\nwant: %v\ngot:  %v",
+					tc.src, want, store.vars)
+			}
+		})
+	}
+}
+
+func TestPersistVarsReset(t *testing.T) {
+	t.Parallel()
+	store := newMemStore("count", "1")
+	var buf bytes.Buffer
+	r, err := New(PersistVars(store), StdIO(nil, &buf, &buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := parse(t, nil, "echo $count; count=$((count + 1))")
+	for i := 0; i < 3; i++ {
+		r.Reset()
+		if err := r.Run(context.Background(), file); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := buf.String(), "1\n2\n3\n"; got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
+
+func TestPersistVarsConcurrent(t *testing.T) {
+	t.Parallel()
+	store := newMemStore("count", "1")
+	file := parse(t, nil, "count=$((count + 1))")
+	var runners []*Runner
+	for i := 0; i < 2; i++ {
+		r, err := New(PersistVars(store))
+		if err != nil {
+			t.Fatal(err)
+		}
+		runners = append(runners, r)
+	}
+	var wg sync.WaitGroup
+	for _, r := range runners {
+		wg.Add(1)
+		go func(r *Runner) {
+			defer wg.Done()
+			if err := r.Run(context.Background(), file); err != nil {
+				t.Error(err)
+			}
+		}(r)
+	}
+	wg.Wait()
+	// Both runs loaded 1 before either saved, so the last one to finish
+	// wins, and one increment is lost.
+	if got := store.vars["count"]; got != "2" {
+		t.Fatalf("want count to be 2, got %q", got)
+	}
+}
+
+func TestPersistVarsDryRun(t *testing.T) {
+	t.Parallel()
+	store := newMemStore("count", "1")
+	r, err := New(PersistVars(store), DryRun(DryRunConfig{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Run(context.Background(), parse(t, nil, "count=5")); err != nil {
+		t.Fatal(err)
+	}
+	if got := store.vars["count"]; got != "1" {
+		t.Fatalf("want count to stay 1, got %q", got)
+	}
+}
+
+func TestPersistVarsBadPattern(t *testing.T) {
+	t.Parallel()
+	if _, err := New(PersistVars(newMemStore(), "[")); err == nil {
+		t.Fatal("want an error for an invalid pattern")
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// procSubst is a process substitution like "<(cmd)", which expands to a path
+// connected to the standard output or input of the commands within.
+//
+// Where supported, the path is a named pipe, and the commands run concurrently
+// with the command consuming the path. Otherwise, it is a regular file; with
+// "<(cmd)" the commands run to completion before the consuming command, and
+// with ">(cmd)" they run after it, reading what it wrote.
+//
+// Either way, the path is on the host's filesystem. The interpreter opens it
+// as is, even when using RootDir or FileSystem, so that the commands see
+// the same file as the programs it runs.
+type procSubst struct {
+	node *syntax.ProcSubst
+	sub  *Runner
+	ctx  context.Context
+
+	dir  string // temporary directory holding path
+	path string
+
+	cancel context.CancelFunc
+	opened chan struct{} // closed once the commands opened path
+	done   chan struct{} // closed once the commands finished
+}
+
+func (r *Runner) startProcSubst(ctx context.Context, ps *syntax.ProcSubst) (string, error) {
+	if r.dryRun != nil {
+		r.dryUneval = true
+		return r.dryRun.Placeholder, nil
+	}
+	dir, err := ioutil.TempDir("", "interp-procsubst")
+	if err != nil {
+		return "", err
+	}
+	p := &procSubst{
+		node:   ps,
+		sub:    r.sub(),
+		dir:    dir,
+		path:   filepath.Join(dir, "fd"),
+		opened: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if r.stmtStdout != nil {
+		p.sub.stdin, p.sub.stdout = r.stmtStdin, r.stmtStdout
+	}
+	p.sub.xtraceLevel++
+	if !fifoSupported {
+		p.ctx, p.cancel = context.WithCancel(ctx)
+		r.procSubsts = append(r.procSubsts, p)
+		if ps.Op == syntax.CmdIn {
+			p.run(os.O_WRONLY | os.O_CREATE)
+		}
+		return p.path, nil
+	}
+	if err := mkfifo(p.path); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	p.ctx, p.cancel = context.WithCancel(ctx)
+	if ps.Op == syntax.CmdIn {
+		go p.run(os.O_WRONLY)
+	} else {
+		go p.run(os.O_RDONLY)
+	}
+	// Only track it once its commands are running, as stop waits for them.
+	r.procSubsts = append(r.procSubsts, p)
+	return p.path, nil
+}
+
+// isProcSubst reports whether path is the path of a process substitution
+// started by the runner or its parents, which may still be in use.
+func (r *Runner) isProcSubst(path string) bool {
+	for _, p := range r.procSubsts {
+		if p.path == path {
+			return true
+		}
+	}
+	for _, p := range r.outerProcSubsts {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+// run opens the path with the given flag and runs the commands.
+func (p *procSubst) run(flag int) {
+	defer close(p.done)
+	f, err := os.OpenFile(p.path, flag, 0600)
+	close(p.opened)
+	if err != nil {
+		p.sub.errf("%v\n", err)
+		return
+	}
+	defer f.Close()
+	if p.node.Op == syntax.CmdIn {
+		p.sub.stdout = f
+	} else {
+		p.sub.stdin = f
+	}
+	p.sub.stmts(p.ctx, p.node.Stmts)
+}
+
+// stopProcSubsts finishes the process substitutions started since there were n
+// of them, once the command consuming them has finished.
+func (r *Runner) stopProcSubsts(n int) {
+	for _, p := range r.procSubsts[n:] {
+		p.stop()
+	}
+	r.procSubsts = r.procSubsts[:n]
+}
+
+func (p *procSubst) stop() {
+	defer os.RemoveAll(p.dir)
+	defer p.cancel()
+	if !fifoSupported {
+		if p.node.Op == syntax.CmdOut {
+			p.run(os.O_RDONLY)
+		}
+		return
+	}
+	if p.node.Op == syntax.CmdIn {
+		// Nothing will read the output of the commands anymore.
+		p.cancel()
+	}
+	select {
+	case <-p.opened:
+	default:
+		// The consuming command never opened the named pipe, so the
+		// commands would block forever opening it. Opening it for both
+		// reading and writing never blocks, and lets them go ahead.
+		// Once we close it, they see a closed pipe or an empty input.
+		if f, err := os.OpenFile(p.path, os.O_RDWR, 0); err == nil {
+			<-p.opened
+			f.Close()
+		}
+	}
+	<-p.done
+}
@@ -0,0 +1,15 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package interp
+
+import "fmt"
+
+// fifoSupported reports whether process substitutions can use named pipes.
+const fifoSupported = false
+
+func mkfifo(path string) error {
+	return fmt.Errorf("named pipes are not supported on this platform")
+}
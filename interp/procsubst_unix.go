@@ -0,0 +1,15 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package interp
+
+import "syscall"
+
+// fifoSupported reports whether process substitutions can use named pipes.
+const fifoSupported = true
+
+func mkfifo(path string) error {
+	return syscall.Mkfifo(path, 0600)
+}
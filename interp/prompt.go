@@ -0,0 +1,290 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"context"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// HostInfo holds information about the host system, such as the user name
+// shown in prompt strings. See SystemInfo.
+type HostInfo struct {
+	User     string // name of the current user
+	Hostname string // full host name, such as "box.example.com"
+	UID      int    // user ID of the current user
+
+	// Now returns the current time. If nil, time.Now is used.
+	Now func() time.Time
+}
+
+// SystemInfo sets the information about the host system used by the
+// interpreter, such as in prompt strings or $UID. This is useful to get
+// deterministic results. If not used, the information is obtained from the
+// system.
+func SystemInfo(info HostInfo) RunnerOption {
+	return func(r *Runner) error {
+		r.hostInfo = &info
+		return nil
+	}
+}
+
+// UserHomeDir sets the function used to look up the home directory of a user
+// by name, such as for the tilde expansion in "cd ~deploy". It is also used to
+// set $HOME for the current user if the environment doesn't have it. This is
+// useful where the system's user database is incomplete or shouldn't be used,
+// such as in containers.
+//
+// If fn returns an error, the tilde prefix is left as is, like in Bash. If not
+// used, os/user.Lookup is used.
+func UserHomeDir(fn func(name string) (string, error)) RunnerOption {
+	return func(r *Runner) error {
+		r.userHomeDir = fn
+		return nil
+	}
+}
+
+// sysInfo returns the host information, querying the system if the
+// SystemInfo option was not used.
+func (r *Runner) sysInfo() HostInfo {
+	if r.hostInfo != nil {
+		info := *r.hostInfo
+		if info.Now == nil {
+			info.Now = time.Now
+		}
+		return info
+	}
+	info := HostInfo{UID: os.Getuid(), Now: time.Now}
+	if u, err := user.Current(); err == nil {
+		info.User = u.Username
+	}
+	info.Hostname, _ = os.Hostname()
+	return info
+}
+
+// ExpandPrompt expands a prompt string such as $PS1, like Bash does.
+//
+// The supported backslash escapes are \u, \h, \H, \w, \W, \$, \j, \d, \t, \T,
+// \@, \A, \D{format}, \n, \r, \a, \e, \\, octal sequences like \033, and the
+// non-printing markers \[ and \], which are removed. Other escapes are left
+// as they are. The information about the host system is obtained as
+// described in SystemInfo.
+//
+// If the promptvars option is enabled, which is the default, the result is
+// then subject to parameter expansion, command substitution, and arithmetic
+// expansion, with the runner's environment.
+func ExpandPrompt(r *Runner, s string) string {
+	if !r.didReset {
+		r.Reset()
+	}
+	if r.ecfg == nil {
+		r.fillExpandConfig(context.Background())
+	}
+	promptVars := r.opts[optPromptVars]
+	var info HostInfo
+	infoDone := false
+	host := func() HostInfo {
+		if !infoDone {
+			info = r.sysInfo()
+			infoDone = true
+		}
+		return info
+	}
+	var buf strings.Builder
+	// esc writes text produced by an escape, which must not be expanded.
+	esc := func(s string) {
+		if !promptVars {
+			buf.WriteString(s)
+			return
+		}
+		// Bytes, not runes, as octal escapes may not be valid UTF-8.
+		for i := 0; i < len(s); i++ {
+			switch s[i] {
+			case '\\', '$', '`':
+				buf.WriteByte('\\')
+			}
+			buf.WriteByte(s[i])
+		}
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 >= len(s) {
+			buf.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch c := s[i]; c {
+		case 'u':
+			esc(host().User)
+		case 'h':
+			name := host().Hostname
+			if i := strings.IndexByte(name, '.'); i >= 0 {
+				name = name[:i]
+			}
+			esc(name)
+		case 'H':
+			esc(host().Hostname)
+		case 'w', 'W':
+			dir := r.envGet("PWD")
+			home := r.envGet("HOME")
+			switch {
+			case home != "" && dir == home:
+				dir = "~"
+			case c == 'W':
+				if dir != "/" {
+					dir = filepath.Base(dir)
+				}
+			case home != "" && strings.HasPrefix(dir, home+"/"):
+				dir = "~" + dir[len(home):]
+			}
+			esc(dir)
+		case '$':
+			if host().UID == 0 {
+				esc("#")
+			} else {
+				esc("$")
+			}
+		case 'j':
+			esc(strconv.Itoa(len(r.bgJobs)))
+		case 'd':
+			esc(host().Now().Format("Mon Jan 02"))
+		case 't':
+			esc(host().Now().Format("15:04:05"))
+		case 'T':
+			esc(host().Now().Format("03:04:05"))
+		case '@':
+			esc(host().Now().Format("03:04 PM"))
+		case 'A':
+			esc(host().Now().Format("15:04"))
+		case 'D':
+			end := -1
+			if i+1 < len(s) && s[i+1] == '{' {
+				end = strings.IndexByte(s[i+1:], '}')
+			}
+			if end < 0 {
+				buf.WriteString(`\D`)
+				break
+			}
+			format := s[i+2 : i+1+end]
+			if format == "" {
+				format = "%X"
+			}
+			esc(strftime(format, host().Now()))
+			i += 1 + end
+		case 'n':
+			buf.WriteByte('\n')
+		case 'r':
+			buf.WriteByte('\r')
+		case 'a':
+			buf.WriteByte('\a')
+		case 'e':
+			buf.WriteByte('\x1b')
+		case '[', ']':
+			// non-printing sequences only matter to line editors
+		case '\\':
+			esc(`\`)
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			j := i
+			for j < len(s) && j < i+3 && s[j] >= '0' && s[j] <= '7' {
+				j++
+			}
+			// Like Bash, values above \377 wrap around, and null
+			// bytes are dropped.
+			n, _ := strconv.ParseUint(s[i:j], 8, 16)
+			if b := byte(n); b != 0 {
+				esc(string([]byte{b}))
+			}
+			i = j - 1
+		default:
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		}
+	}
+	if !promptVars {
+		return buf.String()
+	}
+	word, err := syntax.NewParser().Document(strings.NewReader(buf.String()))
+	if err != nil {
+		return buf.String()
+	}
+	str, err := expand.Document(r.ecfg, word)
+	if err != nil {
+		return buf.String()
+	}
+	return str
+}
+
+// strftime formats a time like strftime(3) in the C locale. Only the most
+// common conversions are supported.
+func strftime(format string, t time.Time) string {
+	var buf strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 >= len(format) {
+			buf.WriteByte(format[i])
+			continue
+		}
+		i++
+		switch c := format[i]; c {
+		case 'a':
+			buf.WriteString(t.Format("Mon"))
+		case 'A':
+			buf.WriteString(t.Format("Monday"))
+		case 'b', 'h':
+			buf.WriteString(t.Format("Jan"))
+		case 'B':
+			buf.WriteString(t.Format("January"))
+		case 'd':
+			buf.WriteString(t.Format("02"))
+		case 'e':
+			buf.WriteString(t.Format("_2"))
+		case 'H':
+			buf.WriteString(t.Format("15"))
+		case 'I':
+			buf.WriteString(t.Format("03"))
+		case 'j':
+			buf.WriteString(t.Format("002"))
+		case 'm':
+			buf.WriteString(t.Format("01"))
+		case 'M':
+			buf.WriteString(t.Format("04"))
+		case 'p':
+			buf.WriteString(t.Format("PM"))
+		case 'S':
+			buf.WriteString(t.Format("05"))
+		case 'y':
+			buf.WriteString(t.Format("06"))
+		case 'Y':
+			buf.WriteString(t.Format("2006"))
+		case 'z':
+			buf.WriteString(t.Format("-0700"))
+		case 'Z':
+			buf.WriteString(t.Format("MST"))
+		case 'D':
+			buf.WriteString(t.Format("01/02/06"))
+		case 'F':
+			buf.WriteString(t.Format("2006-01-02"))
+		case 'R':
+			buf.WriteString(t.Format("15:04"))
+		case 'T', 'X':
+			buf.WriteString(t.Format("15:04:05"))
+		case 'n':
+			buf.WriteByte('\n')
+		case 't':
+			buf.WriteByte('\t')
+		case '%':
+			buf.WriteByte('%')
+		default:
+			buf.WriteByte('%')
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String()
+}
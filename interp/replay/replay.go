@@ -0,0 +1,359 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// Package replay records the results of the programs run by package interp,
+// and replays them later without running the programs again. This allows
+// re-running scripts hermetically, such as when debugging a flaky deployment.
+//
+// Record and Replay are middlewares for interp.ExecHandlers:
+//
+//	runner, err := interp.New(interp.ExecHandlers(replay.Record("run.cassette")))
+//
+// and later, to run the same script again without running any programs:
+//
+//	runner, err := interp.New(interp.ExecHandlers(replay.Replay("run.cassette", replay.Strict, 0)))
+//
+// Only programs are recorded; builtins and functions always run as usual.
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"reflect"
+	"sync"
+
+	"mvdan.cc/sh/v3/interp"
+)
+
+// An Entry is the recorded result of running a program. A cassette file holds
+// one Entry per line, encoded as JSON, in the order in which the programs
+// finished.
+type Entry struct {
+	// Args are the program and its arguments.
+	Args []string `json:"args"`
+
+	// Dir is the directory the program ran in.
+	Dir string `json:"dir"`
+
+	// Stdin is the hex-encoded SHA-256 digest of the standard input read by
+	// the program, and StdinLen is how many bytes it read.
+	Stdin    string `json:"stdin"`
+	StdinLen int64  `json:"stdinLen"`
+
+	Stdout []byte `json:"stdout"`
+	Stderr []byte `json:"stderr"`
+
+	// Status is the program's exit status.
+	Status uint8 `json:"status"`
+}
+
+// Record returns a middleware which runs programs with the next handler, and
+// records each result as an Entry in the cassette file at path. The output of
+// the programs is still written to the interpreter as usual.
+//
+// The file is created or truncated when the first program runs, and entries
+// are added as programs finish, so that a cassette is kept even if the
+// interpreter stops early. Programs which don't finish with an exit status,
+// such as when the context is cancelled, aren't recorded.
+func Record(path string) func(next interp.ExecHandlerFunc) interp.ExecHandlerFunc {
+	var (
+		mu      sync.Mutex
+		created bool
+	)
+	save := func(entry *Entry) error {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		line = append(line, '\n')
+		mu.Lock()
+		defer mu.Unlock()
+		flag := os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		if !created {
+			flag |= os.O_TRUNC
+		}
+		f, err := os.OpenFile(path, flag, 0666)
+		if err != nil {
+			return err
+		}
+		created = true
+		if _, err := f.Write(line); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+	return func(next interp.ExecHandlerFunc) interp.ExecHandlerFunc {
+		return func(ctx context.Context, args []string) error {
+			hc := interp.HandlerCtx(ctx)
+			entry := &Entry{Args: args, Dir: hc.Dir}
+
+			stdin := &digestReader{hash: sha256.New()}
+			if hc.Stdin != nil {
+				stdin.r = hc.Stdin
+				hc.Stdin = stdin
+			}
+			var stdout, stderr bytes.Buffer
+			hc.Stdout = io.MultiWriter(hc.Stdout, &stdout)
+			hc.Stderr = io.MultiWriter(hc.Stderr, &stderr)
+
+			err := next(interp.WithHandlerCtx(ctx, hc), args)
+			if err != nil {
+				status, ok := interp.IsExitStatus(err)
+				if !ok {
+					return err
+				}
+				entry.Status = status
+			}
+			entry.Stdin, entry.StdinLen = stdin.digest(), stdin.n
+			entry.Stdout, entry.Stderr = stdout.Bytes(), stderr.Bytes()
+			if err := save(entry); err != nil {
+				return fmt.Errorf("could not record %s: %v", args[0], err)
+			}
+			return err
+		}
+	}
+}
+
+// digestReader hashes what is read from r, and counts the bytes.
+type digestReader struct {
+	r    io.Reader
+	hash hash.Hash
+	n    int64
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.hash.Write(p[:n])
+	d.n += int64(n)
+	return n, err
+}
+
+func (d *digestReader) digest() string { return hex.EncodeToString(d.hash.Sum(nil)) }
+
+// Strictness is what Replay does with programs which have no recorded result.
+type Strictness int
+
+const (
+	// Strict makes programs without a recorded result stop the interpreter
+	// with an *UnmatchedError.
+	Strict Strictness = iota
+
+	// Fallthrough runs programs without a recorded result with the next
+	// handler, like when not replaying.
+	Fallthrough
+)
+
+// Key is a set of flags for what must match, besides the arguments, for a
+// recorded result to be replayed.
+type Key uint
+
+const (
+	// KeyDir requires the program to run in the same directory.
+	KeyDir Key = 1 << iota
+
+	// KeyStdin requires the program to get the same standard input. As
+	// many bytes as the program read when recording are read, and their
+	// digest must match. If several results could match, enough bytes
+	// for the longest are read, and any not read by the replayed result
+	// are kept for the next program reading the same standard input.
+	// Builtins like "read" don't see them.
+	KeyStdin
+)
+
+// UnmatchedError is returned when replaying with Strict, if a program has no
+// recorded result.
+type UnmatchedError struct {
+	Args []string
+	Dir  string
+}
+
+func (e *UnmatchedError) Error() string {
+	return fmt.Sprintf("no recorded result for %q in %s", e.Args, e.Dir)
+}
+
+// Replay returns a middleware which doesn't run programs, and instead writes
+// the output and returns the exit status of their results in the cassette
+// file at path, as recorded by Record.
+//
+// A result is replayed for a program if its arguments match, as well as
+// anything else required by key. Each result is replayed once. When several
+// results match, they are replayed in the order in which they were recorded.
+// Since the entries aren't matched in the order of the cassette as a whole,
+// programs started in a different order than when recording, such as those run
+// in the background, are still replayed correctly. Identical programs which
+// ran concurrently can get each other's results, as the cassette can't tell
+// them apart.
+//
+// The cassette is loaded when the first program runs. A program without a
+// matching result, including one whose results were all replayed already, is
+// handled according to strictness.
+func Replay(path string, strictness Strictness, key Key) func(next interp.ExecHandlerFunc) interp.ExecHandlerFunc {
+	var (
+		mu      sync.Mutex
+		loaded  bool
+		loadErr error
+		entries []*Entry
+
+		// pending holds the input read from each standard input which
+		// the replayed results didn't read; see KeyStdin.
+		pending = make(map[io.Reader][]byte)
+	)
+	load := func() error {
+		if loaded {
+			return loadErr
+		}
+		loaded = true
+		entries, loadErr = readCassette(path)
+		return loadErr
+	}
+	return func(next interp.ExecHandlerFunc) interp.ExecHandlerFunc {
+		return func(ctx context.Context, args []string) error {
+			hc := interp.HandlerCtx(ctx)
+			mu.Lock()
+			if err := load(); err != nil {
+				mu.Unlock()
+				return err
+			}
+			n := stdinLen(entries, hc, args, key)
+			stdinKey := readerKey(hc.Stdin)
+			stdin := pending[stdinKey]
+			delete(pending, stdinKey)
+			mu.Unlock()
+
+			// Don't hold the lock while reading, as the input may come
+			// from another program in a pipeline.
+			if n > int64(len(stdin)) && hc.Stdin != nil {
+				buf := make([]byte, n-int64(len(stdin)))
+				n, err := io.ReadFull(hc.Stdin, buf)
+				if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+					return err
+				}
+				stdin = append(stdin, buf[:n]...)
+			}
+
+			mu.Lock()
+			entry := take(&entries, hc, args, key, stdin)
+			if entry != nil && stdinKey != nil && int64(len(stdin)) > entry.StdinLen {
+				pending[stdinKey] = stdin[entry.StdinLen:]
+			}
+			mu.Unlock()
+			if entry == nil {
+				if strictness != Fallthrough {
+					return &UnmatchedError{Args: args, Dir: hc.Dir}
+				}
+				if len(stdin) > 0 {
+					// Give back what was read to match.
+					hc.Stdin = io.MultiReader(bytes.NewReader(stdin), hc.Stdin)
+					ctx = interp.WithHandlerCtx(ctx, hc)
+				}
+				return next(ctx, args)
+			}
+			// Like programs, don't write anything if there's no output;
+			// writers such as the interpreter's may be shared.
+			if len(entry.Stdout) > 0 {
+				hc.Stdout.Write(entry.Stdout)
+			}
+			if len(entry.Stderr) > 0 {
+				hc.Stderr.Write(entry.Stderr)
+			}
+			if entry.Status != 0 {
+				return interp.NewExitStatus(entry.Status)
+			}
+			return nil
+		}
+	}
+}
+
+// readerKey returns r for use as a map key, or nil if r is nil or its type
+// isn't comparable.
+func readerKey(r io.Reader) io.Reader {
+	if r == nil || !reflect.TypeOf(r).Comparable() {
+		return nil
+	}
+	return r
+}
+
+// readCassette reads the entries in a cassette file.
+func readCassette(path string) ([]*Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []*Entry
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		entry := new(Entry)
+		if err := dec.Decode(entry); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid cassette %s: %v", path, err)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// matches reports whether an entry matches a program, besides the standard
+// input.
+func matches(entry *Entry, hc interp.HandlerContext, args []string, key Key) bool {
+	return equalArgs(entry.Args, args) && (key&KeyDir == 0 || entry.Dir == hc.Dir)
+}
+
+// stdinLen returns how many bytes of standard input must be read to find the
+// entry matching a program. It is zero unless key includes KeyStdin.
+func stdinLen(entries []*Entry, hc interp.HandlerContext, args []string, key Key) int64 {
+	var n int64
+	if key&KeyStdin == 0 {
+		return 0
+	}
+	for _, entry := range entries {
+		if matches(entry, hc, args, key) && entry.StdinLen > n {
+			n = entry.StdinLen
+		}
+	}
+	return n
+}
+
+// take finds the first entry matching a program, and removes it from entries.
+// With KeyStdin, stdin must start with the input read by the entry. If no
+// entry is found, nil is returned.
+func take(entries *[]*Entry, hc interp.HandlerContext, args []string, key Key, stdin []byte) *Entry {
+	for i, entry := range *entries {
+		if !matches(entry, hc, args, key) {
+			continue
+		}
+		if key&KeyStdin != 0 {
+			if entry.StdinLen > int64(len(stdin)) {
+				continue
+			}
+			sum := sha256.Sum256(stdin[:entry.StdinLen])
+			if hex.EncodeToString(sum[:]) != entry.Stdin {
+				continue
+			}
+		}
+		*entries = append((*entries)[:i], (*entries)[i+1:]...)
+		return entry
+	}
+	return nil
+}
+
+func equalArgs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
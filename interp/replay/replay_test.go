@@ -0,0 +1,227 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package replay
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"mvdan.cc/sh/v3/interp"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// run runs src in dir with the given options, returning its output and the
+// error from Run.
+func run(t *testing.T, dir, src string, opts ...interp.RunnerOption) (string, error) {
+	file, err := syntax.NewParser().Parse(strings.NewReader(src), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	opts = append(opts, interp.StdIO(nil, &buf, &buf), interp.Dir(dir))
+	r, err := interp.New(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = r.Run(context.Background(), file)
+	return buf.String(), err
+}
+
+// noExec is an exec handler which fails the test if any program is run.
+func noExec(t *testing.T) interp.RunnerOption {
+	return interp.ExecHandler(func(ctx context.Context, args []string) error {
+		t.Errorf("program run while replaying: %q", args)
+		return interp.NewExitStatus(1)
+	})
+}
+
+func writeCassette(t *testing.T, path string, entries ...*Entry) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, entry := range entries {
+		if err := enc.Encode(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0666); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func digest(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestRoundTrip(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" {
+		t.Skip("requires Unix programs")
+	}
+	for _, prog := range []string{"sort", "tr", "wc", "cat", "date", "ls"} {
+		if _, err := exec.LookPath(prog); err != nil {
+			t.Skipf("%s not found", prog)
+		}
+	}
+	dir, err := ioutil.TempDir("", "replay-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cassette := filepath.Join(dir, "cassette")
+	// date makes the output differ each time the programs actually run.
+	src := `
+		printf 'b\na\nc\n' | sort
+		date +%s%N >bg1 &
+		{ echo foo | tr a-z A-Z; date +%s%N; } >bg2 &
+		wc -c <<<"some input"
+		ls missing-file >/dev/null 2>&1 || echo "ls failed"
+		wait
+		cat bg1 bg2
+	`
+	recorded, err := run(t, dir, src, interp.ExecHandlers(Record(cassette)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readCassette(cassette)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 7 {
+		t.Fatalf("want 7 recorded entries, got %d", len(entries))
+	}
+
+	replayed, err := run(t, dir, src, noExec(t),
+		interp.ExecHandlers(Replay(cassette, Strict, KeyDir|KeyStdin)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != recorded {
+		t.Fatalf("replayed output differs:\nrecorded:\n%s\nreplayed:\n%s", recorded, replayed)
+	}
+}
+
+func TestReplayOrder(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "replay-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cassette := filepath.Join(dir, "cassette")
+	writeCassette(t, cassette,
+		&Entry{Args: []string{"prog", "b"}, Dir: dir, Stdout: []byte("b\n")},
+		&Entry{Args: []string{"prog", "a"}, Dir: dir, Stdout: []byte("a1\n")},
+		&Entry{Args: []string{"prog", "a"}, Dir: dir, Stdout: []byte("a2\n"), Status: 3},
+	)
+	out, err := run(t, dir, "prog a; echo $?; prog a; echo $?; prog b", noExec(t),
+		interp.ExecHandlers(Replay(cassette, Strict, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "a1\n0\na2\n3\nb\n"; out != want {
+		t.Fatalf("want %q, got %q", want, out)
+	}
+}
+
+func TestReplayStdin(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "replay-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cassette := filepath.Join(dir, "cassette")
+	writeCassette(t, cassette,
+		&Entry{Args: []string{"prog"}, Stdin: digest("two\n"), StdinLen: 4, Stdout: []byte("got two\n")},
+		&Entry{Args: []string{"prog"}, Stdin: digest("one\n"), StdinLen: 4, Stdout: []byte("got one\n")},
+	)
+	out, err := run(t, dir, "echo one | prog; echo two | prog", noExec(t),
+		interp.ExecHandlers(Replay(cassette, Strict, KeyStdin)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "got one\ngot two\n"; out != want {
+		t.Fatalf("want %q, got %q", want, out)
+	}
+}
+
+func TestReplayStdinKept(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "replay-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cassette := filepath.Join(dir, "cassette")
+	// The first program reads enough input for the longest entry, but the
+	// rest must still reach the second program.
+	writeCassette(t, cassette,
+		&Entry{Args: []string{"prog"}, Stdin: digest("one\n"), StdinLen: 4, Stdout: []byte("got one\n")},
+		&Entry{Args: []string{"prog"}, Stdin: digest("two\n"), StdinLen: 4, Stdout: []byte("got two\n")},
+		&Entry{Args: []string{"prog"}, Stdin: digest("other input\n"), StdinLen: 12, Stdout: []byte("other\n")},
+	)
+	out, err := run(t, dir, "printf 'one\\ntwo\\n' | { prog; prog; }", noExec(t),
+		interp.ExecHandlers(Replay(cassette, Strict, KeyStdin)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "got one\ngot two\n"; out != want {
+		t.Fatalf("want %q, got %q", want, out)
+	}
+}
+
+func TestReplayUnmatched(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "replay-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cassette := filepath.Join(dir, "cassette")
+	writeCassette(t, cassette,
+		&Entry{Args: []string{"prog"}, Dir: "/elsewhere", Stdin: digest("in\n"), StdinLen: 3, Stdout: []byte("replayed\n")},
+	)
+
+	_, err = run(t, dir, "echo in | prog", noExec(t),
+		interp.ExecHandlers(Replay(cassette, Strict, KeyDir)))
+	if err, ok := err.(*UnmatchedError); !ok || err.Dir != dir {
+		t.Fatalf("want an *UnmatchedError in %s, got %#v", dir, err)
+	}
+
+	// With Fallthrough, the next handler gets all of the input, including
+	// what was read to try to match it.
+	fallthroughExec := interp.ExecHandler(func(ctx context.Context, args []string) error {
+		hc := interp.HandlerCtx(ctx)
+		in, err := ioutil.ReadAll(hc.Stdin)
+		if err != nil {
+			return err
+		}
+		hc.Stdout.Write(bytes.ToUpper(in))
+		return nil
+	})
+	out, err := run(t, dir, "echo other | prog; echo in | prog; echo in | prog", fallthroughExec,
+		interp.ExecHandlers(Replay(cassette, Fallthrough, KeyStdin)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "OTHER\nreplayed\nIN\n"; out != want {
+		t.Fatalf("want %q, got %q", want, out)
+	}
+
+	_, err = run(t, dir, "prog", interp.ExecHandlers(Replay(filepath.Join(dir, "missing"), Strict, 0)))
+	if !os.IsNotExist(err) {
+		t.Fatalf("want a missing cassette error, got %v", err)
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"strconv"
+	"syscall"
+)
+
+// Resource is a kind of system resource whose usage can be limited. See
+// ResourceLimit.
+type Resource int
+
+const (
+	ResourceCore      Resource = iota // size of core files
+	ResourceData                      // size of the data segment
+	ResourceFileSize                  // size of the files written
+	ResourceOpenFiles                 // number of open file descriptors
+	ResourceStack                     // size of the stack
+	ResourceCPUTime                   // CPU time, in seconds
+	ResourceVirtMem                   // size of the virtual memory
+)
+
+// RlimitInfinity is the value of a limit which is not set.
+const RlimitInfinity = ^uint64(0)
+
+// Rlimit holds the soft and hard limits of a Resource, like in setrlimit(2).
+// Sizes are in bytes.
+type Rlimit struct {
+	Cur uint64 // soft limit
+	Max uint64 // hard limit
+}
+
+// rlimitTable holds the information used by the ulimit builtin, in the same
+// order as the Resource constants.
+var rlimitTable = [...]struct {
+	flag   byte
+	desc   string
+	unit   string
+	factor uint64
+}{
+	ResourceCore:      {'c', "core file size", "blocks", 1024},
+	ResourceData:      {'d', "data seg size", "kbytes", 1024},
+	ResourceFileSize:  {'f', "file size", "blocks", 1024},
+	ResourceOpenFiles: {'n', "open files", "", 1},
+	ResourceStack:     {'s', "stack size", "kbytes", 1024},
+	ResourceCPUTime:   {'t', "cpu time", "seconds", 1},
+	ResourceVirtMem:   {'v', "virtual memory", "kbytes", 1024},
+}
+
+// rlimit returns the current limit for a resource, which is the one set by
+// ResourceLimit or the ulimit builtin, or otherwise the one of the current
+// process.
+func (r *Runner) rlimit(res Resource) Rlimit {
+	if !rlimitSupported {
+		return Rlimit{Cur: RlimitInfinity, Max: RlimitInfinity}
+	}
+	if lim, ok := r.rlimits[res]; ok {
+		return lim
+	}
+	lim, err := getRlimit(res)
+	if err != nil {
+		return Rlimit{Cur: RlimitInfinity, Max: RlimitInfinity}
+	}
+	return lim
+}
+
+func (r *Runner) ulimit(args []string) int {
+	soft, hard := false, false
+	var resources []Resource
+	for len(args) > 0 && len(args[0]) > 1 && args[0][0] == '-' {
+		for _, c := range args[0][1:] {
+			switch c {
+			case 'S':
+				soft = true
+			case 'H':
+				hard = true
+			case 'a':
+				resources = resources[:0]
+				for res := range rlimitTable {
+					resources = append(resources, Resource(res))
+				}
+			default:
+				res := -1
+				for i, info := range rlimitTable {
+					if rune(info.flag) == c {
+						res = i
+					}
+				}
+				if res < 0 {
+					r.errf("ulimit: -%c: invalid option\n", c)
+					return 2
+				}
+				resources = append(resources, Resource(res))
+			}
+		}
+		args = args[1:]
+	}
+	if len(resources) == 0 {
+		resources = []Resource{ResourceFileSize}
+	}
+	switch {
+	case len(args) > 1:
+		r.errf("ulimit: too many arguments\n")
+		return 2
+	case len(args) == 0:
+		for _, res := range resources {
+			lim := r.rlimit(res)
+			value := lim.Cur
+			if hard && !soft {
+				value = lim.Max
+			}
+			info := rlimitTable[res]
+			if len(resources) > 1 {
+				unit := "(-" + string(info.flag) + ") "
+				if info.unit != "" {
+					unit = "(" + info.unit + ", -" + string(info.flag) + ") "
+				}
+				r.outf("%-20s %20s", info.desc, unit)
+			}
+			if value == RlimitInfinity {
+				r.out("unlimited\n")
+			} else {
+				r.outf("%d\n", value/info.factor)
+			}
+		}
+		return 0
+	case len(resources) > 1:
+		r.errf("ulimit: only one limit can be set at a time\n")
+		return 2
+	}
+	res := resources[0]
+	info := rlimitTable[res]
+	lim := r.rlimit(res)
+	var value uint64
+	switch arg := args[0]; arg {
+	case "unlimited":
+		value = RlimitInfinity
+	case "hard":
+		value = lim.Max
+	case "soft":
+		value = lim.Cur
+	default:
+		n, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil || n > RlimitInfinity/info.factor {
+			r.errf("ulimit: %s: invalid number\n", arg)
+			return 1
+		}
+		value = n * info.factor
+	}
+	if !rlimitSupported {
+		r.errf("ulimit: %s: resource limits are not supported on this platform\n", info.desc)
+		return 0
+	}
+	if !soft && !hard {
+		soft, hard = true, true
+	}
+	if hard {
+		// Like an unprivileged process, never raise hard limits.
+		if value > lim.Max {
+			r.errf("ulimit: %s: cannot modify limit: %v\n", info.desc, syscall.EPERM)
+			return 1
+		}
+		lim.Max = value
+	}
+	if soft {
+		lim.Cur = value
+	}
+	if lim.Cur > lim.Max {
+		r.errf("ulimit: %s: cannot modify limit: %v\n", info.desc, syscall.EINVAL)
+		return 1
+	}
+	// Copy the map, as it may be shared with subshells.
+	rlimits := make(map[Resource]Rlimit, len(r.rlimits)+1)
+	for res, lim := range r.rlimits {
+		rlimits[res] = lim
+	}
+	rlimits[res] = lim
+	r.rlimits = rlimits
+	return 0
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+// rlimitSupported reports whether resource limits can be applied to programs.
+const rlimitSupported = true
+
+var rlimitResources = [...]int{
+	ResourceCore:      syscall.RLIMIT_CORE,
+	ResourceData:      syscall.RLIMIT_DATA,
+	ResourceFileSize:  syscall.RLIMIT_FSIZE,
+	ResourceOpenFiles: syscall.RLIMIT_NOFILE,
+	ResourceStack:     syscall.RLIMIT_STACK,
+	ResourceCPUTime:   syscall.RLIMIT_CPU,
+	ResourceVirtMem:   syscall.RLIMIT_AS,
+}
+
+// getRlimit returns the limit of the current process, which is inherited by
+// the programs it starts.
+func getRlimit(res Resource) (Rlimit, error) {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(rlimitResources[res], &lim); err != nil {
+		return Rlimit{}, err
+	}
+	return Rlimit{Cur: lim.Cur, Max: lim.Max}, nil
+}
+
+// startCmd starts a command with the given resource limits.
+//
+// Go's os/exec has no way to call setrlimit(2) in the child before it executes
+// the program, so a shell is started instead, which waits on a pipe before
+// executing the program. Meanwhile, the limits are set on the shell via
+// prlimit(2), and they are kept when it executes the program. Note that the
+// program's first argument is its path rather than cmd.Args[0].
+func startCmd(cmd *exec.Cmd, limits map[Resource]Rlimit) error {
+	if len(limits) == 0 {
+		return cmd.Start()
+	}
+	// Report the most common error directly, as the shell would only print
+	// it. The mode is X_OK.
+	if err := syscall.Access(cmd.Path, 1); err != nil {
+		return &os.PathError{Op: "fork/exec", Path: cmd.Path, Err: err}
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer pw.Close()
+	fd := 3 + len(cmd.ExtraFiles)
+	script := fmt.Sprintf(`read _ <&%d && exec %d<&- "$0" "$@"`, fd, fd)
+	cmd.Args = append([]string{"sh", "-c", script, cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = "/bin/sh"
+	cmd.ExtraFiles = append(cmd.ExtraFiles, pr)
+	err = cmd.Start()
+	pr.Close()
+	if err != nil {
+		return err
+	}
+	if err := setRlimits(cmd.Process.Pid, limits); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return &exec.Error{
+			Name: cmd.Args[3],
+			Err:  fmt.Errorf("could not set resource limits: %v", err),
+		}
+	}
+	// If the shell is gone, cmd.Wait will tell why.
+	pw.Write([]byte("\n"))
+	return nil
+}
+
+func setRlimits(pid int, limits map[Resource]Rlimit) error {
+	for res, lim := range limits {
+		slim := syscall.Rlimit{Cur: lim.Cur, Max: lim.Max}
+		_, _, errno := syscall.RawSyscall6(syscall.SYS_PRLIMIT64,
+			uintptr(pid), uintptr(rlimitResources[res]),
+			uintptr(unsafe.Pointer(&slim)), 0, 0, 0)
+		if errno != 0 {
+			return errno
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"mvdan.cc/sh/v3/expand"
+)
+
+func TestRunnerResourceLimit(t *testing.T) {
+	t.Parallel()
+	if _, err := LookPath(expand.ListEnviron("PATH=/bin:/usr/bin"), "sh"); err != nil {
+		t.Skip("sh is required")
+	}
+	tests := []struct {
+		in, want string
+	}{
+		{"ulimit -n; ulimit -Hn", "100\n200\n"},
+		{"ulimit -Sn; ulimit -n -f | sed 's/ .*//'", "100\nopen\nfile\n"},
+		{"sh -c 'ulimit -n; ulimit -Hn'", "100\n200\n"},
+		{"ulimit -n 50; ulimit -n; ulimit -Hn", "50\n50\n"},
+		{"ulimit -Sn 150; sh -c 'ulimit -n; ulimit -Hn'", "150\n200\n"},
+		{"ulimit -Hn 150; sh -c 'ulimit -n; ulimit -Hn'", "100\n150\n"},
+		{"(ulimit -n 50); ulimit -n", "100\n"},
+		{
+			"ulimit -Hn 300",
+			"ulimit: open files: cannot modify limit: operation not permitted\nexit status 1",
+		},
+		{
+			"ulimit -Sn 300",
+			"ulimit: open files: cannot modify limit: invalid argument\nexit status 1",
+		},
+		{
+			"ulimit -Hn 50",
+			"ulimit: open files: cannot modify limit: invalid argument\nexit status 1",
+		},
+		{"ulimit -Hn 150; ulimit -n hard; ulimit -n", "150\n"},
+		{"ulimit -n unlimited", "ulimit: open files: cannot modify limit: operation not permitted\nexit status 1"},
+		{"ulimit -t 4; ulimit -t; sh -c 'ulimit -t'", "4\n4\n"},
+		{"ulimit -n -f 10", "ulimit: only one limit can be set at a time\nexit status 2"},
+	}
+	for i := range tests {
+		test := tests[i]
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+			file := parse(t, nil, test.in)
+			var cb concBuffer
+			r, err := New(
+				Env(expand.ListEnviron("PATH=/bin:/usr/bin")),
+				ResourceLimit(ResourceOpenFiles, Rlimit{Cur: 100, Max: 200}),
+				StdIO(nil, &cb, &cb),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Run(context.Background(), file); err != nil {
+				cb.WriteString(err.Error())
+			}
+			if got := cb.String(); got != test.want {
+				t.Fatalf("wrong output in %q:\nwant: %q\ngot:  %q", test.in, test.want, got)
+			}
+		})
+	}
+}
+
+func TestStartCmdError(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "interp-rlimit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "noexec")
+	if err := ioutil.WriteFile(path, []byte("#!/bin/sh\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	limits := map[Resource]Rlimit{ResourceOpenFiles: {Cur: 100, Max: 200}}
+	err = startCmd(&exec.Cmd{Path: path, Args: []string{"noexec"}}, limits)
+	if perr, ok := err.(*os.PathError); !ok || perr.Err != syscall.EACCES {
+		t.Fatalf("want a permission error, got %#v", err)
+	}
+}
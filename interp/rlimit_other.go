@@ -0,0 +1,22 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// +build !linux
+
+package interp
+
+import "os/exec"
+
+// rlimitSupported reports whether resource limits can be applied to programs.
+const rlimitSupported = false
+
+// getRlimit reports all resources as unlimited.
+func getRlimit(res Resource) (Rlimit, error) {
+	return Rlimit{Cur: RlimitInfinity, Max: RlimitInfinity}, nil
+}
+
+// startCmd starts a command, ignoring resource limits as they are not
+// supported.
+func startCmd(cmd *exec.Cmd, limits map[Resource]Rlimit) error {
+	return cmd.Start()
+}
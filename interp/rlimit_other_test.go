@@ -0,0 +1,45 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// +build !linux
+
+package interp
+
+import (
+	"context"
+	"testing"
+)
+
+func TestRunnerResourceLimitUnsupported(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		in, want string
+	}{
+		{"ulimit -n; ulimit -Hn", "unlimited\nunlimited\n"},
+		{
+			"ulimit -n 10; echo $?; ulimit -n",
+			"ulimit: open files: resource limits are not supported on this platform\n0\nunlimited\n",
+		},
+	}
+	for i := range tests {
+		test := tests[i]
+		t.Run("", func(t *testing.T) {
+			t.Parallel()
+			file := parse(t, nil, test.in)
+			var cb concBuffer
+			r, err := New(
+				ResourceLimit(ResourceOpenFiles, Rlimit{Cur: 100, Max: 200}),
+				StdIO(nil, &cb, &cb),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := r.Run(context.Background(), file); err != nil {
+				cb.WriteString(err.Error())
+			}
+			if got := cb.String(); got != test.want {
+				t.Fatalf("wrong output in %q:\nwant: %q\ngot:  %q", test.in, test.want, got)
+			}
+		})
+	}
+}
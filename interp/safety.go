@@ -0,0 +1,344 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// SafetyRule describes a kind of destructive command, such as a recursive
+// delete of the root directory. See SafetyPolicy.
+type SafetyRule struct {
+	// Name identifies the rule, such as "rm-root". It is used to disable
+	// rules via SafetyConfig.Disable.
+	Name string
+
+	// Description explains what is destructive about the matched commands,
+	// for use in error messages and prompts.
+	Description string
+
+	// Match reports whether a command is destructive.
+	Match func(cmd *SafetyCommand) bool
+}
+
+// SafetyCommand is a command being checked by a SafetyRule.
+type SafetyCommand struct {
+	// Args are the command's fields after expansion. Programs which run the
+	// rest of their arguments as a command, like "sudo" and "env", are
+	// skipped along with their options, so Args[0] is the command being
+	// run in the end, like "rm".
+	Args []string
+
+	// Dir is the directory the command runs in.
+	Dir string
+
+	// Roots are the protected directories; see SafetyConfig.Roots.
+	Roots []string
+}
+
+// Name returns the base name of the program being run, such as "rm" for
+// "/bin/rm".
+func (c *SafetyCommand) Name() string {
+	if len(c.Args) == 0 {
+		return ""
+	}
+	return filepath.Base(c.Args[0])
+}
+
+// Protected reports whether a path is, or contains, any of the protected
+// directories. The filesystem root and the directories directly within it,
+// like "/usr", are always protected. Relative paths are relative to Dir.
+func (c *SafetyCommand) Protected(path string) bool {
+	if path == "" {
+		return false
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(c.Dir, path)
+	}
+	path = filepath.Clean(path)
+	parent := filepath.Dir(path)
+	if parent == path || filepath.Dir(parent) == parent {
+		return true // the root, or directly within it
+	}
+	for _, root := range c.Roots {
+		root = filepath.Clean(root)
+		if root == path || strings.HasPrefix(root, path+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+// SafetyViolation is a command which matched a SafetyRule.
+type SafetyViolation struct {
+	Rule SafetyRule
+
+	// Args are the command's fields after expansion, as given to the
+	// ExecHandlerFunc.
+	Args []string
+
+	// Pos is the position of the command.
+	Pos syntax.Pos
+}
+
+func (v SafetyViolation) Error() string {
+	return fmt.Sprintf("%s: refusing to run %q: %s (rule %s)",
+		v.Pos, strings.Join(v.Args, " "), v.Rule.Description, v.Rule.Name)
+}
+
+// SafetyConfig configures a SafetyPolicy.
+type SafetyConfig struct {
+	// Rules are the rules to check commands against. If nil,
+	// DefaultSafetyRules is used.
+	Rules []SafetyRule
+
+	// Disable holds the names of the rules which are not checked.
+	Disable []string
+
+	// Roots are the directories to protect from commands like "rm -rf", in
+	// addition to the filesystem root and the directories directly within
+	// it. If nil, the HOME directory in the interpreter's environment is
+	// protected.
+	Roots []string
+
+	// Confirm is called when a command matches a rule, such as to ask the
+	// user. If it returns nil, the command runs. Otherwise, the command
+	// doesn't run, and the error is treated like any error returned by an
+	// ExecHandlerFunc: NewExitStatus only makes the command fail, while
+	// any other error stops the interpreter.
+	//
+	// If Confirm is nil, matching commands are refused by returning the
+	// violation as an error, stopping the interpreter.
+	Confirm func(ctx context.Context, v SafetyViolation) error
+}
+
+// DefaultSafetyRules returns the rules used by SafetyPolicy by default:
+//
+//   - "rm-root" matches recursive deletes of protected directories, such as
+//     "rm -rf /"
+//   - "chmod-root" matches recursive chmod, chown and chgrp on protected
+//     directories, such as "chmod -R 777 /"
+//   - "mkfs" matches programs which create filesystems, such as "mkfs.ext4"
+//   - "dd-device" matches dd writing to a disk, such as "dd of=/dev/sda"
+func DefaultSafetyRules() []SafetyRule {
+	return []SafetyRule{
+		{
+			Name:        "rm-root",
+			Description: "recursive delete of a protected directory",
+			Match: func(cmd *SafetyCommand) bool {
+				if cmd.Name() != "rm" {
+					return false
+				}
+				flags, operands := splitFlags(cmd.Args[1:])
+				return hasFlag(flags, "rR", "--recursive") && anyProtected(cmd, operands)
+			},
+		},
+		{
+			Name:        "chmod-root",
+			Description: "recursive change of the permissions or owner of a protected directory",
+			Match: func(cmd *SafetyCommand) bool {
+				switch cmd.Name() {
+				case "chmod", "chown", "chgrp":
+				default:
+					return false
+				}
+				flags, operands := splitFlags(cmd.Args[1:])
+				if len(operands) > 0 {
+					operands = operands[1:] // the mode, owner or group
+				}
+				return hasFlag(flags, "R", "--recursive") && anyProtected(cmd, operands)
+			},
+		},
+		{
+			Name:        "mkfs",
+			Description: "creation of a filesystem, erasing a disk",
+			Match: func(cmd *SafetyCommand) bool {
+				name := cmd.Name()
+				switch {
+				case name == "mkfs", strings.HasPrefix(name, "mkfs."),
+					name == "mke2fs", name == "mkswap", name == "wipefs":
+					return true
+				}
+				return false
+			},
+		},
+		{
+			Name:        "dd-device",
+			Description: "write to a disk device",
+			Match: func(cmd *SafetyCommand) bool {
+				if cmd.Name() != "dd" {
+					return false
+				}
+				for _, arg := range cmd.Args[1:] {
+					if strings.HasPrefix(arg, "of=") && diskDevice(arg[3:]) {
+						return true
+					}
+				}
+				return false
+			},
+		},
+	}
+}
+
+// SafetyPolicy returns a middleware for ExecHandlerFunc which checks every
+// program against rules of destructive commands, such as "rm -rf /", before
+// running it via next:
+//
+//	exec := interp.SafetyPolicy(cfg)(interp.DefaultExecHandler(2 * time.Second))
+//	runner, err := interp.New(interp.ExecHandler(exec))
+//
+// The checks happen after expansion, so "rm -rf "$dir"/" is caught if dir is
+// empty. Only programs are checked; builtins and functions are not, as they
+// can't be destructive on their own.
+//
+// This is a safety net against common mistakes, and not a sandbox; there are
+// many other ways for a program to be destructive.
+func SafetyPolicy(cfg SafetyConfig) func(next ExecHandlerFunc) ExecHandlerFunc {
+	rules := cfg.Rules
+	if rules == nil {
+		rules = DefaultSafetyRules()
+	}
+	disabled := make(map[string]bool, len(cfg.Disable))
+	for _, name := range cfg.Disable {
+		disabled[name] = true
+	}
+	return func(next ExecHandlerFunc) ExecHandlerFunc {
+		return func(ctx context.Context, args []string) error {
+			hc := HandlerCtx(ctx)
+			cmd := &SafetyCommand{
+				Args:  unwrapCommand(args),
+				Dir:   hc.Dir,
+				Roots: cfg.Roots,
+			}
+			if cmd.Roots == nil {
+				if home := hc.Env.Get("HOME").String(); home != "" {
+					cmd.Roots = []string{home}
+				}
+			}
+			for _, rule := range rules {
+				if disabled[rule.Name] || len(cmd.Args) == 0 || !rule.Match(cmd) {
+					continue
+				}
+				v := SafetyViolation{Rule: rule, Args: args, Pos: hc.Pos}
+				if cfg.Confirm == nil {
+					return v
+				}
+				if err := cfg.Confirm(ctx, v); err != nil {
+					return err
+				}
+			}
+			return next(ctx, args)
+		}
+	}
+}
+
+// unwrapCommand skips the programs at the start of args which run the rest of
+// their arguments as a command, like "sudo" and "env", along with their
+// options.
+func unwrapCommand(args []string) []string {
+	for len(args) > 0 {
+		// the options of these programs which take a value
+		var valueOpts string
+		switch filepath.Base(args[0]) {
+		case "sudo", "doas":
+			valueOpts = "ugCDhprtU"
+		case "env":
+			valueOpts = "uCS"
+		case "nice":
+			valueOpts = "n"
+		case "timeout":
+			valueOpts = "ks"
+		case "nohup", "time", "stdbuf", "ionice":
+		default:
+			return args
+		}
+		name := filepath.Base(args[0])
+		args = args[1:]
+		for len(args) > 0 {
+			arg := args[0]
+			if arg == "--" {
+				args = args[1:]
+				break
+			}
+			if name == "env" && strings.Contains(arg, "=") && !strings.HasPrefix(arg, "-") {
+				args = args[1:] // a variable, like FOO=bar
+				continue
+			}
+			if len(arg) < 2 || arg[0] != '-' {
+				break
+			}
+			args = args[1:]
+			if len(arg) == 2 && strings.IndexByte(valueOpts, arg[1]) >= 0 && len(args) > 0 {
+				args = args[1:] // the option's value
+			}
+		}
+		if name == "timeout" && len(args) > 0 {
+			args = args[1:] // the duration
+		}
+	}
+	return args
+}
+
+// splitFlags separates the flags like "-rf" from the operands in the arguments
+// of a program. All the arguments after "--" are operands.
+func splitFlags(args []string) (flags, operands []string) {
+	for i, arg := range args {
+		switch {
+		case arg == "--":
+			return flags, append(operands, args[i+1:]...)
+		case len(arg) > 1 && arg[0] == '-':
+			flags = append(flags, arg)
+		default:
+			operands = append(operands, arg)
+		}
+	}
+	return flags, operands
+}
+
+// hasFlag reports whether any of the flags is one of the single-letter flags in
+// letters, possibly grouped like "-rf", or the long flag.
+func hasFlag(flags []string, letters, long string) bool {
+	for _, flag := range flags {
+		if flag == long {
+			return true
+		}
+		if !strings.HasPrefix(flag, "--") && strings.ContainsAny(flag[1:], letters) {
+			return true
+		}
+	}
+	return false
+}
+
+func anyProtected(cmd *SafetyCommand, paths []string) bool {
+	for _, path := range paths {
+		if cmd.Protected(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// diskDevice reports whether a path is a disk device, or a partition of one,
+// such as "/dev/sda" or "/dev/nvme0n1p1".
+func diskDevice(path string) bool {
+	path = filepath.ToSlash(filepath.Clean(path))
+	if !strings.HasPrefix(path, "/dev/") {
+		return false
+	}
+	name := path[len("/dev/"):]
+	for _, prefix := range [...]string{
+		"sd", "hd", "vd", "xvd", "nvme", "mmcblk", "md", "dm-",
+		"mapper/", "disk", "rdisk",
+	} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"mvdan.cc/sh/v3/expand"
+)
+
+var safetyTests = []struct {
+	src  string
+	want string // the rule which refuses the command, if any
+}{
+	// rm-root
+	{"rm -rf /", "rm-root"},
+	{"rm -r -f /", "rm-root"},
+	{"rm -fR /usr", "rm-root"},
+	{"rm --recursive --force /etc/", "rm-root"},
+	{"/bin/rm -rf -- /", "rm-root"},
+	{"rm -rf foo /", "rm-root"},
+	{"rm -rf /home/user", "rm-root"},
+	{"rm -rf /home", "rm-root"},
+	{"rm -rf ~", "rm-root"},
+	{"rm -rf ..", "rm-root"},
+	{"dir=; rm -rf \"$dir\"/", "rm-root"},
+	{"dir=; rm -rf \"$dir/\"*", "rm-root"},
+	{"rm -rf /home/user/tmp", ""},
+	{"rm -rf /tmp/foo", ""},
+	{"rm -f /", ""},
+	{"rm -rf foo", ""},
+	{"rm -rf -- -r", ""},
+	{"echo rm -rf /", ""},
+
+	// chmod-root
+	{"chmod -R 777 /", "chmod-root"},
+	{"chown -R nobody /usr", "chmod-root"},
+	{"chgrp --recursive users ~", "chmod-root"},
+	{"chmod 755 /", ""},
+	{"chmod -R 755 /home/user/bin", ""},
+	{"chmod -R / foo", ""},
+
+	// mkfs
+	{"mkfs -t ext4 /dev/sda1", "mkfs"},
+	{"mkfs.ext4 /dev/sda1", "mkfs"},
+	{"/sbin/mke2fs /dev/sdb", "mkfs"},
+	{"mkswap /dev/sdb2", "mkfs"},
+	{"wipefs -a /dev/nvme0n1", "mkfs"},
+	{"mkfsx", ""},
+
+	// dd-device
+	{"dd if=/dev/zero of=/dev/sda", "dd-device"},
+	{"dd if=x.iso of=/dev/nvme0n1 bs=4M", "dd-device"},
+	{"dd of=/dev/mmcblk0p1", "dd-device"},
+	{"dd of=/dev/mapper/root", "dd-device"},
+	{"dd if=/dev/sda of=disk.img", ""},
+	{"dd if=/dev/zero of=/dev/null", ""},
+
+	// wrappers
+	{"sudo rm -rf /", "rm-root"},
+	{"sudo -u root -- rm -rf /", "rm-root"},
+	{"env FOO=bar nice -n 10 rm -rf /", "rm-root"},
+	{"timeout -s KILL 10 mkfs.ext4 /dev/sda", "mkfs"},
+	{"nohup time dd of=/dev/sda", "dd-device"},
+	{"sudo", ""},
+	{"sudo echo rm -rf /", ""},
+
+	// only programs are checked
+	{"rm() { :; }; rm -rf /", ""},
+	{"command rm -rf /", "rm-root"},
+}
+
+func TestSafetyPolicy(t *testing.T) {
+	t.Parallel()
+	env := expand.ListEnviron("HOME=/home/user")
+	for i, tc := range safetyTests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			var ran []string
+			next := func(ctx context.Context, args []string) error {
+				ran = append(ran, strings.Join(args, " "))
+				return nil
+			}
+			r, err := New(
+				Env(env), Dir("/usr/bin"),
+				StdIO(nil, ioutil.Discard, ioutil.Discard),
+				ExecHandler(SafetyPolicy(SafetyConfig{})(next)),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = r.Run(context.Background(), parse(t, nil, tc.src))
+			if tc.want == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			v, ok := err.(SafetyViolation)
+			if !ok {
+				t.Fatalf("want a SafetyViolation, got %v (ran %q)", err, ran)
+			}
+			if v.Rule.Name != tc.want {
+				t.Fatalf("want rule %s, got %s", tc.want, v.Rule.Name)
+			}
+			if len(ran) > 0 {
+				t.Fatalf("refused command ran: %q", ran)
+			}
+		})
+	}
+}
+
+func TestSafetyPolicyConfig(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		cfg     SafetyConfig
+		src     string
+		want    string
+		wantErr string
+	}{
+		{
+			SafetyConfig{Disable: []string{"rm-root"}},
+			"rm -rf /; mkfs /dev/sda",
+			"rm -rf /\n",
+			"1:11: refusing to run \"mkfs /dev/sda\": creation of a filesystem, erasing a disk (rule mkfs)",
+		},
+		{
+			SafetyConfig{Roots: []string{"/srv/data"}},
+			"rm -rf /home/user; rm -rf /srv",
+			"rm -rf /home/user\n",
+			"1:20: refusing to run \"rm -rf /srv\": recursive delete of a protected directory (rule rm-root)",
+		},
+		{
+			SafetyConfig{Rules: []SafetyRule{{
+				Name:        "no-curl",
+				Description: "network access",
+				Match:       func(cmd *SafetyCommand) bool { return cmd.Name() == "curl" },
+			}}},
+			"rm -rf /\ncurl x",
+			"rm -rf /\n",
+			"2:1: refusing to run \"curl x\": network access (rule no-curl)",
+		},
+		{
+			SafetyConfig{Confirm: func(ctx context.Context, v SafetyViolation) error {
+				return NewExitStatus(1)
+			}},
+			"rm -rf / || echo refused $?; rm -rf /tmp/x",
+			"rm -rf /tmp/x\n",
+			"",
+		},
+		{
+			SafetyConfig{Confirm: func(ctx context.Context, v SafetyViolation) error {
+				if v.Args[len(v.Args)-1] == "/" {
+					return fmt.Errorf("denied %q at %s", v.Args, v.Pos)
+				}
+				return nil
+			}},
+			"rm -rf ~\n  sudo rm -rf foo /",
+			"rm -rf /home/user\n",
+			"denied [\"sudo\" \"rm\" \"-rf\" \"foo\" \"/\"] at 2:3",
+		},
+	}
+	env := expand.ListEnviron("HOME=/home/user")
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			var ran strings.Builder
+			next := func(ctx context.Context, args []string) error {
+				fmt.Fprintln(&ran, strings.Join(args, " "))
+				return nil
+			}
+			r, err := New(
+				Env(env),
+				StdIO(nil, ioutil.Discard, ioutil.Discard),
+				ExecHandler(SafetyPolicy(tc.cfg)(next)),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = r.Run(context.Background(), parse(t, nil, tc.src))
+			gotErr := ""
+			if err != nil {
+				gotErr = err.Error()
+			}
+			if gotErr != tc.wantErr {
+				t.Fatalf("want error %q, got %q", tc.wantErr, gotErr)
+			}
+			if got := ran.String(); got != tc.want {
+				t.Fatalf("want ran:\n%s\ngot:\n%s", tc.want, got)
+			}
+		})
+	}
+}
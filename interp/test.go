@@ -16,13 +16,19 @@ import (
 	"mvdan.cc/sh/v3/syntax"
 )
 
-// non-empty string is true, empty string is false
-func (r *Runner) bashTest(ctx context.Context, expr syntax.TestExpr, classic bool) string {
+// bashTest evaluates a test expression, returning a non-empty string if it is
+// true. classic is set for the test and [ builtins, and negated is set when expr
+// is negated by its parent, which only matters for the trace of [[ ]].
+func (r *Runner) bashTest(ctx context.Context, expr syntax.TestExpr, classic, negated bool) string {
 	switch x := expr.(type) {
 	case *syntax.Word:
-		return r.document(x)
+		str := r.document(x)
+		r.xtraceTest(classic, negated, "-n", str)
+		return str
+	case *syntax.RegexWord:
+		return r.regexp(x.Word)
 	case *syntax.ParenTest:
-		return r.bashTest(ctx, x.X, classic)
+		return r.bashTest(ctx, x.X, classic, false)
 	case *syntax.BinaryTest:
 		switch x.Op {
 		case syntax.TsMatchShort, syntax.TsMatch, syntax.TsNoMatch:
@@ -35,18 +41,34 @@ func (r *Runner) bashTest(ctx context.Context, expr syntax.TestExpr, classic boo
 				}
 			} else { // [[
 				pattern := r.pattern(yw)
+				r.xtraceTest(classic, negated, str, x.Op.String(), pattern)
 				if match(pattern, str) == (x.Op != syntax.TsNoMatch) {
 					return "1"
 				}
 			}
 			return ""
+		case syntax.AndTest, syntax.OrTest:
+			// Like in Bash, the right side is only evaluated if
+			// the left side doesn't decide the result.
+			if (r.bashTest(ctx, x.X, classic, false) != "") == (x.Op == syntax.OrTest) {
+				return oneIfStr(x.Op == syntax.OrTest)
+			}
+			return oneIfStr(r.bashTest(ctx, x.Y, classic, false) != "")
 		}
-		if r.binTest(x.Op, r.bashTest(ctx, x.X, classic), r.bashTest(ctx, x.Y, classic)) {
+		xs := r.testOperand(ctx, x.X, classic)
+		ys := r.testOperand(ctx, x.Y, classic)
+		r.xtraceTest(classic, negated, xs, x.Op.String(), ys)
+		if r.binTest(x.Op, xs, ys) {
 			return "1"
 		}
 		return ""
 	case *syntax.UnaryTest:
-		if r.unTest(ctx, x.Op, r.bashTest(ctx, x.X, classic)) {
+		if x.Op == syntax.TsNot {
+			return oneIfStr(r.bashTest(ctx, x.X, classic, !negated) == "")
+		}
+		xs := r.testOperand(ctx, x.X, classic)
+		r.xtraceTest(classic, negated, x.Op.String(), xs)
+		if r.unTest(ctx, x.Op, xs) {
 			return "1"
 		}
 		return ""
@@ -54,6 +76,22 @@ func (r *Runner) bashTest(ctx context.Context, expr syntax.TestExpr, classic boo
 	return ""
 }
 
+// testOperand evaluates an operand of a test operator, such as the file name
+// in "-f file".
+func (r *Runner) testOperand(ctx context.Context, expr syntax.TestExpr, classic bool) string {
+	if w, ok := expr.(*syntax.Word); ok {
+		return r.document(w)
+	}
+	return r.bashTest(ctx, expr, classic, false)
+}
+
+func oneIfStr(b bool) string {
+	if b {
+		return "1"
+	}
+	return ""
+}
+
 func (r *Runner) binTest(op syntax.BinTestOperator, x, y string) bool {
 	switch op {
 	case syntax.TsReMatch:
@@ -133,7 +171,7 @@ func (r *Runner) unTest(ctx context.Context, op syntax.UnTestOperator, x string)
 	case syntax.TsSocket:
 		return r.statMode(x, os.ModeSocket)
 	case syntax.TsSmbLink:
-		info, err := os.Lstat(r.absPath(x))
+		info, err := r.lstat(x)
 		return err == nil && info.Mode()&os.ModeSymlink != 0
 	case syntax.TsSticky:
 		return r.statMode(x, os.ModeSticky)
@@ -145,19 +183,28 @@ func (r *Runner) unTest(ctx context.Context, op syntax.UnTestOperator, x string)
 	// case syntax.TsUsrOwn:
 	// case syntax.TsModif:
 	case syntax.TsRead:
-		f, err := r.open(ctx, x, os.O_RDONLY, 0, false)
+		f, err := r.open(ctx, OpenTest, x, os.O_RDONLY, 0, false)
 		if err == nil {
 			f.Close()
 		}
 		return err == nil
 	case syntax.TsWrite:
-		f, err := r.open(ctx, x, os.O_WRONLY, 0, false)
+		f, err := r.open(ctx, OpenTest, x, os.O_WRONLY, 0, false)
 		if err == nil {
 			f.Close()
 		}
 		return err == nil
 	case syntax.TsExec:
-		_, err := exec.LookPath(r.absPath(x))
+		if _, ok := r.fs.(osFS); !ok {
+			// Only the permission bits can tell what is executable.
+			info, err := r.stat(x)
+			return err == nil && !info.IsDir() && info.Mode()&0111 != 0
+		}
+		path, err := r.hostPath(x)
+		if err != nil {
+			return false
+		}
+		_, err = exec.LookPath(path)
 		return err == nil
 	case syntax.TsNoEmpty:
 		info, err := r.stat(x)
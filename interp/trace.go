@@ -0,0 +1,404 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package interp
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// xtraceOutput returns where the trace of the xtrace option is written: the
+// file descriptor set by BASH_XTRACEFD, or stderr. If that file descriptor has
+// since been closed, the trace is discarded, like in Bash.
+func (r *Runner) xtraceOutput() io.Writer {
+	if r.xtraceFd < 0 {
+		return r.stderr
+	}
+	f, ok := r.fd(r.xtraceFd)
+	if !ok {
+		return ioutil.Discard
+	}
+	return f
+}
+
+// xtraceFdChanged updates where the trace is written after BASH_XTRACEFD was
+// set or unset. As in Bash, unsetting it or setting it to the empty string
+// closes the file descriptor it was set to, and the trace goes back to stderr.
+// An invalid value, such as a file descriptor which isn't open, is an error
+// which also sends the trace to stderr, but leaves the old one open.
+func (r *Runner) xtraceFdChanged() {
+	val := r.envGet("BASH_XTRACEFD")
+	if val == "" {
+		if r.xtraceFd >= 0 {
+			r.setFd(r.xtraceFd, nil)
+		}
+		r.xtraceFd = -1
+		return
+	}
+	fd, err := strconv.Atoi(val)
+	if _, open := r.fd(fd); err != nil || !open || strings.Trim(val, "0123456789") != "" {
+		r.errf("BASH_XTRACEFD: %s: invalid value for trace file descriptor\n", val)
+		r.xtraceFd = -1
+		return
+	}
+	r.xtraceFd = fd
+}
+
+// xtrace writes the trace of a simple command for the xtrace option, with its
+// fields quoted so that they can be read back by the shell.
+func (r *Runner) xtrace(fields []string) {
+	var buf strings.Builder
+	for i, field := range fields {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(xtraceQuote(field))
+	}
+	r.xtraceLine(buf.String())
+}
+
+// xtraceAssign writes the trace of an assignment for the xtrace option.
+func (r *Runner) xtraceAssign(as *syntax.Assign, vr expand.Variable) {
+	var buf strings.Builder
+	buf.WriteString(as.Name.Value)
+	if as.Index != nil {
+		buf.WriteByte('[')
+		syntax.NewPrinter().Print(&buf, as.Index)
+		buf.WriteByte(']')
+	}
+	buf.WriteByte('=')
+	switch vr.Kind {
+	case expand.Indexed:
+		buf.WriteByte('(')
+		for i, elem := range vr.List {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			buf.WriteString(xtraceQuote(elem))
+		}
+		buf.WriteByte(')')
+	case expand.Associative:
+		buf.WriteByte('(')
+		keys := make([]string, 0, len(vr.Map))
+		for key := range vr.Map {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			fmt.Fprintf(&buf, "[%s]=%s", xtraceQuote(key), xtraceQuote(vr.Map[key]))
+		}
+		buf.WriteByte(')')
+	default:
+		buf.WriteString(xtraceQuote(vr.Str))
+	}
+	r.xtraceLine(buf.String())
+}
+
+// xtraceTest writes the trace of a single test within [[ ]], with its operands
+// already expanded, if the xtrace option is set. Like in Bash, the tests of the
+// classic test builtin aren't traced, as the command itself is.
+func (r *Runner) xtraceTest(classic, negated bool, fields ...string) {
+	if classic || !r.opts[optXTrace] {
+		return
+	}
+	var buf strings.Builder
+	buf.WriteString("[[ ")
+	if negated {
+		buf.WriteString("! ")
+	}
+	for _, field := range fields {
+		if field == "" {
+			field = "''"
+		}
+		buf.WriteString(field)
+		buf.WriteByte(' ')
+	}
+	buf.WriteString("]]")
+	r.xtraceLine(buf.String())
+}
+
+// xtraceFor writes the trace of the header of a for loop, which Bash writes
+// before each iteration, with its words as they were written.
+func (r *Runner) xtraceFor(wi *syntax.WordIter) {
+	var buf strings.Builder
+	buf.WriteString("for ")
+	buf.WriteString(wi.Name.Value)
+	buf.WriteString(" in")
+	if !wi.InPos.IsValid() {
+		buf.WriteString(` "$@"`)
+	}
+	printer := syntax.NewPrinter()
+	for _, word := range wi.Items {
+		buf.WriteByte(' ')
+		printer.Print(&buf, word)
+	}
+	r.xtraceLine(buf.String())
+}
+
+// xtraceDecl writes the trace of a declaration clause like "declare -a x=(a)",
+// given its fields with their values expanded and the variables it sets. Like
+// in Bash, the arrays are traced as assignments before the clause, without
+// their values in it, and export and readonly also trace the assignments of
+// strings after the clause.
+func (r *Runner) xtraceDecl(variant string, fields []string, vars []declVar) {
+	for _, v := range vars {
+		if v.as.Array == nil {
+			continue
+		}
+		var buf strings.Builder
+		buf.WriteString(v.as.Name.Value)
+		buf.WriteString("=(")
+		switch v.vr.Kind {
+		case expand.Indexed:
+			for i, elem := range v.vr.List {
+				if i > 0 {
+					buf.WriteByte(' ')
+				}
+				buf.WriteString(sglQuote(elem))
+			}
+		case expand.Associative:
+			keys := make([]string, 0, len(v.vr.Map))
+			for key := range v.vr.Map {
+				keys = append(keys, key)
+			}
+			sort.Strings(keys)
+			for i, key := range keys {
+				if i > 0 {
+					buf.WriteByte(' ')
+				}
+				fmt.Fprintf(&buf, "[%s]=%s", sglQuote(key), sglQuote(v.vr.Map[key]))
+			}
+		}
+		buf.WriteByte(')')
+		r.xtraceLine(buf.String())
+	}
+	r.xtrace(fields)
+	if variant != "export" && variant != "readonly" {
+		return
+	}
+	for _, v := range vars {
+		if !v.as.Naked && v.as.Array == nil {
+			r.xtraceAssign(v.as, v.vr)
+		}
+	}
+}
+
+// xtraceArithmCmd writes the trace of an arithmetic command like "((x + 1))".
+// Like in Bash, the spaces around the expression are kept, and another space
+// is added on each side.
+func (r *Runner) xtraceArithmCmd(x *syntax.ArithmCmd) {
+	var buf strings.Builder
+	spaces := func(from, to syntax.Pos) {
+		if from.Line() == to.Line() && to.Offset() > from.Offset() {
+			buf.WriteString(strings.Repeat(" ", int(to.Offset()-from.Offset())))
+		}
+	}
+	// The expression starts after "((", and ends before "))".
+	start := syntax.NewPos(x.Left.Offset()+2, x.Left.Line(), x.Left.Col()+2)
+	buf.WriteString("(( ")
+	if x.X == nil {
+		spaces(start, x.Right)
+	} else {
+		spaces(start, x.X.Pos())
+		syntax.NewPrinter().Print(&buf, r.xtraceArithm(x.X))
+		spaces(x.X.End(), x.Right)
+	}
+	buf.WriteString(" ))")
+	r.xtraceLine(buf.String())
+}
+
+// xtraceLet writes the trace of a let clause. Its expressions are printed
+// without spaces, and those which are words are expanded like the fields of a
+// simple command.
+func (r *Runner) xtraceLet(x *syntax.LetClause) {
+	fields := []string{"let"}
+	printer := syntax.NewPrinter(syntax.Minify(true))
+	for _, expr := range x.Exprs {
+		if word, ok := expr.(*syntax.Word); ok {
+			if value, ok := r.xtraceWord(word, false); ok {
+				fields = append(fields, value)
+				continue
+			}
+		}
+		var buf strings.Builder
+		printer.Print(&buf, r.xtraceArithm(expr))
+		fields = append(fields, buf.String())
+	}
+	r.xtrace(fields)
+}
+
+// xtraceCase writes the trace of the start of a case clause, with its word as
+// it was written.
+func (r *Runner) xtraceCase(x *syntax.CaseClause) {
+	var buf strings.Builder
+	buf.WriteString("case ")
+	syntax.NewPrinter().Print(&buf, x.Word)
+	buf.WriteString(" in")
+	r.xtraceLine(buf.String())
+}
+
+// xtraceArithm returns a copy of an arithmetic expression for its trace, with
+// the words which have parameter expansions replaced by their values, like in
+// Bash.
+func (r *Runner) xtraceArithm(expr syntax.ArithmExpr) syntax.ArithmExpr {
+	switch x := expr.(type) {
+	case *syntax.BinaryArithm:
+		x2 := *x
+		x2.X, x2.Y = r.xtraceArithm(x.X), r.xtraceArithm(x.Y)
+		return &x2
+	case *syntax.UnaryArithm:
+		x2 := *x
+		x2.X = r.xtraceArithm(x.X)
+		return &x2
+	case *syntax.ParenArithm:
+		x2 := *x
+		x2.X = r.xtraceArithm(x.X)
+		return &x2
+	case *syntax.Word:
+		if value, ok := r.xtraceWord(x, true); ok {
+			lit := &syntax.Lit{ValuePos: x.Pos(), ValueEnd: x.End(), Value: value}
+			return &syntax.Word{Parts: []syntax.WordPart{lit}}
+		}
+	}
+	return expr
+}
+
+// xtraceWord returns the expanded value of a word for a trace, as long as it
+// can be expanded again without side effects, unlike command substitutions.
+// If params is true, only words with parameter expansions are expanded.
+func (r *Runner) xtraceWord(word *syntax.Word, params bool) (string, bool) {
+	hasParams, safe := false, true
+	syntax.Walk(word, func(node syntax.Node) bool {
+		switch x := node.(type) {
+		case *syntax.CmdSubst, *syntax.ArithmExp, *syntax.ProcSubst:
+			safe = false
+		case *syntax.ParamExp:
+			if x.Exp != nil {
+				switch x.Exp.Op {
+				case syntax.AssignUnset, syntax.AssignUnsetOrNull,
+					syntax.ErrorUnset, syntax.ErrorUnsetOrNull:
+					safe = false
+				}
+			}
+			// "a[1]" in arithmetic is a variable, not an expansion
+			if !x.Short || x.Index == nil {
+				hasParams = true
+			}
+		}
+		return safe
+	})
+	if !safe || (params && !hasParams) {
+		return "", false
+	}
+	return r.literal(word), true
+}
+
+// xtraceLine writes a line of the trace, prefixed by the expansion of PS4. Its
+// first character is repeated once per level of nesting, such as in command
+// substitutions.
+func (r *Runner) xtraceLine(line string) {
+	var buf strings.Builder
+	if ps4 := r.envGet("PS4"); ps4 != "" {
+		ps4 = ExpandPrompt(r, ps4)
+		if first, size := utf8.DecodeRuneInString(ps4); size > 0 {
+			for i := 0; i < r.xtraceLevel; i++ {
+				buf.WriteRune(first)
+			}
+		}
+		buf.WriteString(ps4)
+	}
+	buf.WriteString(line)
+	buf.WriteByte('\n')
+	io.WriteString(r.xtraceOutput(), buf.String())
+}
+
+// xtraceQuote quotes a field like Bash does in its trace: as it is if it has
+// no special characters, with $'...' if it has non-printable characters, and with
+// single quotes otherwise.
+func xtraceQuote(s string) string {
+	if s == "" {
+		return "''"
+	}
+	if !utf8.ValidString(s) {
+		return ansiQuote(s)
+	}
+	special := false
+	for i, c := range s {
+		switch {
+		case c == '\t' || c == '\n':
+			special = true
+		case c < 0x20 || c == 0x7f || !unicode.IsPrint(c):
+			return ansiQuote(s)
+		case strings.ContainsRune(" '\"\\|&;()<>!{}*[?]^$`", c):
+			special = true
+		case c == '~' && (i == 0 || s[i-1] == '=' || s[i-1] == ':'):
+			special = true
+		case c == '#' && i == 0:
+			special = true
+		}
+	}
+	if !special {
+		return s
+	}
+	return sglQuote(s)
+}
+
+// sglQuote quotes a string with single quotes.
+func sglQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// ansiQuote quotes a string with $'...', using backslash escapes for the
+// non-printable characters and octal escapes for any other invalid bytes.
+func ansiQuote(s string) string {
+	var buf strings.Builder
+	buf.WriteString("$'")
+	for i := 0; i < len(s); {
+		c, size := utf8.DecodeRuneInString(s[i:])
+		switch c {
+		case '\a':
+			buf.WriteString(`\a`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\x1b':
+			buf.WriteString(`\E`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\v':
+			buf.WriteString(`\v`)
+		case '\\', '\'':
+			buf.WriteByte('\\')
+			buf.WriteRune(c)
+		default:
+			if c < 0x20 || c == 0x7f || (c == utf8.RuneError && size == 1) || !unicode.IsPrint(c) {
+				for j := i; j < i+size; j++ {
+					fmt.Fprintf(&buf, "\\%03o", s[j])
+				}
+			} else {
+				buf.WriteString(s[i : i+size])
+			}
+		}
+		i += size
+	}
+	buf.WriteByte('\'')
+	return buf.String()
+}
@@ -4,10 +4,15 @@
 package interp
 
 import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
 	"os"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"mvdan.cc/sh/v3/expand"
 	"mvdan.cc/sh/v3/syntax"
@@ -38,7 +43,109 @@ func (o overlayEnviron) Each(f func(name string, vr expand.Variable) bool) {
 	}
 }
 
+// handlerEnviron is the environment given to handlers. It is made of the
+// runner's cached variables, plus a few values set only for the command being
+// run, such as the ones in "FOO=bar prog".
+type handlerEnviron struct {
+	overlayEnviron
+
+	// exec and execIdx are the cached list of exported variables of
+	// the parent environment; see envCache.
+	exec    []string
+	execIdx map[string]int
+}
+
+// envCache holds what the handlers see of the variables in Env, Vars and
+// funcVars, so that it isn't built again for every command. environ is
+// cleared whenever any variable changes, and exec only when an exported
+// variable does.
+//
+// Both are read-only once built, so they can be shared with subshells.
+type envCache struct {
+	environ expand.Environ
+
+	// exec is the list of exported variables as "name=value", sorted by
+	// name, and execIdx holds the index of each name in the list.
+	exec    []string
+	execIdx map[string]int
+	execOK  bool
+}
+
+// varsChanged clears the cached environment after a change to the variables.
+// exported is whether the change may affect the exported variables.
+func (r *Runner) varsChanged(exported bool) {
+	r.envCache.environ = nil
+	if exported {
+		r.envCache.exec, r.envCache.execIdx, r.envCache.execOK = nil, nil, false
+	}
+}
+
+func (r *Runner) cachedEnviron() expand.Environ {
+	if r.envCache.environ == nil {
+		oenv := overlayEnviron{
+			parent: r.Env,
+			values: make(map[string]expand.Variable, len(r.Vars)+len(r.funcVars)),
+		}
+		for name, vr := range r.Vars {
+			oenv.Set(name, vr)
+		}
+		for name, vr := range r.funcVars {
+			oenv.Set(name, vr)
+		}
+		r.envCache.environ = oenv
+	}
+	return r.envCache.environ
+}
+
+func (r *Runner) cachedExecEnv() ([]string, map[string]int) {
+	if !r.envCache.execOK {
+		values := make(map[string]string)
+		r.cachedEnviron().Each(func(name string, vr expand.Variable) bool {
+			// Later values win, like they do in os/exec.
+			if _, ok := funcEnvName(name); ok {
+				// added below, if still exported
+				return true
+			}
+			if vr.Exported {
+				values[name] = vr.String()
+			}
+			return true
+		})
+		for name := range r.exportedFuncs {
+			if body := r.Funcs[name]; body != nil {
+				values[funcEnvPrefix+name+funcEnvSuffix] = funcEnvValue(body)
+			}
+		}
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		list := make([]string, len(names))
+		idx := make(map[string]int, len(names))
+		for i, name := range names {
+			list[i] = name + "=" + values[name]
+			idx[name] = i
+		}
+		r.envCache.exec, r.envCache.execIdx, r.envCache.execOK = list, idx, true
+	}
+	return r.envCache.exec, r.envCache.execIdx
+}
+
+// hasExported reports whether any of the variables is exported.
+func hasExported(vars map[string]expand.Variable) bool {
+	for _, vr := range vars {
+		if vr.Exported {
+			return true
+		}
+	}
+	return false
+}
+
 func execEnv(env expand.Environ) []string {
+	if he, ok := env.(handlerEnviron); ok {
+		return he.execEnv()
+	}
 	list := make([]string, 0, 64)
 	env.Each(func(name string, vr expand.Variable) bool {
 		if vr.Exported {
@@ -49,6 +156,30 @@ func execEnv(env expand.Environ) []string {
 	return list
 }
 
+// execEnv returns the exported variables as "name=value", applying the values
+// set only for this command on top of the cached list without building it
+// again. The returned slice must not be modified.
+func (e handlerEnviron) execEnv() []string {
+	if len(e.values) == 0 {
+		return e.exec
+	}
+	list := append([]string(nil), e.exec...)
+	var added []string
+	for name, vr := range e.values {
+		if !vr.Exported {
+			continue
+		}
+		kv := name + "=" + vr.String()
+		if i, ok := e.execIdx[name]; ok {
+			list[i] = kv
+		} else {
+			added = append(added, kv)
+		}
+	}
+	sort.Strings(added)
+	return append(list, added...)
+}
+
 func (r *Runner) lookupVar(name string) expand.Variable {
 	if name == "" {
 		panic("variable name must not be empty")
@@ -63,13 +194,21 @@ func (r *Runner) lookupVar(name string) expand.Variable {
 		vr.Kind, vr.Str = expand.String, strconv.Itoa(r.exit)
 	case "$":
 		vr.Kind, vr.Str = expand.String, strconv.Itoa(os.Getpid())
+	case "!":
+		if r.lastBgJob != nil {
+			vr.Kind, vr.Str = expand.String, strconv.Itoa(r.lastBgJob.processID())
+		}
 	case "PPID":
 		vr.Kind, vr.Str = expand.String, strconv.Itoa(os.Getppid())
+	case "RANDOM", "SRANDOM", "SECONDS", "EPOCHSECONDS", "EPOCHREALTIME":
+		vr = r.dynamicVar(name)
 	case "DIRSTACK":
 		vr.Kind, vr.List = expand.Indexed, r.dirStack
 	case "0":
 		vr.Kind = expand.String
-		if r.filename != "" {
+		if r.shellName != "" {
+			vr.Str = r.shellName
+		} else if r.filename != "" {
 			vr.Str = r.filename
 		} else {
 			vr.Str = "gosh"
@@ -113,6 +252,115 @@ func (r *Runner) lookupVar(name string) expand.Variable {
 	return expand.Variable{}
 }
 
+// maxNameRefDepth is the maximum number of nameref variables to follow when
+// resolving a variable, as they may form a loop.
+const maxNameRefDepth = 100
+
+// resolveVar follows the nameref variables starting at name, returning the
+// name and value of the variable which they refer to. ok is false if the
+// references form a loop.
+//
+// A nameref which doesn't refer to any variable yet, as with "declare -n ref",
+// is returned as is.
+func (r *Runner) resolveVar(name string) (_ string, _ expand.Variable, ok bool) {
+	vr := r.lookupVar(name)
+	for i := 0; i < maxNameRefDepth; i++ {
+		if vr.Kind != expand.NameRef || vr.Str == "" {
+			return name, vr, true
+		}
+		name = vr.Str
+		vr = r.lookupVar(name)
+	}
+	return name, expand.Variable{}, false
+}
+
+// nameRefLoops reports whether the nameref variables starting at name form a
+// loop. Unlike resolveVar, it has no side effects like errors due to nounset,
+// as only the variables set by the program may be namerefs.
+func (r *Runner) nameRefLoops(name string) bool {
+	for i := 0; i < maxNameRefDepth; i++ {
+		if _, ok := r.cmdVars[name]; ok {
+			return false
+		}
+		vr, ok := r.funcVars[name]
+		if !ok {
+			vr, ok = r.Vars[name]
+		}
+		if !ok {
+			vr = r.Env.Get(name)
+		}
+		if vr.Kind != expand.NameRef || vr.Str == "" {
+			return false
+		}
+		name = vr.Str
+	}
+	return true
+}
+
+// isDynamic reports whether a variable is one of those whose value changes by
+// itself, like RANDOM, and whether it still has that special meaning. As in
+// Bash, local variables and unsetting the variable turn it off.
+func (r *Runner) isDynamic(name string) bool {
+	switch name {
+	case "RANDOM", "SRANDOM", "SECONDS", "EPOCHSECONDS", "EPOCHREALTIME":
+	default:
+		return false
+	}
+	if _, ok := r.funcVars[name]; ok {
+		return false
+	}
+	return !r.dynamicOff[name]
+}
+
+// dynamicVar returns the current value of a dynamic variable, or an unset
+// variable if it has lost its special meaning.
+func (r *Runner) dynamicVar(name string) expand.Variable {
+	if !r.isDynamic(name) {
+		return expand.Variable{}
+	}
+	vr := expand.Variable{Kind: expand.String}
+	switch name {
+	case "RANDOM":
+		vr.Str = strconv.Itoa(r.rand.Intn(32768))
+	case "SRANDOM":
+		var b [4]byte
+		crand.Read(b[:])
+		vr.Str = strconv.FormatUint(uint64(binary.BigEndian.Uint32(b[:])), 10)
+	case "SECONDS":
+		vr.Str = strconv.FormatInt(int64(r.now().Sub(r.secondsStart)/time.Second), 10)
+	case "EPOCHSECONDS":
+		vr.Str = strconv.FormatInt(r.now().Unix(), 10)
+	case "EPOCHREALTIME":
+		now := r.now()
+		vr.Str = fmt.Sprintf("%d.%06d", now.Unix(), now.Nanosecond()/1000)
+	}
+	return vr
+}
+
+// setDynamicVar handles an assignment to a dynamic variable, reporting whether
+// it did. Assigning to RANDOM seeds it, assigning to SECONDS sets the number
+// of seconds it counts from, and assignments to the others are ignored.
+func (r *Runner) setDynamicVar(name string, vr expand.Variable) bool {
+	if vr.Local || vr.Kind != expand.String || !r.isDynamic(name) {
+		return false
+	}
+	switch name {
+	case "RANDOM":
+		r.rand.Seed(int64(atoi(vr.Str)))
+	case "SECONDS":
+		r.secondsStart = r.now().Add(-time.Duration(atoi(vr.Str)) * time.Second)
+	}
+	return true
+}
+
+// now returns the current time, as given by SystemInfo if it was used.
+func (r *Runner) now() time.Time {
+	if r.hostInfo != nil && r.hostInfo.Now != nil {
+		return r.hostInfo.Now()
+	}
+	return time.Now()
+}
+
 func (r *Runner) envGet(name string) string {
 	return r.lookupVar(name).String()
 }
@@ -124,12 +372,22 @@ func (r *Runner) delVar(name string) {
 		r.exit = 1
 		return
 	}
+	r.varsChanged(vr.Exported)
 	if vr.Local {
 		// don't overwrite a non-local var with the same name
 		r.funcVars[name] = expand.Variable{}
 	} else {
+		if r.isDynamic(name) {
+			if r.dynamicOff == nil {
+				r.dynamicOff = make(map[string]bool)
+			}
+			r.dynamicOff[name] = true
+		}
 		r.Vars[name] = expand.Variable{} // to not query r.Env
 	}
+	if name == "BASH_XTRACEFD" {
+		r.xtraceFdChanged()
+	}
 }
 
 func (r *Runner) setVarString(name, value string) {
@@ -137,6 +395,9 @@ func (r *Runner) setVarString(name, value string) {
 }
 
 func (r *Runner) setVarInternal(name string, vr expand.Variable) {
+	if r.setDynamicVar(name, vr) {
+		return
+	}
 	if vr.Kind == expand.String {
 		if r.opts[optAllExport] {
 			vr.Exported = true
@@ -148,23 +409,45 @@ func (r *Runner) setVarInternal(name string, vr expand.Variable) {
 		if r.funcVars == nil {
 			r.funcVars = make(map[string]expand.Variable)
 		}
+		r.varsChanged(vr.Exported || r.funcVars[name].Exported)
 		r.funcVars[name] = vr
 	} else {
+		r.varsChanged(vr.Exported || r.Vars[name].Exported)
 		r.Vars[name] = vr
 	}
+	if name == "BASH_XTRACEFD" {
+		r.xtraceFdChanged()
+	}
 }
 
 func (r *Runner) setVar(name string, index syntax.ArithmExpr, vr expand.Variable) {
 	cur := r.lookupVar(name)
+	if vr.Kind != expand.NameRef {
+		// Assigning to a nameref assigns to the variable it refers
+		// to, which keeps its own scope.
+		name2, cur2, ok := r.resolveVar(name)
+		if !ok {
+			r.errf("warning: %s: circular name reference\n", name)
+			r.exit = 1
+			return
+		}
+		if cur.Kind == expand.NameRef && cur.Str == "" && index == nil {
+			// "declare -n ref; ref=name" sets what ref refers to.
+			if !r.validNameRef(name, vr.Str) {
+				return
+			}
+			cur.Str = vr.Str
+			vr = cur
+		} else if name2 != name {
+			name, cur = name2, cur2
+			vr.Local = cur.Local
+		}
+	}
 	if cur.ReadOnly {
 		r.errf("%s: readonly variable\n", name)
 		r.exit = 1
 		return
 	}
-	if name2, var2 := cur.Resolve(r.Env); name2 != "" {
-		name = name2
-		cur = var2
-	}
 
 	if vr.Kind == expand.String && index == nil {
 		// When assigning a string to an array, fall back to the
@@ -222,6 +505,99 @@ func (r *Runner) setFunc(name string, body *syntax.Stmt) {
 		r.Funcs = make(map[string]*syntax.Stmt, 4)
 	}
 	r.Funcs[name] = body
+	if r.exportedFuncs[name] {
+		r.varsChanged(true)
+	}
+}
+
+// delFunc removes a function, which is no longer exported either.
+func (r *Runner) delFunc(name string) {
+	delete(r.Funcs, name)
+	if r.exportedFuncs[name] {
+		delete(r.exportedFuncs, name)
+		r.varsChanged(true)
+	}
+}
+
+// exportFunc marks a function as exported, like "export -f name". Its
+// definition is then passed to the programs run by the shell via an
+// environment variable, like Bash does.
+func (r *Runner) exportFunc(name string) {
+	if r.exportedFuncs == nil {
+		r.exportedFuncs = make(map[string]bool, 4)
+	}
+	r.exportedFuncs[name] = true
+	r.varsChanged(true)
+}
+
+// The environment variable for an exported function is named like
+// "BASH_FUNC_name%%", and its value is like "() { body; }".
+const (
+	funcEnvPrefix = "BASH_FUNC_"
+	funcEnvSuffix = "%%"
+)
+
+// funcEnvName returns the name of the function exported via the environment
+// variable called name, if it is one.
+func funcEnvName(name string) (string, bool) {
+	if len(name) <= len(funcEnvPrefix)+len(funcEnvSuffix) ||
+		!strings.HasPrefix(name, funcEnvPrefix) || !strings.HasSuffix(name, funcEnvSuffix) {
+		return "", false
+	}
+	return name[len(funcEnvPrefix) : len(name)-len(funcEnvSuffix)], true
+}
+
+// funcEnvValue returns the value of the environment variable exporting a
+// function with the given body.
+func funcEnvValue(body *syntax.Stmt) string {
+	var buf strings.Builder
+	buf.WriteString("() ")
+	syntax.NewPrinter().Print(&buf, body)
+	return buf.String()
+}
+
+// importFuncs defines and exports the functions exported via the environment,
+// like Bash does when it starts.
+//
+// A definition is only accepted if it parses as exactly one function
+// declaration with the expected name and nothing else, so that no code in the
+// environment is ever run by just starting the shell. Other definitions are
+// ignored with a warning.
+func (r *Runner) importFuncs() {
+	r.Env.Each(func(name string, vr expand.Variable) bool {
+		fname, ok := funcEnvName(name)
+		if !ok || vr.Kind != expand.String {
+			return true
+		}
+		body := parseFuncEnv(fname, vr.Str)
+		if body == nil {
+			r.errf("warning: %s: ignoring function definition attempt\n", fname)
+			return true
+		}
+		r.setFunc(fname, body)
+		r.exportFunc(fname)
+		return true
+	})
+}
+
+// parseFuncEnv parses the value of an environment variable exporting the
+// function name, returning the function's body, or nil if the value isn't a
+// single definition of that function.
+func parseFuncEnv(name, value string) *syntax.Stmt {
+	if !strings.HasPrefix(value, "() ") {
+		return nil
+	}
+	file, err := syntax.NewParser().Parse(strings.NewReader(name+" "+value), "")
+	if err != nil || len(file.Stmts) != 1 {
+		return nil
+	}
+	st := file.Stmts[0]
+	fd, ok := st.Cmd.(*syntax.FuncDecl)
+	if !ok || fd.Name.Value != name || st.Negated || st.Background ||
+		st.Coprocess || len(st.Redirs) > 0 {
+		return nil
+	}
+	return fd.Body
 }
 
 func stringIndex(index syntax.ArithmExpr) bool {
@@ -236,13 +612,43 @@ func stringIndex(index syntax.ArithmExpr) bool {
 	return false
 }
 
+// validNameRef reports whether a nameref variable may refer to the given name,
+// printing an error otherwise.
+func (r *Runner) validNameRef(name, target string) bool {
+	switch {
+	case !syntax.ValidName(target):
+		r.errf("%q: invalid variable name for name reference\n", target)
+	case target == name:
+		r.errf("%s: nameref variable self references not allowed\n", name)
+	default:
+		return true
+	}
+	r.exit = 1
+	return false
+}
+
 func (r *Runner) assignVal(as *syntax.Assign, valType string) expand.Variable {
 	prev := r.lookupVar(as.Name.Value)
 	if as.Naked {
+		if valType == "-n" {
+			// "declare -n ref" turns ref into a nameref, referring
+			// to the variable named by its value if it has one.
+			switch prev.Kind {
+			case expand.Unset, expand.String:
+				prev.Kind = expand.NameRef
+			}
+		}
 		return prev
 	}
+	if valType != "-n" && prev.Kind == expand.NameRef {
+		// build the new value from the variable being referenced
+		_, prev, _ = r.resolveVar(as.Name.Value)
+		if prev.Kind == expand.NameRef {
+			prev = expand.Variable{} // "declare -n ref" with no target
+		}
+	}
 	if as.Value != nil {
-		s := r.literal(as.Value)
+		s := r.assignWord(as.Value)
 		if !as.Append || !prev.IsSet() {
 			prev.Kind = expand.String
 			if valType == "-n" {
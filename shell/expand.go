@@ -24,15 +24,26 @@ import (
 //
 // An error will be reported if the input string had invalid syntax.
 func Expand(s string, env func(string) string) (string, error) {
+	if env == nil {
+		env = os.Getenv
+	}
+	return ExpandWithConfig(s, &expand.Config{Env: expand.FuncEnviron(env)})
+}
+
+// ExpandWithConfig is like Expand, but it uses an expansion config, which gives
+// control over the environment, globbing, and substitutions. A nil config
+// behaves like an empty one; see expand.Config.
+//
+// Command and process substitutions aren't run unless cfg.CmdSubst and
+// cfg.ProcSubst are set, so that untrusted input can be expanded safely.
+// Encountering one results in an expand.UnexpectedCommandError, which includes
+// its position. To expand them to nothing instead, use funcs which do nothing.
+func ExpandWithConfig(s string, cfg *expand.Config) (string, error) {
 	p := syntax.NewParser()
 	word, err := p.Document(strings.NewReader(s))
 	if err != nil {
 		return "", err
 	}
-	if env == nil {
-		env = os.Getenv
-	}
-	cfg := &expand.Config{Env: expand.FuncEnviron(env)}
 	return expand.Document(cfg, word)
 }
 
@@ -46,6 +57,16 @@ func Expand(s string, env func(string) string) (string, error) {
 //
 // An error will be reported if the input string had invalid syntax.
 func Fields(s string, env func(string) string) ([]string, error) {
+	if env == nil {
+		env = os.Getenv
+	}
+	return FieldsWithConfig(s, &expand.Config{Env: expand.FuncEnviron(env)})
+}
+
+// FieldsWithConfig is like Fields, but it uses an expansion config, just like
+// ExpandWithConfig. Globbing is only done if cfg.ReadDir is set, and relative
+// paths are globbed from the directory in the PWD variable.
+func FieldsWithConfig(s string, cfg *expand.Config) ([]string, error) {
 	p := syntax.NewParser()
 	var words []*syntax.Word
 	err := p.Words(strings.NewReader(s), func(w *syntax.Word) bool {
@@ -55,9 +76,5 @@ func Fields(s string, env func(string) string) ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
-	if env == nil {
-		env = os.Getenv
-	}
-	cfg := &expand.Config{Env: expand.FuncEnviron(env)}
 	return expand.Fields(cfg, words...)
 }
@@ -5,11 +5,17 @@ package shell
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
 	"strings"
 	"testing"
+
+	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/syntax"
 )
 
 func strEnviron(pairs ...string) func(string) string {
@@ -77,6 +83,76 @@ func TestUnexpectedCmdSubst(t *testing.T) {
 	}
 }
 
+func TestExpandWithConfigInjection(t *testing.T) {
+	t.Parallel()
+	// A template and its variables come from an untrusted source.
+	env := expand.ListEnviron("name=$(touch pwned)", "file=<(cat /etc/passwd)")
+	got, err := ExpandWithConfig("Hello $name, see ${file}!", &expand.Config{Env: env})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "Hello $(touch pwned), see <(cat /etc/passwd)!"; got != want {
+		t.Fatalf("\nwant: %q\ngot:  %q", want, got)
+	}
+
+	for _, tc := range []struct {
+		in, want string
+	}{
+		{"Hello $(touch pwned)", "unexpected command substitution at 1:7"},
+		{"Hello `touch pwned`", "unexpected command substitution at 1:7"},
+		{"${name:-$(touch pwned)}", "unexpected command substitution at 1:9"},
+		{"x <(touch pwned)", "unexpected process substitution at 1:3"},
+	} {
+		_, err := FieldsWithConfig(tc.in, &expand.Config{Env: env})
+		uerr, ok := err.(expand.UnexpectedCommandError)
+		if !ok {
+			t.Fatalf("%q: want an UnexpectedCommandError, got %v", tc.in, err)
+		}
+		if got := uerr.Error(); got != tc.want {
+			t.Fatalf("%q: want error %q, got %q", tc.in, tc.want, got)
+		}
+	}
+
+	// Substitutions can also be expanded to nothing.
+	cfg := &expand.Config{
+		Env:       env,
+		CmdSubst:  func(io.Writer, *syntax.CmdSubst) error { return nil },
+		ProcSubst: func(*syntax.ProcSubst) (string, error) { return "", nil },
+	}
+	got, err = ExpandWithConfig("a$(touch pwned)b", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "ab"; got != want {
+		t.Fatalf("\nwant: %q\ngot:  %q", want, got)
+	}
+}
+
+func TestFieldsWithConfigGlob(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "shell-glob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"a.go", "b.go", "c.txt"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cfg := &expand.Config{
+		Env:     expand.ListEnviron("PWD=" + dir),
+		ReadDir: ioutil.ReadDir,
+	}
+	got, err := FieldsWithConfig("*.go '*.go'", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a.go", "b.go", "*.go"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("\nwant: %q\ngot:  %q", want, got)
+	}
+}
+
 var fieldsTests = []struct {
 	in   string
 	env  func(name string) string
@@ -41,7 +41,17 @@ func SourceFile(ctx context.Context, path string) (map[string]expand.Variable, e
 // code. Untrusted shell programs shoudn't be sourced outside of a sandbox
 // environment.
 func SourceNode(ctx context.Context, node syntax.Node) (map[string]expand.Variable, error) {
-	r, _ := interp.New()
+	return SourceNodeWithOptions(ctx, node)
+}
+
+// SourceNodeWithOptions is like SourceNode, but it builds the interpreter with
+// the given options, such as interp.Env, interp.Dir, or interp.ExecHandler to
+// control which programs can be run.
+func SourceNodeWithOptions(ctx context.Context, node syntax.Node, opts ...interp.RunnerOption) (map[string]expand.Variable, error) {
+	r, err := interp.New(opts...)
+	if err != nil {
+		return nil, err
+	}
 	if err := r.Run(ctx, node); err != nil {
 		return nil, fmt.Errorf("could not run: %v", err)
 	}
@@ -53,5 +63,6 @@ func SourceNode(ctx context.Context, node syntax.Node) (map[string]expand.Variab
 	delete(r.Vars, "PATH")
 	delete(r.Vars, "IFS")
 	delete(r.Vars, "OPTIND")
+	delete(r.Vars, "PS4")
 	return r.Vars, nil
 }
@@ -13,6 +13,7 @@ import (
 	"testing"
 
 	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/interp"
 	"mvdan.cc/sh/v3/syntax"
 
 	"github.com/kr/pretty"
@@ -96,6 +97,42 @@ func TestSourceNodeErr(t *testing.T) {
 	}
 }
 
+func TestSourceNodeWithOptions(t *testing.T) {
+	t.Parallel()
+	file, err := syntax.NewParser().Parse(strings.NewReader("a=$(uname); b=$FOO"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var refused []string
+	exec := func(ctx context.Context, args []string) error {
+		refused = append(refused, args[0])
+		return fmt.Errorf("refusing to run %q", args[0])
+	}
+	if _, err := SourceNodeWithOptions(context.Background(), file, interp.ExecHandler(exec)); err == nil {
+		t.Fatal("wanted non-nil error")
+	}
+	if want := []string{"uname"}; !reflect.DeepEqual(refused, want) {
+		t.Fatalf("want refused %q, got %q", want, refused)
+	}
+
+	exec = func(ctx context.Context, args []string) error {
+		fmt.Fprint(interp.HandlerCtx(ctx).Stdout, "fake")
+		return nil
+	}
+	got, err := SourceNodeWithOptions(context.Background(), file,
+		interp.Env(expand.ListEnviron("FOO=bar")), interp.ExecHandler(exec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]expand.Variable{
+		"a": {Kind: expand.String, Str: "fake"},
+		"b": {Kind: expand.String, Str: "bar"},
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatal(strings.Join(pretty.Diff(want, got), "\n"))
+	}
+}
+
 func TestSourceFileContext(t *testing.T) {
 	t.Parallel()
 	tf, err := ioutil.TempFile("", "sh-shell")
@@ -0,0 +1,318 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// An ApplyFunc is invoked by Apply for each node, before and after the node's
+// children are traversed. See Apply for the meaning of its result.
+type ApplyFunc func(*Cursor) bool
+
+// Apply traverses a syntax tree recursively in the same order as Walk,
+// starting with root, and calling pre and post for each node. Either of them
+// may be nil.
+//
+// If pre is not nil, it is called for each node before its children are
+// traversed. If it returns false, the children and the call to post are
+// skipped. If post is not nil and returns false, the traversal is stopped and
+// Apply returns immediately.
+//
+// Unlike Walk, Apply lets pre and post modify the tree via the Cursor, such as
+// replacing the current node or inserting statements next to it. Comments are
+// not visited.
+//
+// The modified tree is returned; it is root unless root itself was replaced.
+// As with any modification, the parents recorded via KeepParents are not
+// updated.
+func Apply(root Node, pre, post ApplyFunc) (result Node) {
+	holder := &struct{ Node }{root}
+	a := &application{pre: pre, post: post}
+	defer func() {
+		if r := recover(); r != nil && r != abortApply {
+			panic(r)
+		}
+		result = holder.Node
+	}()
+	a.apply(nil, "", reflect.ValueOf(holder).Elem().Field(0), nil, root)
+	return holder.Node
+}
+
+var abortApply = new(int)
+
+// A Cursor describes a node encountered during Apply, and allows modifying
+// the tree around it. Its methods must only be called within the ApplyFunc
+// it was given to.
+type Cursor struct {
+	parent Node
+	name   string
+	field  reflect.Value // the field holding the node, or the list
+	iter   *iterator     // nil if the node is not in a list
+	node   Node
+}
+
+type iterator struct {
+	index, step int
+}
+
+// Node returns the current node.
+func (c *Cursor) Node() Node { return c.node }
+
+// Parent returns the parent of the current node, or nil if it is the root.
+func (c *Cursor) Parent() Node { return c.parent }
+
+// Name returns the name of the parent's field which contains the current
+// node, such as "Stmts" or "Cmd". Fields of structs which aren't nodes include
+// the struct's field name, such as "Repl.Orig" for a ParamExp. Name returns
+// the empty string for the root node.
+func (c *Cursor) Name() string { return c.name }
+
+// Index returns the index of the current node in the list containing it, such
+// as the statements of a Block, or -1 if it is not part of a list.
+func (c *Cursor) Index() int {
+	if c.iter == nil {
+		return -1
+	}
+	return c.iter.index
+}
+
+// Replace replaces the current node with n, which is then traversed instead.
+// The node must be of a type which fits in the parent's field; Replace panics
+// otherwise. A nil node removes optional fields, such as the Else of an
+// IfClause, but not list elements; use Delete for those.
+func (c *Cursor) Replace(n Node) {
+	v := c.value("Replace", n)
+	if c.iter != nil {
+		c.field.Index(c.iter.index).Set(v)
+	} else {
+		c.field.Set(v)
+	}
+	c.node = n
+}
+
+// Delete deletes the current node from the list containing it. It panics if
+// the node is not part of a list.
+func (c *Cursor) Delete() {
+	list := c.list("Delete")
+	i, n := c.iter.index, list.Len()
+	reflect.Copy(list.Slice(i, n), list.Slice(i+1, n))
+	list.Index(n - 1).Set(reflect.Zero(list.Type().Elem()))
+	list.SetLen(n - 1)
+	c.iter.step--
+}
+
+// InsertAfter inserts n after the current node in the list containing it. It
+// panics if the node is not part of a list. Apply does not traverse n.
+func (c *Cursor) InsertAfter(n Node) {
+	c.insert("InsertAfter", 1, n)
+	c.iter.step++
+}
+
+// InsertBefore inserts n before the current node in the list containing it.
+// It panics if the node is not part of a list. Apply does not traverse n.
+func (c *Cursor) InsertBefore(n Node) {
+	c.insert("InsertBefore", 0, n)
+	c.iter.index++
+}
+
+// insert inserts n in the list at the given offset from the current node.
+func (c *Cursor) insert(method string, offset int, n Node) {
+	list := c.list(method)
+	v := c.value(method, n)
+	i := c.iter.index + offset
+	list.Set(reflect.Append(list, reflect.Zero(list.Type().Elem())))
+	reflect.Copy(list.Slice(i+1, list.Len()), list.Slice(i, list.Len()))
+	list.Index(i).Set(v)
+}
+
+func (c *Cursor) list(method string) reflect.Value {
+	if c.iter == nil {
+		panic(fmt.Sprintf("syntax.Cursor.%s: %T is not part of a list", method, c.node))
+	}
+	return c.field
+}
+
+// value returns n as a value to be stored in the field holding the current
+// node, or in its list.
+func (c *Cursor) value(method string, n Node) reflect.Value {
+	typ := c.field.Type()
+	if c.iter != nil {
+		typ = typ.Elem()
+	}
+	if n == nil {
+		if c.iter != nil {
+			panic(fmt.Sprintf("syntax.Cursor.%s: nil node in a list", method))
+		}
+		return reflect.Zero(typ)
+	}
+	v := reflect.ValueOf(n)
+	if !v.Type().AssignableTo(typ) {
+		panic(fmt.Sprintf("syntax.Cursor.%s: cannot use %T as %s in %T.%s",
+			method, n, typ, c.parent, c.name))
+	}
+	return v
+}
+
+type application struct {
+	pre, post ApplyFunc
+	cursor    Cursor
+	iter      iterator
+}
+
+// field traverses the node in the parent's field of the given name, if any.
+func (a *application) field(parent Node, name string) {
+	a.fieldValue(parent, name, reflect.ValueOf(parent).Elem().FieldByName(name))
+}
+
+func (a *application) fieldValue(parent Node, name string, v reflect.Value) {
+	if v.IsNil() {
+		return
+	}
+	a.apply(parent, name, v, nil, v.Interface().(Node))
+}
+
+// list traverses the nodes in the parent's list field of the given name,
+// allowing them to be deleted and new ones inserted as it goes.
+func (a *application) list(parent Node, name string) {
+	v := reflect.ValueOf(parent).Elem().FieldByName(name)
+	saved := a.iter
+	a.iter.index = 0
+	for a.iter.index < v.Len() {
+		a.iter.step = 1
+		a.apply(parent, name, v, &a.iter, v.Index(a.iter.index).Interface().(Node))
+		a.iter.index += a.iter.step
+	}
+	a.iter = saved
+}
+
+func (a *application) apply(parent Node, name string, field reflect.Value, iter *iterator, node Node) {
+	saved := a.cursor
+	a.cursor = Cursor{parent: parent, name: name, field: field, iter: iter, node: node}
+	defer func() { a.cursor = saved }()
+	if a.pre != nil && !a.pre(&a.cursor) {
+		return
+	}
+
+	switch x := a.cursor.node.(type) {
+	case nil:
+	case *File:
+		a.list(x, "Stmts")
+	case *Comment:
+	case *Stmt:
+		a.field(x, "Cmd")
+		a.list(x, "Redirs")
+	case *Assign:
+		a.field(x, "Name")
+		a.field(x, "Value")
+		a.field(x, "Index")
+		a.field(x, "Array")
+	case *Redirect:
+		a.field(x, "N")
+		a.field(x, "Word")
+		a.field(x, "Hdoc")
+	case *CallExpr:
+		a.list(x, "Assigns")
+		a.list(x, "Args")
+	case *Subshell:
+		a.list(x, "Stmts")
+	case *Block:
+		a.list(x, "Stmts")
+	case *IfClause:
+		a.list(x, "Cond")
+		a.list(x, "Then")
+		a.field(x, "Else")
+	case *WhileClause:
+		a.list(x, "Cond")
+		a.list(x, "Do")
+	case *ForClause:
+		a.field(x, "Loop")
+		a.list(x, "Do")
+	case *WordIter:
+		a.field(x, "Name")
+		a.list(x, "Items")
+	case *CStyleLoop:
+		a.field(x, "Init")
+		a.field(x, "Cond")
+		a.field(x, "Post")
+	case *BinaryCmd:
+		a.field(x, "X")
+		a.field(x, "Y")
+	case *FuncDecl:
+		a.field(x, "Name")
+		a.field(x, "Body")
+	case *Word:
+		a.list(x, "Parts")
+	case *Lit:
+	case *SglQuoted:
+	case *DblQuoted:
+		a.list(x, "Parts")
+	case *CmdSubst:
+		a.list(x, "Stmts")
+	case *ParamExp:
+		a.field(x, "Param")
+		a.field(x, "Index")
+		if x.Repl != nil {
+			repl := reflect.ValueOf(x.Repl).Elem()
+			a.fieldValue(x, "Repl.Orig", repl.FieldByName("Orig"))
+			a.fieldValue(x, "Repl.With", repl.FieldByName("With"))
+		}
+		if x.Exp != nil {
+			a.fieldValue(x, "Exp.Word", reflect.ValueOf(x.Exp).Elem().FieldByName("Word"))
+		}
+	case *ArithmExp:
+		a.field(x, "X")
+	case *ArithmCmd:
+		a.field(x, "X")
+	case *BinaryArithm:
+		a.field(x, "X")
+		a.field(x, "Y")
+	case *BinaryTest:
+		a.field(x, "X")
+		a.field(x, "Y")
+	case *RegexWord:
+		a.field(x, "Word")
+	case *UnaryArithm:
+		a.field(x, "X")
+	case *UnaryTest:
+		a.field(x, "X")
+	case *ParenArithm:
+		a.field(x, "X")
+	case *ParenTest:
+		a.field(x, "X")
+	case *CaseClause:
+		a.field(x, "Word")
+		a.list(x, "Items")
+	case *CaseItem:
+		a.list(x, "Patterns")
+		a.list(x, "Stmts")
+	case *TestClause:
+		a.field(x, "X")
+	case *DeclClause:
+		a.list(x, "Args")
+	case *ArrayExpr:
+		a.list(x, "Elems")
+	case *ArrayElem:
+		a.field(x, "Index")
+		a.field(x, "Value")
+	case *ExtGlob:
+		a.field(x, "Pattern")
+	case *ProcSubst:
+		a.list(x, "Stmts")
+	case *TimeClause:
+		a.field(x, "Stmt")
+	case *CoprocClause:
+		a.field(x, "Name")
+		a.field(x, "Stmt")
+	case *LetClause:
+		a.list(x, "Exprs")
+	default:
+		panic(fmt.Sprintf("syntax.Apply: unexpected node type %T", x))
+	}
+
+	if a.post != nil && !a.post(&a.cursor) {
+		panic(abortApply)
+	}
+}
@@ -0,0 +1,271 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestApplyOrder(t *testing.T) {
+	t.Parallel()
+	parser := NewParser(KeepComments(true), KeepParents(true))
+	for i, c := range fileTests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			f, err := parser.Parse(strings.NewReader(c.Strs[0]), "")
+			if err != nil {
+				// not valid in the default language variant
+				return
+			}
+			var want []Node
+			Walk(f, func(node Node) bool {
+				switch node.(type) {
+				case nil, *Comment:
+				default:
+					want = append(want, node)
+				}
+				return true
+			})
+			var pre, post []Node
+			Apply(f, func(c *Cursor) bool {
+				node := c.Node()
+				if c.Parent() != f.Parent(node) {
+					t.Fatalf("%T has parent %T, want %T", node, c.Parent(), f.Parent(node))
+				}
+				pre = append(pre, node)
+				return true
+			}, func(c *Cursor) bool {
+				post = append(post, c.Node())
+				return true
+			})
+			if len(pre) != len(want) {
+				t.Fatalf("Apply visited %d nodes, Walk visited %d", len(pre), len(want))
+			}
+			for i, node := range want {
+				if pre[i] != node {
+					t.Fatalf("Apply visited %T at %d, Walk visited %T", pre[i], i, node)
+				}
+			}
+			if len(post) != len(pre) {
+				t.Fatalf("post was called %d times, pre %d times", len(post), len(pre))
+			}
+		})
+	}
+}
+
+var applyTests = []struct {
+	in, want string
+	pre      ApplyFunc
+}{
+	{
+		"foo a\nbar foo",
+		"baz a\nbar baz",
+		func(c *Cursor) bool {
+			if l, ok := c.Node().(*Lit); ok && l.Value == "foo" {
+				c.Replace(&Lit{ValuePos: l.ValuePos, ValueEnd: l.ValueEnd, Value: "baz"})
+			}
+			return true
+		},
+	},
+	{
+		"a; debug; { debug; b; }; debug",
+		"a\n{ b; }",
+		func(c *Cursor) bool {
+			if s, ok := c.Node().(*Stmt); ok && strings.HasPrefix(stmtString(s), "debug") {
+				c.Delete()
+				return false
+			}
+			return true
+		},
+	},
+	{
+		"a; b",
+		"x\na\ny\nx\nb\ny",
+		func(c *Cursor) bool {
+			if _, ok := c.Node().(*Stmt); ok && c.Name() == "Stmts" {
+				c.InsertBefore(litStmt("x"))
+				c.InsertAfter(litStmt("y"))
+			}
+			return true
+		},
+	},
+	{
+		"if a; then b; elif c; then d; else e; fi",
+		"if a; then b; fi",
+		func(c *Cursor) bool {
+			if c.Name() == "Else" {
+				c.Replace(nil)
+			}
+			return true
+		},
+	},
+	{
+		// replaced nodes are traversed
+		"a | b",
+		"(\n\tc\n\tb\n)",
+		func(c *Cursor) bool {
+			switch x := c.Node().(type) {
+			case *BinaryCmd:
+				c.Replace(&Subshell{Stmts: []*Stmt{x.X, x.Y}})
+			case *Lit:
+				if x.Value == "a" {
+					c.Replace(lit("c"))
+				}
+			}
+			return true
+		},
+	},
+	{
+		"echo ${a/foo/bar} ${b:-foo}",
+		"echo ${a/x/bar} ${b:-x}",
+		func(c *Cursor) bool {
+			if w, ok := c.Node().(*Word); ok && (c.Name() == "Repl.Orig" || c.Name() == "Exp.Word") {
+				if w.Lit() == "foo" {
+					c.Replace(&Word{Parts: []WordPart{
+						&Lit{ValuePos: w.Pos(), ValueEnd: w.End(), Value: "x"},
+					}})
+				}
+			}
+			return true
+		},
+	},
+}
+
+func stmtString(s *Stmt) string {
+	var buf bytes.Buffer
+	NewPrinter().Print(&buf, s)
+	return buf.String()
+}
+
+func TestApply(t *testing.T) {
+	t.Parallel()
+	for i, tc := range applyTests {
+		t.Run(fmt.Sprintf("%02d", i), func(t *testing.T) {
+			f, err := NewParser().Parse(strings.NewReader(tc.in), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := Apply(f, tc.pre, nil); got != f {
+				t.Fatalf("Apply returned %T, want the file", got)
+			}
+			var buf bytes.Buffer
+			NewPrinter().Print(&buf, f)
+			if got := strings.TrimSuffix(buf.String(), "\n"); got != tc.want {
+				t.Fatalf("got:\n%s\nwant:\n%s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestApplyRoot(t *testing.T) {
+	t.Parallel()
+	stmt := litStmt("a")
+	got := Apply(stmt, func(c *Cursor) bool {
+		if c.Parent() != nil || c.Name() != "" || c.Index() != -1 {
+			t.Fatalf("unexpected cursor for the root node")
+		}
+		c.Replace(litStmt("b"))
+		return false
+	}, nil)
+	if got == stmt || stmtString(got.(*Stmt)) != "b" {
+		t.Fatalf("the root node was not replaced")
+	}
+}
+
+func TestApplyStop(t *testing.T) {
+	t.Parallel()
+	f, err := NewParser().Parse(strings.NewReader("a\nb\nc"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seen []int
+	Apply(f, nil, func(c *Cursor) bool {
+		if _, ok := c.Node().(*Stmt); ok {
+			seen = append(seen, c.Index())
+			return c.Index() < 1
+		}
+		return true
+	})
+	if fmt.Sprint(seen) != "[0 1]" {
+		t.Fatalf("want the statements 0 and 1 to be seen, got %v", seen)
+	}
+}
+
+func TestApplyPanics(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		fn   func(c *Cursor)
+		want string
+	}{
+		{
+			func(c *Cursor) {
+				if _, ok := c.Node().(*CallExpr); ok {
+					c.Delete()
+				}
+			},
+			"syntax.Cursor.Delete: *syntax.CallExpr is not part of a list",
+		},
+		{
+			func(c *Cursor) {
+				if _, ok := c.Node().(*CallExpr); ok {
+					c.InsertAfter(litStmt("b"))
+				}
+			},
+			"syntax.Cursor.InsertAfter: *syntax.CallExpr is not part of a list",
+		},
+		{
+			func(c *Cursor) {
+				if _, ok := c.Node().(*CallExpr); ok {
+					c.Replace(litWord("b"))
+				}
+			},
+			"syntax.Cursor.Replace: cannot use *syntax.Word as syntax.Command in *syntax.Stmt.Cmd",
+		},
+		{
+			func(c *Cursor) {
+				if _, ok := c.Node().(*Stmt); ok && c.Index() == 0 {
+					c.InsertBefore(litWord("b"))
+				}
+			},
+			"syntax.Cursor.InsertBefore: cannot use *syntax.Word as *syntax.Stmt in *syntax.File.Stmts",
+		},
+		{
+			func(c *Cursor) {
+				if _, ok := c.Node().(*Word); ok {
+					c.Replace(nil)
+				}
+			},
+			"syntax.Cursor.Replace: nil node in a list",
+		},
+	}
+	for _, tc := range tests {
+		f, err := NewParser().Parse(strings.NewReader("a"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		func() {
+			defer func() {
+				if got := recover(); got != tc.want {
+					t.Errorf("got panic %v, want %q", got, tc.want)
+				}
+			}()
+			Apply(f, func(c *Cursor) bool {
+				tc.fn(c)
+				return true
+			}, nil)
+		}()
+	}
+}
+
+func TestApplyUnexpectedType(t *testing.T) {
+	t.Parallel()
+	defer func() {
+		if r := recover(); r == nil {
+			t.Errorf("did not panic")
+		}
+	}()
+	Apply(newNode{}, nil, nil)
+}
@@ -3,7 +3,11 @@
 
 package syntax
 
-import "strconv"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 var (
 	litLeftBrace  = &Lit{Value: "{"}
@@ -21,7 +25,8 @@ var (
 // the literal "foo", and a brace expansion with the elements "bar" and "baz".
 //
 // It does not return an error; malformed brace expansions are simply skipped.
-// For example, the literal word "a{b" is left unchanged.
+// For example, the literal word "a{b" is left unchanged. Escaped characters,
+// like in "a\{b,c}", are never part of a brace expansion.
 func SplitBraces(word *Word) bool {
 	any := false
 	top := &Word{}
@@ -62,6 +67,9 @@ func SplitBraces(word *Word) bool {
 				addLit(&l2)
 			}
 			switch lit.Value[j] {
+			case '\\':
+				j++ // skip the escaped character
+				continue
 			case '{':
 				addlitidx()
 				acc = &Word{}
@@ -109,14 +117,15 @@ func SplitBraces(word *Word) bool {
 				for i, elem := range br.Elems[:2] {
 					val := elem.Lit()
 					if _, err := strconv.Atoi(val); err == nil {
-					} else if len(val) == 1 &&
-						'a' <= val[0] && val[0] <= 'z' {
+					} else if len(val) == 1 && asciiLetter(val[0]) {
 						chars[i] = true
 					} else {
 						broken = true
 					}
 				}
-				if len(br.Elems) == 3 {
+				if len(br.Elems) > 3 {
+					broken = true
+				} else if len(br.Elems) == 3 {
 					// increment must be a number
 					val := br.Elems[2].Lit()
 					if _, err := strconv.Atoi(val); err != nil {
@@ -176,3 +185,231 @@ func SplitBraces(word *Word) bool {
 	*word = *top
 	return true
 }
+
+func asciiLetter(b byte) bool {
+	return 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z'
+}
+
+// ExpandBraces returns the words resulting from the brace expansions in a word,
+// as the shell would expand them. For example, the literal word "/a/{b,c}"
+// results in the literal words "/a/b" and "/a/c". A word without any brace
+// expansions results in a copy of itself.
+//
+// Unlike the expand package, this works at the source level. The word is not
+// modified, and it does not need to be split with SplitBraces first. The
+// resulting words are made of the word's other parts and literals, with
+// adjacent literals joined, so that printing them gives source code which
+// expands to the same words in the same order. Note that an element expanding
+// to nothing, like in "{,a}", results in a word without any parts.
+func ExpandBraces(word *Word) []*Word {
+	split := *word
+	SplitBraces(&split)
+	var words []*Word
+	for _, parts := range expandBraceParts(split.Parts) {
+		words = append(words, &Word{Parts: joinLits(parts)})
+	}
+	return words
+}
+
+// expandBraceParts expands the BraceExp nodes in a list of word parts, in the
+// same order as expand.Braces.
+func expandBraceParts(parts []WordPart) [][]WordPart {
+	for i, part := range parts {
+		br, ok := part.(*BraceExp)
+		if !ok {
+			continue
+		}
+		var all [][]WordPart
+		for _, elem := range braceElems(br) {
+			next := append(elem[:len(elem):len(elem)], parts[i+1:]...)
+			for _, exp := range expandBraceParts(next) {
+				all = append(all, append(parts[:i:i], exp...))
+			}
+		}
+		return all
+	}
+	return [][]WordPart{parts}
+}
+
+// braceElems returns the parts of each element of a brace expansion, generating
+// the elements of a sequence like "{1..3}".
+func braceElems(br *BraceExp) [][]WordPart {
+	if !br.Sequence {
+		elems := make([][]WordPart, len(br.Elems))
+		for i, elem := range br.Elems {
+			elems[i] = elem.Parts
+		}
+		return elems
+	}
+	var from, to, width int
+	if br.Chars {
+		from = int(br.Elems[0].Lit()[0])
+		to = int(br.Elems[1].Lit()[0])
+	} else {
+		fromStr, toStr := br.Elems[0].Lit(), br.Elems[1].Lit()
+		from, _ = strconv.Atoi(fromStr)
+		to, _ = strconv.Atoi(toStr)
+		width = padWidth(fromStr)
+		if w := padWidth(toStr); w > width {
+			width = w
+		}
+	}
+	// The sign of the increment is ignored, as the direction is given by
+	// the endpoints.
+	incr := 1
+	if len(br.Elems) > 2 {
+		n, _ := strconv.Atoi(br.Elems[2].Lit())
+		if n < 0 {
+			n = -n
+		}
+		if n != 0 {
+			incr = n
+		}
+	}
+	if from > to {
+		incr = -incr
+	}
+	var elems [][]WordPart
+	for n := from; (incr > 0 && n <= to) || (incr < 0 && n >= to); n += incr {
+		// The generated elements are positioned like the whole sequence.
+		lit := &Lit{ValuePos: br.Pos(), ValueEnd: br.End()}
+		switch {
+		case br.Chars:
+			lit.Value = string(rune(n))
+		case width > 0:
+			lit.Value = fmt.Sprintf("%0*d", width, n)
+		default:
+			lit.Value = strconv.Itoa(n)
+		}
+		elems = append(elems, []WordPart{lit})
+	}
+	return elems
+}
+
+// padWidth returns the width to which the numbers of a sequence are zero-padded
+// because of one of its endpoints, such as 3 for "001" or "-01".
+func padWidth(s string) int {
+	if len(s) > 1 && s[0] == '0' || len(s) > 2 && s[0] == '-' && s[1] == '0' {
+		return len(s)
+	}
+	return 0
+}
+
+// joinLits returns parts with any adjacent literals joined into one, and
+// without any empty literals.
+func joinLits(parts []WordPart) []WordPart {
+	var joined []WordPart
+	for _, part := range parts {
+		lit, ok := part.(*Lit)
+		if !ok {
+			joined = append(joined, part)
+			continue
+		}
+		if lit.Value == "" {
+			continue
+		}
+		if len(joined) > 0 {
+			if prev, ok := joined[len(joined)-1].(*Lit); ok {
+				joined[len(joined)-1] = &Lit{
+					ValuePos: prev.ValuePos,
+					ValueEnd: lit.ValueEnd,
+					Value:    prev.Value + lit.Value,
+				}
+				continue
+			}
+		}
+		joined = append(joined, lit)
+	}
+	return joined
+}
+
+// FactorBraces is the inverse of ExpandBraces, for lists of words such as the
+// arguments to a command. Runs of consecutive literal words which share a
+// prefix or a suffix are replaced with a single word with a brace expansion,
+// when that is shorter. For example, the words "/a/b" and "/a/c" result in the
+// word "/a/{b,c}". The words are not modified.
+//
+// Only words made of a single literal without any escapes, braces, or commas
+// are factored. Moreover, a factored word is only used if ExpandBraces gives
+// back the original words in order, so the result always expands to the same
+// list of words as the input.
+//
+// Note that brace expansions are not supported in POSIX Shell.
+func FactorBraces(words []*Word) []*Word {
+	var factored []*Word
+	for i := 0; i < len(words); {
+		best, bestEnd := words[i], i+1
+		bestSaved := 0
+		for j := i + 2; j <= len(words); j++ {
+			w, saved := factorWords(words[i:j])
+			if w == nil {
+				break
+			}
+			if saved > bestSaved {
+				best, bestEnd, bestSaved = w, j, saved
+			}
+		}
+		factored = append(factored, best)
+		i = bestEnd
+	}
+	return factored
+}
+
+// factorWords returns the factored form of words, and how many bytes it saves.
+// It returns nil if the words cannot be factored, such as when they share no
+// prefix or suffix.
+func factorWords(words []*Word) (*Word, int) {
+	vals := make([]string, len(words))
+	for i, w := range words {
+		val := w.Lit()
+		if len(w.Parts) != 1 || val == "" || val[0] == '~' ||
+			strings.ContainsAny(val, "\\{},") {
+			return nil, 0
+		}
+		vals[i] = val
+	}
+	prefix := vals[0]
+	for _, val := range vals[1:] {
+		for !strings.HasPrefix(val, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	suffix := vals[0][len(prefix):]
+	for _, val := range vals[1:] {
+		for !strings.HasSuffix(val[len(prefix):], suffix) {
+			suffix = suffix[1:]
+		}
+	}
+	if prefix == "" && suffix == "" {
+		return nil, 0
+	}
+	var sb strings.Builder
+	sb.WriteString(prefix)
+	sb.WriteByte('{')
+	for i, val := range vals {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(val[len(prefix) : len(val)-len(suffix)])
+	}
+	sb.WriteByte('}')
+	sb.WriteString(suffix)
+	lit := words[0].Parts[0].(*Lit)
+	word := &Word{Parts: []WordPart{&Lit{
+		ValuePos: lit.ValuePos,
+		ValueEnd: words[len(words)-1].End(),
+		Value:    sb.String(),
+	}}}
+	// Factoring must not change the words, which could happen with
+	// elements like "1..3".
+	exp := ExpandBraces(word)
+	if len(exp) != len(vals) {
+		return word, -1
+	}
+	for i, w := range exp {
+		if w.Lit() != vals[i] {
+			return word, -1
+		}
+	}
+	return word, (len(words)-1)*(len(prefix)+len(suffix)) - 2
+}
@@ -0,0 +1,261 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// Package build constructs shell syntax trees which can be printed as valid
+// programs, without having to fill in positions or to know which node fields
+// the printer relies upon.
+//
+// The constructed nodes have zero positions, as the printer lays them out
+// without them. Literal strings are quoted as needed, so that they are kept
+// as-is when the program runs, and operands are wrapped in blocks where the
+// precedence of the operators would otherwise change their meaning.
+//
+// Functions taking names, such as Assign, panic if they aren't valid.
+package build
+
+import (
+	"fmt"
+	"strings"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// marker is a valid position, used where the printer needs a field to be set
+// for a token to be printed, such as the "in" of a for loop.
+var marker = syntax.NewPos(0, 1, 1)
+
+// File returns a file with the given statements.
+func File(stmts ...*syntax.Stmt) *syntax.File {
+	return &syntax.File{Stmts: stmts}
+}
+
+// Word returns a word with the literal value s, quoted as needed.
+func Word(s string) *syntax.Word {
+	return &syntax.Word{Parts: quoted(s)}
+}
+
+// Words returns a word for each string as per Word.
+func Words(strs ...string) []*syntax.Word {
+	words := make([]*syntax.Word, len(strs))
+	for i, s := range strs {
+		words[i] = Word(s)
+	}
+	return words
+}
+
+// Var returns a double-quoted expansion of the parameter name, like "$name".
+// The name may also be a positional parameter, like "1", or a special one,
+// like "@".
+func Var(name string) *syntax.Word {
+	short := len(name) == 1 && strings.Contains("0123456789@*#?-$!", name)
+	if !short && !syntax.ValidName(name) {
+		if name == "" || strings.Trim(name, "0123456789") != "" {
+			panic(fmt.Sprintf("build.Var: invalid name %q", name))
+		}
+		// positional parameters past 9 need braces, like "${10}"
+	} else {
+		short = true
+	}
+	return &syntax.Word{Parts: []syntax.WordPart{&syntax.DblQuoted{
+		Parts: []syntax.WordPart{&syntax.ParamExp{
+			Short: short,
+			Param: &syntax.Lit{Value: name},
+		}},
+	}}}
+}
+
+// CmdSubst returns a double-quoted command substitution of the statements,
+// like "$(stmts)".
+func CmdSubst(stmts ...*syntax.Stmt) *syntax.Word {
+	return &syntax.Word{Parts: []syntax.WordPart{&syntax.DblQuoted{
+		Parts: []syntax.WordPart{&syntax.CmdSubst{Stmts: stmts}},
+	}}}
+}
+
+// Join returns a word made of the parts of each of the words, one after the
+// other, like "$HOME"/bin from Var("HOME") and Word("/bin").
+func Join(words ...*syntax.Word) *syntax.Word {
+	w := &syntax.Word{}
+	for _, w2 := range words {
+		w.Parts = append(w.Parts, w2.Parts...)
+	}
+	return w
+}
+
+// Call returns a simple command with the given arguments, quoted as per Word.
+// The first argument is also quoted if it's a reserved word, like "if".
+func Call(args ...string) *syntax.Stmt {
+	words := Words(args...)
+	if len(args) > 0 && reservedWords[args[0]] {
+		words[0] = &syntax.Word{Parts: []syntax.WordPart{
+			&syntax.SglQuoted{Value: args[0]},
+		}}
+	}
+	return CallWords(words...)
+}
+
+// CallWords returns a simple command with the given arguments.
+func CallWords(args ...*syntax.Word) *syntax.Stmt {
+	return &syntax.Stmt{Cmd: &syntax.CallExpr{Args: args}}
+}
+
+// Assign returns an assignment to the variable name, like name=value. If
+// value is nil, the variable is assigned the empty string.
+func Assign(name string, value *syntax.Word) *syntax.Stmt {
+	checkName("Assign", name)
+	return &syntax.Stmt{Cmd: &syntax.CallExpr{Assigns: []*syntax.Assign{{
+		Name:  &syntax.Lit{Value: name},
+		Value: value,
+	}}}}
+}
+
+// If returns an if clause running then if cond succeeds, and else_ otherwise.
+// If else_ is empty, the clause has no else branch.
+func If(cond *syntax.Stmt, then, else_ []*syntax.Stmt) *syntax.Stmt {
+	checkStmt("If", cond)
+	ic := &syntax.IfClause{
+		Cond: []*syntax.Stmt{cond},
+		Then: then,
+	}
+	if len(else_) > 0 {
+		ic.Else = &syntax.IfClause{Then: else_}
+	}
+	return &syntax.Stmt{Cmd: ic}
+}
+
+// While returns a while loop running do for as long as cond succeeds.
+func While(cond *syntax.Stmt, do []*syntax.Stmt) *syntax.Stmt {
+	checkStmt("While", cond)
+	return &syntax.Stmt{Cmd: &syntax.WhileClause{
+		Cond: []*syntax.Stmt{cond},
+		Do:   do,
+	}}
+}
+
+// For returns a for loop running do with the variable name set to each of
+// the items, like "for name in items; do do; done".
+func For(name string, items []*syntax.Word, do []*syntax.Stmt) *syntax.Stmt {
+	checkName("For", name)
+	return &syntax.Stmt{Cmd: &syntax.ForClause{
+		Loop: &syntax.WordIter{
+			Name:  &syntax.Lit{Value: name},
+			InPos: marker,
+			Items: items,
+		},
+		Do: do,
+	}}
+}
+
+// Func returns a function declaration, like "name() { body; }". The name must
+// be a valid function name which needs no quoting.
+func Func(name string, body ...*syntax.Stmt) *syntax.Stmt {
+	if name == "" || strings.Trim(name, safeChars) != "" || reservedWords[name] {
+		panic(fmt.Sprintf("build.Func: invalid name %q", name))
+	}
+	return &syntax.Stmt{Cmd: &syntax.FuncDecl{
+		Name: &syntax.Lit{Value: name},
+		Body: &syntax.Stmt{Cmd: &syntax.Block{Stmts: body}},
+	}}
+}
+
+// Block returns a block of statements, like "{ stmts; }".
+func Block(stmts ...*syntax.Stmt) *syntax.Stmt {
+	return &syntax.Stmt{Cmd: &syntax.Block{Stmts: stmts}}
+}
+
+// Subshell returns the statements run in a subshell, like "(stmts)".
+func Subshell(stmts ...*syntax.Stmt) *syntax.Stmt {
+	return &syntax.Stmt{Cmd: &syntax.Subshell{Stmts: stmts}}
+}
+
+// And returns a list running y if x succeeds, like "x && y".
+func And(x, y *syntax.Stmt) *syntax.Stmt {
+	return binary("And", syntax.AndStmt, x, y)
+}
+
+// Or returns a list running y if x fails, like "x || y".
+func Or(x, y *syntax.Stmt) *syntax.Stmt {
+	return binary("Or", syntax.OrStmt, x, y)
+}
+
+// Pipe returns a pipeline sending the output of x to y, like "x | y".
+func Pipe(x, y *syntax.Stmt) *syntax.Stmt {
+	return binary("Pipe", syntax.Pipe, x, y)
+}
+
+// Not returns s with its exit status negated, like "! s".
+func Not(s *syntax.Stmt) *syntax.Stmt {
+	checkStmt("Not", s)
+	if s.Negated || isList(s) {
+		s = Block(s)
+	}
+	negated := *s
+	negated.Negated = true
+	return &negated
+}
+
+func binary(fn string, op syntax.BinCmdOperator, x, y *syntax.Stmt) *syntax.Stmt {
+	checkStmt(fn, x)
+	checkStmt(fn, y)
+	if op == syntax.Pipe {
+		// "a && b | c" pipes b alone, and "! a | b" negates the pipeline
+		if x.Negated || isList(x) {
+			x = Block(x)
+		}
+		if y.Negated || isList(y) {
+			y = Block(y)
+		}
+	} else if isList(y) {
+		// "a && b || c" is "{ a && b; } || c"
+		y = Block(y)
+	}
+	return &syntax.Stmt{Cmd: &syntax.BinaryCmd{Op: op, X: x, Y: y}}
+}
+
+// isList reports whether s is an "and" or "or" list.
+func isList(s *syntax.Stmt) bool {
+	b, ok := s.Cmd.(*syntax.BinaryCmd)
+	return ok && (b.Op == syntax.AndStmt || b.Op == syntax.OrStmt)
+}
+
+func checkName(fn, name string) {
+	if !syntax.ValidName(name) {
+		panic(fmt.Sprintf("build.%s: invalid name %q", fn, name))
+	}
+}
+
+func checkStmt(fn string, s *syntax.Stmt) {
+	if s == nil {
+		panic(fmt.Sprintf("build.%s: nil statement", fn))
+	}
+}
+
+var reservedWords = map[string]bool{
+	"if": true, "then": true, "elif": true, "else": true, "fi": true,
+	"while": true, "until": true, "for": true, "in": true, "do": true,
+	"done": true, "case": true, "esac": true, "select": true,
+	"function": true, "time": true, "coproc": true,
+}
+
+// quoted returns the word parts for the literal value s. Strings made only of
+// characters which are never special are kept as a literal; others are single
+// quoted, with any single quotes in them escaped by a backslash between the
+// quoted parts.
+func quoted(s string) []syntax.WordPart {
+	if s != "" && strings.Trim(s, safeChars) == "" {
+		return []syntax.WordPart{&syntax.Lit{Value: s}}
+	}
+	var parts []syntax.WordPart
+	for i, part := range strings.Split(s, "'") {
+		if i > 0 {
+			parts = append(parts, &syntax.Lit{Value: `\'`})
+		}
+		if part != "" || s == "" {
+			parts = append(parts, &syntax.SglQuoted{Value: part})
+		}
+	}
+	return parts
+}
+
+const safeChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789" +
+	"%+,-./:@_"
@@ -0,0 +1,154 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package build
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"mvdan.cc/sh/v3/expand"
+	"mvdan.cc/sh/v3/syntax"
+)
+
+func printStmt(t *testing.T, s *syntax.Stmt) string {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := syntax.NewPrinter().Print(&buf, s); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+var buildTests = []struct {
+	stmt *syntax.Stmt
+	want string
+}{
+	{Call("git", "status"), "git status"},
+	{Call("echo", "a b", "it's", ""), `echo 'a b' 'it'\''s' ''`},
+	{Call("if", "then"), "'if' then"},
+	{Call("./run.sh", "--flag=x,y", "a/b:c@d%e+f"), "./run.sh '--flag=x,y' a/b:c@d%e+f"},
+	{Assign("FOO", Word("bar baz")), "FOO='bar baz'"},
+	{Assign("FOO", nil), "FOO="},
+	{
+		Assign("PATH", Join(Var("HOME"), Word("/bin:"), Var("PATH"))),
+		`PATH="$HOME"/bin:"$PATH"`,
+	},
+	{
+		CallWords(Word("echo"), CmdSubst(Call("date"))),
+		`echo "$(date)"`,
+	},
+	{
+		If(Call("true"), []*syntax.Stmt{Call("foo")}, nil),
+		"if true; then foo; fi",
+	},
+	{
+		If(Call("true"), []*syntax.Stmt{Call("foo")}, []*syntax.Stmt{Call("bar")}),
+		"if true; then foo; else bar; fi",
+	},
+	{
+		While(Not(Call("test", "-f", "x")), []*syntax.Stmt{Call("sleep", "1")}),
+		"while ! test -f x; do sleep 1; done",
+	},
+	{
+		For("f", Words("a b", "c"), []*syntax.Stmt{CallWords(Word("rm"), Var("f"))}),
+		`for f in 'a b' c; do rm "$f"; done`,
+	},
+	{For("f", nil, nil), "for f in; do; done"},
+	{
+		Func("greet", CallWords(Word("echo"), Join(Word("hi "), Var("1")))),
+		`greet() { echo 'hi '"$1"; }`,
+	},
+	{CallWords(Word("echo"), Var("@"), Var("10"), Var("_x1")), `echo "$@" "${10}" "$_x1"`},
+	{Subshell(Call("cd", "/"), Call("ls")), "(\n\tcd /\n\tls\n)"},
+	{Or(And(Call("a"), Call("b")), Call("c")), "a && b || c"},
+	{And(Call("a"), Or(Call("b"), Call("c"))), "a && { b || c; }"},
+	{Pipe(And(Call("a"), Call("b")), Call("c")), "{ a && b; } | c"},
+	{Pipe(Not(Call("a")), Call("b")), "{ ! a; } | b"},
+	{Not(Pipe(Call("a"), Call("b"))), "! a | b"},
+	{Not(Or(Call("a"), Call("b"))), "! { a || b; }"},
+	{Not(Not(Call("a"))), "! { ! a; }"},
+}
+
+func TestBuild(t *testing.T) {
+	t.Parallel()
+	for _, tc := range buildTests {
+		got := printStmt(t, tc.stmt)
+		if got != tc.want {
+			t.Errorf("got:\n%s\nwant:\n%s", got, tc.want)
+			continue
+		}
+		// the printed program must parse to the same tree
+		f, err := syntax.NewParser().Parse(strings.NewReader(got), "")
+		if err != nil {
+			t.Errorf("%q does not parse: %v", got, err)
+			continue
+		}
+		if len(f.Stmts) != 1 {
+			t.Errorf("%q parses as %d statements", got, len(f.Stmts))
+			continue
+		}
+		if got2 := printStmt(t, f.Stmts[0]); got2 != got {
+			t.Errorf("%q prints as %q once parsed", got, got2)
+		}
+	}
+}
+
+func TestWordLiteral(t *testing.T) {
+	t.Parallel()
+	for _, s := range []string{
+		"", " ", "a b", "it's", "'", "''", `\`, `"`, "$x", "`x`", "*", "?",
+		"[a]", "{a,b}", "~", "#x", "a=b", "!", ";", "&", "|", "<", ">",
+		"(", ")", "\n", "\t", "é", "a\nb'c\\d",
+	} {
+		word := Word(s)
+		var buf bytes.Buffer
+		if err := syntax.NewPrinter().Print(&buf, File(CallWords(Word("echo"), word))); err != nil {
+			t.Fatal(err)
+		}
+		f, err := syntax.NewParser().Parse(&buf, "")
+		if err != nil {
+			t.Errorf("%q does not parse: %v", buf.String(), err)
+			continue
+		}
+		args := f.Stmts[0].Cmd.(*syntax.CallExpr).Args
+		if len(args) != 2 {
+			t.Errorf("%q has %d arguments", s, len(args))
+			continue
+		}
+		fields, err := expand.Fields(nil, args[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fields) != 1 || fields[0] != s {
+			t.Errorf("%q is printed as the fields %q", s, fields)
+		}
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	t.Parallel()
+	for _, tc := range []struct {
+		fn   func()
+		want string
+	}{
+		{func() { Assign("1a", nil) }, `build.Assign: invalid name "1a"`},
+		{func() { Var("a-b") }, `build.Var: invalid name "a-b"`},
+		{func() { Var("") }, `build.Var: invalid name ""`},
+		{func() { For("", nil, nil) }, `build.For: invalid name ""`},
+		{func() { Func("a b") }, `build.Func: invalid name "a b"`},
+		{func() { Func("done") }, `build.Func: invalid name "done"`},
+		{func() { If(nil, nil, nil) }, "build.If: nil statement"},
+		{func() { And(Call("a"), nil) }, "build.And: nil statement"},
+	} {
+		func() {
+			defer func() {
+				if got := recover(); got != tc.want {
+					t.Errorf("got panic %v, want %q", got, tc.want)
+				}
+			}()
+			tc.fn()
+		}()
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import "runtime/debug"
+
+// Capabilities describes what this version of the package supports, such as
+// to list the available options in a user interface, or to reject unknown
+// option names. See SupportedCapabilities.
+type Capabilities struct {
+	// Version is the version of the mvdan.cc/sh/v3 module, like "v3.0.0".
+	// It is "(devel)" or empty if unknown, such as when building the module
+	// itself or without module support.
+	Version string
+
+	// LangVariants are the names of the language variants, as returned by
+	// LangVariant.String.
+	LangVariants []string
+
+	// ParserOptions and PrinterOptions are the options accepted by
+	// NewParser and NewPrinter, sorted by name.
+	ParserOptions  []OptionInfo
+	PrinterOptions []OptionInfo
+
+	// SimplifyRules are the names of the rules which can be given to
+	// SimplifyRules, as returned by SimplifyRule.String.
+	SimplifyRules []string
+}
+
+// OptionInfo describes a parser or printer option.
+type OptionInfo struct {
+	// Name is the name of the func returning the option, like "Indent".
+	Name string
+
+	// Kind is the type of the option's only parameter, such as "bool",
+	// "uint", "string", or the name of an enum type like "LangVariant".
+	Kind string
+
+	// Default is the value equivalent to not using the option.
+	Default string
+
+	// Values are the names of the possible values for enum types, in the
+	// order of their constants.
+	Values []string
+}
+
+var langVariants = [...]LangVariant{LangBash, LangPOSIX, LangMirBSDKorn}
+
+// bracesModeNames are the names of the BracesMode values, as used by shfmt.
+var bracesModeNames = [...]string{
+	BracesLeave:   "leave",
+	BracesAlways:  "always",
+	BracesMinimal: "minimal",
+}
+
+var parserOptions = [...]OptionInfo{
+	{Name: "KeepComments", Kind: "bool", Default: "false"},
+	{Name: "KeepParents", Kind: "bool", Default: "false"},
+	{Name: "RecoverErrors", Kind: "uint", Default: "0"},
+	{Name: "RetainSource", Kind: "bool", Default: "false"},
+	{Name: "StopAt", Kind: "string", Default: ""},
+	{Name: "Variant", Kind: "LangVariant", Default: LangBash.String()},
+}
+
+var printerOptions = [...]OptionInfo{
+	{Name: "AlignComments", Kind: "uint", Default: "0"},
+	{Name: "BinaryNextLine", Kind: "bool", Default: "false"},
+	{Name: "HeredocIndent", Kind: "bool", Default: "false"},
+	{Name: "Indent", Kind: "uint", Default: "0"},
+	{Name: "KeepPadding", Kind: "bool", Default: "false"},
+	{Name: "Minify", Kind: "bool", Default: "false"},
+	{Name: "MinifyBraces", Kind: "bool", Default: "false"},
+	{Name: "ParamBraces", Kind: "BracesMode", Default: bracesModeNames[BracesLeave]},
+	{Name: "Reindent", Kind: "bool", Default: "false"},
+	{Name: "SpaceRedirects", Kind: "bool", Default: "false"},
+	{Name: "SwitchCaseIndent", Kind: "bool", Default: "false"},
+	{Name: "WrapAt", Kind: "uint", Default: "0"},
+}
+
+// SupportedCapabilities returns what this version of the package supports. The
+// result is a new copy which may be modified.
+func SupportedCapabilities() Capabilities {
+	var c Capabilities
+	if info, ok := debug.ReadBuildInfo(); ok {
+		c.Version = moduleVersion(info)
+	}
+	for _, lang := range langVariants {
+		c.LangVariants = append(c.LangVariants, lang.String())
+	}
+	for _, opt := range parserOptions {
+		if opt.Kind == "LangVariant" {
+			opt.Values = append([]string(nil), c.LangVariants...)
+		}
+		c.ParserOptions = append(c.ParserOptions, opt)
+	}
+	for _, opt := range printerOptions {
+		if opt.Kind == "BracesMode" {
+			opt.Values = append([]string(nil), bracesModeNames[:]...)
+		}
+		c.PrinterOptions = append(c.PrinterOptions, opt)
+	}
+	c.SimplifyRules = append([]string(nil), simplifyRuleNames[:]...)
+	return c
+}
+
+// moduleVersion finds the version of this module in the build information of
+// the running program.
+func moduleVersion(info *debug.BuildInfo) string {
+	const path = "mvdan.cc/sh/v3"
+	if info.Main.Path == path {
+		return info.Main.Version
+	}
+	for _, mod := range info.Deps {
+		if mod.Path != path {
+			continue
+		}
+		if mod.Replace != nil {
+			return mod.Replace.Version
+		}
+		return mod.Version
+	}
+	return ""
+}
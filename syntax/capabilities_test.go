@@ -0,0 +1,166 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import (
+	"go/ast"
+	"go/parser"
+	gotoken "go/token"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+var optionFuncs = map[string]interface{}{
+	"KeepComments":  KeepComments,
+	"KeepParents":   KeepParents,
+	"RecoverErrors": RecoverErrors,
+	"RetainSource":  RetainSource,
+	"StopAt":        StopAt,
+	"Variant":       Variant,
+
+	"AlignComments":    AlignComments,
+	"BinaryNextLine":   BinaryNextLine,
+	"HeredocIndent":    HeredocIndent,
+	"Indent":           Indent,
+	"KeepPadding":      KeepPadding,
+	"Minify":           Minify,
+	"MinifyBraces":     MinifyBraces,
+	"ParamBraces":      ParamBraces,
+	"Reindent":         Reindent,
+	"SpaceRedirects":   SpaceRedirects,
+	"SwitchCaseIndent": SwitchCaseIndent,
+	"WrapAt":           WrapAt,
+}
+
+// sourceOptionFuncs finds the exported funcs in the package's source which
+// return a ParserOption or a PrinterOption, by the name of the option type.
+func sourceOptionFuncs(t *testing.T) map[string][]string {
+	fset := gotoken.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, ".", func(info os.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	funcs := make(map[string][]string)
+	for _, file := range pkgs["syntax"].Files {
+		for _, decl := range file.Decls {
+			fd, ok := decl.(*ast.FuncDecl)
+			if !ok || fd.Recv != nil || !fd.Name.IsExported() {
+				continue
+			}
+			res := fd.Type.Results
+			if res == nil || len(res.List) != 1 {
+				continue
+			}
+			if id, ok := res.List[0].Type.(*ast.Ident); ok {
+				switch id.Name {
+				case "ParserOption", "PrinterOption":
+					funcs[id.Name] = append(funcs[id.Name], fd.Name.Name)
+				}
+			}
+		}
+	}
+	return funcs
+}
+
+func TestCapabilitiesOptions(t *testing.T) {
+	t.Parallel()
+	caps := SupportedCapabilities()
+	names := func(opts []OptionInfo) map[string]bool {
+		m := make(map[string]bool)
+		for _, opt := range opts {
+			m[opt.Name] = true
+		}
+		return m
+	}
+	src := sourceOptionFuncs(t)
+	for typ, opts := range map[string][]OptionInfo{
+		"ParserOption":  caps.ParserOptions,
+		"PrinterOption": caps.PrinterOptions,
+	} {
+		listed := names(opts)
+		for _, name := range src[typ] {
+			if !listed[name] {
+				t.Errorf("%s returns a %s but is not in Capabilities", name, typ)
+			}
+			delete(listed, name)
+		}
+		for name := range listed {
+			t.Errorf("%s is in Capabilities but does not return a %s", name, typ)
+		}
+	}
+}
+
+func TestCapabilitiesDefaults(t *testing.T) {
+	t.Parallel()
+	caps := SupportedCapabilities()
+	check := func(opt OptionInfo, newDefault, newWith func(arg reflect.Value) interface{}) {
+		fn := reflect.ValueOf(optionFuncs[opt.Name])
+		if !fn.IsValid() {
+			t.Errorf("%s is missing from optionFuncs", opt.Name)
+			return
+		}
+		ptyp := fn.Type().In(0)
+		if ptyp.Name() != opt.Kind {
+			t.Errorf("%s: want kind %q, got %q", opt.Name, ptyp.Name(), opt.Kind)
+			return
+		}
+		arg := reflect.New(ptyp).Elem()
+		switch ptyp.Kind() {
+		case reflect.Bool:
+			b, err := strconv.ParseBool(opt.Default)
+			if err != nil {
+				t.Fatal(err)
+			}
+			arg.SetBool(b)
+		case reflect.Uint:
+			n, err := strconv.ParseUint(opt.Default, 10, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			arg.SetUint(n)
+		case reflect.String:
+			arg.SetString(opt.Default)
+		case reflect.Int: // enums
+			i := -1
+			for j, value := range opt.Values {
+				if value == opt.Default {
+					i = j
+				}
+			}
+			if i < 0 {
+				t.Errorf("%s: default %q is not one of %q", opt.Name, opt.Default, opt.Values)
+				return
+			}
+			arg.SetInt(int64(i))
+		}
+		want, got := newDefault(arg), newWith(fn.Call([]reflect.Value{arg})[0])
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("%s(%s) changes the default behavior", opt.Name, opt.Default)
+		}
+	}
+	for _, opt := range caps.ParserOptions {
+		check(opt, func(reflect.Value) interface{} {
+			return NewParser()
+		}, func(opt reflect.Value) interface{} {
+			return NewParser(opt.Interface().(ParserOption))
+		})
+	}
+	for _, opt := range caps.PrinterOptions {
+		check(opt, func(reflect.Value) interface{} {
+			return NewPrinter()
+		}, func(opt reflect.Value) interface{} {
+			return NewPrinter(opt.Interface().(PrinterOption))
+		})
+	}
+	for i, name := range caps.LangVariants {
+		if got := LangVariant(i).String(); got != name {
+			t.Errorf("LangVariant(%d) is %q, not %q", i, got, name)
+		}
+	}
+}
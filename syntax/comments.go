@@ -0,0 +1,197 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+// CommentMap maps statements to the comments associated with them. See
+// NewCommentMap.
+type CommentMap map[Node][]Comment
+
+// NewCommentMap associates the comments in a file parsed with KeepComments to
+// the statements they belong to, following these rules:
+//
+//   - A comment on the line where a statement ends follows the statement, and
+//     is associated with it, as in "foo # bar".
+//   - Comments on the lines directly above a statement are associated with it,
+//     such as the documentation of a function. A blank line between the
+//     comments and the statement breaks the association, as does a blank line
+//     within the comments for those above it.
+//
+// Any other comments, like those at the end of a block or separated by blank
+// lines, aren't associated with any statement.
+//
+// The keys in the map are of type *Stmt, so the documentation of a function is
+// found via the statement holding its *FuncDecl. The comments are in the order
+// they appear in the source.
+func NewCommentMap(f *File) CommentMap {
+	m := make(CommentMap)
+	Walk(f, func(node Node) bool {
+		if s, ok := node.(*Stmt); ok {
+			if cs := stmtComments(s); len(cs) > 0 {
+				m[s] = cs
+			}
+		}
+		return true
+	})
+	return m
+}
+
+// stmtComments returns the comments in s.Comments which are associated with
+// s, as described in NewCommentMap.
+func stmtComments(s *Stmt) []Comment {
+	var leading, trailing []Comment
+	line := s.Pos().Line()
+	for i := len(s.Comments) - 1; i >= 0; i-- {
+		c := s.Comments[i]
+		if !c.Pos().After(s.Pos()) {
+			// leading comments, from the bottom up
+			if c.Pos().Line()+1 != line {
+				break
+			}
+			leading = append(leading, c)
+			line--
+		} else if c.Pos().Line() == s.End().Line() {
+			trailing = append(trailing, c)
+		}
+	}
+	var cs []Comment
+	for i := len(leading) - 1; i >= 0; i-- {
+		cs = append(cs, leading[i])
+	}
+	for i := len(trailing) - 1; i >= 0; i-- {
+		cs = append(cs, trailing[i])
+	}
+	return cs
+}
+
+// Leading returns the comments associated with s which come before it, such as
+// the documentation of a function.
+func (m CommentMap) Leading(s *Stmt) []Comment {
+	var cs []Comment
+	for _, c := range m[s] {
+		if !c.Pos().After(s.Pos()) {
+			cs = append(cs, c)
+		}
+	}
+	return cs
+}
+
+// Trailing returns the comments associated with s which come after it, on the
+// line where it ends.
+func (m CommentMap) Trailing(s *Stmt) []Comment {
+	var cs []Comment
+	for _, c := range m[s] {
+		if c.Pos().After(s.Pos()) {
+			cs = append(cs, c)
+		}
+	}
+	return cs
+}
+
+// Update moves the comments associated with the old node to the new one, such
+// as when replacing a statement, and returns the new node. If both nodes are
+// statements, the comments keep being leading or trailing ones for the new
+// statement, no matter where it is. Update doesn't modify the syntax tree; see
+// Attach.
+func (m CommentMap) Update(old, new Node) Node {
+	cs := m[old]
+	if len(cs) == 0 {
+		return new
+	}
+	delete(m, old)
+	oldStmt, ok1 := old.(*Stmt)
+	newStmt, ok2 := new.(*Stmt)
+	if ok1 && ok2 {
+		cs = append([]Comment(nil), cs...)
+		for i, c := range cs {
+			if c.Pos().After(oldStmt.Pos()) {
+				cs[i].Hash = trailingPos(newStmt)
+			} else {
+				cs[i].Hash = Pos{}
+			}
+		}
+	}
+	m[new] = append(m[new], cs...)
+	return new
+}
+
+// Attach sets the comments of the statements within node to those associated
+// with them in the map, so that the printer keeps each comment with its
+// statement after the statements are moved or replaced, or after the map is
+// modified. A comment associated with a statement is removed from any other
+// statement, so the comments associated with statements which are no longer
+// in the syntax tree are dropped.
+//
+// Leading comments keep their positions if they are still on the lines right
+// before the statement; otherwise, their positions are removed so that they
+// are printed there. Trailing comments are moved to the end of the statement.
+// The comments of the statements which aren't associated with any statement in
+// the map, like those separated by a blank line, are left as they were.
+func (m CommentMap) Attach(node Node) {
+	mapped := make(map[Comment]bool)
+	for _, cs := range m {
+		for _, c := range cs {
+			mapped[c] = true
+		}
+	}
+	Walk(node, func(node Node) bool {
+		s, ok := node.(*Stmt)
+		if !ok {
+			return true
+		}
+		var before, after []Comment
+		for _, c := range s.Comments {
+			if mapped[c] {
+				continue
+			}
+			if c.Pos().After(s.Pos()) {
+				after = append(after, c)
+			} else {
+				before = append(before, c)
+			}
+		}
+		leading, trailing := m.Leading(s), m.Trailing(s)
+		if len(trailing) > 1 {
+			// only one comment fits at the end of a line
+			n := len(trailing) - 1
+			leading = append(leading[:len(leading):len(leading)], trailing[:n]...)
+			trailing = trailing[n:]
+		}
+		if !fitsBefore(s, leading) {
+			leading = append([]Comment(nil), leading...)
+			for i := range leading {
+				leading[i].Hash = Pos{}
+			}
+		}
+		cs := append(before, leading...)
+		cs = append(cs, after...)
+		for _, c := range trailing {
+			if c.Pos().Line() != s.End().Line() || !c.Pos().After(s.End()) {
+				c.Hash = trailingPos(s)
+			}
+			cs = append(cs, c)
+		}
+		s.Comments = cs
+		return true
+	})
+}
+
+// fitsBefore reports whether the leading comments are on the lines right before
+// the statement, one per line, as they are after parsing.
+func fitsBefore(s *Stmt, leading []Comment) bool {
+	line := s.Pos().Line()
+	for i := len(leading) - 1; i >= 0; i-- {
+		c := leading[i]
+		line--
+		if c.Pos().Line() != line || line == 0 || c.End().After(s.Pos()) {
+			return false
+		}
+	}
+	return true
+}
+
+// trailingPos returns the position for a trailing comment of s, which is never
+// the zero position even if s has no positions, as those are printed before s.
+func trailingPos(s *Stmt) Pos {
+	return posAddCol(s.End(), 1)
+}
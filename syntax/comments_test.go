@@ -0,0 +1,168 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var commentMapTests = []struct {
+	in   string
+	want map[string][]string // by the statement's source
+}{
+	{"foo", map[string][]string{}},
+	{"foo # a", map[string][]string{"foo": {" a"}}},
+	{"# a\n# b\nfoo", map[string][]string{"foo": {" a", " b"}}},
+	{"# a\n\nfoo", map[string][]string{}},
+	{"# a\n\n# b\nfoo # c", map[string][]string{"foo": {" b", " c"}}},
+	{"foo\n# a\nbar", map[string][]string{"bar": {" a"}}},
+	{"foo # a\n# b\nbar", map[string][]string{"foo": {" a"}, "bar": {" b"}}},
+	{"foo\n# a", map[string][]string{}},
+	{
+		"# doc\nf() {\n\t# inner\n\tbar # c\n\t# last\n} # d",
+		map[string][]string{
+			"f() {\n\t# inner\n\tbar # c\n\t# last\n}": {" doc", " d"},
+			"bar": {" inner", " c"},
+		},
+	},
+	{
+		"if foo; then # a\n\tbar\nfi # b",
+		map[string][]string{
+			"if foo; then # a\n\tbar\nfi": {" b"},
+			"bar":                         {" a"},
+		},
+	},
+}
+
+func TestCommentMap(t *testing.T) {
+	t.Parallel()
+	p := NewParser(KeepComments(true), RetainSource(true))
+	for i, tc := range commentMapTests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			f, err := p.Parse(strings.NewReader(tc.in), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(map[string][]string)
+			for node, cs := range NewCommentMap(f) {
+				s := node.(*Stmt)
+				src := string(f.Src[s.Pos().Offset():s.End().Offset()])
+				for _, c := range cs {
+					got[src] = append(got[src], c.Text)
+				}
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("want:\n%q\ngot:\n%q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestCommentMapLeadingTrailing(t *testing.T) {
+	t.Parallel()
+	in := "# a\n\n# b\n# c\nf() { bar; } # d\n"
+	f, err := NewParser(KeepComments(true)).Parse(strings.NewReader(in), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewCommentMap(f)
+	texts := func(cs []Comment) (l []string) {
+		for _, c := range cs {
+			l = append(l, c.Text)
+		}
+		return l
+	}
+	s := f.Stmts[0]
+	if got, want := texts(m.Leading(s)), []string{" b", " c"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("want leading comments %q, got %q", want, got)
+	}
+	if got, want := texts(m.Trailing(s)), []string{" d"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("want trailing comments %q, got %q", want, got)
+	}
+}
+
+var commentAttachTests = []struct {
+	in     string
+	modify func(f *File, m CommentMap)
+	want   string
+}{
+	{
+		// no changes
+		"# a\nx # b\n\n# c\n\n# d\nf() {\n\t# e\n\ty # f\n\t# g\n}\nz",
+		func(f *File, m CommentMap) {},
+		"# a\nx # b\n\n# c\n\n# d\nf() {\n\t# e\n\ty # f\n\t# g\n}\nz\n",
+	},
+	{
+		// swap two statements
+		"# a\na # a2\n\n# b\nb # b2",
+		func(f *File, m CommentMap) {
+			f.Stmts[0], f.Stmts[1] = f.Stmts[1], f.Stmts[0]
+		},
+		"# b\nb # b2\n# a\na # a2\n",
+	},
+	{
+		// move a statement into a block
+		"# a\na # a2\n{\n\tb\n}",
+		func(f *File, m CommentMap) {
+			block := f.Stmts[1].Cmd.(*Block)
+			block.Stmts = append(block.Stmts, f.Stmts[0])
+			f.Stmts = f.Stmts[1:]
+		},
+		"{\n\tb\n\t# a\n\ta # a2\n\n}\n",
+	},
+	{
+		// replace a statement with a new one
+		"x\n# a\n# a2\na # a3\ny",
+		func(f *File, m CommentMap) {
+			s := litStmt("new", "cmd")
+			m.Update(f.Stmts[1], s)
+			f.Stmts[1] = s
+		},
+		"x\n# a\n# a2\nnew cmd # a3\n\ny\n",
+	},
+	{
+		// move a comment to another statement
+		"# a\na\nb",
+		func(f *File, m CommentMap) {
+			m[f.Stmts[1]] = m[f.Stmts[0]]
+			delete(m, f.Stmts[0])
+		},
+		"a\n# a\nb\n",
+	},
+	{
+		// unassociated comments move with their statement
+		"# a\n\na # a2\nb",
+		func(f *File, m CommentMap) {
+			f.Stmts[0], f.Stmts[1] = f.Stmts[1], f.Stmts[0]
+		},
+		"b\n# a\na # a2\n",
+	},
+}
+
+func TestCommentMapAttach(t *testing.T) {
+	t.Parallel()
+	p := NewParser(KeepComments(true))
+	for i, tc := range commentAttachTests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			f, err := p.Parse(strings.NewReader(tc.in), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			m := NewCommentMap(f)
+			tc.modify(f, m)
+			m.Attach(f)
+			var buf bytes.Buffer
+			if err := NewPrinter().Print(&buf, f); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != tc.want {
+				t.Fatalf("want:\n%s\ngot:\n%s", tc.want, got)
+			}
+		})
+	}
+}
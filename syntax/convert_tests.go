@@ -0,0 +1,661 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import "strings"
+
+// SimplifyOption is a function which can be passed to Simplify to enable
+// changes which aren't made by default.
+type SimplifyOption func(*simplifier)
+
+// ConvertTests makes Simplify convert test commands to the form suited to
+// lang. Since the two forms don't expand words in the same way, the meaning of
+// a converted test may change subtly, such as when a variable which was split
+// into multiple words no longer is.
+//
+// For LangBash and LangMirBSDKorn, "[ ... ]" commands become "[[ ... ]]"
+// clauses, with "-a" and "-o" turned into "&&" and "||". Expansions on the
+// right side of "=" and "!=" are quoted, so that they're still compared as
+// strings and not as patterns. Commands whose arguments can't be read in a
+// single way, such as when using "$@" or unquoted glob characters, are left as
+// they are. So are arithmetic comparisons like "-eq" unless both operands are
+// integers, as "[[ ]]" would evaluate expansions in them as expressions.
+//
+// For LangPOSIX, "[[ ... ]]" clauses become "[ ... ]" commands, with their
+// expansions quoted so that they aren't split nor globbed. "&&", "||" and "!"
+// between tests become the shell operators, with braces where needed, and
+// matching against a pattern becomes a case clause. Clauses with no faithful
+// translation, such as those using "=~", "<" or operators only supported by
+// Bash, are left as they are; they can be found as the *TestClause nodes left
+// after calling Simplify.
+//
+// In both cases, negation and redirections of the test command are kept.
+func ConvertTests(lang LangVariant) SimplifyOption {
+	return func(s *simplifier) {
+		s.convertTests = true
+		s.testsLang = lang
+		s.grouped = make(map[*Stmt]bool)
+		s.piped = make(map[*Stmt]bool)
+		s.compound = make(map[*Stmt]bool)
+	}
+}
+
+// convertTest converts the test command run by st, if it is one, as described
+// in ConvertTests.
+func (s *simplifier) convertTest(st *Stmt) {
+	if s.testsLang != LangPOSIX {
+		call, _ := st.Cmd.(*CallExpr)
+		if call == nil || len(call.Assigns) > 0 || len(call.Args) < 3 {
+			return
+		}
+		first, last := call.Args[0], call.Args[len(call.Args)-1]
+		if first.Lit() != "[" || last.Lit() != "]" {
+			return
+		}
+		x := bracketTest(call.Args[1 : len(call.Args)-1])
+		if x == nil {
+			return
+		}
+		st.Cmd = &TestClause{Left: first.Pos(), Right: last.Pos(), X: x}
+		s.modified = true
+		return
+	}
+	tc, _ := st.Cmd.(*TestClause)
+	if tc == nil {
+		return
+	}
+	res := posixTest(tc.X, tc.Left)
+	if res == nil {
+		return
+	}
+	s.modified = true
+	res.Negated = st.Negated != res.Negated
+	if _, ok := res.Cmd.(*BinaryCmd); ok && (res.Negated || s.grouped[st] ||
+		s.compound[st] || len(st.Redirs) > 0 || st.Background || st.Coprocess) {
+		inner := &Stmt{Position: res.Position, Cmd: res.Cmd}
+		res = &Stmt{Position: res.Position, Negated: res.Negated, Cmd: &Block{
+			Lbrace: tc.Left, Rbrace: tc.Right, Stmts: []*Stmt{inner},
+		}}
+	}
+	_, isCall := res.Cmd.(*CallExpr)
+	if (res.Negated && (s.piped[st] || s.compound[st])) || (isCall && s.compound[st]) {
+		res = &Stmt{Position: res.Position, Cmd: &Block{
+			Lbrace: tc.Left, Rbrace: tc.Right, Stmts: []*Stmt{res},
+		}}
+	}
+	st.Cmd, st.Negated = res.Cmd, res.Negated
+}
+
+// markTestGroups records which statements can't become a list or be negated
+// if their test clauses are converted to POSIX tests, as described in
+// convertTest.
+func (s *simplifier) markTestGroups(node Node) {
+	switch x := node.(type) {
+	case *BinaryCmd:
+		// "a || [[ b && c ]]" must become "a || { [ b ] && [ c ]; }",
+		// as && and || have the same precedence.
+		s.grouped[x.Y] = true
+		if x.Op == Pipe || x.Op == PipeAll {
+			s.grouped[x.X] = true
+			s.piped[x.X], s.piped[x.Y] = true, true
+		}
+	case *FuncDecl:
+		s.compound[x.Body] = true
+	case *TimeClause:
+		if x.Stmt != nil {
+			s.grouped[x.Stmt], s.piped[x.Stmt] = true, true
+		}
+	case *CoprocClause:
+		s.grouped[x.Stmt], s.piped[x.Stmt] = true, true
+	}
+}
+
+// bracketTest reads the arguments of a "[" command as a test expression, like
+// the test builtin does: depending on the number of arguments if there are at
+// most four, and by operator precedence otherwise. It returns nil if they can't
+// be converted to a test clause.
+func bracketTest(args []*Word) TestExpr {
+	switch len(args) {
+	case 1:
+		return nonEmptyTest(args[0])
+	case 2:
+		v := wordValue(args[0])
+		if v == "!" {
+			return notTest(args[0], bracketTest(args[1:]))
+		}
+		if op := testUnaryOp(v); op != 0 {
+			return unaryTest(args[0], op, args[1])
+		}
+		return nil
+	case 3:
+		switch v := wordValue(args[1]); v {
+		case "-a", "-o":
+			return logicalTest(bracketTest(args[:1]), args[1], bracketTest(args[2:]))
+		default:
+			if op := bracketBinaryOp(v); op != 0 {
+				return binaryTest(args[0], op, args[1], args[2])
+			}
+		}
+		if wordValue(args[0]) == "!" {
+			return notTest(args[0], bracketTest(args[1:]))
+		}
+		if wordValue(args[0]) == "(" && wordValue(args[2]) == ")" {
+			return bracketParen(args[0], bracketTest(args[1:2]), args[2])
+		}
+		return nil
+	case 4:
+		if wordValue(args[0]) == "!" {
+			return notTest(args[0], bracketTest(args[1:]))
+		}
+		if wordValue(args[0]) == "(" && wordValue(args[3]) == ")" {
+			return bracketParen(args[0], bracketTest(args[1:3]), args[3])
+		}
+		return nil
+	}
+	p := testArgsParser{args: args}
+	x := p.or()
+	if len(p.args) > 0 {
+		return nil
+	}
+	return x
+}
+
+// testArgsParser reads the arguments of a "[" command by operator precedence,
+// like Bash's test builtin does with more than four arguments.
+type testArgsParser struct {
+	args []*Word
+}
+
+func (p *testArgsParser) peek() string {
+	if len(p.args) == 0 {
+		return ""
+	}
+	return wordValue(p.args[0])
+}
+
+func (p *testArgsParser) next() *Word {
+	w := p.args[0]
+	p.args = p.args[1:]
+	return w
+}
+
+func (p *testArgsParser) or() TestExpr {
+	x := p.and()
+	for x != nil && p.peek() == "-o" {
+		op := p.next()
+		x = logicalTest(x, op, p.and())
+	}
+	return x
+}
+
+func (p *testArgsParser) and() TestExpr {
+	x := p.not()
+	for x != nil && p.peek() == "-a" {
+		op := p.next()
+		x = logicalTest(x, op, p.not())
+	}
+	return x
+}
+
+func (p *testArgsParser) not() TestExpr {
+	if p.peek() == "!" {
+		op := p.next()
+		return notTest(op, p.not())
+	}
+	return p.primary()
+}
+
+func (p *testArgsParser) primary() TestExpr {
+	if len(p.args) == 0 {
+		return nil
+	}
+	if p.peek() == "(" {
+		lparen := p.next()
+		x := p.or()
+		if x == nil || p.peek() != ")" {
+			return nil
+		}
+		return bracketParen(lparen, x, p.next())
+	}
+	if len(p.args) >= 3 {
+		if op := bracketBinaryOp(wordValue(p.args[1])); op != 0 {
+			x, opWord, y := p.next(), p.next(), p.next()
+			return binaryTest(x, op, opWord, y)
+		}
+	}
+	if op := testUnaryOp(p.peek()); op != 0 && op != TsNot && len(p.args) >= 2 {
+		opWord := p.next()
+		return unaryTest(opWord, op, p.next())
+	}
+	return nonEmptyTest(p.next())
+}
+
+// bracketBinaryOp is like testBinaryOp, but for the arguments of a "["
+// command, where "<" and ">" must be quoted and "=~" isn't supported.
+func bracketBinaryOp(val string) BinTestOperator {
+	switch val {
+	case "<":
+		return TsBefore
+	case ">":
+		return TsAfter
+	case "=", "==":
+		return TsMatch
+	case "=~":
+		return 0
+	}
+	return testBinaryOp(val)
+}
+
+func nonEmptyTest(w *Word) TestExpr {
+	if bracketOperand(w, false) == nil {
+		return nil
+	}
+	return &UnaryTest{OpPos: w.Pos(), Op: TsNempStr, X: w}
+}
+
+func notTest(op *Word, x TestExpr) TestExpr {
+	if x == nil {
+		return nil
+	}
+	return &UnaryTest{OpPos: op.Pos(), Op: TsNot, X: x}
+}
+
+func unaryTest(op *Word, tok UnTestOperator, x *Word) TestExpr {
+	if bracketOperand(x, false) == nil {
+		return nil
+	}
+	return &UnaryTest{OpPos: op.Pos(), Op: tok, X: x}
+}
+
+func binaryTest(x *Word, tok BinTestOperator, op, y *Word) TestExpr {
+	switch tok {
+	case TsEql, TsNeq, TsLeq, TsGeq, TsLss, TsGtr:
+		// [[ ]] evaluates these operands as arithmetic expressions,
+		// which can run commands from the value of a parameter like
+		// 'a[$(cmd)]'. Only integers mean the same to both.
+		if !intLiteral(x) || !intLiteral(y) {
+			return nil
+		}
+	}
+	pattern := tok == TsMatch || tok == TsNoMatch
+	if x, y = bracketOperand(x, false), bracketOperand(y, pattern); x == nil || y == nil {
+		return nil
+	}
+	return &BinaryTest{OpPos: op.Pos(), Op: tok, X: x, Y: y}
+}
+
+func logicalTest(x TestExpr, op *Word, y TestExpr) TestExpr {
+	if x == nil || y == nil {
+		return nil
+	}
+	tok := AndTest
+	if wordValue(op) == "-o" {
+		tok = OrTest
+	}
+	return &BinaryTest{OpPos: op.Pos(), Op: tok, X: x, Y: y}
+}
+
+func bracketParen(lparen *Word, x TestExpr, rparen *Word) TestExpr {
+	if x == nil {
+		return nil
+	}
+	return &ParenTest{Lparen: lparen.Pos(), Rparen: rparen.Pos(), X: x}
+}
+
+// bracketOperand prepares an argument of a "[" command to be used in a test
+// clause, returning nil if its meaning would change more than by not being
+// split. If pattern is true, the word is used as a pattern, so a copy of it is
+// returned with its expansions quoted, to keep comparing them as strings.
+func bracketOperand(w *Word, pattern bool) *Word {
+	if !singleField(w) {
+		return nil
+	}
+	if lit := w.Lit(); testUnaryOp(lit) != 0 || testBinaryOp(lit) != 0 {
+		return nil // would be an operator in a test clause
+	}
+	for _, part := range w.Parts {
+		if lit, ok := part.(*Lit); ok && hasGlobChars(lit.Value, true) {
+			// globbed or brace-expanded by "["
+			return nil
+		}
+	}
+	if pattern {
+		return quoteExpansions(w)
+	}
+	return w
+}
+
+// posixTest converts a test expression to a statement running an equivalent
+// POSIX test command, or returns nil if there isn't one. pos is used for the
+// nodes which don't have an equivalent in the test expression.
+func posixTest(x TestExpr, pos Pos) *Stmt {
+	switch x := x.(type) {
+	case *ParenTest:
+		return posixTest(x.X, pos)
+	case *Word:
+		w := posixOperand(x)
+		if w == nil {
+			return nil
+		}
+		return bracketStmt(pos, posLitWord(x.Pos(), "-n"), w)
+	case *UnaryTest:
+		if x.Op == TsNot {
+			st := posixTest(x.X, pos)
+			if st == nil {
+				return nil
+			}
+			if call, ok := st.Cmd.(*CallExpr); ok && !st.Negated {
+				args := append([]*Word{call.Args[0], posLitWord(x.OpPos, "!")}, call.Args[1:]...)
+				call.Args = args
+				return st
+			}
+			if _, ok := st.Cmd.(*BinaryCmd); ok {
+				st = &Stmt{Position: st.Position, Cmd: &Block{
+					Lbrace: pos, Rbrace: pos, Stmts: []*Stmt{st},
+				}}
+			}
+			st.Negated = !st.Negated
+			return st
+		}
+		switch x.Op {
+		case TsSticky, TsGrpOwn, TsUsrOwn, TsModif, TsOptSet, TsVarSet, TsRefVar:
+			return nil // not in POSIX
+		}
+		w, _ := x.X.(*Word)
+		if w = posixOperand(w); w == nil {
+			return nil
+		}
+		return bracketStmt(pos, posLitWord(x.OpPos, x.Op.String()), w)
+	case *BinaryTest:
+		switch x.Op {
+		case AndTest, OrTest:
+			left, right := posixTest(x.X, pos), posixTest(x.Y, pos)
+			if left == nil || right == nil {
+				return nil
+			}
+			if _, ok := right.Cmd.(*BinaryCmd); ok || right.Negated {
+				right = &Stmt{Position: right.Position, Cmd: &Block{
+					Lbrace: pos, Rbrace: pos, Stmts: []*Stmt{right},
+				}}
+			}
+			op := AndStmt
+			if x.Op == OrTest {
+				op = OrStmt
+			}
+			return &Stmt{Position: left.Position, Cmd: &BinaryCmd{
+				OpPos: x.OpPos, Op: op, X: left, Y: right,
+			}}
+		case TsReMatch, TsBefore, TsAfter:
+			return nil // not in POSIX
+		}
+		xw, _ := x.X.(*Word)
+		yw, _ := x.Y.(*Word)
+		if xw == nil || yw == nil {
+			return nil
+		}
+		switch x.Op {
+		case TsMatchShort, TsMatch, TsNoMatch:
+			if !literalPattern(yw) {
+				return casePatternTest(pos, xw, yw, x.Op == TsNoMatch)
+			}
+		case TsEql, TsNeq, TsLeq, TsGeq, TsLss, TsGtr:
+			// [[ ]] evaluates these operands as arithmetic
+			// expressions; only simple ones mean the same to [.
+			if !arithmOperand(xw) || !arithmOperand(yw) {
+				return nil
+			}
+		}
+		if xw, yw = posixOperand(xw), posixOperand(yw); xw == nil || yw == nil {
+			return nil
+		}
+		op := x.Op.String()
+		switch x.Op {
+		case TsMatchShort, TsMatch:
+			op = "="
+		}
+		return bracketStmt(pos, xw, posLitWord(x.OpPos, op), yw)
+	}
+	return nil
+}
+
+// casePatternTest returns a case clause which succeeds if x matches the
+// pattern, or doesn't match it if negated is true.
+func casePatternTest(pos Pos, x, pattern *Word, negated bool) *Stmt {
+	if !singleField(x) || !singleField(pattern) || hasExtGlob(x) || hasExtGlob(pattern) {
+		return nil
+	}
+	match, other := "true", "false"
+	if negated {
+		match, other = other, match
+	}
+	return &Stmt{Position: pos, Cmd: &CaseClause{
+		Case: pos, Esac: pos, Word: x,
+		Items: []*CaseItem{
+			{Op: Break, OpPos: pos, Patterns: []*Word{pattern}, Stmts: []*Stmt{
+				{Position: pos, Cmd: &CallExpr{Args: []*Word{posLitWord(pos, match)}}},
+			}},
+			{Op: Break, OpPos: pos, Patterns: []*Word{posLitWord(pos, "*")}, Stmts: []*Stmt{
+				{Position: pos, Cmd: &CallExpr{Args: []*Word{posLitWord(pos, other)}}},
+			}},
+		},
+	}}
+}
+
+// bracketStmt returns a statement running "[ args... ]".
+func bracketStmt(pos Pos, args ...*Word) *Stmt {
+	words := make([]*Word, 0, len(args)+2)
+	words = append(words, posLitWord(pos, "["))
+	words = append(words, args...)
+	words = append(words, posLitWord(args[len(args)-1].End(), "]"))
+	return &Stmt{Position: pos, Cmd: &CallExpr{Args: words}}
+}
+
+func posLitWord(pos Pos, val string) *Word {
+	return &Word{Parts: []WordPart{&Lit{ValuePos: pos, ValueEnd: pos, Value: val}}}
+}
+
+// posixOperand prepares an operand of a test clause to be used as an argument
+// of a "[" command, quoting its expansions and globbing characters so that it's
+// still a single field. The word is copied if it needs any quotes. It returns
+// nil if that isn't possible.
+func posixOperand(w *Word) *Word {
+	if w == nil || !singleField(w) || hasExtGlob(w) {
+		return nil
+	}
+	needQuotes := false
+	for _, part := range w.Parts {
+		switch part := part.(type) {
+		case *Lit:
+			if hasGlobChars(part.Value, true) {
+				needQuotes = true
+			}
+		case *ParamExp, *CmdSubst, *ArithmExp:
+			needQuotes = true
+		}
+	}
+	if !needQuotes {
+		return w
+	}
+	// Try quoting the whole word, to not end up with many quotes.
+	var parts []WordPart
+	for i, part := range w.Parts {
+		switch part := part.(type) {
+		case *Lit:
+			if strings.ContainsAny(part.Value, "\\\"$`") ||
+				(i == 0 && strings.HasPrefix(part.Value, "~")) {
+				parts = nil
+			} else {
+				parts = append(parts, part)
+				continue
+			}
+		case *ParamExp, *CmdSubst, *ArithmExp:
+			parts = append(parts, part)
+			continue
+		case *DblQuoted:
+			if !part.Dollar {
+				parts = append(parts, part.Parts...)
+				continue
+			}
+		}
+		parts = nil
+		break
+	}
+	if parts != nil {
+		return &Word{Parts: []WordPart{
+			&DblQuoted{Left: w.Pos(), Right: w.End(), Parts: parts},
+		}}
+	}
+	for _, part := range w.Parts {
+		if lit, ok := part.(*Lit); ok && hasGlobChars(lit.Value, true) {
+			return nil
+		}
+	}
+	return quoteExpansions(w)
+}
+
+// quoteExpansions returns a copy of a word with its unquoted expansions wrapped
+// in double quotes.
+func quoteExpansions(w *Word) *Word {
+	parts := make([]WordPart, len(w.Parts))
+	for i, part := range w.Parts {
+		switch part.(type) {
+		case *ParamExp, *CmdSubst, *ArithmExp:
+			part = &DblQuoted{Left: part.Pos(), Right: part.End(), Parts: []WordPart{part}}
+		}
+		parts[i] = part
+	}
+	return &Word{Parts: parts}
+}
+
+// literalPattern reports whether a pattern only matches itself, as it has no
+// unquoted globbing characters nor expansions.
+func literalPattern(w *Word) bool {
+	for _, part := range w.Parts {
+		switch part := part.(type) {
+		case *Lit:
+			if hasGlobChars(part.Value, false) {
+				return false
+			}
+		case *SglQuoted, *DblQuoted:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// arithmOperand reports whether a word means the same as an operand of an
+// arithmetic test in "[[ ]]" and in "[": an integer or a parameter.
+func arithmOperand(w *Word) bool {
+	if intLiteral(w) {
+		return true
+	}
+	if len(w.Parts) != 1 {
+		return false
+	}
+	part := w.Parts[0]
+	if dq, ok := part.(*DblQuoted); ok && len(dq.Parts) == 1 {
+		part = dq.Parts[0]
+	}
+	pe, ok := part.(*ParamExp)
+	return ok && pe.Exp == nil && pe.Repl == nil && pe.Slice == nil && !pe.Length
+}
+
+// intLiteral reports whether a word is an integer literal, like "3" or "-1".
+func intLiteral(w *Word) bool {
+	lit := strings.TrimPrefix(w.Lit(), "-")
+	return lit != "" && strings.Trim(lit, "0123456789") == ""
+}
+
+// singleField reports whether a word expands to a single field when it's not
+// split, unlike "$@" or "${a[@]}".
+func singleField(w *Word) bool {
+	single := true
+	Walk(w, func(node Node) bool {
+		switch x := node.(type) {
+		case *ParamExp:
+			if x.Param != nil && (x.Param.Value == "@" || x.Param.Value == "*") {
+				single = false
+			}
+			if x.Names != 0 {
+				single = false
+			}
+			if idx, ok := x.Index.(*Word); ok {
+				if lit := idx.Lit(); lit == "@" || lit == "*" {
+					single = false
+				}
+			}
+		case *CmdSubst, *ProcSubst, *ArithmExp:
+			return false // nested words don't matter
+		}
+		return single
+	})
+	return single
+}
+
+func hasExtGlob(w *Word) bool {
+	for _, part := range w.Parts {
+		if _, ok := part.(*ExtGlob); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// hasGlobChars reports whether an unquoted literal has any unescaped globbing
+// characters. If braces is true, braces count too, as they could be part of a
+// brace expansion.
+func hasGlobChars(s string, braces bool) bool {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '*', '?', '[':
+			return true
+		case '{':
+			if braces {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// wordValue returns the string that a word expands to if it has no expansions,
+// like an operator given to a "[" command, or the empty string otherwise.
+func wordValue(w *Word) string {
+	var b strings.Builder
+	for _, part := range w.Parts {
+		switch part := part.(type) {
+		case *Lit:
+			for i := 0; i < len(part.Value); i++ {
+				c := part.Value[i]
+				if c == '\\' && i+1 < len(part.Value) {
+					i++
+					c = part.Value[i]
+				}
+				b.WriteByte(c)
+			}
+		case *SglQuoted:
+			if part.Dollar {
+				return ""
+			}
+			b.WriteString(part.Value)
+		case *DblQuoted:
+			if part.Dollar || len(part.Parts) > 1 {
+				return ""
+			}
+			if len(part.Parts) == 1 {
+				lit, ok := part.Parts[0].(*Lit)
+				if !ok || strings.Contains(lit.Value, "\\") {
+					return ""
+				}
+				b.WriteString(lit.Value)
+			}
+		default:
+			return ""
+		}
+	}
+	return b.String()
+}
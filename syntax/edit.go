@@ -0,0 +1,396 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"unicode/utf8"
+)
+
+// TextEdit replaces the source bytes between the offsets Start and End with
+// NewText. If Start equals End, the edit is an insertion.
+type TextEdit struct {
+	Start, End uint
+	NewText    string
+}
+
+// ApplyEdits returns a copy of src with the edits applied. The edits may be
+// in any order, but they must not overlap, and their offsets must not split a
+// multibyte rune. Insertions at the same offset are applied in the order they
+// were given.
+func ApplyEdits(src []byte, edits []TextEdit) ([]byte, error) {
+	sorted, err := sortEdits(src, edits)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	last := uint(0)
+	for _, e := range sorted {
+		buf.Write(src[last:e.Start])
+		buf.WriteString(e.NewText)
+		last = e.End
+	}
+	buf.Write(src[last:])
+	return buf.Bytes(), nil
+}
+
+func sortEdits(src []byte, edits []TextEdit) ([]TextEdit, error) {
+	for i, e := range edits {
+		if e.Start > e.End || e.End > uint(len(src)) {
+			return nil, fmt.Errorf("edit %d: invalid range %d-%d", i, e.Start, e.End)
+		}
+		for _, offs := range [...]uint{e.Start, e.End} {
+			if offs < uint(len(src)) && !utf8.RuneStart(src[offs]) {
+				return nil, fmt.Errorf("edit %d: offset %d splits a rune", i, offs)
+			}
+		}
+	}
+	sorted := append([]TextEdit(nil), edits...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Start != sorted[j].Start {
+			return sorted[i].Start < sorted[j].Start
+		}
+		// insertions go first, as they don't overlap a replacement
+		// starting at the same offset
+		return sorted[i].End < sorted[j].End
+	})
+	for i := 1; i < len(sorted); i++ {
+		if prev, e := sorted[i-1], sorted[i]; e.Start < prev.End {
+			return nil, fmt.Errorf("edits %d-%d and %d-%d overlap",
+				prev.Start, prev.End, e.Start, e.End)
+		}
+	}
+	return sorted, nil
+}
+
+// ShiftPositions updates the positions in f to match its source after applying
+// edits to it, so that it can still be used without parsing the new source.
+// f must have been parsed with RetainSource, and its Src is replaced with the
+// edited source. Node values such as the literal of a Lit are not changed.
+//
+// A node starting at the same offset as an insertion is moved after the new
+// text, while a Lit ending there keeps its ValueEnd before it. Positions within
+// replaced text are moved to the start of their replacement, apart from the
+// ValueEnd of a Lit, which is moved to its end.
+//
+// The edits must be valid as described in ApplyEdits; ShiftPositions panics
+// otherwise.
+func ShiftPositions(f *File, edits []TextEdit) {
+	if f.Src == nil {
+		panic("syntax.ShiftPositions: the File was not parsed with RetainSource")
+	}
+	sorted, err := sortEdits(f.Src, edits)
+	if err != nil {
+		panic(fmt.Sprintf("syntax.ShiftPositions: %v", err))
+	}
+	src, _ := ApplyEdits(f.Src, sorted)
+	s := newPosShifter(f.Src, src, sorted)
+	mapPositions(reflect.ValueOf(f).Elem(), s.pos)
+	for i, h := range f.hdocs {
+		f.hdocs[i] = s.hdoc(h)
+	}
+	f.Src = src
+}
+
+// Edit applies edits to the source of f and updates f to match, as if the
+// edited source had been parsed again with p. Only the top-level statements
+// touched by the edits are parsed again; the ones before them are kept as they
+// were, and the ones after them are kept with their positions shifted as
+// described in ShiftPositions. This is useful to keep a syntax tree up to date
+// while a file is being edited, such as in an editor.
+//
+// f must have been parsed with RetainSource and with the same options as p.
+// Its Src is replaced with the edited source. If the edited source fails to
+// parse, or the edits are not valid as described in ApplyEdits, an error is
+// returned and f is left unchanged.
+func (p *Parser) Edit(f *File, edits []TextEdit) error {
+	if f.Src == nil {
+		return fmt.Errorf("the File was not parsed with RetainSource")
+	}
+	sorted, err := sortEdits(f.Src, edits)
+	if err != nil {
+		return err
+	}
+	if len(sorted) == 0 {
+		return nil
+	}
+	src, _ := ApplyEdits(f.Src, sorted)
+	retain := p.retainSource
+	p.retainSource = true
+	defer func() { p.retainSource = retain }()
+	if p.stopAt == nil && p.editStmts(f, sorted, src) {
+		return nil
+	}
+	newFile, err := p.Parse(bytes.NewReader(src), f.Name)
+	if err != nil {
+		return err
+	}
+	*f = *newFile
+	return nil
+}
+
+// editStmts updates f to match src by parsing again only the top-level
+// statements touched by the sorted edits. It reports whether it succeeded; if
+// it did not, f is left unchanged and the whole source must be parsed again.
+func (p *Parser) editStmts(f *File, edits []TextEdit, src []byte) bool {
+	stmts := f.Stmts
+	if len(stmts) == 0 {
+		return false
+	}
+	lo, hi := edits[0].Start, edits[len(edits)-1].End
+
+	// The source parsed again goes from the start of the line of stmts[i]
+	// up to the start of the line of stmts[j], or to the end of the file.
+	i, start := 0, uint(0)
+	for k := 1; k < len(stmts); k++ {
+		offs, ok := f.stmtLineStart(stmts[k])
+		if offs > lo {
+			break
+		}
+		if ok {
+			i, start = k, offs
+		}
+	}
+	delta := len(src) - len(f.Src)
+	for j := i + 1; j <= len(stmts); j++ {
+		end := uint(len(f.Src))
+		if j < len(stmts) {
+			offs, ok := f.stmtLineStart(stmts[j])
+			if !ok || offs <= hi {
+				continue
+			}
+			end = offs
+		}
+		newEnd := uint(int(end) + delta)
+		if j < len(stmts) && continuedLine(src, newEnd) {
+			continue
+		}
+		part, err := p.Parse(bytes.NewReader(src[start:newEnd]), f.Name)
+		if err != nil {
+			// The edits might have opened a quote or a block which
+			// only ends further down; let a full parse tell.
+			return false
+		}
+		if j < len(stmts) && len(part.Last) > 0 {
+			continue // the comments would belong to stmts[j]
+		}
+
+		s := newPosShifter(f.Src, src, edits)
+		line, _ := lineCol(s.lines, start)
+		mapPositions(reflect.ValueOf(part).Elem(), func(pos Pos, end bool) Pos {
+			if pos.IsValid() {
+				pos.offs += uint32(start)
+				pos.line += uint16(line - 1)
+			}
+			return pos
+		})
+		after := stmts[j:]
+		mapPositions(reflect.ValueOf(after), s.pos)
+		last := part.Last
+		if j < len(stmts) {
+			last = f.Last
+			mapPositions(reflect.ValueOf(last), s.pos)
+		}
+
+		var hdocs []hdocSource
+		for _, h := range f.hdocs {
+			if uint(h.start) < start {
+				hdocs = append(hdocs, h)
+			}
+		}
+		for _, h := range part.hdocs {
+			h.start += uint32(start)
+			h.end += uint32(start)
+			hdocs = append(hdocs, h)
+		}
+		for _, h := range f.hdocs {
+			if uint(h.start) >= end {
+				hdocs = append(hdocs, s.hdoc(h))
+			}
+		}
+
+		var newStmts []*Stmt
+		if n := i + len(part.Stmts) + len(after); n > 0 {
+			newStmts = make([]*Stmt, 0, n)
+			newStmts = append(newStmts, stmts[:i]...)
+			newStmts = append(newStmts, part.Stmts...)
+			newStmts = append(newStmts, after...)
+		}
+		f.Stmts, f.Last = newStmts, last
+		f.Src, f.hdocs = src, hdocs
+		f.parents = nil
+		if p.keepParents {
+			f.UpdateParents()
+		}
+		return true
+	}
+	return false
+}
+
+// stmtLineStart returns the offset of the start of the line where a top-level
+// statement begins, including its leading comments. It also reports whether a
+// parse may start there, meaning that the statement is the first on its line,
+// the previous line isn't continued, and the line isn't part of a heredoc.
+func (f *File) stmtLineStart(s *Stmt) (uint, bool) {
+	start := uint(s.Pos().offs)
+	for _, c := range s.Comments {
+		if offs := uint(c.Pos().offs); offs < start {
+			start = offs
+		}
+	}
+	for start > 0 && (f.Src[start-1] == ' ' || f.Src[start-1] == '\t') {
+		start--
+	}
+	if start == 0 {
+		return 0, true
+	}
+	if f.Src[start-1] != '\n' || continuedLine(f.Src, start) {
+		return start, false
+	}
+	for _, h := range f.hdocs {
+		if uint(h.start) < start && start <= uint(h.end) {
+			return start, false
+		}
+	}
+	return start, true
+}
+
+// continuedLine reports whether the line before the one starting at offs ends
+// with a line continuation.
+func continuedLine(src []byte, offs uint) bool {
+	bslashes := 0
+	for i := int(offs) - 2; i >= 0 && src[i] == '\\'; i-- {
+		bslashes++
+	}
+	return bslashes%2 == 1
+}
+
+type posShifter struct {
+	edits  []TextEdit // sorted
+	deltas []int      // deltas[i] is the size change of edits[:i]
+
+	// offsets at which lines start in the old and new source
+	oldLines, lines []uint
+}
+
+func newPosShifter(oldSrc, src []byte, sorted []TextEdit) *posShifter {
+	s := &posShifter{edits: sorted}
+	s.deltas = make([]int, len(sorted)+1)
+	for i, e := range sorted {
+		s.deltas[i+1] = s.deltas[i] + len(e.NewText) - int(e.End-e.Start)
+	}
+	s.oldLines = lineStarts(oldSrc)
+	s.lines = lineStarts(src)
+	return s
+}
+
+func lineStarts(src []byte) []uint {
+	lines := []uint{0}
+	for i, b := range src {
+		if b == '\n' {
+			lines = append(lines, uint(i+1))
+		}
+	}
+	return lines
+}
+
+// lineCol returns the line and column of an offset, given the offsets at which
+// lines start.
+func lineCol(lines []uint, offs uint) (line, col int) {
+	line = sort.Search(len(lines), func(i int) bool {
+		return lines[i] > offs
+	})
+	return line, int(offs-lines[line-1]) + 1
+}
+
+// offset maps an offset in the old source to one in the new source. If end is
+// true, the offset is the end of a range, so it stays before any insertions at
+// the same offset.
+func (s *posShifter) offset(offs uint, end bool) uint {
+	i := sort.Search(len(s.edits), func(i int) bool {
+		if end {
+			return s.edits[i].End >= offs
+		}
+		return s.edits[i].End > offs
+	})
+	if i < len(s.edits) && s.edits[i].Start < offs {
+		if end {
+			return uint(int(s.edits[i].End) + s.deltas[i+1])
+		}
+		offs = s.edits[i].Start
+	}
+	return uint(int(offs) + s.deltas[i])
+}
+
+func (s *posShifter) pos(p Pos, end bool) Pos {
+	if !p.IsValid() {
+		return p
+	}
+	// The parser doesn't always count columns by bytes, such as within
+	// backquotes or after escaped newlines, so keep any such difference.
+	oldLine, oldCol := lineCol(s.oldLines, uint(p.offs))
+	offs := s.offset(uint(p.offs), end)
+	line, col := lineCol(s.lines, offs)
+	p.offs = uint32(offs)
+	p.line = uint16(line + int(p.line) - oldLine)
+	p.col = uint16(col + int(p.col) - oldCol)
+	return p
+}
+
+func (s *posShifter) hdoc(h hdocSource) hdocSource {
+	h.start = uint32(s.offset(uint(h.start), false))
+	h.end = uint32(s.offset(uint(h.end), true))
+	return h
+}
+
+var posType = reflect.TypeOf(Pos{})
+
+// mapPositions replaces each position reachable from v with the result of
+// calling fn on it. end is true for positions ending a range, such as the
+// ValueEnd of a Lit.
+func mapPositions(v reflect.Value, fn func(p Pos, end bool) Pos) {
+	m := posMapper{fn: fn, seen: make(map[uintptr]bool)}
+	m.walk(v, false)
+}
+
+type posMapper struct {
+	fn   func(p Pos, end bool) Pos
+	seen map[uintptr]bool
+}
+
+func (m *posMapper) walk(v reflect.Value, end bool) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() || m.seen[v.Pointer()] {
+			return
+		}
+		m.seen[v.Pointer()] = true
+		m.walk(v.Elem(), false)
+	case reflect.Interface:
+		if !v.IsNil() {
+			m.walk(v.Elem(), false)
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return // File.Src
+		}
+		for i := 0; i < v.Len(); i++ {
+			m.walk(v.Index(i), false)
+		}
+	case reflect.Struct:
+		if v.Type() == posType {
+			v.Set(reflect.ValueOf(m.fn(v.Interface().(Pos), end)))
+			return
+		}
+		for i := 0; i < v.NumField(); i++ {
+			field := v.Type().Field(i)
+			if field.PkgPath == "" { // exported
+				m.walk(v.Field(i), field.Name == "ValueEnd")
+			}
+		}
+	}
+}
@@ -0,0 +1,422 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+var applyEditsTests = []struct {
+	src     string
+	edits   []TextEdit
+	want    string
+	wantErr string
+}{
+	{"foo", nil, "foo", ""},
+	{"foo", []TextEdit{{0, 0, "bar "}}, "bar foo", ""},
+	{"foo", []TextEdit{{3, 3, " bar"}}, "foo bar", ""},
+	{"foo bar", []TextEdit{{4, 7, `"$x"`}}, `foo "$x"`, ""},
+	{"foo bar", []TextEdit{{3, 4, ""}, {3, 3, "-"}}, "foo-bar", ""},
+	{
+		"foo bar baz",
+		[]TextEdit{{8, 11, "3"}, {0, 3, "1"}, {4, 7, "2"}},
+		"1 2 3", "",
+	},
+	{
+		"foo",
+		[]TextEdit{{0, 0, "a"}, {0, 0, "b"}, {0, 3, "c"}},
+		"abc", "",
+	},
+	{"foo", []TextEdit{{2, 1, ""}}, "", "edit 0: invalid range 2-1"},
+	{"foo", []TextEdit{{0, 4, ""}}, "", "edit 0: invalid range 0-4"},
+	{
+		"foo bar",
+		[]TextEdit{{0, 5, "x"}, {4, 7, "y"}},
+		"", "edits 0-5 and 4-7 overlap",
+	},
+	{
+		"foo bar",
+		[]TextEdit{{0, 5, "x"}, {2, 2, "y"}},
+		"", "edits 0-5 and 2-2 overlap",
+	},
+	{"echo é", []TextEdit{{6, 7, "e"}}, "", "edit 0: offset 6 splits a rune"},
+	{"echo é", []TextEdit{{5, 6, "e"}}, "", "edit 0: offset 6 splits a rune"},
+	{"echo é", []TextEdit{{5, 7, "e"}}, "echo e", ""},
+}
+
+func TestApplyEdits(t *testing.T) {
+	t.Parallel()
+	for i, tc := range applyEditsTests {
+		t.Run(fmt.Sprintf("%02d", i), func(t *testing.T) {
+			got, err := ApplyEdits([]byte(tc.src), tc.edits)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("want error %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tc.want {
+				t.Fatalf("want %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+// insertBefore returns an insertion of text before the first occurrence of
+// the substring at in src.
+func insertBefore(src, at, text string) TextEdit {
+	i := strings.Index(src, at)
+	if i < 0 {
+		panic(fmt.Sprintf("%q not in %q", at, src))
+	}
+	return TextEdit{uint(i), uint(i), text}
+}
+
+// replace returns an edit replacing the first occurrence of old in src.
+func replace(src, old, text string) TextEdit {
+	i := strings.Index(src, old)
+	if i < 0 {
+		panic(fmt.Sprintf("%q not in %q", old, src))
+	}
+	return TextEdit{uint(i), uint(i + len(old)), text}
+}
+
+const shiftSrc = `#!/bin/sh
+foo() {
+	cat <<-EOF <<BAR
+		body $x
+		é ${y}
+	EOF
+	bar
+	$(baz)
+BAR
+	echo "$x" \
+		'é' $((1 + 2))
+}
+case $1 in
+a) foo | tr a b ;;
+esac
+`
+
+func TestShiftPositions(t *testing.T) {
+	t.Parallel()
+	src := shiftSrc
+	// The edits keep the structure of the program, so that the shifted
+	// positions can be compared with a fresh parse of the new source.
+	tests := [][]TextEdit{
+		{{0, 0, "\n"}},
+		{insertBefore(src, "foo()", "\n\n")},
+		{
+			replace(src, "foo", "longer_name"),
+			insertBefore(src, "cat", "\n\t"),
+		},
+		// inside and around the heredoc bodies
+		{
+			replace(src, "body", "a\nlonger\n\t\tbody"),
+			replace(src, "é ", ""),
+			insertBefore(src, "\n\t$(baz)", "\n"),
+			insertBefore(src, ")\nBAR", "  \\\n  "),
+			insertBefore(src, "\techo", "\n"),
+		},
+		// line continuations
+		{
+			replace(src, "\\\n\t\t'", "'"),
+			insertBefore(src, "$((", "\\\n"),
+			replace(src, "+ ", "+\n"),
+		},
+		{
+			insertBefore(src, " a b", " \\\n\t"),
+			insertBefore(src, "esac", "\n\n\n"),
+			{uint(len(src)), uint(len(src)), "\n\n"},
+		},
+	}
+	p := NewParser(RetainSource(true))
+	for i, edits := range tests {
+		t.Run(fmt.Sprintf("%02d", i), func(t *testing.T) {
+			f, err := p.Parse(strings.NewReader(src), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			newSrc, err := ApplyEdits(f.Src, edits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ShiftPositions(f, edits)
+			if string(f.Src) != string(newSrc) {
+				t.Fatalf("Src was not updated:\n%s", f.Src)
+			}
+			want, err := p.Parse(strings.NewReader(string(newSrc)), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := samePositions(reflect.ValueOf(f), reflect.ValueOf(want), "File"); err != nil {
+				t.Fatalf("%v in:\n%s", err, newSrc)
+			}
+			for i, h := range f.hdocs {
+				wh := want.hdocs[i]
+				if h.start != wh.start || h.end != wh.end {
+					t.Fatalf("heredoc %d: got span %d-%d, want %d-%d in:\n%s",
+						i, h.start, h.end, wh.start, wh.end, newSrc)
+				}
+			}
+		})
+	}
+	t.Run("FileTests", func(t *testing.T) {
+		edits := []TextEdit{{0, 0, "\n# comment\n"}}
+		for i, c := range fileTests {
+			p := NewParser(Variant(LangBash), RetainSource(true))
+			if c.Bash == nil {
+				p = NewParser(Variant(LangPOSIX), RetainSource(true))
+				if c.MirBSDKorn != nil {
+					p = NewParser(Variant(LangMirBSDKorn), RetainSource(true))
+				}
+			}
+			for j, in := range c.Strs {
+				if in == "" {
+					continue // no source is retained
+				}
+				f, err := p.Parse(strings.NewReader(in), "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				ShiftPositions(f, edits)
+				want, err := p.Parse(strings.NewReader(string(f.Src)), "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				path := fmt.Sprintf("%03d-%d", i, j)
+				if err := samePositions(reflect.ValueOf(f), reflect.ValueOf(want), path); err != nil {
+					t.Fatalf("%v in %q", err, in)
+				}
+			}
+		}
+	})
+}
+
+// samePositions checks that two syntax trees have the same shape and
+// positions. Values such as the literal of a Lit are not compared.
+func samePositions(x, y reflect.Value, path string) error {
+	if x.Type() != y.Type() {
+		return fmt.Errorf("%s: %s vs %s", path, x.Type(), y.Type())
+	}
+	switch x.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if x.IsNil() || y.IsNil() {
+			if x.IsNil() != y.IsNil() {
+				return fmt.Errorf("%s: nil mismatch", path)
+			}
+			return nil
+		}
+		return samePositions(x.Elem(), y.Elem(), path)
+	case reflect.Slice:
+		if x.Type().Elem().Kind() == reflect.Uint8 {
+			return nil
+		}
+		if x.Len() != y.Len() {
+			return fmt.Errorf("%s: length %d vs %d", path, x.Len(), y.Len())
+		}
+		for i := 0; i < x.Len(); i++ {
+			if err := samePositions(x.Index(i), y.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		if x.Type() == posType {
+			px, py := x.Interface().(Pos), y.Interface().(Pos)
+			if px != py {
+				return fmt.Errorf("%s: got %d:%d (offset %d), want %d:%d (offset %d)", path,
+					px.Line(), px.Col(), px.Offset(), py.Line(), py.Col(), py.Offset())
+			}
+			return nil
+		}
+		for i := 0; i < x.NumField(); i++ {
+			if x.Type().Field(i).PkgPath != "" {
+				continue
+			}
+			fpath := path + "." + x.Type().Field(i).Name
+			if err := samePositions(x.Field(i), y.Field(i), fpath); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+const editSrc = `#!/bin/bash
+# leading comment
+foo() {
+	cat <<-EOF
+		body $x
+	EOF
+}
+
+echo "multi
+line" 'single
+quoted' # trailing
+
+if true; then
+	bar \
+		--flag
+fi
+
+cat <<EOF | grep é
+EOF
+EOF
+x=(a b
+	c) y=$((1 +
+	2)); echo $x
+for i in 1 2; do echo $i; done
+# last comment
+`
+
+var editTexts = []string{
+	"", "\n", "\n\n", " ", "x", "foo ", ";", "&&", "|", "#", "# c\n", "\\",
+	"\\\n", "'", "\"", "$(", ")", "{ ", "}", "<<EOF\n", "EOF\n", "fi\n",
+	"if true; then\n", "$x", "é",
+}
+
+func TestParserEdit(t *testing.T) {
+	t.Parallel()
+	rnd := rand.New(rand.NewSource(1))
+	p := NewParser(KeepComments(true), RetainSource(true))
+	f, err := p.Parse(strings.NewReader(editSrc), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	offset := func(src []byte) uint {
+		offs := uint(rnd.Intn(len(src) + 1))
+		for offs < uint(len(src)) && !utf8.RuneStart(src[offs]) {
+			offs++
+		}
+		return offs
+	}
+	for i := 0; i < 2000; i++ {
+		var edits []TextEdit
+		for n := rnd.Intn(2) + 1; len(edits) < n; {
+			start := offset(f.Src)
+			end := start
+			if rnd.Intn(2) == 0 {
+				end = offset(f.Src[start:]) / 4
+				end += start
+				for end < uint(len(f.Src)) && !utf8.RuneStart(f.Src[end]) {
+					end++
+				}
+			}
+			e := TextEdit{start, end, editTexts[rnd.Intn(len(editTexts))]}
+			if _, err := sortEdits(f.Src, append(edits, e)); err == nil {
+				edits = append(edits, e)
+			}
+		}
+		oldSrc := f.Src
+		newSrc, err := ApplyEdits(f.Src, edits)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, wantErr := p.Parse(bytes.NewReader(newSrc), "")
+		err = p.Edit(f, edits)
+		if (err == nil) != (wantErr == nil) {
+			t.Fatalf("got error %v, want %v, in:\n%s", err, wantErr, newSrc)
+		}
+		if err != nil {
+			if string(f.Src) != string(oldSrc) {
+				t.Fatalf("File changed after an error")
+			}
+			continue
+		}
+		if err := sameTree(reflect.ValueOf(f), reflect.ValueOf(want), "File"); err != nil {
+			t.Fatalf("%v in:\n%s", err, newSrc)
+		}
+		if rnd.Intn(100) == 0 {
+			// start over, so that the source doesn't degrade
+			if f, err = p.Parse(strings.NewReader(editSrc), ""); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestParserEditReuse(t *testing.T) {
+	t.Parallel()
+	p := NewParser(RetainSource(true))
+	src := "foo\nbar \\\n\tbaz\ncat <<EOF\nbody\nEOF\nlast"
+	f, err := p.Parse(strings.NewReader(src), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, third, last := f.Stmts[0], f.Stmts[2], f.Stmts[3]
+	if err := p.Edit(f, []TextEdit{replace(src, "baz", "a\nb")}); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Stmts) != 5 {
+		t.Fatalf("want 5 statements, got %d", len(f.Stmts))
+	}
+	if f.Stmts[0] != first || f.Stmts[4] != last {
+		t.Fatalf("the statements around the edit were not reused")
+	}
+	if f.Stmts[3] != third {
+		t.Fatalf("the heredoc statement was not reused")
+	}
+	if got, want := f.Stmts[4].Pos().String(), "8:1"; got != want {
+		t.Fatalf("want the last statement at %s, got %s", want, got)
+	}
+	if err := p.Edit(f, []TextEdit{insertBefore(string(f.Src), "body", "'")}); err != nil {
+		t.Fatal(err)
+	}
+	if string(f.NodeText(f.Stmts[3])) != "cat <<EOF\n'body\nEOF" {
+		t.Fatalf("wrong heredoc text: %q", f.NodeText(f.Stmts[3]))
+	}
+	if err := p.Edit(f, []TextEdit{insertBefore(string(f.Src), "b\n", "\"")}); err == nil {
+		t.Fatalf("want an error for an unclosed quote")
+	}
+	if err := p.Edit(f, []TextEdit{{5, 3, ""}}); err == nil {
+		t.Fatalf("want an error for an invalid edit")
+	}
+}
+
+// sameTree checks that two syntax trees are equal, including unexported fields
+// such as the heredoc spans of a File. Unlike reflect.DeepEqual, nil and empty
+// slices are equal, and maps are ignored.
+func sameTree(x, y reflect.Value, path string) error {
+	switch x.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if x.IsNil() || y.IsNil() {
+			if x.IsNil() != y.IsNil() {
+				return fmt.Errorf("%s: nil mismatch", path)
+			}
+			return nil
+		}
+		return sameTree(x.Elem(), y.Elem(), path)
+	case reflect.Slice:
+		if x.Len() != y.Len() {
+			return fmt.Errorf("%s: length %d vs %d", path, x.Len(), y.Len())
+		}
+		for i := 0; i < x.Len(); i++ {
+			if err := sameTree(x.Index(i), y.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < x.NumField(); i++ {
+			fpath := path + "." + x.Type().Field(i).Name
+			if err := sameTree(x.Field(i), y.Field(i), fpath); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+	default:
+		if xs, ys := fmt.Sprint(x), fmt.Sprint(y); xs != ys {
+			return fmt.Errorf("%s: got %s, want %s", path, xs, ys)
+		}
+	}
+	return nil
+}
@@ -97,6 +97,39 @@ func ExampleNewParser_options() {
 	// for ((i = 0; i < 5; i++)); do echo $i > f; done
 }
 
+func ExampleParser_Edit() {
+	src := "foo\nbar\nbaz"
+	p := syntax.NewParser(syntax.RetainSource(true))
+	f, err := p.Parse(strings.NewReader(src), "")
+	if err != nil {
+		return
+	}
+	first, last := f.Stmts[0], f.Stmts[2]
+
+	// Replace "bar" with a statement spanning two lines, as an editor
+	// would when the user types. Only the second statement is parsed again.
+	offs := uint(strings.Index(src, "bar"))
+	err = p.Edit(f, []syntax.TextEdit{{
+		Start:   offs,
+		End:     offs + uint(len("bar")),
+		NewText: "if x; then\n\ty; fi",
+	}})
+	if err != nil {
+		return
+	}
+	fmt.Println(f.Stmts[0] == first, f.Stmts[2] == last)
+	fmt.Println(f.Stmts[2].Pos())
+	syntax.NewPrinter().Print(os.Stdout, f)
+	// Output:
+	// true true
+	// 4:1
+	// foo
+	// if x; then
+	//	y
+	// fi
+	// baz
+}
+
 func ExampleWalk() {
 	in := strings.NewReader(`echo $foo "and $bar"`)
 	f, err := syntax.NewParser().Parse(in, "")
@@ -114,6 +147,56 @@ func ExampleWalk() {
 	// Output: echo $FOO "and $BAR"
 }
 
+func ExampleWalkPath() {
+	in := strings.NewReader("foo() { bar; }\nbaz")
+	f, err := syntax.NewParser().Parse(in, "")
+	if err != nil {
+		return
+	}
+	syntax.WalkPath(f, func(node syntax.Node, path []syntax.Node) bool {
+		call, ok := node.(*syntax.CallExpr)
+		if !ok {
+			return true
+		}
+		fn := ""
+		for _, anc := range path {
+			if decl, ok := anc.(*syntax.FuncDecl); ok {
+				fn = decl.Name.Value
+			}
+		}
+		fmt.Printf("%s is called in %q\n", call.Args[0].Lit(), fn)
+		return true
+	})
+	// Output:
+	// bar is called in "foo"
+	// baz is called in ""
+}
+
+func ExampleApply() {
+	in := strings.NewReader("foo; set -x\nif bar; then\n\tbaz; set -x\nfi")
+	f, err := syntax.NewParser().Parse(in, "")
+	if err != nil {
+		return
+	}
+	syntax.Apply(f, func(c *syntax.Cursor) bool {
+		if stmt, ok := c.Node().(*syntax.Stmt); ok {
+			call, ok := stmt.Cmd.(*syntax.CallExpr)
+			if ok && len(call.Args) == 2 && call.Args[0].Lit() == "set" &&
+				call.Args[1].Lit() == "-x" {
+				c.Delete()
+				return false
+			}
+		}
+		return true
+	}, nil)
+	syntax.NewPrinter().Print(os.Stdout, f)
+	// Output:
+	// foo
+	// if bar; then
+	//	baz
+	// fi
+}
+
 func ExampleDebugPrint() {
 	in := strings.NewReader(`echo 'foo'`)
 	f, err := syntax.NewParser().Parse(in, "")
@@ -152,6 +152,8 @@ var fileTests = []testCase{
 			"foo;bar;",
 			"\nfoo\nbar\n",
 			"foo\r\nbar\r\n",
+			"foo # a \\\nbar",
+			"foo #\\\nbar",
 		},
 		common: litStmts("foo", "bar"),
 	},
@@ -2953,14 +2955,25 @@ var fileTests = []testCase{
 			},
 		},
 	},
+	{
+		Strs: []string{"case i in 1) a ;; esac"},
+		mksh: &CaseClause{
+			Word: litWord("i"),
+			Items: []*CaseItem{{
+				Op:       Break,
+				Patterns: litWords("1"),
+				Stmts:    litStmts("a"),
+			}},
+		},
+	},
 	{
 		Strs: []string{
-			"case i in 1) a ;; esac",
 			"case i { 1) a ;; }",
 			"case i {\n1) a ;;\n}",
 		},
 		mksh: &CaseClause{
-			Word: litWord("i"),
+			Braces: true,
+			Word:   litWord("i"),
 			Items: []*CaseItem{{
 				Op:       Break,
 				Patterns: litWords("1"),
@@ -3208,7 +3221,7 @@ var fileTests = []testCase{
 		bash: &TestClause{X: &BinaryTest{
 			Op: TsReMatch,
 			X:  litWord("a"),
-			Y:  litWord("b"),
+			Y:  &RegexWord{Word: litWord("b")},
 		}},
 	},
 	{
@@ -3216,10 +3229,10 @@ var fileTests = []testCase{
 		bash: &TestClause{X: &BinaryTest{
 			Op: TsReMatch,
 			X:  litWord("a"),
-			Y: word(
+			Y: &RegexWord{Word: word(
 				dblQuoted(lit(" foo ")),
 				litParamExp("bar"),
-			),
+			)},
 		}},
 	},
 	{
@@ -3227,10 +3240,10 @@ var fileTests = []testCase{
 		bash: &TestClause{X: &BinaryTest{
 			Op: TsReMatch,
 			X:  litWord("a"),
-			Y: word(
+			Y: &RegexWord{Word: word(
 				lit("foo"),
 				dblQuoted(lit("bar")),
-			),
+			)},
 		}},
 	},
 	{
@@ -3238,7 +3251,7 @@ var fileTests = []testCase{
 		bash: &TestClause{X: &BinaryTest{
 			Op: TsReMatch,
 			X:  litWord("a"),
-			Y:  litWord("[ab](c |d)"),
+			Y:  &RegexWord{Word: litWord("[ab](c |d)")},
 		}},
 	},
 	{
@@ -3246,7 +3259,7 @@ var fileTests = []testCase{
 		bash: &TestClause{X: &BinaryTest{
 			Op: TsReMatch,
 			X:  litWord("a"),
-			Y:  litWord("( ]])"),
+			Y:  &RegexWord{Word: litWord("( ]])")},
 		}},
 	},
 	{
@@ -3254,7 +3267,7 @@ var fileTests = []testCase{
 		bash: &TestClause{X: &BinaryTest{
 			Op: TsReMatch,
 			X:  litWord("a"),
-			Y:  word(lit("("), litParamExp("foo"), lit(")")),
+			Y:  &RegexWord{Word: word(lit("("), litParamExp("foo"), lit(")"))},
 		}},
 	},
 	{
@@ -3262,7 +3275,7 @@ var fileTests = []testCase{
 		bash: &TestClause{X: &BinaryTest{
 			Op: TsReMatch,
 			X:  litWord("a"),
-			Y:  litWord(`b\ c|d`),
+			Y:  &RegexWord{Word: litWord(`b\ c|d`)},
 		}},
 	},
 	{
@@ -3278,7 +3291,7 @@ var fileTests = []testCase{
 		bash: &TestClause{X: &BinaryTest{
 			Op: TsReMatch,
 			X:  litWord("a"),
-			Y:  litWord("-n"),
+			Y:  &RegexWord{Word: litWord("-n")},
 		}},
 	},
 	{
@@ -3288,12 +3301,12 @@ var fileTests = []testCase{
 			X: &BinaryTest{
 				Op: TsReMatch,
 				X:  litWord("a"),
-				Y:  word(lit("b"), lit("$")),
+				Y:  &RegexWord{Word: word(lit("b"), lit("$"))},
 			},
 			Y: &BinaryTest{
 				Op: TsReMatch,
 				X:  litWord("c"),
-				Y:  word(lit("d"), lit("$")),
+				Y:  &RegexWord{Word: word(lit("d"), lit("$"))},
 			},
 		}},
 	},
@@ -3639,6 +3652,36 @@ var fileTests = []testCase{
 			},
 		},
 	},
+	{
+		Strs: []string{"export foo=(a [2]=b)", "export foo=(a [2]=b )"},
+		bash: &DeclClause{
+			Variant: lit("export"),
+			Args: []*Assign{{
+				Name: lit("foo"),
+				Array: &ArrayExpr{Elems: []*ArrayElem{
+					{Value: litWord("a")},
+					{Index: litWord("2"), Value: litWord("b")},
+				}},
+			}},
+		},
+	},
+	{
+		Strs: []string{"readonly -A foo+=([a]=b)"},
+		bash: &DeclClause{
+			Variant: lit("readonly"),
+			Args: []*Assign{
+				{Naked: true, Value: litWord("-A")},
+				{
+					Append: true,
+					Name:   lit("foo"),
+					Array: &ArrayExpr{Elems: []*ArrayElem{{
+						Index: litWord("a"),
+						Value: litWord("b"),
+					}}},
+				},
+			},
+		},
+	},
 	{
 		Strs: []string{"declare foo[a]="},
 		bash: &DeclClause{
@@ -4185,6 +4228,110 @@ var fileTests = []testCase{
 			litParamExp("k"),
 		)),
 	},
+	{
+		Strs: []string{"${a%%+( )}"},
+		bsmk: word(&ParamExp{
+			Param: lit("a"),
+			Exp: &Expansion{
+				Op:   RemLargeSuffix,
+				Word: word(&ExtGlob{Op: GlobOneOrMore, Pattern: lit(" ")}),
+			},
+		}),
+		posix: word(&ParamExp{
+			Param: lit("a"),
+			Exp: &Expansion{
+				Op:   RemLargeSuffix,
+				Word: litWord("+( )"),
+			},
+		}),
+	},
+	{
+		Strs: []string{`${a#b@(c|d)e}`},
+		bsmk: word(&ParamExp{
+			Param: lit("a"),
+			Exp: &Expansion{
+				Op: RemSmallPrefix,
+				Word: word(
+					lit("b"),
+					&ExtGlob{Op: GlobOne, Pattern: lit("c|d")},
+					lit("e"),
+				),
+			},
+		}),
+	},
+	{
+		Strs: []string{`${a//*([0-9])/+(b)}`},
+		bsmk: word(&ParamExp{
+			Param: lit("a"),
+			Repl: &Replace{
+				All:  true,
+				Orig: word(&ExtGlob{Op: GlobZeroOrMore, Pattern: lit("[0-9]")}),
+				With: litWord("+(b)"),
+			},
+		}),
+	},
+	{
+		Strs: []string{`"${a,,!(b)}"`},
+		bash: dblQuoted(&ParamExp{
+			Param: lit("a"),
+			Exp: &Expansion{
+				Op:   LowerAll,
+				Word: word(&ExtGlob{Op: GlobExcept, Pattern: lit("b")}),
+			},
+		}),
+	},
+	{
+		Strs: []string{`${a#b@(c|$d)}`},
+		bsmk: word(&ParamExp{
+			Param: lit("a"),
+			Exp: &Expansion{
+				Op: RemSmallPrefix,
+				Word: word(
+					lit("b"),
+					lit("@(c|"),
+					litParamExp("d"),
+					lit(")"),
+				),
+			},
+		}),
+		posix: word(&ParamExp{
+			Param: lit("a"),
+			Exp: &Expansion{
+				Op:   RemSmallPrefix,
+				Word: word(lit("b@(c|"), litParamExp("d"), lit(")")),
+			},
+		}),
+	},
+	{
+		Strs: []string{`${a/@("b")/c}`},
+		bsmk: word(&ParamExp{
+			Param: lit("a"),
+			Repl: &Replace{
+				Orig: word(lit("@("), dblQuoted(lit("b")), lit(")")),
+				With: litWord("c"),
+			},
+		}),
+	},
+	{
+		Strs: []string{`${a:-@(b)}`},
+		common: word(&ParamExp{
+			Param: lit("a"),
+			Exp: &Expansion{
+				Op:   DefaultUnsetOrNull,
+				Word: litWord("@(b)"),
+			},
+		}),
+	},
+	{
+		Strs: []string{`${a%%\?(b)}`},
+		common: word(&ParamExp{
+			Param: lit("a"),
+			Exp: &Expansion{
+				Op:   RemLargeSuffix,
+				Word: litWord(`\?(b)`),
+			},
+		}),
+	},
 }
 
 // these don't have a canonical format with the same syntax tree
@@ -4530,6 +4677,8 @@ func clearPosRecurse(tb testing.TB, src string, v interface{}) {
 		setPos(&x.Lparen, "(")
 		setPos(&x.Rparen, ")")
 		recurse(x.X)
+	case *RegexWord:
+		recurse(x.Word)
 	case *FuncDecl:
 		if x.RsrvWord {
 			setPos(&x.Position, "function")
@@ -0,0 +1,297 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import (
+	"fmt"
+	"html"
+	"io"
+)
+
+// HighlightClass is the kind of a token written by a Highlighter.
+type HighlightClass int
+
+const (
+	HighlightNone      HighlightClass = iota // plain text, like arguments and heredoc bodies
+	HighlightKeyword                         // reserved words like "if", and tokens like "[[" and "{"
+	HighlightBuiltin                         // names of builtins, like "echo" and "declare"
+	HighlightOperator                        // control and redirect operators, like "&&" and ">"
+	HighlightString                          // quoted strings
+	HighlightExpansion                       // parameter, arithmetic, command and process expansions
+	HighlightVariable                        // variable names in assignments
+	HighlightComment                         // comments
+)
+
+func (c HighlightClass) String() string {
+	switch c {
+	case HighlightKeyword:
+		return "keyword"
+	case HighlightBuiltin:
+		return "builtin"
+	case HighlightOperator:
+		return "operator"
+	case HighlightString:
+		return "string"
+	case HighlightExpansion:
+		return "expansion"
+	case HighlightVariable:
+		return "variable"
+	case HighlightComment:
+		return "comment"
+	}
+	return "none"
+}
+
+// HighlightFunc writes a token of a given class to w. See HighlightWith.
+type HighlightFunc func(w io.Writer, class HighlightClass, text string) error
+
+// HighlightHTML writes tokens as HTML, with each token which isn't of class
+// HighlightNone in a span with the class "sh-" followed by the name of its
+// class, such as "sh-keyword". All text is escaped.
+func HighlightHTML(w io.Writer, class HighlightClass, text string) error {
+	text = html.EscapeString(text)
+	if class == HighlightNone {
+		_, err := io.WriteString(w, text)
+		return err
+	}
+	_, err := fmt.Fprintf(w, `<span class="sh-%s">%s</span>`, class, text)
+	return err
+}
+
+var ansiColors = [...]string{
+	HighlightKeyword:   "\x1b[1;34m", // bold blue
+	HighlightBuiltin:   "\x1b[36m",   // cyan
+	HighlightOperator:  "\x1b[33m",   // yellow
+	HighlightString:    "\x1b[32m",   // green
+	HighlightExpansion: "\x1b[35m",   // magenta
+	HighlightVariable:  "\x1b[34m",   // blue
+	HighlightComment:   "\x1b[90m",   // grey
+}
+
+// HighlightANSI writes tokens with ANSI escape codes to color them, for use
+// in terminals.
+func HighlightANSI(w io.Writer, class HighlightClass, text string) error {
+	if class == HighlightNone {
+		_, err := io.WriteString(w, text)
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%s%s\x1b[0m", ansiColors[class], text)
+	return err
+}
+
+// HighlighterOption is a function which can be passed to NewHighlighter to
+// alter its behaviour.
+type HighlighterOption func(*Highlighter)
+
+// HighlightWith sets the function used to write each token. The default is
+// HighlightHTML.
+func HighlightWith(fn HighlightFunc) HighlighterOption {
+	return func(h *Highlighter) { h.write = fn }
+}
+
+// NewHighlighter allocates a new Highlighter and applies any number of options.
+func NewHighlighter(options ...HighlighterOption) *Highlighter {
+	h := &Highlighter{write: HighlightHTML}
+	for _, opt := range options {
+		opt(h)
+	}
+	return h
+}
+
+// Highlighter writes the source of shell programs split into tokens, each of
+// them with a class such as HighlightKeyword. The classes come from the syntax
+// tree, so they are exactly how the parser understands the program, even with
+// nested quotes, command substitutions, and heredocs.
+type Highlighter struct {
+	write HighlightFunc
+}
+
+// Highlight writes the source of a file with syntax highlighting. The file must
+// have been parsed with RetainSource, and with KeepComments for comments to be
+// highlighted.
+//
+// All of the source is written as it was parsed. Heredoc bodies are plain
+// text, except for the expansions within them if their delimiter was unquoted.
+func (h *Highlighter) Highlight(w io.Writer, f *File) error {
+	if f.Src == nil {
+		return fmt.Errorf("cannot highlight a file parsed without RetainSource")
+	}
+	src := f.Src
+	classes := make([]HighlightClass, len(src))
+	paint := func(start, end Pos, class HighlightClass) {
+		s, e := int(start.Offset()), int(end.Offset())
+		if !start.IsValid() || e > len(src) {
+			return
+		}
+		for i := s; i < e; i++ {
+			classes[i] = class
+		}
+	}
+	// paintLen paints n bytes starting at pos.
+	paintLen := func(pos Pos, n int, class HighlightClass) {
+		paint(pos, posAddCol(pos, n), class)
+	}
+	// paintWord paints the reserved word starting at pos, or a single byte
+	// for tokens like "{".
+	paintWord := func(pos Pos) {
+		n := 0
+		for i := int(pos.Offset()); i < len(src) && asciiLetter(src[i]); i++ {
+			n++
+		}
+		if n == 0 {
+			n = 1
+		}
+		paintLen(pos, n, HighlightKeyword)
+	}
+	// Nodes are visited before their children, so that the classes of the
+	// children take precedence.
+	Walk(f, func(node Node) bool {
+		switch x := node.(type) {
+		case *Comment:
+			paint(x.Pos(), x.End(), HighlightComment)
+		case *Stmt:
+			if x.Negated && src[x.Position.Offset()] == '!' {
+				paintLen(x.Position, 1, HighlightKeyword)
+			}
+			if x.Semicolon.IsValid() {
+				n := 1
+				if x.Coprocess {
+					n = 2
+				}
+				paintLen(x.Semicolon, n, HighlightOperator)
+			}
+		case *Assign:
+			if x.Name != nil {
+				paint(x.Name.Pos(), x.Name.End(), HighlightVariable)
+			}
+		case *Redirect:
+			paintLen(x.OpPos, len(x.Op.String()), HighlightOperator)
+		case *CallExpr:
+			if len(x.Args) > 0 && isBuiltin(x.Args[0].Lit()) {
+				paint(x.Args[0].Pos(), x.Args[0].End(), HighlightBuiltin)
+			}
+		case *Subshell:
+			paintLen(x.Lparen, 1, HighlightOperator)
+			paintLen(x.Rparen, 1, HighlightOperator)
+		case *Block:
+			paintWord(x.Lbrace)
+			paintWord(x.Rbrace)
+		case *IfClause:
+			paintWord(x.Position)
+			if x.ThenPos.IsValid() {
+				paintWord(x.ThenPos)
+			}
+			if x.FiPos.IsValid() {
+				paintWord(x.FiPos)
+			}
+		case *WhileClause:
+			paintWord(x.WhilePos)
+			paintWord(x.DoPos)
+			paintWord(x.DonePos)
+		case *ForClause:
+			paintWord(x.ForPos)
+			// the position of any ";" before "do" isn't recorded
+			end := x.Loop.End()
+			i := int(end.Offset())
+			for i < len(src) && (src[i] == ' ' || src[i] == '\t' || src[i] == '\n') {
+				i++
+			}
+			if i < len(src) && src[i] == ';' {
+				paintLen(posAddCol(end, i-int(end.Offset())), 1, HighlightOperator)
+			}
+			paintWord(x.DoPos)
+			paintWord(x.DonePos)
+		case *WordIter:
+			if x.InPos.IsValid() {
+				paintWord(x.InPos)
+			}
+		case *CaseClause:
+			paintWord(x.Case)
+			// "in" or "{" is the first token after the word
+			i := int(x.Word.End().Offset())
+			for i < len(src) && (src[i] == ' ' || src[i] == '\t' || src[i] == '\n') {
+				i++
+			}
+			paintWord(posAddCol(x.Word.End(), i-int(x.Word.End().Offset())))
+			paintWord(x.Esac)
+		case *CaseItem:
+			if x.OpPos.IsValid() {
+				paintLen(x.OpPos, len(x.Op.String()), HighlightOperator)
+			}
+		case *BinaryCmd:
+			paintLen(x.OpPos, len(x.Op.String()), HighlightOperator)
+		case *FuncDecl:
+			if x.RsrvWord {
+				paintWord(x.Position)
+			}
+		case *ArithmCmd:
+			paintLen(x.Left, 2, HighlightKeyword)
+			paintLen(x.Right, 2, HighlightKeyword)
+		case *TestClause:
+			paintLen(x.Left, 2, HighlightKeyword)
+			paintLen(x.Right, 2, HighlightKeyword)
+		case *DeclClause:
+			paint(x.Variant.Pos(), x.Variant.End(), HighlightBuiltin)
+		case *LetClause:
+			paintLen(x.Let, 3, HighlightBuiltin)
+		case *TimeClause:
+			paintWord(x.Time)
+		case *CoprocClause:
+			paintWord(x.Coproc)
+		case *SglQuoted:
+			paint(x.Pos(), x.End(), HighlightString)
+		case *DblQuoted:
+			paint(x.Pos(), x.End(), HighlightString)
+		case *ParamExp:
+			paint(x.Pos(), x.End(), HighlightExpansion)
+		case *ArithmExp:
+			paint(x.Pos(), x.End(), HighlightExpansion)
+		case *CmdSubst:
+			// the commands inside are highlighted on their own
+			paint(x.Pos(), x.End(), HighlightNone)
+			left, right := 2, 1 // "$(" and ")"
+			switch {
+			case x.Backquotes:
+				left = 1
+			case x.TempFile, x.ReplyVar:
+				left, right = 3, 1 // "${ " and "}"
+			}
+			paintLen(x.Left, left, HighlightExpansion)
+			paintLen(x.Right, right, HighlightExpansion)
+		case *ProcSubst:
+			paint(x.Pos(), x.End(), HighlightNone)
+			paintLen(x.OpPos, 2, HighlightExpansion)
+			paintLen(x.Rparen, 1, HighlightExpansion)
+		}
+		return true
+	})
+	start := 0
+	for i := 1; i <= len(src); i++ {
+		if i < len(src) && classes[i] == classes[start] {
+			continue
+		}
+		if err := h.write(w, classes[start], string(src[start:i])); err != nil {
+			return err
+		}
+		start = i
+	}
+	return nil
+}
+
+// isBuiltin reports whether a command name is a builtin in Bash.
+func isBuiltin(name string) bool {
+	switch name {
+	case ":", ".", "[", "alias", "bg", "bind", "break", "builtin", "caller",
+		"cd", "command", "compgen", "complete", "compopt", "continue",
+		"declare", "dirs", "disown", "echo", "enable", "eval", "exec",
+		"exit", "export", "false", "fc", "fg", "getopts", "hash", "help",
+		"history", "jobs", "kill", "let", "local", "logout", "mapfile",
+		"popd", "printf", "pushd", "pwd", "read", "readarray", "readonly",
+		"return", "set", "shift", "shopt", "source", "suspend", "test",
+		"times", "trap", "true", "type", "typeset", "ulimit", "umask",
+		"unalias", "unset", "wait":
+		return true
+	}
+	return false
+}
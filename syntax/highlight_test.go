@@ -0,0 +1,128 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var highlightTests = []struct {
+	in   string
+	want []string
+}{
+	{
+		"foo=bar echo 'a' \"b $c\" # d",
+		[]string{"variable:foo", "none:=bar ", "builtin:echo", "none: ",
+			"string:'a'", "none: ", `string:"b `, "expansion:$c", `string:"`,
+			"none: ", "comment:# d"},
+	},
+	{
+		"if ! [[ x ]]; then y; fi",
+		[]string{"keyword:if", "none: ", "keyword:!", "none: ", "keyword:[[",
+			"none: x ", "keyword:]]", "operator:;", "none: ", "keyword:then",
+			"none: y", "operator:;", "none: ", "keyword:fi"},
+	},
+	{
+		`a "$(b "c" | d)" <(e)`,
+		[]string{"none:a ", `string:"`, "expansion:$(", "none:b ",
+			`string:"c"`, "none: ", "operator:|", "none: d", "expansion:)",
+			`string:"`, "none: ", "expansion:<(", "none:e", "expansion:)"},
+	},
+	{
+		"cat <<EOF\nx $y `z`\nEOF\ncat <<'EOF'\n$y\nEOF",
+		[]string{"none:cat ", "operator:<<", "none:EOF\nx ", "expansion:$y",
+			"none: ", "expansion:`", "none:z", "expansion:`", "none:\nEOF\ncat ",
+			"operator:<<", "string:'EOF'", "none:\n$y\nEOF"},
+	},
+	{
+		"case $x in\na) b ;;\nesac",
+		[]string{"keyword:case", "none: ", "expansion:$x", "none: ",
+			"keyword:in", "none:\na) b ", "operator:;;", "none:\n",
+			"keyword:esac"},
+	},
+	{
+		"for i in 1 2; do echo $((i + 1)) >&2; done",
+		[]string{"keyword:for", "none: i ", "keyword:in", "none: 1 2",
+			"operator:;", "none: ", "keyword:do", "none: ", "builtin:echo",
+			"none: ", "expansion:$((i + 1))", "none: ", "operator:>&", "none:2",
+			"operator:;", "none: ", "keyword:done"},
+	},
+	{
+		"for ((i = 0; i < 2; i++)) ; do :; done\nfor i\ndo :; done",
+		[]string{"keyword:for", "none: ((i = 0; i < 2; i++)) ", "operator:;",
+			"none: ", "keyword:do", "none: ", "builtin::", "operator:;",
+			"none: ", "keyword:done", "none:\n", "keyword:for", "none: i\n",
+			"keyword:do", "none: ", "builtin::", "operator:;", "none: ",
+			"keyword:done"},
+	},
+	{
+		"function f { local x=${y:-\"z\"}; }",
+		[]string{"keyword:function", "none: f ", "keyword:{", "none: ",
+			"builtin:local", "none: ", "variable:x", "none:=",
+			"expansion:${y:-", `string:"z"`, "expansion:}", "operator:;",
+			"none: ", "keyword:}"},
+	},
+}
+
+func TestHighlight(t *testing.T) {
+	t.Parallel()
+	p := NewParser(KeepComments(true), RetainSource(true))
+	for i, tc := range highlightTests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			f, err := p.Parse(strings.NewReader(tc.in), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			var buf bytes.Buffer
+			h := NewHighlighter(HighlightWith(func(w io.Writer, class HighlightClass, text string) error {
+				got = append(got, class.String()+":"+text)
+				_, err := io.WriteString(w, text)
+				return err
+			}))
+			if err := h.Highlight(&buf, f); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("want:\n%q\ngot:\n%q", tc.want, got)
+			}
+			if buf.String() != tc.in {
+				t.Fatalf("source not kept as is: %q", buf.String())
+			}
+		})
+	}
+}
+
+func TestHighlightHTML(t *testing.T) {
+	t.Parallel()
+	in := "echo \"<a>\" && x # &"
+	f, err := NewParser(KeepComments(true), RetainSource(true)).Parse(strings.NewReader(in), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := NewHighlighter().Highlight(&buf, f); err != nil {
+		t.Fatal(err)
+	}
+	want := `<span class="sh-builtin">echo</span> ` +
+		`<span class="sh-string">&#34;&lt;a&gt;&#34;</span> ` +
+		`<span class="sh-operator">&amp;&amp;</span> x ` +
+		`<span class="sh-comment"># &amp;</span>`
+	if got := buf.String(); got != want {
+		t.Fatalf("want:\n%s\ngot:\n%s", want, got)
+	}
+
+	f, err = NewParser().Parse(strings.NewReader(in), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := NewHighlighter().Highlight(&buf, f); err == nil {
+		t.Fatalf("want an error without RetainSource")
+	}
+}
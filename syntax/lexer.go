@@ -153,6 +153,10 @@ readAgain:
 func (p *Parser) nextKeepSpaces() {
 	r := p.r
 	p.pos = p.getPos()
+	if p.extGlobStart(r) {
+		p.extGlobToken(r)
+		return
+	}
 	switch p.quote {
 	case paramExpRepl:
 		switch r {
@@ -253,12 +257,14 @@ skipSpace:
 		case '#':
 			r = p.rune()
 			p.newLit(r)
-			for r != '\n' && r != utf8.RuneSelf {
-				if r == escNewl {
-					p.litBs = append(p.litBs, '\\', '\n')
-				}
+			for r != '\n' && r != utf8.RuneSelf && r != escNewl {
 				r = p.rune()
 			}
+			if r == escNewl {
+				// A backslash doesn't continue a comment; it is
+				// part of it, and the newline still ends it.
+				p.litBs = append(p.litBs, '\\')
+			}
 			if p.keepComments {
 				*p.curComs = append(*p.curComs, Comment{
 					Hash: p.pos,
@@ -267,6 +273,9 @@ skipSpace:
 			} else {
 				p.litBs = nil
 			}
+			if r == escNewl {
+				p.r = '\n'
+			}
 			p.next()
 		case '[', '=':
 			if p.quote == arrayElems {
@@ -276,20 +285,7 @@ skipSpace:
 			}
 		case '?', '*', '+', '@', '!':
 			if p.peekByte('(') {
-				switch r {
-				case '?':
-					p.tok = globQuest
-				case '*':
-					p.tok = globStar
-				case '+':
-					p.tok = globPlus
-				case '@':
-					p.tok = globAt
-				default: // '!'
-					p.tok = globExcl
-				}
-				p.rune()
-				p.rune()
+				p.extGlobToken(r)
 			} else {
 				p.advanceLitNone(r)
 			}
@@ -800,10 +796,51 @@ loop:
 	p.tok, p.val = _LitWord, p.endLit()
 }
 
+// extGlobStart reports whether an extended glob, such as "@(a|b)", starts with
+// the rune r within a pattern in a parameter expansion.
+func (p *Parser) extGlobStart(r rune) bool {
+	if p.lang == LangPOSIX || !p.extGlobPattern() {
+		return false
+	}
+	switch r {
+	case '?', '*', '+', '@', '!':
+		return p.peekByte('(')
+	}
+	return false
+}
+
+// extGlobPattern reports whether we are lexing a pattern in a parameter
+// expansion.
+func (p *Parser) extGlobPattern() bool {
+	return p.patternExp && p.quote&(paramExpRepl|paramExpExp) != 0
+}
+
+// extGlobToken lexes the operator of an extended glob, starting with r.
+func (p *Parser) extGlobToken(r rune) {
+	switch r {
+	case '?':
+		p.tok = globQuest
+	case '*':
+		p.tok = globStar
+	case '+':
+		p.tok = globPlus
+	case '@':
+		p.tok = globAt
+	default: // '!'
+		p.tok = globExcl
+	}
+	p.rune()
+	p.rune()
+}
+
 func (p *Parser) advanceLitOther(r rune) {
 	tok := _LitWord
 loop:
 	for p.newLit(r); r != utf8.RuneSelf; r = p.rune() {
+		if p.extGlobStart(r) {
+			tok = _Lit
+			break
+		}
 		switch r {
 		case '\\': // escaped byte follows
 			p.rune()
@@ -25,11 +25,132 @@ type File struct {
 
 	Stmts []*Stmt
 	Last  []Comment
+
+	// Src is the parsed source, only kept when using RetainSource.
+	Src []byte
+
+	hdocs []hdocSource // in source order, only kept along with Src
+
+	parents map[Node]Node // see UpdateParents
 }
 
 func (f *File) Pos() Pos { return stmtsPos(f.Stmts, f.Last) }
 func (f *File) End() Pos { return stmtsEnd(f.Stmts, f.Last) }
 
+// hdocSource is the source span of a heredoc body, from its first line up to
+// and including its closing delimiter.
+type hdocSource struct {
+	redir      *Redirect
+	start, end uint32
+}
+
+// NodeText returns the original source text of a node belonging to the file.
+// It returns nil if the file was not parsed with RetainSource.
+//
+// Line continuations are kept as they were in the source. Heredoc bodies are
+// included for the heredocs within the node, even if they do not directly
+// follow it as in "cat <<EOF | grep foo", and left out for any other heredocs.
+// In those cases, the result is a copy instead of a slice of Src.
+func (f *File) NodeText(node Node) []byte {
+	if f.Src == nil {
+		return nil
+	}
+	start, end := node.Pos().offs, node.End().offs
+	var own []hdocSource
+	if len(f.hdocs) > 0 {
+		Walk(node, func(node Node) bool {
+			if r, ok := node.(*Redirect); ok {
+				for _, h := range f.hdocs {
+					if h.redir == r {
+						own = append(own, h)
+					}
+				}
+			}
+			return true
+		})
+	}
+	if len(own) > 0 {
+		// The end of a redirect with a heredoc, or of a node ending
+		// with one, is at the end of the heredoc body. Find the end of
+		// the node's text before the bodies.
+		end = start
+		Walk(node, func(node Node) bool {
+			switch node.(type) {
+			case nil, *Comment:
+				return true
+			}
+			nodeEnd := node.End().offs
+			for _, h := range own {
+				if nodeEnd > h.start && nodeEnd <= h.end {
+					return true
+				}
+			}
+			if nodeEnd > end {
+				end = nodeEnd
+			}
+			return true
+		})
+	}
+	// A node can end between the backslash and the newline of a line
+	// continuation, such as "foo\" followed by a newline.
+	if int(end) < len(f.Src) && f.Src[end] == '\n' {
+		bslashes := 0
+		for i := end; i > start && f.Src[i-1] == '\\'; i-- {
+			bslashes++
+		}
+		if bslashes%2 == 1 {
+			end--
+		}
+	}
+
+	text := f.Src[start:end]
+	copied := false
+	from := start
+	for _, h := range f.hdocs {
+		if h.start < start || h.end > end || isOwnHdoc(own, h) {
+			continue
+		}
+		// Another statement's heredoc body, like in "foo <<EOF && {".
+		if !copied {
+			text = nil
+			copied = true
+		}
+		text = append(text, f.Src[from:h.start]...)
+		if from = h.end; int(from) < len(f.Src) && f.Src[from] == '\n' {
+			from++
+		}
+	}
+	if copied {
+		text = append(text, f.Src[from:end]...)
+	}
+	for _, h := range own {
+		if h.start < end {
+			continue // already included, like in "$(cat <<EOF ...)"
+		}
+		if !copied && h.start == end+1 && f.Src[end] == '\n' {
+			end = h.end
+			text = f.Src[start:end]
+			continue
+		}
+		if !copied {
+			text = append([]byte(nil), text...)
+			copied = true
+		}
+		text = append(text, '\n')
+		text = append(text, f.Src[h.start:h.end]...)
+	}
+	return text
+}
+
+func isOwnHdoc(own []hdocSource, h hdocSource) bool {
+	for _, h2 := range own {
+		if h2 == h {
+			return true
+		}
+	}
+	return false
+}
+
 func stmtsPos(stmts []*Stmt, last []Comment) Pos {
 	if len(stmts) > 0 {
 		s := stmts[0]
@@ -70,6 +191,23 @@ type Pos struct {
 	line, col uint16
 }
 
+// NewPos creates a position with the given byte offset, line, and column, as
+// returned by Offset, Line, and Col. Numbers too large to be stored in a Pos
+// are capped at the largest value which fits.
+func NewPos(offset, line, column uint) Pos {
+	const maxOffs, maxLineCol = 1<<32 - 1, 1<<16 - 1
+	if offset > maxOffs {
+		offset = maxOffs
+	}
+	if line > maxLineCol {
+		line = maxLineCol
+	}
+	if column > maxLineCol {
+		column = maxLineCol
+	}
+	return Pos{offs: uint32(offset), line: uint16(line), col: uint16(column)}
+}
+
 // Offset returns the byte offset of the position in the original source file.
 // Byte offsets start at 0.
 func (p Pos) Offset() uint { return uint(p.offs) }
@@ -214,6 +352,9 @@ func (a *Assign) End() Pos {
 		return a.Array.End()
 	}
 	if a.Index != nil {
+		if a.Naked {
+			return posAddCol(a.Index.End(), 1)
+		}
 		return posAddCol(a.Index.End(), 2)
 	}
 	if a.Naked {
@@ -276,6 +417,8 @@ type Subshell struct {
 
 	Stmts []*Stmt
 	Last  []Comment
+
+	emptyLines []uint // see inlineSubshell
 }
 
 func (s *Subshell) Pos() Pos { return s.Lparen }
@@ -493,6 +636,8 @@ type CmdSubst struct {
 	Backquotes bool // deprecated `foo`
 	TempFile   bool // mksh's ${ foo;}
 	ReplyVar   bool // mksh's ${|foo;}
+
+	emptyLines []uint // see inlineSubshell
 }
 
 func (c *CmdSubst) Pos() Pos { return c.Left }
@@ -648,6 +793,7 @@ func (p *ParenArithm) End() Pos { return posAddCol(p.Rparen, 1) }
 // CaseClause represents a case (switch) clause.
 type CaseClause struct {
 	Case, Esac Pos
+	Braces     bool // mksh's "case x { ... }" form
 
 	Word  *Word
 	Items []*CaseItem
@@ -655,7 +801,12 @@ type CaseClause struct {
 }
 
 func (c *CaseClause) Pos() Pos { return c.Case }
-func (c *CaseClause) End() Pos { return posAddCol(c.Esac, 4) }
+func (c *CaseClause) End() Pos {
+	if c.Braces {
+		return posAddCol(c.Esac, 1)
+	}
+	return posAddCol(c.Esac, 4)
+}
 
 // CaseItem represents a pattern list (case) within a CaseClause.
 type CaseItem struct {
@@ -690,7 +841,7 @@ func (t *TestClause) End() Pos { return posAddCol(t.Right, 2) }
 
 // TestExpr represents all nodes that form test expressions.
 //
-// These are *BinaryTest, *UnaryTest, *ParenTest, and *Word.
+// These are *BinaryTest, *UnaryTest, *ParenTest, *RegexWord, and *Word.
 type TestExpr interface {
 	Node
 	testExprNode()
@@ -699,6 +850,7 @@ type TestExpr interface {
 func (*BinaryTest) testExprNode() {}
 func (*UnaryTest) testExprNode()  {}
 func (*ParenTest) testExprNode()  {}
+func (*RegexWord) testExprNode()  {}
 func (*Word) testExprNode()       {}
 
 // BinaryTest represents a binary test expression.
@@ -711,6 +863,22 @@ type BinaryTest struct {
 func (b *BinaryTest) Pos() Pos { return b.X.Pos() }
 func (b *BinaryTest) End() Pos { return b.Y.End() }
 
+// RegexWord represents the regular expression on the right side of a Bash
+// regex test, such as "^a(b|c)+$" in "[[ $x =~ ^a(b|c)+$ ]]".
+//
+// It is parsed like a word, except that unquoted spaces, parentheses and
+// brackets don't end it. Its quoted parts and escaped characters match
+// literally; see expand.Regexp. The printer writes it exactly as it was parsed,
+// as any change to its text could change what it matches.
+//
+// This node will only appear with LangBash.
+type RegexWord struct {
+	Word *Word
+}
+
+func (r *RegexWord) Pos() Pos { return r.Word.Pos() }
+func (r *RegexWord) End() Pos { return r.Word.End() }
+
 // UnaryTest represents a unary test expression. The unary opearator may come
 // before or after the sub-expression.
 type UnaryTest struct {
@@ -831,6 +999,9 @@ type TimeClause struct {
 func (c *TimeClause) Pos() Pos { return c.Time }
 func (c *TimeClause) End() Pos {
 	if c.Stmt == nil {
+		if c.PosixFormat {
+			return posAddCol(c.Time, 7) // "time -p"
+		}
 		return posAddCol(c.Time, 4)
 	}
 	return c.Stmt.End()
@@ -63,6 +63,18 @@ func (v *posWalker) Visit(n Node) bool {
 	return true
 }
 
+func TestNewPos(t *testing.T) {
+	t.Parallel()
+	pos := NewPos(12, 3, 4)
+	if pos.Offset() != 12 || pos.Line() != 3 || pos.Col() != 4 {
+		t.Fatalf("want offset 12 at 3:4, got offset %d at %s", pos.Offset(), pos)
+	}
+	pos = NewPos(^uint(0), 1<<20, 1<<20)
+	if pos.Offset() != 1<<32-1 || pos.Line() != 1<<16-1 || pos.Col() != 1<<16-1 {
+		t.Fatalf("want capped numbers, got offset %d at %s", pos.Offset(), pos)
+	}
+}
+
 func TestWeirdOperatorString(t *testing.T) {
 	t.Parallel()
 	op := RedirOperator(1000)
@@ -7,6 +7,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"strconv"
 	"strings"
 	"unicode/utf8"
@@ -23,6 +24,41 @@ func KeepComments(enabled bool) ParserOption {
 	return func(p *Parser) { p.keepComments = enabled }
 }
 
+// RetainSource makes the parser keep the source it parses in File.Src, so
+// that the original text of any node can be obtained via File.NodeText.
+// It is disabled by default, as the entire source is then kept in memory.
+//
+// Only Parser.Parse is affected by this option.
+func RetainSource(enabled bool) ParserOption {
+	return func(p *Parser) { p.retainSource = enabled }
+}
+
+// KeepParents makes the parser record the parent of every node in the file, so
+// that it can be obtained via File.Parent. It is disabled by default, as it
+// requires an extra pass over the syntax tree.
+//
+// Only Parser.Parse is affected by this option.
+func KeepParents(enabled bool) ParserOption {
+	return func(p *Parser) { p.keepParents = enabled }
+}
+
+// RecoverErrors makes the parser keep going after a syntax error, up to the
+// given number of errors, so that all of them can be reported at once. Zero,
+// the default, stops at the first error.
+//
+// When an error is found, the top-level statement it's in is dropped, and
+// parsing starts again at the next line which can start a statement. The
+// resulting File holds all the statements which parsed correctly, and the
+// returned error is an ErrorList with each ParseError and LangError found.
+// Since the parser can only guess where the dropped statement ends, the errors
+// after the first one may be caused by the first.
+//
+// Only Parser.Parse is affected by this option, and the entire source is then
+// read into memory.
+func RecoverErrors(maxErrors uint) ParserOption {
+	return func(p *Parser) { p.recoverErrors = maxErrors }
+}
+
 type LangVariant int
 
 const (
@@ -61,7 +97,7 @@ func (l LangVariant) String() string {
 // "foo $$" and "foo;$$", but not on "foo '$$'".
 //
 // The match is done by prefix, so the example above will also act on
-// "foo $$bar".
+// "foo $$bar". An empty word, the default, disables the option.
 func StopAt(word string) ParserOption {
 	if len(word) > 4 {
 		panic("stop word can't be over four bytes in size")
@@ -69,6 +105,9 @@ func StopAt(word string) ParserOption {
 	if strings.ContainsAny(word, " \t\n\r") {
 		panic("stop word can't contain whitespace characters")
 	}
+	if word == "" {
+		return func(p *Parser) { p.stopAt = nil }
+	}
 	return func(p *Parser) { p.stopAt = []byte(word) }
 }
 
@@ -88,8 +127,15 @@ func NewParser(options ...ParserOption) *Parser {
 // Parse can be called more than once, but not concurrently. That is, a
 // Parser can be reused once it is done working.
 func (p *Parser) Parse(r io.Reader, name string) (*File, error) {
+	if p.recoverErrors > 0 {
+		return p.parseRecover(r, name)
+	}
 	p.reset()
 	p.f = &File{Name: name}
+	var src bytes.Buffer
+	if p.retainSource {
+		r = io.TeeReader(r, &src)
+	}
 	p.src = r
 	p.rune()
 	p.next()
@@ -99,9 +145,112 @@ func (p *Parser) Parse(r io.Reader, name string) (*File, error) {
 		// trigger it
 		p.doHeredocs()
 	}
+	if p.retainSource {
+		p.f.Src = src.Bytes()
+	}
+	if p.keepParents && p.err == nil {
+		p.f.UpdateParents()
+	}
 	return p.f, p.err
 }
 
+// parseRecover is like Parse, but recovers from errors as described in
+// RecoverErrors.
+func (p *Parser) parseRecover(r io.Reader, name string) (*File, error) {
+	src, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	p.reset()
+	p.f = &File{Name: name}
+	var errs ErrorList
+	offs, line := 0, 1
+	for {
+		p.src = bytes.NewReader(src[offs:])
+		p.rune()
+		p.next()
+		stmts, last := p.stmtList()
+		if p.err == nil {
+			p.doHeredocs()
+		}
+		if p.err == nil {
+			p.f.Stmts = append(p.f.Stmts, stmts...)
+			p.f.Last = append(p.f.Last, last...)
+			break
+		}
+		for _, s := range stmts {
+			if s.Pos().After(p.stmtStart) || s.Pos() == p.stmtStart {
+				break
+			}
+			p.f.Stmts = append(p.f.Stmts, s)
+		}
+		errs = append(errs, p.err)
+		if uint(len(errs)) >= p.recoverErrors {
+			break
+		}
+		// Start again after the line with the error, skipping the
+		// lines which can't start a statement.
+		var next int
+		switch err := p.err.(type) {
+		case ParseError:
+			next = int(err.Pos.Offset())
+		case LangError:
+			next = int(err.Pos.Offset())
+		}
+		if next < offs {
+			next = offs
+		}
+		for next < len(src) {
+			i := bytes.IndexByte(src[next:], '\n')
+			if i < 0 {
+				next = len(src)
+				break
+			}
+			next += i + 1
+			if !closesStmt(src[next:]) {
+				break
+			}
+		}
+		if next >= len(src) {
+			break
+		}
+		line += bytes.Count(src[offs:next], []byte("\n"))
+		offs = next
+		p.reset()
+		p.offs = offs
+		p.npos = NewPos(0, uint(line), 1)
+	}
+	if p.retainSource {
+		p.f.Src = src
+	}
+	if p.keepParents {
+		p.f.UpdateParents()
+	}
+	if len(errs) > 0 {
+		return p.f, errs
+	}
+	return p.f, nil
+}
+
+// closesStmt reports whether a line starts with a token which can't start a
+// statement, such as "fi" or ";;".
+func closesStmt(line []byte) bool {
+	line = bytes.TrimLeft(line, " \t")
+	if bytes.HasPrefix(line, []byte(";;")) || bytes.HasPrefix(line, []byte("}")) ||
+		bytes.HasPrefix(line, []byte(")")) {
+		return true
+	}
+	end := bytes.IndexAny(line, " \t\n;&|")
+	if end < 0 {
+		end = len(line)
+	}
+	switch string(line[:end]) {
+	case "then", "elif", "else", "fi", "do", "done", "esac":
+		return true
+	}
+	return false
+}
+
 // Stmts reads and parses statements one at a time, calling a function
 // each time one is parsed. If the function returns false, parsing is
 // stopped and the function is not called again.
@@ -288,8 +437,19 @@ type Parser struct {
 	quote   quoteState // current lexer state
 	eqlOffs int        // position of '=' in val (a literal)
 
-	keepComments bool
-	lang         LangVariant
+	// patternExp is set when lexing a pattern in a parameter expansion,
+	// such as "${a%%pattern}", where extended globs are recognised.
+	patternExp bool
+
+	keepComments  bool
+	retainSource  bool
+	keepParents   bool
+	recoverErrors uint
+	lang          LangVariant
+
+	// stmtStart is the position of the top-level statement being parsed,
+	// used to recover from errors.
+	stmtStart Pos
 
 	stopAt []byte
 
@@ -305,6 +465,9 @@ type Parser struct {
 	// non-zero number means that we require certain tokens or words before
 	// reaching EOF.
 	openStmts int
+	// openClauses are the compound commands whose closing reserved words
+	// we have yet to reach, innermost last.
+	openClauses []openClause
 	// openBquotes is how many levels of backquotes are open at the moment.
 	openBquotes int
 
@@ -358,7 +521,10 @@ func (p *Parser) reset() {
 	p.r, p.w = 0, 0
 	p.err, p.readErr = nil, nil
 	p.quote, p.forbidNested = noState, false
+	p.patternExp = false
 	p.openStmts = 0
+	p.openClauses = p.openClauses[:0]
+	p.stmtStart = Pos{}
 	p.heredocs, p.buriedHdocs = p.heredocs[:0], 0
 	p.parsingDoc = false
 	p.openBquotes, p.buriedBquotes = 0, 0
@@ -541,6 +707,7 @@ func (p *Parser) doHeredocs() {
 		if i > 0 && p.r == '\n' {
 			p.rune()
 		}
+		start := p.getPos()
 		if quoted {
 			r.Hdoc = p.quotedHdocWord()
 		} else {
@@ -551,6 +718,13 @@ func (p *Parser) doHeredocs() {
 			p.posErr(r.Pos(), "unclosed here-document '%s'",
 				string(p.hdocStop))
 		}
+		if p.retainSource {
+			p.f.hdocs = append(p.f.hdocs, hdocSource{
+				redir: r,
+				start: start.offs,
+				end:   p.getPos().offs,
+			})
+		}
 	}
 	p.quote = old
 }
@@ -639,6 +813,48 @@ func (p *Parser) stmtEnd(n Node, start, end string) Pos {
 	return pos
 }
 
+// openClause is a compound command which is missing its closing reserved
+// word, such as an if clause and its "fi".
+type openClause struct {
+	pos        Pos
+	start, end string
+}
+
+func (p *Parser) openClause(pos Pos, start, end string) {
+	p.openClauses = append(p.openClauses, openClause{pos, start, end})
+}
+
+func (p *Parser) closeClause() {
+	p.openClauses = p.openClauses[:len(p.openClauses)-1]
+}
+
+// unclosedErr reports an error if the reserved word end closes one of the
+// clauses around the innermost open clause, as then the innermost clause is
+// most likely missing its own end. For example, a "fi" in a loop inside an
+// if clause means that the loop is missing its "done".
+func (p *Parser) unclosedErr(end string) bool {
+	n := len(p.openClauses)
+	if n == 0 {
+		return false
+	}
+	inner := p.openClauses[n-1]
+	if inner.end == end {
+		return false
+	}
+	for _, outer := range p.openClauses[:n-1] {
+		if outer.end != end {
+			continue
+		}
+		if inner.start == "{" {
+			p.posErr(inner.pos, "reached %q without matching { with }", end)
+		} else {
+			p.posErr(inner.pos, "%s statement must end with %q", inner.start, inner.end)
+		}
+		return true
+	}
+	return false
+}
+
 func (p *Parser) quoteErr(lpos Pos, quote token) {
 	p.posErr(lpos, "reached %s without closing quote %s",
 		p.tok.String(), quote)
@@ -675,6 +891,20 @@ func IsIncomplete(err error) bool {
 	return ok && perr.Incomplete
 }
 
+// ErrorList is the list of errors found by Parser.Parse when recovering from
+// them via RecoverErrors, in the order they were found.
+type ErrorList []error
+
+func (l ErrorList) Error() string {
+	switch len(l) {
+	case 0:
+		return "no errors"
+	case 1:
+		return l[0].Error()
+	}
+	return fmt.Sprintf("%s (and %d more errors)", l[0], len(l)-1)
+}
+
 // ParseError represents an error found when parsing a source file, from which
 // the parser cannot recover.
 type ParseError struct {
@@ -772,6 +1002,9 @@ loop:
 			}
 			p.curErr("%s can only be used in a case clause", p.tok)
 		}
+		if p.openStmts == 0 {
+			p.stmtStart = p.pos
+		}
 		if !newLine && !gotEnd {
 			p.curErr("statements must be separated by &, ; or a newline")
 		}
@@ -1065,6 +1298,14 @@ func (p *Parser) wordPart() WordPart {
 			switch r {
 			case utf8.RuneSelf:
 				break globLoop
+			case '$', '`', '"', '\'':
+				if p.extGlobPattern() {
+					// ExtGlob can't hold expansions or quotes, so
+					// keep the pattern as a word like before.
+					l := p.lit(eg.OpPos, eg.Op.String()+p.endLit())
+					p.next()
+					return l
+				}
 			case '(':
 				lparens++
 			case ')':
@@ -1399,13 +1640,15 @@ func (p *Parser) paramExp() *ParamExp {
 			p.langErr(p.pos, "search and replace", LangBash, LangMirBSDKorn)
 		}
 		pe.Repl = &Replace{All: p.tok == dblSlash}
-		p.quote = paramExpRepl
+		oldPattern := p.patternExp
+		p.quote, p.patternExp = paramExpRepl, true
 		p.next()
 		pe.Repl.Orig = p.getWord()
-		p.quote = paramExpExp
+		p.quote, p.patternExp = paramExpExp, false
 		if p.got(slash) {
 			pe.Repl.With = p.getWord()
 		}
+		p.patternExp = oldPattern
 	case colon:
 		// slicing
 		if p.lang == LangPOSIX {
@@ -1454,6 +1697,15 @@ func (p *Parser) paramExp() *ParamExp {
 
 func (p *Parser) paramExpExp() *Expansion {
 	op := ParExpOperator(p.tok)
+	oldPattern := p.patternExp
+	defer func() { p.patternExp = oldPattern }()
+	switch op {
+	case RemSmallPrefix, RemLargePrefix, RemSmallSuffix, RemLargeSuffix,
+		UpperFirst, UpperAll, LowerFirst, LowerAll:
+		p.patternExp = true
+	default:
+		p.patternExp = false
+	}
 	p.quote = paramExpExp
 	p.next()
 	if op == OtherParamOps {
@@ -1797,19 +2049,27 @@ func (p *Parser) gotStmtPipe(s *Stmt, binCmd bool) *Stmt {
 		case "case":
 			p.caseClause(s)
 		case "}":
-			p.curErr(`%q can only be used to close a block`, p.val)
+			if !p.unclosedErr(p.val) {
+				p.curErr(`%q can only be used to close a block`, p.val)
+			}
 		case "then":
 			p.curErr(`%q can only be used in an if`, p.val)
 		case "elif":
 			p.curErr(`%q can only be used in an if`, p.val)
 		case "fi":
-			p.curErr(`%q can only be used to end an if`, p.val)
+			if !p.unclosedErr(p.val) {
+				p.curErr(`%q can only be used to end an if`, p.val)
+			}
 		case "do":
 			p.curErr(`%q can only be used in a loop`, p.val)
 		case "done":
-			p.curErr(`%q can only be used to end a loop`, p.val)
+			if !p.unclosedErr(p.val) {
+				p.curErr(`%q can only be used to end a loop`, p.val)
+			}
 		case "esac":
-			p.curErr(`%q can only be used to end a case`, p.val)
+			if !p.unclosedErr(p.val) {
+				p.curErr(`%q can only be used to end a case`, p.val)
+			}
 		case "!":
 			if !s.Negated {
 				p.curErr(`"!" can only be used in full statements`)
@@ -1926,8 +2186,15 @@ func (p *Parser) gotStmtPipe(s *Stmt, binCmd bool) *Stmt {
 		s.Cmd = b
 		s.Comments, b.X.Comments = b.X.Comments, nil
 		// in "! x | y", the bang applies to the entire pipeline
-		s.Negated = b.X.Negated
-		b.X.Negated = false
+		if s.Negated = b.X.Negated; s.Negated {
+			b.X.Negated = false
+			// X now starts after the bang
+			if x := b.X; len(x.Redirs) > 0 && (x.Cmd == nil || x.Cmd.Pos().After(x.Redirs[0].Pos())) {
+				x.Position = x.Redirs[0].Pos()
+			} else if x.Cmd != nil {
+				x.Position = x.Cmd.Pos()
+			}
+		}
 	}
 	return s
 }
@@ -1960,7 +2227,9 @@ func (p *Parser) arithmExpCmd(s *Stmt) {
 func (p *Parser) block(s *Stmt) {
 	b := &Block{Lbrace: p.pos}
 	p.next()
+	p.openClause(b.Lbrace, "{", "}")
 	b.Stmts, b.Last = p.stmtList("}")
+	p.closeClause()
 	pos, ok := p.gotRsrv("}")
 	b.Rbrace = pos
 	if !ok {
@@ -1972,6 +2241,8 @@ func (p *Parser) block(s *Stmt) {
 func (p *Parser) ifClause(s *Stmt) {
 	rootIf := &IfClause{Position: p.pos}
 	p.next()
+	p.openClause(rootIf.Position, "if", "fi")
+	defer p.closeClause()
 	rootIf.Cond, rootIf.CondLast = p.followStmts("if", rootIf.Position, "then")
 	rootIf.ThenPos = p.followRsrv(rootIf.Position, "if <cond>", "then")
 	rootIf.Then, rootIf.ThenLast = p.followStmts("then", rootIf.ThenPos, "fi", "elif", "else")
@@ -2014,6 +2285,8 @@ func (p *Parser) whileClause(s *Stmt, until bool) {
 		rsrvCond = "until <cond>"
 	}
 	p.next()
+	p.openClause(wc.WhilePos, rsrv, "done")
+	defer p.closeClause()
 	wc.Cond, wc.CondLast = p.followStmts(rsrv, wc.WhilePos, "do")
 	wc.DoPos = p.followRsrv(wc.WhilePos, rsrvCond, "do")
 	wc.Do, wc.DoLast = p.followStmts("do", wc.DoPos, "done")
@@ -2024,6 +2297,8 @@ func (p *Parser) whileClause(s *Stmt, until bool) {
 func (p *Parser) forClause(s *Stmt) {
 	fc := &ForClause{ForPos: p.pos}
 	p.next()
+	p.openClause(fc.ForPos, "for", "done")
+	defer p.closeClause()
 	fc.Loop = p.loop(fc.ForPos)
 	fc.DoPos = p.followRsrv(fc.ForPos, "for foo [in words]", "do")
 
@@ -2091,6 +2366,8 @@ func (p *Parser) wordIter(ftok string, fpos Pos) *WordIter {
 func (p *Parser) selectClause(s *Stmt) {
 	fc := &ForClause{ForPos: p.pos, Select: true}
 	p.next()
+	p.openClause(fc.ForPos, "select", "done")
+	defer p.closeClause()
 	fc.Loop = p.wordIter("select", fc.ForPos)
 	fc.DoPos = p.followRsrv(fc.ForPos, "select foo [in words]", "do")
 	fc.Do, fc.DoLast = p.followStmts("do", fc.DoPos, "done")
@@ -2108,11 +2385,14 @@ func (p *Parser) caseClause(s *Stmt) {
 		if p.lang != LangMirBSDKorn {
 			p.posErr(cc.Pos(), `"case i {" is a mksh feature`)
 		}
+		cc.Braces = true
 		end = "}"
 	} else {
 		p.followRsrv(cc.Case, "case x", "in")
 	}
+	p.openClause(cc.Case, "case", end)
 	cc.Items = p.caseItems(end)
+	p.closeClause()
 	cc.Last, p.accComs = p.accComs, nil
 	cc.Esac = p.stmtEnd(cc, "case", end)
 	s.Cmd = cc
@@ -2134,7 +2414,11 @@ func (p *Parser) caseItems(stop string) (items []*CaseItem) {
 				break
 			}
 			if !p.got(or) {
-				p.curErr("case patterns must be separated with |")
+				// a single word like "done" may be closing an
+				// outer clause
+				if len(ci.Patterns) != 1 || !p.unclosedErr(ci.Patterns[0].Lit()) {
+					p.curErr("case patterns must be separated with |")
+				}
 			}
 		}
 		old := p.preNested(switchCase)
@@ -2247,7 +2531,12 @@ func (p *Parser) testExpr(ftok token, fpos Pos, pastAndOr bool) TestExpr {
 				AndTest, OrTest, "]]")
 		}
 		p.next()
-		b.Y = p.followWordTok(token(b.Op), b.OpPos)
+		w := p.followWordTok(token(b.Op), b.OpPos)
+		if b.Op == TsReMatch {
+			b.Y = &RegexWord{Word: w}
+		} else {
+			b.Y = w
+		}
 	}
 	p.quote = oldQuote
 	return b
@@ -2371,6 +2660,7 @@ func (p *Parser) coprocClause(s *Stmt) {
 		if call, ok := cc.Stmt.Cmd.(*CallExpr); ok {
 			// name was in fact the start of a call
 			call.Args = append([]*Word{cc.Name}, call.Args...)
+			cc.Stmt.Position = cc.Name.Pos()
 			cc.Name = nil
 		}
 	}
@@ -2458,7 +2748,12 @@ loop:
 			}
 			fallthrough
 		default:
-			p.curErr("a command can only contain words and redirects")
+			if p.tok == leftParen && !p.spaced && declArrayArgs(ce.Args) {
+				// e.g. "export foo=(bar)" when not parsed as a DeclClause
+				p.langErr(p.pos, "arrays", LangBash)
+			} else {
+				p.curErr("a command can only contain words and redirects")
+			}
 		}
 	}
 	if len(ce.Assigns) == 0 && len(ce.Args) == 0 {
@@ -2476,6 +2771,24 @@ loop:
 	s.Cmd = ce
 }
 
+// declArrayArgs reports whether args are a declaration builtin followed by
+// the start of an assignment, like "export foo=", which an array may follow.
+func declArrayArgs(args []*Word) bool {
+	if len(args) < 2 {
+		return false
+	}
+	switch args[0].Lit() {
+	case "declare", "local", "export", "readonly", "typeset", "nameref":
+	default:
+		return false
+	}
+	lit := args[len(args)-1].Lit()
+	if !strings.HasSuffix(lit, "=") {
+		return false
+	}
+	return ValidName(strings.TrimSuffix(lit[:len(lit)-1], "+"))
+}
+
 func (p *Parser) funcDecl(s *Stmt, name *Lit, pos Pos) {
 	fd := &FuncDecl{
 		Position: pos,
@@ -500,6 +500,34 @@ var shellTests = []errorCase{
 		in:     "if done; then b; fi",
 		common: `1:4: "done" can only be used to end a loop`,
 	},
+	{
+		in:     "if a; then\n\tfor i in b; do\n\t\tc\nfi",
+		common: `2:2: for statement must end with "done"`,
+	},
+	{
+		in:     "for i in a; do\n\tif b; then\n\t\tc\n\tfor j in d; do\n\t\te\n\tdone\ndone",
+		common: `2:2: if statement must end with "fi"`,
+	},
+	{
+		in:     "while a; do\n\tcase b in\n\tc) d ;;\ndone",
+		common: `2:2: case statement must end with "esac"`,
+	},
+	{
+		in:     "case a in\nb)\n\tuntil c; do\n\t\td\n\t;;\nesac",
+		common: `3:2: until statement must end with "done"`,
+	},
+	{
+		in:     "if a; then\n\tcase b in\n\tc)\n\t\tfor i in d; do\n\t\t\te\n\t\t;;\n\tesac\nfi",
+		common: `4:3: for statement must end with "done"`,
+	},
+	{
+		in:     "foo() {\n\tif a; then\n\t\tb\n}",
+		common: `2:2: if statement must end with "fi"`,
+	},
+	{
+		in:     "if a; then { b; fi",
+		common: `1:12: reached "fi" without matching { with }`,
+	},
 	{
 		in:     "'",
 		common: `1:1: reached EOF without closing quote '`,
@@ -1743,6 +1771,23 @@ var shellTests = []errorCase{
 		in:     "a=$c\n'",
 		common: `2:1: reached EOF without closing quote '`,
 	},
+	{
+		in:    "export foo=(1 2)",
+		posix: `1:12: arrays are a bash feature`,
+	},
+	{
+		in:    "readonly foo+=([a]=b)",
+		posix: `1:15: arrays are a bash feature`,
+	},
+	{
+		in:    "declare -A foo=([a]=b)",
+		posix: `1:16: arrays are a bash feature`,
+		mksh:  `1:16: arrays are a bash feature`,
+	},
+	{
+		in:     "echo foo=(1 2)",
+		common: `1:10: a command can only contain words and redirects`,
+	},
 	{
 		in:    "echo ${!foo}",
 		posix: `1:8: ${!foo} is a bash/mksh feature`,
@@ -1863,6 +1908,263 @@ func TestInputName(t *testing.T) {
 	}
 }
 
+func TestNodeText(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		in   string
+		node func(f *File) Node
+		want string
+	}{
+		{
+			"foo; bar  baz \\\n\tqux # c",
+			func(f *File) Node { return f.Stmts[1] },
+			"bar  baz \\\n\tqux",
+		},
+		{
+			"foo \"${bar}\"",
+			func(f *File) Node { return f.Stmts[0].Cmd.(*CallExpr).Args[1] },
+			"\"${bar}\"",
+		},
+		{
+			"cat <<EOF\nbody\nEOF\nfoo",
+			func(f *File) Node { return f.Stmts[0] },
+			"cat <<EOF\nbody\nEOF",
+		},
+		{
+			"cat <<EOF | grep x\nbody\nEOF",
+			func(f *File) Node { return f.Stmts[0].Cmd.(*BinaryCmd).X },
+			"cat <<EOF\nbody\nEOF",
+		},
+		{
+			"cat <<EOF | grep x\nbody\nEOF",
+			func(f *File) Node { return f.Stmts[0].Cmd.(*BinaryCmd).Y },
+			"grep x",
+		},
+		{
+			"cat <<A; cat <<-B # c\na\nA\n\tb\n\tB\n",
+			func(f *File) Node { return f.Stmts[1] },
+			"cat <<-B\n\tb\n\tB",
+		},
+		{
+			"cat <<A <<'B'\na\nA\nb\nB",
+			func(f *File) Node { return f.Stmts[0].Redirs[1] },
+			"<<'B'\nb\nB",
+		},
+		{
+			"foo <<EOF && {\nbar\nEOF\n\tetc\n}",
+			func(f *File) Node { return f.Stmts[0].Cmd.(*BinaryCmd).Y },
+			"{\n\tetc\n}",
+		},
+		{
+			"foo$\\\n",
+			func(f *File) Node { return f.Stmts[0] },
+			"foo$",
+		},
+		{
+			"echo $(cat <<EOF\nbody\nEOF\n) after",
+			func(f *File) Node { return f.Stmts[0].Cmd.(*CallExpr).Args[1] },
+			"$(cat <<EOF\nbody\nEOF\n)",
+		},
+	}
+	p := NewParser(KeepComments(true), RetainSource(true))
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			f, err := p.Parse(strings.NewReader(tc.in), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(f.Src); got != tc.in {
+				t.Fatalf("File.Src mismatch:\nwant: %q\ngot:  %q", tc.in, got)
+			}
+			if got := string(f.NodeText(tc.node(f))); got != tc.want {
+				t.Fatalf("NodeText mismatch in %q:\nwant: %q\ngot:  %q",
+					tc.in, tc.want, got)
+			}
+		})
+	}
+	f, err := NewParser().Parse(strings.NewReader("foo"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Src != nil || f.NodeText(f.Stmts[0]) != nil {
+		t.Fatal("expected no source without RetainSource")
+	}
+}
+
+// equalNoPos is like reflect.DeepEqual, but it ignores positions.
+func equalNoPos(x, y reflect.Value) bool {
+	if x.Type() != y.Type() {
+		return false
+	}
+	switch x.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if x.IsNil() || y.IsNil() {
+			return x.IsNil() == y.IsNil()
+		}
+		return equalNoPos(x.Elem(), y.Elem())
+	case reflect.Slice:
+		if x.Len() != y.Len() {
+			return false
+		}
+		for i := 0; i < x.Len(); i++ {
+			if !equalNoPos(x.Index(i), y.Index(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.Struct:
+		if x.Type() == posType {
+			return true
+		}
+		for i := 0; i < x.NumField(); i++ {
+			if !equalNoPos(x.Field(i), y.Field(i)) {
+				return false
+			}
+		}
+		return true
+	case reflect.String:
+		return x.String() == y.String()
+	case reflect.Bool:
+		return x.Bool() == y.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return x.Int() == y.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return x.Uint() == y.Uint()
+	}
+	panic(fmt.Sprintf("unexpected kind: %s", x.Kind()))
+}
+
+// TestNodeTextReparse checks that the text of every statement and command
+// argument in the file tests parses back into an equal node. Backquotes are
+// skipped, as their escaping means the text is not valid on its own.
+func TestNodeTextReparse(t *testing.T) {
+	t.Parallel()
+	printer := NewPrinter()
+	print := func(node Node) string {
+		var buf bytes.Buffer
+		if err := printer.Print(&buf, node); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+	for i, c := range fileTests {
+		lang := LangPOSIX
+		if c.Bash != nil {
+			lang = LangBash
+		} else if c.MirBSDKorn != nil {
+			lang = LangMirBSDKorn
+		}
+		p := NewParser(Variant(lang), RetainSource(true))
+		for j, in := range c.Strs {
+			t.Run(fmt.Sprintf("%03d-%d", i, j), func(t *testing.T) {
+				f, err := p.Parse(strings.NewReader(in), "")
+				if err != nil {
+					t.Fatal(err)
+				}
+				check := func(node Node, text []byte, got Node) {
+					if !equalNoPos(reflect.ValueOf(node), reflect.ValueOf(got)) {
+						want, got := print(node), print(got)
+						t.Fatalf("text %q of %T in %q parsed into a different node:\nwant: %q\ngot:  %q",
+							text, node, in, want, got)
+					}
+				}
+				Walk(f, func(node Node) bool {
+					switch x := node.(type) {
+					case *CmdSubst:
+						return !x.Backquotes
+					case *Stmt:
+						text := f.NodeText(x)
+						f2, err := p.Parse(bytes.NewReader(text), "")
+						if err != nil {
+							t.Fatalf("text %q of %T in %q is invalid: %v", text, x, in, err)
+						}
+						if len(f2.Stmts) != 1 {
+							t.Fatalf("text %q of %T in %q parsed into %d statements",
+								text, x, in, len(f2.Stmts))
+						}
+						check(x, text, f2.Stmts[0])
+					case *CallExpr:
+						for _, word := range x.Args {
+							text := f.NodeText(word)
+							var words []*Word
+							err := p.Words(bytes.NewReader(text), func(w *Word) bool {
+								words = append(words, w)
+								return true
+							})
+							if err != nil || len(words) != 1 {
+								t.Fatalf("text %q of %T in %q is not a single word: %v",
+									text, word, in, err)
+							}
+							check(word, text, words[0])
+						}
+					}
+					return true
+				})
+			})
+		}
+	}
+}
+
+func TestNodeSpan(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		in   string
+		node func(f *File) Node
+		want string
+	}{
+		{
+			"declare a[1] b",
+			func(f *File) Node { return f.Stmts[0].Cmd.(*DeclClause).Args[0] },
+			"a[1]",
+		},
+		{
+			"a[1]=x",
+			func(f *File) Node { return f.Stmts[0].Cmd.(*CallExpr).Assigns[0] },
+			"a[1]=x",
+		},
+		{
+			"time -p; foo",
+			func(f *File) Node { return f.Stmts[0].Cmd },
+			"time -p",
+		},
+		{
+			"time; foo",
+			func(f *File) Node { return f.Stmts[0].Cmd },
+			"time",
+		},
+		{
+			"! foo | bar",
+			func(f *File) Node { return f.Stmts[0].Cmd.(*BinaryCmd).X },
+			"foo",
+		},
+		{
+			"! >f foo | bar",
+			func(f *File) Node { return f.Stmts[0].Cmd.(*BinaryCmd).X },
+			">f foo",
+		},
+		{
+			"coproc foo bar",
+			func(f *File) Node { return f.Stmts[0].Cmd.(*CoprocClause).Stmt },
+			"foo bar",
+		},
+	}
+	p := NewParser()
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			f, err := p.Parse(strings.NewReader(tc.in), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			node := tc.node(f)
+			got := tc.in[node.Pos().Offset():node.End().Offset()]
+			if got != tc.want {
+				t.Fatalf("%T spans the wrong text in %q:\nwant: %q\ngot:  %q",
+					node, tc.in, tc.want, got)
+			}
+		})
+	}
+}
+
 var errBadReader = fmt.Errorf("write: expected error")
 
 type badReader struct{}
@@ -2248,3 +2550,73 @@ func TestIsIncomplete(t *testing.T) {
 		})
 	}
 }
+
+func TestParseRecoverErrors(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		in   string
+		max  uint
+		want string // the statements kept, printed
+		errs []string
+	}{
+		{"foo\nbar\n", 5, "foo\nbar\n", nil},
+		{"foo\nbar )\nbaz\n", 5, "foo\nbaz\n", []string{
+			`2:5: a command can only contain words and redirects`,
+		}},
+		{"foo; bar )\nbaz\n", 5, "foo\nbaz\n", []string{
+			`1:10: a command can only contain words and redirects`,
+		}},
+		{"if foo\n\tbar )\nfi\nbaz\n", 5, "baz\n", []string{
+			`2:6: a command can only contain words and redirects`,
+		}},
+		{"a )\nb )\nc )\nd\n", 2, "", []string{
+			`1:3: a command can only contain words and redirects`,
+			`2:3: a command can only contain words and redirects`,
+		}},
+		{"a )\nb\nc &&\n", 5, "b\n", []string{
+			`1:3: a command can only contain words and redirects`,
+			`3:3: && must be followed by a statement`,
+		}},
+		{"foo\n[[ a ]] )\n$(( 1 +", 5, "foo\n[[ a ]]\n", []string{
+			`2:9: statements must be separated by &, ; or a newline`,
+			`3:7: + must be followed by an expression`,
+		}},
+	}
+	printer := NewPrinter()
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%02d", i), func(t *testing.T) {
+			p := NewParser(RecoverErrors(tc.max))
+			f, err := p.Parse(strings.NewReader(tc.in), "")
+			var got []string
+			if err != nil {
+				list, ok := err.(ErrorList)
+				if !ok {
+					t.Fatalf("want an ErrorList, got %T", err)
+				}
+				for _, err := range list {
+					got = append(got, err.Error())
+				}
+			}
+			if !reflect.DeepEqual(got, tc.errs) {
+				t.Fatalf("errors mismatch in %q:\nwant: %q\ngot:  %q", tc.in, tc.errs, got)
+			}
+			var buf bytes.Buffer
+			for _, s := range f.Stmts {
+				printer.Print(&buf, s)
+				buf.WriteString("\n")
+				// Positions must still be correct after recovering.
+				pos := s.Pos()
+				before := tc.in[:pos.Offset()]
+				line := uint(strings.Count(before, "\n") + 1)
+				col := uint(len(before) - strings.LastIndex(before, "\n"))
+				if pos.Line() != line || pos.Col() != col {
+					t.Fatalf("statement at offset %d has position %s, want %d:%d",
+						pos.Offset(), pos, line, col)
+				}
+			}
+			if buf.String() != tc.want {
+				t.Fatalf("statements mismatch in %q:\nwant: %q\ngot:  %q", tc.in, tc.want, buf.String())
+			}
+		})
+	}
+}
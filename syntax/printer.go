@@ -8,9 +8,11 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 	"text/tabwriter"
 	"unicode"
+	"unicode/utf8"
 )
 
 // PrinterOption is a function which can be passed to NewPrinter
@@ -43,24 +45,51 @@ func SpaceRedirects(enabled bool) PrinterOption {
 	return func(p *Printer) { p.spaceRedirects = enabled }
 }
 
-// KeepPadding will keep most nodes and tokens in the same column that
-// they were in the original source. This allows the user to decide how
-// to align and pad their code with spaces.
+// KeepPadding will keep the padding between the tokens in each line, such as
+// the extra spaces used to align code by hand.
 //
-// Note that this feature is best-effort and will only keep the
-// alignment stable, so it may need some human help the first time it is
-// run.
+// Tokens which are in the same column in consecutive lines of the source are
+// aligned again once the rest of the formatting is done, so that the alignment
+// survives changes to the indentation or to the code before the tokens. This
+// applies to the words and redirects of simple commands and declarations,
+// such as the values in a block of assignments, to trailing comments, and to
+// the bodies of case patterns. A single line in between without such a token
+// does not break the alignment. Any other padding is kept as it was relative
+// to the token before it in the line.
+//
+// Padding is always written with spaces, and never at the start of a line.
+// Minify ignores this option.
 func KeepPadding(enabled bool) PrinterOption {
 	return func(p *Printer) {
-		// TODO: support setting this option to false.
-		if enabled {
-			p.keepPadding = true
-			p.cols.Writer = p.bufWriter.(*bufio.Writer)
-			p.bufWriter = &p.cols
+		switch {
+		case enabled && p.pad == nil:
+			p.pad = &padWriter{dst: p.bufWriter}
+			p.bufWriter = p.pad
+		case !enabled && p.pad != nil:
+			p.bufWriter = p.pad.dst
+			p.pad = nil
 		}
+		p.keepPadding = enabled
 	}
 }
 
+// AlignComments will align the trailing comments of runs of consecutive
+// statements in the same list, padding each statement with spaces so that the
+// comments start at the same column. At most maxPadding spaces are used before
+// each comment, so a statement which would need more starts a new run. A run
+// only contains statements on consecutive lines with a trailing comment each,
+// so it is broken by a blank line, a comment line, or any other statement, such
+// as one spanning multiple lines. A maxPadding of zero disables the option.
+//
+// Without this option, the trailing comments on consecutive lines are aligned
+// without any limit. Note that the values of consecutive assignments cannot be
+// aligned in the same way, as the shell does not allow blanks around "=".
+//
+// This option is ignored when KeepPadding or Minify are used.
+func AlignComments(maxPadding uint) PrinterOption {
+	return func(p *Printer) { p.alignPadding = maxPadding }
+}
+
 // Minify will print programs in a way to save the most bytes possible.
 // For example, indentation and comments are skipped, and extra
 // whitespace is avoided when possible.
@@ -68,6 +97,99 @@ func Minify(enabled bool) PrinterOption {
 	return func(p *Printer) { p.minify = enabled }
 }
 
+// MinifyBraces will make Minify also factor the common prefixes and suffixes of
+// consecutive words into brace expansions, such as "/a/{b,c}" for the words
+// "/a/b" and "/a/c", when that saves bytes. This applies to the arguments of
+// simple commands and to the words of for loops; see FactorBraces.
+//
+// Since brace expansions are not part of POSIX Shell, this option should only
+// be used for the shells which support them, such as Bash.
+func MinifyBraces(enabled bool) PrinterOption {
+	return func(p *Printer) { p.minifyBraces = enabled }
+}
+
+// HeredocIndent will re-indent the bodies of <<- heredocs to match the
+// indentation level of the surrounding code, including when indenting with
+// spaces. Since <<- only strips leading tabs, the bodies and their closing
+// delimiters are always indented with tabs, one per level. The relative
+// indentation between the lines of a body is kept.
+//
+// A body is only re-indented if its existing indentation is uniform, meaning
+// that the leading whitespace of each of its lines consists of tabs only.
+// Heredocs using << are always printed byte for byte.
+//
+// Without this option, <<- bodies are only re-indented when indenting with
+// tabs.
+func HeredocIndent(enabled bool) PrinterOption {
+	return func(p *Printer) { p.hdocIndent = enabled }
+}
+
+// Reindent converts the indentation of what the printer can't reformat, from
+// the indentation used in the source to the one set by Indent. This is useful
+// for a one-off conversion between tabs and spaces, or between widths. The
+// indentation of the source is detected from the lines which start statements.
+//
+// The lines in regions where formatting is disabled keep their indentation
+// levels, and the alignment of line continuations past the indentation of the
+// line before them is kept as it was. The columns aligned by KeepPadding are
+// computed again, keeping each group in its source column relative to its least
+// indented line, so that converting back results in the original source.
+// Heredoc bodies and multi-line strings are never changed.
+//
+// This option only has an effect when printing a *File parsed with
+// RetainSource.
+func Reindent(enabled bool) PrinterOption {
+	return func(p *Printer) { p.reindent = enabled }
+}
+
+// BracesMode is the way braces around simple parameter expansions are printed;
+// see ParamBraces.
+type BracesMode int
+
+const (
+	BracesLeave   BracesMode = iota // leave braces as they were, like "$a ${b}"
+	BracesAlways                    // add braces where idiomatic, like "${a}"
+	BracesMinimal                   // remove braces where possible, like "$a"
+)
+
+// String returns the name of the mode, like "minimal", as used by shfmt.
+func (m BracesMode) String() string {
+	if m < 0 || int(m) >= len(bracesModeNames) {
+		return "unknown braces mode"
+	}
+	return bracesModeNames[m]
+}
+
+// ParamBraces changes how braces around simple parameter expansions are
+// printed. Expansions with operators, such as "${a:-b}" or "${#a}", are never
+// changed.
+//
+// BracesAlways only adds braces around variable names, so special and
+// positional parameters like "$?" or "$1" are left as they are. BracesMinimal
+// keeps the braces whenever they are needed, such as in "${a}b" or "${10}".
+// Minify implies BracesMinimal.
+func ParamBraces(mode BracesMode) PrinterOption {
+	return func(p *Printer) { p.braces = mode }
+}
+
+// WrapAt breaks simple commands, arrays, pipelines and lists which would go
+// past the given column, so that the printed lines fit in it where possible.
+// Lines are broken between the words of a command with escaped newlines,
+// between the elements of arrays, and at the operators of pipelines and lists,
+// following BinaryNextLine. The lines after a break are indented by one more
+// level.
+//
+// Lines are never broken inside quotes, before heredoc bodies, between an
+// option like "-o" and a separate argument in the same line after it, or
+// between a command name and its first argument if the command name already
+// goes past the column, so some lines may still go past it. Tabs are counted as eight columns. Since
+// breaks are kept when printing again, the output is stable.
+//
+// A column of zero disables the option, and Minify ignores it.
+func WrapAt(col uint) PrinterOption {
+	return func(p *Printer) { p.wrapAt = col }
+}
+
 // NewPrinter allocates a new Printer and applies any number of options.
 func NewPrinter(opts ...PrinterOption) *Printer {
 	p := &Printer{
@@ -84,8 +206,26 @@ func NewPrinter(opts ...PrinterOption) *Printer {
 // to w are buffered.
 //
 // The node types supported at the moment are *File, *Stmt, *Word, any Command
-// node, and any WordPart node. A trailing newline will only be printed when a
-// *File is used.
+// node, any WordPart node, and any ArithmExpr node. A trailing newline will
+// only be printed when a *File is used.
+//
+// Comments are never dropped, but those where the grammar can't keep them,
+// such as between an if condition and "then", are moved to a fixed place. The
+// first comment before "then", "do", or a function's body follows the reserved
+// word or the opening brace or parenthesis on its line, like in
+// "if foo; then # comment", and any others start the body. Comments after
+// "else", "(", "$(", or ";;" stay on their line, and those before ";;" stay in
+// the body of the case item. A comment ends at the end of its line, even if the
+// line ends with a backslash. Comments of a statement without a position, such
+// as those set by CommentMap.Attach, are printed on the lines right before it.
+//
+// When printing a *File parsed with RetainSource, formatting can be disabled
+// for a region of statements by placing a "# shfmt:off" comment line before
+// them, and enabled again with a "# shfmt:on" comment line. The statements and
+// comments between the two directives are printed exactly as they were in the
+// source. The directives apply to the statement list they are in, so a region
+// without a "# shfmt:on" extends until the end of its block, or until the end
+// of the file at the top level. These directives are ignored when minifying.
 func (p *Printer) Print(w io.Writer, node Node) error {
 	p.reset()
 
@@ -104,8 +244,25 @@ func (p *Printer) Print(w io.Writer, node Node) error {
 	w = p.tabWriter
 
 	p.bufWriter.Reset(w)
+	if p.wrapAt > 0 && !p.minify {
+		p.cols = &colWriter{bufWriter: p.bufWriter, blank: true}
+		p.bufWriter = p.cols
+		defer func() {
+			p.bufWriter = p.cols.bufWriter
+			p.cols = nil
+		}()
+	}
 	switch x := node.(type) {
 	case *File:
+		if x.Src != nil && !p.minify {
+			p.file = x
+			if p.reindent {
+				p.srcIndent, p.srcIndentOK = sourceIndent(x)
+			}
+		}
+		if p.pad != nil {
+			p.pad.reindent = p.reindent && p.file != nil
+		}
 		p.stmtList(x.Stmts, x.Last)
 		p.newline(x.End())
 	case *Stmt:
@@ -116,9 +273,15 @@ func (p *Printer) Print(w io.Writer, node Node) error {
 	case *Word:
 		p.line = x.Pos().Line()
 		p.word(x)
+	case *RegexWord:
+		p.line = x.Pos().Line()
+		p.testExpr(x)
 	case WordPart:
 		p.line = x.Pos().Line()
 		p.wordPart(x, nil)
+	case ArithmExpr:
+		p.line = x.Pos().Line()
+		p.arithmExpr(x, false, false)
 	default:
 		return fmt.Errorf("unsupported node type: %T", x)
 	}
@@ -137,6 +300,119 @@ func (p *Printer) Print(w io.Writer, node Node) error {
 	return nil
 }
 
+// PrintLines is like Print for a file, but it only formats the top-level
+// statements on the lines from start to end, counting from 1 and both
+// inclusive. The rest of the source is copied as is, so the file must have been
+// parsed with RetainSource.
+//
+// Statements which share a line are formatted together, each along with the
+// comments before it. Statements in a region with formatting disabled via a
+// "# shfmt:off" comment are kept as they are, like with Print.
+func (p *Printer) PrintLines(w io.Writer, f *File, start, end uint) error {
+	src := f.Src
+	if src == nil && (len(f.Stmts) > 0 || len(f.Last) > 0) {
+		return fmt.Errorf("PrintLines needs the source, kept via RetainSource")
+	}
+	// A chunk is a list of statements sharing lines, spanning the whole
+	// lines from offset start up to end, without any trailing empty lines.
+	type chunk struct {
+		first, last        int
+		start, end         uint
+		startLine, endLine uint
+	}
+	var chunks []chunk
+	offStart := make([]int, len(f.Stmts)) // see below
+	off := -1
+	for i := 0; i < len(f.Stmts); {
+		c := chunk{first: i, last: i}
+		for c.last+1 < len(f.Stmts) &&
+			stmtsPos(f.Stmts[c.last+1:], nil).Line() <= f.Stmts[c.last].End().Line() {
+			c.last++
+		}
+		// offStart is the first statement of the region with formatting
+		// disabled which each statement belongs to, or -1.
+		for j := c.first; j <= c.last; j++ {
+			s := f.Stmts[j]
+			for _, com := range s.Comments {
+				if com.Pos().After(s.Pos()) {
+					break
+				}
+				switch FmtDirective(com) {
+				case "off":
+					if off < 0 {
+						off = j
+					}
+				case "on":
+					off = -1
+				}
+			}
+			offStart[j] = off
+		}
+		pos := stmtsPos(f.Stmts[c.first:], nil)
+		c.start = uint(bytes.LastIndexByte(src[:pos.Offset()], '\n') + 1)
+		c.startLine = pos.Line()
+		chunks = append(chunks, c)
+		i = c.last + 1
+	}
+	for i := range chunks {
+		c := &chunks[i]
+		c.end = uint(len(src))
+		if i+1 < len(chunks) {
+			c.end = chunks[i+1].start
+		} else if len(f.Last) > 0 {
+			lastPos := f.Last[0].Pos().Offset()
+			c.end = uint(bytes.LastIndexByte(src[:lastPos], '\n') + 1)
+		}
+		for c.end > c.start {
+			lineStart := uint(bytes.LastIndexByte(src[:c.end-1], '\n') + 1)
+			if len(bytes.TrimSpace(src[lineStart:c.end])) > 0 {
+				break
+			}
+			c.end = lineStart
+		}
+		text := src[c.start:c.end]
+		lines := uint(bytes.Count(text, []byte("\n")))
+		if len(text) > 0 && text[len(text)-1] != '\n' {
+			lines++
+		}
+		c.endLine = c.startLine
+		if lines > 0 {
+			c.endLine += lines - 1
+		}
+	}
+	first, last := -1, -1
+	for i, c := range chunks {
+		if c.endLine >= start && c.startLine <= end {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	if first < 0 {
+		_, err := w.Write(src)
+		return err
+	}
+	// Include the start of a region with formatting disabled, so that
+	// the region is printed as it is.
+	if off := offStart[chunks[first].first]; off >= 0 {
+		for chunks[first].first > off {
+			first--
+		}
+	}
+	if _, err := w.Write(src[:chunks[first].start]); err != nil {
+		return err
+	}
+	part := *f
+	part.Stmts = f.Stmts[chunks[first].first : chunks[last].last+1]
+	part.Last = nil
+	if err := p.Print(w, &part); err != nil {
+		return err
+	}
+	_, err := w.Write(src[chunks[last].end:])
+	return err
+}
+
 type bufWriter interface {
 	Write([]byte) (int, error)
 	WriteString(string) (int, error)
@@ -145,40 +421,268 @@ type bufWriter interface {
 	Flush() error
 }
 
-type colCounter struct {
-	*bufio.Writer
-	column    int
-	lineStart bool
+// colWriter keeps track of the column at the end of the output, for WrapAt.
+type colWriter struct {
+	bufWriter
+
+	col   uint
+	blank bool // whether the current line only has blanks so far
+}
+
+func (w *colWriter) Write(b []byte) (int, error) {
+	for _, c := range b {
+		w.add(c)
+	}
+	return w.bufWriter.Write(b)
+}
+
+func (w *colWriter) WriteString(s string) (int, error) {
+	for i := 0; i < len(s); i++ {
+		w.add(s[i])
+	}
+	return w.bufWriter.WriteString(s)
+}
+
+func (w *colWriter) WriteByte(c byte) error {
+	w.add(c)
+	return w.bufWriter.WriteByte(c)
 }
 
-func (c *colCounter) WriteByte(b byte) error {
-	switch b {
-	case '\n':
-		c.column = 0
-		c.lineStart = true
-	case '\t', ' ':
+func (w *colWriter) add(c byte) {
+	switch {
+	case c == '\n':
+		w.col, w.blank = 0, true
+	case c == '\xff' || !utf8.RuneStart(c):
+		// tabwriter escapes and the rest of multibyte runes
+	case c == '\t':
+		w.col += 8 - w.col%8
 	default:
-		c.lineStart = false
+		w.col++
+		if c != ' ' {
+			w.blank = false
+		}
+	}
+}
+
+// padWriter holds all the output when KeepPadding is used, so that the tokens
+// in each alignment group can be padded to the same column once all of their
+// lines have been printed.
+type padWriter struct {
+	buf bytes.Buffer
+	dst bufWriter
+
+	// lineStart is the offset in buf at which the current line starts, and
+	// blank is whether the line only has blanks so far.
+	lineStart int
+	blank     bool
+
+	marks []padMark
+
+	// gaps holds the minimum distance in the source between the tokens of
+	// each alignment group and the tokens before them, and cols holds the
+	// source column of each group.
+	gaps []int
+	cols []int
+
+	// reindent is set with Reindent, in which case the groups in the same
+	// column in consecutive lines are also aligned together, and are kept
+	// in their source column relative to their least indented line.
+	reindent bool
+}
+
+// padMark is a position in the output where a token of an alignment group
+// starts, and before which padding may be needed.
+type padMark struct {
+	offset    int
+	lineStart int
+	col       int // the output column at offset, not counting padding
+	group     int
+
+	// used with Reindent; shift is how much wider the indentation of the
+	// line is in the output than in the source, and indent is the width
+	// in the source.
+	line          uint
+	shift, indent int
+}
+
+func (w *padWriter) track(s string) {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\n':
+			w.lineStart = w.buf.Len() + i + 1
+			w.blank = true
+		case ' ', '\t':
+		default:
+			w.blank = false
+		}
+	}
+}
+
+func (w *padWriter) Write(b []byte) (int, error) {
+	w.track(string(b))
+	return w.buf.Write(b)
+}
+
+func (w *padWriter) WriteString(s string) (int, error) {
+	w.track(s)
+	return w.buf.WriteString(s)
+}
+
+func (w *padWriter) WriteByte(b byte) error {
+	w.track(string(b))
+	return w.buf.WriteByte(b)
+}
+
+// col returns the current column in the output, starting at zero. Tabs are
+// expanded like in padCol.
+func (w *padWriter) col() int {
+	return visualWidth(w.buf.Bytes()[w.lineStart:])
+}
+
+// indent returns the width of the indentation of the current line.
+func (w *padWriter) indent() int {
+	line := w.buf.Bytes()[w.lineStart:]
+	end := 0
+	for end < len(line) && (line[end] == ' ' || line[end] == '\t' || line[end] == '\xff') {
+		end++
+	}
+	return visualWidth(line[:end])
+}
+
+// visualWidth returns the width of a string, expanding tabs to the next
+// multiple of eight and ignoring tabwriter escapes.
+func visualWidth(b []byte) int {
+	width := 0
+	for len(b) > 0 {
+		r, size := utf8.DecodeRune(b)
+		switch {
+		case b[0] == '\xff':
+		case r == '\t':
+			width += 8 - width%8
+		default:
+			width++
+		}
+		b = b[size:]
 	}
-	c.column++
-	return c.Writer.WriteByte(b)
+	return width
+}
+
+func (w *padWriter) Reset(dst io.Writer) {
+	w.dst.Reset(dst)
+	w.clear()
 }
 
-func (c *colCounter) WriteString(s string) (int, error) {
-	c.lineStart = false
-	for _, r := range s {
-		if r == '\n' {
-			c.column = 0
+func (w *padWriter) clear() {
+	w.buf.Reset()
+	w.lineStart, w.blank = 0, true
+	w.marks = w.marks[:0]
+	w.gaps, w.cols = w.gaps[:0], w.cols[:0]
+}
+
+func (w *padWriter) Flush() error {
+	pads := w.pads()
+	out := w.buf.Bytes()
+	last := 0
+	for i, m := range w.marks {
+		w.dst.Write(out[last:m.offset])
+		for n := 0; n < pads[i]; n++ {
+			w.dst.WriteByte(' ')
+		}
+		last = m.offset
+	}
+	w.dst.Write(out[last:])
+	w.clear()
+	return w.dst.Flush()
+}
+
+// pads returns the number of spaces to write at each mark. Each group is padded
+// so that its tokens start at the same column, keeping the smallest distance
+// between them and the tokens before them that they had in the source.
+//
+// The groups are resolved from left to right, so that the padding of any
+// tokens earlier in the same line is known.
+func (w *padWriter) pads() []int {
+	pads := make([]int, len(w.marks))
+	byGroup := make([][]int, len(w.gaps))
+	for i, m := range w.marks {
+		byGroup[m.group] = append(byGroup[m.group], i)
+	}
+	order := make([]int, len(w.gaps))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return w.cols[order[i]] < w.cols[order[j]]
+	})
+	col := func(i int) int {
+		col := w.marks[i].col
+		for j := i - 1; j >= 0 && w.marks[j].lineStart == w.marks[i].lineStart; j-- {
+			col += pads[j]
+		}
+		return col
+	}
+	if w.reindent {
+		w.mergeGroups(byGroup)
+	}
+	for _, g := range order {
+		if len(byGroup[g]) == 0 {
+			continue // merged into another group
+		}
+		target := 0
+		for _, i := range byGroup[g] {
+			if col := col(i); col > target {
+				target = col
+			}
+		}
+		if w.reindent {
+			// The source column, shifted like the least indented
+			// line, as long as all the tokens fit.
+			least := byGroup[g][0]
+			for _, i := range byGroup[g] {
+				if w.marks[i].indent < w.marks[least].indent {
+					least = i
+				}
+			}
+			if col := w.cols[g] - 1 + w.marks[least].shift; col >= target {
+				target = col
+			} else {
+				target += w.gaps[g] - 1
+			}
+		} else {
+			target += w.gaps[g] - 1
+		}
+		for _, i := range byGroup[g] {
+			pads[i] = target - col(i)
 		}
-		c.column++
 	}
-	return c.Writer.WriteString(s)
+	return pads
 }
 
-func (c *colCounter) Reset(w io.Writer) {
-	c.column = 1
-	c.lineStart = true
-	c.Writer.Reset(w)
+// mergeGroups joins the groups with tokens in the same source column in
+// consecutive lines, as used by Reindent. The marks of each merged group are
+// moved to the first of them, and the smallest gap is kept.
+func (w *padWriter) mergeGroups(byGroup [][]int) {
+	last := make(map[int]int) // the last mark seen in each source column
+	for i, m := range w.marks {
+		col := w.cols[m.group]
+		j, ok := last[col]
+		last[col] = i
+		if !ok || w.marks[j].line+1 != m.line {
+			continue
+		}
+		from, to := m.group, w.marks[j].group
+		if from == to {
+			continue
+		}
+		for _, k := range byGroup[from] {
+			w.marks[k].group = to
+		}
+		byGroup[to] = append(byGroup[to], byGroup[from]...)
+		byGroup[from] = nil
+		if w.gaps[from] < w.gaps[to] {
+			w.gaps[to] = w.gaps[from]
+		}
+	}
 }
 
 // Printer holds the internal state of the printing mechanism of a
@@ -186,19 +690,46 @@ func (c *colCounter) Reset(w io.Writer) {
 type Printer struct {
 	bufWriter
 	tabWriter *tabwriter.Writer
-	cols      colCounter
+
+	// pad is the writer used with KeepPadding.
+	pad *padWriter
 
 	indentSpaces   uint
 	binNextLine    bool
 	swtCaseIndent  bool
 	spaceRedirects bool
 	keepPadding    bool
+	alignPadding   uint
 	minify         bool
+	minifyBraces   bool
+	braces         BracesMode
+	hdocIndent     bool
+	reindent       bool
+	wrapAt         uint
+
+	// cols keeps track of the output column with WrapAt.
+	cols *colWriter
+	// inQuotes is the number of double quotes being printed, inside which
+	// lines aren't broken with WrapAt.
+	inQuotes int
+
+	// srcIndent is the indentation detected in the source with Reindent,
+	// in spaces per level or zero for tabs, if srcIndentOK is set.
+	srcIndent   uint
+	srcIndentOK bool
+
+	// regex is set while printing a RegexWord, whose parts must be
+	// printed as they are.
+	regex bool
 
 	wantSpace   bool
 	wantNewline bool
 	wroteSemi   bool
 
+	// commentPad is the number of spaces to write before the next trailing
+	// comment, as set by AlignComments. If zero, a tab is used.
+	commentPad uint
+
 	// pendingComments are any comments in the current line or statement
 	// that we have yet to print. This is useful because that way, we can
 	// ensure that all comments are written immediately before a newline.
@@ -226,10 +757,28 @@ type Printer struct {
 
 	// used when printing <<- heredocs with tab indentation
 	tabsPrinter *Printer
+
+	// file is the file being printed, if its source can be printed
+	// verbatim in regions where formatting is disabled.
+	file *File
+
+	// used to measure statements when aligning comments
+	alignPrinter *Printer
+
+	// padGroups maps the positions of the tokens aligned by KeepPadding to
+	// their alignment groups, or to -1 if they weren't padded.
+	padGroups map[Pos]int
+	// lastPad is the last token padded by KeepPadding.
+	lastPad padPoint
+
+	// emptyLines are the lines left empty by the subshells removed by
+	// Simplify, which are not kept as empty lines.
+	emptyLines map[uint]bool
 }
 
 func (p *Printer) reset() {
 	p.wantSpace, p.wantNewline = false, false
+	p.commentPad = 0
 	p.pendingComments = p.pendingComments[:0]
 
 	// minification uses its own newline logic
@@ -240,6 +789,12 @@ func (p *Printer) reset() {
 	p.levelIncs = p.levelIncs[:0]
 	p.nestedBinary = false
 	p.pendingHdocs = p.pendingHdocs[:0]
+	p.file = nil
+	p.padGroups = nil
+	p.lastPad = padPoint{}
+	p.emptyLines = nil
+	p.srcIndent, p.srcIndentOK = 0, false
+	p.inQuotes = 0
 }
 
 func (p *Printer) spaces(n uint) {
@@ -258,14 +813,57 @@ func (p *Printer) spacePad(pos Pos) {
 		p.WriteByte(' ')
 		p.wantSpace = false
 	}
-	if p.cols.lineStart {
+	if p.pad == nil || p.minify || !pos.IsValid() {
+		return
+	}
+	w := p.pad
+	tok := padPoint{pos: pos, col: p.padCol(pos), out: w.col(), line: w.lineStart}
+	switch group, ok := p.padGroups[pos]; {
+	case w.blank:
 		// Never add padding at the start of a line, since this may
 		// result in broken indentation or mixing of spaces and tabs.
-		return
+	case ok:
+		delete(p.padGroups, pos)
+		if group >= 0 {
+			p.padMark(tok, group)
+		}
+	case w.reindent:
+		// Make a group of its own, which may be aligned with others.
+		start := pos.Offset()
+		for start > 0 && (p.file.Src[start-1] == ' ' || p.file.Src[start-1] == '\t') {
+			start--
+		}
+		if gap := tok.col - p.srcCol(start); gap > 1 {
+			p.padMark(tok, len(w.gaps))
+			w.gaps = append(w.gaps, gap)
+			w.cols = append(w.cols, tok.col)
+		}
+	case p.lastPad.line == w.lineStart && p.lastPad.pos.Line() == pos.Line():
+		for ; tok.out < p.lastPad.out+tok.col-p.lastPad.col; tok.out++ {
+			p.WriteByte(' ')
+		}
 	}
-	for !p.cols.lineStart && p.cols.column > 0 && p.cols.column < int(pos.col) {
-		p.WriteByte(' ')
+	p.lastPad = tok
+}
+
+// padMark marks a token to be padded as part of an alignment group.
+func (p *Printer) padMark(tok padPoint, group int) {
+	w := p.pad
+	m := padMark{offset: w.buf.Len(), lineStart: w.lineStart, col: tok.out, group: group}
+	if w.reindent {
+		m.line = tok.pos.Line()
+		start := tok.pos.Offset()
+		for start > 0 && p.file.Src[start-1] != '\n' {
+			start--
+		}
+		end := start
+		for end < uint(len(p.file.Src)) && (p.file.Src[end] == ' ' || p.file.Src[end] == '\t') {
+			end++
+		}
+		m.indent = visualWidth(p.file.Src[start:end])
+		m.shift = w.indent() - m.indent
 	}
+	w.marks = append(w.marks, m)
 }
 
 func (p *Printer) bslashNewl() {
@@ -277,6 +875,80 @@ func (p *Printer) bslashNewl() {
 	p.indent()
 }
 
+// wrapNewl breaks a line which would go past the column set by WrapAt. Unlike
+// bslashNewl, the current line in the source stays the same.
+func (p *Printer) wrapNewl() {
+	if p.wantSpace {
+		p.space()
+	}
+	p.WriteString("\\\n")
+	p.indent()
+}
+
+// canWrap reports whether the current line may be broken for WrapAt.
+func (p *Printer) canWrap() bool {
+	return p.cols != nil && !p.cols.blank && p.wantSpace &&
+		p.inQuotes == 0 && len(p.pendingHdocs) == 0
+}
+
+// wrapWord reports whether the line must be broken before ws[i] for it to fit
+// in the column set by WrapAt. An option like "-o" is kept in the same line as
+// the argument following it.
+func (p *Printer) wrapWord(ws []*Word, i int) bool {
+	if !p.canWrap() {
+		return false
+	}
+	if i > 0 && isOption(ws[i-1]) && !isOption(ws[i]) {
+		return false
+	}
+	if i == 0 && p.cols.col+2 > p.wrapAt {
+		// The line would still be too long with the break, such as
+		// one with a command name after "then".
+		return false
+	}
+	width := p.measure(ws[i])
+	if i+1 < len(ws) && isOption(ws[i]) && !isOption(ws[i+1]) &&
+		ws[i+1].Pos().Line() == ws[i].Pos().Line() {
+		width += 1 + p.measure(ws[i+1])
+	}
+	return p.cols.col+1+width > p.wrapAt
+}
+
+// wrapBinary reports whether the line must be broken at the operator of a
+// binary command for its second statement to fit in the column set by WrapAt.
+func (p *Printer) wrapBinary(x *BinaryCmd) bool {
+	if !p.canWrap() {
+		return false
+	}
+	y := *x.Y
+	y.Comments = nil
+	width := uint(len(x.Op.String())) + 1 + p.measure(&y)
+	return p.cols.col+1+width > p.wrapAt
+}
+
+// wrapElem reports whether the line must be broken before an array element for
+// it to fit in the column set by WrapAt.
+func (p *Printer) wrapElem(el *ArrayElem) bool {
+	if !p.canWrap() {
+		return false
+	}
+	var width uint
+	if el.Index != nil {
+		width += 3 + p.measure(el.Index) // [i]=
+	}
+	if el.Value != nil {
+		width += p.measure(el.Value)
+	}
+	return p.cols.col+1+width > p.wrapAt
+}
+
+// isOption reports whether a word is a literal option like "-o" or "--foo",
+// which may be followed by a separate argument.
+func isOption(w *Word) bool {
+	lit := w.Lit()
+	return len(lit) > 1 && lit[0] == '-' && lit != "--"
+}
+
 func (p *Printer) spacedString(s string, pos Pos) {
 	p.spacePad(pos)
 	p.WriteString(s)
@@ -304,6 +976,7 @@ func (p *Printer) semiOrNewl(s string, pos Pos) {
 		}
 		if !p.minify {
 			p.space()
+			p.spacePad(pos)
 		}
 		p.line = pos.Line()
 	}
@@ -403,7 +1076,13 @@ func (p *Printer) flushHeredocs() {
 		p.line++
 		p.WriteByte('\n')
 		p.wantNewline, p.wantSpace = false, false
-		if r.Op == DashHdoc && p.indentSpaces == 0 && !p.minify {
+		if r.Op == DashHdoc && p.hdocIndent && !p.minify {
+			if body, ok := p.hdocBody(r.Hdoc); ok {
+				p.indentHdoc(body)
+			} else {
+				p.word(r.Hdoc)
+			}
+		} else if r.Op == DashHdoc && p.indentSpaces == 0 && !p.minify {
 			if r.Hdoc != nil {
 				extra := extraIndenter{
 					bufWriter:   p.bufWriter,
@@ -420,7 +1099,9 @@ func (p *Printer) flushHeredocs() {
 				p.indent()
 			}
 		} else if r.Hdoc != nil {
-			p.word(r.Hdoc)
+			// Like in quotes, escaped newlines in the body
+			// mustn't be followed by indentation.
+			p.wordParts(r.Hdoc.Parts, true)
 		}
 		p.unquotedWord(r.Word)
 		if r.Hdoc != nil {
@@ -444,7 +1125,7 @@ func (p *Printer) newlines(pos Pos) {
 	}
 	p.newline(pos)
 	if pos.Line() > p.line {
-		if !p.minify {
+		if !p.minify && p.emptyLineBetween(p.line-1, pos.Line()) {
 			// preserve single empty lines
 			p.WriteByte('\n')
 		}
@@ -453,6 +1134,28 @@ func (p *Printer) newlines(pos Pos) {
 	p.indent()
 }
 
+// emptyLineBetween reports whether there is an empty line to keep between the
+// lines after and before. Lines left empty by Simplify don't count.
+func (p *Printer) emptyLineBetween(after, before uint) bool {
+	for line := after + 1; line < before; line++ {
+		if !p.emptyLines[line] {
+			return true
+		}
+	}
+	return false
+}
+
+// addEmptyLines records the lines left empty by Simplify within a node; see
+// emptyLineBetween.
+func (p *Printer) addEmptyLines(lines []uint) {
+	if len(lines) > 0 && p.emptyLines == nil {
+		p.emptyLines = make(map[uint]bool)
+	}
+	for _, line := range lines {
+		p.emptyLines[line] = true
+	}
+}
+
 func (p *Printer) rightParen(pos Pos) {
 	if !p.minify {
 		p.newlines(pos)
@@ -485,13 +1188,15 @@ func (p *Printer) flushComments() {
 		switch {
 		case i > 0, cline > p.line && p.line > 0:
 			p.WriteByte('\n')
-			if cline > p.line+1 {
+			if p.emptyLineBetween(p.line, cline) {
 				p.WriteByte('\n')
 			}
 			p.indent()
 		case p.wantSpace:
 			if p.keepPadding {
 				p.spacePad(c.Pos())
+			} else if p.commentPad > 0 {
+				p.spaces(p.commentPad)
 			} else {
 				p.WriteByte('\t')
 			}
@@ -505,6 +1210,7 @@ func (p *Printer) flushComments() {
 		p.wantNewline = true
 	}
 	p.pendingComments = nil
+	p.commentPad = 0
 }
 
 func (p *Printer) comments(comments ...Comment) {
@@ -550,6 +1256,7 @@ func (p *Printer) wordPart(wp, next WordPart) {
 		p.dblQuoted(x)
 	case *CmdSubst:
 		p.line = x.Pos().Line()
+		p.addEmptyLines(x.emptyLines)
 		switch {
 		case x.TempFile:
 			p.WriteString("${")
@@ -559,12 +1266,14 @@ func (p *Printer) wordPart(wp, next WordPart) {
 			p.semiRsrv("}", x.Right)
 		case x.ReplyVar:
 			p.WriteString("${|")
+			p.spaceComment(x.Left, x.Stmts, x.Last)
 			p.nestedStmts(x.Stmts, x.Last, x.Right)
 			p.wantSpace = false
 			p.semiRsrv("}", x.Right)
 		default:
 			p.WriteString("$(")
 			p.wantSpace = len(x.Stmts) > 0 && startsWithLparen(x.Stmts[0])
+			p.spaceComment(x.Left, x.Stmts, x.Last)
 			p.nestedStmts(x.Stmts, x.Last, x.Right)
 			p.rightParen(x.Right)
 		}
@@ -575,10 +1284,18 @@ func (p *Printer) wordPart(wp, next WordPart) {
 		}
 		name := x.Param.Value
 		switch {
-		case !p.minify:
+		case p.regex:
 		case x.Excl, x.Length, x.Width:
 		case x.Index != nil, x.Slice != nil:
-		case x.Repl != nil, x.Exp != nil:
+		case x.Repl != nil, x.Exp != nil, x.Names != 0:
+		case x.Short:
+			if p.braces == BracesAlways && !p.minify && ValidName(name) {
+				x2 := *x
+				x2.Short = false
+				p.paramExp(&x2)
+				return
+			}
+		case !p.minify && p.braces != BracesMinimal:
 		case len(name) > 1 && !ValidName(name): // ${10}
 		case ValidName(name + litCont): // ${var}cont
 		default:
@@ -605,6 +1322,7 @@ func (p *Printer) wordPart(wp, next WordPart) {
 			p.space()
 		}
 		p.WriteString(x.Op.String())
+		p.spaceComment(x.OpPos, x.Stmts, x.Last)
 		p.nestedStmts(x.Stmts, x.Last, x.Rparen)
 		p.rightParen(x.Rparen)
 	}
@@ -616,7 +1334,9 @@ func (p *Printer) dblQuoted(dq *DblQuoted) {
 	}
 	p.WriteByte('"')
 	if len(dq.Parts) > 0 {
+		p.inQuotes++
 		p.wordParts(dq.Parts, true)
+		p.inQuotes--
 	}
 	// Add any trailing escaped newlines.
 	for p.line < dq.Right.Line() {
@@ -696,7 +1416,7 @@ func (p *Printer) loop(loop Loop) {
 		p.writeLit(x.Name.Value)
 		if x.InPos.IsValid() {
 			p.spacedString(" in", Pos{})
-			p.wordJoin(x.Items)
+			p.wordJoin(p.factorBraces(x.Items))
 		}
 	case *CStyleLoop:
 		p.WriteString("((")
@@ -758,6 +1478,11 @@ func (p *Printer) testExpr(expr TestExpr) {
 	switch x := expr.(type) {
 	case *Word:
 		p.word(x)
+	case *RegexWord:
+		regex := p.regex
+		p.regex = true
+		p.word(x.Word)
+		p.regex = regex
 	case *BinaryTest:
 		p.testExpr(x.X)
 		p.space()
@@ -801,15 +1526,30 @@ func (p *Printer) unquotedWord(w *Word) {
 	}
 }
 
+// factorBraces returns the words to print for a list of words which undergo
+// brace expansion, as factored with MinifyBraces.
+func (p *Printer) factorBraces(ws []*Word) []*Word {
+	if !p.minify || !p.minifyBraces {
+		return ws
+	}
+	return FactorBraces(ws)
+}
+
 func (p *Printer) wordJoin(ws []*Word) {
 	anyNewline := false
-	for _, w := range ws {
+	for i, w := range ws {
 		if pos := w.Pos(); pos.Line() > p.line {
 			if !anyNewline {
 				p.incLevel()
 				anyNewline = true
 			}
 			p.bslashNewl()
+		} else if p.wrapWord(ws, i) {
+			if !anyNewline {
+				p.incLevel()
+				anyNewline = true
+			}
+			p.wrapNewl()
 		} else {
 			p.spacePad(w.Pos())
 		}
@@ -856,6 +1596,9 @@ func (p *Printer) elemJoin(elems []*ArrayElem, last []Comment) {
 		if el.Pos().Line() > p.line {
 			p.newline(el.Pos())
 			p.indent()
+		} else if p.wrapElem(el) {
+			p.newline(Pos{})
+			p.indent()
 		} else if p.wantSpace {
 			p.space()
 		}
@@ -953,7 +1696,7 @@ func (p *Printer) command(cmd Command, redirs []*Redirect) (startRedirs int) {
 			p.word(r.Word)
 			startRedirs++
 		}
-		p.wordJoin(x.Args[1:])
+		p.wordJoin(p.factorBraces(x.Args[1:]))
 	case *Block:
 		p.WriteByte('{')
 		p.wantSpace = true
@@ -962,8 +1705,10 @@ func (p *Printer) command(cmd Command, redirs []*Redirect) (startRedirs int) {
 	case *IfClause:
 		p.ifClause(x, false)
 	case *Subshell:
+		p.addEmptyLines(x.emptyLines)
 		p.WriteByte('(')
 		p.wantSpace = len(x.Stmts) > 0 && startsWithLparen(x.Stmts[0])
+		p.spaceComment(x.Lparen, x.Stmts, x.Last)
 		p.spacePad(stmtsPos(x.Stmts, x.Last))
 		p.nestedStmts(x.Stmts, x.Last, x.Rparen)
 		p.wantSpace = false
@@ -991,7 +1736,7 @@ func (p *Printer) command(cmd Command, redirs []*Redirect) (startRedirs int) {
 		p.semiRsrv("done", x.DonePos)
 	case *BinaryCmd:
 		p.stmt(x.X)
-		if p.minify || x.Y.Pos().Line() <= p.line {
+		if p.minify || (x.Y.Pos().Line() <= p.line && !p.wrapBinary(x)) {
 			// leave p.nestedBinary untouched
 			p.spacedToken(x.Op.String(), x.OpPos)
 			p.line = x.Y.Pos().Line()
@@ -1044,10 +1789,17 @@ func (p *Printer) command(cmd Command, redirs []*Redirect) (startRedirs int) {
 	case *CaseClause:
 		p.WriteString("case ")
 		p.word(x.Word)
-		p.WriteString(" in")
+		if x.Braces {
+			p.WriteString(" {")
+		} else {
+			p.WriteString(" in")
+		}
 		if p.swtCaseIndent {
 			p.incLevel()
 		}
+		if p.pad != nil && !p.minify {
+			p.padCaseItems(x.Items)
+		}
 		for i, ci := range x.Items {
 			var last []Comment
 			for i, c := range ci.Comments {
@@ -1058,6 +1810,7 @@ func (p *Printer) command(cmd Command, redirs []*Redirect) (startRedirs int) {
 				p.comments(c)
 			}
 			p.newlines(ci.Pos())
+			p.line = ci.Pos().Line()
 			p.casePatternJoin(ci.Patterns)
 			p.WriteByte(')')
 			p.wantSpace = !p.minify
@@ -1086,7 +1839,11 @@ func (p *Printer) command(cmd Command, redirs []*Redirect) (startRedirs int) {
 			p.flushComments()
 			p.decLevel()
 		}
-		p.semiRsrv("esac", x.Esac)
+		if x.Braces {
+			p.semiRsrv("}", x.Esac)
+		} else {
+			p.semiRsrv("esac", x.Esac)
+		}
 	case *ArithmCmd:
 		p.WriteString("((")
 		if x.Unsigned {
@@ -1175,29 +1932,97 @@ func startsWithLparen(s *Stmt) bool {
 	return false
 }
 
+// spaceComment makes sure that a comment following an opening token at pos,
+// like "(" or "$(", is separated from it by a space. "(# foo" is valid, but
+// hard to read.
+func (p *Printer) spaceComment(pos Pos, stmts []*Stmt, last []Comment) {
+	if p.minify {
+		return // no comments are printed
+	}
+	if len(p.pendingComments) > 0 {
+		// Comments from before the token, such as those between a
+		// function's name and its body, also follow it.
+		p.wantSpace = true
+		return
+	}
+	var c *Comment
+	if len(stmts) > 0 {
+		if len(stmts[0].Comments) > 0 && stmts[0].Pos().After(stmts[0].Comments[0].Pos()) {
+			c = &stmts[0].Comments[0]
+		}
+	} else if len(last) > 0 {
+		c = &last[0]
+	}
+	if c != nil && c.Pos().Line() == pos.Line() {
+		p.wantSpace = true
+	}
+}
+
 func (p *Printer) stmtList(stmts []*Stmt, last []Comment) {
 	sep := p.wantNewline ||
 		(len(stmts) > 0 && stmts[0].Pos().Line() > p.line)
-	for _, s := range stmts {
+	skipComs := 0 // leading comments already printed verbatim
+	var pads []uint
+	if p.alignPadding > 0 && !p.keepPadding && !p.minify {
+		pads = p.commentPads(stmts)
+	}
+	if p.pad != nil && !p.minify {
+		lines := make(map[uint][]padToken)
+		for _, s := range stmts {
+			p.padStmt(lines, s, Pos{})
+		}
+		p.padAlign(lines)
+	}
+	for i := 0; i < len(stmts); i++ {
+		s := stmts[i]
 		pos := s.Pos()
-		var midComs, endComs []Comment
-		for _, c := range s.Comments {
-			if c.End().After(s.End()) {
+		coms := s.Comments[skipComs:]
+		skipComs = 0
+		if off := p.offDirective(coms, pos); off >= 0 {
+			p.comments(coms[:off+1]...)
+			n, skip := p.verbatim(stmts[i:], coms[off+1:], last)
+			if i += n - 1; i+1 < len(stmts) {
+				skipComs = skip
+			} else {
+				last = last[skip:]
+			}
+			p.wantNewline = true
+			continue
+		}
+		var ownComs, midComs, endComs []Comment
+		for _, c := range coms {
+			noPos := c.Hash == (Pos{})
+			if !noPos && c.End().After(s.End()) {
 				endComs = append(endComs, c)
 				break
 			}
-			if c.Pos().After(pos) {
+			if !noPos && c.Pos().After(pos) {
 				midComs = append(midComs, c)
 				continue
 			}
+			if noPos || len(ownComs) > 0 || (i > 0 && c.Pos().Line() <= p.line) {
+				// Leading comments which can't be placed by their
+				// positions, like those of a statement which was
+				// moved or added, go right before the statement.
+				ownComs = append(ownComs, c)
+				continue
+			}
 			p.comments(c)
 		}
 		if !p.minify || p.wantSpace {
 			p.newlines(pos)
 		}
 		p.line = pos.Line()
+		if len(ownComs) > 0 && !p.minify {
+			p.comments(ownComs...)
+			p.newline(pos)
+			p.indent()
+		}
 		p.comments(midComs...)
 		p.stmt(s)
+		if pads != nil && len(endComs) > 0 {
+			p.commentPad = pads[i]
+		}
 		p.comments(endComs...)
 		p.wantNewline = true
 	}
@@ -1207,6 +2032,573 @@ func (p *Printer) stmtList(stmts []*Stmt, last []Comment) {
 	p.comments(last...)
 }
 
+// commentPads returns the number of spaces to write before the trailing
+// comment of each statement in a list to align the comments, following
+// AlignComments. Zero means that a statement's comment isn't aligned.
+func (p *Printer) commentPads(stmts []*Stmt) []uint {
+	pads := make([]uint, len(stmts))
+	var run []int // indexes of the statements in the current run
+	var widths []uint
+	var minWidth, maxWidth uint
+	flush := func() {
+		for j, i := range run {
+			pads[i] = maxWidth - widths[j] + 1
+		}
+		run, widths = run[:0], widths[:0]
+	}
+	for i, s := range stmts {
+		width, ok := p.alignWidth(stmts, i)
+		if !ok {
+			flush()
+			continue
+		}
+		if len(run) > 0 {
+			prev := stmts[run[len(run)-1]]
+			newMin, newMax := minWidth, maxWidth
+			if width < newMin {
+				newMin = width
+			}
+			if width > newMax {
+				newMax = width
+			}
+			switch {
+			case prev != stmts[i-1], s.Pos().Line() != prev.End().Line()+1:
+				flush()
+			case newMax-newMin+1 > p.alignPadding:
+				flush()
+			default:
+				minWidth, maxWidth = newMin, newMax
+			}
+		}
+		if len(run) == 0 {
+			minWidth, maxWidth = width, width
+		}
+		run = append(run, i)
+		widths = append(widths, width)
+	}
+	flush()
+	return pads
+}
+
+// alignWidth returns the printed width of a statement in a list if its trailing
+// comment can be aligned with AlignComments. That is, if the statement is on
+// its own line, and its only comment is the one after it in the same line.
+func (p *Printer) alignWidth(stmts []*Stmt, i int) (uint, bool) {
+	s := stmts[i]
+	if len(s.Comments) != 1 {
+		return 0, false
+	}
+	if c := s.Comments[0]; !c.Pos().After(s.End()) || c.Pos().Line() != s.End().Line() {
+		return 0, false
+	}
+	if s.Pos().Line() != s.End().Line() {
+		return 0, false
+	}
+	for _, r := range s.Redirs {
+		if r.Op == Hdoc || r.Op == DashHdoc {
+			return 0, false
+		}
+	}
+	noComs := *s
+	noComs.Comments = nil
+	var buf bytes.Buffer
+	if err := p.measurePrinter().Print(&buf, &noComs); err != nil || bytes.IndexByte(buf.Bytes(), '\n') >= 0 {
+		return 0, false
+	}
+	return uint(utf8.RuneCount(buf.Bytes())), true
+}
+
+// measurePrinter returns a printer with the options of p which affect the width
+// of single lines, to measure nodes with.
+func (p *Printer) measurePrinter() *Printer {
+	if p.alignPrinter == nil {
+		p.alignPrinter = NewPrinter()
+	}
+	q := p.alignPrinter
+	q.indentSpaces = p.indentSpaces
+	q.binNextLine = p.binNextLine
+	q.swtCaseIndent = p.swtCaseIndent
+	q.spaceRedirects = p.spaceRedirects
+	q.braces = p.braces
+	return q
+}
+
+// measure returns the printed width of the first line of a node, for WrapAt.
+func (p *Printer) measure(node Node) uint {
+	var buf bytes.Buffer
+	if err := p.measurePrinter().Print(&buf, node); err != nil {
+		return 0
+	}
+	b := buf.Bytes()
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		b = b[:i]
+	}
+	return uint(utf8.RuneCount(b))
+}
+
+// padToken is a token which may be aligned with KeepPadding. col is its column
+// in the source, and gap is the distance from the end of the token before it.
+type padToken struct {
+	pos      Pos
+	col, gap int
+}
+
+// padPoint is a token as padded with KeepPadding, with its column in the source
+// and its column and line start offset in the output.
+type padPoint struct {
+	pos            Pos
+	col, out, line int
+}
+
+// padCol returns the column of a position in the source, expanding tabs to the
+// next multiple of eight like terminals do. Byte columns are used if the source
+// is not available.
+func (p *Printer) padCol(pos Pos) int {
+	col := int(pos.Col())
+	if p.file == nil {
+		return col
+	}
+	end := int(pos.Offset())
+	start := end - col + 1
+	if start < 0 || end > len(p.file.Src) {
+		return col
+	}
+	return p.srcCol(uint(end))
+}
+
+// srcCol is like padCol, but for an offset in the source.
+func (p *Printer) srcCol(offs uint) int {
+	start := offs
+	for start > 0 && p.file.Src[start-1] != '\n' {
+		start--
+	}
+	col := 1
+	for _, r := range string(p.file.Src[start:offs]) {
+		if r == '\t' {
+			col += 8 - (col-1)%8
+		} else {
+			col++
+		}
+	}
+	return col
+}
+
+// padAdd adds a token to lines if it's in the same line as the end of the token
+// before it.
+func (p *Printer) padAdd(lines map[uint][]padToken, pos, prevEnd Pos) {
+	if !pos.IsValid() || pos.Line() != prevEnd.Line() {
+		return
+	}
+	col := p.padCol(pos)
+	lines[pos.Line()] = append(lines[pos.Line()], padToken{pos, col, col - p.padCol(prevEnd)})
+}
+
+// padStmt adds the tokens of a statement which may be aligned to lines. These
+// are its start if prevEnd is valid, the words and redirects of a simple
+// command or declaration which fits in a single line, and its trailing
+// comment.
+func (p *Printer) padStmt(lines map[uint][]padToken, s *Stmt, prevEnd Pos) {
+	if prevEnd.IsValid() {
+		p.padAdd(lines, s.Pos(), prevEnd)
+	}
+	if s.Pos().Line() == s.End().Line() {
+		var nodes []Node
+		switch x := s.Cmd.(type) {
+		case *CallExpr:
+			for _, a := range x.Assigns {
+				nodes = append(nodes, a)
+			}
+			for _, w := range x.Args {
+				nodes = append(nodes, w)
+			}
+		case *DeclClause:
+			nodes = append(nodes, x.Variant)
+			for _, a := range x.Args {
+				nodes = append(nodes, a)
+			}
+		}
+		for _, r := range s.Redirs {
+			nodes = append(nodes, r)
+		}
+		sort.Slice(nodes, func(i, j int) bool {
+			return nodes[j].Pos().After(nodes[i].Pos())
+		})
+		for i := 1; i < len(nodes); i++ {
+			p.padAdd(lines, nodes[i].Pos(), nodes[i-1].End())
+		}
+	}
+	for _, c := range s.Comments {
+		if c.Pos().After(s.End()) {
+			p.padAdd(lines, c.Pos(), s.End())
+			break
+		}
+	}
+}
+
+// padCaseItems aligns the bodies of the items in a case clause, their
+// operators such as ";;", and their trailing comments.
+func (p *Printer) padCaseItems(items []*CaseItem) {
+	lines := make(map[uint][]padToken)
+	for _, ci := range items {
+		if len(ci.Patterns) == 0 {
+			continue
+		}
+		// just after the closing parenthesis
+		prevEnd := posAddCol(ci.Patterns[len(ci.Patterns)-1].End(), 1)
+		for _, s := range ci.Stmts {
+			p.padStmt(lines, s, prevEnd)
+			prevEnd = Pos{}
+		}
+		if len(ci.Stmts) > 0 {
+			prevEnd = ci.Stmts[len(ci.Stmts)-1].End()
+		}
+		if !ci.OpPos.IsValid() {
+			continue
+		}
+		p.padAdd(lines, ci.OpPos, prevEnd)
+		opEnd := posAddCol(ci.OpPos, len(ci.Op.String()))
+		for _, c := range ci.Comments {
+			if c.Pos().After(ci.OpPos) {
+				p.padAdd(lines, c.Pos(), opEnd)
+				break
+			}
+		}
+	}
+	p.padAlign(lines)
+}
+
+// padAlign splits the tokens in lines into alignment groups for KeepPadding.
+// A group is made of the tokens in the same source column in consecutive
+// lines, as long as at least one of them is padded. A single line without a
+// token in that column may be in between two of the tokens.
+//
+// Tokens which are already in a group, such as the words in the body of a case
+// item, are left alone.
+func (p *Printer) padAlign(lines map[uint][]padToken) {
+	nums := make([]uint, 0, len(lines))
+	for line := range lines {
+		nums = append(nums, line)
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+	if p.padGroups == nil {
+		p.padGroups = make(map[Pos]int)
+	}
+	for len(nums) > 0 {
+		n := 1
+		for n < len(nums) && nums[n] == nums[n-1]+1 {
+			n++
+		}
+		run := nums[:n]
+		nums = nums[n:]
+
+		var cols []int
+		byCol := make(map[int][]padToken)
+		for _, line := range run {
+			for _, tok := range lines[line] {
+				if _, ok := p.padGroups[tok.pos]; ok {
+					continue
+				}
+				if byCol[tok.col] == nil {
+					cols = append(cols, tok.col)
+				}
+				byCol[tok.col] = append(byCol[tok.col], tok)
+			}
+		}
+		sort.Ints(cols)
+		for _, col := range cols {
+			toks := byCol[col]
+			for len(toks) > 0 {
+				n := 1
+				for n < len(toks) && toks[n].pos.Line() <= toks[n-1].pos.Line()+2 {
+					n++
+				}
+				p.padGroup(col, toks[:n])
+				toks = toks[n:]
+			}
+		}
+	}
+}
+
+// padGroup adds an alignment group with the given tokens if any of them is
+// padded in the source. Otherwise, the tokens are recorded as not padded.
+func (p *Printer) padGroup(col int, toks []padToken) {
+	padded := false
+	minGap := toks[0].gap
+	for _, tok := range toks {
+		if tok.gap > 1 {
+			padded = true
+		}
+		if tok.gap < minGap {
+			minGap = tok.gap
+		}
+	}
+	if minGap < 1 {
+		minGap = 1
+	}
+	group := -1
+	if padded {
+		group = len(p.pad.gaps)
+		p.pad.gaps = append(p.pad.gaps, minGap)
+		p.pad.cols = append(p.pad.cols, col)
+	}
+	for _, tok := range toks {
+		p.padGroups[tok.pos] = group
+	}
+}
+
+// FmtDirective returns "on" or "off" if a comment is a "# shfmt:on" or
+// "# shfmt:off" directive to enable or disable formatting, and an empty string
+// otherwise.
+func FmtDirective(c Comment) string {
+	switch strings.TrimSpace(c.Text) {
+	case "shfmt:on":
+		return "on"
+	case "shfmt:off":
+		return "off"
+	}
+	return ""
+}
+
+// offDirective returns the index of the comment before pos which disables
+// formatting, as long as it isn't enabled again before pos. It returns -1 if
+// there is none or directives are not in use.
+func (p *Printer) offDirective(coms []Comment, pos Pos) int {
+	if p.file == nil {
+		return -1
+	}
+	off := -1
+	for i, c := range coms {
+		if c.Pos().After(pos) {
+			break
+		}
+		switch FmtDirective(c) {
+		case "off":
+			if off < 0 {
+				off = i
+			}
+		case "on":
+			off = -1
+		}
+	}
+	return off
+}
+
+// verbatim prints a region with formatting disabled from the source, starting
+// with the comments coms and the statement stmts[0], and ending before the next
+// comment which enables formatting, be it before one of the following
+// statements or among the last comments of the list.
+//
+// It returns the number of statements printed, and the number of leading
+// comments of the next statement, or of last if there is none, which were
+// printed along with them.
+func (p *Printer) verbatim(stmts []*Stmt, coms []Comment, last []Comment) (n, skip int) {
+	startPos := stmts[0].Pos()
+	if len(coms) > 0 && startPos.After(coms[0].Pos()) {
+		startPos = coms[0].Pos()
+	}
+	endComs := last
+	n = len(stmts)
+	for j, s := range stmts[1:] {
+		if k := onDirective(s.Comments, s.Pos()); k >= 0 {
+			n, endComs = j+1, s.Comments[:k]
+			break
+		}
+	}
+	if n == len(stmts) {
+		if k := onDirective(last, Pos{}); k >= 0 {
+			endComs = last[:k]
+		}
+	}
+	end := stmts[n-1].End()
+	for _, c := range stmts[n-1].Comments {
+		end = posMax(end, c.End())
+	}
+	if len(endComs) > 0 {
+		end = posMax(end, endComs[len(endComs)-1].End())
+	}
+	src := p.file.Src
+	start, endOffs := startPos.Offset(), end.Offset()
+	for _, h := range p.file.hdocs {
+		offs := uint(h.redir.Pos().Offset())
+		if offs >= start && offs < endOffs && uint(h.end) > endOffs {
+			endOffs = uint(h.end)
+		}
+	}
+
+	// Include the indentation before the region and anything up to the end
+	// of its last line, as long as it is only whitespace.
+	lineStart := start
+	for lineStart > 0 && (src[lineStart-1] == ' ' || src[lineStart-1] == '\t') {
+		lineStart--
+	}
+	if lineStart == 0 || src[lineStart-1] == '\n' {
+		start = lineStart
+	}
+	lineEnd := endOffs
+	for int(lineEnd) < len(src) && (src[lineEnd] == ' ' || src[lineEnd] == '\t') {
+		lineEnd++
+	}
+	if int(lineEnd) == len(src) || src[lineEnd] == '\n' {
+		endOffs = lineEnd
+	}
+
+	p.newline(startPos)
+	if startPos.Line() > p.line {
+		p.WriteByte('\n')
+		p.line++
+	}
+	text := string(src[start:endOffs])
+	if p.srcIndentOK && (start == 0 || src[start-1] == '\n') {
+		text = p.reindentRegion(text, start, stmts[:n])
+	}
+	p.writeLit(text)
+	p.line = startPos.Line() + uint(strings.Count(text, "\n"))
+	p.wantSpace = false
+	return n, len(endComs)
+}
+
+// sourceIndent returns the indentation used in the source of a file, in spaces
+// per level or zero for tabs. It is the smallest indentation of the lines
+// starting a statement, unless any of them is indented with tabs. ok is false
+// if no such line is indented.
+func sourceIndent(f *File) (indent uint, ok bool) {
+	Walk(f, func(node Node) bool {
+		s, isStmt := node.(*Stmt)
+		if !isStmt {
+			return true
+		}
+		ws := lineIndent(f.Src, s.Pos().Offset())
+		switch {
+		case ws == "" || ws == "\x00":
+		case ws[0] == '\t':
+			indent, ok = 0, true
+			return false
+		case !ok || uint(len(ws)) < indent:
+			indent, ok = uint(len(ws)), true
+		}
+		return true
+	})
+	return indent, ok
+}
+
+// lineIndent returns the whitespace between the start of a line in src and
+// offs, or "\x00" if there is anything else in between.
+func lineIndent(src []byte, offs uint) string {
+	start := offs
+	for start > 0 && (src[start-1] == ' ' || src[start-1] == '\t') {
+		start--
+	}
+	if start > 0 && src[start-1] != '\n' {
+		return "\x00"
+	}
+	return string(src[start:offs])
+}
+
+// reindentRegion converts the indentation of the lines of a region where
+// formatting is disabled, given its text starting at offset start of the
+// source and its statements. See Reindent.
+func (p *Printer) reindentRegion(text string, start uint, stmts []*Stmt) string {
+	// Lines starting within these spans of the source are left alone.
+	type span struct{ start, end uint }
+	var raw []span
+	for _, h := range p.file.hdocs {
+		raw = append(raw, span{uint(h.start), uint(h.end)})
+	}
+	for _, s := range stmts {
+		Walk(s, func(node Node) bool {
+			switch node.(type) {
+			case *SglQuoted, *DblQuoted:
+				if node.Pos().Line() != node.End().Line() {
+					raw = append(raw, span{node.Pos().Offset() + 1, node.End().Offset()})
+				}
+				return false
+			}
+			return true
+		})
+	}
+
+	var b strings.Builder
+	var prevIn, prevOut string
+	cont := false // whether the previous line ends with a line continuation
+	for offs := start; text != ""; {
+		line := text
+		if i := strings.IndexByte(text, '\n'); i >= 0 {
+			line = text[:i+1]
+		}
+		text = text[len(line):]
+		isRaw := false
+		for _, sp := range raw {
+			if offs >= sp.start && offs < sp.end {
+				isRaw = true
+				break
+			}
+		}
+		offs += uint(len(line))
+		body := strings.TrimLeft(line, " \t")
+		in := line[:len(line)-len(body)]
+		out := in
+		switch {
+		case isRaw, body == "\n", body == "":
+			b.WriteString(line)
+			cont = false
+			continue
+		case cont && len(in) > len(prevIn) && strings.HasPrefix(in, prevIn):
+			extra := in[len(prevIn):]
+			if levels, rest := p.indentLevels(extra); rest == "" {
+				extra = p.levelsIndent(levels)
+			}
+			out = prevOut + extra
+		default:
+			levels, rest := p.indentLevels(in)
+			out = p.levelsIndent(levels) + rest
+		}
+		b.WriteString(out)
+		b.WriteString(body)
+		prevIn, prevOut = in, out
+		trimmed := strings.TrimRight(body, "\n")
+		bslashes := len(trimmed) - len(strings.TrimRight(trimmed, "\\"))
+		cont = bslashes%2 == 1
+	}
+	return b.String()
+}
+
+// indentLevels splits leading whitespace into the number of indentation levels
+// in the source and the whitespace after them.
+func (p *Printer) indentLevels(ws string) (levels int, rest string) {
+	if p.srcIndent == 0 {
+		rest = strings.TrimLeft(ws, "\t")
+		return len(ws) - len(rest), rest
+	}
+	unit := strings.Repeat(" ", int(p.srcIndent))
+	for strings.HasPrefix(ws, unit) {
+		ws = ws[len(unit):]
+		levels++
+	}
+	return levels, ws
+}
+
+// levelsIndent returns the whitespace to indent a number of levels.
+func (p *Printer) levelsIndent(levels int) string {
+	if p.indentSpaces == 0 {
+		return strings.Repeat("\t", levels)
+	}
+	return strings.Repeat(" ", levels*int(p.indentSpaces))
+}
+
+// onDirective returns the index of the first comment before pos which enables
+// formatting, or -1 if there is none. An invalid pos means no limit.
+func onDirective(coms []Comment, pos Pos) int {
+	for i, c := range coms {
+		if pos.IsValid() && c.Pos().After(pos) {
+			break
+		}
+		if FmtDirective(c) == "on" {
+			return i
+		}
+	}
+	return -1
+}
+
 // extraIndenter ensures that all lines in a '<<-' heredoc body have at least
 // baseIndent leading tabs. Those that had more tab indentation than the first
 // heredoc line will keep that relative indentation.
@@ -1264,6 +2656,66 @@ func (e *extraIndenter) WriteString(s string) (int, error) {
 	return len(s), nil
 }
 
+// hdocBody returns the lines of a <<- heredoc body as they would be printed,
+// without the leading tabs of the closing delimiter's line. ok is false if the
+// indentation of the lines is not uniform.
+func (p *Printer) hdocBody(w *Word) (lines []string, ok bool) {
+	if w == nil {
+		return nil, true
+	}
+	var buf bytes.Buffer
+	bw := bufio.NewWriter(&buf)
+	bodyPrinter := &Printer{bufWriter: bw, line: w.Pos().Line()}
+	bodyPrinter.word(w)
+	bw.Flush()
+	body := strings.Replace(buf.String(), "\xff", "", -1)
+	lines = strings.Split(body, "\n")
+	lines = lines[:len(lines)-1]
+	for _, line := range lines {
+		indent := line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+		if strings.Contains(indent, " ") {
+			return nil, false
+		}
+	}
+	return lines, true
+}
+
+// indentHdoc writes the lines of a <<- heredoc body one level deeper than the
+// current indentation, followed by the indentation of the closing delimiter.
+func (p *Printer) indentHdoc(lines []string) {
+	minTabs := -1
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		tabs := len(line) - len(strings.TrimLeft(line, "\t"))
+		if minTabs < 0 || tabs < minTabs {
+			minTabs = tabs
+		}
+	}
+	for _, line := range lines {
+		if line != "" {
+			p.hdocTabs(p.level + 1)
+			p.writeLit(line[minTabs:])
+		}
+		p.WriteByte('\n')
+	}
+	p.hdocTabs(p.level)
+}
+
+// hdocTabs writes n tabs regardless of the indentation style, as <<- heredocs
+// only strip leading tabs.
+func (p *Printer) hdocTabs(n uint) {
+	if n == 0 {
+		return
+	}
+	p.WriteByte('\xff')
+	for i := uint(0); i < n; i++ {
+		p.WriteByte('\t')
+	}
+	p.WriteByte('\xff')
+}
+
 func (p *Printer) nestedStmts(stmts []*Stmt, last []Comment, closing Pos) {
 	p.incLevel()
 	switch {
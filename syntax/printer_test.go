@@ -8,6 +8,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"reflect"
+	"sort"
 	"strings"
 	"testing"
 )
@@ -32,6 +34,73 @@ func TestPrintCompact(t *testing.T) {
 	}
 }
 
+// TestPrintIdempotent checks that, for every input in fileTests, the printed
+// program parses to the same syntax tree, and that printing it again does not
+// change it, with a few combinations of printer options.
+func TestPrintIdempotent(t *testing.T) {
+	t.Parallel()
+	printers := []struct {
+		name    string
+		printer *Printer
+		// sameTree is false for printers which rewrite programs, such
+		// as by dropping comments or the braces in ${foo}.
+		sameTree bool
+	}{
+		{"Default", NewPrinter(), true},
+		{"Spaces", NewPrinter(Indent(4), SwitchCaseIndent(true), SpaceRedirects(true)), true},
+		{"BinNext", NewPrinter(BinaryNextLine(true)), true},
+		{"Minify", NewPrinter(Minify(true)), false},
+		{"BracesMin", NewPrinter(ParamBraces(BracesMinimal)), false},
+	}
+	for i, c := range fileTests {
+		lang := LangPOSIX
+		if c.Bash != nil {
+			lang = LangBash
+		} else if c.MirBSDKorn != nil {
+			lang = LangMirBSDKorn
+		}
+		parser := NewParser(Variant(lang))
+		for j, in := range c.Strs {
+			if strings.HasSuffix(in, "\\") {
+				// a trailing backslash can't be followed by a newline
+				continue
+			}
+			for _, pr := range printers {
+				pr := pr
+				t.Run(fmt.Sprintf("%03d-%d/%s", i, j, pr.name), func(t *testing.T) {
+					want, err := parser.Parse(strings.NewReader(in), "")
+					if err != nil {
+						t.Fatal(err)
+					}
+					out, err := strPrint(pr.printer, want)
+					if err != nil {
+						t.Fatal(err)
+					}
+					got, err := parser.Parse(strings.NewReader(out), "")
+					if err != nil {
+						t.Fatalf("printed program does not parse: %v\nin:\n%q\nout:\n%q", err, in, out)
+					}
+					out2, err := strPrint(pr.printer, got)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if out2 != out {
+						t.Fatalf("printing is not idempotent:\nin:\n%q\nfirst:\n%q\nsecond:\n%q", in, out, out2)
+					}
+					if !pr.sameTree {
+						return
+					}
+					clearPosRecurse(t, in, want)
+					clearPosRecurse(t, out, got)
+					if !reflect.DeepEqual(got, want) {
+						t.Fatalf("syntax tree changed:\nin:\n%q\nout:\n%q", in, out)
+					}
+				})
+			}
+		}
+	}
+}
+
 func strPrint(p *Printer, node Node) (string, error) {
 	var buf bytes.Buffer
 	err := p.Print(&buf, node)
@@ -373,6 +442,10 @@ var printTests = []printCase{
 	samePrint("case a in b) [[ x =~ y ]] ;; esac"),
 	samePrint("case a in b) [[ a =~ b$ || c =~ d$ ]] ;; esac"),
 	samePrint("case a in b) [[ a =~ (b) ]] ;; esac"),
+	samePrint(`[[ a =~ ^(a  b|"c  d")$ ]]`),
+	samePrint(`[[ a =~ ^[]]+$ && b =~ [^]]]] ]]`),
+	samePrint(`[[ a =~ ^a\ \ b\.c\\$ ]]`),
+	samePrint(`[[ a =~ ^$re${re}"$re"\$re$ ]]`),
 	{
 		"a=(\nb\nc\n) b=c",
 		"a=(\n\tb\n\tc\n) b=c",
@@ -534,6 +607,135 @@ func TestPrintWeirdFormat(t *testing.T) {
 	}
 }
 
+// commentSlotTests cover comments next to reserved words and other tokens,
+// where the grammar doesn't allow them to stay. Each must be printed in the
+// same place every time, without changing the program.
+var commentSlotTests = []printCase{
+	{
+		"if foo # a\nthen\n\tbar\nfi",
+		"if foo; then # a\n\tbar\nfi",
+	},
+	{
+		"if foo\n# a\n# b\nthen\n\tbar\nfi",
+		"if foo; then # a\n\t# b\n\tbar\nfi",
+	},
+	{
+		"if foo; # a\nthen bar; fi",
+		"if foo; then # a\n\tbar\nfi",
+	},
+	samePrint("if foo; then # a\n\t# b\n\tbar\nfi"),
+	{
+		"if foo # a \\\nthen\n\tbar\nfi",
+		"if foo; then # a \\\n\tbar\nfi",
+	},
+	{
+		"if foo; then\n\tbar\nelif baz # a\n# b\nthen\n\tqux\nfi",
+		"if foo; then\n\tbar\nelif baz; then # a\n\t# b\n\tqux\nfi",
+	},
+	samePrint("if foo; then\n\tbar\nelse # a\n\t# b\n\tbaz\nfi"),
+	{
+		"if foo; then bar; else # a\n\tbaz; fi",
+		"if foo; then bar; else # a\n\tbaz\nfi",
+	},
+	samePrint("if foo; then\n\tbar\n\t# a\nelse\n\tbaz\n\t# b\nfi # c"),
+	{
+		"while foo # a\n# b\ndo\n\tbar\ndone",
+		"while foo; do # a\n\t# b\n\tbar\ndone",
+	},
+	samePrint("until foo; do # a \\\n\tbar\ndone # b"),
+	samePrint("while\n\t# a\n\tfoo # b\ndo\n\tbar\ndone"),
+	{
+		"for i in a b # a\ndo # b\n\tbar\ndone",
+		"for i in a b; do # a\n\t# b\n\tbar\ndone",
+	},
+	{
+		"for i # a\ndo\n\tbar\ndone",
+		"for i; do # a\n\tbar\ndone",
+	},
+	{
+		"for ((i = 0; i < 3; i++)) # a\ndo\n\tbar\ndone",
+		"for ((i = 0; i < 3; i++)); do # a\n\tbar\ndone",
+	},
+	{
+		"select i in a b # a\ndo\n\tbar\ndone",
+		"select i in a b; do # a\n\tbar\ndone",
+	},
+	samePrint("case x in # a\n# b\na) ;;\nesac"),
+	samePrint("case x in\na) # a\n\tfoo\n\t# b\n\t;; # c\n# d\nb) bar ;; # e\nesac"),
+	samePrint("case x in\na)\n\tfoo\n\t# a \\\n\t;;\nesac"),
+	samePrint("{ # a\n\tfoo\n\t# b\n} # c"),
+	samePrint("( # a\n\tfoo\n\t# b\n) # c"),
+	{
+		"(# a\n\tfoo\n)",
+		"( # a\n\tfoo\n)",
+	},
+	{
+		"x=$(# a\n\tfoo # b\n)",
+		"x=$( # a\n\tfoo # b\n)",
+	},
+	{
+		"foo() # a\n# b\n{\n\tbar\n}",
+		"foo() { # a\n\t# b\n\tbar\n}",
+	},
+	{
+		"foo() # a\n(\n\tbar\n)",
+		"foo() ( # a\n\tbar\n)",
+	},
+	samePrint("foo && # a\n\t# b\n\tbar"),
+	samePrint("foo | # a \\\n\tbar"),
+	samePrint("if foo; then\n\tcat <<EOF\na \\\nb\nEOF\nfi"),
+}
+
+func TestPrintCommentSlots(t *testing.T) {
+	t.Parallel()
+	parser := NewParser(KeepComments(true))
+	noComments := NewParser()
+	printer := NewPrinter()
+	commentTexts := func(f *File) []string {
+		var texts []string
+		Walk(f, func(node Node) bool {
+			if c, ok := node.(*Comment); ok {
+				texts = append(texts, c.Text)
+			}
+			return true
+		})
+		sort.Strings(texts)
+		return texts
+	}
+	for i, tc := range commentSlotTests {
+		tc := tc
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			printTest(t, parser, printer, tc.in, tc.want)
+			printTest(t, parser, printer, tc.want, tc.want)
+
+			in, err := parser.Parse(strings.NewReader(tc.in), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := parser.Parse(strings.NewReader(tc.want), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, got := commentTexts(in), commentTexts(out); !reflect.DeepEqual(got, want) {
+				t.Fatalf("comments changed:\nwant: %q\ngot:  %q", want, got)
+			}
+			in, err = noComments.Parse(strings.NewReader(tc.in), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err = noComments.Parse(strings.NewReader(tc.want), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			clearPosRecurse(t, tc.in, in)
+			clearPosRecurse(t, tc.want, out)
+			if !reflect.DeepEqual(out, in) {
+				t.Fatalf("syntax tree changed:\nin:\n%q\nout:\n%q", tc.in, tc.want)
+			}
+		})
+	}
+}
+
 func parsePath(tb testing.TB, path string) *File {
 	f, err := os.Open(path)
 	if err != nil {
@@ -778,13 +980,59 @@ func TestPrintKeepPadding(t *testing.T) {
 		samePrint("(  a   )"),
 		samePrint("'foo\nbar'   # x"),
 		{"\tfoo", "foo"},
-		{"  if foo; then bar; fi", "if   foo; then bar; fi"},
+		{"  if foo; then bar; fi", "if foo; then bar; fi"},
+		samePrint("if foo;   then bar; fi"),
+		samePrint("for i in a;  do b;   done"),
+
+		// aligned comments and assignments
+		samePrint("a=1      # x\nbbbb=22  # y"),
+		samePrint("a=1    # x\nbbbb=22 # y"),
+		{"a=1     # x\nbbbbb=2 # y\n\ncc=3 # z", "a=1     # x\nbbbbb=2 # y\n\ncc=3 # z"},
+		samePrint("export  A=1\nexport BB=2"),
+		samePrint("local   a=1  # x\nlocal   bbb  # y"),
+		samePrint("foo  >a   # x\nfoo  >>bb # y"),
+		{
+			"a=$(( 1 + 2 ))   # x\nbbbbb=3          # y",
+			"a=$((1 + 2))   # x\nbbbbb=3        # y",
+		},
+		{
+			"a=$(( 1 + 2 ))  # x\nbbbbbbbbbbbbb=3 # y",
+			"a=$((1 + 2))    # x\nbbbbbbbbbbbbb=3 # y",
+		},
+		{
+			"aaaaaaaa=1  # x\nb=$((1+2))  # y",
+			"aaaaaaaa=1    # x\nb=$((1 + 2))  # y",
+		},
+
+		// a single line in between does not break a group
+		samePrint("a=1    # x\nfoo bar baz\nbbbb=2 # y"),
+		samePrint("a=1    # x\nfoooooooo  # z\nbbbb=2 # y"),
+		samePrint("a=1    # x\nfoo\nbar\nbbbb=2  # y"),
+
+		// tabs are expanded when the source is kept, and padding is
+		// always written with spaces
+		{"a=1\t# x\nbbbb=2\t# y", "a=1     # x\nbbbb=2  # y"},
+		{"a=1\t\t# x\nbbbb=2\t\t# y", "a=1             # x\nbbbb=2          # y"},
+		{"a=1\t\t# x\nbbbbbbbbb=2\t# y", "a=1             # x\nbbbbbbbbb=2     # y"},
+
+		// case items
+		samePrint("case $x in\na)    foo   ;;\nbbb)  barr  ;; # y\nc)    b     ;;\nesac"),
+		{
+			"case $x in\n\ta)   foo ;;\n\tbb)  $(( 1 )) ;;\nesac",
+			"case $x in\na)   foo ;;\nbb)  $((1)) ;;\nesac",
+		},
+
+		// nested statements keep their own alignment
+		{
+			"f() {\n  a=1    # x\n  bbbb=2 # y\n}",
+			"f() {\n\ta=1    # x\n\tbbbb=2 # y\n}",
+		},
 	}
-	parser := NewParser(KeepComments(true))
+	parser := NewParser(KeepComments(true), RetainSource(true))
 	printer := NewPrinter(KeepPadding(true))
 	for i, tc := range tests {
 		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
-			// ensure that Reset does properly reset colCounter
+			// ensure that Reset does properly reset the buffered output
 			printer.WriteByte('x')
 			printer.Reset(nil)
 			printTest(t, parser, printer, tc.in, tc.want)
@@ -792,6 +1040,156 @@ func TestPrintKeepPadding(t *testing.T) {
 	}
 }
 
+func TestPrintReindent(t *testing.T) {
+	t.Parallel()
+	tests := [...]struct {
+		from, to uint
+		in, want string
+	}{
+		{
+			2, 0,
+			"{\n  # shfmt:off\n  foo   bar\n    baz\n   odd\n  # shfmt:on\n}",
+			"{\n\t# shfmt:off\n\tfoo   bar\n\t\tbaz\n\t odd\n\t# shfmt:on\n}",
+		},
+		{
+			0, 4,
+			"{\n\t# shfmt:off\n\tfoo   bar\n\t\tbaz\n\t# shfmt:on\n}",
+			"{\n    # shfmt:off\n    foo   bar\n        baz\n    # shfmt:on\n}",
+		},
+		{
+			2, 0,
+			"{\n  # shfmt:off\n  for f in a \\\n           b; do :; done\n  foo  \\\n    bar\n  # shfmt:on\n}",
+			"{\n\t# shfmt:off\n\tfor f in a \\\n\t         b; do :; done\n\tfoo  \\\n\t\tbar\n\t# shfmt:on\n}",
+		},
+		{
+			2, 0,
+			"{\n  # shfmt:off\n  echo  \"a\n    b\" 'c\n    d'\n  cat  <<EOF\n    body\nEOF\n  # shfmt:on\n}",
+			"{\n\t# shfmt:off\n\techo  \"a\n    b\" 'c\n    d'\n\tcat  <<EOF\n    body\nEOF\n\t# shfmt:on\n}",
+		},
+		{
+			2, 0,
+			"if x; then   # a\n  foo        # b\nfi           # c",
+			"if x; then   # a\n\tfoo  # b\nfi           # c",
+		},
+		{
+			2, 0,
+			"foo     # a\nif x; then\n  a=1   # b\n  bbb=2 # c\nfi",
+			"foo     # a\nif x; then\n\ta=1   # b\n\tbbb=2 # c\nfi",
+		},
+		{
+			2, 0,
+			"if x; then  # a\n  foobar    # b\nfi          # c",
+			"if x; then      # a\n\tfoobar  # b\nfi              # c",
+		},
+	}
+	parser := NewParser(KeepComments(true), RetainSource(true))
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			printer := NewPrinter(KeepPadding(true), Reindent(true), Indent(tc.to))
+			printTest(t, parser, printer, tc.in, tc.want)
+		})
+		if i == len(tests)-1 {
+			break // the padding doesn't fit, so it can't be converted back
+		}
+		t.Run(fmt.Sprintf("%03d-back", i), func(t *testing.T) {
+			printer := NewPrinter(KeepPadding(true), Reindent(true), Indent(tc.from))
+			printTest(t, parser, printer, tc.want, tc.in)
+		})
+	}
+}
+
+func TestPrintKeepPaddingOptions(t *testing.T) {
+	t.Parallel()
+	tests := [...]struct {
+		opts     []PrinterOption
+		in, want string
+	}{
+		{
+			[]PrinterOption{Indent(4)},
+			"f() {\n\ta=1    # x\n\tbbbb=2 # y\n}",
+			"f() {\n    a=1    # x\n    bbbb=2 # y\n}",
+		},
+		{
+			[]PrinterOption{SwitchCaseIndent(true)},
+			"case $x in\na)    foo ;; # x\nbbb)  bar ;; # y\nesac",
+			"case $x in\n\ta)    foo ;; # x\n\tbbb)  bar ;; # y\nesac",
+		},
+		{
+			[]PrinterOption{Indent(2), SwitchCaseIndent(true)},
+			"case $x in\na)    foo ;;\nbbb)  bar ;;\nesac",
+			"case $x in\n  a)    foo ;;\n  bbb)  bar ;;\nesac",
+		},
+		{
+			[]PrinterOption{Minify(true)},
+			"a=1    # x\nbbbb=2 # y\necho  foo   bar\ncase $x in\na)    foo  ;;\nesac",
+			"a=1\nbbbb=2\necho foo bar\ncase $x in\na)foo\nesac",
+		},
+		{
+			[]PrinterOption{KeepPadding(false)},
+			"echo  foo   bar # x",
+			"echo foo bar # x",
+		},
+	}
+	parser := NewParser(KeepComments(true))
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			opts := append([]PrinterOption{KeepPadding(true)}, tc.opts...)
+			printTest(t, parser, NewPrinter(opts...), tc.in, tc.want)
+		})
+	}
+}
+
+func TestPrintAlignComments(t *testing.T) {
+	t.Parallel()
+	tests := [...]struct {
+		spaces   uint
+		in, want string
+	}{
+		{0, "a=1 # x", "a=1 # x"},
+		{
+			0,
+			"a=1 # x\nbbbbbb=22 # y\ncc=é # z",
+			"a=1       # x\nbbbbbb=22 # y\ncc=é      # z",
+		},
+		// broken by blank lines, comment lines and other statements
+		{
+			0,
+			"a=1 # x\n\nbbb=2 # y\n# z\nc=3 # z\nfoo\ndd=4 # w",
+			"a=1 # x\n\nbbb=2 # y\n# z\nc=3 # z\nfoo\ndd=4 # w",
+		},
+		{
+			0,
+			"a=1 # x\nfoo; bbb=2 # y\nc=3 # z\nif x; then # w\n\tfoo\nfi",
+			"a=1 # x\nfoo\nbbb=2 # y\nc=3   # z\nif x; then # w\n\tfoo\nfi",
+		},
+		// a run exceeding the padding cap
+		{
+			0,
+			"a=1 # x\nbb=2 # y\nccccccccccc=3 # z\ndddd=4 # w\ne=5 # v\nf=6",
+			"a=1  # x\nbb=2 # y\nccccccccccc=3 # z\ndddd=4        # w\ne=5 # v\nf=6",
+		},
+		{
+			2,
+			"f() {\nfoo=$(bar) # x\nlocal x=\"y\" # y\n}",
+			"f() {\n  foo=$(bar)  # x\n  local x=\"y\" # y\n}",
+		},
+		{
+			0,
+			"if x; then\necho   foo # x\nfoooo=bar # y\nfi # z\nbar # w",
+			"if x; then\n\techo foo  # x\n\tfoooo=bar # y\nfi # z\nbar # w",
+		},
+	}
+	parser := NewParser(KeepComments(true))
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			printer := NewPrinter(Indent(tc.spaces), AlignComments(8))
+			printTest(t, parser, printer, tc.in, tc.want)
+			// the output must be stable
+			printTest(t, parser, printer, tc.want, tc.want)
+		})
+	}
+}
+
 func TestPrintMinify(t *testing.T) {
 	t.Parallel()
 	tests := [...]printCase{
@@ -867,6 +1265,353 @@ func TestPrintMinify(t *testing.T) {
 	}
 }
 
+func TestPrintMinifyBraces(t *testing.T) {
+	t.Parallel()
+	tests := [...]printCase{
+		samePrint("install -d /a/{b,c}"),
+		{
+			"install -d /a/b /a/c",
+			"install -d /a/{b,c}",
+		},
+		{
+			"echo /usr/lib/a.so /usr/lib/b.so x y",
+			"echo /usr/lib/{a,b}.so x y",
+		},
+		{
+			"for f in a.sh b.sh c.sh; do\n\t:\ndone",
+			"for f in {a,b,c}.sh;do\n:\ndone",
+		},
+		samePrint("echo ab ac"),
+		{
+			"echo 1..2 1..3",
+			"echo 1..{2,3}",
+		},
+		samePrint("echo a1..3 a2"),
+		samePrint(`echo \\a/b \\a/c "/a/b" "/a/c" $x/b $x/c`),
+		samePrint("/a/b /a/c"),
+	}
+	parser := NewParser(KeepComments(true))
+	printer := NewPrinter(Minify(true), MinifyBraces(true))
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			printTest(t, parser, printer, tc.in, tc.want)
+		})
+	}
+}
+
+func TestPrintParamBraces(t *testing.T) {
+	t.Parallel()
+	const opExps = "echo ${a:-def} ${a-b} ${#a} ${!a} ${a[1]} ${a:1:2} ${a/b/c} ${a%x}"
+	tests := [...]struct {
+		mode     BracesMode
+		in, want string
+	}{
+		{BracesLeave, "echo $a ${b} $1 ${2}", "echo $a ${b} $1 ${2}"},
+		{BracesAlways, "echo $a ${b} $foo_bar", "echo ${a} ${b} ${foo_bar}"},
+		{BracesAlways, "echo $? $# $$ $! $@ $* $- $0 $1", "echo $? $# $$ $! $@ $* $- $0 $1"},
+		{BracesAlways, "echo ${10} $1x \"$a\"b", "echo ${10} $1x \"${a}\"b"},
+		{BracesAlways, "echo $((a + $b))", "echo $((a + ${b}))"},
+		{BracesAlways, "echo ${a:-$b}", "echo ${a:-${b}}"},
+		{BracesMinimal, "echo $a ${b} ${c}-d ${e}f ${g}_h", "echo $a $b $c-d ${e}f ${g}_h"},
+		{BracesMinimal, "echo ${0} ${3} ${10} ${?} ${#}", "echo $0 $3 ${10} $? $#"},
+		{BracesMinimal, "echo \"${a}\" \"${a}b\" ${a}${b}", "echo \"$a\" \"${a}b\" $a$b"},
+
+		// regexes are printed as they are
+		{BracesAlways, "[[ $a =~ ^$b$ ]]", "[[ ${a} =~ ^$b$ ]]"},
+		{BracesMinimal, "[[ ${a} =~ ^${b}$ ]]", "[[ $a =~ ^${b}$ ]]"},
+
+		// expansions with operators are never changed
+		{BracesLeave, opExps, opExps},
+		{BracesAlways, opExps, opExps},
+		{BracesMinimal, opExps, opExps},
+	}
+	parser := NewParser(KeepComments(true))
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			printer := NewPrinter(ParamBraces(tc.mode))
+			printTest(t, parser, printer, tc.in, tc.want)
+		})
+	}
+}
+
+func TestPrintWrapAt(t *testing.T) {
+	t.Parallel()
+	tests := [...]struct {
+		col      uint
+		bnl      bool
+		in, want string
+	}{
+		{20, false, "foo bar baz", "foo bar baz"},
+		{20, false, "foo bar baz qux quux corge", "foo bar baz qux quux \\\n\tcorge"},
+		{10, false, "foo bar baz qux quux", "foo bar \\\n\tbaz \\\n\tqux \\\n\tquux"},
+		{10, false, "if a; then\n\tfoo bar baz\nfi", "if a; then\n\tfoo bar \\\n\t\tbaz\nfi"},
+		{0, false, "foo bar baz qux quux corge", "foo bar baz qux quux corge"},
+
+		// commands too long for a single line are only broken between words
+		{10, false, "foo verylongargument", "foo \\\n\tverylongargument"},
+		{10, false, "verylongcommand", "verylongcommand"},
+		{10, false, "foo 'a b c d e f'", "foo \\\n\t'a b c d e f'"},
+		{10, false, "echo \"$(foo bar baz qux)\"", "echo \\\n\t\"$(foo bar baz qux)\""},
+		{10, false, "if a; then echo x; fi", "if a; then echo x; fi"},
+		{10, false, "if a; then echo x y; fi", "if a; then echo x \\\n\ty; fi"},
+
+		// options are kept with their arguments
+		{20, false, "curl -fsSL -o output.tar.gz", "curl -fsSL \\\n\t-o output.tar.gz"},
+		{20, false, "foo --name value -- bar", "foo --name value -- \\\n\tbar"},
+
+		// pipelines and lists are broken at their operators
+		{20, false, "foo bar | baz qux | quux", "foo bar | baz qux |\n\tquux"},
+		{20, true, "foo bar | baz qux | quux", "foo bar | baz qux \\\n\t| quux"},
+		{20, false, "foo bar && baz qux && quux", "foo bar && baz qux &&\n\tquux"},
+		{20, false, "foo bar | baz qux quux", "foo bar |\n\tbaz qux quux"},
+
+		// arrays are broken between their elements
+		{20, false, "foo=(aaa bbb ccc ddd eee)", "foo=(aaa bbb ccc ddd\n\teee)"},
+		{20, false, "declare -A m=([a]=1 [bb]=22 [ccc]=333)", "declare -A m=([a]=1\n\t[bb]=22\n\t[ccc]=333)"},
+		{20, false, "foo=(\n\taaa\n\tbbb\n)", "foo=(\n\taaa\n\tbbb\n)"},
+
+		// heredoc bodies must follow the line with their operator
+		{10, false, "foo <<EOF bar baz qux\nbody\nEOF", "foo bar \\\n\tbaz \\\n\tqux <<EOF\nbody\nEOF"},
+		{10, false, "foo <<EOF | bar baz qux\nbody\nEOF", "foo <<EOF | bar baz qux\nbody\nEOF"},
+	}
+	parser := NewParser(KeepComments(true))
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			printer := NewPrinter(WrapAt(tc.col), BinaryNextLine(tc.bnl))
+			printTest(t, parser, printer, tc.in, tc.want)
+			// the output must be stable
+			printTest(t, parser, printer, tc.want, tc.want)
+			// and minifying ignores the option
+			prog, err := parser.Parse(strings.NewReader(tc.in), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, _ := strPrint(NewPrinter(Minify(true)), prog)
+			got, _ := strPrint(NewPrinter(Minify(true), WrapAt(tc.col)), prog)
+			if got != want {
+				t.Fatalf("WrapAt changed minified output:\nwant:\n%q\ngot:\n%q", want, got)
+			}
+		})
+	}
+}
+
+func TestPrintHeredocIndent(t *testing.T) {
+	t.Parallel()
+	tests := [...]struct {
+		spaces   uint
+		in, want string
+	}{
+		// plain heredocs are never changed
+		{
+			2,
+			"{\ncat <<EOF\n\tfoo\n  bar\nEOF\n}",
+			"{\n  cat <<EOF\n\tfoo\n  bar\nEOF\n}",
+		},
+		{
+			0,
+			"{\ncat <<-EOF\nfoo\n\t\tbar\nEOF\n}",
+			"{\n\tcat <<-EOF\n\t\tfoo\n\t\t\t\tbar\n\tEOF\n}",
+		},
+		{
+			2,
+			"{\ncat <<-EOF\nfoo\n\t\tbar\nEOF\n}",
+			"{\n  cat <<-EOF\n\t\tfoo\n\t\t\t\tbar\n\tEOF\n}",
+		},
+		{
+			4,
+			"f() {\n\t\t\tcat <<-EOF\n\t\t\t\t${foo}\n\n\t\t\t\t\tbar\t$(baz)\n\t\t\tEOF\n}",
+			"f() {\n    cat <<-EOF\n\t\t${foo}\n\n\t\t\tbar\t$(baz)\n\tEOF\n}",
+		},
+		{
+			2,
+			"case x in\na)\nif foo; then\ncat <<-EOF\n\tfoo\n\tEOF\nfi\n;;\nesac",
+			"case x in\na)\n  if foo; then\n    cat <<-EOF\n\t\t\tfoo\n\t\tEOF\n  fi\n  ;;\nesac",
+		},
+		{
+			2,
+			"{\ncat <<-EOF\nEOF\n}",
+			"{\n  cat <<-EOF\n\tEOF\n}",
+		},
+		// indentation that is not uniform is kept
+		{
+			2,
+			"{\ncat <<-EOF\n\tfoo\n  bar\n\tEOF\n}",
+			"{\n  cat <<-EOF\n\tfoo\n  bar\n\tEOF\n}",
+		},
+		{
+			0,
+			"{\n\tcat <<-EOF\n\t\t\tfoo\n\t\t  bar\n\tEOF\n}",
+			"{\n\tcat <<-EOF\n\t\t\tfoo\n\t\t  bar\n\tEOF\n}",
+		},
+	}
+	parser := NewParser(KeepComments(true))
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			printer := NewPrinter(Indent(tc.spaces), HeredocIndent(true))
+			printTest(t, parser, printer, tc.in, tc.want)
+		})
+	}
+
+	// The syntax tree must still point into the original bodies.
+	in := "{\ncat <<-EOF\n\t\tfoo $bar\n\tEOF\n}\n"
+	f, err := parser.Parse(strings.NewReader(in), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := strPrint(NewPrinter(Indent(2), HeredocIndent(true)), f); err != nil {
+		t.Fatal(err)
+	}
+	hdoc := f.Stmts[0].Cmd.(*Block).Stmts[0].Redirs[0].Hdoc
+	for _, part := range hdoc.Parts {
+		var want string
+		switch x := part.(type) {
+		case *Lit:
+			want = x.Value
+		case *ParamExp:
+			want = "$" + x.Param.Value
+		}
+		start := part.Pos().Offset()
+		if got := in[start : start+uint(len(want))]; got != want {
+			t.Errorf("%T at offset %d: got %q, want %q", part, start, got, want)
+		}
+	}
+}
+
+func TestPrintFmtDirectives(t *testing.T) {
+	t.Parallel()
+	tests := [...]printCase{
+		samePrint("# shfmt:off\nfoo   bar\n# shfmt:on\nfoo bar"),
+		{
+			"foo   bar\n# shfmt:off\nfoo   bar\n# shfmt:on\nfoo   bar",
+			"foo bar\n# shfmt:off\nfoo   bar\n# shfmt:on\nfoo bar",
+		},
+		// regions directly next to formatted code
+		{
+			"a  1\n#shfmt:off\nb  2\n#shfmt:on\nc  3\n#shfmt:off\nd  4\n#shfmt:on\ne  5",
+			"a 1\n#shfmt:off\nb  2\n#shfmt:on\nc 3\n#shfmt:off\nd  4\n#shfmt:on\ne 5",
+		},
+		// comments, indentation and empty lines are kept
+		samePrint("# shfmt:off\n\n  echo   a   # a\n\n# aligned\n  echo   bb  # b\n\n# shfmt:on\nfoo"),
+		{
+			"# before\n# shfmt:off\n# first\nfoo  |\n  bar\n# last\n# shfmt:on\n# after\n  foo",
+			"# before\n# shfmt:off\n# first\nfoo  |\n  bar\n# last\n# shfmt:on\n# after\nfoo",
+		},
+		samePrint("# shfmt:off\nusage() {\n\techo   \"a    b\"\n    echo   \"cc   d\"\n}\n# shfmt:on"),
+		samePrint("# shfmt:off\ndeclare -A m=(\n  [one]=1     [two]=2\n  [three]=3   [four]=4\n)"),
+		// heredoc bodies are part of the region
+		samePrint("# shfmt:off\ncat   <<EOF\n\tfoo\nEOF\n# shfmt:on\ncat <<EOF\n\tfoo\nEOF"),
+		samePrint("# shfmt:off\ncat   <<-EOF  |   tr a b\n\tfoo\n\tEOF\n# shfmt:on"),
+		samePrint("# shfmt:off\ncat <<EOF\nkeep\nEOF\necho   after\n# shfmt:on\nfoo"),
+		samePrint("# shfmt:off\ncat <<EOF; echo   same  line\nkeep\nEOF\necho   after\n# shfmt:on"),
+		{
+			"if a; then\n  # shfmt:off\n  cat <<EOF\nx\nEOF\n  b   c\nfi",
+			"if a; then\n\t# shfmt:off\n  cat <<EOF\nx\nEOF\n  b   c\nfi",
+		},
+		// an unclosed region lasts until the end of its block
+		{
+			"if a; then\n  # shfmt:off\n  b   c\n  d   e\nfi\n  f   g",
+			"if a; then\n\t# shfmt:off\n  b   c\n  d   e\nfi\nf g",
+		},
+		{
+			"{\n  # shfmt:off\n  x   y; }\n",
+			"{\n\t# shfmt:off\n  x   y;\n}",
+		},
+		{
+			"f() {\n  # shfmt:off\n  x   y\n  # shfmt:on\n  x   y\n}",
+			"f() {\n\t# shfmt:off\n  x   y\n\t# shfmt:on\n\tx y\n}",
+		},
+		{
+			"# shfmt:off\n# shfmt:on\nfoo   bar",
+			"# shfmt:off\n# shfmt:on\nfoo bar",
+		},
+		// a stray "on" is just a comment
+		{
+			"# shfmt:on\nfoo   bar",
+			"# shfmt:on\nfoo bar",
+		},
+		// directives must be on their own lines
+		{
+			"foo   bar # shfmt:off\nfoo   bar",
+			"foo bar # shfmt:off\nfoo bar",
+		},
+	}
+	parser := NewParser(KeepComments(true), RetainSource(true))
+	printer := NewPrinter()
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			printTest(t, parser, printer, tc.in, tc.want)
+			printTest(t, parser, printer, tc.want, tc.want)
+		})
+	}
+
+	t.Run("NoSource", func(t *testing.T) {
+		parser := NewParser(KeepComments(true))
+		printTest(t, parser, printer, "# shfmt:off\nfoo   bar", "# shfmt:off\nfoo bar")
+	})
+	t.Run("Minify", func(t *testing.T) {
+		printer := NewPrinter(Minify(true))
+		printTest(t, parser, printer, "# shfmt:off\nfoo   bar", "foo bar")
+	})
+}
+
+func TestPrintLines(t *testing.T) {
+	t.Parallel()
+	tests := [...]struct {
+		start, end uint
+		in, want   string
+	}{
+		{1, 1, "a  1\nb  2\nc  3\n", "a 1\nb  2\nc  3\n"},
+		{2, 2, "a  1\nb  2\nc  3\n", "a  1\nb 2\nc  3\n"},
+		{2, 3, "a  1\nb  2\nc  3", "a  1\nb 2\nc 3\n"},
+		{4, 9, "a  1\nb  2\nc  3\n", "a  1\nb  2\nc  3\n"},
+		// whole statements are formatted, with their comments
+		{3, 3, "a  1\nif  x;  then\n  b  2\nfi\n", "a  1\nif x; then\n\tb 2\nfi\n"},
+		{3, 3, "a  1\n# c  1\n\n# c  2\nb  2\n\n\nc  3\n", "a  1\n# c  1\n\n# c  2\nb 2\n\n\nc  3\n"},
+		{1, 1, "a  1\nb  2 # c\n", "a 1\nb  2 # c\n"},
+		// statements sharing a line go together
+		{2, 2, "a  1;  b  2\nc  3\n", "a  1;  b  2\nc 3\n"},
+		{1, 1, "a  1;  b  2\nc  3\n", "a 1\nb 2\nc  3\n"},
+		{1, 1, "cat  <<EOF; b  2\n  body\nEOF\nc  3\n", "cat <<EOF\n  body\nEOF\nb 2\nc  3\n"},
+		// blank lines between the formatted statements are kept
+		{1, 5, "a  1\n\n\n\nb  2\nc  3\n", "a 1\n\nb 2\nc  3\n"},
+		{1, 1, "  a  1\n\n  b  2\n", "a 1\n\n  b  2\n"},
+		// last comments and heredocs are kept
+		{2, 2, "a  1\nb  <<EOF\n\tbody\nEOF\n# last  comment\n", "a  1\nb <<EOF\n\tbody\nEOF\n# last  comment\n"},
+		// regions with formatting off are kept as a whole
+		{3, 3, "# shfmt:off\na  1\nb  2\n# shfmt:on\nc  3\n", "# shfmt:off\na  1\nb  2\n# shfmt:on\nc  3\n"},
+		{5, 5, "# shfmt:off\na  1\nb  2\n# shfmt:on\nc  3\n", "# shfmt:off\na  1\nb  2\n# shfmt:on\nc 3\n"},
+		{1, 1, "", ""},
+	}
+	parser := NewParser(KeepComments(true), RetainSource(true))
+	printer := NewPrinter()
+	for i, tc := range tests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			prog, err := parser.Parse(strings.NewReader(tc.in), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			if err := printer.PrintLines(&buf, prog, tc.start, tc.end); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != tc.want {
+				t.Fatalf("PrintLines(%d, %d) mismatch:\nin:\n%q\nwant:\n%q\ngot:\n%q",
+					tc.start, tc.end, tc.in, tc.want, got)
+			}
+		})
+	}
+
+	t.Run("NoSource", func(t *testing.T) {
+		prog, err := NewParser().Parse(strings.NewReader("foo"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := printer.PrintLines(ioutil.Discard, prog, 1, 1); err == nil {
+			t.Fatal("want an error without the source")
+		}
+	})
+}
+
 func TestPrintMinifyNotBroken(t *testing.T) {
 	t.Parallel()
 	parserBash := NewParser(KeepComments(true))
@@ -978,6 +1723,14 @@ func TestPrintNodeTypes(t *testing.T) {
 			in:   sglQuoted("foo"),
 			want: "'foo'",
 		},
+		{
+			in: &BinaryArithm{
+				Op: Quo,
+				X:  litWord("x"),
+				Y:  &ParenArithm{X: &UnaryArithm{Op: Inc, X: litWord("y")}},
+			},
+			want: "x / (++y)",
+		},
 		{
 			in:      &Comment{},
 			wantErr: true,
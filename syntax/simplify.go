@@ -3,30 +3,128 @@
 
 package syntax
 
-import "bytes"
+import (
+	"bytes"
+	"strings"
+)
 
 // Simplify modifies a node to remove redundant pieces of syntax, and returns
 // whether any changes were made.
 //
-// The changes currently applied are:
+// The changes currently applied are the following, each with its rule:
 //
-//     Remove clearly useless parentheses       $(( (expr) ))
-//     Remove dollars from vars in exprs        (($var))
-//     Remove duplicate subshells               $( (stmts) )
-//     Remove redundant quotes                  [[ "$var" == str ]]
-//     Merge negations with unary operators     [[ ! -n $var ]]
-//     Use single quotes to shorten literals    "\$foo"
-func Simplify(n Node) bool {
-	s := simplifier{}
+//     Remove clearly useless parentheses       $(( (expr) ))         SimplifyArithmParens
+//     Remove dollars from vars in exprs        (($var))              SimplifyArithmVars
+//     Remove duplicate subshells               $( (stmts) )          SimplifySubshells
+//     Remove redundant quotes                  [[ "$var" == str ]]   SimplifyTestQuotes
+//     Remove parentheses in test clauses       [[ (-z $var) ]]       SimplifyTestParens
+//     Merge negations with unary operators     [[ ! -n $var ]]       SimplifyTestNegations
+//     Use == rather than = in test clauses     [[ $var = str ]]      SimplifyTestMatch
+//     Use single quotes to shorten literals    "\$foo"               SimplifySingleQuotes
+//
+// The SimplifyRules option limits the changes to a subset of the rules.
+//
+// Comments are never removed. When a subshell is removed, its comments and
+// those of its statement are kept in the surrounding list: the ones before
+// the subshell go before its first statement, and the rest go after its last
+// statement. The other changes don't remove any nodes with comments. Positions are
+// left as they are, but the printer drops the lines which are left empty by a
+// removed subshell's parentheses.
+//
+// Options such as ConvertTests enable further changes.
+//
+// If n is a *File with its parents recorded, they are updated as well.
+func Simplify(n Node, opts ...SimplifyOption) bool {
+	s := simplifier{rules: SimplifyAll}
+	for _, opt := range opts {
+		opt(&s)
+	}
 	Walk(n, s.visit)
+	if f, ok := n.(*File); ok && s.modified && f.parents != nil {
+		f.UpdateParents()
+	}
 	return s.modified
 }
 
+// SimplifyRule is a set of the changes made by Simplify, as listed in its
+// documentation.
+type SimplifyRule uint
+
+const (
+	SimplifyArithmParens SimplifyRule = 1 << iota
+	SimplifyArithmVars
+	SimplifySubshells
+	SimplifyTestQuotes
+	SimplifyTestParens
+	SimplifyTestNegations
+	SimplifyTestMatch
+	SimplifySingleQuotes
+
+	// SimplifyAll is all the rules, which Simplify applies by default.
+	SimplifyAll SimplifyRule = 1<<iota - 1
+)
+
+// simplifyRuleNames are the names of the single rules, as used by shfmt.
+var simplifyRuleNames = [...]string{
+	"arithm-parens",
+	"arithm-vars",
+	"subshells",
+	"test-quotes",
+	"test-parens",
+	"test-negations",
+	"test-match",
+	"single-quotes",
+}
+
+// String returns the name of a single rule, like "test-quotes", or the names
+// of multiple rules separated by commas.
+func (r SimplifyRule) String() string {
+	var names []string
+	for i, name := range simplifyRuleNames {
+		if r&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// LookupSimplifyRule returns the rule with the given name, as returned by
+// SimplifyRule.String, and whether it exists.
+func LookupSimplifyRule(name string) (SimplifyRule, bool) {
+	for i, rname := range simplifyRuleNames {
+		if rname == name {
+			return 1 << uint(i), true
+		}
+	}
+	return 0, false
+}
+
+// SimplifyRules makes Simplify only apply the given rules, rather than all of
+// them. Options such as ConvertTests are not affected.
+func SimplifyRules(rules SimplifyRule) SimplifyOption {
+	return func(s *simplifier) { s.rules = rules }
+}
+
 type simplifier struct {
 	modified bool
+
+	rules SimplifyRule
+
+	convertTests bool
+	testsLang    LangVariant
+
+	// Statements which can't be a list, can't be negated, or must be a
+	// compound command if their test clause is converted; see convertTest.
+	grouped, piped, compound map[*Stmt]bool
 }
 
 func (s *simplifier) visit(node Node) bool {
+	if s.convertTests {
+		s.markTestGroups(node)
+		if st, ok := node.(*Stmt); ok {
+			s.convertTest(st)
+		}
+	}
 	switch x := node.(type) {
 	case *Assign:
 		x.Index = s.removeParensArithm(x.Index)
@@ -57,9 +155,9 @@ func (s *simplifier) visit(node Node) bool {
 		x.X = s.inlineSimpleParams(x.X)
 		x.Y = s.inlineSimpleParams(x.Y)
 	case *CmdSubst:
-		x.Stmts = s.inlineSubshell(x.Stmts)
+		x.Stmts, x.Last = s.inlineSubshell(x.Stmts, x.Last, x.Left, x.Right, &x.emptyLines)
 	case *Subshell:
-		x.Stmts = s.inlineSubshell(x.Stmts)
+		x.Stmts, x.Last = s.inlineSubshell(x.Stmts, x.Last, x.Lparen, x.Rparen, &x.emptyLines)
 	case *Word:
 		x.Parts = s.simplifyWord(x.Parts)
 	case *TestClause:
@@ -71,13 +169,13 @@ func (s *simplifier) visit(node Node) bool {
 	case *BinaryTest:
 		x.X = s.unquoteParams(x.X)
 		x.X = s.removeNegateTest(x.X)
-		if x.Op == TsMatchShort {
+		if x.Op == TsMatchShort && s.rules&SimplifyTestMatch != 0 {
 			s.modified = true
 			x.Op = TsMatch
 		}
 		switch x.Op {
-		case TsMatch, TsNoMatch:
-			// unquoting enables globbing
+		case TsMatch, TsNoMatch, TsReMatch:
+			// unquoting enables globbing and regex syntax
 		default:
 			x.Y = s.unquoteParams(x.Y)
 		}
@@ -89,6 +187,9 @@ func (s *simplifier) visit(node Node) bool {
 }
 
 func (s *simplifier) simplifyWord(wps []WordPart) []WordPart {
+	if s.rules&SimplifySingleQuotes == 0 {
+		return wps
+	}
 parts:
 	for i, wp := range wps {
 		dq, _ := wp.(*DblQuoted)
@@ -136,6 +237,9 @@ parts:
 }
 
 func (s *simplifier) removeParensArithm(x ArithmExpr) ArithmExpr {
+	if s.rules&SimplifyArithmParens == 0 {
+		return x
+	}
 	for {
 		par, _ := x.(*ParenArithm)
 		if par == nil {
@@ -147,6 +251,9 @@ func (s *simplifier) removeParensArithm(x ArithmExpr) ArithmExpr {
 }
 
 func (s *simplifier) inlineSimpleParams(x ArithmExpr) ArithmExpr {
+	if s.rules&SimplifyArithmVars == 0 {
+		return x
+	}
 	w, _ := x.(*Word)
 	if w == nil || len(w.Parts) != 1 {
 		return x
@@ -168,7 +275,17 @@ func (s *simplifier) inlineSimpleParams(x ArithmExpr) ArithmExpr {
 	return &Word{Parts: []WordPart{pe.Param}}
 }
 
-func (s *simplifier) inlineSubshell(stmts []*Stmt) []*Stmt {
+// inlineSubshell replaces a list of statements consisting of a single subshell
+// with the list within the subshell. The comments of the removed statement and
+// subshell are kept: the ones before the statement move to the first statement
+// in the subshell, and the rest are added to the comments at the end of the
+// list, in their original order. open and close are the positions which
+// enclose the list, such as the parentheses of the parent subshell, and the
+// lines left empty are added to emptyLines.
+func (s *simplifier) inlineSubshell(stmts []*Stmt, last []Comment, open, close Pos, emptyLines *[]uint) ([]*Stmt, []Comment) {
+	if s.rules&SimplifySubshells == 0 {
+		return stmts, last
+	}
 	for len(stmts) == 1 {
 		st := stmts[0]
 		if st.Negated || st.Background || st.Coprocess ||
@@ -180,12 +297,79 @@ func (s *simplifier) inlineSubshell(stmts []*Stmt) []*Stmt {
 			break
 		}
 		s.modified = true
+		var before, after []Comment
+		for _, c := range st.Comments {
+			if c.Pos().After(st.Pos()) {
+				after = append(after, c)
+			} else {
+				before = append(before, c)
+			}
+		}
+		*emptyLines = append(*emptyLines, sub.emptyLines...)
+		*emptyLines = append(*emptyLines, parenLines(sub, after, open, close)...)
+		innerLast := sub.Last
+		if len(sub.Stmts) > 0 {
+			first := sub.Stmts[0]
+			first.Comments = append(before, first.Comments...)
+		} else {
+			innerLast = append(before, innerLast...)
+		}
 		stmts = sub.Stmts
+		last = append(append(innerLast, after...), last...)
 	}
-	return stmts
+	return stmts, last
+}
+
+// parenLines returns the lines of the parentheses of a subshell being removed
+// if nothing else is on them, so that they don't end up as empty lines. after
+// holds the comments following the subshell.
+func parenLines(sub *Subshell, after []Comment, open, close Pos) []uint {
+	// The lines of the first and last things kept from within the subshell.
+	var first, last uint
+	if len(sub.Stmts) > 0 {
+		st := sub.Stmts[0]
+		first = st.Pos().Line()
+		if len(st.Comments) > 0 && st.Comments[0].Pos().Line() < first {
+			first = st.Comments[0].Pos().Line()
+		}
+		st = sub.Stmts[len(sub.Stmts)-1]
+		last = st.End().Line()
+		for _, c := range st.Comments {
+			if l := c.End().Line(); l > last {
+				last = l
+			}
+		}
+	}
+	if len(sub.Last) > 0 {
+		if first == 0 {
+			first = sub.Last[0].Pos().Line()
+		}
+		last = sub.Last[len(sub.Last)-1].End().Line()
+	}
+	free := func(line uint) bool {
+		if line <= open.Line() || line >= close.Line() {
+			return false
+		}
+		for _, c := range after {
+			if c.Pos().Line() == line {
+				return false
+			}
+		}
+		return first == 0 || line < first || line > last
+	}
+	var lines []uint
+	for _, line := range [...]uint{sub.Lparen.Line(), sub.Rparen.Line()} {
+		if free(line) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
 }
 
 func (s *simplifier) unquoteParams(x TestExpr) TestExpr {
+	if s.rules&SimplifyTestQuotes == 0 {
+		return x
+	}
 	w, _ := x.(*Word)
 	if w == nil || len(w.Parts) != 1 {
 		return x
@@ -203,6 +387,9 @@ func (s *simplifier) unquoteParams(x TestExpr) TestExpr {
 }
 
 func (s *simplifier) removeParensTest(x TestExpr) TestExpr {
+	if s.rules&SimplifyTestParens == 0 {
+		return x
+	}
 	for {
 		par, _ := x.(*ParenTest)
 		if par == nil {
@@ -214,6 +401,9 @@ func (s *simplifier) removeParensTest(x TestExpr) TestExpr {
 }
 
 func (s *simplifier) removeNegateTest(x TestExpr) TestExpr {
+	if s.rules&SimplifyTestNegations == 0 {
+		return x
+	}
 	u, _ := x.(*UnaryTest)
 	if u == nil || u.Op != TsNot {
 		return x
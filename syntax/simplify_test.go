@@ -45,12 +45,15 @@ var simplifyTests = [...]simplifyTest{
 	noSimple(`[[ ! -e foo ]]`),
 	noSimple(`[[ foo == bar ]]`),
 	{`[[ foo = bar ]]`, `[[ foo == bar ]]`},
+	{`[[ "$foo" =~ "$bar" ]]`, `[[ $foo =~ "$bar" ]]`},
 
 	// stmts
 	{"$( (sts))", "$(sts)"},
 	{"( ( (sts)))", "(sts)"},
 	noSimple("( (sts) >f)"),
 	noSimple("(\n\tx\n\t(sts)\n)"),
+	{"x=$(\n\t(\n\t\tsts\n\t)\n)\nfoo\n\nbar", "x=$(\n\tsts\n)\nfoo\n\nbar"},
+	{"(\n\t( (\n\t\tsts\n\n\t\tsts\n\t) )\n)", "(\n\tsts\n\n\tsts\n)"},
 
 	// strings
 	noSimple(`"foo"`),
@@ -93,3 +96,250 @@ func TestSimplify(t *testing.T) {
 		})
 	}
 }
+
+// simplifyCommentTests show where the comments go when Simplify changes or
+// removes nodes. No comment should ever be lost.
+var simplifyCommentTests = [...]simplifyTest{
+	// arithmetic exprs
+	{
+		"# a\n(((b - c))) # d\n# e",
+		"# a\n((b - c)) # d\n# e",
+	},
+	{
+		"# a\nx=$(($y + 1)) # b",
+		"# a\nx=$((y + 1)) # b",
+	},
+
+	// test exprs
+	{
+		"# a\n[[ ! -n \"$foo\" ]] # b",
+		"# a\n[[ -z $foo ]] # b",
+	},
+	{
+		"# a\n[[ (-z \"$foo\") ]] # b",
+		"# a\n[[ -z $foo ]] # b",
+	},
+
+	// stmts
+	{
+		"# a\n( # b\n\t( # c\n\t\tfoo # d\n\t\t# e\n\t) # f\n\t# g\n) # h",
+		"# a\n( # b\n\t# c\n\tfoo # d\n\t# e\n\t# f\n\t# g\n) # h",
+	},
+	{
+		"x=$( # a\n\t(\n\t\t# b\n\t\tfoo\n\t)\n)",
+		"x=$( # a\n\t# b\n\tfoo\n)",
+	},
+	{
+		"(\n\t( # a\n\t\t# b\n\t)\n)",
+		"(\n\t# a\n\t# b\n)",
+	},
+	{
+		"( ( (foo # a\n) # b\n) # c\n)",
+		"(\n\tfoo # a\n\t# b\n\t# c\n)",
+	},
+
+	// strings
+	{
+		"# a\necho \"fo\\$o\" # b",
+		"# a\necho 'fo$o' # b",
+	},
+}
+
+var simplifyRulesTests = [...]struct {
+	rules    SimplifyRule
+	in, want string
+}{
+	{SimplifyArithmParens, "$((($a)))", "$(($a))"},
+	{SimplifyArithmVars, "$((($a)))", "$(((a)))"},
+	{SimplifyArithmParens | SimplifyArithmVars, "$((($a)))", "$((a))"},
+	{SimplifySubshells, "$( (foo))", "$(foo)"},
+	{SimplifyTestQuotes, `[[ ! ("$a" = b) ]]`, `[[ ! ($a = b) ]]`},
+	{SimplifyTestParens, `[[ ("$a" = b) ]]`, `[[ "$a" = b ]]`},
+	{SimplifyTestMatch, `[[ ! ("$a" = b) ]]`, `[[ ! ("$a" == b) ]]`},
+	{SimplifyTestNegations, `[[ ! -n "$a" ]]`, `[[ -z "$a" ]]`},
+	{SimplifySingleQuotes, `echo "\$a" "$( (b))"`, `echo '$a' "$( (b))"`},
+	{0, `[[ ("$a" = b) ]]`, `[[ ("$a" = b) ]]`},
+}
+
+func TestSimplifyRules(t *testing.T) {
+	t.Parallel()
+	parser := NewParser()
+	printer := NewPrinter()
+	for i, tc := range simplifyRulesTests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			prog, err := parser.Parse(strings.NewReader(tc.in), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			simplified := Simplify(prog, SimplifyRules(tc.rules))
+			var buf bytes.Buffer
+			printer.Print(&buf, prog)
+			want := tc.want + "\n"
+			if got := buf.String(); got != want {
+				t.Fatalf("Simplify mismatch of %q with %q\nwant: %q\ngot:  %q",
+					tc.in, tc.rules, want, got)
+			}
+			if simplified != (tc.in != tc.want) {
+				t.Fatalf("returned %v for %q", simplified, tc.in)
+			}
+		})
+	}
+	names := strings.Split(SimplifyAll.String(), ",")
+	if len(names) != len(simplifyRuleNames) {
+		t.Fatalf("SimplifyAll has %d names, want %d", len(names), len(simplifyRuleNames))
+	}
+	for _, name := range names {
+		rule, ok := LookupSimplifyRule(name)
+		if !ok || rule.String() != name {
+			t.Errorf("LookupSimplifyRule(%q) = %v, %v", name, rule, ok)
+		}
+	}
+	if _, ok := LookupSimplifyRule("all"); ok {
+		t.Errorf("LookupSimplifyRule found an unknown name")
+	}
+}
+
+func TestSimplifyComments(t *testing.T) {
+	t.Parallel()
+	parser := NewParser(KeepComments(true))
+	printer := NewPrinter()
+	for i, tc := range simplifyCommentTests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			prog, err := parser.Parse(strings.NewReader(tc.in), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !Simplify(prog) {
+				t.Fatalf("returned false but should simplify")
+			}
+			var buf bytes.Buffer
+			printer.Print(&buf, prog)
+			want := tc.want + "\n"
+			if got := buf.String(); got != want {
+				t.Fatalf("Simplify mismatch of %q\nwant: %q\ngot:  %q",
+					tc.in, want, got)
+			}
+		})
+	}
+}
+
+func TestSimplifyKeepsPositions(t *testing.T) {
+	t.Parallel()
+	in := "x=$(\n\t(\n\t\tfoo\n\t)\n)\nbar\n"
+	prog, err := NewParser().Parse(strings.NewReader(in), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bar := prog.Stmts[1]
+	// Simplify a subtree, without the file around it.
+	if !Simplify(prog.Stmts[0]) {
+		t.Fatalf("returned false but should simplify")
+	}
+	if got, want := bar.Pos(), NewPos(19, 6, 1); got != want {
+		t.Fatalf("bar moved from %v to %v, offset %d", want, got, got.Offset())
+	}
+	var buf bytes.Buffer
+	NewPrinter().Print(&buf, prog)
+	want := "x=$(\n\tfoo\n)\nbar\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("Simplify mismatch of %q\nwant: %q\ngot:  %q", in, want, got)
+	}
+}
+
+var convertTestsTests = [...]struct {
+	lang     LangVariant
+	in, want string
+}{
+	// [ ] to [[ ]]
+	{LangBash, "[ -f a ]", "[[ -f a ]]"},
+	{LangBash, `[ "$a" = "$b" ]`, `[[ $a == "$b" ]]`},
+	{LangBash, `[ "$a" != b ]`, `[[ $a != b ]]`},
+	{LangBash, `[ $a = b ]`, `[[ $a == b ]]`},
+	{LangBash, `[ -n "$a" ]`, `[[ -n $a ]]`},
+	{LangBash, `[ -z $a ]`, `[[ -z $a ]]`},
+	{LangBash, `[ "$a" ]`, `[[ -n $a ]]`},
+	{LangBash, "[ 3 -eq -3 ]", "[[ 3 -eq -3 ]]"},
+	{LangBash, "[ a -nt b ]", "[[ a -nt b ]]"},
+	{LangBash, "[ ! -e a ]", "[[ ! -e a ]]"},
+	{LangBash, "! [ -e a ]", "! [[ -e a ]]"},
+	{LangBash, `[ ! "$a" = b ]`, `[[ $a != b ]]`},
+	{LangBash, "[ -f a -a -r a ]", "[[ -f a && -r a ]]"},
+	{LangBash, "[ -f a -o -d a ]", "[[ -f a || -d a ]]"},
+	{LangBash, `[ \( -f a -o -d a \) -a -r a ]`, "[[ (-f a || -d a) && -r a ]]"},
+	{LangBash, "[ -e a ] >/dev/null 2>&1", "[[ -e a ]] >/dev/null 2>&1"},
+	{LangBash, "[ -e a ] && echo y", "[[ -e a ]] && echo y"},
+	{LangBash, "[ -e a ] | cat", "[[ -e a ]] | cat"},
+	{LangMirBSDKorn, "[ -f a -a -r a ]", "[[ -f a && -r a ]]"},
+	{LangBash, "[ ]", "[ ]"},
+	{LangBash, "[ a b ]", "[ a b ]"},
+	{LangBash, `[ "$@" ]`, `[ "$@" ]`},
+	{LangBash, "[ a* = b ]", "[ a* = b ]"},
+	{LangBash, "foo=bar [ -e a ]", "foo=bar [ -e a ]"},
+	{LangBash, "[ -e a", "[ -e a"},
+	{LangBash, "test -e a", "test -e a"},
+	{LangBash, `[ "$a" -eq 3 ]`, `[ "$a" -eq 3 ]`},
+	{LangBash, `[ 3 -lt $a ]`, `[ 3 -lt $a ]`},
+	{LangBash, `[ "$a" -ne "$(b)" -a -f c ]`, `[ "$a" -ne "$(b)" -a -f c ]`},
+
+	// [[ ]] to [ ] and case
+	{LangPOSIX, "[[ -f a ]]", "[ -f a ]"},
+	{LangPOSIX, `[[ $a == "$b" ]]`, `[ "$a" = "$b" ]`},
+	{LangPOSIX, `[[ $a != b ]]`, `[ "$a" != b ]`},
+	{LangPOSIX, `[[ $a == "x*" ]]`, `[ "$a" = "x*" ]`},
+	{LangPOSIX, `[[ $a == x\* ]]`, `[ "$a" = x\* ]`},
+	{LangPOSIX, "[[ -n $a ]]", `[ -n "$a" ]`},
+	{LangPOSIX, "[[ $a ]]", `[ -n "$a" ]`},
+	{LangPOSIX, "[[ $a -eq $b ]]", `[ "$a" -eq "$b" ]`},
+	{LangPOSIX, "[[ ! -e a ]]", "[ ! -e a ]"},
+	{LangPOSIX, "! [[ -e a ]]", "! [ -e a ]"},
+	{LangPOSIX, "[[ -f a && -r a ]]", "[ -f a ] && [ -r a ]"},
+	{LangPOSIX, "[[ -f a || -d a ]]", "[ -f a ] || [ -d a ]"},
+	{LangPOSIX, "[[ (-f a || -d a) && -r a ]]", "[ -f a ] || [ -d a ] && [ -r a ]"},
+	{LangPOSIX, "[[ a && (b || c) ]]", "[ -n a ] && { [ -n b ] || [ -n c ]; }"},
+	{LangPOSIX, "[[ a || b && c ]]", "[ -n a ] || { [ -n b ] && [ -n c ]; }"},
+	{LangPOSIX, "[[ ! (a && b) ]]", "! { [ -n a ] && [ -n b ]; }"},
+	{LangPOSIX, "! [[ a && b ]]", "! { [ -n a ] && [ -n b ]; }"},
+	{LangPOSIX, "x || [[ a && b ]]", "x || { [ -n a ] && [ -n b ]; }"},
+	{LangPOSIX, "[[ $a == x* ]]", "case $a in x*) true ;; *) false ;; esac"},
+	{LangPOSIX, "[[ $a != x* ]]", "case $a in x*) false ;; *) true ;; esac"},
+	{LangPOSIX, "[[ -e a ]] >/dev/null", "[ -e a ] >/dev/null"},
+	{LangPOSIX, "[[ -e a && -r a ]] >/dev/null", "{ [ -e a ] && [ -r a ]; } >/dev/null"},
+	{LangPOSIX, "[[ -e a && -r a ]] | cat", "{ [ -e a ] && [ -r a ]; } | cat"},
+	{LangPOSIX, "[[ -e a ]] &", "[ -e a ] &"},
+	{LangPOSIX, "f() [[ -f a ]]", "f() { [ -f a ]; }"},
+	{LangPOSIX, "if [[ -e a ]]; then :; fi", "if [ -e a ]; then :; fi"},
+	{LangPOSIX, "[[ $a =~ x ]]", "[[ $a =~ x ]]"},
+	{LangPOSIX, "[[ a < b ]]", "[[ a < b ]]"},
+	{LangPOSIX, "[[ -v a ]]", "[[ -v a ]]"},
+	{LangPOSIX, "[[ $a == @(x|y) ]]", "[[ $a == @(x|y) ]]"},
+	{LangPOSIX, `[[ "$@" ]]`, `[[ "$@" ]]`},
+	{LangPOSIX, "[[ $a -eq b+1 ]]", "[[ $a -eq b+1 ]]"},
+}
+
+func TestSimplifyConvertTests(t *testing.T) {
+	t.Parallel()
+	parser := NewParser()
+	printer := NewPrinter()
+	for i, tc := range convertTestsTests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			prog, err := parser.Parse(strings.NewReader(tc.in), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			Simplify(prog, ConvertTests(tc.lang))
+			var buf bytes.Buffer
+			printer.Print(&buf, prog)
+			want := tc.want + "\n"
+			if got := buf.String(); got != want {
+				t.Fatalf("Simplify mismatch of %q\nwant: %q\ngot:  %q",
+					tc.in, want, got)
+			}
+			// Converting again should be a no-op.
+			if Simplify(prog, ConvertTests(tc.lang)) {
+				buf.Reset()
+				printer.Print(&buf, prog)
+				t.Fatalf("second Simplify of %q made changes: %q", tc.in, buf.String())
+			}
+		})
+	}
+}
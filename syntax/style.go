@@ -0,0 +1,83 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+// Style is a named bundle of parser and printer options, such as the one
+// returned by StyleGoogle. Each field corresponds to the option of the same
+// name; the zero value of a field is the option's default, so the zero Style
+// is the same as StyleDefault apart from its name.
+//
+// A Style may be modified to override some of its settings before getting its
+// options.
+type Style struct {
+	// Name is the name of the style, like "google".
+	Name string
+
+	Variant LangVariant
+
+	AlignComments    uint
+	BinaryNextLine   bool
+	HeredocIndent    bool
+	Indent           uint
+	KeepPadding      bool
+	Minify           bool
+	MinifyBraces     bool
+	ParamBraces      BracesMode
+	Reindent         bool
+	SpaceRedirects   bool
+	SwitchCaseIndent bool
+	WrapAt           uint
+}
+
+// StyleDefault returns the style used when no options are given, which
+// formats with tabs.
+func StyleDefault() Style {
+	return Style{Name: "default"}
+}
+
+// StyleGoogle returns the style described by the Google Shell Style Guide:
+// Bash, indented with two spaces, with case branches indented, and with long
+// pipelines and lists split so that each line starts with an operator.
+func StyleGoogle() Style {
+	return Style{
+		Name:             "google",
+		Variant:          LangBash,
+		Indent:           2,
+		BinaryNextLine:   true,
+		SwitchCaseIndent: true,
+	}
+}
+
+// StyleMinimalDiff returns a style which changes as little of the source as
+// possible while still formatting it, such as to format existing scripts in a
+// single small commit. Column alignment paddings are kept.
+func StyleMinimalDiff() Style {
+	return Style{
+		Name:        "minimal-diff",
+		KeepPadding: true,
+	}
+}
+
+// ParserOptions returns the parser options of the style.
+func (s Style) ParserOptions() []ParserOption {
+	return []ParserOption{Variant(s.Variant)}
+}
+
+// PrinterOptions returns the printer options of the style.
+func (s Style) PrinterOptions() []PrinterOption {
+	return []PrinterOption{
+		AlignComments(s.AlignComments),
+		BinaryNextLine(s.BinaryNextLine),
+		HeredocIndent(s.HeredocIndent),
+		Indent(s.Indent),
+		KeepPadding(s.KeepPadding),
+		Minify(s.Minify),
+		MinifyBraces(s.MinifyBraces),
+		ParamBraces(s.ParamBraces),
+		Reindent(s.Reindent),
+		SpaceRedirects(s.SpaceRedirects),
+		SwitchCaseIndent(s.SwitchCaseIndent),
+		WrapAt(s.WrapAt),
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package syntax
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var styles = []Style{StyleDefault(), StyleGoogle(), StyleMinimalDiff()}
+
+// TestStyles checks the output of each style on a fixture against a golden
+// file, so that the meaning of a style doesn't change by accident. After an
+// intended change, run the test with UPDATE_STYLES=1 to update the files.
+func TestStyles(t *testing.T) {
+	t.Parallel()
+	dir := filepath.Join("testdata", "styles")
+	src, err := ioutil.ReadFile(filepath.Join(dir, "input.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, style := range styles {
+		style := style
+		t.Run(style.Name, func(t *testing.T) {
+			opts := append(style.ParserOptions(), KeepComments(true))
+			f, err := NewParser(opts...).Parse(strings.NewReader(string(src)), "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := strPrint(NewPrinter(style.PrinterOptions()...), f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(dir, style.Name+".sh")
+			if os.Getenv("UPDATE_STYLES") != "" {
+				if err := ioutil.WriteFile(path, []byte(got), 0666); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != strings.Replace(string(want), "\r", "", -1) {
+				t.Fatalf("output of style %q differs from %s:\n%s", style.Name, path, got)
+			}
+		})
+	}
+}
+
+func TestStyleFields(t *testing.T) {
+	t.Parallel()
+	typ := reflect.TypeOf(Style{})
+	var opts []OptionInfo
+	opts = append(opts, printerOptions[:]...)
+	opts = append(opts, OptionInfo{Name: "Variant"})
+	for _, opt := range opts {
+		if _, ok := typ.FieldByName(opt.Name); !ok {
+			t.Errorf("Style is missing the option %s", opt.Name)
+		}
+	}
+	if len(StyleDefault().PrinterOptions()) != len(printerOptions) {
+		t.Errorf("Style.PrinterOptions does not return all printer options")
+	}
+	def := StyleDefault()
+	def.Name = ""
+	if def != (Style{}) {
+		t.Errorf("StyleDefault is not the zero Style")
+	}
+}
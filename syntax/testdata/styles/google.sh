@@ -0,0 +1,28 @@
+#!/bin/bash
+
+# Comments and paddings aligned by hand.
+readonly NAME="app"  # the name
+readonly VERSION=1.2 # the version
+
+main() {
+  local dir=${1:-.}
+  if [[ -d $dir ]]; then
+    find "$dir" -name '*.sh' | sort | uniq -c | while read -r count file; do
+      echo "$count $file"
+    done
+  fi
+  cmd_one --flag \
+    && cmd_two \
+    || cmd_three
+  case $NAME in
+    app) echo app ;;
+    *)
+      echo "other" >&2
+      ;;
+  esac
+  cat <<-EOF >out.txt
+		indented $NAME
+	EOF
+}
+
+main "$@"
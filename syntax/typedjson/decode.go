@@ -0,0 +1,269 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package typedjson
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// nodeTypes are the node types which can be found in interface fields, or at
+// the root, by the names used in "Type" keys.
+var nodeTypes = make(map[string]reflect.Type)
+
+func init() {
+	for _, node := range []syntax.Node{
+		&syntax.File{},
+		&syntax.Comment{},
+		&syntax.Stmt{},
+		&syntax.Assign{},
+		&syntax.Redirect{},
+
+		&syntax.CallExpr{},
+		&syntax.IfClause{},
+		&syntax.WhileClause{},
+		&syntax.ForClause{},
+		&syntax.CaseClause{},
+		&syntax.Block{},
+		&syntax.Subshell{},
+		&syntax.BinaryCmd{},
+		&syntax.FuncDecl{},
+		&syntax.ArithmCmd{},
+		&syntax.TestClause{},
+		&syntax.DeclClause{},
+		&syntax.LetClause{},
+		&syntax.TimeClause{},
+		&syntax.CoprocClause{},
+
+		&syntax.WordIter{},
+		&syntax.CStyleLoop{},
+
+		&syntax.Word{},
+		&syntax.Lit{},
+		&syntax.SglQuoted{},
+		&syntax.DblQuoted{},
+		&syntax.ParamExp{},
+		&syntax.CmdSubst{},
+		&syntax.ArithmExp{},
+		&syntax.ProcSubst{},
+		&syntax.ExtGlob{},
+		&syntax.BraceExp{},
+
+		&syntax.BinaryArithm{},
+		&syntax.UnaryArithm{},
+		&syntax.ParenArithm{},
+
+		&syntax.BinaryTest{},
+		&syntax.UnaryTest{},
+		&syntax.ParenTest{},
+		&syntax.RegexWord{},
+
+		&syntax.CaseItem{},
+		&syntax.ArrayExpr{},
+		&syntax.ArrayElem{},
+	} {
+		typ := reflect.TypeOf(node).Elem()
+		nodeTypes[typ.Name()] = typ
+	}
+}
+
+// Decode reads a syntax tree encoded as JSON by Encode. The root node's type is
+// given by its "Type" key; if it has none, it is decoded as a *syntax.File.
+//
+// Positions missing from the input are left as zero values, so tools may add
+// nodes without any. Unknown keys and values of the wrong type are an error.
+func Decode(r io.Reader) (syntax.Node, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("want a JSON object, got %s", jsonKind(v))
+	}
+	if _, ok := obj["Type"]; !ok {
+		f := &syntax.File{}
+		if err := decodeValue(reflect.ValueOf(f).Elem(), obj, "File"); err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+	var node syntax.Node
+	if err := decodeValue(reflect.ValueOf(&node).Elem(), obj, "root"); err != nil {
+		return nil, err
+	}
+	return node, nil
+}
+
+// decodeValue sets val from a JSON value decoded by encoding/json. path
+// describes where the value is, to give context in errors.
+func decodeValue(val reflect.Value, v interface{}, path string) error {
+	typ := val.Type()
+	switch typ.Kind() {
+	case reflect.Ptr:
+		if v == nil {
+			return nil
+		}
+		ptr := reflect.New(typ.Elem())
+		if err := decodeValue(ptr.Elem(), v, path); err != nil {
+			return err
+		}
+		val.Set(ptr)
+		return nil
+	case reflect.Interface:
+		if v == nil {
+			return nil
+		}
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: want an object, got %s", path, jsonKind(v))
+		}
+		name, _ := obj["Type"].(string)
+		ntyp := nodeTypes[name]
+		if ntyp == nil {
+			return fmt.Errorf("%s: unknown node type: %q", path, name)
+		}
+		if !reflect.PtrTo(ntyp).Implements(typ) {
+			return fmt.Errorf("%s: %s is not a valid %s", path, name, typ.Name())
+		}
+		ptr := reflect.New(ntyp)
+		if err := decodeValue(ptr.Elem(), obj, path); err != nil {
+			return err
+		}
+		val.Set(ptr)
+		return nil
+	case reflect.Struct:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: want an object, got %s", path, jsonKind(v))
+		}
+		if typ == posType {
+			return decodePos(val, obj, path)
+		}
+		fields := make(map[string]int)
+		for _, i := range exportedFields(typ) {
+			fields[typ.Field(i).Name] = i
+		}
+		for key, fv := range obj {
+			i, ok := fields[key]
+			if !ok {
+				switch key {
+				case "Pos", "End", "Type", "AttachedComments":
+					continue
+				}
+				return fmt.Errorf("%s: unknown key %q for %s", path, key, typ.Name())
+			}
+			if err := decodeValue(val.Field(i), fv, path+"."+key); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Slice:
+		if v == nil {
+			return nil
+		}
+		list, ok := v.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: want an array, got %s", path, jsonKind(v))
+		}
+		slice := reflect.MakeSlice(typ, len(list), len(list))
+		for i, ev := range list {
+			if err := decodeValue(slice.Index(i), ev, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		val.Set(slice)
+		return nil
+	case reflect.String:
+		s, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s: want a string, got %s", path, jsonKind(v))
+		}
+		val.SetString(s)
+		return nil
+	case reflect.Bool:
+		b, ok := v.(bool)
+		if !ok {
+			return fmt.Errorf("%s: want a boolean, got %s", path, jsonKind(v))
+		}
+		val.SetBool(b)
+		return nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		num, ok := v.(json.Number)
+		if !ok {
+			return fmt.Errorf("%s: want a number, got %s", path, jsonKind(v))
+		}
+		n, err := strconv.ParseUint(string(num), 10, typ.Bits())
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		val.SetUint(n)
+		return nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		num, ok := v.(json.Number)
+		if !ok {
+			return fmt.Errorf("%s: want a number, got %s", path, jsonKind(v))
+		}
+		n, err := strconv.ParseInt(string(num), 10, typ.Bits())
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		val.SetInt(n)
+		return nil
+	}
+	return fmt.Errorf("%s: cannot decode into %s", path, typ)
+}
+
+func decodePos(val reflect.Value, obj map[string]interface{}, path string) error {
+	var nums [3]uint
+	for i, key := range [...]string{"Offset", "Line", "Col"} {
+		fv, ok := obj[key]
+		if !ok {
+			continue
+		}
+		num, ok := fv.(json.Number)
+		if !ok {
+			return fmt.Errorf("%s.%s: want a number, got %s", path, key, jsonKind(fv))
+		}
+		n, err := strconv.ParseUint(string(num), 10, 0)
+		if err != nil {
+			return fmt.Errorf("%s.%s: %v", path, key, err)
+		}
+		nums[i] = uint(n)
+	}
+	for key := range obj {
+		switch key {
+		case "Offset", "Line", "Col":
+		default:
+			return fmt.Errorf("%s: unknown key %q for Pos", path, key)
+		}
+	}
+	val.Set(reflect.ValueOf(syntax.NewPos(nums[0], nums[1], nums[2])))
+	return nil
+}
+
+// jsonKind describes the kind of a JSON value decoded by encoding/json.
+func jsonKind(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case map[string]interface{}:
+		return "an object"
+	case []interface{}:
+		return "an array"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	default:
+		return "a number"
+	}
+}
@@ -0,0 +1,286 @@
+// Copyright (c) 2017, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+// Package typedjson encodes and decodes shell syntax trees as JSON, keeping
+// the types of the nodes.
+//
+// Each node is a JSON object with a key per exported field, including the
+// positions, which are objects with "Offset", "Line", and "Col" keys. Nodes
+// found in interface fields, such as a Stmt's Cmd, and the root node have a
+// "Type" key with the name of the node's type, like "CallExpr". Nodes also
+// have "Pos" and "End" keys with the results of their methods of the same
+// names.
+//
+// When encoding a file, statements with comments associated to them as per
+// syntax.NewCommentMap also have an "AttachedComments" key listing them.
+//
+// The "Pos", "End", and "AttachedComments" keys are ignored when decoding, as
+// are the "Type" keys of nodes whose type is known from their field.
+package typedjson
+
+import (
+	"bufio"
+	"encoding/json"
+	"go/ast"
+	"io"
+	"reflect"
+	"sort"
+	"strconv"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+// EncodeOptions allows configuring how syntax nodes are encoded.
+type EncodeOptions struct {
+	// Indent, if non-empty, is used to indent the output with one line per
+	// object key and array element, like in json.MarshalIndent.
+	Indent string
+}
+
+// Encode writes a syntax tree as compact JSON, followed by a newline. The
+// output is the same as that of encoding/json with map values, including
+// sorted keys.
+func Encode(w io.Writer, node syntax.Node) error {
+	return EncodeOptions{}.Encode(w, node)
+}
+
+// Encode writes a syntax tree as JSON, followed by a newline. Nodes are written
+// as they are visited, so that no intermediate document is built in memory.
+func (opts EncodeOptions) Encode(w io.Writer, node syntax.Node) error {
+	jw := jsonWriter{
+		w:      bufio.NewWriter(w),
+		indent: opts.Indent,
+		fields: make(map[reflect.Type][]jsonField),
+	}
+	if f, ok := node.(*syntax.File); ok {
+		jw.comments = syntax.NewCommentMap(f)
+	}
+	jw.encode(reflect.ValueOf(&node).Elem(), "")
+	jw.w.WriteByte('\n')
+	if jw.err != nil {
+		return jw.err
+	}
+	return jw.w.Flush()
+}
+
+type jsonWriter struct {
+	w      *bufio.Writer
+	indent string
+	level  int
+	err    error
+
+	// fields caches the sorted list of object keys per struct type.
+	fields map[reflect.Type][]jsonField
+	numBuf []byte
+
+	comments syntax.CommentMap
+}
+
+// jsonField is an object key for a struct. index is the struct field's index,
+// or one of the negative constants below for keys not backed by a field.
+type jsonField struct {
+	name  string
+	index int
+}
+
+const (
+	fieldPos = -1 - iota
+	fieldEnd
+	fieldType
+	fieldAttached
+)
+
+var (
+	nodeType = reflect.TypeOf((*syntax.Node)(nil)).Elem()
+	posType  = reflect.TypeOf(syntax.Pos{})
+	fileType = reflect.TypeOf(syntax.File{})
+	stmtType = reflect.TypeOf(syntax.Stmt{})
+)
+
+// exportedFields returns the indexes of the struct fields which are encoded.
+func exportedFields(typ reflect.Type) []int {
+	var fields []int
+	for i := 0; i < typ.NumField(); i++ {
+		ftyp := typ.Field(i)
+		if !ast.IsExported(ftyp.Name) {
+			continue
+		}
+		if typ == fileType && ftyp.Name == "Src" {
+			continue // the source is the input itself
+		}
+		fields = append(fields, i)
+	}
+	return fields
+}
+
+func (j *jsonWriter) structFields(typ reflect.Type) []jsonField {
+	if fields, ok := j.fields[typ]; ok {
+		return fields
+	}
+	var fields []jsonField
+	for _, i := range exportedFields(typ) {
+		fields = append(fields, jsonField{typ.Field(i).Name, i})
+	}
+	// Pos methods are defined on struct pointer receivers.
+	if reflect.PtrTo(typ).Implements(nodeType) {
+		fields = append(fields, jsonField{"Pos", fieldPos}, jsonField{"End", fieldEnd})
+	}
+	fields = append(fields, jsonField{"Type", fieldType})
+	if typ == stmtType {
+		fields = append(fields, jsonField{"AttachedComments", fieldAttached})
+	}
+	sort.Slice(fields, func(i, k int) bool {
+		return fields[i].name < fields[k].name
+	})
+	j.fields[typ] = fields
+	return fields
+}
+
+func (j *jsonWriter) newline() {
+	if j.indent == "" {
+		return
+	}
+	j.w.WriteByte('\n')
+	for i := 0; i < j.level; i++ {
+		j.w.WriteString(j.indent)
+	}
+}
+
+func (j *jsonWriter) key(i int, name string) {
+	if i > 0 {
+		j.w.WriteByte(',')
+	} else {
+		j.w.WriteByte('{')
+		j.level++
+	}
+	j.newline()
+	j.w.WriteByte('"')
+	j.w.WriteString(name) // never needs escaping
+	j.w.WriteString(`":`)
+	if j.indent != "" {
+		j.w.WriteByte(' ')
+	}
+}
+
+func (j *jsonWriter) endObject(n int) {
+	if n == 0 {
+		j.w.WriteString("{}")
+		return
+	}
+	j.level--
+	j.newline()
+	j.w.WriteByte('}')
+}
+
+func (j *jsonWriter) uint(n uint64) {
+	j.numBuf = strconv.AppendUint(j.numBuf[:0], n, 10)
+	j.w.Write(j.numBuf)
+}
+
+// encode writes a value. typeName is non-empty if the value was found in an
+// interface, in which case a "Type" key is added.
+func (j *jsonWriter) encode(val reflect.Value, typeName string) {
+	switch val.Kind() {
+	case reflect.Ptr:
+		elem := val.Elem()
+		if !elem.IsValid() {
+			j.w.WriteString("null")
+			return
+		}
+		j.encode(elem, typeName)
+	case reflect.Interface:
+		if val.IsNil() {
+			j.w.WriteString("null")
+			return
+		}
+		elem := val.Elem()
+		typ := elem.Type()
+		if typ.Kind() == reflect.Ptr {
+			typ = typ.Elem()
+		}
+		j.encode(elem, typ.Name())
+	case reflect.Struct:
+		if val.Type() == posType {
+			j.pos(val.Interface().(syntax.Pos))
+			return
+		}
+		n := 0
+		for _, field := range j.structFields(val.Type()) {
+			switch field.index {
+			case fieldPos:
+				j.key(n, field.name)
+				j.pos(val.Addr().Interface().(syntax.Node).Pos())
+			case fieldEnd:
+				j.key(n, field.name)
+				j.pos(val.Addr().Interface().(syntax.Node).End())
+			case fieldType:
+				if typeName == "" {
+					continue
+				}
+				j.key(n, field.name)
+				j.value(typeName)
+			case fieldAttached:
+				comments := j.comments[val.Addr().Interface().(*syntax.Stmt)]
+				if len(comments) == 0 {
+					continue
+				}
+				j.key(n, field.name)
+				j.encode(reflect.ValueOf(comments), "")
+			default:
+				j.key(n, field.name)
+				j.encode(val.Field(field.index), "")
+			}
+			n++
+		}
+		j.endObject(n)
+	case reflect.Slice:
+		if val.Len() == 0 {
+			j.w.WriteString("[]")
+			return
+		}
+		j.w.WriteByte('[')
+		j.level++
+		for i := 0; i < val.Len(); i++ {
+			if i > 0 {
+				j.w.WriteByte(',')
+			}
+			j.newline()
+			j.encode(val.Index(i), "")
+		}
+		j.level--
+		j.newline()
+		j.w.WriteByte(']')
+	case reflect.Bool:
+		if val.Bool() {
+			j.w.WriteString("true")
+		} else {
+			j.w.WriteString("false")
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		j.uint(val.Uint())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		j.numBuf = strconv.AppendInt(j.numBuf[:0], val.Int(), 10)
+		j.w.Write(j.numBuf)
+	default:
+		j.value(val.Interface())
+	}
+}
+
+// value writes any other value via encoding/json, such as a string.
+func (j *jsonWriter) value(v interface{}) {
+	bs, err := json.Marshal(v)
+	if err != nil && j.err == nil {
+		j.err = err
+	}
+	j.w.Write(bs)
+}
+
+func (j *jsonWriter) pos(pos syntax.Pos) {
+	j.key(0, "Col")
+	j.uint(uint64(pos.Col()))
+	j.key(1, "Line")
+	j.uint(uint64(pos.Line()))
+	j.key(2, "Offset")
+	j.uint(uint64(pos.Offset()))
+	j.endObject(3)
+}
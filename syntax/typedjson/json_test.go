@@ -0,0 +1,155 @@
+// Copyright (c) 2019, Daniel Martí <mvdan@mvdan.cc>
+// See LICENSE for licensing information
+
+package typedjson
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"mvdan.cc/sh/v3/syntax"
+)
+
+var roundTripTests = []string{
+	"",
+	"foo",
+	"# only a comment",
+	"foo # bar\n\n# baz\nqux",
+	"c=(1 [2]=x)\na=b foo >out 2>&1 <<<\"$in\"",
+	"if a; then b; elif c; then d; else e; fi",
+	"while a; do b; done; until a; do b; done",
+	"for i in 1 2; do :; done; for ((i = 0; i < 3; i++)); do :; done",
+	"case $x in\na | b) foo ;;\n*) bar ;&\nesac",
+	"{ a; b; } && (c) || ! d &",
+	"f() {\n\tlocal x=${y:-z} a=${b/c/d} e=${f:1:2}\n}",
+	"function g { :; }",
+	"[[ -n $a && ($b =~ ^c+$ || ! -f d) ]]",
+	"echo $((1 + 2 * -x)) $(cmd) `old` <(in) >(out) @(a|b) {a,b}",
+	"let i++ 'j = 2'; ((k *= 3))",
+	"declare -a arr=(a b); time -p sleep 1; coproc foo { bar; }",
+	"cat <<EOF\nheredoc $x\nEOF\ncat <<-'EOF'\n\tliteral\n\tEOF",
+	"foo \\\n\tbar 'single' \"double $x\" $'ansi' $\"locale\"",
+}
+
+func parse(t testing.TB, src string) *syntax.File {
+	f, err := syntax.NewParser(syntax.KeepComments(true)).Parse(strings.NewReader(src), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func printNode(t testing.TB, node syntax.Node) string {
+	var buf bytes.Buffer
+	if err := syntax.NewPrinter().Print(&buf, node); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestRoundTrip(t *testing.T) {
+	t.Parallel()
+	canonical, err := ioutil.ReadFile(filepath.Join("..", "canonical.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := append(roundTripTests, string(canonical))
+	for i, src := range tests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			f := parse(t, src)
+			var enc bytes.Buffer
+			if err := (EncodeOptions{Indent: "\t"}).Encode(&enc, f); err != nil {
+				t.Fatal(err)
+			}
+			node, err := Decode(bytes.NewReader(enc.Bytes()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want, got := printNode(t, f), printNode(t, node); got != want {
+				t.Fatalf("printed output differs:\nwant: %q\ngot:  %q", want, got)
+			}
+			var enc2 bytes.Buffer
+			if err := (EncodeOptions{Indent: "\t"}).Encode(&enc2, node); err != nil {
+				t.Fatal(err)
+			}
+			if want, got := enc.String(), enc2.String(); got != want {
+				t.Fatalf("encoded output differs:\nwant: %s\ngot:  %s", want, got)
+			}
+		})
+	}
+}
+
+func TestDecodeNodes(t *testing.T) {
+	t.Parallel()
+	// A tool may write nodes from scratch, without positions.
+	node, err := Decode(strings.NewReader(`{"Stmts": [{"Cmd": {"Type": "CallExpr",
+		"Args": [{"Parts": [{"Type": "Lit", "Value": "foo"}]}]}}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := printNode(t, node), "foo\n"; got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+
+	// Roots other than a file need their type.
+	var enc bytes.Buffer
+	word := parse(t, "foo$bar").Stmts[0].Cmd.(*syntax.CallExpr).Args[0]
+	if err := Encode(&enc, word); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(enc.String(), `{"End":`) || !strings.Contains(enc.String(), `"Type":"Word"}`) {
+		t.Fatalf("unexpected compact encoding: %s", enc.String())
+	}
+	node, err = Decode(&enc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := node.(*syntax.Word); !ok {
+		t.Fatalf("want a *syntax.Word, got %T", node)
+	}
+	if got, want := printNode(t, node), "foo$bar"; got != want {
+		t.Fatalf("want %q, got %q", want, got)
+	}
+}
+
+var decodeErrorTests = []struct {
+	in, want string
+}{
+	{`[]`, `want a JSON object, got an array`},
+	{`{"Stmts": {}}`, `File.Stmts: want an array, got an object`},
+	{`{"Foo": 1}`, `File: unknown key "Foo" for File`},
+	{`{"Stmts": [{"Cmd": {"Value": "x"}}]}`, `File.Stmts[0].Cmd: unknown node type: ""`},
+	{`{"Stmts": [{"Cmd": {"Type": "Lit"}}]}`, `File.Stmts[0].Cmd: Lit is not a valid Command`},
+	{`{"Stmts": [{"Negated": 1}]}`, `File.Stmts[0].Negated: want a boolean, got a number`},
+	{`{"Stmts": [{"Position": {"Line": -1}}]}`, `File.Stmts[0].Position.Line: strconv.ParseUint`},
+	{`{"Stmts": [{"Cmd": {"Type": "BinaryCmd", "Op": 10000000000}}]}`, `File.Stmts[0].Cmd.Op: strconv.ParseUint`},
+}
+
+func TestDecodeErrors(t *testing.T) {
+	t.Parallel()
+	for i, tc := range decodeErrorTests {
+		_, err := Decode(strings.NewReader(tc.in))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%03d: want error containing %q, got %v", i, tc.want, err)
+		}
+	}
+}
+
+func BenchmarkEncode(b *testing.B) {
+	var buf bytes.Buffer
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&buf, "foo_%d() {\n\tif [[ -n $bar ]]; then\n\t\techo \"$((i + %d))\" >out\n\tfi\n}\n", i, i)
+	}
+	prog := parse(b, buf.String())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := (EncodeOptions{Indent: "\t"}).Encode(ioutil.Discard, prog); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
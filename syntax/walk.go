@@ -24,10 +24,37 @@ func walkWords(words []*Word, f func(Node) bool) {
 	}
 }
 
+// UpdateParents records the parent of every node in the file, so that they
+// can be obtained via Parent. Parser.Parse does this when using KeepParents.
+//
+// The records are not updated when the syntax tree is modified, so this method
+// must be called again after any modification which adds or replaces nodes.
+// Simplify does so when given a file with parents recorded.
+func (f *File) UpdateParents() {
+	f.parents = make(map[Node]Node)
+	WalkPath(f, func(node Node, path []Node) bool {
+		// Walk visits copies of comments, so they can't be looked up.
+		if _, ok := node.(*Comment); !ok && len(path) > 0 {
+			f.parents[node] = path[len(path)-1]
+		}
+		return true
+	})
+}
+
+// Parent returns the node which directly contains the given node in the file,
+// such as the *Stmt containing a *CallExpr. It returns nil for the file itself,
+// for comments, for nodes which are not part of the file, and if the parents
+// were not recorded via KeepParents or UpdateParents.
+func (f *File) Parent(node Node) Node {
+	return f.parents[node]
+}
+
 // Walk traverses a syntax tree in depth-first order: It starts by calling
 // f(node); node must not be nil. If f returns true, Walk invokes f
 // recursively for each of the non-nil children of node, followed by
 // f(nil).
+//
+// To replace or delete nodes while traversing a syntax tree, use Apply.
 func Walk(node Node, f func(Node) bool) {
 	if !f(node) {
 		return
@@ -150,6 +177,8 @@ func Walk(node Node, f func(Node) bool) {
 	case *BinaryTest:
 		Walk(x.X, f)
 		Walk(x.Y, f)
+	case *RegexWord:
+		Walk(x.Word, f)
 	case *UnaryArithm:
 		Walk(x.X, f)
 	case *UnaryTest:
@@ -227,6 +256,29 @@ func Walk(node Node, f func(Node) bool) {
 	f(nil)
 }
 
+// WalkPath traverses a syntax tree like Walk, but f is also given the path of
+// ancestors leading to each node, starting with the root node given to
+// WalkPath and ending with the node's parent. For example, this can tell
+// whether a node is within a function declaration or a command substitution.
+// Unlike Walk, f is not called with nil after the children of a node.
+//
+// The path slice is reused as the traversal goes on, so it must be copied to be
+// kept after f returns.
+func WalkPath(node Node, f func(node Node, path []Node) bool) {
+	var path []Node
+	Walk(node, func(node Node) bool {
+		if node == nil {
+			path = path[:len(path)-1]
+			return true
+		}
+		if !f(node, path) {
+			return false
+		}
+		path = append(path, node)
+		return true
+	})
+}
+
 // DebugPrint prints the provided syntax tree, spanning multiple lines and with
 // indentation. Can be useful to investigate the content of a syntax tree.
 func DebugPrint(w io.Writer, node Node) error {
@@ -235,6 +287,8 @@ func DebugPrint(w io.Writer, node Node) error {
 	return p.err
 }
 
+var fileType = reflect.TypeOf(File{})
+
 type debugPrinter struct {
 	out   io.Writer
 	level int
@@ -292,13 +346,24 @@ func (p *debugPrinter) print(x reflect.Value) {
 			return
 		}
 		t := x.Type()
+		var fields []int
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.PkgPath != "" {
+				continue // unexported
+			}
+			if t == fileType && field.Name == "Src" {
+				continue // the source is not part of the tree
+			}
+			fields = append(fields, i)
+		}
 		p.printf("%s {", t)
 		p.level++
 		p.newline()
-		for i := 0; i < t.NumField(); i++ {
+		for j, i := range fields {
 			p.printf("%s: ", t.Field(i).Name)
 			p.print(x.Field(i))
-			if i == x.NumField()-1 {
+			if j == len(fields)-1 {
 				p.level--
 			}
 			p.newline()
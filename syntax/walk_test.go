@@ -45,6 +45,7 @@ func TestWalk(t *testing.T) {
 		"*syntax.BinaryTest":   false,
 		"*syntax.UnaryTest":    false,
 		"*syntax.ParenTest":    false,
+		"*syntax.RegexWord":    false,
 		"*syntax.DeclClause":   false,
 		"*syntax.ArrayExpr":    false,
 		"*syntax.ArrayElem":    false,
@@ -122,3 +123,145 @@ func TestWalkUnexpectedType(t *testing.T) {
 		return true
 	})
 }
+
+func TestParents(t *testing.T) {
+	t.Parallel()
+	parser := NewParser(KeepComments(true), KeepParents(true))
+	for i, c := range fileTests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			f, err := parser.Parse(strings.NewReader(c.Strs[0]), "")
+			if err != nil {
+				// not valid in the default language variant
+				return
+			}
+			if parent := f.Parent(f); parent != nil {
+				t.Fatalf("file has a parent: %T", parent)
+			}
+			Walk(f, func(node Node) bool {
+				switch node.(type) {
+				case nil, *File, *Comment:
+					return true
+				}
+				// each node must lead up to the file
+				for cur := node; cur != f; cur = f.Parent(cur) {
+					if cur == nil {
+						t.Fatalf("%T does not lead up to the file", node)
+					}
+				}
+				return true
+			})
+		})
+	}
+}
+
+func TestParentsEnclosing(t *testing.T) {
+	t.Parallel()
+	in := "foo() {\n\tif true; then\n\t\techo $((((1)) + 2))\n\tfi\n}\nbar"
+	f, err := NewParser(KeepParents(true)).Parse(strings.NewReader(in), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	enclosingFunc := func(node Node) string {
+		for ; node != nil; node = f.Parent(node) {
+			if fd, ok := node.(*FuncDecl); ok {
+				return fd.Name.Value
+			}
+		}
+		return ""
+	}
+	var calls []*CallExpr
+	var arithm *ArithmExp
+	Walk(f, func(node Node) bool {
+		switch x := node.(type) {
+		case *CallExpr:
+			calls = append(calls, x)
+		case *ArithmExp:
+			arithm = x
+		}
+		return true
+	})
+	if got := enclosingFunc(calls[1]); got != "foo" {
+		t.Fatalf("want echo to be within foo, got %q", got)
+	}
+	if got := enclosingFunc(calls[2]); got != "" {
+		t.Fatalf("want bar to be outside any function, got %q", got)
+	}
+	if f.Parent(arithm.X) != arithm {
+		t.Fatalf("wrong parent for %T", arithm.X)
+	}
+	if f.Parent(&Lit{Value: "foo"}) != nil {
+		t.Fatalf("unrelated node has a parent")
+	}
+
+	// Simplify replaces the redundant parentheses, so it must update the
+	// parents too.
+	if !Simplify(f) {
+		t.Fatal("Simplify did not modify the file")
+	}
+	bin := arithm.X.(*BinaryArithm)
+	if f.Parent(bin.X) != bin {
+		t.Fatalf("wrong parent for %T after Simplify", bin.X)
+	}
+
+	f, err = NewParser().Parse(strings.NewReader(in), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent := f.Parent(f.Stmts[0]); parent != nil {
+		t.Fatalf("parents were not kept, but got %T", parent)
+	}
+}
+
+func TestWalkPath(t *testing.T) {
+	t.Parallel()
+	parser := NewParser(KeepComments(true), KeepParents(true))
+	for i, c := range fileTests {
+		t.Run(fmt.Sprintf("%03d", i), func(t *testing.T) {
+			f, err := parser.Parse(strings.NewReader(c.Strs[0]), "")
+			if err != nil {
+				// not valid in the default language variant
+				return
+			}
+			WalkPath(f, func(node Node, path []Node) bool {
+				if _, ok := node.(*Comment); ok {
+					return true
+				}
+				// the path must match the recorded parents
+				cur := node
+				for i := len(path) - 1; i >= 0; i-- {
+					cur = f.Parent(cur)
+					if cur != path[i] {
+						t.Fatalf("%T has %T at %d in its path, want %T", node, path[i], i, cur)
+					}
+				}
+				if cur != f {
+					t.Fatalf("the path of %T does not start with the file", node)
+				}
+				return true
+			})
+		})
+	}
+}
+
+func TestWalkPathSkip(t *testing.T) {
+	t.Parallel()
+	in := "foo() { bar $(baz); }\nqux"
+	f, err := NewParser().Parse(strings.NewReader(in), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	WalkPath(f, func(node Node, path []Node) bool {
+		switch node.(type) {
+		case *CmdSubst:
+			return false
+		case *CallExpr:
+			got = append(got, fmt.Sprintf("%d", len(path)))
+		}
+		return true
+	})
+	// baz is skipped, and qux is directly within the file's statement
+	if want := "[6 2]"; fmt.Sprint(got) != want {
+		t.Fatalf("want path lengths %s, got %v", want, got)
+	}
+}